@@ -0,0 +1,119 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Package batchsig signs and verifies the notification batches gateways send
+// to the notifications bot, so batches injected on the network path between
+// them are rejected.
+//
+// The NotificationBatch message of the pinned comms version has no signature
+// field, so the signature is carried as bytes field SignatureField, which
+// older bots ignore as an unknown field.
+package batchsig
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+	pb "gitlab.com/elixxir/comms/mixmessages"
+	"gitlab.com/elixxir/crypto/hash"
+	"gitlab.com/xx_network/crypto/csprng"
+	"gitlab.com/xx_network/crypto/signature/rsa"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io"
+)
+
+// SignatureField is the field number of the batch signature.
+const SignatureField protowire.Number = 3
+
+// ErrUnsigned is returned when verifying a batch which carries no signature.
+var ErrUnsigned = errors.New("notification batch is not signed")
+
+// Digest returns the hash signed for the batch: the round ID followed by the
+// ephemeral ID, identity fingerprint and message hash of each notification.
+func Digest(batch *pb.NotificationBatch) ([]byte, error) {
+	h, err := hash.NewCMixHash()
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to create hash")
+	}
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], batch.RoundID)
+	h.Write(b[:])
+	for _, n := range batch.Notifications {
+		binary.BigEndian.PutUint64(b[:], uint64(n.EphemeralID))
+		h.Write(b[:])
+		writeField(h, n.IdentityFP)
+		writeField(h, n.MessageHash)
+	}
+	return h.Sum(nil), nil
+}
+
+// writeField writes the length prefixed field to w, so the boundaries between
+// fields are part of the digest.
+func writeField(w io.Writer, field []byte) {
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(len(field)))
+	_, _ = w.Write(l[:])
+	_, _ = w.Write(field)
+}
+
+// Sign signs the batch with the gateway's private key and attaches the
+// signature, replacing any existing one.
+func Sign(batch *pb.NotificationBatch, key *rsa.PrivateKey) error {
+	digest, err := Digest(batch)
+	if err != nil {
+		return err
+	}
+	sig, err := rsa.Sign(csprng.NewSystemRNG(), key, hash.CMixHash, digest, nil)
+	if err != nil {
+		return errors.WithMessage(err, "Failed to sign notification batch")
+	}
+	unknown, _ := stripSignature(batch.ProtoReflect().GetUnknown())
+	unknown = protowire.AppendTag(unknown, SignatureField, protowire.BytesType)
+	unknown = protowire.AppendBytes(unknown, sig)
+	batch.ProtoReflect().SetUnknown(unknown)
+	return nil
+}
+
+// Verify checks the batch's signature against the gateway's public key. It
+// returns ErrUnsigned if the batch carries no signature.
+func Verify(batch *pb.NotificationBatch, key *rsa.PublicKey) error {
+	_, sig := stripSignature(batch.ProtoReflect().GetUnknown())
+	if sig == nil {
+		return ErrUnsigned
+	}
+	digest, err := Digest(batch)
+	if err != nil {
+		return err
+	}
+	err = rsa.Verify(key, hash.CMixHash, digest, sig, nil)
+	if err != nil {
+		return errors.WithMessage(err, "Invalid notification batch signature")
+	}
+	return nil
+}
+
+// stripSignature returns the unknown fields without the signature field, and
+// the signature if one was present.
+func stripSignature(unknown []byte) ([]byte, []byte) {
+	var rest, sig []byte
+	for len(unknown) > 0 {
+		num, typ, n := protowire.ConsumeTag(unknown)
+		if n < 0 {
+			return rest, sig
+		}
+		m := protowire.ConsumeFieldValue(num, typ, unknown[n:])
+		if m < 0 {
+			return rest, sig
+		}
+		if num == SignatureField && typ == protowire.BytesType {
+			sig, _ = protowire.ConsumeBytes(unknown[n:])
+		} else {
+			rest = append(rest, unknown[:n+m]...)
+		}
+		unknown = unknown[n+m:]
+	}
+	return rest, sig
+}
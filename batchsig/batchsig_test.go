@@ -0,0 +1,64 @@
+package batchsig
+
+import (
+	"github.com/pkg/errors"
+	pb "gitlab.com/elixxir/comms/mixmessages"
+	"gitlab.com/xx_network/crypto/csprng"
+	"gitlab.com/xx_network/crypto/signature/rsa"
+	"google.golang.org/protobuf/proto"
+	"testing"
+)
+
+// Tests that a signed batch verifies after a marshal round trip and that
+// unsigned, tampered and wrongly signed batches are rejected.
+func TestSignVerify(t *testing.T) {
+	key, err := rsa.GenerateKey(csprng.NewSystemRNG(), 1024)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %+v", err)
+	}
+	other, err := rsa.GenerateKey(csprng.NewSystemRNG(), 1024)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %+v", err)
+	}
+	batch := &pb.NotificationBatch{
+		RoundID: 42,
+		Notifications: []*pb.NotificationData{
+			{EphemeralID: 5, IdentityFP: []byte("fp"), MessageHash: []byte("hash")},
+		},
+	}
+
+	if err = Verify(batch, key.GetPublic()); !errors.Is(err, ErrUnsigned) {
+		t.Errorf("Expected unsigned batch error, received %+v", err)
+	}
+
+	if err = Sign(batch, key); err != nil {
+		t.Fatalf("Failed to sign batch: %+v", err)
+	}
+	marshalled, err := proto.Marshal(batch)
+	if err != nil {
+		t.Fatalf("Failed to marshal batch: %+v", err)
+	}
+	received := &pb.NotificationBatch{}
+	if err = proto.Unmarshal(marshalled, received); err != nil {
+		t.Fatalf("Failed to unmarshal batch: %+v", err)
+	}
+	if err = Verify(received, key.GetPublic()); err != nil {
+		t.Errorf("Failed to verify signed batch: %+v", err)
+	}
+	if err = Verify(received, other.GetPublic()); err == nil {
+		t.Errorf("Batch should not verify against another gateway's key")
+	}
+
+	received.Notifications[0].EphemeralID = 6
+	if err = Verify(received, key.GetPublic()); err == nil {
+		t.Errorf("Tampered batch should not verify")
+	}
+
+	// Re-signing a modified batch replaces its signature
+	if err = Sign(received, key); err != nil {
+		t.Fatalf("Failed to sign batch: %+v", err)
+	}
+	if err = Verify(received, key.GetPublic()); err != nil {
+		t.Errorf("Failed to verify re-signed batch: %+v", err)
+	}
+}
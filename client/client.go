@@ -0,0 +1,195 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Package client makes the notification bot's client RPCs. It builds and signs
+// the requests with a client's transmission key, so Go services and tests can
+// register with the bot without hand-rolling comms calls.
+package client
+
+import (
+	"github.com/pkg/errors"
+	pb "gitlab.com/elixxir/comms/mixmessages"
+	"gitlab.com/elixxir/crypto/notifications"
+	"gitlab.com/elixxir/crypto/rsa"
+	"gitlab.com/xx_network/comms/connect"
+	"gitlab.com/xx_network/comms/messages"
+	"gitlab.com/xx_network/crypto/csprng"
+	"gitlab.com/xx_network/primitives/id"
+	"gitlab.com/xx_network/primitives/id/ephemeral"
+	"time"
+)
+
+// Comms is the part of the client comms used to reach the notification bot.
+// It is implemented by *client.Comms from gitlab.com/elixxir/comms/client.
+type Comms interface {
+	RegisterToken(host *connect.Host, message *pb.RegisterTokenRequest) (*messages.Ack, error)
+	UnregisterToken(host *connect.Host, message *pb.UnregisterTokenRequest) (*messages.Ack, error)
+	RegisterTrackedID(host *connect.Host, message *pb.RegisterTrackedIdRequest) (*messages.Ack, error)
+	UnregisterTrackedID(host *connect.Host, message *pb.UnregisterTrackedIdRequest) (*messages.Ack, error)
+}
+
+// Identity is a client's transmission key and the permissioning server's
+// signature registering it.
+type Identity struct {
+	Key                         rsa.PrivateKey
+	RegistrationTimestamp       int64
+	TransmissionRsaRegistrarSig []byte
+}
+
+// TransmissionRsaPem returns the PEM encoded public transmission key.
+func (i Identity) TransmissionRsaPem() []byte {
+	return i.Key.Public().MarshalPem()
+}
+
+// RegisterTokenRequest returns a request to register the token for the app,
+// signed at the passed in time.
+func (i Identity) RegisterTokenRequest(token, app string, at time.Time) (*pb.RegisterTokenRequest, error) {
+	sig, err := notifications.SignToken(i.Key, token, app, at, notifications.RegisterTokenTag, csprng.NewSystemRNG())
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to sign token")
+	}
+	return &pb.RegisterTokenRequest{
+		App:                         app,
+		Token:                       token,
+		TransmissionRsaPem:          i.TransmissionRsaPem(),
+		RegistrationTimestamp:       i.RegistrationTimestamp,
+		TransmissionRsaRegistrarSig: i.TransmissionRsaRegistrarSig,
+		RequestTimestamp:            at.UnixNano(),
+		TokenSignature:              sig,
+	}, nil
+}
+
+// UnregisterTokenRequest returns a request to unregister the token of the
+// app, signed at the passed in time.
+func (i Identity) UnregisterTokenRequest(token, app string, at time.Time) (*pb.UnregisterTokenRequest, error) {
+	sig, err := notifications.SignToken(i.Key, token, app, at, notifications.UnregisterTokenTag, csprng.NewSystemRNG())
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to sign token")
+	}
+	return &pb.UnregisterTokenRequest{
+		App:                app,
+		Token:              token,
+		TransmissionRsaPem: i.TransmissionRsaPem(),
+		RequestTimestamp:   at.UnixNano(),
+		TokenSignature:     sig,
+	}, nil
+}
+
+// RegisterTrackedIDRequest returns a request to track the passed in
+// intermediary IDs, signed at the passed in time.
+func (i Identity) RegisterTrackedIDRequest(iids [][]byte, at time.Time) (*pb.RegisterTrackedIdRequest, error) {
+	req, err := i.trackedIDRequest(iids, at, notifications.RegisterTrackedIDTag)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.RegisterTrackedIdRequest{
+		Request:                     req,
+		RegistrationTimestamp:       i.RegistrationTimestamp,
+		TransmissionRsaRegistrarSig: i.TransmissionRsaRegistrarSig,
+	}, nil
+}
+
+// UnregisterTrackedIDRequest returns a request to stop tracking the passed in
+// intermediary IDs, signed at the passed in time.
+func (i Identity) UnregisterTrackedIDRequest(iids [][]byte, at time.Time) (*pb.UnregisterTrackedIdRequest, error) {
+	req, err := i.trackedIDRequest(iids, at, notifications.UnregisterTrackedIDTag)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.UnregisterTrackedIdRequest{Request: req}, nil
+}
+
+// trackedIDRequest signs the intermediary IDs with the passed in tag.
+func (i Identity) trackedIDRequest(iids [][]byte, at time.Time, tag notifications.NotificationTag) (*pb.TrackedIntermediaryIdRequest, error) {
+	sig, err := notifications.SignIdentity(i.Key, iids, at, tag, csprng.NewSystemRNG())
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to sign tracked IDs")
+	}
+	return &pb.TrackedIntermediaryIdRequest{
+		TrackedIntermediaryID: iids,
+		TransmissionRsaPem:    i.TransmissionRsaPem(),
+		RequestTimestamp:      at.UnixNano(),
+		Signature:             sig,
+	}, nil
+}
+
+// IntermediaryIDs returns the intermediary IDs the bot tracks for the passed
+// in reception IDs.
+func IntermediaryIDs(ids ...*id.ID) ([][]byte, error) {
+	iids := make([][]byte, 0, len(ids))
+	for _, rid := range ids {
+		iid, err := ephemeral.GetIntermediaryId(rid)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "Failed to get intermediary ID of %s", rid)
+		}
+		iids = append(iids, iid)
+	}
+	return iids, nil
+}
+
+// Client makes the notification bot's RPCs for a single identity.
+type Client struct {
+	comms    Comms
+	host     *connect.Host
+	identity Identity
+}
+
+// New returns a Client reaching the bot at host through comms.
+func New(comms Comms, host *connect.Host, identity Identity) *Client {
+	return &Client{comms: comms, host: host, identity: identity}
+}
+
+// RegisterToken registers the token for the app. It succeeds if the token is
+// already registered.
+func (c *Client) RegisterToken(token, app string) error {
+	req, err := c.identity.RegisterTokenRequest(token, app, time.Now())
+	if err != nil {
+		return err
+	}
+	_, err = c.comms.RegisterToken(c.host, req)
+	return errors.WithMessage(err, "Failed to register token")
+}
+
+// UnregisterToken unregisters the token of the app. It succeeds if the token
+// is not registered.
+func (c *Client) UnregisterToken(token, app string) error {
+	req, err := c.identity.UnregisterTokenRequest(token, app, time.Now())
+	if err != nil {
+		return err
+	}
+	_, err = c.comms.UnregisterToken(c.host, req)
+	return errors.WithMessage(err, "Failed to unregister token")
+}
+
+// RegisterTrackedID has the bot push the identity's tokens for messages to
+// the passed in reception IDs. A token must be registered first.
+func (c *Client) RegisterTrackedID(ids ...*id.ID) error {
+	iids, err := IntermediaryIDs(ids...)
+	if err != nil {
+		return err
+	}
+	req, err := c.identity.RegisterTrackedIDRequest(iids, time.Now())
+	if err != nil {
+		return err
+	}
+	_, err = c.comms.RegisterTrackedID(c.host, req)
+	return errors.WithMessage(err, "Failed to register tracked IDs")
+}
+
+// UnregisterTrackedID stops the bot tracking the passed in reception IDs.
+func (c *Client) UnregisterTrackedID(ids ...*id.ID) error {
+	iids, err := IntermediaryIDs(ids...)
+	if err != nil {
+		return err
+	}
+	req, err := c.identity.UnregisterTrackedIDRequest(iids, time.Now())
+	if err != nil {
+		return err
+	}
+	_, err = c.comms.UnregisterTrackedID(c.host, req)
+	return errors.WithMessage(err, "Failed to unregister tracked IDs")
+}
@@ -0,0 +1,99 @@
+package client
+
+import (
+	pb "gitlab.com/elixxir/comms/mixmessages"
+	"gitlab.com/elixxir/crypto/notifications"
+	"gitlab.com/elixxir/crypto/rsa"
+	"gitlab.com/xx_network/comms/connect"
+	"gitlab.com/xx_network/comms/messages"
+	"gitlab.com/xx_network/crypto/csprng"
+	"gitlab.com/xx_network/primitives/id"
+	"testing"
+	"time"
+)
+
+// recordingComms records the requests sent to the bot.
+type recordingComms struct {
+	registerToken     *pb.RegisterTokenRequest
+	unregisterToken   *pb.UnregisterTokenRequest
+	registerTracked   *pb.RegisterTrackedIdRequest
+	unregisterTracked *pb.UnregisterTrackedIdRequest
+}
+
+func (r *recordingComms) RegisterToken(_ *connect.Host, m *pb.RegisterTokenRequest) (*messages.Ack, error) {
+	r.registerToken = m
+	return &messages.Ack{}, nil
+}
+
+func (r *recordingComms) UnregisterToken(_ *connect.Host, m *pb.UnregisterTokenRequest) (*messages.Ack, error) {
+	r.unregisterToken = m
+	return &messages.Ack{}, nil
+}
+
+func (r *recordingComms) RegisterTrackedID(_ *connect.Host, m *pb.RegisterTrackedIdRequest) (*messages.Ack, error) {
+	r.registerTracked = m
+	return &messages.Ack{}, nil
+}
+
+func (r *recordingComms) UnregisterTrackedID(_ *connect.Host, m *pb.UnregisterTrackedIdRequest) (*messages.Ack, error) {
+	r.unregisterTracked = m
+	return &messages.Ack{}, nil
+}
+
+// Tests that the client's requests carry the identity's registration and
+// signatures the bot accepts.
+func TestClient(t *testing.T) {
+	key, err := rsa.GetScheme().Generate(csprng.NewSystemRNG(), 1024)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %+v", err)
+	}
+	identity := Identity{Key: key, RegistrationTimestamp: 42, TransmissionRsaRegistrarSig: []byte("registrar")}
+	comms := &recordingComms{}
+	c := New(comms, nil, identity)
+	rid := id.NewIdFromString("user", id.User, t)
+
+	if err = c.RegisterToken("token", "app"); err != nil {
+		t.Fatalf("Failed to register token: %+v", err)
+	}
+	if err = c.UnregisterToken("token", "app"); err != nil {
+		t.Fatalf("Failed to unregister token: %+v", err)
+	}
+	if err = c.RegisterTrackedID(rid); err != nil {
+		t.Fatalf("Failed to register tracked ID: %+v", err)
+	}
+	if err = c.UnregisterTrackedID(rid); err != nil {
+		t.Fatalf("Failed to unregister tracked ID: %+v", err)
+	}
+	iids, err := IntermediaryIDs(rid)
+	if err != nil {
+		t.Fatalf("Failed to get intermediary ID: %+v", err)
+	}
+
+	reg := comms.registerToken
+	if reg.RegistrationTimestamp != 42 || string(reg.TransmissionRsaRegistrarSig) != "registrar" {
+		t.Errorf("Request should carry the identity's registration, got %+v", reg)
+	}
+	err = notifications.VerifyToken(key.Public(), "token", "app", time.Unix(0, reg.RequestTimestamp),
+		notifications.RegisterTokenTag, reg.TokenSignature)
+	if err != nil {
+		t.Errorf("Invalid register token signature: %+v", err)
+	}
+	unreg := comms.unregisterToken
+	err = notifications.VerifyToken(key.Public(), "token", "app", time.Unix(0, unreg.RequestTimestamp),
+		notifications.UnregisterTokenTag, unreg.TokenSignature)
+	if err != nil {
+		t.Errorf("Invalid unregister token signature: %+v", err)
+	}
+	tracked := comms.registerTracked.Request
+	err = notifications.VerifyIdentity(key.Public(), iids, time.Unix(0, tracked.RequestTimestamp),
+		notifications.RegisterTrackedIDTag, tracked.Signature)
+	if err != nil {
+		t.Errorf("Invalid register tracked ID signature: %+v", err)
+	}
+	untracked := comms.unregisterTracked.Request
+	err = notifications.VerifyIdentity(key.Public(), iids, time.Unix(0, untracked.RequestTimestamp),
+		notifications.UnregisterTrackedIDTag, untracked.Signature)
+	if err != nil {
+		t.Errorf("Invalid unregister tracked ID signature: %+v", err)
+	}
+}
@@ -0,0 +1,73 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Package clock provides the time source used by the time-based subsystems of
+// the notifications bot, so that tests can control it.
+
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a source of the current time.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// Sleep pauses until d has passed on the clock.
+	Sleep(d time.Duration)
+}
+
+// Real is a Clock backed by the system time.
+type Real struct{}
+
+// Now returns the current system time.
+func (Real) Now() time.Time { return time.Now() }
+
+// Sleep pauses the calling goroutine for d.
+func (Real) Sleep(d time.Duration) { time.Sleep(d) }
+
+// Fake is a Clock which only moves when told to. Sleeping on it advances it
+// by the slept duration immediately.
+type Fake struct {
+	now time.Time
+	mux sync.Mutex
+}
+
+// NewFake returns a Fake clock set to now.
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+// Now returns the time the clock is set to.
+func (f *Fake) Now() time.Time {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.now
+}
+
+// Sleep advances the clock by d without blocking.
+func (f *Fake) Sleep(d time.Duration) {
+	if d > 0 {
+		f.Advance(d)
+	}
+}
+
+// Advance moves the clock forward by d.
+func (f *Fake) Advance(d time.Duration) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.now = f.now.Add(d)
+}
+
+// Set moves the clock to t.
+func (f *Fake) Set(t time.Time) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.now = t
+}
@@ -0,0 +1,28 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+// Tests that a Fake clock only moves when advanced or slept on.
+func TestFake(t *testing.T) {
+	start := time.Unix(1000, 0)
+	f := NewFake(start)
+	if !f.Now().Equal(start) {
+		t.Errorf("Unexpected start time %s", f.Now())
+	}
+
+	f.Advance(time.Minute)
+	f.Sleep(time.Second)
+	f.Sleep(-time.Hour)
+	expected := start.Add(time.Minute + time.Second)
+	if !f.Now().Equal(expected) {
+		t.Errorf("Expected %s, got %s", expected, f.Now())
+	}
+
+	f.Set(start)
+	if !f.Now().Equal(start) {
+		t.Errorf("Clock was not set back to %s", start)
+	}
+}
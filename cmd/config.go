@@ -0,0 +1,478 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Handles validation of the config file, so misconfigurations are caught
+// before a deploy rather than when the bot starts
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/elixxir/notifications-bot/notifications"
+	"gitlab.com/elixxir/notifications-bot/proxy"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gitlab.com/xx_network/primitives/utils"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the config file options which are validated. Durations are
+// parsed when the config is loaded, so malformed durations are reported by
+// loadConfig.
+type Config struct {
+	Port                  int
+	ListenAddress         string
+	CertPath              string
+	KeyPath               string
+	PermissioningCertPath string
+	PermissioningAddress  string
+	AddressFamily         string
+	CommsID               string
+	CommsRole             string
+	HappyEyeballsDelay    time.Duration
+
+	DBAddress            string
+	DBReadReplicas       []string
+	DBSlowQueryThreshold time.Duration
+	IdentityKeyPath      string
+	DBRetry              struct {
+		Attempts  int
+		BaseDelay time.Duration
+		MaxDelay  time.Duration
+	}
+	EphemeralCreation struct {
+		Workers           int
+		InsertBatch       int
+		ReconcileInterval time.Duration
+	}
+	TokenEncryption struct {
+		LookupKeyPath string
+		Keys          map[string]string
+	}
+	TokenPolicy string
+
+	FirebaseCredentialsPath      string
+	HavenFirebaseCredentialsPath string
+	ApnsKeyPath                  string
+	HavenApnsKeyPath             string
+	HttpsCert                    string
+	HttpsKey                     string
+	TranslationsPath             string
+
+	AdminAddress       string
+	MetricsAddress     string
+	AttestationAddress string
+	ReceiptTTL         time.Duration
+
+	GatewayAllowedOrigins []string
+
+	AlignSendsToRounds   bool
+	AdaptiveSendInterval bool
+
+	NotificationRate         int
+	NotificationsPerBatch    int
+	MaxNotificationPayload   int
+	MaxSendAttempts          int
+	MaxPushesPerToken        int
+	MaxBufferedNotifications int
+	PushHistorySize          int
+	TestPushInterval         time.Duration
+	GatewayPollHistory       int
+
+	RoundSettleDelay      time.Duration
+	MinSendInterval       time.Duration
+	DeliveryLogRetention  time.Duration
+	DeletedTokenRetention time.Duration
+	PushTTL               time.Duration
+	LookupTimeout         time.Duration
+	SendTimeout           time.Duration
+	CanaryInterval        time.Duration
+	GatewayStaleAfter     time.Duration
+	BackpressureDelay     time.Duration
+	MaxNotificationAge    time.Duration
+	StatsInterval         time.Duration
+	AnalyticsInterval     time.Duration
+	SelfCheckTimeout      time.Duration
+	FeatureFlagRefresh    time.Duration
+
+	Digest struct {
+		Interval time.Duration
+	}
+
+	Conversations map[string]notifications.ConversationParams
+	PushQuotas    map[string]notifications.PushQuota
+
+	Backfill struct {
+		MaxCatchUp time.Duration
+		Timeout    time.Duration
+	}
+
+	PermissioningKeys []struct {
+		CertPath string
+		Until    string
+	}
+
+	RegistrarVerifier struct {
+		CheckInterval time.Duration
+	}
+
+	RegistrationBans struct {
+		Threshold   int
+		Window      time.Duration
+		Duration    time.Duration
+		MaxDuration time.Duration
+	}
+
+	AsyncRegistration struct {
+		QueueSize int
+		Workers   int
+		StatusTTL time.Duration
+	}
+
+	KeyRotation struct {
+		PreviousCertPath string
+		PreviousKeyPath  string
+		GraceUntil       string
+	}
+
+	Degraded struct {
+		MaxQueued      int
+		FlushInterval  time.Duration
+		LookupCacheTTL time.Duration
+	}
+
+	Failover struct {
+		Heartbeat    time.Duration
+		LeaseTimeout time.Duration
+	}
+
+	GRPC struct {
+		KeepaliveTime          time.Duration
+		KeepaliveTimeout       time.Duration
+		MinClientKeepalive     time.Duration
+		MaxConnectionIdle      time.Duration
+		MaxConnectionAge       time.Duration
+		MaxConnectionAgeGrace  time.Duration
+		ClientKeepaliveTime    time.Duration
+		ClientKeepaliveTimeout time.Duration
+	}
+
+	Proxy struct {
+		URL   string
+		Rules []proxy.Rule
+		Comms string
+	}
+}
+
+// loadConfig decodes the config read by viper, with defaults applied.
+func loadConfig() (Config, error) {
+	var c Config
+	err := viper.Unmarshal(&c)
+	return c, errors.WithMessage(err, "Failed to parse config")
+}
+
+// validateConfig loads and validates the config, returning every problem
+// found.
+func validateConfig() error {
+	c, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	return c.Validate()
+}
+
+// configErrors collects the problems found in a config.
+type configErrors []string
+
+func (e *configErrors) addf(format string, a ...interface{}) {
+	*e = append(*e, fmt.Sprintf(format, a...))
+}
+
+// required records a problem if the option is unset.
+func (e *configErrors) required(key, value string) {
+	if value == "" {
+		e.addf("%s is required", key)
+	}
+}
+
+// port records a problem if the port is outside the valid range.
+func (e *configErrors) port(key string, port int) {
+	if port < 1 || port > 65535 {
+		e.addf("%s must be between 1 and 65535, got %d", key, port)
+	}
+}
+
+// address records a problem if a set option is not a valid host:port.
+func (e *configErrors) address(key, value string) {
+	if value == "" {
+		return
+	}
+	_, port, err := net.SplitHostPort(value)
+	if err != nil {
+		e.addf("%s must be a host:port, got %q: %v", key, value, err)
+		return
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		e.addf("%s has an invalid port %q", key, port)
+		return
+	}
+	e.port(key+" port", p)
+}
+
+// path records a problem if a set option does not name an existing file.
+func (e *configErrors) path(key, value string) {
+	if value == "" {
+		return
+	}
+	expanded, err := utils.ExpandPath(value)
+	if err != nil {
+		e.addf("%s could not be expanded: %v", key, err)
+		return
+	}
+	if _, err = os.Stat(expanded); err != nil {
+		e.addf("%s does not exist: %v", key, err)
+	}
+}
+
+// pair records a problem if only one of two options which must be set
+// together is set.
+func (e *configErrors) pair(key1, value1, key2, value2 string) {
+	if (value1 == "") != (value2 == "") {
+		e.addf("%s and %s must be set together", key1, key2)
+	}
+}
+
+// nonNegative records a problem if the option is negative.
+func (e *configErrors) nonNegative(key string, value int64) {
+	if value < 0 {
+		e.addf("%s may not be negative, got %d", key, value)
+	}
+}
+
+// Validate returns an error listing every problem with the config.
+func (c Config) Validate() error {
+	var e configErrors
+
+	e.port("port", c.Port)
+	e.required("permissioningCertPath", c.PermissioningCertPath)
+	e.required("permissioningAddress", c.PermissioningAddress)
+	e.address("permissioningAddress", c.PermissioningAddress)
+	if err := notifications.AddressFamily(c.AddressFamily).Validate(); err != nil {
+		e.addf("addressFamily: %v", err)
+	}
+	if _, err := notifications.ParseCommsID(c.CommsID, c.CommsRole); err != nil {
+		e.addf("commsID: %v", err)
+	}
+	if c.ListenAddress != "" && net.ParseIP(c.ListenAddress) == nil {
+		e.addf("listenAddress must be an IP address, got %q", c.ListenAddress)
+	}
+
+	if c.AlignSendsToRounds && c.AdaptiveSendInterval {
+		e.addf("adaptiveSendInterval requires alignSendsToRounds to be false")
+	}
+
+	e.address("dbAddress", c.DBAddress)
+	if err := storage.TokenPolicy(c.TokenPolicy).Validate(); err != nil {
+		e.addf("tokenPolicy: %v", err)
+	}
+	// Postgres allows 65535 parameters per statement, four per ephemeral
+	if c.EphemeralCreation.InsertBatch > 10000 {
+		e.addf("ephemeralCreation.insertBatch must be at most 10000, got %d", c.EphemeralCreation.InsertBatch)
+	}
+	for i, replica := range c.DBReadReplicas {
+		e.address(fmt.Sprintf("dbReadReplicas[%d]", i), replica)
+	}
+	e.address("adminAddress", c.AdminAddress)
+	e.address("metricsAddress", c.MetricsAddress)
+	e.address("attestationAddress", c.AttestationAddress)
+
+	if _, err := proxy.New(proxy.Params{URL: c.Proxy.URL, Rules: c.Proxy.Rules}); err != nil {
+		e.addf("proxy: %v", err)
+	}
+	if _, err := proxy.ParseCommsURL(c.Proxy.Comms); err != nil {
+		e.addf("proxy.comms: %v", err)
+	}
+
+	for conversation := range c.Conversations {
+		if conversation == "" || !constants.Conversation(conversation).Valid() {
+			e.addf("conversations has unknown conversation %q, expected dm, group or channel", conversation)
+		}
+	}
+
+	for app, quota := range c.PushQuotas {
+		e.nonNegative(fmt.Sprintf("pushQuotas.%s.daily", app), int64(quota.Daily))
+		if err := quota.Overflow.Validate(); err != nil {
+			e.addf("pushQuotas.%s.overflow: %v", app, err)
+		} else if quota.Overflow == notifications.OverflowDigest && c.Digest.Interval <= 0 {
+			e.addf("pushQuotas.%s.overflow digest requires digest.interval to be set", app)
+		}
+	}
+
+	e.pair("certPath", c.CertPath, "keyPath", c.KeyPath)
+	e.pair("httpsCert", c.HttpsCert, "httpsKey", c.HttpsKey)
+	for i, k := range c.PermissioningKeys {
+		e.required(fmt.Sprintf("permissioningKeys[%d].certPath", i), k.CertPath)
+		e.path(fmt.Sprintf("permissioningKeys[%d].certPath", i), k.CertPath)
+		if _, err := time.Parse(time.RFC3339, k.Until); k.Until != "" && err != nil {
+			e.addf("permissioningKeys[%d].until must be an RFC 3339 time, got %q", i, k.Until)
+		}
+	}
+	e.pair("keyRotation.previousCertPath", c.KeyRotation.PreviousCertPath,
+		"keyRotation.previousKeyPath", c.KeyRotation.PreviousKeyPath)
+	if c.KeyRotation.PreviousKeyPath != "" {
+		if _, err := time.Parse(time.RFC3339, c.KeyRotation.GraceUntil); err != nil {
+			e.addf("keyRotation.graceUntil must be an RFC 3339 time, got %q", c.KeyRotation.GraceUntil)
+		}
+	}
+	for key, value := range map[string]string{
+		"certPath":                      c.CertPath,
+		"keyPath":                       c.KeyPath,
+		"keyRotation.previousCertPath":  c.KeyRotation.PreviousCertPath,
+		"keyRotation.previousKeyPath":   c.KeyRotation.PreviousKeyPath,
+		"permissioningCertPath":         c.PermissioningCertPath,
+		"identityKeyPath":               c.IdentityKeyPath,
+		"tokenEncryption.lookupKeyPath": c.TokenEncryption.LookupKeyPath,
+		"firebaseCredentialsPath":       c.FirebaseCredentialsPath,
+		"havenFirebaseCredentialsPath":  c.HavenFirebaseCredentialsPath,
+		"apnsKeyPath":                   c.ApnsKeyPath,
+		"havenApnsKeyPath":              c.HavenApnsKeyPath,
+		"httpsCert":                     c.HttpsCert,
+		"httpsKey":                      c.HttpsKey,
+		"translationsPath":              c.TranslationsPath,
+	} {
+		e.path(key, value)
+	}
+	for keyID, keyPath := range c.TokenEncryption.Keys {
+		if parsed, err := strconv.ParseUint(keyID, 10, 8); err != nil {
+			e.addf("tokenEncryption.keys ID %q must be between 0 and 255", keyID)
+		} else {
+			e.path(fmt.Sprintf("tokenEncryption.keys[%d]", parsed), keyPath)
+		}
+	}
+	if len(c.TokenEncryption.Keys) > 0 && c.TokenEncryption.LookupKeyPath == "" {
+		e.addf("tokenEncryption.keys requires tokenEncryption.lookupKeyPath")
+	}
+
+	for key, value := range map[string]int{
+		"notificationRate":              c.NotificationRate,
+		"notificationsPerBatch":         c.NotificationsPerBatch,
+		"maxNotificationPayload":        c.MaxNotificationPayload,
+		"maxSendAttempts":               c.MaxSendAttempts,
+		"maxPushesPerToken":             c.MaxPushesPerToken,
+		"maxBufferedNotifications":      c.MaxBufferedNotifications,
+		"dbRetry.attempts":              c.DBRetry.Attempts,
+		"ephemeralCreation.workers":     c.EphemeralCreation.Workers,
+		"ephemeralCreation.insertBatch": c.EphemeralCreation.InsertBatch,
+		"degraded.maxQueued":            c.Degraded.MaxQueued,
+		"pushHistorySize":               c.PushHistorySize,
+		"gatewayPollHistory":            c.GatewayPollHistory,
+		"registrationBans.threshold":    c.RegistrationBans.Threshold,
+		"asyncRegistration.queueSize":   c.AsyncRegistration.QueueSize,
+		"asyncRegistration.workers":     c.AsyncRegistration.Workers,
+	} {
+		e.nonNegative(key, int64(value))
+	}
+	for key, value := range map[string]time.Duration{
+		"happyEyeballsDelay":                  c.HappyEyeballsDelay,
+		"roundSettleDelay":                    c.RoundSettleDelay,
+		"minSendInterval":                     c.MinSendInterval,
+		"deliveryLogRetention":                c.DeliveryLogRetention,
+		"deletedTokenRetention":               c.DeletedTokenRetention,
+		"pushTTL":                             c.PushTTL,
+		"lookupTimeout":                       c.LookupTimeout,
+		"sendTimeout":                         c.SendTimeout,
+		"canaryInterval":                      c.CanaryInterval,
+		"gatewayStaleAfter":                   c.GatewayStaleAfter,
+		"backpressureDelay":                   c.BackpressureDelay,
+		"maxNotificationAge":                  c.MaxNotificationAge,
+		"dbSlowQueryThreshold":                c.DBSlowQueryThreshold,
+		"dbRetry.baseDelay":                   c.DBRetry.BaseDelay,
+		"dbRetry.maxDelay":                    c.DBRetry.MaxDelay,
+		"statsInterval":                       c.StatsInterval,
+		"analyticsInterval":                   c.AnalyticsInterval,
+		"selfCheckTimeout":                    c.SelfCheckTimeout,
+		"receiptTTL":                          c.ReceiptTTL,
+		"testPushInterval":                    c.TestPushInterval,
+		"digest.interval":                     c.Digest.Interval,
+		"backfill.maxCatchUp":                 c.Backfill.MaxCatchUp,
+		"backfill.timeout":                    c.Backfill.Timeout,
+		"degraded.flushInterval":              c.Degraded.FlushInterval,
+		"degraded.lookupCacheTTL":             c.Degraded.LookupCacheTTL,
+		"failover.heartbeat":                  c.Failover.Heartbeat,
+		"failover.leaseTimeout":               c.Failover.LeaseTimeout,
+		"registrarVerifier.checkInterval":     c.RegistrarVerifier.CheckInterval,
+		"ephemeralCreation.reconcileInterval": c.EphemeralCreation.ReconcileInterval,
+		"registrationBans.window":             c.RegistrationBans.Window,
+		"registrationBans.duration":           c.RegistrationBans.Duration,
+		"registrationBans.maxDuration":        c.RegistrationBans.MaxDuration,
+		"asyncRegistration.statusTTL":         c.AsyncRegistration.StatusTTL,
+		"featureFlagRefresh":                  c.FeatureFlagRefresh,
+		"grpc.keepaliveTime":                  c.GRPC.KeepaliveTime,
+		"grpc.keepaliveTimeout":               c.GRPC.KeepaliveTimeout,
+		"grpc.minClientKeepalive":             c.GRPC.MinClientKeepalive,
+		"grpc.maxConnectionIdle":              c.GRPC.MaxConnectionIdle,
+		"grpc.maxConnectionAge":               c.GRPC.MaxConnectionAge,
+		"grpc.maxConnectionAgeGrace":          c.GRPC.MaxConnectionAgeGrace,
+		"grpc.clientKeepaliveTime":            c.GRPC.ClientKeepaliveTime,
+		"grpc.clientKeepaliveTimeout":         c.GRPC.ClientKeepaliveTimeout,
+	} {
+		if value < 0 {
+			e.addf("%s may not be negative, got %s", key, value)
+		}
+	}
+
+	if len(e) == 0 {
+		return nil
+	}
+	// Sorted so the report is stable between runs
+	sort.Strings(e)
+	return errors.New(strings.Join(e, "\n"))
+}
+
+func init() {
+	configValidateCmd.Flags().StringVarP(&cfgFile, "config", "c",
+		"", "Sets a custom config file path")
+	configCmd.AddCommand(configValidateCmd)
+	rootCmd.AddCommand(configCmd)
+}
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Works with the config file",
+	Args:  cobra.NoArgs,
+}
+
+var configValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Checks the config file for misconfigurations",
+	Long: `Checks that required options are set, ports are in range, addresses are
+host:port pairs, files exist and durations parse, listing every problem found.
+Exits with a non-zero status if the config is invalid.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		initConfig()
+		if !validConfig {
+			return errors.Errorf("Failed to read config file %s", cfgFile)
+		}
+		setDefaults()
+		if err := validateConfig(); err != nil {
+			cmd.SilenceUsage = true
+			return errors.Errorf("Config file %s is invalid:\n%v", cfgFile, err)
+		}
+		fmt.Printf("Config file %s is valid\n", cfgFile)
+		return nil
+	},
+}
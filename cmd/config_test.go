@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tests that every problem with a config is reported, and that a valid config
+// passes.
+func TestConfig_Validate(t *testing.T) {
+	c := Config{
+		Port:                  11420,
+		PermissioningCertPath: "config.go",
+		PermissioningAddress:  "permissioning.xx.network:11420",
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Valid config rejected: %+v", err)
+	}
+
+	c.Port = 70000
+	c.PermissioningAddress = "permissioning.xx.network"
+	c.CertPath = "missing.crt"
+	c.DBAddress = "localhost:0"
+	c.PushTTL = -time.Second
+	c.AlignSendsToRounds, c.AdaptiveSendInterval = true, true
+	err := c.Validate()
+	if err == nil {
+		t.Fatalf("Invalid config accepted")
+	}
+	for _, expected := range []string{
+		"port must be between 1 and 65535",
+		"permissioningAddress must be a host:port",
+		"certPath and keyPath must be set together",
+		"certPath does not exist",
+		"dbAddress port must be between 1 and 65535",
+		"pushTTL may not be negative",
+		"adaptiveSendInterval requires alignSendsToRounds to be false",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected problem %q in:\n%v", expected, err)
+		}
+	}
+}
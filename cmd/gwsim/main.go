@@ -0,0 +1,144 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// gwsim simulates the gateway side of the notification comms for integration
+// tests and local development. It pushes the notification batches described
+// by a script to a notifications bot, so a full cMix network is not needed.
+//
+// The bot only accepts batches from gateways in its NDF when
+// enforceGatewayAuth is set, so it must be disabled for the simulator.
+
+package main
+
+import (
+	crand "crypto/rand"
+	"encoding/base64"
+	"github.com/spf13/cobra"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/comms/gateway"
+	"gitlab.com/xx_network/comms/connect"
+	"gitlab.com/xx_network/comms/gossip"
+	"gitlab.com/xx_network/primitives/id"
+	"gitlab.com/xx_network/primitives/utils"
+	"math/rand"
+	"os"
+	"time"
+)
+
+var (
+	scriptPath, botAddress, botCertPath string
+	botID                               string
+	certPath, keyPath, listenAddress    string
+	seed                                int64
+)
+
+var rootCmd = &cobra.Command{
+	Use:   "gwsim",
+	Short: "Simulates a gateway pushing notification batches to a notifications bot",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		jww.SetStdoutThreshold(jww.LevelInfo)
+
+		s, err := loadScript(scriptPath)
+		if err != nil {
+			jww.FATAL.Panicf("%+v", err)
+		}
+
+		var botCert, cert, key []byte
+		if botCertPath != "" {
+			if botCert, err = utils.ReadFile(botCertPath); err != nil {
+				jww.FATAL.Panicf("Failed to read notifications bot certificate: %+v", err)
+			}
+		}
+		if certPath != "" && keyPath != "" {
+			if cert, err = utils.ReadFile(certPath); err != nil {
+				jww.FATAL.Panicf("Failed to read certificate: %+v", err)
+			}
+			if key, err = utils.ReadFile(keyPath); err != nil {
+				jww.FATAL.Panicf("Failed to read key: %+v", err)
+			}
+		}
+		if botCert == nil {
+			connect.TestingOnlyDisableTLS = true
+		}
+
+		gwID, err := id.NewRandomID(crand.Reader, id.Gateway)
+		if err != nil {
+			jww.FATAL.Panicf("Failed to generate gateway ID: %+v", err)
+		}
+		gw := gateway.StartGateway(gwID, listenAddress, gateway.NewImplementation(),
+			cert, key, gossip.DefaultManagerFlags())
+		defer gw.Shutdown()
+
+		botHostID := &id.NotificationBot
+		if botID != "" {
+			data, err := base64.StdEncoding.DecodeString(botID)
+			if err != nil {
+				jww.FATAL.Panicf("Notifications bot ID is not base64 encoded: %+v", err)
+			}
+			if botHostID, err = id.Unmarshal(data); err != nil {
+				jww.FATAL.Panicf("Invalid notifications bot ID: %+v", err)
+			}
+		}
+
+		params := connect.GetDefaultHostParams()
+		params.AuthEnabled = false
+		host, err := gw.AddHost(botHostID, botAddress, botCert, params)
+		if err != nil {
+			jww.FATAL.Panicf("Failed to add notifications bot host: %+v", err)
+		}
+
+		rng := rand.New(rand.NewSource(seed))
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		failed := 0
+		for n := 0; n < s.Rounds; n++ {
+			batch := s.batch(n, rng)
+			err = gw.SendNotificationBatch(host, batch)
+			if err != nil {
+				failed++
+				jww.ERROR.Printf("Failed to send batch for round %d: %+v", batch.RoundID, err)
+			} else {
+				jww.INFO.Printf("Sent %d notifications for round %d", len(batch.Notifications), batch.RoundID)
+			}
+			if n < s.Rounds-1 {
+				<-ticker.C
+			}
+		}
+		if failed > 0 {
+			jww.ERROR.Printf("%d of %d batches failed", failed, s.Rounds)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.Flags().StringVarP(&scriptPath, "script", "s", "",
+		"JSON script of users and rounds to simulate")
+	rootCmd.Flags().StringVar(&botAddress, "botAddress", "127.0.0.1:11420",
+		"Address of the notifications bot")
+	rootCmd.Flags().StringVar(&botID, "botID", "",
+		"Base64 encoded comms ID of the notifications bot, if it sets commsID")
+	rootCmd.Flags().StringVar(&botCertPath, "botCert", "",
+		"TLS certificate of the notifications bot; TLS is disabled if empty")
+	rootCmd.Flags().StringVar(&certPath, "cert", "",
+		"TLS certificate of the simulated gateway")
+	rootCmd.Flags().StringVar(&keyPath, "key", "",
+		"Private key of the simulated gateway")
+	rootCmd.Flags().StringVar(&listenAddress, "listen", "127.0.0.1:0",
+		"Address the simulated gateway listens on")
+	rootCmd.Flags().Int64Var(&seed, "seed", 42,
+		"Seed for generated fingerprints and message hashes")
+	_ = rootCmd.MarkFlagRequired("script")
+}
+
+func main() {
+	if err := rootCmd.Execute(); err != nil {
+		jww.ERROR.Println(err)
+		os.Exit(1)
+	}
+}
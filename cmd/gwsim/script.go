@@ -0,0 +1,107 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	pb "gitlab.com/elixxir/comms/mixmessages"
+	"io"
+	"math/rand"
+	"os"
+	"time"
+)
+
+// script describes the notification batches the simulator sends.
+//
+//	{
+//	  "startRound": 1000,
+//	  "rounds": 10,
+//	  "interval": "2s",
+//	  "users": [
+//	    {"ephemeralId": 123456, "messagesPerRound": 2},
+//	    {"ephemeralId": -42, "messagesPerRound": 1, "everyNRounds": 3}
+//	  ]
+//	}
+type script struct {
+	StartRound uint64 `json:"startRound"`
+	Rounds     int    `json:"rounds"`
+	// Interval between batches, as a Go duration string
+	Interval string       `json:"interval"`
+	Users    []scriptUser `json:"users"`
+
+	interval time.Duration
+}
+
+// scriptUser is an ephemeral ID which receives messages in simulated rounds.
+type scriptUser struct {
+	EphemeralID      int64 `json:"ephemeralId"`
+	MessagesPerRound int   `json:"messagesPerRound"`
+	// EveryNRounds limits the user to every Nth round; every round if 0
+	EveryNRounds int `json:"everyNRounds"`
+}
+
+// loadScript reads a script from the JSON file at path.
+func loadScript(path string) (*script, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to open script")
+	}
+	defer f.Close()
+	return parseScript(f)
+}
+
+// parseScript decodes and validates a script.
+func parseScript(r io.Reader) (*script, error) {
+	s := &script{}
+	err := json.NewDecoder(r).Decode(s)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to parse script")
+	}
+	if s.Rounds < 1 {
+		return nil, errors.New("Script must send at least one round")
+	}
+	if len(s.Users) == 0 {
+		return nil, errors.New("Script must list at least one user")
+	}
+	s.interval = time.Second
+	if s.Interval != "" {
+		s.interval, err = time.ParseDuration(s.Interval)
+		if err != nil {
+			return nil, errors.WithMessage(err, "Invalid script interval")
+		}
+	}
+	return s, nil
+}
+
+// batch builds the notification batch for the nth round of the script, with
+// random identity fingerprints and message hashes.
+func (s *script) batch(n int, rng *rand.Rand) *pb.NotificationBatch {
+	b := &pb.NotificationBatch{RoundID: s.StartRound + uint64(n)}
+	for _, u := range s.Users {
+		if u.EveryNRounds > 1 && n%u.EveryNRounds != 0 {
+			continue
+		}
+		count := u.MessagesPerRound
+		if count < 1 {
+			count = 1
+		}
+		for i := 0; i < count; i++ {
+			fp := make([]byte, 25)
+			msgHash := make([]byte, 32)
+			rng.Read(fp)
+			rng.Read(msgHash)
+			b.Notifications = append(b.Notifications, &pb.NotificationData{
+				EphemeralID: u.EphemeralID,
+				IdentityFP:  fp,
+				MessageHash: msgHash,
+			})
+		}
+	}
+	return b
+}
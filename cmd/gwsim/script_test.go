@@ -0,0 +1,52 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tests that a script is parsed and expanded into batches per user schedule.
+func Test_script_batch(t *testing.T) {
+	s, err := parseScript(strings.NewReader(`{
+		"startRound": 100,
+		"rounds": 3,
+		"interval": "250ms",
+		"users": [
+			{"ephemeralId": 1, "messagesPerRound": 2},
+			{"ephemeralId": 2, "everyNRounds": 2}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to parse script: %+v", err)
+	}
+	if s.interval != 250*time.Millisecond {
+		t.Errorf("Unexpected interval %s", s.interval)
+	}
+
+	rng := rand.New(rand.NewSource(42))
+	expected := []int{3, 2, 3}
+	for n, count := range expected {
+		b := s.batch(n, rng)
+		if b.RoundID != uint64(100+n) {
+			t.Errorf("Unexpected round ID %d for batch %d", b.RoundID, n)
+		}
+		if len(b.Notifications) != count {
+			t.Errorf("Expected %d notifications in batch %d, got %d", count, n, len(b.Notifications))
+		}
+	}
+}
+
+// Tests that scripts without rounds or users are rejected.
+func Test_parseScript_Invalid(t *testing.T) {
+	for _, js := range []string{
+		`{"rounds": 0, "users": [{"ephemeralId": 1}]}`,
+		`{"rounds": 1, "users": []}`,
+		`{"rounds": 1, "interval": "soon", "users": [{"ephemeralId": 1}]}`,
+	} {
+		if _, err := parseScript(strings.NewReader(js)); err == nil {
+			t.Errorf("Script should have been rejected: %s", js)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Handles the one-time migration of legacy user registrations
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gitlab.com/xx_network/primitives/id/ephemeral"
+	"time"
+)
+
+var (
+	legacyTable        string
+	legacyV0Table      string
+	legacyAddressSpace uint8
+)
+
+func init() {
+	migrateLegacyCmd.Flags().StringVarP(&cfgFile, "config", "c",
+		"", "Sets a custom config file path")
+	migrateLegacyCmd.Flags().StringVar(&legacyTable, "legacyTable",
+		storage.LegacyUsersTable, "Name of the table holding legacy users")
+	migrateLegacyCmd.Flags().StringVar(&legacyV0Table, "legacyV0Table",
+		storage.LegacyV0UsersTable, "Name of the table holding users of the original ID and token schema")
+	migrateLegacyCmd.Flags().Uint8Var(&legacyAddressSpace, "addressSpace",
+		16, "Address space size used to generate ephemeral IDs for migrated identities")
+	rootCmd.AddCommand(migrateLegacyCmd)
+}
+
+var migrateLegacyCmd = &cobra.Command{
+	Use:     "migrateLegacy",
+	Aliases: []string{"migrate-legacy"},
+	Short:   "Converts legacy user registrations to the token and tracked ID schema",
+	Long: `Converts each row of the legacy user tables into a user, token and tracked
+identity. The original table held a token for each user ID, whose intermediary
+ID is tracked; the later table held a single token and intermediary ID per
+user. Migrated rows are removed from the legacy tables, so the migration can be
+resumed. Original rows which cannot be migrated are reported and left in place.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		initConfig()
+		initLog()
+
+		s, err := storage.NewStorageFromParams(storageParams())
+		if err != nil {
+			jww.FATAL.Panicf("Failed to initialize storage: %+v", err)
+		}
+
+		_, epoch := ephemeral.HandleQuantization(time.Now())
+		migrated, unmigratable, err := s.MigrateLegacyV0Users(legacyV0Table, epoch, legacyAddressSpace)
+		for _, u := range unmigratable {
+			jww.WARN.Printf("Could not migrate legacy user %q: %s", u.Id, u.Reason)
+		}
+		if err != nil {
+			jww.FATAL.Panicf("Legacy migration stopped after %d original users: %+v", migrated, err)
+		}
+		jww.INFO.Printf("Migrated %d original users, %d left in %s could not be migrated",
+			migrated, len(unmigratable), legacyV0Table)
+
+		migrated, err = s.MigrateLegacyUsers(legacyTable, epoch, legacyAddressSpace)
+		if err != nil {
+			jww.FATAL.Panicf("Legacy migration stopped after %d users: %+v", migrated, err)
+		}
+		jww.INFO.Printf("Legacy migration complete, %d users migrated", migrated)
+	},
+}
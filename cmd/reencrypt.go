@@ -0,0 +1,50 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Handles re-encryption of stored tokens after enabling encryption at rest or
+// rotating keys
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/notifications-bot/storage"
+)
+
+func init() {
+	reencryptTokensCmd.Flags().StringVarP(&cfgFile, "config", "c",
+		"", "Sets a custom config file path")
+	rootCmd.AddCommand(reencryptTokensCmd)
+}
+
+var reencryptTokensCmd = &cobra.Command{
+	Use:   "reencryptTokens",
+	Short: "Seals stored tokens and transmission RSA keys with the current token key",
+	Long: `Seals every stored device token and transmission RSA key which is stored
+in the clear or sealed with an older key using the token encryption key with
+the highest ID. Tokens stored in the clear are moved under their pseudonym.
+Run it with the bot stopped after enabling token encryption, and after adding a
+new key; older keys can be removed from the config once it completes. Rows are
+rewritten one at a time, so the command can be resumed.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		initConfig()
+		initLog()
+
+		s, err := storage.NewStorageFromParams(storageParams())
+		if err != nil {
+			jww.FATAL.Panicf("Failed to initialize storage: %+v", err)
+		}
+
+		rewritten, err := s.ReencryptTokens()
+		if err != nil {
+			jww.FATAL.Panicf("Re-encryption stopped after %d rows: %+v", rewritten, err)
+		}
+		jww.INFO.Printf("Re-encryption complete, %d rows rewritten", rewritten)
+	},
+}
@@ -10,19 +10,26 @@
 package cmd
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"github.com/spf13/cobra"
 	jww "github.com/spf13/jwalterweatherman"
 	"github.com/spf13/viper"
 	"gitlab.com/elixxir/comms/mixmessages"
+	"gitlab.com/elixxir/notifications-bot/events"
 	"gitlab.com/elixxir/notifications-bot/notifications"
 	"gitlab.com/elixxir/notifications-bot/notifications/providers"
+	"gitlab.com/elixxir/notifications-bot/proxy"
 	"gitlab.com/elixxir/notifications-bot/storage"
 	"gitlab.com/xx_network/comms/connect"
 	"gitlab.com/xx_network/primitives/id"
 	"gitlab.com/xx_network/primitives/utils"
 	"net"
 	"os"
+	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 )
@@ -31,6 +38,7 @@ var (
 	cfgFile, logPath   string
 	verbose            bool
 	noTLS              bool
+	skipChecks         bool
 	validConfig        bool
 	NotificationParams notifications.Params
 	loopDelay          int
@@ -58,10 +66,21 @@ var rootCmd = &cobra.Command{
 			}
 		}
 
+		setDefaults()
+		if err := validateConfig(); err != nil {
+			jww.FATAL.Panicf("Invalid config file %s:\n%v", cfgFile, err)
+		}
+		// gRPC reads its proxy from the environment when connecting, so it is
+		// set before any connection is made
+		err := proxy.ConfigureComms(viper.GetString("proxy.comms"), viper.GetStringSlice("proxy.commsBypass"))
+		if err != nil {
+			jww.FATAL.Panicf("Failed to configure comms proxy: %+v", err)
+		}
+
 		// Parse config file options
 		certPath := viper.GetString("certPath")
 		keyPath := viper.GetString("keyPath")
-		localAddress := fmt.Sprintf("0.0.0.0:%d", viper.GetInt("port"))
+		localAddress := net.JoinHostPort(viper.GetString("listenAddress"), strconv.Itoa(viper.GetInt("port")))
 		fbCreds, err := utils.ExpandPath(viper.GetString("firebaseCredentialsPath"))
 		if err != nil {
 			jww.FATAL.Panicf("Unable to expand credentials path: %+v", err)
@@ -89,57 +108,263 @@ var rootCmd = &cobra.Command{
 		if err != nil {
 			jww.FATAL.Panicf("Unable to expand https cert path: %+v", err)
 		}
-		viper.SetDefault("notificationRate", 30)
-		viper.SetDefault("notificationsPerBatch", 20)
-		// This is set to approx. 90% of the stated limit (4096)
-		viper.SetDefault("maxNotificationPayload", 3686)
+		translationsPath, err := utils.ExpandPath(viper.GetString("translationsPath"))
+		if err != nil {
+			jww.FATAL.Panicf("Failed to expand translations path: %+v", err)
+		}
+
+		var apnsTiers, havenApnsTiers map[string]providers.APNSTier
+		err = viper.UnmarshalKey("apnsPriorityTiers", &apnsTiers)
+		if err != nil {
+			jww.FATAL.Panicf("Failed to parse apnsPriorityTiers: %+v", err)
+		}
+		err = viper.UnmarshalKey("havenApnsPriorityTiers", &havenApnsTiers)
+		if err != nil {
+			jww.FATAL.Panicf("Failed to parse havenApnsPriorityTiers: %+v", err)
+		}
+
+		var providerLimits map[string]notifications.ProviderLimits
+		err = viper.UnmarshalKey("providerLimits", &providerLimits)
+		if err != nil {
+			jww.FATAL.Panicf("Failed to parse providerLimits: %+v", err)
+		}
+
+		var pushQuotas map[string]notifications.PushQuota
+		err = viper.UnmarshalKey("pushQuotas", &pushQuotas)
+		if err != nil {
+			jww.FATAL.Panicf("Failed to parse pushQuotas: %+v", err)
+		}
+
+		var conversations map[string]notifications.ConversationParams
+		err = viper.UnmarshalKey("conversations", &conversations)
+		if err != nil {
+			jww.FATAL.Panicf("Failed to parse conversations: %+v", err)
+		}
+
+		var proxyRules []proxy.Rule
+		err = viper.UnmarshalKey("proxy.rules", &proxyRules)
+		if err != nil {
+			jww.FATAL.Panicf("Failed to parse proxy.rules: %+v", err)
+		}
+
+		var pinnedKeys []struct{ CertPath, Until string }
+		err = viper.UnmarshalKey("permissioningKeys", &pinnedKeys)
+		if err != nil {
+			jww.FATAL.Panicf("Failed to parse permissioningKeys: %+v", err)
+		}
+		var permissioningKeys []notifications.PermissioningKey
+		for _, k := range pinnedKeys {
+			pk := notifications.PermissioningKey{}
+			pk.CertPath, err = utils.ExpandPath(k.CertPath)
+			if err != nil {
+				jww.FATAL.Panicf("Unable to expand permissioning key path: %+v", err)
+			}
+			if k.Until != "" {
+				pk.Until, err = time.Parse(time.RFC3339, k.Until)
+				if err != nil {
+					jww.FATAL.Panicf("Invalid until of permissioning key %s: %+v", k.CertPath, err)
+				}
+			}
+			permissioningKeys = append(permissioningKeys, pk)
+		}
+
+		commsID, err := notifications.ParseCommsID(viper.GetString("commsID"), viper.GetString("commsRole"))
+		if err != nil {
+			jww.FATAL.Panicf("Failed to parse comms ID: %+v", err)
+		}
+
+		var tenants []notifications.TenantParams
+		err = viper.UnmarshalKey("tenants", &tenants)
+		if err != nil {
+			jww.FATAL.Panicf("Failed to parse tenants: %+v", err)
+		}
+		for i := range tenants {
+			tenants[i].FBCreds, err = utils.ExpandPath(tenants[i].FBCreds)
+			if err != nil {
+				jww.FATAL.Panicf("Unable to expand credentials path of tenant %s: %+v", tenants[i].Name, err)
+			}
+			tenants[i].APNS.KeyPath, err = utils.ExpandPath(tenants[i].APNS.KeyPath)
+			if err != nil {
+				jww.FATAL.Panicf("Unable to expand APNS key path of tenant %s: %+v", tenants[i].Name, err)
+			}
+		}
+
 		// Populate params
 		NotificationParams = notifications.Params{
 			Address:                localAddress,
+			CommsID:                commsID,
 			CertPath:               certPath,
 			KeyPath:                keyPath,
 			FBCreds:                fbCreds,
 			NotificationRate:       viper.GetInt("notificationRate"),
 			NotificationsPerBatch:  viper.GetInt("notificationsPerBatch"),
+			AlignSendsToRounds:     viper.GetBool("alignSendsToRounds"),
+			RoundSettleDelay:       viper.GetDuration("roundSettleDelay"),
+			MinSendInterval:        viper.GetDuration("minSendInterval"),
+			AdaptiveSendInterval:   viper.GetBool("adaptiveSendInterval"),
 			MaxNotificationPayload: viper.GetInt("maxNotificationPayload"),
 			APNS: providers.APNSParams{
-				KeyPath:  apnsKeyPath,
-				KeyID:    viper.GetString("apnsKeyID"),
-				Issuer:   viper.GetString("apnsIssuer"),
-				BundleID: viper.GetString("apnsBundleID"),
-				Dev:      viper.GetBool("apnsDev"),
+				KeyPath:    apnsKeyPath,
+				KeyID:      viper.GetString("apnsKeyID"),
+				Issuer:     viper.GetString("apnsIssuer"),
+				BundleID:   viper.GetString("apnsBundleID"),
+				Dev:        viper.GetBool("apnsDev"),
+				MaxPayload: viper.GetInt("apnsMaxPayload"),
+				Sound:      viper.GetString("apnsSound"),
+				Tiers:      apnsTiers,
 			},
 			HavenAPNS: providers.APNSParams{
-				KeyPath:  havenApnsKeyPath,
-				KeyID:    viper.GetString("havenApnsKeyID"),
-				Issuer:   viper.GetString("havenApnsIssuer"),
-				BundleID: viper.GetString("havenApnsBundleID"),
-				Dev:      viper.GetBool("havenApnsDev"),
+				KeyPath:    havenApnsKeyPath,
+				KeyID:      viper.GetString("havenApnsKeyID"),
+				Issuer:     viper.GetString("havenApnsIssuer"),
+				BundleID:   viper.GetString("havenApnsBundleID"),
+				Dev:        viper.GetBool("havenApnsDev"),
+				MaxPayload: viper.GetInt("havenApnsMaxPayload"),
+				Sound:      viper.GetString("havenApnsSound"),
+				Tiers:      havenApnsTiers,
+			},
+			WebPush: providers.WebPushParams{
+				VAPIDPrivateKey: viper.GetString("webPushVapidPrivateKey"),
+				Subject:         viper.GetString("webPushSubject"),
+			},
+			HavenFBCreds:     havenFbCreds,
+			HttpsCertPath:    httpsCertPath,
+			HttpsKeyPath:     httpsKeyPath,
+			TranslationsPath: translationsPath,
+			ProviderLimits:   providerLimits,
+			Tenants:          tenants,
+			PushTTL:          viper.GetDuration("pushTTL"),
+			FCMChannel: notifications.ChannelParams{
+				ChannelID: viper.GetString("fcmChannelID"),
+				Sound:     viper.GetString("fcmSound"),
+			},
+			HavenFCMChannel: notifications.ChannelParams{
+				ChannelID: viper.GetString("havenFcmChannelID"),
+				Sound:     viper.GetString("havenFcmSound"),
+			},
+			FCMAnalyticsLabel: viper.GetString("fcmAnalyticsLabel"),
+
+			MinProtocolVersion:       viper.GetInt("minProtocolVersion"),
+			EnforceGatewayAuth:       viper.GetBool("enforceGatewayAuth"),
+			RequireBatchSignatures:   viper.GetBool("requireBatchSignatures"),
+			GatewayStaleAfter:        viper.GetDuration("gatewayStaleAfter"),
+			GatewayPollHistory:       viper.GetInt("gatewayPollHistory"),
+			AddressFamily:            notifications.AddressFamily(viper.GetString("addressFamily")),
+			HappyEyeballsDelay:       viper.GetDuration("happyEyeballsDelay"),
+			AdminAddress:             viper.GetString("adminAddress"),
+			AdminToken:               viper.GetString("adminToken"),
+			ProfileDir:               viper.GetString("profileDir"),
+			MetricsAddress:           viper.GetString("metricsAddress"),
+			AttestationAddress:       viper.GetString("attestationAddress"),
+			GatewayAllowedOrigins:    viper.GetStringSlice("gatewayAllowedOrigins"),
+			ReceiptTTL:               viper.GetDuration("receiptTTL"),
+			DeliveryLogRetention:     viper.GetDuration("deliveryLogRetention"),
+			PushHistorySize:          viper.GetInt("pushHistorySize"),
+			TestPushInterval:         viper.GetDuration("testPushInterval"),
+			DeletedTokenRetention:    viper.GetDuration("deletedTokenRetention"),
+			MaxSendAttempts:          viper.GetInt("maxSendAttempts"),
+			ReregistrationNudges:     viper.GetBool("reregistrationNudges"),
+			QuietRepeatPushes:        viper.GetBool("quietRepeatPushes"),
+			MaxPushesPerToken:        viper.GetInt("maxPushesPerToken"),
+			LookupTimeout:            viper.GetDuration("lookupTimeout"),
+			SendTimeout:              viper.GetDuration("sendTimeout"),
+			Outbox:                   viper.GetBool("outbox"),
+			BroadcastRate:            viper.GetInt("broadcastRate"),
+			CanaryInterval:           viper.GetDuration("canaryInterval"),
+			CanaryAlertFailures:      viper.GetInt("canaryAlertFailures"),
+			MaintenanceDrainRounds:   viper.GetInt("maintenanceDrainRounds"),
+			MaxBufferedNotifications: viper.GetInt("maxBufferedNotifications"),
+			BackpressureDelay:        viper.GetDuration("backpressureDelay"),
+			MaxNotificationAge:       viper.GetDuration("maxNotificationAge"),
+			NdfStreamURL:             viper.GetString("ndfStreamURL"),
+			StatsInterval:            viper.GetDuration("statsInterval"),
+			AnalyticsInterval:        viper.GetDuration("analyticsInterval"),
+			FaultInjection:           viper.GetBool("faultInjection"),
+			Digest: notifications.DigestParams{
+				Interval:         viper.GetDuration("digest.interval"),
+				UrgentPriorities: viper.GetStringSlice("digest.urgentPriorities"),
+			},
+			Conversations: conversations,
+			PushQuotas:    pushQuotas,
+			Backfill: notifications.BackfillParams{
+				URL:        viper.GetString("backfill.url"),
+				MaxCatchUp: viper.GetDuration("backfill.maxCatchUp"),
+				Timeout:    viper.GetDuration("backfill.timeout"),
+			},
+			PermissioningKeys: permissioningKeys,
+			Proxy: proxy.Params{
+				URL:   viper.GetString("proxy.url"),
+				Rules: proxyRules,
+			},
+			GRPC: notifications.GRPCParams{
+				KeepaliveTime:          viper.GetDuration("grpc.keepaliveTime"),
+				KeepaliveTimeout:       viper.GetDuration("grpc.keepaliveTimeout"),
+				MinClientKeepalive:     viper.GetDuration("grpc.minClientKeepalive"),
+				MaxConnectionIdle:      viper.GetDuration("grpc.maxConnectionIdle"),
+				MaxConnectionAge:       viper.GetDuration("grpc.maxConnectionAge"),
+				MaxConnectionAgeGrace:  viper.GetDuration("grpc.maxConnectionAgeGrace"),
+				MaxConcurrentStreams:   viper.GetUint32("grpc.maxConcurrentStreams"),
+				ClientKeepaliveTime:    viper.GetDuration("grpc.clientKeepaliveTime"),
+				ClientKeepaliveTimeout: viper.GetDuration("grpc.clientKeepaliveTimeout"),
+			},
+			Registrar: notifications.RegistrarParams{
+				CheckInterval: viper.GetDuration("registrarVerifier.checkInterval"),
+				Quarantine:    viper.GetBool("registrarVerifier.quarantine"),
+			},
+			RegistrationBans: notifications.RegistrationBanParams{
+				Threshold:   viper.GetInt("registrationBans.threshold"),
+				Window:      viper.GetDuration("registrationBans.window"),
+				Duration:    viper.GetDuration("registrationBans.duration"),
+				MaxDuration: viper.GetDuration("registrationBans.maxDuration"),
+			},
+			AsyncRegistration: notifications.AsyncRegistrationParams{
+				QueueSize: viper.GetInt("asyncRegistration.queueSize"),
+				Workers:   viper.GetInt("asyncRegistration.workers"),
+				StatusTTL: viper.GetDuration("asyncRegistration.statusTTL"),
+			},
+			FeatureFlagRefresh: viper.GetDuration("featureFlagRefresh"),
+			KeyRotation: notifications.KeyRotationParams{
+				PreviousCertPath: viper.GetString("keyRotation.previousCertPath"),
+				PreviousKeyPath:  viper.GetString("keyRotation.previousKeyPath"),
+				GraceUntil:       viper.GetTime("keyRotation.graceUntil"),
+			},
+			Degraded: notifications.DegradedParams{
+				Enabled:        viper.GetBool("degraded.enabled"),
+				WALPath:        viper.GetString("degraded.walPath"),
+				MaxQueued:      viper.GetInt("degraded.maxQueued"),
+				FlushInterval:  viper.GetDuration("degraded.flushInterval"),
+				LookupCacheTTL: viper.GetDuration("degraded.lookupCacheTTL"),
+			},
+			Failover: notifications.FailoverParams{
+				Enabled:      viper.GetBool("failover.enabled"),
+				InstanceID:   viper.GetString("failover.instanceID"),
+				Heartbeat:    viper.GetDuration("failover.heartbeat"),
+				LeaseTimeout: viper.GetDuration("failover.leaseTimeout"),
+			},
+			Ephemeral: notifications.EphemeralParams{
+				Period:        viper.GetDuration("ephemeral.period"),
+				OffsetPhase:   viper.GetDuration("ephemeral.offsetPhase"),
+				CreationLead:  viper.GetDuration("ephemeral.creationLead"),
+				DeletionGrace: viper.GetDuration("ephemeral.deletionGrace"),
+			},
+			EphemeralReconcileInterval: viper.GetDuration("ephemeralCreation.reconcileInterval"),
+			Events: events.Params{
+				Type:       viper.GetString("events.type"),
+				Address:    viper.GetString("events.address"),
+				Topic:      viper.GetString("events.topic"),
+				BufferSize: viper.GetInt("events.bufferSize"),
 			},
-			HavenFBCreds:  havenFbCreds,
-			HttpsCertPath: httpsCertPath,
-			HttpsKeyPath:  httpsKeyPath,
 		}
 
-		rawAddr := viper.GetString("dbAddress")
-		var addr, port string
-		if rawAddr != "" {
-			addr, port, err = net.SplitHostPort(rawAddr)
-			if err != nil {
-				jww.FATAL.Panicf("Unable to get database port from %s: %+v", rawAddr, err)
-			}
-		}
 		// Initialize the storage backend
-		s, err := storage.NewStorage(
-			viper.GetString("dbUsername"),
-			viper.GetString("dbPassword"),
-			viper.GetString("dbName"),
-			addr,
-			port,
-		)
+		s, err := storage.NewStorageFromParams(storageParams())
 		if err != nil {
 			jww.FATAL.Panicf("Failed to initialize storage: %+v", err)
 		}
+		err = s.SealIdentities()
+		if err != nil {
+			jww.FATAL.Panicf("Failed to seal stored intermediary IDs: %+v", err)
+		}
 
 		// Start notifications server
 		jww.INFO.Println("Starting Notifications...")
@@ -149,6 +374,14 @@ var rootCmd = &cobra.Command{
 		}
 
 		impl.Storage = s
+		err = impl.InjectStorageFaults()
+		if err != nil {
+			jww.FATAL.Panicf("Failed to set up storage fault injection: %+v", err)
+		}
+		err = impl.OpenWriteAhead()
+		if err != nil {
+			jww.FATAL.Panicf("Failed to open write-ahead buffer: %+v", err)
+		}
 
 		// Read in permissioning certificate
 		cert, err := utils.ReadFile(viper.GetString("permissioningCertPath"))
@@ -159,22 +392,65 @@ var rootCmd = &cobra.Command{
 		// Add host for permissioning server
 		hostParams := connect.GetDefaultHostParams()
 		hostParams.AuthEnabled = false
-		_, err = impl.Comms.AddHost(&id.Permissioning, viper.GetString("permissioningAddress"), cert, hostParams)
+		NotificationParams.GRPC.ApplyClient(&hostParams)
+		permAddress, err := notifications.ResolveAddress(context.Background(), viper.GetString("permissioningAddress"),
+			NotificationParams.AddressFamily, NotificationParams.HappyEyeballsDelay)
+		if err != nil {
+			jww.FATAL.Panicf("Invalid permissioning address: %+v", err)
+		}
+		err = impl.AddPermissioningHost(permAddress, cert, hostParams)
 		if err != nil {
 			jww.FATAL.Panicf("Failed to Create permissioning host: %+v", err)
 		}
 
+		// Check the configuration before serving
+		report := impl.SelfCheck(NotificationParams, viper.GetDuration("selfCheckTimeout"))
+		reportJSON, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			jww.FATAL.Panicf("Failed to marshal self-check report: %+v", err)
+		}
+		jww.INFO.Printf("Startup self-check report:\n%s", reportJSON)
+		if failed := report.Failed(); len(failed) > 0 {
+			if !skipChecks {
+				jww.FATAL.Panicf("%d startup checks failed, see the report above or "+
+					"start with --skip-checks to ignore them", len(failed))
+			}
+			jww.WARN.Printf("Starting despite %d failed startup checks", len(failed))
+		}
+
 		// Start ephemeral ID tracking
 		errChan := make(chan error)
 		impl.TrackNdf()
 		for atomic.LoadUint32(impl.ReceivedNdf()) != 1 {
 			time.Sleep(time.Second)
 		}
+		// In failover mode, wait warm on standby until this instance holds
+		// the sender lease
+		impl.AwaitActive()
 		go impl.EphIdCreator()
 		go impl.EphIdDeleter()
+		go impl.DeliveryLogCleaner(NotificationParams.DeliveryLogRetention)
+		go impl.DeletedTokenCleaner(NotificationParams.DeletedTokenRetention)
+		go impl.StatsReporter(NotificationParams.StatsInterval)
+		go impl.AnalyticsAggregator(NotificationParams.AnalyticsInterval)
+		go impl.CanaryMonitor(NotificationParams.CanaryInterval, NotificationParams.CanaryAlertFailures)
+		go impl.DigestSender()
+		go impl.Backfill()
+		go impl.WriteAheadFlusher()
+		go impl.KeyRotator()
+		go impl.RegistrarVerifier()
+		go impl.AsyncRegistrar()
+		if NotificationParams.Outbox {
+			go impl.OutboxDispatcher()
+		}
+		err = impl.RestoreMaintenance()
+		if err != nil {
+			jww.FATAL.Panicf("Failed to restore maintenance mode: %+v", err)
+		}
 
 		// Wait forever to prevent process from ending
 		err = <-errChan
+		impl.Shutdown()
 		jww.FATAL.Panicf("Notifications loop error received: %+v", err)
 	},
 }
@@ -209,14 +485,160 @@ func init() {
 	rootCmd.Flags().BoolVar(&noTLS, "noTLS", false,
 		"Runs without TLS enabled")
 
+	rootCmd.Flags().BoolVar(&skipChecks, "skip-checks", false,
+		"Starts even if startup self-checks fail")
+
 	rootCmd.Flags().IntVarP(&loopDelay, "loopDelay", "", 500,
 		"Set the delay between notification loops (in milliseconds)")
+	err := rootCmd.Flags().MarkDeprecated("loopDelay",
+		"sends are aligned to rounds, see alignSendsToRounds and roundSettleDelay")
+	handleBindingError(err, "loopDelay")
 
 	// Bind config and command line flags of the same name
-	err := viper.BindPFlag("verbose", rootCmd.Flags().Lookup("verbose"))
+	err = viper.BindPFlag("verbose", rootCmd.Flags().Lookup("verbose"))
 	handleBindingError(err, "verbose")
 }
 
+// setDefaults sets the default of each config option which has one.
+func setDefaults() {
+	viper.SetDefault("listenAddress", "0.0.0.0")
+	viper.SetDefault("notificationRate", 30)
+	viper.SetDefault("alignSendsToRounds", true)
+	viper.SetDefault("roundSettleDelay", 500*time.Millisecond)
+	viper.SetDefault("minSendInterval", time.Second)
+	viper.SetDefault("notificationsPerBatch", 20)
+	// This is set to approx. 90% of the stated limit (4096)
+	viper.SetDefault("maxNotificationPayload", 3686)
+	viper.SetDefault("deliveryLogRetention", 7*24*time.Hour)
+	viper.SetDefault("pushHistorySize", 50)
+	viper.SetDefault("testPushInterval", time.Minute)
+	viper.SetDefault("deletedTokenRetention", 30*24*time.Hour)
+	viper.SetDefault("pushTTL", providers.DefaultPushTTL)
+	viper.SetDefault("fcmAnalyticsLabel", "{app}_{type}")
+	viper.SetDefault("maxSendAttempts", 3)
+	viper.SetDefault("reregistrationNudges", true)
+	viper.SetDefault("maxPushesPerToken", 1)
+	viper.SetDefault("lookupTimeout", 10*time.Second)
+	viper.SetDefault("sendTimeout", 30*time.Second)
+	viper.SetDefault("broadcastRate", 100)
+	viper.SetDefault("canaryInterval", 5*time.Minute)
+	viper.SetDefault("canaryAlertFailures", 2)
+	viper.SetDefault("gatewayStaleAfter", 10*time.Minute)
+	viper.SetDefault("gatewayPollHistory", 1000)
+	viper.SetDefault("addressFamily", notifications.AnyFamily)
+	viper.SetDefault("happyEyeballsDelay", notifications.DefaultHappyEyeballsDelay)
+	viper.SetDefault("maintenanceDrainRounds", 10)
+	viper.SetDefault("maxBufferedNotifications", 100000)
+	viper.SetDefault("statsInterval", 10*time.Minute)
+	viper.SetDefault("analyticsInterval", time.Hour)
+	viper.SetDefault("events.topic", "notifications")
+	viper.SetDefault("events.bufferSize", 1024)
+	viper.SetDefault("selfCheckTimeout", 10*time.Second)
+	viper.SetDefault("receiptTTL", 30*24*time.Hour)
+	viper.SetDefault("dbSlowQueryThreshold", 500*time.Millisecond)
+	viper.SetDefault("dbAutoMigrate", true)
+	viper.SetDefault("dbRetry.attempts", 4)
+	viper.SetDefault("dbRetry.baseDelay", 100*time.Millisecond)
+	viper.SetDefault("dbRetry.maxDelay", 2*time.Second)
+	viper.SetDefault("ephemeralCreation.workers", 0)
+	viper.SetDefault("ephemeralCreation.insertBatch", storage.DefaultEphemeralInsertBatch)
+	viper.SetDefault("ephemeralCreation.reconcileInterval", time.Hour)
+	viper.SetDefault("tokenPolicy", string(storage.LatestWins))
+	viper.SetDefault("backfill.maxCatchUp", 6*time.Hour)
+	viper.SetDefault("backfill.timeout", time.Minute)
+	viper.SetDefault("registrarVerifier.checkInterval", 10*time.Minute)
+	viper.SetDefault("registrarVerifier.quarantine", true)
+	viper.SetDefault("registrationBans.threshold", 5)
+	viper.SetDefault("registrationBans.window", 10*time.Minute)
+	viper.SetDefault("registrationBans.duration", time.Minute)
+	viper.SetDefault("registrationBans.maxDuration", 24*time.Hour)
+	viper.SetDefault("asyncRegistration.queueSize", 0)
+	viper.SetDefault("asyncRegistration.workers", 4)
+	viper.SetDefault("asyncRegistration.statusTTL", time.Hour)
+	viper.SetDefault("featureFlagRefresh", 30*time.Second)
+	viper.SetDefault("grpc.keepaliveTime", 5*time.Second)
+	viper.SetDefault("grpc.keepaliveTimeout", time.Minute)
+	viper.SetDefault("grpc.minClientKeepalive", 3*time.Second)
+	viper.SetDefault("grpc.maxConnectionIdle", time.Minute)
+	viper.SetDefault("grpc.maxConnectionAge", time.Hour)
+	viper.SetDefault("grpc.maxConnectionAgeGrace", time.Minute)
+	viper.SetDefault("grpc.maxConcurrentStreams", 250000)
+	viper.SetDefault("grpc.clientKeepaliveTime", 5*time.Second)
+	viper.SetDefault("grpc.clientKeepaliveTimeout", time.Minute)
+	viper.SetDefault("degraded.enabled", true)
+	viper.SetDefault("degraded.maxQueued", 10000)
+	viper.SetDefault("degraded.flushInterval", 5*time.Second)
+	viper.SetDefault("degraded.lookupCacheTTL", 5*time.Minute)
+}
+
+// storageParams builds the storage backend configuration from the config file.
+func storageParams() storage.Params {
+	rawAddr := viper.GetString("dbAddress")
+	var addr, port string
+	if rawAddr != "" {
+		var err error
+		addr, port, err = net.SplitHostPort(rawAddr)
+		if err != nil {
+			jww.FATAL.Panicf("Unable to get database port from %s: %+v", rawAddr, err)
+		}
+	}
+	identityKey := readKeyFile(viper.GetString("identityKeyPath"), "identity")
+	tokenLookupKey := readKeyFile(viper.GetString("tokenEncryption.lookupKeyPath"), "token lookup")
+	var tokenKeys map[uint8][]byte
+	if len(tokenLookupKey) > 0 {
+		tokenKeys = make(map[uint8][]byte)
+		for keyID, keyPath := range viper.GetStringMapString("tokenEncryption.keys") {
+			parsed, err := strconv.ParseUint(keyID, 10, 8)
+			if err != nil {
+				jww.FATAL.Panicf("Token encryption key ID %q must be between 0 and 255", keyID)
+			}
+			tokenKeys[uint8(parsed)] = readKeyFile(keyPath, "token encryption")
+		}
+	}
+	return storage.Params{
+		Username:            viper.GetString("dbUsername"),
+		Password:            viper.GetString("dbPassword"),
+		DBName:              viper.GetString("dbName"),
+		Address:             addr,
+		Port:                port,
+		PartitionEphemerals: viper.GetBool("partitionEphemerals"),
+		SkipMigration:       !viper.GetBool("dbAutoMigrate"),
+		ReadReplicas:        viper.GetStringSlice("dbReadReplicas"),
+		SlowQueryThreshold:  viper.GetDuration("dbSlowQueryThreshold"),
+		IdentityKey:         identityKey,
+		TokenLookupKey:      tokenLookupKey,
+		TokenKeys:           tokenKeys,
+		Retry: storage.RetryParams{
+			Attempts:  viper.GetInt("dbRetry.attempts"),
+			BaseDelay: viper.GetDuration("dbRetry.baseDelay"),
+			MaxDelay:  viper.GetDuration("dbRetry.maxDelay"),
+		},
+		Ephemerals: storage.EphemeralParams{
+			Workers:      viper.GetInt("ephemeralCreation.workers"),
+			InsertBatch:  viper.GetInt("ephemeralCreation.insertBatch"),
+			CreationLead: viper.GetDuration("ephemeral.creationLead"),
+		},
+		TokenPolicy: storage.TokenPolicy(viper.GetString("tokenPolicy")),
+	}
+}
+
+// readKeyFile reads a base64 encoded key from the passed in path. It returns
+// nil if the path is empty.
+func readKeyFile(keyPath, name string) []byte {
+	if keyPath == "" {
+		return nil
+	}
+	encoded, err := utils.ReadFile(keyPath)
+	if err != nil {
+		jww.FATAL.Panicf("Failed to read %s key: %+v", name, err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		jww.FATAL.Panicf("The %s key must be base64 encoded: %+v", name, err)
+	}
+	return key
+}
+
 // Handle flag binding errors
 func handleBindingError(err error, flag string) {
 	if err != nil {
@@ -7,9 +7,100 @@
 
 package constants
 
+import "strings"
+
 const NotificationsTag = "notificationData"
+const NotificationsCountTag = "notificationCount"
+const NotificationsMoreTag = "notificationMore"
+const NotificationChannelTag = "notificationChannel"
+const NotificationSoundTag = "notificationSound"
+const NotificationBroadcastTag = "notificationBroadcast"
+const NotificationReregisterTag = "notificationReregister"
+const NotificationSilentTag = "notificationSilent"
+const NotificationDigestTag = "notificationDigest"
+const NotificationPrivacyTag = "notificationPrivacy"
+const NotificationServiceTag = "notificationService"
+const NotificationConversationTag = "notificationConversation"
+const NotificationTestTag = "notificationTest"
 const NotificationTitle = "Privacy: protected!"
 const NotificationBody = "Some notifications are not for you to ensure privacy; we hope to remove this notification soon"
+const NotificationDigestBody = "You have %d new messages"
+const NotificationGenericBody = "New activity"
+const NotificationTestBody = "Notifications are working on this device"
+
+// PrivacyLevel limits what pushes to a token reveal on the lock screen.
+type PrivacyLevel string
+
+const (
+	// PrivacyDefault shows the alert text configured for the app
+	PrivacyDefault PrivacyLevel = ""
+	// PrivacyGeneric shows only NotificationGenericBody and withholds the
+	// number of notifications
+	PrivacyGeneric PrivacyLevel = "generic"
+	// PrivacyCount shows the number of new messages
+	PrivacyCount PrivacyLevel = "count"
+	// PrivacyService shows the number of new messages and the service they
+	// are for
+	PrivacyService PrivacyLevel = "service"
+)
+
+// Valid returns true if the privacy level is recognised.
+func (p PrivacyLevel) Valid() bool {
+	switch p {
+	case PrivacyDefault, PrivacyGeneric, PrivacyCount, PrivacyService:
+		return true
+	}
+	return false
+}
+
+// Conversation is the service tag of a tracked ID: the kind of conversation
+// its messages belong to. It decides the priority, alert text and mute
+// preference applied to pushes for the ID.
+type Conversation string
+
+const (
+	// ConversationUntagged is the conversation of IDs tagged by no client
+	ConversationUntagged Conversation = ""
+	// ConversationDM is a direct message conversation
+	ConversationDM Conversation = "dm"
+	// ConversationGroup is a group chat
+	ConversationGroup Conversation = "group"
+	// ConversationChannel is a broadcast channel
+	ConversationChannel Conversation = "channel"
+)
+
+// conversationLanes orders conversations from the most to the least urgent.
+// Untagged IDs rank below direct messages, which they were before tags were
+// introduced, and above group chats.
+var conversationLanes = []Conversation{ConversationDM, ConversationUntagged, ConversationGroup, ConversationChannel}
+
+// Valid returns true if the conversation is recognised.
+func (c Conversation) Valid() bool {
+	return c.Lane() >= 0
+}
+
+// Lane returns the rank of the conversation's lane, where pushes in lower
+// lanes are sent first, or -1 if the conversation is not recognised.
+func (c Conversation) Lane() int {
+	for i, lane := range conversationLanes {
+		if c == lane {
+			return i
+		}
+	}
+	return -1
+}
+
+// ParseConversations splits a comma separated list of conversations, as
+// stored with a user's muted conversations.
+func ParseConversations(list string) []Conversation {
+	var conversations []Conversation
+	for _, c := range strings.Split(list, ",") {
+		if c != "" {
+			conversations = append(conversations, Conversation(c))
+		}
+	}
+	return conversations
+}
 
 type App uint8
 
@@ -18,6 +109,7 @@ const (
 	MessengerAndroid
 	HavenIOS
 	HavenAndroid
+	MessengerWeb
 )
 
 func (a App) String() string {
@@ -30,7 +122,56 @@ func (a App) String() string {
 		return "havenIOS"
 	case HavenAndroid:
 		return "havenAndroid"
+	case MessengerWeb:
+		return "messengerWeb"
+	default:
+		return "unknown"
+	}
+}
+
+// Apps lists every app the bot can send notifications for.
+var Apps = []App{MessengerIOS, MessengerAndroid, HavenIOS, HavenAndroid, MessengerWeb}
+
+// Provider returns the name of the push service notifications for the app
+// are sent through.
+func (a App) Provider() string {
+	switch a {
+	case MessengerIOS, HavenIOS:
+		return "apns"
+	case MessengerAndroid, HavenAndroid:
+		return "fcm"
+	case MessengerWeb:
+		return "webpush"
 	default:
 		return "unknown"
 	}
 }
+
+// TenantSeparator separates the tenant name from the push service in the app
+// of tokens registered for a tenant, e.g. acme/fcm.
+const TenantSeparator = "/"
+
+// TenantApp returns the app tokens of the tenant using the passed in push
+// service (apns, fcm or webpush) are registered with.
+func TenantApp(tenant, provider string) string {
+	return tenant + TenantSeparator + provider
+}
+
+// SplitTenant returns the tenant and push service of a tenant app. The tenant
+// is empty for the bot's own apps, which are returned unchanged.
+func SplitTenant(app string) (tenant, provider string) {
+	if i := strings.Index(app, TenantSeparator); i >= 0 {
+		return app[:i], app[i+len(TenantSeparator):]
+	}
+	return "", app
+}
+
+// LegacyApp returns the app of a token registered through the legacy
+// registration API, which did not carry one. FCM tokens contain a colon while
+// APNS tokens are hex encoded.
+func LegacyApp(token string) App {
+	if strings.Contains(token, ":") {
+		return MessengerAndroid
+	}
+	return MessengerIOS
+}
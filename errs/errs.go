@@ -0,0 +1,81 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Package errs defines the categories of the errors returned across the
+// notifications bot, so callers can branch on them with errors.Is rather than
+// matching messages. Errors are categorised by wrapping a sentinel, or by
+// marking an error which already carries a message with Mark.
+
+package errs
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+)
+
+var (
+	// ErrNotRegistered is wrapped by the errors returned when a token or user
+	// is not registered
+	ErrNotRegistered = errors.New("not registered")
+	// ErrInvalidSignature is wrapped by the errors returned when a request or
+	// registration signature does not verify
+	ErrInvalidSignature = errors.New("invalid signature")
+	// ErrStaleTimestamp is wrapped by the errors returned when a request was
+	// signed too long ago
+	ErrStaleTimestamp = errors.New("stale request timestamp")
+	// ErrProviderPermanent is wrapped by the errors returned when a push
+	// service rejected a token for good; it is purged rather than retried
+	ErrProviderPermanent = errors.New("push service rejected the token")
+	// ErrProviderTransient is wrapped by the errors returned when a send
+	// failed but the token is still valid and the send can be retried
+	ErrProviderTransient = errors.New("push service send failed")
+	// ErrRateLimited is wrapped by the errors returned when a client made a
+	// request again sooner than it is allowed to
+	ErrRateLimited = errors.New("rate limited")
+)
+
+// marked is an error which errors.Is reports as both itself and category.
+type marked struct {
+	err      error
+	category error
+}
+
+// Mark returns err categorised as category. The returned error has the
+// message of err, and errors.Is reports it as both err and category. It
+// returns nil if err is nil.
+func Mark(err, category error) error {
+	if err == nil {
+		return nil
+	}
+	return &marked{err: err, category: category}
+}
+
+// Error returns the message of the marked error.
+func (m *marked) Error() string { return m.err.Error() }
+
+// Unwrap returns the marked error.
+func (m *marked) Unwrap() error { return m.err }
+
+// Is returns true if target is the category of the error.
+func (m *marked) Is(target error) bool { return target == m.category }
+
+// Format formats the marked error, with its stack trace for %+v.
+func (m *marked) Format(s fmt.State, verb rune) {
+	switch verb {
+	case 'v':
+		if s.Flag('+') {
+			_, _ = fmt.Fprintf(s, "%+v", m.err)
+			return
+		}
+		fallthrough
+	case 's':
+		_, _ = io.WriteString(s, m.Error())
+	case 'q':
+		_, _ = fmt.Fprintf(s, "%q", m.Error())
+	}
+}
@@ -0,0 +1,34 @@
+package errs
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"strings"
+	"testing"
+)
+
+// Tests that marked errors keep their message and are reported by errors.Is
+// as both the original error and the category, through further wrapping.
+func TestMark(t *testing.T) {
+	original := errors.New("token signature mismatch")
+	err := errors.WithMessage(Mark(original, ErrInvalidSignature), "Failed to verify token signature")
+
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Marked error should be its category")
+	}
+	if !errors.Is(err, original) {
+		t.Errorf("Marked error should still be the original error")
+	}
+	if errors.Is(err, ErrStaleTimestamp) {
+		t.Errorf("Marked error should not be another category")
+	}
+	if err.Error() != "Failed to verify token signature: token signature mismatch" {
+		t.Errorf("Marked error should keep its message, got %q", err.Error())
+	}
+	if trace := fmt.Sprintf("%+v", err); !strings.Contains(trace, "TestMark") {
+		t.Errorf("Marked error should keep its stack trace, got %s", trace)
+	}
+	if Mark(nil, ErrInvalidSignature) != nil {
+		t.Errorf("Marking nil should return nil")
+	}
+}
@@ -0,0 +1,142 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Package events publishes notification lifecycle events (registrations,
+// sends, token purges) to an external event bus so downstream analytics and
+// alerting systems can consume them.
+
+package events
+
+import (
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"time"
+)
+
+// Type describes the kind of event being published.
+type Type string
+
+const (
+	Registration Type = "registration"
+	SendSuccess  Type = "send_success"
+	SendFailure  Type = "send_failure"
+	TokenPurge   Type = "token_purge"
+	// ReregistrationNudge is published when a device is asked to refresh the
+	// registration of a sibling device whose token was purged
+	ReregistrationNudge Type = "reregistration_nudge"
+	// CanaryFailure is published when a canary token fails the configured
+	// number of heartbeats in a row and CanaryRecovery when it next succeeds
+	CanaryFailure  Type = "canary_failure"
+	CanaryRecovery Type = "canary_recovery"
+	// ProviderMisconfigured is published when a push service rejects a send
+	// because of the bot's credentials or configuration
+	ProviderMisconfigured Type = "provider_misconfigured"
+	// FailoverTakeover is published when an instance takes over sending in
+	// failover mode
+	FailoverTakeover Type = "failover_takeover"
+)
+
+// Event is a single notification lifecycle event. Device tokens are never
+// included in published events.
+type Event struct {
+	Type                Type      `json:"type"`
+	Timestamp           time.Time `json:"timestamp"`
+	App                 string    `json:"app,omitempty"`
+	TransmissionRSAHash []byte    `json:"transmissionRsaHash,omitempty"`
+	Rounds              []uint64  `json:"rounds,omitempty"`
+	Error               string    `json:"error,omitempty"`
+	// Instance is the ID of the instance taking over in failover mode
+	Instance string `json:"instance,omitempty"`
+}
+
+// Publisher sends events to an event bus.
+type Publisher interface {
+	// Publish sends the event to the bus
+	Publish(e Event) error
+	// Close releases any connections held by the publisher
+	Close() error
+}
+
+// Params holds the configuration for the event bus.
+type Params struct {
+	// Type of event bus, either "nats" or "kafka"; events are disabled if empty
+	Type string
+	// Address of the NATS server (host:port) or base URL of the Kafka REST proxy
+	Address string
+	// Subject prefix (NATS) or topic (Kafka) events are published to
+	Topic string
+	// BufferSize is the number of events held while waiting to be published;
+	// events are dropped when the buffer is full
+	BufferSize int
+}
+
+// NewPublisher creates a Publisher for the configured event bus. Publishing is
+// done asynchronously so a slow or unavailable bus never blocks the caller.
+// Returns nil if no event bus is configured.
+func NewPublisher(params Params) (Publisher, error) {
+	var p Publisher
+	switch params.Type {
+	case "":
+		return nil, nil
+	case "nats":
+		p = newNats(params.Address, params.Topic)
+	case "kafka":
+		p = newKafka(params.Address, params.Topic)
+	default:
+		return nil, errors.Errorf("Unknown event bus type %q", params.Type)
+	}
+	jww.INFO.Printf("Publishing notification events to %s at %s", params.Type, params.Address)
+	return newAsync(p, params.BufferSize), nil
+}
+
+// async wraps a Publisher so events are published from a separate thread.
+type async struct {
+	p     Publisher
+	queue chan Event
+	done  chan struct{}
+}
+
+func newAsync(p Publisher, bufferSize int) *async {
+	if bufferSize < 1 {
+		bufferSize = 1
+	}
+	a := &async{
+		p:     p,
+		queue: make(chan Event, bufferSize),
+		done:  make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+func (a *async) run() {
+	defer close(a.done)
+	for e := range a.queue {
+		err := a.p.Publish(e)
+		if err != nil {
+			jww.WARN.Printf("Failed to publish %s event: %+v", e.Type, err)
+		}
+	}
+}
+
+// Publish queues the event for publishing, returning an error if the buffer
+// is full and the event was dropped.
+func (a *async) Publish(e Event) error {
+	select {
+	case a.queue <- e:
+		return nil
+	default:
+		return errors.Errorf("Event buffer full, dropping %s event", e.Type)
+	}
+}
+
+// Close publishes all queued events and closes the underlying publisher.
+func (a *async) Close() error {
+	close(a.queue)
+	<-a.done
+	return a.p.Close()
+}
@@ -0,0 +1,124 @@
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tests that the NATS publisher connects and sends events on the expected subject.
+func TestNats_Publish(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %+v", err)
+	}
+	defer ln.Close()
+
+	lines := make(chan string, 10)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			lines <- strings.TrimSpace(line)
+		}
+	}()
+
+	n := newNats(ln.Addr().String(), "notifications")
+	defer n.Close()
+	err = n.Publish(Event{Type: SendSuccess, App: "app"})
+	if err != nil {
+		t.Fatalf("Failed to publish: %+v", err)
+	}
+
+	expected := []string{"CONNECT", "PUB notifications.send_success", "{"}
+	for _, prefix := range expected {
+		select {
+		case line := <-lines:
+			if !strings.HasPrefix(line, prefix) {
+				t.Errorf("Expected line starting with %q, received %q", prefix, line)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for %q", prefix)
+		}
+	}
+}
+
+// Tests that the Kafka publisher produces events to the REST proxy topic.
+func TestKafka_Publish(t *testing.T) {
+	received := make(chan kafkaRecords, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/topics/notifications" {
+			t.Errorf("Unexpected request path %s", r.URL.Path)
+		}
+		body, _ := io.ReadAll(r.Body)
+		var records kafkaRecords
+		err := json.Unmarshal(body, &records)
+		if err != nil {
+			t.Errorf("Failed to unmarshal records: %+v", err)
+		}
+		received <- records
+	}))
+	defer server.Close()
+
+	k := newKafka(server.URL, "notifications")
+	err := k.Publish(Event{Type: TokenPurge, App: "app"})
+	if err != nil {
+		t.Fatalf("Failed to publish: %+v", err)
+	}
+
+	records := <-received
+	if len(records.Records) != 1 || records.Records[0].Value.Type != TokenPurge {
+		t.Errorf("Did not receive expected records: %+v", records)
+	}
+}
+
+// blockingPublisher blocks every publish until released.
+type blockingPublisher struct {
+	release chan struct{}
+}
+
+func (b *blockingPublisher) Publish(Event) error {
+	<-b.release
+	return nil
+}
+
+func (b *blockingPublisher) Close() error { return nil }
+
+// Tests that the async publisher drops events once its buffer is full.
+func TestAsync_Publish_Full(t *testing.T) {
+	bp := &blockingPublisher{release: make(chan struct{})}
+	a := newAsync(bp, 1)
+
+	// The first event is taken by the publishing thread, the second fills the
+	// buffer and the third must be dropped
+	_ = a.Publish(Event{Type: Registration})
+	time.Sleep(50 * time.Millisecond)
+	err := a.Publish(Event{Type: Registration})
+	if err != nil {
+		t.Fatalf("Second event should have been buffered: %+v", err)
+	}
+	err = a.Publish(Event{Type: Registration})
+	if err == nil {
+		t.Errorf("Third event should have been dropped")
+	}
+
+	close(bp.release)
+	err = a.Close()
+	if err != nil {
+		t.Errorf("Failed to close publisher: %+v", err)
+	}
+}
@@ -0,0 +1,67 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const kafkaContentType = "application/vnd.kafka.json.v2+json"
+const kafkaTimeout = 10 * time.Second
+
+// kafka publishes events to a Kafka topic through a Kafka REST proxy.
+type kafka struct {
+	endpoint string
+	client   *http.Client
+}
+
+// kafkaRecords is the body of a REST proxy produce request.
+type kafkaRecords struct {
+	Records []kafkaRecord `json:"records"`
+}
+
+type kafkaRecord struct {
+	Key   string `json:"key"`
+	Value Event  `json:"value"`
+}
+
+func newKafka(proxyURL, topic string) *kafka {
+	return &kafka{
+		endpoint: strings.TrimSuffix(proxyURL, "/") + "/topics/" + url.PathEscape(topic),
+		client:   &http.Client{Timeout: kafkaTimeout},
+	}
+}
+
+// Publish produces the event to the topic, keyed by event type.
+func (k *kafka) Publish(e Event) error {
+	body, err := json.Marshal(kafkaRecords{Records: []kafkaRecord{{Key: string(e.Type), Value: e}}})
+	if err != nil {
+		return errors.WithMessage(err, "Failed to marshal event")
+	}
+
+	resp, err := k.client.Post(k.endpoint, kafkaContentType, bytes.NewReader(body))
+	if err != nil {
+		return errors.WithMessagef(err, "Failed to produce to %s", k.endpoint)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("Kafka REST proxy at %s returned status %s", k.endpoint, resp.Status)
+	}
+	return nil
+}
+
+// Close is a no-op for the REST proxy publisher.
+func (k *kafka) Close() error {
+	return nil
+}
@@ -0,0 +1,116 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const natsDialTimeout = 5 * time.Second
+
+// nats publishes events to a NATS server using the plain text client
+// protocol. Events are published to the subject <prefix>.<event type>.
+type nats struct {
+	address string
+	prefix  string
+
+	mux  sync.Mutex
+	conn net.Conn
+}
+
+func newNats(address, prefix string) *nats {
+	return &nats{address: address, prefix: prefix}
+}
+
+// Publish sends the event to NATS, connecting first if necessary.
+func (n *nats) Publish(e Event) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return errors.WithMessage(err, "Failed to marshal event")
+	}
+	subject := fmt.Sprintf("%s.%s", n.prefix, e.Type)
+
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if n.conn == nil {
+		err = n.connect()
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = fmt.Fprintf(n.conn, "PUB %s %d\r\n%s\r\n", subject, len(payload), payload)
+	if err != nil {
+		// Drop the connection so the next publish reconnects
+		_ = n.conn.Close()
+		n.conn = nil
+		return errors.WithMessagef(err, "Failed to publish to %s", subject)
+	}
+	return nil
+}
+
+// connect dials the NATS server and starts a thread answering server pings.
+// Must be called with the lock held.
+func (n *nats) connect() error {
+	conn, err := net.DialTimeout("tcp", n.address, natsDialTimeout)
+	if err != nil {
+		return errors.WithMessagef(err, "Failed to connect to NATS at %s", n.address)
+	}
+	_, err = fmt.Fprint(conn, "CONNECT {\"verbose\":false,\"pedantic\":false,\"name\":\"notifications-bot\"}\r\n")
+	if err != nil {
+		_ = conn.Close()
+		return errors.WithMessage(err, "Failed to send NATS CONNECT")
+	}
+	n.conn = conn
+	go n.readLoop(conn)
+	return nil
+}
+
+// readLoop consumes messages sent by the server, replying to keepalive pings
+// and logging protocol errors, until the connection is closed.
+func (n *nats) readLoop(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PING":
+			n.mux.Lock()
+			_, err = fmt.Fprint(conn, "PONG\r\n")
+			n.mux.Unlock()
+			if err != nil {
+				return
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			jww.WARN.Printf("NATS server returned error: %s", line)
+		}
+	}
+}
+
+// Close closes the connection to the NATS server.
+func (n *nats) Close() error {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if n.conn == nil {
+		return nil
+	}
+	err := n.conn.Close()
+	n.conn = nil
+	return err
+}
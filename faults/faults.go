@@ -0,0 +1,66 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Package faults injects random failures into storage writes and provider
+// sends, for validating retry and recovery behavior in staging. Injectors
+// fail nothing until their rate is raised.
+
+package faults
+
+import (
+	"github.com/pkg/errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrInjected is returned by operations failed on purpose.
+var ErrInjected = errors.New("injected fault")
+
+// Injector decides whether an operation should fail, at a configurable rate.
+type Injector struct {
+	percent float64
+	rng     *rand.Rand
+	mux     sync.Mutex
+}
+
+// NewInjector returns an Injector which fails nothing until its rate is set.
+func NewInjector() *Injector {
+	return &Injector{rng: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// SetRate sets the percentage of operations which fail, between 0 and 100.
+func (i *Injector) SetRate(percent float64) error {
+	if percent < 0 || percent > 100 {
+		return errors.Errorf("fault rate %f must be between 0 and 100", percent)
+	}
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	i.percent = percent
+	return nil
+}
+
+// Rate returns the percentage of operations which fail.
+func (i *Injector) Rate() float64 {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	return i.percent
+}
+
+// Fail returns ErrInjected if the operation should fail, or nil otherwise.
+// A nil Injector never fails.
+func (i *Injector) Fail() error {
+	if i == nil {
+		return nil
+	}
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	if i.percent > 0 && i.rng.Float64()*100 < i.percent {
+		return ErrInjected
+	}
+	return nil
+}
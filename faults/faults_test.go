@@ -0,0 +1,38 @@
+package faults
+
+import (
+	"errors"
+	"testing"
+)
+
+// Tests that an Injector fails nothing at 0%, everything at 100% and rejects
+// rates out of range.
+func TestInjector_Fail(t *testing.T) {
+	var nilInjector *Injector
+	if nilInjector.Fail() != nil {
+		t.Error("A nil injector should never fail")
+	}
+
+	i := NewInjector()
+	for n := 0; n < 100; n++ {
+		if err := i.Fail(); err != nil {
+			t.Fatalf("Injector at 0%% failed: %+v", err)
+		}
+	}
+
+	if err := i.SetRate(100); err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < 100; n++ {
+		if err := i.Fail(); !errors.Is(err, ErrInjected) {
+			t.Fatalf("Injector at 100%% did not fail: %+v", err)
+		}
+	}
+
+	if err := i.SetRate(101); err == nil {
+		t.Error("Rate above 100 should be rejected")
+	}
+	if i.Rate() != 100 {
+		t.Errorf("Rejected rate should not be applied, rate is %f", i.Rate())
+	}
+}
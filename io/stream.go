@@ -0,0 +1,114 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Stream NDF updates from the network as they are published, instead of
+// polling for them. The permissioning comms have no streaming NDF RPC, so the
+// updates are read from a server-sent events endpoint published alongside
+// permissioning or scheduling. Each event's data is a JSON encoded NDF
+// message, which is signed by permissioning like a polled one.
+//
+// Use the "NdfStream" interface in functions so you can mock the NDF for
+// testing.
+
+package io
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/pkg/errors"
+	pb "gitlab.com/elixxir/comms/mixmessages"
+	"net/http"
+	"net/url"
+)
+
+// NdfStream is implemented by objects which receive NDF updates as they are
+// published.
+type NdfStream interface {
+	// StreamNdf sends each NDF published after the one with the passed in
+	// hash to updates, blocking until ctx is done or the stream breaks.
+	StreamNdf(ctx context.Context, ndfHash []byte, updates chan<- *pb.NDF) error
+}
+
+// HttpNdfStream reads NDF updates from a server-sent events endpoint.
+type HttpNdfStream struct {
+	url    *url.URL
+	client *http.Client
+}
+
+// NewHttpNdfStream creates a stream of the NDF updates served at the passed
+// in URL.
+func NewHttpNdfStream(endpoint string) (*HttpNdfStream, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Invalid NDF stream URL")
+	}
+	return &HttpNdfStream{url: u, client: &http.Client{}}, nil
+}
+
+// StreamNdf implements NdfStream. The hash of the last NDF received is sent
+// as the hash query parameter, so the endpoint can send the current NDF
+// first if it differs.
+func (s *HttpNdfStream) StreamNdf(ctx context.Context, ndfHash []byte, updates chan<- *pb.NDF) error {
+	u := *s.url
+	q := u.Query()
+	q.Set("hash", base64.URLEncoding.EncodeToString(ndfHash))
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return errors.WithMessage(err, "Failed to build NDF stream request")
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return errors.WithMessage(err, "Failed to open NDF stream")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("NDF stream returned status %s", resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, 16<<20)
+	var data bytes.Buffer
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		switch {
+		case len(line) == 0:
+			// A blank line ends the event
+			if data.Len() == 0 {
+				continue
+			}
+			ndf := &pb.NDF{}
+			if err = json.Unmarshal(data.Bytes(), ndf); err != nil {
+				return errors.WithMessage(err, "Failed to decode streamed NDF")
+			}
+			data.Reset()
+			select {
+			case updates <- ndf:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		case bytes.HasPrefix(line, []byte("data:")):
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.Write(bytes.TrimPrefix(bytes.TrimPrefix(line, []byte("data:")), []byte(" ")))
+		}
+		// Comments, used as keep-alives, and other fields are ignored
+	}
+	if err = scanner.Err(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return errors.WithMessage(err, "NDF stream broke")
+	}
+	return errors.New("NDF stream closed by the server")
+}
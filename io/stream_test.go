@@ -0,0 +1,46 @@
+package io
+
+import (
+	"context"
+	"fmt"
+	pb "gitlab.com/elixxir/comms/mixmessages"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Tests that each event of the stream is decoded into an NDF, that comments
+// and other fields are ignored, and that the last hash is sent.
+func TestHttpNdfStream_StreamNdf(t *testing.T) {
+	var gotHash string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHash = r.URL.Query().Get("hash")
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, ": keep-alive\n\n")
+		fmt.Fprint(w, "event: ndf\ndata: {\"Ndf\":\"Zmlyc3Q=\"}\n\n")
+		fmt.Fprint(w, "data: {\"Ndf\":\"c2Vjb25k\",\n")
+		fmt.Fprint(w, "data:  \"Signature\":null}\n\n")
+	}))
+	defer server.Close()
+
+	stream, err := NewHttpNdfStream(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to create stream: %+v", err)
+	}
+	updates := make(chan *pb.NDF, 2)
+	err = stream.StreamNdf(context.Background(), []byte("hash"), updates)
+	if err == nil {
+		t.Errorf("Closing the stream should return an error")
+	}
+	if gotHash != "aGFzaA==" {
+		t.Errorf("Expected the last hash to be sent, got %q", gotHash)
+	}
+	if len(updates) != 2 {
+		t.Fatalf("Expected 2 NDFs, got %d", len(updates))
+	}
+	for _, expected := range []string{"first", "second"} {
+		if ndf := <-updates; string(ndf.Ndf) != expected {
+			t.Errorf("Expected NDF %q, got %q", expected, ndf.Ndf)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// account contains the signed requests clients make about all of their
+// registrations at once. They are not part of the notification bot's comms,
+// so they are served over HTTP alongside the attestation.
+
+package notifications
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/crypto/notifications"
+	"gitlab.com/elixxir/crypto/rsa"
+	"gitlab.com/elixxir/notifications-bot/errs"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"net/http"
+	"time"
+)
+
+// Tags signed into account requests. They are numbered well above the tags of
+// the registration requests so a signature cannot be replayed as another
+// request.
+const (
+	UnregisterAllTag notifications.NotificationTag = 0x80 + iota
+	RegistrationStatusTag
+	AppOpenedTag
+	EnableDigestTag
+	DisableDigestTag
+	IdentityPreimagesTag
+	PushHistoryTag
+	IdentityConversationTag
+	MutedConversationsTag
+	TestNotificationTag
+)
+
+// maxAccountRequestBytes limits the size of account request bodies.
+const maxAccountRequestBytes = 16 << 10
+
+// AccountRequest is a request about all registrations of a transmission key.
+// Signature is made with notifications.SignIdentity over the PEM encoded key,
+// the request timestamp and the request's tag.
+type AccountRequest struct {
+	TransmissionRsaPem []byte
+	RequestTimestamp   int64
+	Signature          []byte
+}
+
+// verifyAccountRequest checks the request timestamp and the signature of an
+// account request for the passed in tag.
+func (nb *Impl) verifyAccountRequest(msg *AccountRequest, tag notifications.NotificationTag) error {
+	if msg == nil || len(msg.TransmissionRsaPem) == 0 {
+		return errors.New("Request must include a transmission RSA key")
+	}
+	requestTimestamp := time.Unix(0, msg.RequestTimestamp)
+	if err := nb.checkRequestTimestamp(requestTimestamp); err != nil {
+		return err
+	}
+
+	pub, err := rsa.GetScheme().UnmarshalPublicKeyPEM(msg.TransmissionRsaPem)
+	if err != nil {
+		return errors.WithMessage(err, "Failed to unmarshal public key")
+	}
+	err = notifications.VerifyIdentity(pub, [][]byte{msg.TransmissionRsaPem}, requestTimestamp, tag, msg.Signature)
+	if err != nil {
+		return errs.Mark(errors.WithMessage(err, "Failed to verify request signature"), errs.ErrInvalidSignature)
+	}
+	return nil
+}
+
+// UnregisterAll unregisters every token and tracked ID registered with the
+// transmission key which signed the request, for clients logging out of all
+// devices or wiping a device. Does not return an error if nothing is
+// registered.
+func (nb *Impl) UnregisterAll(msg *AccountRequest) error {
+	jww.INFO.Println("UnregisterAll")
+	err := nb.verifyAccountRequest(msg, UnregisterAllTag)
+	if err != nil {
+		return err
+	}
+	return nb.Storage.UnregisterUser(msg.TransmissionRsaPem)
+}
+
+// handleUnregisterAll serves UnregisterAll for a JSON encoded AccountRequest.
+func (nb *Impl) handleUnregisterAll(w http.ResponseWriter, r *http.Request) {
+	msg, ok := decodeAccountRequest(w, r)
+	if !ok {
+		return
+	}
+	err := nb.verifyAccountRequest(msg, UnregisterAllTag)
+	if err != nil {
+		adminError(w, http.StatusUnauthorized, err)
+		return
+	}
+	err = nb.Storage.UnregisterUser(msg.TransmissionRsaPem)
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, errors.WithMessage(err, "Failed to unregister"))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RegistrationStatus summarises a client's registrations, so the client can
+// show which of its devices receive notifications and detect broken ones.
+type RegistrationStatus struct {
+	Devices    []DeviceStatus `json:"devices"`
+	TrackedIDs int            `json:"trackedIds"`
+}
+
+// DeviceStatus describes a token registered by a client. Pushes are only
+// reported within the delivery log retention period.
+type DeviceStatus struct {
+	Token string `json:"token"`
+	App   string `json:"app"`
+	// Standby is set on fallback tokens not yet pushed to
+	Standby  bool       `json:"standby,omitempty"`
+	LastPush *time.Time `json:"lastPush,omitempty"`
+	// LastFailure and LastError describe the most recent push which failed,
+	// if any
+	LastFailure *time.Time `json:"lastFailure,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+}
+
+// RegistrationStatus returns the tokens and number of tracked IDs registered
+// with the transmission key which signed the request, along with the time of
+// the last push to each token.
+func (nb *Impl) RegistrationStatus(msg *AccountRequest) (*RegistrationStatus, error) {
+	jww.INFO.Println("RegistrationStatus")
+	err := nb.verifyAccountRequest(msg, RegistrationStatusTag)
+	if err != nil {
+		return nil, err
+	}
+	return nb.registrationStatus(msg.TransmissionRsaPem)
+}
+
+// registrationStatus builds the registration status of the user with the
+// passed in transmission key.
+func (nb *Impl) registrationStatus(transmissionRsaPem []byte) (*RegistrationStatus, error) {
+	status := &RegistrationStatus{Devices: []DeviceStatus{}}
+	trsaHash, err := storage.HashTransmissionRSA(transmissionRsaPem)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to hash transmission RSA")
+	}
+	u, err := nb.Storage.GetUser(trsaHash)
+	if err != nil {
+		if errors.Is(err, errs.ErrNotRegistered) {
+			return status, nil
+		}
+		return nil, errors.WithMessage(err, "Failed to get user")
+	}
+	logs, err := nb.Storage.GetDeliveryLogs(trsaHash)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to get delivery logs")
+	}
+
+	status.TrackedIDs = len(u.Identities)
+	for _, t := range u.Tokens {
+		opened, err := nb.Storage.OpenToken(storage.GTNResult{Token: t.Token, SealedToken: t.SealedToken})
+		if err != nil {
+			return nil, errors.WithMessage(err, "Failed to open token")
+		}
+		device := DeviceStatus{Token: opened.Token, App: t.App, Standby: t.Standby}
+		// Logs are most recent first
+		for _, l := range logs {
+			if l.Token != t.Token {
+				continue
+			}
+			ts := l.Timestamp
+			if l.Error == "" && device.LastPush == nil {
+				device.LastPush = &ts
+			} else if l.Error != "" && device.LastFailure == nil {
+				device.LastFailure, device.LastError = &ts, l.Error
+			}
+			if device.LastPush != nil && device.LastFailure != nil {
+				break
+			}
+		}
+		status.Devices = append(status.Devices, device)
+	}
+	return status, nil
+}
+
+// handleRegistrationStatus serves RegistrationStatus for a JSON encoded
+// AccountRequest.
+func (nb *Impl) handleRegistrationStatus(w http.ResponseWriter, r *http.Request) {
+	msg, ok := decodeAccountRequest(w, r)
+	if !ok {
+		return
+	}
+	err := nb.verifyAccountRequest(msg, RegistrationStatusTag)
+	if err != nil {
+		adminError(w, http.StatusUnauthorized, err)
+		return
+	}
+	status, err := nb.registrationStatus(msg.TransmissionRsaPem)
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, status)
+}
+
+// AppOpened records that the client which signed the request opened the app,
+// so the next push it is sent is visible again when quietRepeatPushes is set.
+func (nb *Impl) AppOpened(msg *AccountRequest) error {
+	jww.DEBUG.Println("AppOpened")
+	err := nb.verifyAccountRequest(msg, AppOpenedTag)
+	if err != nil {
+		return err
+	}
+	return nb.appOpened(msg.TransmissionRsaPem)
+}
+
+// appOpened clears the notified flag of the user with the passed in
+// transmission key.
+func (nb *Impl) appOpened(transmissionRsaPem []byte) error {
+	trsaHash, err := storage.HashTransmissionRSA(transmissionRsaPem)
+	if err != nil {
+		return errors.WithMessage(err, "Failed to hash transmission RSA")
+	}
+	return nb.Storage.MarkAppOpened(trsaHash)
+}
+
+// handleAppOpened serves AppOpened for a JSON encoded AccountRequest.
+func (nb *Impl) handleAppOpened(w http.ResponseWriter, r *http.Request) {
+	msg, ok := decodeAccountRequest(w, r)
+	if !ok {
+		return
+	}
+	err := nb.verifyAccountRequest(msg, AppOpenedTag)
+	if err != nil {
+		adminError(w, http.StatusUnauthorized, err)
+		return
+	}
+	err = nb.appOpened(msg.TransmissionRsaPem)
+	if errors.Is(err, errs.ErrNotRegistered) {
+		adminError(w, http.StatusNotFound, errors.New("not registered"))
+		return
+	} else if err != nil {
+		adminError(w, http.StatusInternalServerError, errors.WithMessage(err, "Failed to record app open"))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SetDigest turns digest mode on or off for the client which signed the
+// request. The request is signed with EnableDigestTag or DisableDigestTag.
+func (nb *Impl) SetDigest(msg *AccountRequest, enabled bool) error {
+	jww.INFO.Printf("SetDigest(%t)", enabled)
+	err := nb.verifyAccountRequest(msg, digestTag(enabled))
+	if err != nil {
+		return err
+	}
+	return nb.setDigest(msg.TransmissionRsaPem, enabled)
+}
+
+// digestTag returns the tag signed into a request turning digest mode on or
+// off.
+func digestTag(enabled bool) notifications.NotificationTag {
+	if enabled {
+		return EnableDigestTag
+	}
+	return DisableDigestTag
+}
+
+// setDigest sets the digest preference of the user with the passed in
+// transmission key.
+func (nb *Impl) setDigest(transmissionRsaPem []byte, enabled bool) error {
+	trsaHash, err := storage.HashTransmissionRSA(transmissionRsaPem)
+	if err != nil {
+		return errors.WithMessage(err, "Failed to hash transmission RSA")
+	}
+	return nb.Storage.SetUserDigest(trsaHash, enabled)
+}
+
+// handleSetDigest returns a handler serving SetDigest for a JSON encoded
+// AccountRequest.
+func (nb *Impl) handleSetDigest(enabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		msg, ok := decodeAccountRequest(w, r)
+		if !ok {
+			return
+		}
+		err := nb.verifyAccountRequest(msg, digestTag(enabled))
+		if err != nil {
+			adminError(w, http.StatusUnauthorized, err)
+			return
+		}
+		err = nb.setDigest(msg.TransmissionRsaPem, enabled)
+		if errors.Is(err, errs.ErrNotRegistered) {
+			adminError(w, http.StatusNotFound, errors.New("not registered"))
+			return
+		} else if err != nil {
+			adminError(w, http.StatusInternalServerError, errors.WithMessage(err, "Failed to set digest mode"))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// decodeAccountRequest reads the AccountRequest posted in the body of r,
+// writing an error response and returning false if there is none.
+func decodeAccountRequest(w http.ResponseWriter, r *http.Request) (*AccountRequest, bool) {
+	if r.Method != http.MethodPost {
+		adminError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+		return nil, false
+	}
+	msg := &AccountRequest{}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAccountRequestBytes)).Decode(msg)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, errors.WithMessage(err, "Invalid request"))
+		return nil, false
+	}
+	return msg, true
+}
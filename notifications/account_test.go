@@ -0,0 +1,156 @@
+package notifications
+
+import (
+	"bytes"
+	"encoding/json"
+	"gitlab.com/elixxir/crypto/notifications"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gitlab.com/elixxir/notifications-bot/testutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// accountRequest returns an account request by the client with the passed in
+// tag, signed at the passed in time.
+func accountRequest(t *testing.T, c *testutil.Client, tag notifications.NotificationTag, at time.Time) *AccountRequest {
+	return &AccountRequest{
+		TransmissionRsaPem: c.TransmissionRsaPem,
+		RequestTimestamp:   at.UnixNano(),
+		Signature:          c.SignAccountRequest(t, tag, at),
+	}
+}
+
+// Tests that UnregisterAll removes every token of the signing client and
+// rejects requests signed for another purpose or by another key.
+func TestImpl_UnregisterAll(t *testing.T) {
+	s := testutil.NewStorage(t)
+	impl := &Impl{Storage: s}
+	c := testutil.NewClient(t)
+
+	for _, token := range []string{"token1", "token2"} {
+		if err := s.RegisterToken(token, "HavenIOS", c.TransmissionRsaPem); err != nil {
+			t.Fatalf("Failed to register token: %+v", err)
+		}
+	}
+
+	if err := impl.UnregisterAll(accountRequest(t, c, notifications.UnregisterTokenTag, time.Now())); err == nil {
+		t.Errorf("Request signed with another tag should be rejected")
+	}
+	forged := accountRequest(t, testutil.NewClient(t), UnregisterAllTag, time.Now())
+	forged.TransmissionRsaPem = c.TransmissionRsaPem
+	if err := impl.UnregisterAll(forged); err == nil {
+		t.Errorf("Request signed by another key should be rejected")
+	}
+	if err := impl.UnregisterAll(accountRequest(t, c, UnregisterAllTag, time.Now().Add(-time.Minute))); err == nil {
+		t.Errorf("Stale request should be rejected")
+	}
+
+	if err := impl.UnregisterAll(accountRequest(t, c, UnregisterAllTag, time.Now())); err != nil {
+		t.Fatalf("Failed to unregister all: %+v", err)
+	}
+	trsaHash, err := storage.HashTransmissionRSA(c.TransmissionRsaPem)
+	if err != nil {
+		t.Fatalf("Failed to hash transmission RSA: %+v", err)
+	}
+	u, err := s.GetUser(trsaHash)
+	if err != nil {
+		t.Fatalf("Failed to get user: %+v", err)
+	}
+	if len(u.Tokens) != 0 {
+		t.Errorf("Tokens remain after unregistering all: %+v", u.Tokens)
+	}
+}
+
+// Tests that the unregister all endpoint decodes signed requests and rejects
+// unsigned ones.
+func TestImpl_handleUnregisterAll(t *testing.T) {
+	impl := &Impl{Storage: testutil.NewStorage(t)}
+	c := testutil.NewClient(t)
+
+	post := func(msg *AccountRequest) int {
+		body, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatalf("Failed to encode request: %+v", err)
+		}
+		w := httptest.NewRecorder()
+		impl.handleUnregisterAll(w, httptest.NewRequest(http.MethodPost, "/unregisterAll", bytes.NewReader(body)))
+		return w.Code
+	}
+
+	if code := post(accountRequest(t, c, UnregisterAllTag, time.Now())); code != http.StatusNoContent {
+		t.Errorf("Expected status %d, received %d", http.StatusNoContent, code)
+	}
+	unsigned := accountRequest(t, c, UnregisterAllTag, time.Now())
+	unsigned.Signature = nil
+	if code := post(unsigned); code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for unsigned request, received %d", http.StatusUnauthorized, code)
+	}
+}
+
+// Tests that the registration status lists the client's devices with their
+// last successful and failed pushes and counts its tracked IDs.
+func TestImpl_RegistrationStatus(t *testing.T) {
+	s := testutil.NewStorage(t)
+	impl := &Impl{Storage: s}
+	c := testutil.NewClient(t)
+
+	status, err := impl.RegistrationStatus(accountRequest(t, c, RegistrationStatusTag, time.Now()))
+	if err != nil {
+		t.Fatalf("Failed to get status of unregistered client: %+v", err)
+	}
+	if len(status.Devices) != 0 || status.TrackedIDs != 0 {
+		t.Errorf("Unregistered client should have no registrations: %+v", status)
+	}
+
+	for _, token := range []string{"pushed", "idle"} {
+		if err = s.RegisterToken(token, "HavenIOS", c.TransmissionRsaPem); err != nil {
+			t.Fatalf("Failed to register token: %+v", err)
+		}
+	}
+	if err = s.RegisterTrackedID([][]byte{[]byte("intermediaryId")}, c.TransmissionRsaPem, 0, 8); err != nil {
+		t.Fatalf("Failed to register tracked ID: %+v", err)
+	}
+	trsaHash, err := storage.HashTransmissionRSA(c.TransmissionRsaPem)
+	if err != nil {
+		t.Fatalf("Failed to hash transmission RSA: %+v", err)
+	}
+	pushed, failed := time.Now().Add(-time.Hour).UTC().Round(time.Second), time.Now().UTC().Round(time.Second)
+	err = s.InsertDeliveryLogs([]*storage.DeliveryLog{
+		{TransmissionRSAHash: trsaHash, Token: "pushed", App: "HavenIOS", RoundId: 1, Timestamp: pushed.Add(-time.Hour)},
+		{TransmissionRSAHash: trsaHash, Token: "pushed", App: "HavenIOS", RoundId: 2, Timestamp: pushed},
+		{TransmissionRSAHash: trsaHash, Token: "pushed", App: "HavenIOS", RoundId: 3, Timestamp: failed, Error: "unavailable"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to insert delivery logs: %+v", err)
+	}
+
+	if _, err = impl.RegistrationStatus(accountRequest(t, c, UnregisterAllTag, time.Now())); err == nil {
+		t.Errorf("Request signed with another tag should be rejected")
+	}
+	status, err = impl.RegistrationStatus(accountRequest(t, c, RegistrationStatusTag, time.Now()))
+	if err != nil {
+		t.Fatalf("Failed to get status: %+v", err)
+	}
+	if len(status.Devices) != 2 || status.TrackedIDs != 1 {
+		t.Fatalf("Expected 2 devices and 1 tracked ID: %+v", status)
+	}
+	for _, d := range status.Devices {
+		switch d.Token {
+		case "pushed":
+			if d.LastPush == nil || !d.LastPush.Equal(pushed) {
+				t.Errorf("Expected last push at %s, got %v", pushed, d.LastPush)
+			}
+			if d.LastFailure == nil || !d.LastFailure.Equal(failed) || d.LastError != "unavailable" {
+				t.Errorf("Expected last failure at %s, got %v: %q", failed, d.LastFailure, d.LastError)
+			}
+		case "idle":
+			if d.LastPush != nil || d.LastFailure != nil {
+				t.Errorf("Idle device should have no pushes: %+v", d)
+			}
+		default:
+			t.Errorf("Unexpected device %+v", d)
+		}
+	}
+}
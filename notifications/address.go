@@ -0,0 +1,251 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Address handling for the hosts the bot connects to, which may be given as
+// IPv4 or IPv6 literals or as dual-stack host names
+
+package notifications
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/xx_network/primitives/ndf"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// AddressFamily selects which addresses of a dual-stack host are preferred.
+type AddressFamily string
+
+const (
+	// AnyFamily keeps the order returned by the resolver
+	AnyFamily AddressFamily = "any"
+	// PreferIPv4 and PreferIPv6 try addresses of that family first, falling
+	// back to the other family
+	PreferIPv4 AddressFamily = "ipv4"
+	PreferIPv6 AddressFamily = "ipv6"
+)
+
+// DefaultHappyEyeballsDelay is the delay before a connection attempt to the
+// next address of a host is started while earlier attempts are pending, as
+// recommended by RFC 8305.
+const DefaultHappyEyeballsDelay = 250 * time.Millisecond
+
+// Validate returns an error if the address family is not recognised.
+func (f AddressFamily) Validate() error {
+	switch f {
+	case "", AnyFamily, PreferIPv4, PreferIPv6:
+		return nil
+	}
+	return errors.Errorf("unknown address family %q, must be any, ipv4 or ipv6", f)
+}
+
+// normalizeAddress returns the passed in host:port in canonical form. IPv6
+// literals are bracketed and compressed, IPv4-mapped IPv6 addresses are
+// unmapped and host names are lowercased. Bare IPv6 literals are rejected, as
+// their port cannot be told apart from the address.
+func normalizeAddress(address string) (string, error) {
+	address = strings.TrimSpace(address)
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		if _, parseErr := netip.ParseAddr(address); parseErr == nil {
+			return "", errors.Errorf("address %q is missing a port; IPv6 addresses must be written as [address]:port", address)
+		}
+		return "", errors.WithMessagef(err, "Invalid address %q", address)
+	}
+	if host == "" || port == "" {
+		return "", errors.Errorf("address %q must have a host and port", address)
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return net.JoinHostPort(ip.Unmap().String(), port), nil
+	}
+	return net.JoinHostPort(strings.ToLower(host), port), nil
+}
+
+// orderAddresses sorts the addresses of a host for connection attempts,
+// alternating between families starting with the preferred one as described
+// in RFC 8305. The resolver's order is kept within each family.
+func orderAddresses(ips []netip.Addr, family AddressFamily) []netip.Addr {
+	var v4, v6 []netip.Addr
+	for _, ip := range ips {
+		ip = ip.Unmap()
+		if ip.Is4() {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	first, second := v6, v4
+	switch family {
+	case PreferIPv4:
+		first, second = v4, v6
+	case PreferIPv6:
+	default:
+		if len(ips) > 0 && ips[0].Unmap().Is4() {
+			first, second = v4, v6
+		}
+	}
+
+	ordered := make([]netip.Addr, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			ordered = append(ordered, first[i])
+		}
+		if i < len(second) {
+			ordered = append(ordered, second[i])
+		}
+	}
+	return ordered
+}
+
+// dialFunc opens a connection to the passed in host:port.
+type dialFunc func(ctx context.Context, address string) (net.Conn, error)
+
+// happyEyeballs races connections to the passed in addresses, starting each
+// attempt delay after the previous one unless it has already failed, and
+// returns the first address connected to.
+func happyEyeballs(ctx context.Context, addresses []string, delay time.Duration, dial dialFunc) (string, error) {
+	if len(addresses) == 0 {
+		return "", errors.New("no addresses to connect to")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		address string
+		err     error
+	}
+	results := make(chan result, len(addresses))
+	attempt := func(address string) {
+		conn, err := dial(ctx, address)
+		if err == nil {
+			_ = conn.Close()
+		}
+		results <- result{address, err}
+	}
+
+	next, pending := 0, 0
+	start := func() {
+		go attempt(addresses[next])
+		next++
+		pending++
+	}
+	start()
+	var lastErr error
+	for pending > 0 {
+		var stagger <-chan time.Time
+		var timer *time.Timer
+		if next < len(addresses) {
+			timer = time.NewTimer(delay)
+			stagger = timer.C
+		}
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				return r.address, nil
+			}
+			lastErr = r.err
+			// A failed attempt starts the next one without waiting
+			if next < len(addresses) {
+				start()
+			}
+		case <-stagger:
+			start()
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	return "", errors.WithMessagef(lastErr, "Failed to connect to any of %v", addresses)
+}
+
+// ResolveAddress returns the address to connect to for the passed in host:port.
+// Literal addresses are returned normalized. Host names are resolved and their
+// addresses raced in the order preferred by family, returning the first one
+// which accepts a connection. If no address can be connected to, the
+// normalized host name is returned so the connection is retried later.
+func ResolveAddress(ctx context.Context, address string, family AddressFamily, delay time.Duration) (string, error) {
+	normalized, err := normalizeAddress(address)
+	if err != nil {
+		return "", err
+	}
+	host, port, _ := net.SplitHostPort(normalized)
+	if _, err = netip.ParseAddr(host); err == nil {
+		return normalized, nil
+	}
+
+	resolved, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		jww.WARN.Printf("Failed to resolve %s, connecting by name: %+v", host, err)
+		return normalized, nil
+	}
+	var candidates []string
+	for _, ip := range orderAddresses(resolved, family) {
+		candidates = append(candidates, net.JoinHostPort(ip.String(), port))
+	}
+	if delay <= 0 {
+		delay = DefaultHappyEyeballsDelay
+	}
+	var d net.Dialer
+	chosen, err := happyEyeballs(ctx, candidates, delay, func(ctx context.Context, address string) (net.Conn, error) {
+		return d.DialContext(ctx, "tcp", address)
+	})
+	if err != nil {
+		jww.WARN.Printf("Failed to connect to any address of %s, connecting by name: %+v", host, err)
+		return normalized, nil
+	}
+	jww.INFO.Printf("Connecting to %s at %s", normalized, chosen)
+	return chosen, nil
+}
+
+// overrideGatewayAddresses normalizes the addresses of the gateways in the
+// passed in NDF, registering them as overrides so gateway hosts are created
+// with them. Host names are resolved to an address of the preferred family
+// if one is set; addresses which cannot be parsed are logged and left as is.
+func (nb *Impl) overrideGatewayAddresses(def *ndf.NetworkDefinition) {
+	overrides := nb.instance().GetIpOverrideList()
+	for _, gw := range def.Gateways {
+		gwID, err := gw.GetGatewayId()
+		if err != nil {
+			continue
+		}
+		address, err := normalizeAddress(gw.Address)
+		if err != nil {
+			jww.WARN.Printf("Gateway %s has an invalid address in the NDF: %+v", gwID, err)
+			continue
+		}
+		if nb.addressFamily == PreferIPv4 || nb.addressFamily == PreferIPv6 {
+			address = nb.preferFamily(address)
+		}
+		// Overridden even if unchanged, as overrides cannot be removed when
+		// a gateway leaves the NDF and may be stale if it returns
+		overrides.Override(gwID, address)
+	}
+}
+
+// preferFamily resolves the host of the passed in normalized address, returning
+// its first address of the preferred family, or the address unchanged if it is
+// a literal or cannot be resolved.
+func (nb *Impl) preferFamily(address string) string {
+	host, port, _ := net.SplitHostPort(address)
+	if _, err := netip.ParseAddr(host); err == nil {
+		return address
+	}
+	ctx, cancel := context.WithTimeout(nb.context(), 5*time.Second)
+	defer cancel()
+	resolved, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil || len(resolved) == 0 {
+		return address
+	}
+	return net.JoinHostPort(orderAddresses(resolved, nb.addressFamily)[0].String(), port)
+}
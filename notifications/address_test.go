@@ -0,0 +1,94 @@
+package notifications
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// Tests that addresses are normalized and that bare IPv6 literals are rejected.
+func Test_normalizeAddress(t *testing.T) {
+	valid := map[string]string{
+		"1.2.3.4:11420":              "1.2.3.4:11420",
+		" Gateway.Example.com:8443 ": "gateway.example.com:8443",
+		"[2001:DB8:0:0::1]:11420":    "[2001:db8::1]:11420",
+		"[::ffff:1.2.3.4]:11420":     "1.2.3.4:11420",
+		"[fe80::1%eth0]:11420":       "[fe80::1%eth0]:11420",
+	}
+	for in, expected := range valid {
+		out, err := normalizeAddress(in)
+		if err != nil {
+			t.Errorf("Failed to normalize %q: %+v", in, err)
+		} else if out != expected {
+			t.Errorf("Normalized %q to %q, expected %q", in, out, expected)
+		}
+	}
+	for _, in := range []string{"2001:db8::1", "2001:db8::1:11420", "gateway.example.com", ":11420", "[::1]:"} {
+		if out, err := normalizeAddress(in); err == nil {
+			t.Errorf("Normalizing %q should fail, returned %q", in, out)
+		}
+	}
+}
+
+// Tests that addresses alternate between families starting with the preferred
+// one.
+func Test_orderAddresses(t *testing.T) {
+	ips := []netip.Addr{
+		netip.MustParseAddr("1.1.1.1"),
+		netip.MustParseAddr("2.2.2.2"),
+		netip.MustParseAddr("::1"),
+		netip.MustParseAddr("::2"),
+		netip.MustParseAddr("3.3.3.3"),
+	}
+	expected := map[AddressFamily][]string{
+		AnyFamily:  {"1.1.1.1", "::1", "2.2.2.2", "::2", "3.3.3.3"},
+		PreferIPv4: {"1.1.1.1", "::1", "2.2.2.2", "::2", "3.3.3.3"},
+		PreferIPv6: {"::1", "1.1.1.1", "::2", "2.2.2.2", "3.3.3.3"},
+	}
+	for family, e := range expected {
+		ordered := orderAddresses(ips, family)
+		for i, ip := range ordered {
+			if ip.String() != e[i] {
+				t.Errorf("%s: expected %v, got %v", family, e, ordered)
+				break
+			}
+		}
+	}
+}
+
+// Tests that happy eyeballs falls back to the next address when an attempt
+// fails or stalls, and returns the first address connected to.
+func Test_happyEyeballs(t *testing.T) {
+	dial := func(_ context.Context, address string) (net.Conn, error) {
+		switch address {
+		case "refused":
+			return nil, errors.New("connection refused")
+		case "stalled":
+			time.Sleep(time.Second)
+			return nil, errors.New("timeout")
+		}
+		client, server := net.Pipe()
+		_ = server.Close()
+		return client, nil
+	}
+
+	start := time.Now()
+	chosen, err := happyEyeballs(context.Background(), []string{"refused", "stalled", "ok"}, 50*time.Millisecond, dial)
+	if err != nil {
+		t.Fatalf("Failed to connect: %+v", err)
+	}
+	if chosen != "ok" {
+		t.Errorf("Expected to connect to %q, connected to %q", "ok", chosen)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Stalled attempt should not delay fallback, took %s", elapsed)
+	}
+
+	_, err = happyEyeballs(context.Background(), []string{"refused", "refused"}, 50*time.Millisecond, dial)
+	if err == nil {
+		t.Errorf("Connecting should fail when every address is refused")
+	}
+}
@@ -0,0 +1,112 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// admin contains the operator-facing HTTP API of the notifications bot
+
+package notifications
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"net/http"
+	"strings"
+)
+
+// startAdmin serves the admin API on the passed in TCP address or unix socket
+// in a new thread.
+func (nb *Impl) startAdmin(address, token string) {
+	if token == "" {
+		jww.WARN.Println("Admin API address set without an admin token, not starting admin API")
+		return
+	}
+	serveHTTP("admin API", address, nb.adminHandler(token))
+}
+
+// adminHandler builds the handler for the admin API. All endpoints require the
+// passed in token to be sent as a bearer token.
+func (nb *Impl) adminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/deliveries", nb.handleDeliveries)
+	mux.HandleFunc("/analytics", nb.handleAnalytics)
+	mux.HandleFunc("/dlq", nb.handleDeadLetters)
+	mux.HandleFunc("/dlq/redrive", nb.handleRedrive)
+	mux.HandleFunc("/tokens/priority", nb.handleTokenPriority)
+	mux.HandleFunc("/tokens/sound", nb.handleTokenSound)
+	mux.HandleFunc("/tokens/locale", nb.handleTokenLocale)
+	mux.HandleFunc("/tokens/restore", nb.handleTokenRestore)
+	mux.HandleFunc("/tokens/versions", nb.handleTokenVersions)
+	mux.HandleFunc("/tokens/decommission", nb.handleDecommissionApp)
+	mux.HandleFunc("/blocklist", nb.handleBlocklist)
+	mux.HandleFunc("/features", nb.handleFeatures)
+	mux.HandleFunc("/broadcast", nb.handleBroadcast)
+	mux.HandleFunc("/registrars/reverify", nb.handleReverifyRegistrars)
+	mux.HandleFunc("/registrationBans", nb.handleRegistrationBans)
+	mux.HandleFunc("/canaries", nb.handleCanaries)
+	mux.HandleFunc("/gateways", nb.handleGateways)
+	mux.HandleFunc("/gateways/polls", nb.handleGatewayPolls)
+	mux.HandleFunc("/maintenance", nb.handleMaintenance)
+	mux.HandleFunc("/ingestion", nb.handleIngestion)
+	mux.HandleFunc("/faults", nb.handleFaults)
+	mux.HandleFunc("/metrics", nb.handleMetrics)
+	nb.registerDebug(mux)
+	return requireAdminToken(token, mux)
+}
+
+// requireAdminToken wraps the passed in handler, rejecting any request which
+// does not carry the expected bearer token.
+func requireAdminToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(received), []byte(token)) != 1 {
+			adminError(w, http.StatusUnauthorized, errors.New("invalid admin token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleDeliveries returns the delivery history for the user with the
+// base64 encoded transmission RSA hash passed in the transmissionRsaHash
+// query parameter.
+func (nb *Impl) handleDeliveries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		adminError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	trsaHash, err := base64.StdEncoding.DecodeString(r.URL.Query().Get("transmissionRsaHash"))
+	if err != nil || len(trsaHash) == 0 {
+		adminError(w, http.StatusBadRequest, errors.New("transmissionRsaHash must be a base64 encoded hash"))
+		return
+	}
+
+	logs, err := nb.Storage.GetDeliveryLogs(trsaHash)
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, errors.WithMessage(err, "Failed to get delivery logs"))
+		return
+	}
+	writeJSON(w, logs)
+}
+
+// writeJSON writes the passed in value to the response as JSON.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		jww.ERROR.Printf("Failed to write admin API response: %+v", err)
+	}
+}
+
+// adminError writes the passed in error to the response with the given status.
+func adminError(w http.ResponseWriter, status int, err error) {
+	jww.DEBUG.Printf("Admin API request failed: %+v", err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
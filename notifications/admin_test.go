@@ -0,0 +1,81 @@
+package notifications
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// newAdminRequest builds an admin API request with the passed in bearer token.
+func newAdminRequest(method, target, token string) *http.Request {
+	req := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+// Tests that the admin API rejects requests without the admin token.
+func TestImpl_adminHandler_Auth(t *testing.T) {
+	impl := &Impl{}
+	handler := impl.adminHandler("secret")
+
+	for _, token := range []string{"", "wrong"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newAdminRequest(http.MethodGet, "/deliveries", token))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status %d for token %q, received %d", http.StatusUnauthorized, token, w.Code)
+		}
+	}
+}
+
+// Tests that the deliveries endpoint returns the delivery logs for a user.
+func TestImpl_handleDeliveries(t *testing.T) {
+	s, err := storage.NewStorage("", "", "TestImpl_handleDeliveries", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+	impl := &Impl{Storage: s}
+	handler := impl.adminHandler("secret")
+
+	trsaHash := []byte("trsaHash")
+	err = s.InsertDeliveryLogs([]*storage.DeliveryLog{{
+		TransmissionRSAHash: trsaHash,
+		Token:               "token",
+		App:                 "app",
+		RoundId:             42,
+		MessageId:           "msg",
+		Status:              http.StatusOK,
+		Timestamp:           time.Now(),
+	}})
+	if err != nil {
+		t.Fatalf("Failed to insert delivery logs: %+v", err)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newAdminRequest(http.MethodGet, "/deliveries?transmissionRsaHash="+
+		url.QueryEscape(base64.StdEncoding.EncodeToString(trsaHash)), "secret"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, received %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	var logs []*storage.DeliveryLog
+	err = json.Unmarshal(w.Body.Bytes(), &logs)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal response: %+v", err)
+	}
+	if len(logs) != 1 || logs[0].RoundId != 42 || logs[0].MessageId != "msg" {
+		t.Errorf("Did not receive expected delivery logs: %+v", logs)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newAdminRequest(http.MethodGet, "/deliveries", "secret"))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for missing hash, received %d", http.StatusBadRequest, w.Code)
+	}
+}
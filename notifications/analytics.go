@@ -0,0 +1,102 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package notifications
+
+import (
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"net/http"
+	"time"
+)
+
+const (
+	// analyticsBackfillDays is the number of past days rolled up when the
+	// aggregator starts, covering days missed while the bot was down
+	analyticsBackfillDays = 7
+	// analyticsDefaultRange is the number of days returned by the admin API
+	// when no range is requested
+	analyticsDefaultRange = 30
+	// analyticsDayFormat is the format days are passed to the admin API in
+	analyticsDayFormat = "2006-01-02"
+)
+
+// startOfDay returns midnight UTC at the start of the day of t.
+func startOfDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+// rollupDays aggregates the delivery logs of the days from the day of from up
+// to and including the day of to.
+func (nb *Impl) rollupDays(from, to time.Time) error {
+	for day := startOfDay(from); !day.After(to); day = day.Add(24 * time.Hour) {
+		err := nb.Storage.RollupDeliveryLogs(day)
+		if err != nil {
+			return errors.WithMessagef(err, "Failed to roll up deliveries of %s", day.Format(analyticsDayFormat))
+		}
+	}
+	return nil
+}
+
+// AnalyticsAggregator is a long-running thread which rolls the delivery logs
+// up into daily per-app counters. The last week is backfilled on startup;
+// afterwards the current and previous day are refreshed every interval, so
+// sends logged around midnight are counted.
+func (nb *Impl) AnalyticsAggregator(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	now := nb.now()
+	err := nb.rollupDays(now.AddDate(0, 0, -analyticsBackfillDays), now)
+	if err != nil {
+		jww.WARN.Printf("Failed to backfill delivery analytics: %+v", err)
+	}
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		now = nb.now()
+		err = nb.rollupDays(now.AddDate(0, 0, -1), now)
+		if err != nil {
+			jww.WARN.Printf("Failed to roll up delivery analytics: %+v", err)
+		}
+	}
+}
+
+// handleAnalytics returns the daily delivery rollups for the days between
+// the from and to query parameters (YYYY-MM-DD, inclusive), by default the
+// last 30 days, optionally limited to the app parameter.
+func (nb *Impl) handleAnalytics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		adminError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	query := r.URL.Query()
+	to := startOfDay(nb.now())
+	from := to.AddDate(0, 0, -analyticsDefaultRange+1)
+	for param, day := range map[string]*time.Time{"from": &from, "to": &to} {
+		raw := query.Get(param)
+		if raw == "" {
+			continue
+		}
+		parsed, err := time.Parse(analyticsDayFormat, raw)
+		if err != nil {
+			adminError(w, http.StatusBadRequest, errors.Errorf("%s must be a date formatted as YYYY-MM-DD", param))
+			return
+		}
+		*day = parsed
+	}
+	if from.After(to) {
+		adminError(w, http.StatusBadRequest, errors.New("from must not be after to"))
+		return
+	}
+
+	rollups, err := nb.Storage.GetDeliveryRollups(from, to, query.Get("app"))
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, errors.WithMessage(err, "Failed to get delivery rollups"))
+		return
+	}
+	writeJSON(w, rollups)
+}
@@ -0,0 +1,69 @@
+package notifications
+
+import (
+	"encoding/json"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gitlab.com/elixxir/notifications-bot/testutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Tests that delivery logs are rolled up into daily per-app counters which
+// are served by the admin API.
+func TestImpl_handleAnalytics(t *testing.T) {
+	s := testutil.NewStorage(t)
+	impl := &Impl{Storage: s}
+	handler := impl.adminHandler("secret")
+
+	day := startOfDay(time.Now()).AddDate(0, 0, -2)
+	at := day.Add(time.Hour)
+	logs := []*storage.DeliveryLog{
+		// One send covering two rounds
+		{TransmissionRSAHash: []byte("a"), Token: "a", App: "app", RoundId: 1, Status: 200, Timestamp: at},
+		{TransmissionRSAHash: []byte("a"), Token: "a", App: "app", RoundId: 2, Status: 200, Timestamp: at},
+		{TransmissionRSAHash: []byte("a"), Token: "a", App: "app", RoundId: 3, Status: 200, Timestamp: at.Add(time.Minute)},
+		{TransmissionRSAHash: []byte("b"), Token: "b", App: "app", RoundId: 3, Status: 200, Timestamp: at},
+		{TransmissionRSAHash: []byte("c"), Token: "c", App: "app", RoundId: 3, Status: 410, Error: "unregistered", Timestamp: at},
+		{TransmissionRSAHash: []byte("d"), Token: "d", App: "app", RoundId: 3, Error: "timeout", Timestamp: at},
+		{TransmissionRSAHash: []byte("e"), Token: "e", App: "other", RoundId: 3, Timestamp: at},
+		// The next day
+		{TransmissionRSAHash: []byte("a"), Token: "a", App: "app", RoundId: 4, Timestamp: day.Add(25 * time.Hour)},
+	}
+	if err := s.InsertDeliveryLogs(logs); err != nil {
+		t.Fatalf("Failed to insert delivery logs: %+v", err)
+	}
+	if err := impl.rollupDays(day, day.Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to roll up deliveries: %+v", err)
+	}
+	// Rolling up again replaces the counters rather than adding to them
+	if err := impl.rollupDays(day, day.Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to roll up deliveries: %+v", err)
+	}
+
+	date := day.Format(analyticsDayFormat)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newAdminRequest(http.MethodGet, "/analytics?from="+date+"&to="+date+"&app=app", "secret"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	var rollups []*storage.DeliveryRollup
+	if err := json.NewDecoder(w.Body).Decode(&rollups); err != nil {
+		t.Fatalf("Failed to decode rollups: %+v", err)
+	}
+	if len(rollups) != 1 {
+		t.Fatalf("Expected 1 rollup, received %+v", rollups)
+	}
+	r := rollups[0]
+	if !r.Day.Equal(day) || r.App != "app" || r.Sent != 3 || r.Failed != 2 || r.UniqueIdentities != 2 ||
+		r.FailedByReason["410"] != 1 || r.FailedByReason["error"] != 1 {
+		t.Errorf("Unexpected rollup: %+v", r)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newAdminRequest(http.MethodGet, "/analytics?from=yesterday", "secret"))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for invalid date, received %d", http.StatusBadRequest, w.Code)
+	}
+}
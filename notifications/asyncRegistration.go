@@ -0,0 +1,303 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// During large registration bursts, such as an app release, registrations and
+// unregistrations made on the attestation address may be accepted into a
+// queue and verified and stored by background workers, keeping the latency of
+// the requests flat. Requests signed with the same transmission RSA key are
+// processed in the order they were received. Each queued request is
+// identified by an ack token derived from its signature, returned in the
+// RegistrationAck of the /async/ endpoints and the X-Registration-Ack header
+// of the registration gateway. Clients check the outcome of a request with its
+// ack token until the status expires. gRPC replies have no room for the ack
+// token, so requests over gRPC are processed before replying.
+
+package notifications
+
+import (
+	"encoding/hex"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	pb "gitlab.com/elixxir/comms/mixmessages"
+	"gitlab.com/elixxir/crypto/hash"
+	"hash/fnv"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// AsyncRegistrationParams configures asynchronous registration.
+type AsyncRegistrationParams struct {
+	// QueueSize is the number of registrations which may wait to be
+	// processed, split between the workers; registrations are processed as
+	// they are received if 0
+	QueueSize int
+	// Workers is the number of registrations processed at once. Each worker
+	// processes the requests of a share of the transmission RSA keys
+	Workers int
+	// StatusTTL is how long the outcome of a registration may be checked
+	// after it was processed
+	StatusTTL time.Duration
+}
+
+// AckState is the state of a queued registration.
+type AckState string
+
+const (
+	AckQueued     AckState = "queued"
+	AckRegistered AckState = "registered"
+	AckFailed     AckState = "failed"
+)
+
+// RegistrationAck is the status of a queued registration.
+type RegistrationAck struct {
+	Ack    string    `json:"ack"`
+	State  AckState  `json:"state"`
+	Error  string    `json:"error,omitempty"`
+	Queued time.Time `json:"queued"`
+	// Processed is when the registration was verified and stored or failed
+	Processed *time.Time `json:"processed,omitempty"`
+}
+
+// AckToken returns the ack token of a queued registration with the passed in
+// signature: the token signature of a RegisterTokenRequest or
+// UnregisterTokenRequest, or the signature of the tracked ID request of a
+// RegisterTrackedIdRequest or UnregisterTrackedIdRequest.
+func AckToken(signature []byte) string {
+	h, _ := hash.NewCMixHash()
+	h.Write(signature)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// queuedRegistration is a registration waiting to be processed.
+type queuedRegistration struct {
+	ack      string
+	register func() error
+}
+
+// asyncRegistrations queues registrations and holds their status.
+type asyncRegistrations struct {
+	params AsyncRegistrationParams
+	// queues holds the queue of each worker. The requests of a transmission
+	// RSA key are always put on the same queue, so they are processed in order
+	queues []chan queuedRegistration
+
+	mux  sync.Mutex
+	acks map[string]*RegistrationAck
+}
+
+// newAsyncRegistrations returns a queue configured by params, or nil if
+// asynchronous registration is disabled.
+func newAsyncRegistrations(params AsyncRegistrationParams) *asyncRegistrations {
+	if params.QueueSize <= 0 {
+		return nil
+	}
+	if params.Workers <= 0 {
+		params.Workers = 1
+	}
+	a := &asyncRegistrations{
+		params: params,
+		queues: make([]chan queuedRegistration, params.Workers),
+		acks:   map[string]*RegistrationAck{},
+	}
+	size := (params.QueueSize + params.Workers - 1) / params.Workers
+	for i := range a.queues {
+		a.queues[i] = make(chan queuedRegistration, size)
+	}
+	return a
+}
+
+// queueFor returns the queue of the requests signed with the passed in
+// transmission RSA key.
+func (a *asyncRegistrations) queueFor(transmissionRSA []byte) chan queuedRegistration {
+	h := fnv.New32a()
+	h.Write(transmissionRSA)
+	return a.queues[h.Sum32()%uint32(len(a.queues))]
+}
+
+// enqueue queues register under ack at now, behind the other requests signed
+// with the passed in transmission RSA key. A registration already queued
+// under ack is not queued again. Returns an error if the queue is full.
+func (a *asyncRegistrations) enqueue(transmissionRSA []byte, ack string, register func() error, now time.Time) (RegistrationAck, error) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	if status, ok := a.acks[ack]; ok && status.State == AckQueued {
+		return *status, nil
+	}
+	select {
+	case a.queueFor(transmissionRSA) <- queuedRegistration{ack: ack, register: register}:
+	default:
+		return RegistrationAck{}, errors.New("Registration queue is full, retry later")
+	}
+	status := &RegistrationAck{Ack: ack, State: AckQueued, Queued: now}
+	a.acks[ack] = status
+	return *status, nil
+}
+
+// done records the outcome of the registration queued under ack.
+func (a *asyncRegistrations) done(ack string, err error, now time.Time) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	status, ok := a.acks[ack]
+	if !ok {
+		return
+	}
+	status.State = AckRegistered
+	if err != nil {
+		status.State, status.Error = AckFailed, err.Error()
+	}
+	status.Processed = &now
+}
+
+// status returns the status of the registration queued under ack.
+func (a *asyncRegistrations) status(ack string) (RegistrationAck, bool) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	status, ok := a.acks[ack]
+	if !ok {
+		return RegistrationAck{}, false
+	}
+	return *status, true
+}
+
+// sweep drops the status of registrations processed more than the status TTL
+// before now.
+func (a *asyncRegistrations) sweep(now time.Time) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	for ack, status := range a.acks {
+		if status.Processed != nil && now.Sub(*status.Processed) > a.params.StatusTTL {
+			delete(a.acks, ack)
+		}
+	}
+}
+
+// AsyncRegistrar processes queued registrations until the bot is stopped.
+// It returns immediately if asynchronous registration is disabled.
+func (nb *Impl) AsyncRegistrar() {
+	if nb.asyncRegistrations == nil {
+		return
+	}
+	for _, queue := range nb.asyncRegistrations.queues {
+		go nb.processRegistrations(queue)
+	}
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-nb.context().Done():
+			return
+		case <-ticker.C:
+			nb.asyncRegistrations.sweep(nb.now())
+		}
+	}
+}
+
+// processRegistrations verifies and stores the registrations of queue in
+// order until the bot is stopped.
+func (nb *Impl) processRegistrations(queue <-chan queuedRegistration) {
+	a := nb.asyncRegistrations
+	for {
+		select {
+		case <-nb.context().Done():
+			return
+		case q := <-queue:
+			err := q.register()
+			if err != nil {
+				jww.DEBUG.Printf("Rejected queued registration %s: %+v", q.ack, err)
+			}
+			a.done(q.ack, err, nb.now())
+		}
+	}
+}
+
+// registerAsync queues register under ack if asynchronous registration is
+// enabled, returning its RegistrationAck, and otherwise calls it and returns
+// a nil RegistrationAck. Registrations signed with a banned transmission RSA
+// key are refused before they are queued.
+func (nb *Impl) registerAsync(transmissionRSA []byte, ack string, register func() error) (*RegistrationAck, error) {
+	if nb.asyncRegistrations == nil {
+		return nil, register()
+	}
+	if err := nb.checkBanned(transmissionRSA); err != nil {
+		return nil, err
+	}
+	status, err := nb.asyncRegistrations.enqueue(transmissionRSA, ack, register, nb.now())
+	if err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// handleRegisterTokenAsync queues the registration of a JSON encoded
+// RegisterTokenRequest and its options, returning its RegistrationAck.
+func (nb *Impl) handleRegisterTokenAsync(w http.ResponseWriter, r *http.Request) {
+	msg := &registerTokenBody{RegisterTokenRequest: &pb.RegisterTokenRequest{}}
+	if !decodeRegistration(w, r, msg) {
+		return
+	}
+	nb.handleEnqueue(w, msg.RegisterTokenRequest.TransmissionRsaPem, AckToken(msg.RegisterTokenRequest.TokenSignature), func() error {
+		return nb.registerToken(msg.RegisterTokenRequest, msg.TokenOptions)
+	})
+}
+
+// handleRegisterTrackedIDAsync queues the registration of a JSON encoded
+// RegisterTrackedIdRequest, returning its RegistrationAck.
+func (nb *Impl) handleRegisterTrackedIDAsync(w http.ResponseWriter, r *http.Request) {
+	msg := &pb.RegisterTrackedIdRequest{}
+	if !decodeRegistration(w, r, msg) {
+		return
+	}
+	if msg.Request == nil {
+		adminError(w, http.StatusBadRequest, errors.New("Request must include the tracked IDs"))
+		return
+	}
+	nb.handleEnqueue(w, msg.Request.TransmissionRsaPem, AckToken(msg.Request.Signature), func() error {
+		return nb.RegisterTrackedID(msg)
+	})
+}
+
+// handleEnqueue queues register under ack and writes its RegistrationAck.
+// Registrations signed with a banned transmission RSA key are refused before
+// they are queued.
+func (nb *Impl) handleEnqueue(w http.ResponseWriter, transmissionRSA []byte, ack string, register func() error) {
+	if nb.asyncRegistrations == nil {
+		adminError(w, http.StatusNotFound, errors.New("asynchronous registration is disabled"))
+		return
+	}
+	if err := nb.checkBanned(transmissionRSA); err != nil {
+		adminError(w, http.StatusForbidden, err)
+		return
+	}
+	status, err := nb.asyncRegistrations.enqueue(transmissionRSA, ack, register, nb.now())
+	if err != nil {
+		adminError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, status)
+}
+
+// handleRegistrationAck serves the RegistrationAck of the registration queued
+// under the ack query parameter.
+func (nb *Impl) handleRegistrationAck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		adminError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	if nb.asyncRegistrations == nil {
+		adminError(w, http.StatusNotFound, errors.New("asynchronous registration is disabled"))
+		return
+	}
+	status, ok := nb.asyncRegistrations.status(r.URL.Query().Get("ack"))
+	if !ok {
+		adminError(w, http.StatusNotFound, errors.New("unknown or expired ack token"))
+		return
+	}
+	writeJSON(w, status)
+}
@@ -0,0 +1,164 @@
+package notifications
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/notifications-bot/clock"
+	"gitlab.com/elixxir/notifications-bot/errs"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Tests that queued registrations are acknowledged at once, processed in the
+// background and their outcome served until the status expires.
+func TestImpl_registerAsync(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	impl := &Impl{clock: fake, ctx: ctx, asyncRegistrations: newAsyncRegistrations(AsyncRegistrationParams{
+		QueueSize: 1, Workers: 1, StatusTTL: time.Minute,
+	})}
+	a := impl.asyncRegistrations
+
+	release := make(chan struct{})
+	trsa := []byte("transmission RSA")
+	ok, bad := AckToken([]byte("ok")), AckToken([]byte("bad"))
+	if _, err := impl.registerAsync(trsa, ok, func() error { <-release; return nil }); err != nil {
+		t.Fatalf("Failed to queue registration: %+v", err)
+	}
+	// Retries of a queued registration are not queued again
+	if _, err := impl.registerAsync(trsa, ok, func() error { t.Error("Retry should not be processed"); return nil }); err != nil {
+		t.Fatalf("Failed to queue retried registration: %+v", err)
+	}
+	if _, err := impl.registerAsync(trsa, bad, func() error { return nil }); err == nil {
+		t.Fatalf("Registration should be refused while the queue is full")
+	}
+
+	go impl.processRegistrations(a.queues[0])
+	close(release)
+	waitForAck(t, a, ok, AckRegistered)
+	if _, err := impl.registerAsync(trsa, bad, func() error { return errors.New("bad signature") }); err != nil {
+		t.Fatalf("Failed to queue registration: %+v", err)
+	}
+	waitForAck(t, a, bad, AckFailed)
+
+	handler := http.HandlerFunc(impl.handleRegistrationAck)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/async/status?ack="+bad, nil))
+	var status RegistrationAck
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("Failed to decode status: %+v", err)
+	}
+	if status.State != AckFailed || status.Error != "bad signature" || status.Processed == nil {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+
+	fake.Advance(2 * time.Minute)
+	a.sweep(fake.Now())
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/async/status?ack="+bad, nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expired status should 404, got %d", w.Code)
+	}
+
+	disabled := &Impl{}
+	if _, err := disabled.registerAsync(trsa, ok, func() error { return errors.New("sync") }); err == nil {
+		t.Errorf("Registrations should be processed at once with the queue disabled")
+	}
+}
+
+// Tests that the requests of a transmission RSA key are processed in the order
+// they were queued, while other keys' requests are processed by other workers.
+func TestImpl_registerAsync_Ordered(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	impl := &Impl{clock: clock.NewFake(time.Now()), ctx: ctx,
+		asyncRegistrations: newAsyncRegistrations(AsyncRegistrationParams{
+			QueueSize: 64, Workers: 4, StatusTTL: time.Minute,
+		})}
+	a := impl.asyncRegistrations
+	if len(a.queues) != 4 || cap(a.queues[0]) != 16 {
+		t.Fatalf("Expected 4 queues of 16, got %d of %d", len(a.queues), cap(a.queues[0]))
+	}
+	trsa := []byte("transmission RSA")
+	if a.queueFor(trsa) != a.queueFor([]byte("transmission RSA")) {
+		t.Errorf("Requests of a key should share a queue")
+	}
+
+	var mux sync.Mutex
+	var order []int
+	var last string
+	for i := 0; i < 10; i++ {
+		i := i
+		last = AckToken([]byte{byte(i)})
+		_, err := impl.registerAsync(trsa, last, func() error {
+			mux.Lock()
+			defer mux.Unlock()
+			order = append(order, i)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Failed to queue request %d: %+v", i, err)
+		}
+	}
+	for _, queue := range a.queues {
+		go impl.processRegistrations(queue)
+	}
+	waitForAck(t, a, last, AckRegistered)
+	mux.Lock()
+	defer mux.Unlock()
+	for i, processed := range order {
+		if processed != i {
+			t.Fatalf("Requests should be processed in the order queued, got %v", order)
+		}
+	}
+}
+
+// Tests that registrations signed with a banned key are refused before they
+// are queued, both over RPC and the HTTP API.
+func TestImpl_registerAsync_Banned(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	impl := &Impl{clock: fake,
+		asyncRegistrations: newAsyncRegistrations(AsyncRegistrationParams{
+			QueueSize: 1, Workers: 1, StatusTTL: time.Minute,
+		}),
+		registrationBans: newRegistrationBans(RegistrationBanParams{
+			Threshold: 1, Window: time.Minute, Duration: time.Minute,
+		}),
+	}
+	trsa := []byte("transmission RSA")
+	impl.registrationBans.observe(clientPeer(trsa), errs.ErrInvalidSignature, fake.Now())
+
+	ack := AckToken([]byte("banned"))
+	if _, err := impl.registerAsync(trsa, ack, func() error { return nil }); err == nil {
+		t.Errorf("Registration from a banned source should be refused")
+	}
+	w := httptest.NewRecorder()
+	impl.handleEnqueue(w, trsa, ack, func() error { return nil })
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d, got %d", http.StatusForbidden, w.Code)
+	}
+	if _, queued := impl.asyncRegistrations.status(ack); queued {
+		t.Errorf("Banned registration should not be queued")
+	}
+
+	if _, err := impl.registerAsync([]byte("other RSA"), ack, func() error { return nil }); err != nil {
+		t.Errorf("Registrations from other sources should be queued: %+v", err)
+	}
+}
+
+// waitForAck waits for the registration queued under ack to reach state.
+func waitForAck(t *testing.T, a *asyncRegistrations, ack string, state AckState) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if status, ok := a.status(ack); ok && status.State == state {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Registration %s did not reach state %s", ack, state)
+}
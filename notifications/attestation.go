@@ -0,0 +1,153 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package notifications
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/crypto/hash"
+	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/xx_network/crypto/signature/rsa"
+	"net/http"
+)
+
+// Attestation describes the bot to clients before they register. It is signed
+// with the bot's RSA key; clients check the signature against the key of the
+// notification bot certificate in their NDF, so an impostor serving its own
+// certificate is detected.
+type Attestation struct {
+	Certificate string
+	Providers   []string
+	Apps        []string
+	// ProtocolVersion and MinProtocolVersion bound the client protocol
+	// versions served
+	ProtocolVersion    int
+	MinProtocolVersion int
+	Timestamp          int64
+	Signature          []byte
+	// NextSignature is by the key the bot is rotating to, during the grace
+	// period of a key rotation
+	NextSignature []byte
+}
+
+// digest returns the hash of the attestation's fields which is signed.
+func (a *Attestation) digest() ([]byte, error) {
+	h, err := hash.NewCMixHash()
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to create hash")
+	}
+	write := func(b []byte) {
+		var l [4]byte
+		binary.BigEndian.PutUint32(l[:], uint32(len(b)))
+		h.Write(l[:])
+		h.Write(b)
+	}
+	var versions [8]byte
+	binary.BigEndian.PutUint32(versions[:4], uint32(a.ProtocolVersion))
+	binary.BigEndian.PutUint32(versions[4:], uint32(a.MinProtocolVersion))
+	h.Write(versions[:])
+	write([]byte(a.Certificate))
+	for _, list := range [][]string{a.Providers, a.Apps} {
+		var n [4]byte
+		binary.BigEndian.PutUint32(n[:], uint32(len(list)))
+		h.Write(n[:])
+		for _, s := range list {
+			write([]byte(s))
+		}
+	}
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(a.Timestamp))
+	h.Write(ts[:])
+	return h.Sum(nil), nil
+}
+
+// Verify checks the attestation's signature against the passed in public key
+// of the notification bot, or the key it is rotating to.
+func (a *Attestation) Verify(key *rsa.PublicKey) error {
+	digest, err := a.digest()
+	if err != nil {
+		return err
+	}
+	return verifyEither(key, digest, a.Signature, a.NextSignature)
+}
+
+// Attestation returns the bot's certificate, the apps it has providers for,
+// the push services behind them and the protocol versions it serves, signed
+// with the bot's RSA key.
+func (nb *Impl) Attestation() (*Attestation, error) {
+	if nb.signingKey == nil {
+		return nil, errors.New("bot is running without a key, cannot sign attestation")
+	}
+	a := &Attestation{
+		Certificate:        string(nb.currentCertificate()),
+		ProtocolVersion:    ProtocolVersion,
+		MinProtocolVersion: nb.minProtocolVersion(),
+		Timestamp:          nb.now().Unix(),
+	}
+	seen := map[string]struct{}{}
+	for _, app := range constants.Apps {
+		if nb.providers[app.String()] == nil {
+			continue
+		}
+		a.Apps = append(a.Apps, app.String())
+		if _, ok := seen[app.Provider()]; !ok {
+			seen[app.Provider()] = struct{}{}
+			a.Providers = append(a.Providers, app.Provider())
+		}
+	}
+
+	digest, err := a.digest()
+	if err != nil {
+		return nil, err
+	}
+	a.Signature, a.NextSignature, err = nb.sign(digest)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to sign attestation")
+	}
+	return a, nil
+}
+
+// startAttestation serves the attestation, the signed account requests and the
+// registration gateway to clients on the passed in address in a new thread.
+// Unlike the admin API it is public; account requests are authenticated by
+// their signatures.
+func (nb *Impl) startAttestation(address string, gatewayOrigins []string) {
+	mux := http.NewServeMux()
+	mux.Handle(gatewayPrefix, nb.gatewayHandler(gatewayOrigins))
+	mux.HandleFunc("/attestation", nb.handleAttestation)
+	mux.HandleFunc("/registerToken", nb.handleRegisterToken)
+	mux.HandleFunc("/registerTrackedID", nb.handleRegisterTrackedID)
+	mux.HandleFunc("/async/registerToken", nb.handleRegisterTokenAsync)
+	mux.HandleFunc("/async/registerTrackedID", nb.handleRegisterTrackedIDAsync)
+	mux.HandleFunc("/async/status", nb.handleRegistrationAck)
+	mux.HandleFunc("/unregisterAll", nb.handleUnregisterAll)
+	mux.HandleFunc("/status", nb.handleRegistrationStatus)
+	mux.HandleFunc("/opened", nb.handleAppOpened)
+	mux.HandleFunc("/digest/enable", nb.handleSetDigest(true))
+	mux.HandleFunc("/digest/disable", nb.handleSetDigest(false))
+	mux.HandleFunc("/identityPreimages", nb.handleSetIdentityPreimages)
+	mux.HandleFunc("/identityConversation", nb.handleSetIdentityConversation)
+	mux.HandleFunc("/conversations/mute", nb.handleSetMutedConversations)
+	mux.HandleFunc("/history", nb.handlePushHistory)
+	mux.HandleFunc("/test", nb.handleTestNotification)
+	serveHTTP("attestation", address, mux)
+}
+
+// handleAttestation serves a freshly signed attestation.
+func (nb *Impl) handleAttestation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		adminError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	a, err := nb.Attestation()
+	if err != nil {
+		adminError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	writeJSON(w, a)
+}
@@ -0,0 +1,79 @@
+package notifications
+
+import (
+	"encoding/json"
+	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/elixxir/notifications-bot/notifications/providers"
+	"gitlab.com/xx_network/crypto/signature/rsa"
+	"gitlab.com/xx_network/primitives/utils"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// Tests that the attestation lists the configured apps and providers and
+// verifies against the bot's public key, and that altering it is detected.
+func TestImpl_Attestation(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Failed to get working directory: %+v", err)
+	}
+	cert, err := utils.ReadFile(wd + "/../testutil/cmix.rip.crt")
+	if err != nil {
+		t.Fatalf("Failed to read certificate: %+v", err)
+	}
+	keyPem, err := utils.ReadFile(wd + "/../testutil/cmix.rip.key")
+	if err != nil {
+		t.Fatalf("Failed to read key: %+v", err)
+	}
+	key, err := rsa.LoadPrivateKeyFromPem(keyPem)
+	if err != nil {
+		t.Fatalf("Failed to load key: %+v", err)
+	}
+
+	impl := &Impl{
+		certificate: cert,
+		signingKey:  key,
+		providers: map[string]providers.Provider{
+			constants.MessengerIOS.String():     &MockProvider{},
+			constants.MessengerAndroid.String(): &MockProvider{},
+			constants.HavenIOS.String():         &MockProvider{},
+		},
+	}
+
+	resp := httptest.NewRecorder()
+	impl.handleAttestation(resp, httptest.NewRequest(http.MethodGet, "/attestation", nil))
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", resp.Code, resp.Body.String())
+	}
+	a := &Attestation{}
+	if err = json.Unmarshal(resp.Body.Bytes(), a); err != nil {
+		t.Fatalf("Failed to unmarshal attestation: %+v", err)
+	}
+
+	expectedApps := []string{constants.MessengerIOS.String(), constants.MessengerAndroid.String(), constants.HavenIOS.String()}
+	if !reflect.DeepEqual(a.Apps, expectedApps) {
+		t.Errorf("Unexpected apps\n\tExpected: %v\n\tReceived: %v", expectedApps, a.Apps)
+	}
+	if !reflect.DeepEqual(a.Providers, []string{"apns", "fcm"}) {
+		t.Errorf("Unexpected providers: %v", a.Providers)
+	}
+	if a.Certificate != string(cert) || a.ProtocolVersion != ProtocolVersion || a.MinProtocolVersion != ProtocolLegacy {
+		t.Errorf("Attestation did not contain expected data: %+v", a)
+	}
+
+	if err = a.Verify(key.GetPublic()); err != nil {
+		t.Errorf("Failed to verify attestation: %+v", err)
+	}
+	a.Apps = append(a.Apps, constants.MessengerWeb.String())
+	if err = a.Verify(key.GetPublic()); err == nil {
+		t.Errorf("Altered attestation should not verify")
+	}
+
+	impl.signingKey = nil
+	if _, err = impl.Attestation(); err == nil {
+		t.Errorf("Attestation should fail without a key")
+	}
+}
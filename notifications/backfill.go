@@ -0,0 +1,155 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Gateways only send notification batches to a running bot, so rounds which
+// complete while it is down are otherwise never pushed. On startup the bot
+// fetches the batches of rounds after its last gateway watermark from a
+// historical rounds endpoint and processes them like received batches.
+
+package notifications
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	pb "gitlab.com/elixxir/comms/mixmessages"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// backfillSender is the sender batch keys of backfilled batches are recorded
+// under.
+const backfillSender = "backfill"
+
+// BackfillParams configures catching up on rounds missed while the bot was
+// down.
+type BackfillParams struct {
+	// URL of the historical rounds endpoint; backfill is disabled if empty
+	URL string
+	// MaxCatchUp bounds how far back rounds are backfilled. Rounds completed
+	// longer ago are skipped, as their notifications are no longer useful
+	MaxCatchUp time.Duration
+	// Timeout bounds the request to the endpoint; unbounded if 0
+	Timeout time.Duration
+}
+
+// BatchSource returns the notification batches of rounds completed after a
+// round and a time.
+type BatchSource interface {
+	Batches(ctx context.Context, afterRound uint64, since time.Time) ([]*pb.NotificationBatch, error)
+}
+
+// httpBatchSource fetches batches from a historical rounds endpoint serving
+// a JSON encoded list of NotificationBatch messages for the afterRound and
+// since (Unix seconds) query parameters.
+type httpBatchSource struct {
+	url    string
+	client *http.Client
+}
+
+// newHTTPBatchSource returns a BatchSource for the endpoint at the passed in
+// URL.
+func newHTTPBatchSource(endpoint string) (*httpBatchSource, error) {
+	if _, err := url.Parse(endpoint); err != nil {
+		return nil, errors.WithMessage(err, "Invalid backfill URL")
+	}
+	return &httpBatchSource{url: endpoint, client: &http.Client{}}, nil
+}
+
+// Batches implements BatchSource.
+func (s *httpBatchSource) Batches(ctx context.Context, afterRound uint64, since time.Time) ([]*pb.NotificationBatch, error) {
+	u, err := url.Parse(s.url)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Invalid backfill URL")
+	}
+	q := u.Query()
+	q.Set("afterRound", strconv.FormatUint(afterRound, 10))
+	q.Set("since", strconv.FormatInt(since.Unix(), 10))
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to build backfill request")
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to request rounds to backfill")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("Backfill endpoint returned %s", resp.Status)
+	}
+	var batches []*pb.NotificationBatch
+	err = json.NewDecoder(resp.Body).Decode(&batches)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to decode rounds to backfill")
+	}
+	return batches, nil
+}
+
+// Backfill processes the batches of rounds completed after the highest round
+// accepted from any gateway, and no longer ago than the max catch-up window.
+// It does nothing if backfill is not configured or no batch was ever
+// accepted. Batches are deduplicated against those gateways resend.
+func (nb *Impl) Backfill() {
+	if nb.backfillSource == nil {
+		return
+	}
+	watermarks, err := nb.Storage.GetGatewayWatermarks()
+	if err != nil {
+		jww.ERROR.Printf("Failed to get gateway watermarks to backfill from: %+v", err)
+		return
+	}
+	if len(watermarks) == 0 {
+		jww.INFO.Printf("No notification batches accepted yet, nothing to backfill")
+		return
+	}
+	var after uint64
+	var since time.Time
+	for _, wm := range watermarks {
+		if wm.LastRound > after {
+			after = wm.LastRound
+		}
+		if wm.ReceivedAt.After(since) {
+			since = wm.ReceivedAt
+		}
+	}
+	if floor := nb.now().Add(-nb.backfill.MaxCatchUp); nb.backfill.MaxCatchUp > 0 && since.Before(floor) {
+		jww.WARN.Printf("Last notification batch was accepted at %s, only backfilling rounds since %s",
+			since, floor)
+		since = floor
+	}
+
+	ctx, cancel := withTimeout(nb.context(), nb.backfill.Timeout)
+	batches, err := nb.backfillSource.Batches(ctx, after, since)
+	cancel()
+	if err != nil {
+		jww.ERROR.Printf("Failed to backfill rounds after %d: %+v", after, err)
+		return
+	}
+	sort.Slice(batches, func(i, j int) bool { return batches[i].RoundID < batches[j].RoundID })
+
+	accepted := 0
+	for _, batch := range batches {
+		if batch.RoundID <= after {
+			continue
+		}
+		ok, err := nb.acceptBatch(batch, backfillSender)
+		if err != nil {
+			jww.ERROR.Printf("Failed to backfill round %d: %+v", batch.RoundID, err)
+			continue
+		}
+		if ok {
+			accepted++
+		}
+	}
+	jww.INFO.Printf("Backfilled %d of %d rounds after round %d", accepted, len(batches), after)
+}
@@ -0,0 +1,70 @@
+package notifications
+
+import (
+	"context"
+	pb "gitlab.com/elixxir/comms/mixmessages"
+	"gitlab.com/elixxir/notifications-bot/testutil"
+	"testing"
+	"time"
+)
+
+// staticBatchSource returns the same batches for every request, recording
+// the bounds it was asked for.
+type staticBatchSource struct {
+	batches    []*pb.NotificationBatch
+	afterRound uint64
+	since      time.Time
+}
+
+func (s *staticBatchSource) Batches(_ context.Context, afterRound uint64, since time.Time) ([]*pb.NotificationBatch, error) {
+	s.afterRound, s.since = afterRound, since
+	return s.batches, nil
+}
+
+// Tests that rounds after the highest gateway watermark are buffered, bounded
+// by the max catch-up window, and that a second backfill does not buffer them
+// again.
+func TestImpl_Backfill(t *testing.T) {
+	s := testutil.NewStorage(t)
+	batch := func(round uint64) *pb.NotificationBatch {
+		return &pb.NotificationBatch{
+			RoundID:       round,
+			Notifications: []*pb.NotificationData{{EphemeralID: int64(round), MessageHash: []byte("hash")}},
+		}
+	}
+	source := &staticBatchSource{batches: []*pb.NotificationBatch{batch(7), batch(4), batch(6)}}
+	impl := &Impl{
+		Storage:        s,
+		backfillSource: source,
+		backfill:       BackfillParams{MaxCatchUp: time.Hour},
+	}
+
+	lastBatch := time.Now().Add(-2 * time.Hour)
+	if err := s.UpsertGatewayWatermark("gw1", 3, lastBatch); err != nil {
+		t.Fatalf("Failed to record watermark: %+v", err)
+	}
+	if err := s.UpsertGatewayWatermark("gw2", 5, lastBatch); err != nil {
+		t.Fatalf("Failed to record watermark: %+v", err)
+	}
+
+	impl.Backfill()
+	if source.afterRound != 5 {
+		t.Errorf("Expected rounds after the highest watermark to be requested, got %d", source.afterRound)
+	}
+	if time.Since(source.since) > time.Hour+time.Minute {
+		t.Errorf("Backfill should be bounded by the max catch-up window, requested since %s", source.since)
+	}
+	buffered := s.GetNotificationBuffer().Swap()
+	if len(buffered) != 2 || len(buffered[6]) != 1 || len(buffered[7]) != 1 {
+		t.Errorf("Expected rounds 6 and 7 to be buffered, got %+v", buffered)
+	}
+
+	impl.roundStore.Range(func(key, _ interface{}) bool {
+		impl.roundStore.Delete(key)
+		return true
+	})
+	impl.Backfill()
+	if buffered = s.GetNotificationBuffer().Swap(); len(buffered) != 0 {
+		t.Errorf("Backfilled rounds should not be buffered again, got %+v", buffered)
+	}
+}
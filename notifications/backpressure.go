@@ -0,0 +1,75 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package notifications
+
+import (
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// backpressurePoll is how often a delayed batch checks for buffer space.
+const backpressurePoll = 50 * time.Millisecond
+
+// ingestionStats counts batches affected by backpressure.
+type ingestionStats struct {
+	delayed  uint64
+	rejected uint64
+}
+
+// hasCapacity returns true if n more notifications fit in the buffer. A batch
+// is always admitted to an empty buffer so that oversized batches can progress.
+func (nb *Impl) hasCapacity(n int) bool {
+	if nb.maxBuffered <= 0 {
+		return true
+	}
+	buffered := nb.Storage.GetNotificationBuffer().Len()
+	return buffered == 0 || buffered+int64(n) <= int64(nb.maxBuffered)
+}
+
+// admitBatch applies backpressure to a batch of n notifications. If the
+// buffer is full, it waits up to the backpressure delay for the sender to
+// free space, then rejects the batch so the gateway can retry it later.
+func (nb *Impl) admitBatch(n int) error {
+	if nb.hasCapacity(n) {
+		return nil
+	}
+
+	if nb.backpressureDelay > 0 {
+		atomic.AddUint64(&nb.ingestion.delayed, 1)
+		deadline := time.Now().Add(nb.backpressureDelay)
+		for time.Now().Before(deadline) {
+			time.Sleep(backpressurePoll)
+			if nb.hasCapacity(n) {
+				return nil
+			}
+		}
+	}
+
+	atomic.AddUint64(&nb.ingestion.rejected, 1)
+	depth := nb.Storage.GetNotificationBuffer().Len()
+	jww.WARN.Printf("Rejecting batch of %d notifications, buffer holds %d of %d", n, depth, nb.maxBuffered)
+	return errors.Errorf("Notification buffer is full (%d of %d), retry later", depth, nb.maxBuffered)
+}
+
+// handleIngestion reports the depth of the notification buffer and the number
+// of batches delayed or rejected by backpressure.
+func (nb *Impl) handleIngestion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		adminError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"depth":    nb.Storage.GetNotificationBuffer().Len(),
+		"capacity": nb.maxBuffered,
+		"delayed":  atomic.LoadUint64(&nb.ingestion.delayed),
+		"rejected": atomic.LoadUint64(&nb.ingestion.rejected),
+	})
+}
@@ -0,0 +1,44 @@
+package notifications
+
+import (
+	pb "gitlab.com/elixxir/comms/mixmessages"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"testing"
+)
+
+// Tests that batches exceeding the buffer capacity are rejected and can be
+// retried once the sender has drained the buffer.
+func TestImpl_admitBatch(t *testing.T) {
+	s, err := storage.NewStorage("", "", "TestImpl_admitBatch", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+	impl := &Impl{Storage: s, maxBuffered: 2}
+
+	batch := func(rid uint64) *pb.NotificationBatch {
+		return &pb.NotificationBatch{
+			RoundID: rid,
+			Notifications: []*pb.NotificationData{
+				{EphemeralID: 5}, {EphemeralID: 6},
+			},
+		}
+	}
+
+	if err = impl.ReceiveNotificationBatch(batch(1), nil); err != nil {
+		t.Fatalf("First batch should have been admitted: %+v", err)
+	}
+	if err = impl.ReceiveNotificationBatch(batch(2), nil); err == nil {
+		t.Fatal("Second batch should have been rejected")
+	}
+	if impl.ingestion.rejected != 1 {
+		t.Errorf("Expected %d rejected batch, recorded %d", 1, impl.ingestion.rejected)
+	}
+
+	s.GetNotificationBuffer().Swap()
+	if err = impl.ReceiveNotificationBatch(batch(2), nil); err != nil {
+		t.Errorf("Rejected batch should be admitted on retry: %+v", err)
+	}
+	if depth := s.GetNotificationBuffer().Len(); depth != 2 {
+		t.Errorf("Expected buffer depth %d, received %d", 2, depth)
+	}
+}
@@ -0,0 +1,90 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// The blocklist holds users, by transmission RSA hash, which an operator has
+// barred from registering and receiving pushes. Blocked users are rejected by
+// the registration handlers and left out of the token lookups of every send.
+
+package notifications
+
+import (
+	"encoding/base64"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gorm.io/gorm"
+	"net/http"
+)
+
+// checkBlocked returns an error if the user with the passed in transmission
+// RSA key is on the blocklist.
+func (nb *Impl) checkBlocked(transmissionRSA []byte) error {
+	trsaHash, err := storage.HashTransmissionRSA(transmissionRSA)
+	if err != nil {
+		return errors.WithMessage(err, "Failed to hash transmission RSA")
+	}
+	blocked, err := nb.Storage.IsUserBlocked(trsaHash)
+	if err != nil {
+		return errors.WithMessage(err, "Failed to check blocklist")
+	}
+	if blocked {
+		return errors.New("User is blocked from registering for notifications")
+	}
+	return nil
+}
+
+// handleBlocklist serves the blocklist admin endpoint. A GET lists the blocked
+// users, a POST blocks the user with the base64 encoded transmissionRsaHash
+// for the passed in reason and a DELETE unblocks them.
+func (nb *Impl) handleBlocklist(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		blocked, err := nb.Storage.GetBlockedUsers()
+		if err != nil {
+			adminError(w, http.StatusInternalServerError, errors.WithMessage(err, "Failed to get blocklist"))
+			return
+		}
+		writeJSON(w, blocked)
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		adminError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	encoded := r.URL.Query().Get("transmissionRsaHash")
+	trsaHash, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(trsaHash) == 0 {
+		adminError(w, http.StatusBadRequest, errors.New("transmissionRsaHash must be a base64 encoded hash"))
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		err = nb.Storage.UnblockUser(trsaHash)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			adminError(w, http.StatusNotFound, errors.New("user is not blocked"))
+			return
+		} else if err != nil {
+			adminError(w, http.StatusInternalServerError, errors.WithMessage(err, "Failed to unblock user"))
+			return
+		}
+		jww.INFO.Printf("Unblocked user %s", encoded)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	b := &storage.BlockedUser{
+		TransmissionRsaHash: trsaHash,
+		Reason:              r.URL.Query().Get("reason"),
+		CreatedAt:           nb.now(),
+	}
+	err = nb.Storage.BlockUser(b)
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, errors.WithMessage(err, "Failed to block user"))
+		return
+	}
+	jww.INFO.Printf("Blocked user %s: %s", encoded, b.Reason)
+	writeJSON(w, b)
+}
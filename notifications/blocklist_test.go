@@ -0,0 +1,68 @@
+package notifications
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// Tests that users blocked through the admin API are rejected at
+// registration until they are unblocked.
+func TestImpl_handleBlocklist(t *testing.T) {
+	s, err := storage.NewStorage("", "", "TestImpl_handleBlocklist", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+	impl := &Impl{Storage: s}
+	handler := impl.adminHandler("secret")
+
+	trsa := []byte("transmission RSA")
+	trsaHash, err := storage.HashTransmissionRSA(trsa)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := "/blocklist?transmissionRsaHash=" + url.QueryEscape(base64.StdEncoding.EncodeToString(trsaHash))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newAdminRequest(http.MethodPost, target+"&reason=abuse", "secret"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to block user: %d %s", w.Code, w.Body.String())
+	}
+	if err = impl.checkBlocked(trsa); err == nil {
+		t.Errorf("Blocked user should be rejected")
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newAdminRequest(http.MethodGet, "/blocklist", "secret"))
+	var blocked []*storage.BlockedUser
+	if err = json.Unmarshal(w.Body.Bytes(), &blocked); err != nil {
+		t.Fatalf("Failed to decode blocklist: %+v", err)
+	}
+	if len(blocked) != 1 || blocked[0].Reason != "abuse" {
+		t.Errorf("Unexpected blocklist: %+v", blocked)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newAdminRequest(http.MethodDelete, target, "secret"))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Failed to unblock user: %d %s", w.Code, w.Body.String())
+	}
+	if err = impl.checkBlocked(trsa); err != nil {
+		t.Errorf("Unblocked user should be accepted: %+v", err)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newAdminRequest(http.MethodDelete, target, "secret"))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Unblocking a user who is not blocked should not be found, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newAdminRequest(http.MethodPost, "/blocklist?transmissionRsaHash=!", "secret"))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Invalid hash should be rejected, got %d", w.Code)
+	}
+}
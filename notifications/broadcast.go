@@ -0,0 +1,225 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Operator broadcasts: a one-off message pushed to every token of an app
+
+package notifications
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/notifications-bot/notifications/providers"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// broadcastBatchSize is the number of tokens read from storage at a time
+// while broadcasting.
+const broadcastBatchSize = 1000
+
+// BroadcastStatus reports the progress of the running or most recent
+// broadcast.
+type BroadcastStatus struct {
+	App     string    `json:"app"`
+	Total   int64     `json:"total"`
+	Sent    int64     `json:"sent"`
+	Failed  int64     `json:"failed"`
+	Rate    int       `json:"rate"`
+	Running bool      `json:"running"`
+	Started time.Time `json:"started"`
+	DryRun  bool      `json:"dryRun,omitempty"`
+}
+
+// errBroadcastRunning is returned when a broadcast is requested while
+// another is still being sent.
+var errBroadcastRunning = errors.New("a broadcast is already running")
+
+// broadcastState holds the status of the current broadcast. The sent and
+// failed counts are updated atomically by the send threads.
+type broadcastState struct {
+	sync.Mutex
+	status       BroadcastStatus
+	sent, failed int64
+}
+
+// get returns a copy of the current status.
+func (b *broadcastState) get() BroadcastStatus {
+	b.Lock()
+	defer b.Unlock()
+	status := b.status
+	status.Sent = atomic.LoadInt64(&b.sent)
+	status.Failed = atomic.LoadInt64(&b.failed)
+	return status
+}
+
+// Broadcast pushes message to every active token registered for app, at most
+// rate pushes per second. Only one broadcast runs at a time; it is sent in a
+// new thread and abandoned if ctx is done. If dryRun is set, only the number
+// of tokens which would be pushed to is returned.
+func (nb *Impl) Broadcast(ctx context.Context, app, message string, rate int, dryRun bool) (BroadcastStatus, error) {
+	provider, ok := nb.providers[app]
+	if !ok {
+		return BroadcastStatus{}, errors.Errorf("no provider for app %s", app)
+	}
+	if message == "" {
+		return BroadcastStatus{}, errors.New("broadcast message must be set")
+	}
+	if rate <= 0 {
+		return BroadcastStatus{}, errors.New("broadcast rate must be positive")
+	}
+
+	total, err := nb.Storage.CountActiveTokens(app)
+	if err != nil {
+		return BroadcastStatus{}, errors.WithMessage(err, "Failed to count tokens")
+	}
+	status := BroadcastStatus{App: app, Total: total, Rate: rate, Started: time.Now()}
+	if dryRun {
+		status.DryRun = true
+		return status, nil
+	}
+
+	nb.broadcast.Lock()
+	if nb.broadcast.status.Running {
+		nb.broadcast.Unlock()
+		return BroadcastStatus{}, errBroadcastRunning
+	}
+	status.Running = true
+	nb.broadcast.status = status
+	atomic.StoreInt64(&nb.broadcast.sent, 0)
+	atomic.StoreInt64(&nb.broadcast.failed, 0)
+	nb.broadcast.Unlock()
+
+	jww.INFO.Printf("Broadcasting to %d %s tokens at %d/s", total, app, rate)
+	go nb.runBroadcast(ctx, provider, app, message, rate)
+	return status, nil
+}
+
+// runBroadcast sends the broadcast to each token of app in turn, starting a
+// send every 1/rate seconds.
+func (nb *Impl) runBroadcast(ctx context.Context, provider providers.Provider, app, message string, rate int) {
+	ticker := time.NewTicker(time.Second / time.Duration(rate))
+	defer ticker.Stop()
+
+	var wg sync.WaitGroup
+	err := nb.Storage.IterateActiveTokens(app, broadcastBatchSize, func(tokens []*storage.Token) error {
+		for _, t := range tokens {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-ticker.C:
+			}
+			wg.Add(1)
+			go func(t *storage.Token) {
+				defer wg.Done()
+				counter := &nb.broadcast.sent
+				if err := nb.sendBroadcast(ctx, provider, message, t); err != nil {
+					jww.DEBUG.Printf("Failed to send broadcast to %s token: %+v", app, err)
+					counter = &nb.broadcast.failed
+				}
+				atomic.AddInt64(counter, 1)
+			}(t)
+		}
+		return nil
+	})
+	wg.Wait()
+
+	status := nb.broadcast.get()
+	if err != nil {
+		jww.ERROR.Printf("Broadcast to %s stopped after %d of %d tokens: %+v", app, status.Sent+status.Failed, status.Total, err)
+	} else {
+		jww.INFO.Printf("Broadcast to %s complete: %d sent, %d failed", app, status.Sent, status.Failed)
+	}
+	nb.broadcast.Lock()
+	nb.broadcast.status.Running = false
+	nb.broadcast.Unlock()
+}
+
+// sendBroadcast pushes message to a single token. Tokens rejected by the
+// provider are removed, as they are when sending notifications.
+func (nb *Impl) sendBroadcast(ctx context.Context, provider providers.Provider, message string, t *storage.Token) error {
+	target, err := nb.Storage.OpenToken(storage.GTNResult{
+		Token:               t.Token,
+		SealedToken:         t.SealedToken,
+		App:                 t.App,
+		Priority:            t.Priority,
+		ChannelID:           t.ChannelID,
+		Sound:               t.Sound,
+		Locale:              t.Locale,
+		Privacy:             t.Privacy,
+		TransmissionRSAHash: t.TransmissionRSAHash,
+		Broadcast:           message,
+	})
+	if err != nil {
+		return err
+	}
+	sendCtx, cancel := withTimeout(ctx, nb.sendTimeout)
+	defer cancel()
+	_, tokenValid, err := provider.Notify(sendCtx, "", target)
+	if err != nil && !tokenValid {
+		if delErr := nb.Storage.DeleteToken(t.Token, t.App); delErr != nil {
+			jww.ERROR.Printf("Failed to remove %s token registration tRSA hash %+v: %+v", t.App, t.TransmissionRSAHash, delErr)
+		}
+	}
+	return err
+}
+
+// handleBroadcast serves the broadcast admin endpoint.
+//   - GET returns the status of the running or most recent broadcast
+//   - POST broadcasts the message parameter to all tokens of the app
+//     parameter, at the rate parameter if it is below the configured rate.
+//     With dryRun=true only the number of tokens is returned.
+func (nb *Impl) handleBroadcast(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, nb.broadcast.get())
+	case http.MethodPost:
+		query := r.URL.Query()
+		app, message := query.Get("app"), query.Get("message")
+		if _, ok := nb.providers[app]; !ok {
+			adminError(w, http.StatusBadRequest, errors.Errorf("no provider for app %q", app))
+			return
+		}
+		if message == "" {
+			adminError(w, http.StatusBadRequest, errors.New("message must be set"))
+			return
+		}
+		rate := nb.broadcastRate
+		if raw := query.Get("rate"); raw != "" {
+			requested, err := strconv.Atoi(raw)
+			if err != nil || requested <= 0 {
+				adminError(w, http.StatusBadRequest, errors.New("rate must be a positive integer"))
+				return
+			}
+			if requested < rate || rate <= 0 {
+				rate = requested
+			}
+		}
+		if rate <= 0 {
+			adminError(w, http.StatusBadRequest, errors.New("rate must be set as no broadcast rate is configured"))
+			return
+		}
+
+		// The broadcast outlives the request, so it is bound to the bot
+		status, err := nb.Broadcast(nb.context(), app, message, rate, query.Get("dryRun") == "true")
+		if err != nil {
+			if errors.Is(err, errBroadcastRunning) {
+				adminError(w, http.StatusConflict, err)
+				return
+			}
+			adminError(w, http.StatusInternalServerError, errors.WithMessage(err, "Failed to start broadcast"))
+			return
+		}
+		writeJSON(w, status)
+	default:
+		adminError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+	}
+}
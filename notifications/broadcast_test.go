@@ -0,0 +1,108 @@
+package notifications
+
+import (
+	"context"
+	"encoding/json"
+	"gitlab.com/elixxir/notifications-bot/notifications/providers"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingProvider records the targets pushed to through it.
+type recordingProvider struct {
+	sync.Mutex
+	targets []storage.GTNResult
+}
+
+func (rp *recordingProvider) Notify(_ context.Context, _ string, target storage.GTNResult) (providers.Receipt, bool, error) {
+	rp.Lock()
+	defer rp.Unlock()
+	rp.targets = append(rp.targets, target)
+	return providers.Receipt{}, true, nil
+}
+
+// Tests that a broadcast dry run only counts tokens, and that a broadcast
+// pushes the message to every active token of the app.
+func TestImpl_handleBroadcast(t *testing.T) {
+	s, err := storage.NewStorage("", "", "TestImpl_handleBroadcast", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+	rp := &recordingProvider{}
+	impl := &Impl{
+		Storage:       s,
+		broadcastRate: 1000,
+		providers:     map[string]providers.Provider{"app": rp},
+	}
+	handler := impl.adminHandler("secret")
+
+	for _, token := range []string{"a", "b", "c"} {
+		if err = s.RegisterToken(token, "app", []byte("trsa"+token)); err != nil {
+			t.Fatalf("Failed to register token: %+v", err)
+		}
+	}
+	if err = s.RegisterToken("other", "otherApp", []byte("trsaother")); err != nil {
+		t.Fatalf("Failed to register token: %+v", err)
+	}
+	if err = s.RegisterFallbackToken("a", "standby", "app", []byte("trsaa")); err != nil {
+		t.Fatalf("Failed to register fallback token: %+v", err)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newAdminRequest(http.MethodPost, "/broadcast?app=app", "secret"))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d without a message, received %d", http.StatusBadRequest, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newAdminRequest(http.MethodPost, "/broadcast?app=app&message=maintenance+tonight&dryRun=true", "secret"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	var status BroadcastStatus
+	if err = json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatalf("Failed to decode status: %+v", err)
+	}
+	if !status.DryRun || status.Total != 3 {
+		t.Errorf("Dry run should count %d tokens: %+v", 3, status)
+	}
+	if len(rp.targets) != 0 {
+		t.Fatalf("Dry run should not push: %+v", rp.targets)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newAdminRequest(http.MethodPost, "/broadcast?app=app&message=maintenance+tonight", "secret"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for impl.broadcast.get().Running {
+		if time.Now().After(deadline) {
+			t.Fatal("Broadcast did not complete")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	status = impl.broadcast.get()
+	if status.Sent != 3 || status.Failed != 0 {
+		t.Errorf("Unexpected broadcast status: %+v", status)
+	}
+	rp.Lock()
+	defer rp.Unlock()
+	var tokens []string
+	for _, target := range rp.targets {
+		if target.Broadcast != "maintenance tonight" {
+			t.Errorf("Push did not carry the broadcast message: %+v", target)
+		}
+		tokens = append(tokens, target.Token)
+	}
+	sort.Strings(tokens)
+	if len(tokens) != 3 || tokens[0] != "a" || tokens[1] != "b" || tokens[2] != "c" {
+		t.Errorf("Broadcast should reach every active token of the app, reached %v", tokens)
+	}
+}
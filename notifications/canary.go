@@ -0,0 +1,257 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Canary monitoring: operator devices sent a heartbeat push at a fixed
+// interval, so degraded provider delivery is noticed before users report it
+
+package notifications
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/notifications-bot/events"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gorm.io/gorm"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CanaryStatus holds the heartbeat results of a single canary.
+type CanaryStatus struct {
+	// ID is the canary's token as stored, which is a pseudonym if tokens are
+	// encrypted at rest
+	ID                  string        `json:"id"`
+	App                 string        `json:"app"`
+	Sent                int64         `json:"sent"`
+	Failed              int64         `json:"failed"`
+	ConsecutiveFailures int           `json:"consecutiveFailures"`
+	LastLatency         time.Duration `json:"lastLatency"`
+	LastSuccess         time.Time     `json:"lastSuccess,omitempty"`
+	LastError           string        `json:"lastError,omitempty"`
+	// Alerting is set once ConsecutiveFailures reaches the alert threshold
+	// and cleared on the next successful heartbeat
+	Alerting bool `json:"alerting"`
+}
+
+// canaryState holds the status of each canary by ID.
+type canaryState struct {
+	sync.Mutex
+	statuses map[string]*CanaryStatus
+}
+
+// list returns a copy of the status of each canary, ordered by ID.
+func (c *canaryState) list() []CanaryStatus {
+	c.Lock()
+	defer c.Unlock()
+	list := make([]CanaryStatus, 0, len(c.statuses))
+	for _, s := range c.statuses {
+		list = append(list, *s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// CanaryMonitor is a long-running thread which sends a heartbeat push to every
+// canary at the passed in interval. A canary which fails alertAfter
+// heartbeats in a row raises an alert.
+func (nb *Impl) CanaryMonitor(interval time.Duration, alertAfter int) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		nb.checkCanaries(alertAfter)
+		select {
+		case <-nb.context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkCanaries sends a heartbeat push to every canary and records the result.
+func (nb *Impl) checkCanaries(alertAfter int) {
+	canaries, err := nb.Storage.GetCanaries()
+	if err != nil {
+		jww.ERROR.Printf("Failed to get canaries: %+v", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range canaries {
+		wg.Add(1)
+		go func(c *storage.Canary) {
+			defer wg.Done()
+			start := time.Now()
+			err := nb.sendHeartbeat(c)
+			nb.recordHeartbeat(c, time.Since(start), err, alertAfter)
+		}(c)
+	}
+	wg.Wait()
+
+	// Forget canaries which have been removed
+	nb.canaries.Lock()
+	defer nb.canaries.Unlock()
+	current := make(map[string]bool, len(canaries))
+	for _, c := range canaries {
+		current[c.Token] = true
+	}
+	for id := range nb.canaries.statuses {
+		if !current[id] {
+			delete(nb.canaries.statuses, id)
+		}
+	}
+}
+
+// sendHeartbeat sends an empty push to the canary.
+func (nb *Impl) sendHeartbeat(c *storage.Canary) error {
+	provider, ok := nb.providers[c.App]
+	if !ok {
+		return errors.Errorf("no provider for app %s", c.App)
+	}
+	target := storage.GTNResult{Token: c.Token, SealedToken: c.SealedToken, App: c.App}
+	if len(c.SealedToken) > 0 {
+		var err error
+		target, err = nb.Storage.OpenToken(target)
+		if err != nil {
+			return err
+		}
+	}
+	ctx, cancel := withTimeout(nb.context(), nb.sendTimeout)
+	defer cancel()
+	_, _, err := provider.Notify(ctx, "", target)
+	return err
+}
+
+// recordHeartbeat updates the status of the canary with the result of a
+// heartbeat, alerting when it reaches alertAfter consecutive failures and
+// when it recovers.
+func (nb *Impl) recordHeartbeat(c *storage.Canary, latency time.Duration, sendErr error, alertAfter int) {
+	nb.canaries.Lock()
+	if nb.canaries.statuses == nil {
+		nb.canaries.statuses = make(map[string]*CanaryStatus)
+	}
+	status, ok := nb.canaries.statuses[c.Token]
+	if !ok {
+		status = &CanaryStatus{ID: c.Token}
+		nb.canaries.statuses[c.Token] = status
+	}
+	status.App = c.App
+	status.LastLatency = latency
+
+	var event events.Type
+	if sendErr != nil {
+		status.Failed++
+		status.ConsecutiveFailures++
+		status.LastError = sendErr.Error()
+		if !status.Alerting && status.ConsecutiveFailures >= alertAfter {
+			status.Alerting = true
+			event = events.CanaryFailure
+		}
+	} else {
+		status.Sent++
+		status.ConsecutiveFailures = 0
+		status.LastSuccess = time.Now()
+		status.LastError = ""
+		if status.Alerting {
+			status.Alerting = false
+			event = events.CanaryRecovery
+		}
+	}
+	failures := status.ConsecutiveFailures
+	nb.canaries.Unlock()
+
+	switch event {
+	case events.CanaryFailure:
+		jww.ERROR.Printf("ALERT: %s canary %s failed %d heartbeats in a row: %+v", c.App, c.Token, failures, sendErr)
+		nb.publish(events.Event{Type: event, App: c.App, Error: sendErr.Error()})
+	case events.CanaryRecovery:
+		jww.INFO.Printf("%s canary %s recovered", c.App, c.Token)
+		nb.publish(events.Event{Type: event, App: c.App})
+	default:
+		if sendErr != nil {
+			jww.WARN.Printf("%s canary %s heartbeat failed: %+v", c.App, c.Token, sendErr)
+		}
+	}
+}
+
+// handleCanaries serves the canary admin endpoint.
+//   - GET lists the heartbeat status of each canary
+//   - POST registers the token parameter as a canary of the app parameter
+//   - DELETE removes the canary with the token parameter
+func (nb *Impl) handleCanaries(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, nb.canaries.list())
+	case http.MethodPost:
+		token, app := query.Get("token"), query.Get("app")
+		if token == "" {
+			adminError(w, http.StatusBadRequest, errors.New("token must be set"))
+			return
+		}
+		if _, ok := nb.providers[app]; !ok {
+			adminError(w, http.StatusBadRequest, errors.Errorf("no provider for app %q", app))
+			return
+		}
+		err := nb.Storage.AddCanary(token, app)
+		if err != nil {
+			adminError(w, http.StatusInternalServerError, errors.WithMessage(err, "Failed to add canary"))
+			return
+		}
+		writeJSON(w, map[string]string{"token": token, "app": app})
+	case http.MethodDelete:
+		token := query.Get("token")
+		if token == "" {
+			adminError(w, http.StatusBadRequest, errors.New("token must be set"))
+			return
+		}
+		err := nb.Storage.DeleteCanary(token)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				adminError(w, http.StatusNotFound, errors.New("token is not a canary"))
+				return
+			}
+			adminError(w, http.StatusInternalServerError, errors.WithMessage(err, "Failed to remove canary"))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		adminError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// formatCanaryMetrics renders canary heartbeat results as Prometheus metrics.
+func formatCanaryMetrics(statuses []CanaryStatus) string {
+	if len(statuses) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	metric("notifications_canary_heartbeats_total", "counter", "Canary heartbeat pushes by result.")
+	for _, s := range statuses {
+		fmt.Fprintf(&b, "notifications_canary_heartbeats_total{app=%q,canary=%q,result=\"success\"} %d\n", s.App, s.ID, s.Sent)
+		fmt.Fprintf(&b, "notifications_canary_heartbeats_total{app=%q,canary=%q,result=\"failure\"} %d\n", s.App, s.ID, s.Failed)
+	}
+	metric("notifications_canary_latency_seconds", "gauge", "Provider latency of the last canary heartbeat.")
+	for _, s := range statuses {
+		fmt.Fprintf(&b, "notifications_canary_latency_seconds{app=%q,canary=%q} %g\n", s.App, s.ID, s.LastLatency.Seconds())
+	}
+	metric("notifications_canary_consecutive_failures", "gauge", "Canary heartbeats failed in a row.")
+	for _, s := range statuses {
+		fmt.Fprintf(&b, "notifications_canary_consecutive_failures{app=%q,canary=%q} %d\n", s.App, s.ID, s.ConsecutiveFailures)
+	}
+	return b.String()
+}
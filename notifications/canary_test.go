@@ -0,0 +1,68 @@
+package notifications
+
+import (
+	"gitlab.com/elixxir/notifications-bot/notifications/providers"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Tests that canary heartbeats are recorded, that an alert is raised after
+// the configured number of failures and cleared on recovery, and that
+// removed canaries are forgotten.
+func TestImpl_checkCanaries(t *testing.T) {
+	s, err := storage.NewStorage("", "", "TestImpl_checkCanaries", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+	fp := &failingProvider{fails: 2}
+	impl := &Impl{
+		Storage:   s,
+		providers: map[string]providers.Provider{"app": fp},
+	}
+	handler := impl.adminHandler("secret")
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newAdminRequest(http.MethodPost, "/canaries?token=canary&app=unknown", "secret"))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for unknown app, received %d", http.StatusBadRequest, w.Code)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newAdminRequest(http.MethodPost, "/canaries?token=canary&app=app", "secret"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", w.Code, w.Body.String())
+	}
+
+	impl.checkCanaries(2)
+	statuses := impl.canaries.list()
+	if len(statuses) != 1 || statuses[0].Failed != 1 || statuses[0].Alerting {
+		t.Fatalf("Single failure should be recorded without alerting: %+v", statuses)
+	}
+	impl.checkCanaries(2)
+	statuses = impl.canaries.list()
+	if statuses[0].ConsecutiveFailures != 2 || !statuses[0].Alerting {
+		t.Errorf("Canary should alert after %d failures: %+v", 2, statuses[0])
+	}
+	impl.checkCanaries(2)
+	statuses = impl.canaries.list()
+	if statuses[0].Sent != 1 || statuses[0].ConsecutiveFailures != 0 || statuses[0].Alerting {
+		t.Errorf("Canary should recover after a successful heartbeat: %+v", statuses[0])
+	}
+
+	metrics := formatCanaryMetrics(statuses)
+	if !strings.Contains(metrics, `notifications_canary_heartbeats_total{app="app",canary="canary",result="failure"} 2`) {
+		t.Errorf("Metrics did not include canary failures:\n%s", metrics)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newAdminRequest(http.MethodDelete, "/canaries?token=canary", "secret"))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	impl.checkCanaries(2)
+	if statuses = impl.canaries.list(); len(statuses) != 0 {
+		t.Errorf("Removed canary should be forgotten: %+v", statuses)
+	}
+}
@@ -0,0 +1,30 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package notifications
+
+import (
+	"gitlab.com/xx_network/comms/connect"
+	"gitlab.com/xx_network/primitives/id"
+)
+
+// NotificationComms is the part of the notification bot comms used by the
+// request handlers, so they can be run against a test double instead of a
+// started server.
+type NotificationComms interface {
+	GetHost(hostId *id.ID) (*connect.Host, bool)
+	RemoveHost(hostId *id.ID)
+}
+
+// hosts returns the comms hosts are looked up in; the server comms unless a
+// test double is set.
+func (nb *Impl) hosts() NotificationComms {
+	if nb.comms != nil {
+		return nb.comms
+	}
+	return nb.server()
+}
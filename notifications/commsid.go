@@ -0,0 +1,55 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// The bot's comms run under id.NotificationBot by default. Test networks and
+// bots serving several regions can run under an ID of their own, so each can
+// be registered with permissioning and addressed separately.
+
+package notifications
+
+import (
+	"encoding/base64"
+	"github.com/pkg/errors"
+	"gitlab.com/xx_network/primitives/id"
+	"strings"
+)
+
+// ParseCommsID returns the ID the bot's comms run under: the passed in base64
+// encoded ID, as printed by id.ID.String, or id.NotificationBot if it is empty.
+// If role is set, it replaces the type of the ID; it is one of generic,
+// gateway, node, user or group.
+func ParseCommsID(encoded, role string) (*id.ID, error) {
+	commsID := id.NotificationBot.DeepCopy()
+	if encoded != "" {
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, errors.Wrapf(err, "comms ID %q is not base64 encoded", encoded)
+		}
+		commsID, err = id.Unmarshal(data)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "Invalid comms ID %q", encoded)
+		}
+	}
+	if role != "" {
+		t, err := parseIDType(role)
+		if err != nil {
+			return nil, err
+		}
+		commsID.SetType(t)
+	}
+	return commsID, nil
+}
+
+// parseIDType returns the ID type with the passed in name.
+func parseIDType(name string) (id.Type, error) {
+	for t := id.Generic; t < id.NumTypes; t++ {
+		if strings.EqualFold(t.String(), name) {
+			return t, nil
+		}
+	}
+	return 0, errors.Errorf("unknown comms role %q, must be generic, gateway, node, user or group", name)
+}
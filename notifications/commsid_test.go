@@ -0,0 +1,42 @@
+package notifications
+
+import (
+	"crypto/rand"
+	"gitlab.com/xx_network/primitives/id"
+	"testing"
+)
+
+// Tests that the comms ID defaults to the notifications bot ID, can be set to
+// an encoded ID and has its type replaced by the role.
+func TestParseCommsID(t *testing.T) {
+	commsID, err := ParseCommsID("", "")
+	if err != nil || !commsID.Cmp(&id.NotificationBot) {
+		t.Errorf("Expected the notifications bot ID by default, got %s: %+v", commsID, err)
+	}
+
+	custom, err := id.NewRandomID(rand.Reader, id.Generic)
+	if err != nil {
+		t.Fatalf("Failed to generate ID: %+v", err)
+	}
+	commsID, err = ParseCommsID(custom.String(), "")
+	if err != nil || !commsID.Cmp(custom) {
+		t.Errorf("Expected ID %s, got %s: %+v", custom, commsID, err)
+	}
+
+	commsID, err = ParseCommsID(custom.String(), "Node")
+	if err != nil || commsID.GetType() != id.Node {
+		t.Errorf("Expected a node ID, got %s: %+v", commsID, err)
+	}
+	if custom.GetType() != id.Generic {
+		t.Errorf("Setting the role should not modify the ID it was parsed from")
+	}
+	if id.NotificationBot.GetType() != id.Generic {
+		t.Fatalf("Setting the role should not modify the notifications bot ID")
+	}
+	if _, err = ParseCommsID("", "relay"); err == nil {
+		t.Errorf("Unknown role should be rejected")
+	}
+	if _, err = ParseCommsID("not base64!", ""); err == nil {
+		t.Errorf("Malformed ID should be rejected")
+	}
+}
@@ -0,0 +1,275 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Clients tag each tracked ID with the conversation its messages belong to: a
+// direct message, group chat or channel. Pushes take the priority tier and
+// alert text configured for their conversation, users can mute the
+// conversations they do not want to be pushed for, and each send cycle pushes
+// direct messages ahead of group chats and channels. Gateways cannot tag
+// notifications, since the notification data they send has no field for it.
+
+package notifications
+
+import (
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/crypto/notifications"
+	"gitlab.com/elixxir/crypto/rsa"
+	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/elixxir/notifications-bot/errs"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gorm.io/gorm"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ConversationParams configures the pushes for a conversation.
+type ConversationParams struct {
+	// Priority is the priority tier of pushes to tokens without their own
+	Priority string
+	// Title and Body replace the app's alert text; the app's, localized for
+	// the token, is used where empty
+	Title string
+	Body  string
+}
+
+// IdentityConversationRequest tags a tracked identity with the conversation
+// its messages belong to; an empty conversation removes the tag. Signature is
+// made with notifications.SignIdentity over the intermediary ID followed by
+// the conversation, the request timestamp and IdentityConversationTag.
+type IdentityConversationRequest struct {
+	TransmissionRsaPem []byte
+	IntermediaryId     []byte
+	Conversation       string
+	RequestTimestamp   int64
+	Signature          []byte
+}
+
+// MutedConversationsRequest sets the conversations the user who signed it is
+// not pushed for, replacing any muted before; an empty list unmutes them all.
+// Signature is made with notifications.SignIdentity over the PEM encoded key
+// followed by each conversation, the request timestamp and
+// MutedConversationsTag.
+type MutedConversationsRequest struct {
+	TransmissionRsaPem []byte
+	Muted              []string
+	RequestTimestamp   int64
+	Signature          []byte
+}
+
+// verifyIdentityConversation checks the conversation, request timestamp and
+// signature of an IdentityConversationRequest.
+func (nb *Impl) verifyIdentityConversation(msg *IdentityConversationRequest) error {
+	if msg == nil || len(msg.TransmissionRsaPem) == 0 || len(msg.IntermediaryId) == 0 {
+		return errors.New("Request must include a transmission RSA key and intermediary ID")
+	}
+	if !constants.Conversation(msg.Conversation).Valid() {
+		return errors.Errorf("Unknown conversation %q", msg.Conversation)
+	}
+	requestTimestamp := time.Unix(0, msg.RequestTimestamp)
+	if err := nb.checkRequestTimestamp(requestTimestamp); err != nil {
+		return err
+	}
+
+	pub, err := rsa.GetScheme().UnmarshalPublicKeyPEM(msg.TransmissionRsaPem)
+	if err != nil {
+		return errors.WithMessage(err, "Failed to unmarshal public key")
+	}
+	signed := [][]byte{msg.IntermediaryId, []byte(msg.Conversation)}
+	err = notifications.VerifyIdentity(pub, signed, requestTimestamp, IdentityConversationTag, msg.Signature)
+	if err != nil {
+		return errs.Mark(errors.WithMessage(err, "Failed to verify request signature"), errs.ErrInvalidSignature)
+	}
+	return nil
+}
+
+// SetIdentityConversation tags an identity tracked by the client which signed
+// the request with its conversation.
+func (nb *Impl) SetIdentityConversation(msg *IdentityConversationRequest) error {
+	jww.DEBUG.Println("SetIdentityConversation")
+	err := nb.verifyIdentityConversation(msg)
+	if err != nil {
+		return err
+	}
+	return nb.Storage.SetIdentityConversation(msg.IntermediaryId, msg.TransmissionRsaPem,
+		constants.Conversation(msg.Conversation))
+}
+
+// handleSetIdentityConversation serves SetIdentityConversation for a JSON
+// encoded IdentityConversationRequest.
+func (nb *Impl) handleSetIdentityConversation(w http.ResponseWriter, r *http.Request) {
+	msg := &IdentityConversationRequest{}
+	if !decodeRegistration(w, r, msg) {
+		return
+	}
+	err := nb.verifyIdentityConversation(msg)
+	if err != nil {
+		adminError(w, http.StatusUnauthorized, err)
+		return
+	}
+	err = nb.Storage.SetIdentityConversation(msg.IntermediaryId, msg.TransmissionRsaPem,
+		constants.Conversation(msg.Conversation))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		adminError(w, http.StatusNotFound, errors.New("identity not tracked"))
+		return
+	} else if err != nil {
+		adminError(w, http.StatusInternalServerError, errors.WithMessage(err, "Failed to set conversation"))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// verifyMutedConversations checks the conversations, request timestamp and
+// signature of a MutedConversationsRequest.
+func (nb *Impl) verifyMutedConversations(msg *MutedConversationsRequest) error {
+	if msg == nil || len(msg.TransmissionRsaPem) == 0 {
+		return errors.New("Request must include a transmission RSA key")
+	}
+	signed := [][]byte{msg.TransmissionRsaPem}
+	for _, c := range msg.Muted {
+		if c == "" || !constants.Conversation(c).Valid() {
+			return errors.Errorf("Unknown conversation %q", c)
+		}
+		signed = append(signed, []byte(c))
+	}
+	requestTimestamp := time.Unix(0, msg.RequestTimestamp)
+	if err := nb.checkRequestTimestamp(requestTimestamp); err != nil {
+		return err
+	}
+
+	pub, err := rsa.GetScheme().UnmarshalPublicKeyPEM(msg.TransmissionRsaPem)
+	if err != nil {
+		return errors.WithMessage(err, "Failed to unmarshal public key")
+	}
+	err = notifications.VerifyIdentity(pub, signed, requestTimestamp, MutedConversationsTag, msg.Signature)
+	if err != nil {
+		return errs.Mark(errors.WithMessage(err, "Failed to verify request signature"), errs.ErrInvalidSignature)
+	}
+	return nil
+}
+
+// SetMutedConversations sets the conversations the user who signed the
+// request is not pushed for.
+func (nb *Impl) SetMutedConversations(msg *MutedConversationsRequest) error {
+	jww.INFO.Println("SetMutedConversations")
+	err := nb.verifyMutedConversations(msg)
+	if err != nil {
+		return err
+	}
+	return nb.setMutedConversations(msg.TransmissionRsaPem, msg.Muted)
+}
+
+// setMutedConversations stores the muted conversations of the user with the
+// passed in transmission key.
+func (nb *Impl) setMutedConversations(transmissionRsaPem []byte, muted []string) error {
+	trsaHash, err := storage.HashTransmissionRSA(transmissionRsaPem)
+	if err != nil {
+		return errors.WithMessage(err, "Failed to hash transmission RSA")
+	}
+	return nb.Storage.SetUserMutedConversations(trsaHash, strings.Join(muted, ","))
+}
+
+// handleSetMutedConversations serves SetMutedConversations for a JSON encoded
+// MutedConversationsRequest.
+func (nb *Impl) handleSetMutedConversations(w http.ResponseWriter, r *http.Request) {
+	msg := &MutedConversationsRequest{}
+	if !decodeRegistration(w, r, msg) {
+		return
+	}
+	err := nb.verifyMutedConversations(msg)
+	if err != nil {
+		adminError(w, http.StatusUnauthorized, err)
+		return
+	}
+	err = nb.setMutedConversations(msg.TransmissionRsaPem, msg.Muted)
+	if errors.Is(err, errs.ErrNotRegistered) {
+		adminError(w, http.StatusNotFound, errors.New("not registered"))
+		return
+	} else if err != nil {
+		adminError(w, http.StatusInternalServerError, errors.WithMessage(err, "Failed to set muted conversations"))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// conversationOf returns the most urgent conversation of the identities an
+// ephemeral ID matched. Identities tagged with an unknown conversation count
+// as untagged.
+func conversationOf(matches []storage.GTNResult) constants.Conversation {
+	most := constants.ConversationChannel
+	for _, m := range matches {
+		c := constants.Conversation(m.Conversation)
+		if !c.Valid() {
+			c = constants.ConversationUntagged
+		}
+		if c.Lane() < most.Lane() {
+			most = c
+		}
+	}
+	return most
+}
+
+// mutes returns true if the user of target muted conversation.
+func mutes(target storage.GTNResult, conversation constants.Conversation) bool {
+	for _, muted := range constants.ParseConversations(target.MutedConversations) {
+		if muted == conversation {
+			return true
+		}
+	}
+	return false
+}
+
+// unmuted returns the ephemeral IDs of the group whose conversation its user
+// has not muted, and the most urgent of their conversations.
+func unmuted(g *notificationGroup) ([]int64, constants.Conversation) {
+	var ephemerals []int64
+	most := constants.ConversationChannel
+	for _, eid := range g.ephemerals {
+		c := conversationOf(g.matches[eid])
+		if mutes(g.target, c) {
+			continue
+		}
+		ephemerals = append(ephemerals, eid)
+		if c.Lane() < most.Lane() {
+			most = c
+		}
+	}
+	return ephemerals, most
+}
+
+// sortByLane orders groups so those with more urgent conversations are sent
+// first, keeping the order of groups in the same lane.
+func sortByLane(groups []*notificationGroup) {
+	lanes := make(map[*notificationGroup]int, len(groups))
+	for _, g := range groups {
+		most := constants.ConversationChannel
+		for _, matches := range g.matches {
+			if c := conversationOf(matches); c.Lane() < most.Lane() {
+				most = c
+			}
+		}
+		lanes[g] = most.Lane()
+	}
+	sort.SliceStable(groups, func(i, j int) bool { return lanes[groups[i]] < lanes[groups[j]] })
+}
+
+// withConversation returns target carrying conversation, with the priority
+// tier and alert text configured for it.
+func (nb *Impl) withConversation(target storage.GTNResult, conversation constants.Conversation) storage.GTNResult {
+	target.Conversation = string(conversation)
+	params, ok := nb.conversations[string(conversation)]
+	if !ok {
+		return target
+	}
+	if target.Priority == "" {
+		target.Priority = params.Priority
+	}
+	target.AlertTitle, target.AlertBody = params.Title, params.Body
+	return target
+}
@@ -0,0 +1,126 @@
+package notifications
+
+import (
+	"context"
+	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/elixxir/notifications-bot/notifications/providers"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gitlab.com/elixxir/notifications-bot/testutil"
+	"gitlab.com/elixxir/primitives/notifications"
+	"gitlab.com/xx_network/primitives/id"
+	"gitlab.com/xx_network/primitives/id/ephemeral"
+	"testing"
+)
+
+// Tests that pushes take the priority and alert text of their identity's
+// conversation, and are not sent for conversations the user muted.
+func TestImpl_SendBatch_Conversations(t *testing.T) {
+	s := testutil.NewStorage(t)
+	android := constants.MessengerAndroid.String()
+	rp := &recordingProvider{}
+	impl := &Impl{
+		Storage:          s,
+		maxSendAttempts:  1,
+		maxNotifications: 20,
+		maxPayloadBytes:  4096,
+		providers:        map[string]providers.Provider{android: rp},
+		conversations: map[string]ConversationParams{
+			"channel": {Priority: "low", Body: "New channel post"},
+		},
+	}
+
+	trsa := []byte("trsa")
+	iid, err := ephemeral.GetIntermediaryId(id.NewIdFromString("channel", id.User, t))
+	if err != nil {
+		t.Fatalf("Failed to get intermediary ID: %+v", err)
+	}
+	if err = s.RegisterToken("token", android, trsa); err != nil {
+		t.Fatalf("Failed to register token: %+v", err)
+	}
+	if err = s.RegisterTrackedID([][]byte{iid}, trsa, 0, 8); err != nil {
+		t.Fatalf("Failed to register tracked ID: %+v", err)
+	}
+	if err = s.SetIdentityConversation(iid, trsa, constants.ConversationChannel); err != nil {
+		t.Fatalf("Failed to tag tracked ID: %+v", err)
+	}
+	eph, err := s.GetLatestEphemeral()
+	if err != nil {
+		t.Fatalf("Failed to get ephemeral: %+v", err)
+	}
+	trsaHash, err := storage.HashTransmissionRSA(trsa)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(round uint64) {
+		ctx, cycle := withSendCycle(context.Background())
+		_, err := impl.SendBatch(ctx, map[int64][]*notifications.Data{
+			eph.EphemeralId: {{EphemeralID: eph.EphemeralId, RoundID: round, MessageHash: []byte("hello"), IdentityFP: []byte("identity")}},
+		})
+		if err != nil {
+			t.Fatalf("Failed to send batch: %+v", err)
+		}
+		cycle.summary()
+	}
+
+	send(1)
+	if len(rp.targets) != 1 {
+		t.Fatalf("Expected one push, got %d", len(rp.targets))
+	}
+	target := rp.targets[0]
+	if target.Conversation != "channel" || target.Priority != "low" || target.AlertBody != "New channel post" {
+		t.Errorf("Push should carry its conversation's settings: %+v", target)
+	}
+
+	if err = s.SetUserMutedConversations(trsaHash, "group,channel"); err != nil {
+		t.Fatalf("Failed to mute conversations: %+v", err)
+	}
+	send(2)
+	if len(rp.targets) != 1 {
+		t.Errorf("Muted conversation should not be pushed, got %d pushes", len(rp.targets))
+	}
+}
+
+// Tests that groups are ordered by the most urgent conversation of their
+// identities, keeping the order within a lane.
+func Test_sortByLane(t *testing.T) {
+	group := func(token string, conversations ...string) *notificationGroup {
+		g := &notificationGroup{target: storage.GTNResult{Token: token}, matches: map[int64][]storage.GTNResult{}}
+		for i, c := range conversations {
+			g.matches[int64(i)] = []storage.GTNResult{{Token: token, Conversation: c}}
+		}
+		return g
+	}
+	groups := []*notificationGroup{
+		group("channel", "channel"),
+		group("group", "group", "channel"),
+		group("untagged", ""),
+		group("dm", "channel", "dm"),
+		group("unknown", "bogus"),
+	}
+	sortByLane(groups)
+	expected := []string{"dm", "untagged", "unknown", "group", "channel"}
+	for i, g := range groups {
+		if g.target.Token != expected[i] {
+			t.Errorf("Unexpected group %d\n\tExpected: %s\n\tReceived: %s", i, expected[i], g.target.Token)
+		}
+	}
+}
+
+// Tests that only the ephemeral IDs of conversations the user did not mute
+// are kept.
+func Test_unmuted(t *testing.T) {
+	g := &notificationGroup{
+		target:     storage.GTNResult{MutedConversations: "dm"},
+		ephemerals: []int64{1, 2, 3},
+		matches: map[int64][]storage.GTNResult{
+			1: {{Conversation: "dm"}},
+			2: {{Conversation: "channel"}},
+			3: {{Conversation: "group"}, {Conversation: "dm"}},
+		},
+	}
+	ephemerals, conversation := unmuted(g)
+	if len(ephemerals) != 1 || ephemerals[0] != 2 || conversation != constants.ConversationChannel {
+		t.Errorf("Unexpected unmuted ephemerals %v of conversation %q", ephemerals, conversation)
+	}
+}
@@ -0,0 +1,161 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Each send cycle which finds notifications buffered logs a single summary
+// line once its sends complete, so the health of the pipeline can be judged
+// from the logs alone.
+
+package notifications
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/notifications-bot/notifications/providers"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sendCycleKey is the context key of the sendCycle a send belongs to.
+type sendCycleKey struct{}
+
+// sendCycle counts what happened to the notifications of a send cycle. Its
+// methods do nothing on a nil *sendCycle, so sends outside a cycle, such as
+// those of the outbox dispatcher, are not counted.
+type sendCycle struct {
+	start time.Time
+	sends sync.WaitGroup
+
+	mux        sync.Mutex
+	ephemerals int
+	users      int
+	cacheHits  int
+	held       int
+	queued     int
+	attempted  int
+	succeeded  int
+	failed     map[string]int
+}
+
+// withSendCycle returns a context carrying a new sendCycle started now.
+func withSendCycle(ctx context.Context) (context.Context, *sendCycle) {
+	c := &sendCycle{start: time.Now(), failed: map[string]int{}}
+	return context.WithValue(ctx, sendCycleKey{}, c), c
+}
+
+// sendCycleFrom returns the sendCycle carried by ctx, or nil if there is none.
+func sendCycleFrom(ctx context.Context) *sendCycle {
+	c, _ := ctx.Value(sendCycleKey{}).(*sendCycle)
+	return c
+}
+
+// lookedUp records the token lookup of the passed in ephemeral IDs, which was
+// served from the lookup cache if cached is set.
+func (c *sendCycle) lookedUp(ephemerals []int64, results []storage.GTNResult, cached bool) {
+	if c == nil {
+		return
+	}
+	users := map[string]struct{}{}
+	for _, r := range results {
+		users[string(r.TransmissionRSAHash)] = struct{}{}
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.ephemerals += len(ephemerals)
+	c.users += len(users)
+	if cached {
+		c.cacheHits += len(ephemerals)
+	}
+}
+
+// heldForDigest records a token whose notifications were held for its digest.
+func (c *sendCycle) heldForDigest() {
+	if c == nil {
+		return
+	}
+	c.mux.Lock()
+	c.held++
+	c.mux.Unlock()
+}
+
+// queuedPushes records pushes written to the outbox for the dispatcher.
+func (c *sendCycle) queuedPushes(n int) {
+	if c == nil {
+		return
+	}
+	c.mux.Lock()
+	c.queued += n
+	c.mux.Unlock()
+}
+
+// goSend runs send in its own thread, which the cycle's summary waits for.
+func (c *sendCycle) goSend(send func()) {
+	if c == nil {
+		go send()
+		return
+	}
+	c.sends.Add(1)
+	go func() {
+		defer c.sends.Done()
+		send()
+	}()
+}
+
+// sent records the result of a push.
+func (c *sendCycle) sent(res NotificationResult) {
+	if c == nil {
+		return
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.attempted++
+	if res.Err == nil {
+		c.succeeded++
+		return
+	}
+	c.failed[failureReason(res)]++
+}
+
+// summary waits for the cycle's sends to complete and returns its summary
+// line.
+func (c *sendCycle) summary() string {
+	c.sends.Wait()
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	reasons := make([]string, 0, len(c.failed))
+	failed := 0
+	for reason, n := range c.failed {
+		reasons = append(reasons, reason+":"+strconv.Itoa(n))
+		failed += n
+	}
+	sort.Strings(reasons)
+	return fmt.Sprintf("cycle=send ephemerals=%d users=%d cacheHits=%d held=%d queued=%d "+
+		"attempted=%d succeeded=%d failed=%d failedBy=%s duration=%s",
+		c.ephemerals, c.users, c.cacheHits, c.held, c.queued,
+		c.attempted, c.succeeded, failed, strings.Join(reasons, ","), time.Since(c.start))
+}
+
+// failureReason classifies a failed push by why the provider did not deliver
+// it: a rejected token or configuration, a timeout, the HTTP status it
+// returned, or error if there was none.
+func failureReason(res NotificationResult) string {
+	switch {
+	case !res.TokenValid:
+		return "invalidToken"
+	case errors.Is(res.Err, providers.ErrMisconfigured):
+		return "misconfigured"
+	case errors.Is(res.Err, context.DeadlineExceeded):
+		return "timeout"
+	case res.Receipt.Status != 0:
+		return strconv.Itoa(res.Receipt.Status)
+	}
+	return "error"
+}
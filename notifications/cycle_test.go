@@ -0,0 +1,81 @@
+package notifications
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/elixxir/notifications-bot/notifications/providers"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gitlab.com/elixxir/primitives/notifications"
+	"gitlab.com/xx_network/primitives/id"
+	"gitlab.com/xx_network/primitives/id/ephemeral"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tests that the summary of a send cycle counts its lookups and waits for its
+// sends to complete.
+func TestImpl_SendBatch_CycleSummary(t *testing.T) {
+	s, err := storage.NewStorage("", "", "TestImpl_SendBatch_CycleSummary", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+	impl := &Impl{
+		Storage:          s,
+		maxNotifications: 20,
+		maxPayloadBytes:  4096,
+		maxSendAttempts:  1,
+		providers: map[string]providers.Provider{
+			constants.MessengerAndroid.String(): &MockProvider{donech: make(chan string, 1)},
+		},
+	}
+	iid, err := ephemeral.GetIntermediaryId(id.NewIdFromString("zezima", id.User, t))
+	if err != nil {
+		t.Fatalf("Failed to create iid: %+v", err)
+	}
+	_, epoch := ephemeral.HandleQuantization(time.Now())
+	_, err = s.RegisterForNotifications(iid, []byte("rsacert"), "token", constants.MessengerAndroid.String(), epoch, 16)
+	if err != nil {
+		t.Fatalf("Failed to register: %+v", err)
+	}
+	eph, err := s.GetLatestEphemeral()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cycle := withSendCycle(context.Background())
+	_, err = impl.SendBatch(ctx, map[int64][]*notifications.Data{
+		eph.EphemeralId: {{EphemeralID: eph.EphemeralId, RoundID: 3, MessageHash: []byte("hello"), IdentityFP: []byte("identity")}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to send batch: %+v", err)
+	}
+	summary := cycle.summary()
+	if !strings.Contains(summary, "ephemerals=1 users=1 cacheHits=0 held=0 queued=0 attempted=1 succeeded=1 failed=0 ") {
+		t.Errorf("Unexpected cycle summary: %s", summary)
+	}
+}
+
+// Tests that failed sends are counted by reason.
+func Test_sendCycle_sent(t *testing.T) {
+	_, cycle := withSendCycle(context.Background())
+	for _, res := range []NotificationResult{
+		{TokenValid: true},
+		{TokenValid: false, Err: errors.New("unregistered")},
+		{TokenValid: true, Err: errors.WithMessage(providers.ErrMisconfigured, "bad key")},
+		{TokenValid: true, Err: context.DeadlineExceeded},
+		{TokenValid: true, Err: errors.New("unavailable"), Receipt: providers.Receipt{Status: 503}},
+		{TokenValid: true, Err: errors.New("unavailable"), Receipt: providers.Receipt{Status: 503}},
+		{TokenValid: true, Err: errors.New("reset")},
+	} {
+		cycle.sent(res)
+	}
+	summary := cycle.summary()
+	expected := "attempted=7 succeeded=1 failed=6 failedBy=503:2,error:1,invalidToken:1,misconfigured:1,timeout:1 "
+	if !strings.Contains(summary, expected) {
+		t.Errorf("Expected %q in cycle summary: %s", expected, summary)
+	}
+	var none *sendCycle
+	none.sent(NotificationResult{})
+}
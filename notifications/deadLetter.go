@@ -0,0 +1,163 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package notifications
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// deadLetter moves a notification which could not be delivered after all
+// attempts into the dead-letter queue.
+func (nb *Impl) deadLetter(req NotificationRequest, res NotificationResult) {
+	target := req.Target
+	err := nb.Storage.InsertDeadLetter(&storage.DeadLetter{
+		TransmissionRSAHash: target.TransmissionRSAHash,
+		Token:               target.Token,
+		App:                 target.App,
+		EphemeralId:         target.EphemeralId,
+		Rounds:              req.Rounds,
+		Payload:             req.Payload,
+		Attempts:            res.Attempts,
+		Error:               res.Err.Error(),
+		Timestamp:           time.Now(),
+	})
+	if err != nil {
+		jww.ERROR.Printf("Failed to add notification for tRSA hash %+v to dead-letter queue: %+v", target.TransmissionRSAHash, err)
+	}
+}
+
+// RedriveDeadLetter removes the dead letter with the passed in ID from the
+// queue and attempts to send it again. The send uses the owner's current
+// registration of the token, so the dead letter is kept if the token has since
+// been unregistered. If the send fails, it is re-added to the queue as a new
+// entry. The send is abandoned if ctx is done first.
+func (nb *Impl) RedriveDeadLetter(ctx context.Context, id uint) error {
+	dl, err := nb.Storage.GetDeadLetter(id)
+	if err != nil {
+		return errors.WithMessagef(err, "Failed to get dead letter %d", id)
+	}
+	token, err := nb.Storage.GetOwnedToken(dl.Token, dl.App, dl.TransmissionRSAHash)
+	if err != nil {
+		return errors.WithMessagef(err, "Failed to get token of dead letter %d", id)
+	}
+	err = nb.Storage.DeleteDeadLetter(id)
+	if err != nil {
+		return errors.WithMessagef(err, "Failed to remove dead letter %d", id)
+	}
+
+	return nb.notify(ctx, NotificationRequest{
+		Target: storage.GTNResult{
+			Token:               token.Token,
+			SealedToken:         token.SealedToken,
+			App:                 token.App,
+			Priority:            token.Priority,
+			ChannelID:           token.ChannelID,
+			Sound:               token.Sound,
+			Locale:              token.Locale,
+			Privacy:             token.Privacy,
+			Fallback:            token.Fallback,
+			TransmissionRSAHash: token.TransmissionRSAHash,
+			EphemeralId:         dl.EphemeralId,
+		},
+		Payload: dl.Payload,
+		Rounds:  dl.Rounds,
+	}).Err
+}
+
+// handleDeadLetters serves the dead-letter queue admin endpoint.
+//   - GET lists all entries in the queue
+//   - DELETE purges the entry with the given id, or all entries if all=true
+func (nb *Impl) handleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		dls, err := nb.Storage.GetDeadLetters()
+		if err != nil {
+			adminError(w, http.StatusInternalServerError, errors.WithMessage(err, "Failed to get dead letters"))
+			return
+		}
+		writeJSON(w, dls)
+	case http.MethodDelete:
+		if r.URL.Query().Get("all") == "true" {
+			err := nb.Storage.DeleteAllDeadLetters()
+			if err != nil {
+				adminError(w, http.StatusInternalServerError, errors.WithMessage(err, "Failed to purge dead letters"))
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		id, err := parseDeadLetterID(r)
+		if err != nil {
+			adminError(w, http.StatusBadRequest, err)
+			return
+		}
+		err = nb.Storage.DeleteDeadLetter(id)
+		if err != nil {
+			adminError(w, http.StatusInternalServerError, errors.WithMessagef(err, "Failed to purge dead letter %d", id))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		adminError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// handleRedrive serves the dead-letter re-drive admin endpoint. A POST re-sends
+// the entry with the given id, or every entry in the queue if all=true.
+func (nb *Impl) handleRedrive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		adminError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	var ids []uint
+	if r.URL.Query().Get("all") == "true" {
+		dls, err := nb.Storage.GetDeadLetters()
+		if err != nil {
+			adminError(w, http.StatusInternalServerError, errors.WithMessage(err, "Failed to get dead letters"))
+			return
+		}
+		for _, dl := range dls {
+			ids = append(ids, dl.ID)
+		}
+	} else {
+		id, err := parseDeadLetterID(r)
+		if err != nil {
+			adminError(w, http.StatusBadRequest, err)
+			return
+		}
+		ids = []uint{id}
+	}
+
+	// Report the outcome of each re-drive by dead letter ID
+	results := make(map[uint]string, len(ids))
+	for _, id := range ids {
+		err := nb.RedriveDeadLetter(r.Context(), id)
+		if err != nil {
+			results[id] = err.Error()
+		} else {
+			results[id] = "delivered"
+		}
+	}
+	writeJSON(w, results)
+}
+
+// parseDeadLetterID reads the id query parameter of a dead-letter request.
+func parseDeadLetterID(r *http.Request) (uint, error) {
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		return 0, errors.New("id must be a dead letter ID, or all=true must be set")
+	}
+	return uint(id), nil
+}
@@ -0,0 +1,137 @@
+package notifications
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/elixxir/notifications-bot/notifications/providers"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gitlab.com/elixxir/notifications-bot/testutil"
+	"testing"
+)
+
+// failingProvider fails the first fails sends made through it.
+type failingProvider struct {
+	fails int
+	calls int
+	last  storage.GTNResult
+}
+
+func (fp *failingProvider) Notify(_ context.Context, csv string, target storage.GTNResult) (providers.Receipt, bool, error) {
+	fp.calls++
+	fp.last = target
+	if fp.calls <= fp.fails {
+		return providers.Receipt{}, true, errors.New("provider unavailable")
+	}
+	return providers.Receipt{MessageID: "delivered"}, true, nil
+}
+
+// Tests that a notification is dead-lettered once all attempts fail and can
+// then be re-driven.
+func TestImpl_notify_DeadLetter(t *testing.T) {
+	s, err := storage.NewStorage("", "", "TestImpl_notify_DeadLetter", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+	fp := &failingProvider{fails: 2}
+	impl := &Impl{
+		Storage:         s,
+		maxSendAttempts: 2,
+		providers: map[string]providers.Provider{
+			constants.MessengerAndroid.String(): fp,
+		},
+	}
+
+	app := constants.MessengerAndroid.String()
+	if err = s.RegisterToken("token", app, []byte("trsa")); err != nil {
+		t.Fatalf("Failed to register token: %+v", err)
+	}
+	trsaHash, err := storage.HashTransmissionRSA([]byte("trsa"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SetTokenLocale("token", app, trsaHash, "de"); err != nil {
+		t.Fatalf("Failed to set token locale: %+v", err)
+	}
+
+	target := storage.GTNResult{
+		Token:               "token",
+		App:                 app,
+		TransmissionRSAHash: trsaHash,
+		EphemeralId:         5,
+	}
+	err = impl.notify(context.Background(), NotificationRequest{Target: target, Payload: "csv", Rounds: []uint64{42}}).Err
+	if err == nil {
+		t.Fatalf("notify should have returned an error")
+	}
+	if fp.calls != 2 {
+		t.Errorf("Expected %d send attempts, provider received %d", 2, fp.calls)
+	}
+
+	dls, err := s.GetDeadLetters()
+	if err != nil {
+		t.Fatalf("Failed to get dead letters: %+v", err)
+	}
+	if len(dls) != 1 {
+		t.Fatalf("Expected %d dead letter, found %d", 1, len(dls))
+	}
+	if dls[0].Attempts != 2 || dls[0].Payload != "csv" || len(dls[0].Rounds) != 1 || dls[0].Rounds[0] != 42 {
+		t.Errorf("Dead letter did not contain expected data: %+v", dls[0])
+	}
+
+	err = impl.RedriveDeadLetter(context.Background(), dls[0].ID)
+	if err != nil {
+		t.Fatalf("Failed to redrive dead letter: %+v", err)
+	}
+	if fp.last.Locale != "de" || fp.last.EphemeralId != 5 {
+		t.Errorf("Redrive should send with the owner's registration: %+v", fp.last)
+	}
+	dls, err = s.GetDeadLetters()
+	if err != nil {
+		t.Fatalf("Failed to get dead letters: %+v", err)
+	}
+	if len(dls) != 0 {
+		t.Errorf("Dead letter queue should be empty after successful redrive: %+v", dls)
+	}
+}
+
+// Tests that a send rejected because of the bot's configuration is not
+// retried, and is dead-lettered without purging the token.
+func TestImpl_notify_Misconfigured(t *testing.T) {
+	s, err := storage.NewStorage("", "", "TestImpl_notify_Misconfigured", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+	p := testutil.NewProvider(testutil.Result{Err: errors.WithMessage(providers.ErrMisconfigured, "bad credentials")})
+	impl := &Impl{
+		Storage:         s,
+		maxSendAttempts: 3,
+		providers: map[string]providers.Provider{
+			constants.MessengerAndroid.String(): p,
+		},
+	}
+	if err = s.RegisterToken("token", constants.MessengerAndroid.String(), []byte("trsa")); err != nil {
+		t.Fatalf("Failed to register token: %+v", err)
+	}
+
+	target := storage.GTNResult{
+		Token:               "token",
+		App:                 constants.MessengerAndroid.String(),
+		TransmissionRSAHash: []byte("trsaHash"),
+		EphemeralId:         5,
+	}
+	err = impl.notify(context.Background(), NotificationRequest{Target: target, Payload: "csv", Rounds: []uint64{42}}).Err
+	if !errors.Is(err, providers.ErrMisconfigured) {
+		t.Fatalf("Expected misconfiguration error, received %+v", err)
+	}
+	if sends := p.Sends(); len(sends) != 1 {
+		t.Errorf("Misconfiguration should not be retried, provider received %d sends", len(sends))
+	}
+	dls, err := s.GetDeadLetters()
+	if err != nil || len(dls) != 1 {
+		t.Errorf("Expected the notification to be dead-lettered: %+v %+v", dls, err)
+	}
+	if _, err = s.GetToken("token", constants.MessengerAndroid.String()); err != nil {
+		t.Errorf("Token should not be purged: %+v", err)
+	}
+}
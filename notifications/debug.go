@@ -0,0 +1,88 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Profiling endpoints of the admin API, used to diagnose latency in the
+// notification loops of a running bot
+
+package notifications
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
+	rpprof "runtime/pprof"
+	"time"
+)
+
+// registerDebug adds the net/http/pprof handlers, a goroutine dump and the
+// heap profile trigger to the passed in admin mux.
+func (nb *Impl) registerDebug(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/goroutines", handleGoroutines)
+	mux.HandleFunc("/debug/heap", nb.handleHeapProfile)
+}
+
+// handleGoroutines writes the stack traces of all goroutines as text, in the
+// format of an unrecovered panic.
+func handleGoroutines(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		adminError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	err := rpprof.Lookup("goroutine").WriteTo(w, 2)
+	if err != nil {
+		jww.ERROR.Printf("Failed to write goroutine dump: %+v", err)
+	}
+}
+
+// handleHeapProfile runs a garbage collection and takes a heap profile. If a
+// profile directory is configured the profile is written there and its path
+// returned, otherwise the profile itself is returned.
+func (nb *Impl) handleHeapProfile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		adminError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	runtime.GC()
+	if nb.profileDir == "" {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", `attachment; filename="heap.pprof"`)
+		err := rpprof.WriteHeapProfile(w)
+		if err != nil {
+			jww.ERROR.Printf("Failed to write heap profile: %+v", err)
+		}
+		return
+	}
+
+	path := filepath.Join(nb.profileDir, fmt.Sprintf("heap-%s.pprof", time.Now().UTC().Format("20060102T150405.000")))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, errors.WithMessage(err, "Failed to create heap profile"))
+		return
+	}
+	err = rpprof.WriteHeapProfile(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		adminError(w, http.StatusInternalServerError, errors.WithMessage(err, "Failed to write heap profile"))
+		return
+	}
+	jww.INFO.Printf("Heap profile written to %s", path)
+	writeJSON(w, map[string]string{"path": path})
+}
@@ -0,0 +1,67 @@
+package notifications
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Tests that the profiling endpoints are served behind the admin token.
+func TestImpl_registerDebug(t *testing.T) {
+	impl := &Impl{}
+	handler := impl.adminHandler("secret")
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newAdminRequest(http.MethodGet, "/debug/pprof/", ""))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d without token, received %d", http.StatusUnauthorized, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newAdminRequest(http.MethodGet, "/debug/pprof/", "secret"))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "goroutine") {
+		t.Errorf("Expected pprof index, received %d: %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newAdminRequest(http.MethodGet, "/debug/goroutines", "secret"))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "TestImpl_registerDebug") {
+		t.Errorf("Goroutine dump did not include the test's stack, received %d", w.Code)
+	}
+}
+
+// Tests that heap profiles are written to the profile directory, or returned
+// if there is none.
+func TestImpl_handleHeapProfile(t *testing.T) {
+	impl := &Impl{profileDir: t.TempDir()}
+	handler := impl.adminHandler("secret")
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newAdminRequest(http.MethodGet, "/debug/heap", "secret"))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status %d for GET, received %d", http.StatusMethodNotAllowed, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newAdminRequest(http.MethodPost, "/debug/heap", "secret"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to take heap profile: %d %s", w.Code, w.Body.String())
+	}
+	var resp map[string]string
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %+v", err)
+	}
+	if fi, err := os.Stat(resp["path"]); err != nil || fi.Size() == 0 {
+		t.Errorf("Heap profile not written to %q: %+v", resp["path"], err)
+	}
+
+	impl.profileDir = ""
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newAdminRequest(http.MethodPost, "/debug/heap", "secret"))
+	if w.Code != http.StatusOK || w.Body.Len() == 0 {
+		t.Errorf("Expected heap profile in response, received %d with %d bytes", w.Code, w.Body.Len())
+	}
+}
@@ -0,0 +1,482 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// While the database is read-only, as when a replica is being promoted to
+// primary, registrations are accepted into a write-ahead buffer and applied in
+// order once writes succeed again, and token lookups which fail are served
+// from the results of recent lookups, so the bot keeps pushing and clients do
+// not see every RPC fail.
+
+package notifications
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DegradedParams configures how the bot runs while the database is
+// read-only.
+type DegradedParams struct {
+	// Enabled buffers registrations while the database is read-only rather
+	// than failing them
+	Enabled bool
+	// WALPath is the file buffered registrations are kept in, so they survive
+	// a restart; they are only held in memory if empty. Registrations are
+	// sealed with the token key if tokens are encrypted
+	WALPath string
+	// MaxQueued bounds the buffered registrations; further registrations
+	// fail until the buffer is flushed. Unbounded if 0
+	MaxQueued int
+	// FlushInterval is how often buffered registrations are retried
+	FlushInterval time.Duration
+	// LookupCacheTTL is how long the results of token lookups are kept to
+	// serve sends when lookups fail; nothing is cached if 0
+	LookupCacheTTL time.Duration
+}
+
+// writeKind is the kind of registration held in the write-ahead buffer.
+type writeKind string
+
+const (
+	registerTokenWrite       writeKind = "registerToken"
+	registerTrackedIDWrite   writeKind = "registerTrackedID"
+	registerIdentityWrite    writeKind = "registerIdentity"
+	registerFallbackWrite    writeKind = "registerFallback"
+	unregisterTokenWrite     writeKind = "unregisterToken"
+	unregisterTrackedIDWrite writeKind = "unregisterTrackedID"
+)
+
+// pendingWrite is a verified registration waiting to be written. Ephemeral
+// IDs are generated for the epoch it is applied in.
+type pendingWrite struct {
+	Kind               writeKind
+	Token              string   `json:",omitempty"`
+	App                string   `json:",omitempty"`
+	PrimaryToken       string   `json:",omitempty"`
+	TransmissionRsaPem []byte   `json:",omitempty"`
+	IntermediaryIDs    [][]byte `json:",omitempty"`
+	// Options are sent by the client when registering a token
+	Options TokenOptions
+	// RegistrationTimestamp and RegistrarSig are the permissioning signature
+	// the registration was accepted with, recorded so it can be re-verified
+	RegistrationTimestamp int64  `json:",omitempty"`
+	RegistrarSig          []byte `json:",omitempty"`
+	Queued                time.Time
+}
+
+// walAD binds registrations sealed in the write-ahead buffer's file to it.
+var walAD = []byte("write-ahead buffer")
+
+// recordSealer seals the registrations written to the write-ahead buffer's
+// file.
+type recordSealer interface {
+	SealRecord(record, ad []byte) ([]byte, error)
+	OpenRecord(sealed, ad []byte) ([]byte, error)
+}
+
+// writeAheadBuffer holds registrations received while the database is
+// read-only, in the order they were received.
+type writeAheadBuffer struct {
+	mux     sync.Mutex
+	path    string
+	max     int
+	sealer  recordSealer // nil if registrations are written in the clear
+	pending []pendingWrite
+	// readOnly is set while writes fail because the database is read-only
+	readOnly uint32
+}
+
+// newWriteAheadBuffer returns a buffer persisted to the file at path, loading
+// any registrations left in it. Registrations are sealed with sealer if it is
+// not nil.
+func newWriteAheadBuffer(path string, max int, sealer recordSealer) (*writeAheadBuffer, error) {
+	b := &writeAheadBuffer{path: path, max: max, sealer: sealer}
+	if path == "" {
+		return b, nil
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return b, nil
+	} else if err != nil {
+		return nil, errors.WithMessage(err, "Failed to open write-ahead buffer")
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		w, err := b.decode(scanner.Bytes())
+		if err != nil {
+			return nil, errors.WithMessage(err, "Failed to read write-ahead buffer")
+		}
+		b.pending = append(b.pending, w)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, errors.WithMessage(err, "Failed to read write-ahead buffer")
+	}
+	if len(b.pending) > 0 {
+		jww.INFO.Printf("Loaded %d buffered registrations from %s", len(b.pending), path)
+	}
+	return b, nil
+}
+
+// encode returns the line w is kept under in the buffer's file: its JSON,
+// sealed and base64 encoded if the buffer has a sealer.
+func (b *writeAheadBuffer) encode(w pendingWrite) ([]byte, error) {
+	line, err := json.Marshal(w)
+	if err != nil || b.sealer == nil {
+		return line, err
+	}
+	sealed, err := b.sealer.SealRecord(line, walAD)
+	if err != nil {
+		return nil, err
+	}
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(sealed)))
+	base64.StdEncoding.Encode(encoded, sealed)
+	return encoded, nil
+}
+
+// decode returns the registration kept under a line of the buffer's file.
+// Lines written in the clear, before tokens were encrypted, are read as is.
+func (b *writeAheadBuffer) decode(line []byte) (pendingWrite, error) {
+	var w pendingWrite
+	if len(line) > 0 && line[0] != '{' {
+		if b.sealer == nil {
+			return w, errors.New("registration is sealed but tokens are not encrypted")
+		}
+		sealed, err := base64.StdEncoding.DecodeString(string(line))
+		if err != nil {
+			return w, err
+		}
+		if line, err = b.sealer.OpenRecord(sealed, walAD); err != nil {
+			return w, err
+		}
+	}
+	return w, json.Unmarshal(line, &w)
+}
+
+// add appends w to the buffer, syncing it to the buffer's file.
+func (b *writeAheadBuffer) add(w pendingWrite) error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.max > 0 && len(b.pending) >= b.max {
+		return errors.Errorf("Database is read-only and %d registrations are already buffered, retry later", len(b.pending))
+	}
+	if b.path != "" {
+		line, err := b.encode(w)
+		if err != nil {
+			return errors.WithMessage(err, "Failed to encode registration")
+		}
+		f, err := os.OpenFile(b.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return errors.WithMessage(err, "Failed to open write-ahead buffer")
+		}
+		_, err = f.Write(append(line, '\n'))
+		if err == nil {
+			err = f.Sync()
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return errors.WithMessage(err, "Failed to write registration to write-ahead buffer")
+		}
+	}
+	b.pending = append(b.pending, w)
+	return nil
+}
+
+// len returns the number of buffered registrations.
+func (b *writeAheadBuffer) len() int {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return len(b.pending)
+}
+
+// flush applies the buffered registrations in order until one fails because
+// the database is still read-only or with a transient error, removing those
+// applied. Registrations which fail for any other reason are dropped, as they
+// would have failed had they been applied when received.
+func (b *writeAheadBuffer) flush(apply func(w pendingWrite) error) error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	applied := 0
+	var err error
+	for _, w := range b.pending {
+		err = apply(w)
+		if storage.IsReadOnly(err) || storage.IsTransient(err) {
+			break
+		} else if err != nil {
+			jww.WARN.Printf("Dropping buffered %s registration from %s: %+v", w.Kind, w.Queued, err)
+		}
+		applied++
+		err = nil
+	}
+	if applied == 0 {
+		return err
+	}
+	b.pending = b.pending[applied:]
+	if b.path != "" {
+		if rewriteErr := b.rewrite(); rewriteErr != nil {
+			return rewriteErr
+		}
+	}
+	jww.INFO.Printf("Applied %d buffered registrations, %d remain", applied, len(b.pending))
+	return err
+}
+
+// rewrite replaces the buffer's file with the pending registrations.
+func (b *writeAheadBuffer) rewrite() error {
+	tmp := b.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.WithMessage(err, "Failed to rewrite write-ahead buffer")
+	}
+	w := bufio.NewWriter(f)
+	for _, p := range b.pending {
+		var line []byte
+		if line, err = b.encode(p); err != nil {
+			break
+		}
+		if _, err = w.Write(append(line, '\n')); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.WithMessage(err, "Failed to rewrite write-ahead buffer")
+	}
+	return errors.WithMessage(os.Rename(tmp, b.path), "Failed to replace write-ahead buffer")
+}
+
+// OpenWriteAhead creates the write-ahead buffer if registrations are buffered
+// while the database is read-only, loading any left in its file. It must be
+// called once storage is set, as registrations are sealed with the token key
+// if tokens are encrypted.
+func (nb *Impl) OpenWriteAhead() error {
+	if !nb.degraded.Enabled {
+		return nil
+	}
+	var sealer recordSealer
+	if nb.Storage.TokensEncrypted() {
+		sealer = nb.Storage
+	}
+	var err error
+	nb.writeAhead, err = newWriteAheadBuffer(nb.degraded.WALPath, nb.degraded.MaxQueued, sealer)
+	return err
+}
+
+// write applies a verified registration, buffering it instead if the
+// database is read-only. While registrations are buffered, new ones are
+// buffered behind them so they are applied in the order received.
+func (nb *Impl) write(w pendingWrite) error {
+	if nb.writeAhead == nil {
+		return nb.applyWrite(w)
+	}
+	if nb.writeAhead.len() == 0 {
+		err := nb.applyWrite(w)
+		if !storage.IsReadOnly(err) {
+			return err
+		}
+		if atomic.CompareAndSwapUint32(&nb.writeAhead.readOnly, 0, 1) {
+			jww.ERROR.Printf("Database is read-only, buffering registrations: %+v", err)
+		}
+	}
+	w.Queued = nb.now()
+	return nb.writeAhead.add(w)
+}
+
+// applyWrite writes a registration to storage, recording the registrar
+// signature it was accepted with.
+func (nb *Impl) applyWrite(w pendingWrite) error {
+	err := nb.writeRegistration(w)
+	if err != nil || len(w.RegistrarSig) == 0 {
+		return err
+	}
+	trsaHash, err := storage.HashTransmissionRSA(w.TransmissionRsaPem)
+	if err != nil {
+		return errors.WithMessage(err, "Failed to hash transmission RSA")
+	}
+	return nb.Storage.SetUserRegistrar(trsaHash, w.RegistrationTimestamp, w.RegistrarSig)
+}
+
+// writeRegistration writes the registration itself to storage.
+func (nb *Impl) writeRegistration(w pendingWrite) error {
+	switch w.Kind {
+	case registerTokenWrite:
+		err := nb.Storage.RegisterToken(w.Token, w.App, w.TransmissionRsaPem)
+		if err != nil {
+			return err
+		}
+		if w.Options.TokenProvenance.Empty() && w.Options.Privacy == nil {
+			return nil
+		}
+		trsaHash, err := storage.HashTransmissionRSA(w.TransmissionRsaPem)
+		if err != nil {
+			return errors.WithMessage(err, "Failed to hash transmission RSA")
+		}
+		if !w.Options.TokenProvenance.Empty() {
+			err = nb.Storage.SetTokenProvenance(w.Token, w.App, trsaHash, w.Options.TokenProvenance)
+			if err != nil {
+				return err
+			}
+		}
+		if w.Options.Privacy != nil {
+			return nb.Storage.SetTokenPrivacy(w.Token, w.App, trsaHash, string(*w.Options.Privacy))
+		}
+		return nil
+	case registerTrackedIDWrite:
+		_, epoch := nb.quantize(nb.now())
+		return nb.Storage.RegisterTrackedID(w.IntermediaryIDs, w.TransmissionRsaPem, epoch,
+			nb.instance().GetPartialNdf().Get().AddressSpace[0].Size)
+	case registerIdentityWrite:
+		_, epoch := nb.quantize(nb.now())
+		return nb.Storage.RegisterIdentity(w.Token, w.App, w.TransmissionRsaPem, w.IntermediaryIDs, epoch,
+			nb.instance().GetPartialNdf().Get().AddressSpace[0].Size)
+	case registerFallbackWrite:
+		return nb.Storage.RegisterFallbackToken(w.PrimaryToken, w.Token, w.App, w.TransmissionRsaPem)
+	case unregisterTokenWrite:
+		return nb.Storage.UnregisterToken(w.Token, w.TransmissionRsaPem)
+	case unregisterTrackedIDWrite:
+		return nb.Storage.UnregisterTrackedIDs(w.IntermediaryIDs, w.TransmissionRsaPem)
+	default:
+		return errors.Errorf("Unknown registration kind %q", w.Kind)
+	}
+}
+
+// WriteAheadFlusher is a long-running thread which applies buffered
+// registrations every flush interval once the database accepts writes again.
+func (nb *Impl) WriteAheadFlusher() {
+	if nb.writeAhead == nil {
+		return
+	}
+	interval := nb.degraded.FlushInterval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-nb.context().Done():
+			return
+		case <-ticker.C:
+			nb.flushWriteAhead()
+		}
+	}
+}
+
+// flushWriteAhead applies buffered registrations, clearing the read-only flag
+// once all of them have been applied.
+func (nb *Impl) flushWriteAhead() {
+	if nb.writeAhead.len() == 0 {
+		return
+	}
+	err := nb.writeAhead.flush(nb.applyWrite)
+	if err != nil {
+		jww.DEBUG.Printf("Buffered registrations not applied yet: %+v", err)
+		return
+	}
+	if nb.writeAhead.len() == 0 && atomic.CompareAndSwapUint32(&nb.writeAhead.readOnly, 1, 0) {
+		jww.INFO.Printf("Database accepts writes again, all buffered registrations applied")
+	}
+}
+
+// cachedLookup holds the token lookup results for an ephemeral ID.
+type cachedLookup struct {
+	results []storage.GTNResult
+	at      time.Time
+}
+
+// lookupCache holds recent token lookup results by ephemeral ID, so sends can
+// continue while the database cannot be read.
+type lookupCache struct {
+	mux       sync.Mutex
+	ttl       time.Duration
+	entries   map[int64]cachedLookup
+	lastSweep time.Time
+}
+
+// put records the results of a lookup of the passed in ephemeral IDs,
+// evicting expired entries at most once per TTL.
+func (c *lookupCache) put(ephemerals []int64, results []storage.GTNResult, now time.Time) {
+	byEphemeral := make(map[int64][]storage.GTNResult, len(ephemerals))
+	for _, res := range results {
+		byEphemeral[res.EphemeralId] = append(byEphemeral[res.EphemeralId], res)
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.entries == nil {
+		c.entries = map[int64]cachedLookup{}
+	}
+	for _, eid := range ephemerals {
+		c.entries[eid] = cachedLookup{results: byEphemeral[eid], at: now}
+	}
+	if now.Sub(c.lastSweep) > c.ttl {
+		for eid, e := range c.entries {
+			if now.Sub(e.at) > c.ttl {
+				delete(c.entries, eid)
+			}
+		}
+		c.lastSweep = now
+	}
+}
+
+// get returns the cached results for the passed in ephemeral IDs, and false
+// if any of them has no unexpired entry.
+func (c *lookupCache) get(ephemerals []int64, now time.Time) ([]storage.GTNResult, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	var results []storage.GTNResult
+	for _, eid := range ephemerals {
+		e, ok := c.entries[eid]
+		if !ok || now.Sub(e.at) > c.ttl {
+			return nil, false
+		}
+		results = append(results, e.results...)
+	}
+	return results, true
+}
+
+// cachedLookup returns the cached token lookup results for the passed in
+// ephemeral IDs, and false if lookups are not cached or any of them is missing.
+func (nb *Impl) cachedLookup(ephemerals []int64) ([]storage.GTNResult, bool) {
+	if nb.lookups == nil {
+		return nil, false
+	}
+	return nb.lookups.get(ephemerals, nb.now())
+}
+
+// formatDegradedMetrics renders the read-only state and the number of
+// buffered registrations as Prometheus gauges.
+func formatDegradedMetrics(b *writeAheadBuffer) string {
+	if b == nil {
+		return ""
+	}
+	return fmt.Sprintf("# HELP notifications_db_read_only Whether registrations are being buffered because the database is read-only.\n"+
+		"# TYPE notifications_db_read_only gauge\n"+
+		"notifications_db_read_only %d\n"+
+		"# HELP notifications_buffered_registrations Registrations waiting for the database to accept writes.\n"+
+		"# TYPE notifications_buffered_registrations gauge\n"+
+		"notifications_buffered_registrations %d\n", atomic.LoadUint32(&b.readOnly), b.len())
+}
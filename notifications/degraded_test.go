@@ -0,0 +1,139 @@
+package notifications
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// readOnlyErr is the error postgres returns for writes to a read-only
+// database.
+type readOnlyErr struct{}
+
+func (readOnlyErr) Error() string    { return "cannot execute INSERT in a read-only transaction" }
+func (readOnlyErr) SQLState() string { return "25006" }
+
+// Tests that buffered registrations survive a restart and are applied in
+// order once writes stop failing as read-only or transiently, dropping those
+// which fail for other reasons.
+func TestWriteAheadBuffer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+	b, err := newWriteAheadBuffer(path, 3, nil)
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %+v", err)
+	}
+	for _, token := range []string{"a", "b", "c"} {
+		if err = b.add(pendingWrite{Kind: registerTokenWrite, Token: token}); err != nil {
+			t.Fatalf("Failed to buffer registration: %+v", err)
+		}
+	}
+	if err = b.add(pendingWrite{Kind: registerTokenWrite, Token: "d"}); err == nil {
+		t.Errorf("Registrations past the limit should be rejected")
+	}
+
+	b, err = newWriteAheadBuffer(path, 3, nil)
+	if err != nil {
+		t.Fatalf("Failed to reload buffer: %+v", err)
+	}
+	if b.len() != 3 {
+		t.Fatalf("Expected 3 registrations after reload, got %d", b.len())
+	}
+
+	err = b.flush(func(w pendingWrite) error { return errors.WithStack(readOnlyErr{}) })
+	if !storage.IsReadOnly(err) || b.len() != 3 {
+		t.Errorf("Nothing should be applied while read-only, got %+v with %d left", err, b.len())
+	}
+	err = b.flush(func(w pendingWrite) error { return errors.WithStack(syscall.ECONNRESET) })
+	if !errors.Is(err, syscall.ECONNRESET) || b.len() != 3 {
+		t.Errorf("Nothing should be dropped on transient errors, got %+v with %d left", err, b.len())
+	}
+
+	var applied []string
+	err = b.flush(func(w pendingWrite) error {
+		switch w.Token {
+		case "b":
+			return errors.New("invalid")
+		case "c":
+			return readOnlyErr{}
+		}
+		applied = append(applied, w.Token)
+		return nil
+	})
+	if !storage.IsReadOnly(err) || b.len() != 1 || len(applied) != 1 || applied[0] != "a" {
+		t.Errorf("Expected a applied, b dropped and c left, got %v with %d left: %+v", applied, b.len(), err)
+	}
+
+	b, err = newWriteAheadBuffer(path, 3, nil)
+	if err != nil {
+		t.Fatalf("Failed to reload buffer: %+v", err)
+	}
+	if b.len() != 1 || b.pending[0].Token != "c" {
+		t.Errorf("Only c should remain after reload, got %+v", b.pending)
+	}
+}
+
+// Tests that with tokens encrypted, buffered registrations are sealed in the
+// buffer's file and can only be read back with the token key.
+func TestWriteAheadBuffer_Sealed(t *testing.T) {
+	s, err := storage.NewStorageFromParams(storage.Params{
+		DBName:         "TestWriteAheadBuffer_Sealed",
+		TokenLookupKey: bytes.Repeat([]byte{1}, storage.TokenKeySize),
+		TokenKeys:      map[uint8][]byte{1: bytes.Repeat([]byte{2}, storage.TokenKeySize)},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+	path := filepath.Join(t.TempDir(), "wal")
+	b, err := newWriteAheadBuffer(path, 0, s)
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %+v", err)
+	}
+	for _, token := range []string{"secretToken", "otherToken"} {
+		err = b.add(pendingWrite{Kind: registerTokenWrite, Token: token, TransmissionRsaPem: []byte("secretPem")})
+		if err != nil {
+			t.Fatalf("Failed to buffer registration: %+v", err)
+		}
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(contents, []byte("secret")) {
+		t.Errorf("Buffered registrations should be sealed: %s", contents)
+	}
+
+	if _, err = newWriteAheadBuffer(path, 0, nil); err == nil {
+		t.Errorf("Sealed registrations should not load without the token key")
+	}
+	b, err = newWriteAheadBuffer(path, 0, s)
+	if err != nil {
+		t.Fatalf("Failed to reload buffer: %+v", err)
+	}
+	if b.len() != 2 || b.pending[0].Token != "secretToken" || string(b.pending[1].TransmissionRsaPem) != "secretPem" {
+		t.Errorf("Unexpected registrations after reload: %+v", b.pending)
+	}
+}
+
+// Tests that cached lookups are only served for ephemeral IDs all looked up
+// within the TTL.
+func TestLookupCache(t *testing.T) {
+	c := &lookupCache{ttl: time.Minute}
+	now := time.Unix(1000, 0)
+	c.put([]int64{1, 2}, []storage.GTNResult{{EphemeralId: 1, Token: "a"}, {EphemeralId: 1, Token: "b"}}, now)
+
+	results, ok := c.get([]int64{1, 2}, now.Add(time.Second))
+	if !ok || len(results) != 2 {
+		t.Errorf("Expected both results for 1 and none for 2, got %+v", results)
+	}
+	if _, ok = c.get([]int64{1, 3}, now); ok {
+		t.Errorf("Lookups including an uncached ephemeral ID should miss")
+	}
+	if _, ok = c.get([]int64{1}, now.Add(2*time.Minute)); ok {
+		t.Errorf("Expired lookups should miss")
+	}
+}
@@ -0,0 +1,71 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package notifications
+
+import (
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"time"
+)
+
+// deliveryLogCleanFreq is how often expired delivery logs are removed.
+const deliveryLogCleanFreq = time.Hour
+
+// logDelivery records the outcome of a send to a provider in the delivery log,
+// with one entry for each round covered by the send.
+func (nb *Impl) logDelivery(req NotificationRequest, res NotificationResult) {
+	now := time.Now()
+	var errStr string
+	if res.Err != nil {
+		errStr = res.Err.Error()
+	}
+
+	target := req.Target
+	logs := make([]*storage.DeliveryLog, 0, len(req.Rounds))
+	for _, rid := range req.Rounds {
+		logs = append(logs, &storage.DeliveryLog{
+			TransmissionRSAHash: target.TransmissionRSAHash,
+			Token:               target.Token,
+			App:                 target.App,
+			EphemeralId:         target.EphemeralId,
+			RoundId:             rid,
+			MessageId:           res.Receipt.MessageID,
+			Status:              res.Receipt.Status,
+			Error:               errStr,
+			Fallback:            target.FailedOver,
+			Timestamp:           now,
+		})
+	}
+
+	err := nb.Storage.InsertDeliveryLogs(logs)
+	if err != nil {
+		jww.WARN.Printf("Failed to record delivery of %s push for tRSA hash %+v: %+v", target.App, target.TransmissionRSAHash, err)
+	}
+}
+
+// DeliveryLogCleaner is a long-running thread which removes delivery log
+// entries and push history older than the passed in retention period.
+func (nb *Impl) DeliveryLogCleaner(retention time.Duration) {
+	ticker := time.NewTicker(deliveryLogCleanFreq)
+	for {
+		err := nb.Storage.DeleteDeliveryLogs(time.Now().Add(-retention))
+		if err != nil {
+			jww.WARN.Printf("Failed to delete expired delivery logs: %+v", err)
+		}
+		err = nb.Storage.DeletePushEvents(time.Now().Add(-retention))
+		if err != nil {
+			jww.WARN.Printf("Failed to delete expired push history: %+v", err)
+		}
+		// Push counts are only needed for the current day's quotas
+		err = nb.Storage.DeletePushCounts(startOfDay(nb.now()))
+		if err != nil {
+			jww.WARN.Printf("Failed to delete expired push counts: %+v", err)
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,101 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Users in digest mode are not pushed for each batch. Their non-urgent
+// notifications are held in storage and summarised in a single "You have N
+// new messages" push every digest interval.
+
+package notifications
+
+import (
+	"context"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"time"
+)
+
+// DigestParams configures digest mode.
+type DigestParams struct {
+	// Interval is how often held notifications are sent as a summary push.
+	// Digest mode is off if 0, and users who turned it on are pushed for
+	// each batch as usual
+	Interval time.Duration
+	// UrgentPriorities lists the token priority tiers whose notifications
+	// bypass the digest and are pushed at once
+	UrgentPriorities []string
+}
+
+// holdForDigest holds count notifications for target until its next summary
+// push if its user is in digest mode and the token's priority tier is not
+// urgent. It returns false if the notifications should be pushed now,
+// including when they could not be held.
+func (nb *Impl) holdForDigest(ctx context.Context, target storage.GTNResult, count int) bool {
+	if nb.digest.Interval <= 0 || !target.Digest || count == 0 {
+		return false
+	}
+	if !nb.featureEnabled(FeatureDigests, target.TransmissionRSAHash) {
+		return false
+	}
+	for _, urgent := range nb.digest.UrgentPriorities {
+		if target.Priority == urgent {
+			return false
+		}
+	}
+	err := nb.Storage.WithContext(ctx).AddToDigest(&storage.DigestEntry{
+		Token:               target.Token,
+		App:                 target.App,
+		TransmissionRsaHash: target.TransmissionRSAHash,
+		Target:              target,
+		Count:               int64(count),
+		HeldSince:           nb.now(),
+	})
+	if err != nil {
+		jww.ERROR.Printf("Failed to hold notifications for tRSA hash %+v for digest, sending now: %+v",
+			target.TransmissionRSAHash, err)
+		return false
+	}
+	return true
+}
+
+// DigestSender is a long-running thread which sends the notifications held
+// for each token as a single summary push every digest interval.
+func (nb *Impl) DigestSender() {
+	if nb.digest.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(nb.digest.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-nb.context().Done():
+			return
+		case <-ticker.C:
+			nb.sendDigests()
+		}
+	}
+}
+
+// sendDigests takes the held notifications and sends each token its summary
+// push. Notifications stay held while sends are paused.
+func (nb *Impl) sendDigests() {
+	if nb.inMaintenance() || !nb.isActive() {
+		return
+	}
+	entries, err := nb.Storage.TakeDigests()
+	if err != nil {
+		jww.ERROR.Printf("Failed to take held digest notifications: %+v", err)
+		return
+	}
+	for _, e := range entries {
+		target := e.Target
+		target.Count = int(e.Count)
+		target.Digested = true
+		go func(target storage.GTNResult) {
+			nb.notify(nb.context(), NotificationRequest{Target: target})
+		}(target)
+	}
+}
@@ -0,0 +1,97 @@
+package notifications
+
+import (
+	"context"
+	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/elixxir/notifications-bot/notifications/providers"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gitlab.com/elixxir/notifications-bot/testutil"
+	"gitlab.com/elixxir/primitives/notifications"
+	"gitlab.com/xx_network/primitives/id"
+	"gitlab.com/xx_network/primitives/id/ephemeral"
+	"testing"
+	"time"
+)
+
+// Tests that notifications for a user in digest mode are held for a summary
+// push with their count, while tokens in an urgent tier are pushed at once.
+func TestImpl_SendBatch_Digest(t *testing.T) {
+	s := testutil.NewStorage(t)
+	android := constants.MessengerAndroid.String()
+	provider := testutil.NewProvider()
+	impl := &Impl{
+		Storage:           s,
+		maxSendAttempts:   1,
+		maxNotifications:  20,
+		maxPayloadBytes:   4096,
+		maxPushesPerToken: 1,
+		digest:            DigestParams{Interval: time.Minute, UrgentPriorities: []string{"urgent"}},
+		providers:         map[string]providers.Provider{android: provider},
+	}
+
+	trsa := []byte("trsa")
+	iid, err := ephemeral.GetIntermediaryId(id.NewIdFromString("user", id.User, t))
+	if err != nil {
+		t.Fatalf("Failed to get intermediary ID: %+v", err)
+	}
+	for _, token := range []string{"held", "urgent"} {
+		if err = s.RegisterToken(token, android, trsa); err != nil {
+			t.Fatalf("Failed to register token: %+v", err)
+		}
+	}
+	trsaHash, err := storage.HashTransmissionRSA(trsa)
+	if err != nil {
+		t.Fatalf("Failed to hash transmission RSA: %+v", err)
+	}
+	if err = s.SetTokenPriority("urgent", android, trsaHash, "urgent"); err != nil {
+		t.Fatalf("Failed to set token priority: %+v", err)
+	}
+	if err = s.RegisterTrackedID([][]byte{iid}, trsa, 0, 8); err != nil {
+		t.Fatalf("Failed to register tracked ID: %+v", err)
+	}
+	if err = s.SetUserDigest(trsaHash, true); err != nil {
+		t.Fatalf("Failed to turn on digest mode: %+v", err)
+	}
+	eph, err := s.GetLatestEphemeral()
+	if err != nil {
+		t.Fatalf("Failed to get ephemeral: %+v", err)
+	}
+
+	for round := uint64(1); round <= 2; round++ {
+		_, err = impl.SendBatch(context.Background(), map[int64][]*notifications.Data{
+			eph.EphemeralId: {{EphemeralID: eph.EphemeralId, RoundID: round, MessageHash: []byte("hello"), IdentityFP: []byte("identity")}},
+		})
+		if err != nil {
+			t.Fatalf("Failed to send batch: %+v", err)
+		}
+	}
+	waitForSends(t, provider, 2)
+	for _, send := range provider.Sends() {
+		if send.Target.Token != "urgent" || send.Target.Digested {
+			t.Errorf("Only the urgent token should be pushed before the digest, got %+v", send.Target)
+		}
+	}
+
+	impl.sendDigests()
+	sends := waitForSends(t, provider, 3)
+	digest := sends[2].Target
+	if digest.Token != "held" || !digest.Digested || digest.Count != 2 || sends[2].CSV != "" {
+		t.Errorf("Expected a summary push of 2 notifications to the held token, got %+v", sends[2])
+	}
+}
+
+// waitForSends waits for the provider to have been sent n pushes and returns
+// them.
+func waitForSends(t *testing.T, provider *testutil.Provider, n int) []testutil.Send {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sends := provider.Sends()
+		if len(sends) >= n {
+			return sends
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d pushes, got %d", n, len(sends))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
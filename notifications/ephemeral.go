@@ -9,6 +9,7 @@ package notifications
 
 import (
 	"fmt"
+	"github.com/pkg/errors"
 	jww "github.com/spf13/jwalterweatherman"
 	"gitlab.com/elixxir/notifications-bot/storage"
 	"gitlab.com/xx_network/primitives/id/ephemeral"
@@ -16,105 +17,262 @@ import (
 	"time"
 )
 
-const offsetPhase = ephemeral.Period / ephemeral.NumOffsets
-const creationLead = 5 * time.Minute
-const deletionDelay = -(time.Duration(ephemeral.Period) + creationLead)
 const ephemeralStateKey = "lastEphemeralOffset"
 
-// EphIdCreator runs as a thread to track ephemeral IDs for users who registered to receive push notifications
+// Defaults of the EphemeralParams, matching the quantization of the
+// primitives library used by the cMix network.
+const (
+	defaultEphemeralPeriod = time.Duration(ephemeral.Period)
+	defaultCreationLead    = storage.DefaultCreationLead
+	defaultDeletionGrace   = defaultCreationLead
+)
+
+// EphemeralParams holds the ephemeral ID timing assumed by the bot; zero values
+// take the defaults. Ephemeral IDs are derived by the primitives library with
+// its own period and offsets, which clients use too, so Period and OffsetPhase
+// must match them and are only set so a configuration assuming other timing
+// is refused at startup.
+type EphemeralParams struct {
+	// Period is the length of an ephemeral ID's lifetime; must be
+	// ephemeral.Period
+	Period time.Duration
+	// OffsetPhase is the length of each of the ephemeral.NumOffsets offset
+	// buckets identities are spread across; must be ephemeral.NsPerOffset
+	OffsetPhase time.Duration
+	// CreationLead is how far ahead of an offset bucket ephemerals are
+	// generated for the identities in it
+	CreationLead time.Duration
+	// DeletionGrace is how long past the end of their period ephemerals are
+	// kept before being deleted
+	DeletionGrace time.Duration
+}
+
+// withDefaults returns the params with unset fields replaced by defaults.
+func (p EphemeralParams) withDefaults() EphemeralParams {
+	if p.Period == 0 {
+		p.Period = defaultEphemeralPeriod
+	}
+	if p.OffsetPhase == 0 {
+		p.OffsetPhase = p.Period / time.Duration(ephemeral.NumOffsets)
+	}
+	if p.CreationLead == 0 {
+		p.CreationLead = defaultCreationLead
+	}
+	if p.DeletionGrace == 0 {
+		p.DeletionGrace = defaultDeletionGrace
+	}
+	return p
+}
+
+// Validate returns an error if the params, once defaults are applied, differ
+// from the timing ephemeral IDs are derived with or are inconsistent.
+func (p EphemeralParams) Validate() error {
+	p = p.withDefaults()
+	if p.Period < 0 || p.OffsetPhase < 0 || p.CreationLead < 0 || p.DeletionGrace < 0 {
+		return errors.Errorf("ephemeral timing must not be negative: %+v", p)
+	}
+	if p.Period != defaultEphemeralPeriod {
+		return errors.Errorf("period %s differs from the ephemeral ID period %s clients derive IDs with",
+			p.Period, defaultEphemeralPeriod)
+	}
+	if p.OffsetPhase != time.Duration(ephemeral.NsPerOffset) {
+		return errors.Errorf("offset phase %s differs from the ephemeral ID offset phase %s clients derive IDs with",
+			p.OffsetPhase, time.Duration(ephemeral.NsPerOffset))
+	}
+	if p.CreationLead >= p.Period {
+		return errors.Errorf("creation lead %s must be shorter than period %s",
+			p.CreationLead, p.Period)
+	}
+	return nil
+}
+
+// timing returns the ephemeral ID timing of the Impl.
+func (nb *Impl) timing() EphemeralParams {
+	return nb.ephemeral.withDefaults()
+}
+
+// quantize returns the offset bucket and epoch containing t.
+func (nb *Impl) quantize(t time.Time) (int64, int32) {
+	epoch := t.UnixNano() / int64(nb.timing().OffsetPhase)
+	return epoch % ephemeral.NumOffsets, int32(epoch)
+}
+
+// deletionDelay returns how far back from now ephemerals are expired.
+func (nb *Impl) deletionDelay() time.Duration {
+	t := nb.timing()
+	return -(t.Period + t.DeletionGrace)
+}
+
+// maxOffsetsPerTick bounds the number of offset buckets processed on each
+// creator tick, so that catching up after downtime is spread over many ticks
+// rather than done in a single burst of database writes.
+const maxOffsetsPerTick = 64
+
+// EphIdCreator runs as a thread to track ephemeral IDs for users who registered to receive push notifications.
+// Work is done incrementally: every OffsetPhase, ephemerals are generated for the identities in the offset
+// buckets between the last processed bucket and CreationLead from now.
+// Once caught up, it reconciles the ephemerals of all identities every reconcile interval.
 func (nb *Impl) EphIdCreator() {
 	nb.initCreator()
-	ticker := time.NewTicker(time.Duration(offsetPhase))
-	go nb.addEphemerals(time.Now().Add(creationLead))
-	//handle all future epochs
-	for true {
+	ticker := time.NewTicker(nb.timing().OffsetPhase)
+	var lastReconcile time.Time
+	for {
+		end := nb.now().Add(nb.timing().CreationLead)
+		nb.addPendingEphemerals(end)
+		caughtUp := !nb.nextOffsetTime.Before(end)
+		if caughtUp && nb.reconcileInterval > 0 && nb.now().Sub(lastReconcile) >= nb.reconcileInterval {
+			repaired, err := nb.reconcileEphemerals()
+			if err != nil {
+				jww.WARN.Printf("Failed to reconcile ephemerals after repairing %d identities: %+v", repaired, err)
+			} else if repaired > 0 {
+				jww.WARN.Printf("Added missing ephemerals for %d identities", repaired)
+			}
+			lastReconcile = nb.now()
+		}
 		<-ticker.C
-		go nb.addEphemerals(time.Now().Add(creationLead))
 	}
 }
 
 func (nb *Impl) initCreator() {
+	t := nb.timing()
 	// Retrieve most recent ephemeral from storage
 	var lastEpochTime time.Time
 	lastEphEpoch, err := nb.Storage.GetStateValue(ephemeralStateKey)
 	if err != nil {
 		jww.WARN.Printf("Failed to get latest ephemeral: %+v", err)
-		lastEpochTime = time.Now().Add(-time.Duration(ephemeral.Period))
+		lastEpochTime = nb.now().Add(-t.Period)
 	} else {
 		lastEpochInt, err := strconv.Atoi(lastEphEpoch)
 		if err != nil {
 			jww.FATAL.Printf("Failed to convert last epoch to int: %+v", err)
 		}
-		lastEpochTime = time.Unix(0, int64(lastEpochInt)*offsetPhase) // Epoch time of last ephemeral ID
+		// Resume from the bucket after the last one which was processed
+		lastEpochTime = time.Unix(0, int64(lastEpochInt+1)*int64(t.OffsetPhase))
 		// If the last epoch is further back than the ephemeral ID period, only go back one period for generation
-		if lastEpochTime.Before(time.Now().Add(-time.Duration(ephemeral.Period))) {
-			lastEpochTime = time.Now().Add(-time.Duration(ephemeral.Period))
+		if lastEpochTime.Before(nb.now().Add(-t.Period)) {
+			lastEpochTime = nb.now().Add(-t.Period)
 		}
 	}
-	// Add all missed ephemeral IDs
-	// increment by offsetPhase up to 5 minutes from now making ephemerals
-	for endTime := time.Now().Add(creationLead); lastEpochTime.Before(endTime); lastEpochTime = lastEpochTime.Add(time.Duration(offsetPhase)) {
-		nb.addEphemerals(lastEpochTime)
-	}
-	// handle the next epoch
-	_, epoch := ephemeral.HandleQuantization(lastEpochTime)
-	nextTrigger := time.Unix(0, int64(epoch)*offsetPhase)
+	nb.nextOffsetTime = lastEpochTime
+
+	// Add the buckets up to now, further missed buckets are caught up
+	// incrementally by the creator thread
+	nb.addPendingEphemerals(nb.now().Add(t.CreationLead))
+	_, epoch := nb.quantize(nb.now())
 
 	// Check for users with no associated ephemerals, add them if found (this should not happen unless there were issues)
-	orphaned, err := nb.Storage.GetOrphanedIdentities()
+	size := uint(nb.instance().GetPartialNdf().Get().AddressSpace[0].Size)
+	orphaned := 0
+	err = nb.Storage.IterateOrphanedIdentities(storage.IdentityBatchSize, func(identities []*storage.Identity) error {
+		orphaned += len(identities)
+		for _, i := range identities {
+			_, err := nb.Storage.AddLatestEphemeral(i, epoch, size) // TODO: is this the correct epoch?  Should we do the previous one as well?
+			if err != nil {
+				jww.WARN.Printf("Failed to add latest ephemeral for orphaned identity %+v: %+v", i.IntermediaryId, err)
+			}
+		}
+		return nil
+	})
 	if err != nil {
 		jww.FATAL.Panicf("Failed to retrieve orphaned users: %+v", err)
 	}
-	if len(orphaned) > 0 {
-		jww.WARN.Printf("Found %d orphaned users in database", len(orphaned))
+	if orphaned > 0 {
+		jww.WARN.Printf("Found %d orphaned users in database", orphaned)
+	}
+
+	if behind := nb.nextOffsetTime.Add(-t.CreationLead).Sub(nb.now()); behind < 0 {
+		jww.INFO.Printf("Ephemeral creation is %s behind, catching up incrementally", -behind)
 	}
-	for _, i := range orphaned {
-		_, err := nb.Storage.AddLatestEphemeral(i, epoch, uint(nb.inst.GetPartialNdf().Get().AddressSpace[0].Size)) // TODO: is this the correct epoch?  Should we do the previous one as well?
+}
+
+// addPendingEphemerals generates ephemerals for up to maxOffsetsPerTick offset
+// buckets, starting from the next unprocessed bucket and stopping at end. If a
+// bucket fails it is retried on the next call.
+func (nb *Impl) addPendingEphemerals(end time.Time) {
+	for i := 0; i < maxOffsetsPerTick && nb.nextOffsetTime.Before(end); i++ {
+		err := nb.addEphemerals(nb.nextOffsetTime)
 		if err != nil {
-			jww.WARN.Printf("Failed to add latest ephemeral for orphaned identity %+v: %+v", i.IntermediaryId, err)
+			jww.WARN.Printf("Failed to add ephemerals for %s, will retry: %+v", nb.nextOffsetTime, err)
+			return
 		}
+		nb.nextOffsetTime = nb.nextOffsetTime.Add(nb.timing().OffsetPhase)
 	}
-
-	jww.INFO.Println(fmt.Sprintf("Sleeping until next trigger at %+v", nextTrigger))
-	time.Sleep(time.Until(nextTrigger))
 }
 
-func (nb *Impl) addEphemerals(start time.Time) {
-	currentOffset, epoch := ephemeral.HandleQuantization(start)
-	def := nb.inst.GetPartialNdf()
+// addEphemerals generates ephemerals for all identities in the offset bucket
+// containing start, and records the bucket as processed.
+func (nb *Impl) addEphemerals(start time.Time) error {
+	currentOffset, epoch := nb.quantize(start)
+	def := nb.instance().GetPartialNdf()
 	// FIXME: Does the address space need more logic here?
 	err := nb.Storage.AddEphemeralsForOffset(currentOffset, epoch, uint(def.Get().AddressSpace[0].Size), start)
 	if err != nil {
-		jww.WARN.Printf("failed to update ephemerals: %+v", err)
+		return errors.WithMessage(err, "failed to update ephemerals")
 	}
 	err = nb.Storage.UpsertState(&storage.State{
 		Key:   ephemeralStateKey,
 		Value: strconv.Itoa(int(epoch)),
 	})
+	if err != nil {
+		return errors.WithMessage(err, "failed to store last processed offset")
+	}
+	return nil
+}
+
+// reconcileEphemerals adds an ephemeral for the current epoch to every tracked
+// identity with none generated within the last period, as left by an offset
+// bucket which failed part way. It returns the number of identities repaired.
+func (nb *Impl) reconcileEphemerals() (int, error) {
+	now := nb.now()
+	_, epoch := nb.quantize(now)
+	_, since := nb.quantize(now.Add(-nb.timing().Period))
+	size := uint(nb.instance().GetPartialNdf().Get().AddressSpace[0].Size)
+	repaired := 0
+	err := nb.Storage.IterateIdentitiesWithoutEphemeral(since, storage.IdentityBatchSize,
+		func(identities []*storage.Identity) error {
+			for _, i := range identities {
+				_, err := nb.Storage.AddLatestEphemeral(i, epoch, size)
+				if err != nil {
+					return errors.WithMessagef(err, "Failed to add ephemeral for identity %v", i.IntermediaryId)
+				}
+				repaired++
+			}
+			return nil
+		})
+	return repaired, err
 }
 
 func (nb *Impl) EphIdDeleter() {
 	nb.initDeleter()
-	ticker := time.NewTicker(time.Duration(offsetPhase))
+	ticker := time.NewTicker(nb.timing().OffsetPhase)
 	//handle all future epochs
 	for true {
 		<-ticker.C
-		go nb.deleteEphemerals(time.Now().Add(deletionDelay))
+		go nb.deleteEphemerals(nb.now().Add(nb.deletionDelay()))
 	}
 }
 
 func (nb *Impl) initDeleter() {
 	//handle the next epoch
-	_, epoch := ephemeral.HandleQuantization(time.Now())
-	nextTrigger := time.Unix(0, int64(epoch+1)*offsetPhase)
+	_, epoch := nb.quantize(nb.now())
+	nextTrigger := time.Unix(0, int64(epoch+1)*int64(nb.timing().OffsetPhase))
 	// Bring us into phase with ephemeral identity creation
-	time.Sleep(time.Until(nextTrigger))
-	go nb.deleteEphemerals(time.Now().Add(deletionDelay))
+	nb.sleep(nextTrigger.Sub(nb.now()))
+	nb.deleteEphemerals(nb.now().Add(nb.deletionDelay()))
+}
+
+// sleep pauses for d on the Impl's clock.
+func (nb *Impl) sleep(d time.Duration) {
+	if nb.clock == nil {
+		time.Sleep(d)
+		return
+	}
+	nb.clock.Sleep(d)
 }
 
 func (nb *Impl) deleteEphemerals(start time.Time) {
 	fmt.Println("deleteEphemerals")
-	_, currentEpoch := ephemeral.HandleQuantization(start)
+	_, currentEpoch := nb.quantize(start)
 	err := nb.Storage.DeleteOldEphemerals(currentEpoch)
 	if err != nil {
 		jww.WARN.Printf("failed to delete ephemerals: %+v", err)
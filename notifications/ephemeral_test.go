@@ -10,6 +10,7 @@ package notifications
 import (
 	"fmt"
 	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/notifications-bot/clock"
 	"gitlab.com/elixxir/notifications-bot/constants"
 	"gitlab.com/elixxir/notifications-bot/storage"
 	"gitlab.com/xx_network/comms/connect"
@@ -33,6 +34,7 @@ func TestImpl_InitDeleter(t *testing.T) {
 	}
 	impl := &Impl{
 		Storage: s,
+		clock:   clock.NewFake(time.Now()),
 	}
 	uid := id.NewIdFromString("deleter_zezima", id.User, t)
 	iid, err := ephemeral.GetIntermediaryId(uid)
@@ -57,7 +59,6 @@ func TestImpl_InitDeleter(t *testing.T) {
 		t.Error("Did not receive ephemeral for user")
 	}
 	impl.initDeleter()
-	time.Sleep(time.Second * 10)
 	elist, err = s.GetEphemeral(e.EphemeralId)
 	if err == nil {
 		t.Errorf("Ephemeral should have been deleted, did not receive error: %+v", e)
@@ -111,3 +112,107 @@ func TestImpl_InitCreator(t *testing.T) {
 		t.Error("Did not receive ephemeral for user")
 	}
 }
+
+// Tests that addPendingEphemerals processes at most maxOffsetsPerTick buckets
+// per call and records its progress.
+func TestImpl_addPendingEphemerals(t *testing.T) {
+	s, err := storage.NewStorage("", "", "TestImpl_addPendingEphemerals", "", "")
+	if err != nil {
+		t.Fatalf("Failed to init storage: %+v", err)
+	}
+	impl, err := StartNotifications(Params{
+		NotificationsPerBatch: 20,
+		NotificationRate:      30,
+	}, true, true)
+	if err != nil {
+		t.Fatalf("Failed to create impl: %+v", err)
+	}
+	impl.Storage = s
+
+	now := time.Now()
+	start := now.Add(-10 * maxOffsetsPerTick * impl.timing().OffsetPhase)
+	impl.nextOffsetTime = start
+
+	impl.addPendingEphemerals(now)
+	expected := start.Add(maxOffsetsPerTick * impl.timing().OffsetPhase)
+	if !impl.nextOffsetTime.Equal(expected) {
+		t.Errorf("Creator did not advance by %d buckets\n\tExpected: %s\n\tReceived: %s",
+			maxOffsetsPerTick, expected, impl.nextOffsetTime)
+	}
+
+	_, lastEpoch := ephemeral.HandleQuantization(expected.Add(-impl.timing().OffsetPhase))
+	stored, err := s.GetStateValue(ephemeralStateKey)
+	if err != nil {
+		t.Fatalf("Failed to get stored offset: %+v", err)
+	}
+	if stored != fmt.Sprintf("%d", lastEpoch) {
+		t.Errorf("Stored offset did not match last processed bucket\n\tExpected: %d\n\tReceived: %s", lastEpoch, stored)
+	}
+
+	// Once caught up, no further buckets should be processed
+	impl.nextOffsetTime = now
+	impl.addPendingEphemerals(now)
+	if !impl.nextOffsetTime.Equal(now) {
+		t.Errorf("Creator should not process buckets past the end time")
+	}
+}
+
+// Tests that request timestamps are checked against the Impl's clock, so skew
+// can be simulated without waiting.
+func TestImpl_checkRequestTimestamp(t *testing.T) {
+	signed := time.Unix(1700000000, 0)
+	fake := clock.NewFake(signed)
+	impl := &Impl{clock: fake}
+
+	fake.Advance(4 * time.Second)
+	if err := impl.checkRequestTimestamp(signed); err != nil {
+		t.Errorf("Request within 5 seconds should be accepted: %+v", err)
+	}
+	fake.Advance(2 * time.Second)
+	if err := impl.checkRequestTimestamp(signed); err == nil {
+		t.Error("Request older than 5 seconds should be rejected")
+	}
+}
+
+// Tests that the default timing quantizes times like the primitives library.
+func TestImpl_quantize(t *testing.T) {
+	impl := &Impl{}
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		ts := now.Add(time.Duration(i) * 7 * time.Minute)
+		offset, epoch := impl.quantize(ts)
+		expectedOffset, expectedEpoch := ephemeral.HandleQuantization(ts)
+		if offset != expectedOffset || epoch != expectedEpoch {
+			t.Errorf("Quantization of %s did not match\n\tExpected: %d, %d\n\tReceived: %d, %d",
+				ts, expectedOffset, expectedEpoch, offset, epoch)
+		}
+	}
+}
+
+// Tests that EphemeralParams.Validate accepts consistent timing and rejects
+// timing which differs from that of the primitives library.
+func TestEphemeralParams_Validate(t *testing.T) {
+	valid := []EphemeralParams{
+		{},
+		{CreationLead: time.Minute, DeletionGrace: time.Minute},
+		{Period: time.Duration(ephemeral.Period), OffsetPhase: time.Duration(ephemeral.NsPerOffset)},
+	}
+	for i, p := range valid {
+		if err := p.Validate(); err != nil {
+			t.Errorf("Params %d should be valid: %+v", i, err)
+		}
+	}
+
+	invalid := []EphemeralParams{
+		{Period: -time.Hour},
+		{Period: time.Hour},
+		{OffsetPhase: time.Second},
+		{CreationLead: 48 * time.Hour},
+		{DeletionGrace: -time.Minute},
+	}
+	for i, p := range invalid {
+		if err := p.Validate(); err == nil {
+			t.Errorf("Params %d should be invalid: %+v", i, p)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Failover mode: several instances share the database, and only the one
+// holding the sender lease accepts and sends notifications. The others wait
+// on standby with the NDF, storage and providers initialized, and take over
+// as soon as the active instance stops renewing the lease.
+
+package notifications
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/notifications-bot/events"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// senderLease is the name of the lease held by the active instance
+	senderLease = "sender"
+	// defaultHeartbeat and defaultLeaseTimeout are used when failover is
+	// enabled without setting them
+	defaultHeartbeat    = time.Second
+	defaultLeaseTimeout = 5 * time.Second
+)
+
+// FailoverParams configures failover mode.
+type FailoverParams struct {
+	// Enabled starts the instance on standby until it holds the sender lease
+	Enabled bool
+	// InstanceID identifies the instance as the lease holder; the host name
+	// and process ID if empty. It must differ between instances.
+	InstanceID string
+	// Heartbeat is how often the active instance renews the lease and
+	// standby instances try to take it
+	Heartbeat time.Duration
+	// LeaseTimeout is how long after its last renewal the lease can be taken
+	// over. The active instance steps down a heartbeat earlier if it cannot
+	// renew it, so two instances never send at once.
+	LeaseTimeout time.Duration
+}
+
+// failover holds the lease state of an instance running in failover mode.
+type failover struct {
+	holder    string
+	heartbeat time.Duration
+	timeout   time.Duration
+	// active is 1 while the instance holds the lease
+	active uint32
+}
+
+// newFailover returns the failover state for params, or nil if failover is
+// disabled.
+func newFailover(params FailoverParams) (*failover, error) {
+	if !params.Enabled {
+		return nil, nil
+	}
+	f := &failover{holder: params.InstanceID, heartbeat: params.Heartbeat, timeout: params.LeaseTimeout}
+	if f.holder == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, errors.WithMessage(err, "Failed to get host name for instance ID")
+		}
+		f.holder = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+	if f.heartbeat <= 0 {
+		f.heartbeat = defaultHeartbeat
+	}
+	if f.timeout <= 0 {
+		f.timeout = defaultLeaseTimeout
+	}
+	if f.timeout <= 2*f.heartbeat {
+		return nil, errors.Errorf("Lease timeout %s must be more than two heartbeats of %s", f.timeout, f.heartbeat)
+	}
+	return f, nil
+}
+
+// isActive returns true if the instance sends notifications: failover is
+// disabled or the instance holds the sender lease.
+func (nb *Impl) isActive() bool {
+	return nb.lease == nil || atomic.LoadUint32(&nb.lease.active) == 1
+}
+
+// AwaitActive blocks until the instance holds the sender lease, then renews
+// it every heartbeat in a new thread. It returns immediately if failover is
+// disabled.
+func (nb *Impl) AwaitActive() {
+	f := nb.lease
+	if f == nil {
+		return
+	}
+	jww.INFO.Printf("Instance %s waiting on standby for the sender lease", f.holder)
+	for {
+		now := nb.now()
+		held, err := nb.Storage.AcquireLease(senderLease, f.holder, now, f.timeout)
+		if err != nil {
+			jww.WARN.Printf("Failed to acquire sender lease: %+v", err)
+		} else if held {
+			atomic.StoreUint32(&f.active, 1)
+			jww.INFO.Printf("Instance %s took over sending", f.holder)
+			nb.publish(events.Event{Type: events.FailoverTakeover, Timestamp: now, Instance: f.holder})
+			go nb.renewLease(now)
+			return
+		}
+		select {
+		case <-nb.context().Done():
+			return
+		case <-time.After(f.heartbeat):
+		}
+	}
+}
+
+// renewLease is a long-running thread renewing the sender lease every
+// heartbeat. The process exits if the lease is lost, so it restarts on
+// standby without sending alongside the new active instance.
+func (nb *Impl) renewLease(renewed time.Time) {
+	ticker := time.NewTicker(nb.lease.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-nb.context().Done():
+			return
+		case <-ticker.C:
+		}
+		var err error
+		renewed, err = nb.heartbeat(renewed)
+		if err != nil {
+			jww.FATAL.Panicf("Stepping down: %+v", err)
+		}
+	}
+}
+
+// heartbeat renews the sender lease, returning the time it was last renewed.
+// It returns an error if the instance must stop sending: another instance
+// holds the lease, or it could not be renewed for long enough that it may be
+// taken over within the next heartbeat.
+func (nb *Impl) heartbeat(renewed time.Time) (time.Time, error) {
+	f := nb.lease
+	now := nb.now()
+	held, err := nb.Storage.AcquireLease(senderLease, f.holder, now, f.timeout)
+	switch {
+	case err == nil && held:
+		return now, nil
+	case err == nil:
+		atomic.StoreUint32(&f.active, 0)
+		return renewed, errors.Errorf("Instance %s lost the sender lease to another instance", f.holder)
+	case now.Sub(renewed) >= f.timeout-f.heartbeat:
+		atomic.StoreUint32(&f.active, 0)
+		return renewed, errors.WithMessagef(err, "Instance %s could not renew the sender lease since %s",
+			f.holder, renewed)
+	default:
+		jww.WARN.Printf("Failed to renew sender lease: %+v", err)
+		return renewed, nil
+	}
+}
+
+// releaseLease gives up the sender lease on shutdown, so a standby instance
+// takes over without waiting for it to expire.
+func (nb *Impl) releaseLease() {
+	f := nb.lease
+	if f == nil || nb.Storage == nil || atomic.SwapUint32(&f.active, 0) != 1 {
+		return
+	}
+	err := nb.Storage.ReleaseLease(senderLease, f.holder)
+	if err != nil {
+		jww.WARN.Printf("Failed to release sender lease: %+v", err)
+		return
+	}
+	jww.INFO.Printf("Instance %s released the sender lease", f.holder)
+}
+
+// formatFailoverMetrics renders whether the instance holds the sender lease
+// as a Prometheus gauge, if failover is enabled.
+func formatFailoverMetrics(f *failover) string {
+	if f == nil {
+		return ""
+	}
+	return fmt.Sprintf("# HELP notifications_failover_active Whether the instance holds the sender lease.\n"+
+		"# TYPE notifications_failover_active gauge\n"+
+		"notifications_failover_active{instance=%q} %d\n", f.holder, atomic.LoadUint32(&f.active))
+}
@@ -0,0 +1,91 @@
+package notifications
+
+import (
+	pb "gitlab.com/elixxir/comms/mixmessages"
+	"gitlab.com/elixxir/notifications-bot/clock"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"testing"
+	"time"
+)
+
+// Tests that only the instance holding the sender lease accepts batches, that
+// a standby instance takes over once the active one stops renewing the lease,
+// and that the previous instance then steps down.
+func TestImpl_Failover(t *testing.T) {
+	s, err := storage.NewStorage("", "", "TestImpl_Failover", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+	fake := clock.NewFake(time.Now())
+	newInstance := func(holder string) *Impl {
+		f, err := newFailover(FailoverParams{Enabled: true, InstanceID: holder,
+			Heartbeat: time.Hour, LeaseTimeout: 3 * time.Hour})
+		if err != nil {
+			t.Fatalf("Failed to set up failover: %+v", err)
+		}
+		return &Impl{Storage: s, lease: f, clock: fake}
+	}
+	a, b := newInstance("a"), newInstance("b")
+
+	a.AwaitActive()
+	if !a.isActive() {
+		t.Fatalf("Instance should be active once it holds the lease")
+	}
+	if b.isActive() {
+		t.Fatalf("Second instance should be on standby")
+	}
+	if err = b.ReceiveNotificationBatch(&pb.NotificationBatch{RoundID: 1}, nil); err == nil {
+		t.Errorf("Standby instance should reject notification batches")
+	}
+
+	// A standby instance takes over once the lease expires
+	renewed := fake.Now()
+	fake.Advance(time.Hour)
+	if renewed, err = a.heartbeat(renewed); err != nil {
+		t.Fatalf("Active instance failed to renew its lease: %+v", err)
+	}
+	fake.Advance(4 * time.Hour)
+	done := make(chan struct{})
+	go func() {
+		b.AwaitActive()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Standby instance did not take over the expired lease")
+	}
+	if !b.isActive() {
+		t.Errorf("Instance should be active after taking over")
+	}
+	if _, err = a.heartbeat(renewed); err == nil || a.isActive() {
+		t.Errorf("Previous instance should step down once its lease was taken")
+	}
+
+	// Releasing the lease on shutdown lets the other instance take it at once
+	b.releaseLease()
+	if b.isActive() {
+		t.Errorf("Instance should not be active after releasing its lease")
+	}
+	a.AwaitActive()
+	if !a.isActive() {
+		t.Errorf("Released lease should be taken without waiting for it to expire")
+	}
+}
+
+// Tests that a lease timeout too short to step down before a takeover is
+// rejected.
+func Test_newFailover(t *testing.T) {
+	f, err := newFailover(FailoverParams{})
+	if err != nil || f != nil {
+		t.Errorf("Failover should be disabled by default: %+v %+v", f, err)
+	}
+	_, err = newFailover(FailoverParams{Enabled: true, Heartbeat: time.Second, LeaseTimeout: 2 * time.Second})
+	if err == nil {
+		t.Errorf("Lease timeout of two heartbeats should be rejected")
+	}
+	f, err = newFailover(FailoverParams{Enabled: true})
+	if err != nil || f.holder == "" || f.heartbeat != defaultHeartbeat || f.timeout != defaultLeaseTimeout {
+		t.Errorf("Unexpected defaults: %+v %+v", f, err)
+	}
+}
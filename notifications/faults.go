@@ -0,0 +1,100 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package notifications
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/notifications-bot/faults"
+	"gitlab.com/elixxir/notifications-bot/notifications/providers"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// faultyProvider wraps a provider, failing sends at the rate set on its
+// injector. Injected failures leave the token valid so they are retried.
+type faultyProvider struct {
+	providers.Provider
+	faults *faults.Injector
+}
+
+// Notify fails with faults.ErrInjected or passes the send to the provider.
+func (f *faultyProvider) Notify(ctx context.Context, csv string, target storage.GTNResult) (providers.Receipt, bool, error) {
+	if err := f.faults.Fail(); err != nil {
+		return providers.Receipt{}, true, errors.WithMessagef(err, "Failed to send to %s", target.App)
+	}
+	return f.Provider.Notify(ctx, csv, target)
+}
+
+// MaxCSV returns the payload limit of the wrapped provider, if it has one.
+func (f *faultyProvider) MaxCSV(target storage.GTNResult) int {
+	if pl, ok := f.Provider.(providers.PayloadLimiter); ok {
+		return pl.MaxCSV(target)
+	}
+	return math.MaxInt
+}
+
+// enableFaultInjection wraps every configured provider so its sends can be
+// failed through the admin API.
+func (nb *Impl) enableFaultInjection() {
+	nb.sendFaults = faults.NewInjector()
+	nb.writeFaults = faults.NewInjector()
+	for app, p := range nb.providers {
+		if p != nil {
+			nb.providers[app] = &faultyProvider{Provider: p, faults: nb.sendFaults}
+		}
+	}
+}
+
+// InjectStorageFaults makes writes to the Impl's storage fail at the rate set
+// through the admin API. It does nothing unless fault injection is enabled.
+func (nb *Impl) InjectStorageFaults() error {
+	if nb.writeFaults == nil {
+		return nil
+	}
+	return nb.Storage.InjectWriteFaults(nb.writeFaults)
+}
+
+// handleFaults reports the fault injection rates, or sets them from the
+// dbWrites and providerSends query parameters, given as percentages.
+func (nb *Impl) handleFaults(w http.ResponseWriter, r *http.Request) {
+	if nb.sendFaults == nil || nb.writeFaults == nil {
+		adminError(w, http.StatusNotFound, errors.New("fault injection is disabled"))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		for param, inj := range map[string]*faults.Injector{
+			"dbWrites":      nb.writeFaults,
+			"providerSends": nb.sendFaults,
+		} {
+			raw := r.URL.Query().Get(param)
+			if raw == "" {
+				continue
+			}
+			rate, err := strconv.ParseFloat(raw, 64)
+			if err == nil {
+				err = inj.SetRate(rate)
+			}
+			if err != nil {
+				adminError(w, http.StatusBadRequest, errors.Errorf("%s must be a percentage between 0 and 100", param))
+				return
+			}
+		}
+	default:
+		adminError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"dbWrites":      nb.writeFaults.Rate(),
+		"providerSends": nb.sendFaults.Rate(),
+	})
+}
@@ -0,0 +1,67 @@
+package notifications
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"gitlab.com/elixxir/notifications-bot/faults"
+	"gitlab.com/elixxir/notifications-bot/notifications/providers"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Tests that fault rates set through the admin API fail provider sends and
+// storage writes.
+func TestImpl_handleFaults(t *testing.T) {
+	s, err := storage.NewStorage("", "", "TestImpl_handleFaults", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+	mp := &MockProvider{donech: make(chan string, 1)}
+	impl := &Impl{
+		Storage:   s,
+		providers: map[string]providers.Provider{"app": mp},
+	}
+	handler := impl.adminHandler("secret")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, newAdminRequest(http.MethodGet, "/faults", "secret"))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Faults endpoint should be unavailable when disabled, got %d", rec.Code)
+	}
+
+	impl.enableFaultInjection()
+	if err = impl.InjectStorageFaults(); err != nil {
+		t.Fatalf("Failed to inject storage faults: %+v", err)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, newAdminRequest(http.MethodPost, "/faults?dbWrites=100&providerSends=100", "secret"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Failed to set fault rates: %d %s", rec.Code, rec.Body.String())
+	}
+	var rates map[string]float64
+	if err = json.NewDecoder(rec.Body).Decode(&rates); err != nil {
+		t.Fatal(err)
+	}
+	if rates["dbWrites"] != 100 || rates["providerSends"] != 100 {
+		t.Errorf("Unexpected fault rates: %+v", rates)
+	}
+
+	_, tokenValid, err := impl.providers["app"].Notify(context.Background(), "csv", storage.GTNResult{App: "app"})
+	if !errors.Is(err, faults.ErrInjected) || !tokenValid {
+		t.Errorf("Send should fail with an injected fault and a valid token, got %v %+v", tokenValid, err)
+	}
+	err = s.UpsertState(&storage.State{Key: "key", Value: "value"})
+	if !errors.Is(err, faults.ErrInjected) {
+		t.Errorf("Write should fail with an injected fault, got %+v", err)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, newAdminRequest(http.MethodPost, "/faults?dbWrites=150", "secret"))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Rate above 100 should be rejected, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,205 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Feature flags gate risky behaviors, so operators can roll them out to a
+// percentage of identities, or turn them off, through the admin API without
+// redeploying. Flags are stored in the database, so every instance applies
+// them, and cached in memory for the featureFlagRefresh interval. Each
+// identity is assigned a stable bucket per flag from its transmission RSA
+// hash, so raising a flag's percentage only adds identities to the rollout.
+
+package notifications
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gorm.io/gorm"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Names of the behaviors gated by feature flags.
+const (
+	// FeatureDigests holds the notifications of users in digest mode for
+	// their summary push
+	FeatureDigests = "digests"
+	// FeatureMultiplePushes sends notifications which do not fit in one push
+	// as up to maxPushesPerToken pushes, rather than only the first
+	FeatureMultiplePushes = "multiplePushes"
+	// FeatureWebPush sends pushes to web push tokens
+	FeatureWebPush = "webPush"
+)
+
+// featureDefaults is the percentage of identities each feature is enabled for
+// when no flag is set for it.
+var featureDefaults = map[string]float64{
+	FeatureDigests:        100,
+	FeatureMultiplePushes: 100,
+	FeatureWebPush:        100,
+}
+
+// FeatureStatus is the rollout of a feature returned by the admin API.
+type FeatureStatus struct {
+	Name    string
+	Percent float64
+	// Default is set if no flag is stored for the feature
+	Default   bool
+	UpdatedAt time.Time
+}
+
+// featureFlags caches the feature flags set in storage.
+type featureFlags struct {
+	mux     sync.Mutex
+	refresh time.Duration
+	flags   map[string]*storage.FeatureFlag
+	loaded  time.Time
+}
+
+// newFeatureFlags returns a cache of feature flags which are reloaded from
+// storage once they are older than refresh.
+func newFeatureFlags(refresh time.Duration) *featureFlags {
+	return &featureFlags{refresh: refresh}
+}
+
+// featureEnabled returns true if the named feature is enabled for the user
+// with the passed in transmission RSA hash.
+func (nb *Impl) featureEnabled(name string, transmissionRsaHash []byte) bool {
+	percent := nb.featurePercent(name)
+	if percent >= 100 {
+		return true
+	} else if percent <= 0 {
+		return false
+	}
+	return featureBucket(name, transmissionRsaHash) < percent
+}
+
+// featurePercent returns the percentage of identities the named feature is
+// enabled for, reloading the flags from storage if the cache is stale. The
+// cached flags are kept if they cannot be reloaded.
+func (nb *Impl) featurePercent(name string) float64 {
+	if nb.features == nil {
+		return featureDefaults[name]
+	}
+	ff := nb.features
+	ff.mux.Lock()
+	defer ff.mux.Unlock()
+	now := nb.now()
+	if ff.flags == nil || now.Sub(ff.loaded) >= ff.refresh {
+		flags, err := nb.Storage.GetFeatureFlags()
+		if err != nil {
+			jww.WARN.Printf("Failed to reload feature flags, using cached flags: %+v", err)
+		} else {
+			ff.flags = map[string]*storage.FeatureFlag{}
+			for _, f := range flags {
+				ff.flags[f.Name] = f
+			}
+		}
+		ff.loaded = now
+	}
+	if f, ok := ff.flags[name]; ok {
+		return f.Percent
+	}
+	return featureDefaults[name]
+}
+
+// invalidateFeatures drops the cached flags, so changes made through the admin
+// API apply to this instance at once.
+func (nb *Impl) invalidateFeatures() {
+	if nb.features == nil {
+		return
+	}
+	nb.features.mux.Lock()
+	nb.features.flags = nil
+	nb.features.mux.Unlock()
+}
+
+// featureBucket returns the stable position, in [0, 100), of the user with the
+// passed in transmission RSA hash in the rollout of the named feature. The name
+// is hashed in so each feature is rolled out to a different set of identities.
+func featureBucket(name string, transmissionRsaHash []byte) float64 {
+	h := sha256.New()
+	h.Write([]byte(name))
+	h.Write(transmissionRsaHash)
+	sum := h.Sum(nil)
+	return float64(binary.BigEndian.Uint64(sum[:8])%10000) / 100
+}
+
+// handleFeatures serves the feature flag admin endpoint. A GET lists the
+// rollout of every feature, a POST enables the named feature for the passed in
+// percent of identities and a DELETE returns it to its default.
+func (nb *Impl) handleFeatures(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		flags, err := nb.Storage.GetFeatureFlags()
+		if err != nil {
+			adminError(w, http.StatusInternalServerError, errors.WithMessage(err, "Failed to get feature flags"))
+			return
+		}
+		writeJSON(w, featureStatuses(flags))
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		adminError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if _, ok := featureDefaults[name]; !ok {
+		adminError(w, http.StatusBadRequest, errors.Errorf("unknown feature %q", name))
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		err := nb.Storage.DeleteFeatureFlag(name)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			adminError(w, http.StatusNotFound, errors.New("feature flag is not set"))
+			return
+		} else if err != nil {
+			adminError(w, http.StatusInternalServerError, errors.WithMessage(err, "Failed to delete feature flag"))
+			return
+		}
+		nb.invalidateFeatures()
+		jww.INFO.Printf("Reset feature %s to its default", name)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	percent, err := strconv.ParseFloat(r.URL.Query().Get("percent"), 64)
+	if err != nil || percent < 0 || percent > 100 {
+		adminError(w, http.StatusBadRequest, errors.New("percent must be a number from 0 to 100"))
+		return
+	}
+	f := &storage.FeatureFlag{Name: name, Percent: percent, UpdatedAt: nb.now()}
+	if err = nb.Storage.UpsertFeatureFlag(f); err != nil {
+		adminError(w, http.StatusInternalServerError, errors.WithMessage(err, "Failed to set feature flag"))
+		return
+	}
+	nb.invalidateFeatures()
+	jww.INFO.Printf("Enabled feature %s for %g%% of identities", name, percent)
+	writeJSON(w, FeatureStatus{Name: f.Name, Percent: f.Percent, UpdatedAt: f.UpdatedAt})
+}
+
+// featureStatuses returns the rollout of every feature, ordered by name, given
+// the flags set in storage.
+func featureStatuses(flags []*storage.FeatureFlag) []FeatureStatus {
+	set := map[string]*storage.FeatureFlag{}
+	for _, f := range flags {
+		set[f.Name] = f
+	}
+	var statuses []FeatureStatus
+	for _, name := range []string{FeatureDigests, FeatureMultiplePushes, FeatureWebPush} {
+		if f, ok := set[name]; ok {
+			statuses = append(statuses, FeatureStatus{Name: name, Percent: f.Percent, UpdatedAt: f.UpdatedAt})
+		} else {
+			statuses = append(statuses, FeatureStatus{Name: name, Percent: featureDefaults[name], Default: true})
+		}
+	}
+	return statuses
+}
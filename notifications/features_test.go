@@ -0,0 +1,106 @@
+package notifications
+
+import (
+	"encoding/json"
+	"fmt"
+	"gitlab.com/elixxir/notifications-bot/clock"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Tests that features set through the admin API apply at once, that flags set
+// by another instance apply once the cache is refreshed and that deleting a
+// flag restores the default.
+func TestImpl_handleFeatures(t *testing.T) {
+	s, err := storage.NewStorage("", "", "TestImpl_handleFeatures", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+	fake := clock.NewFake(time.Now())
+	impl := &Impl{Storage: s, clock: fake, features: newFeatureFlags(time.Minute)}
+	handler := impl.adminHandler("secret")
+	trsaHash := []byte("transmission RSA hash")
+
+	if !impl.featureEnabled(FeatureDigests, trsaHash) {
+		t.Errorf("Features should be enabled by default")
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newAdminRequest(http.MethodPost, "/features?name=digests&percent=0", "secret"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to set feature flag: %d %s", w.Code, w.Body.String())
+	}
+	if impl.featureEnabled(FeatureDigests, trsaHash) {
+		t.Errorf("Feature set to 0%% through the admin API should be disabled at once")
+	}
+
+	err = s.UpsertFeatureFlag(&storage.FeatureFlag{Name: FeatureWebPush, Percent: 0, UpdatedAt: time.Now()})
+	if err != nil {
+		t.Fatalf("Failed to set feature flag: %+v", err)
+	}
+	if !impl.featureEnabled(FeatureWebPush, trsaHash) {
+		t.Errorf("Flags set by another instance should not apply before the cache is refreshed")
+	}
+	fake.Advance(time.Minute)
+	if impl.featureEnabled(FeatureWebPush, trsaHash) {
+		t.Errorf("Flags set by another instance should apply once the cache is refreshed")
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newAdminRequest(http.MethodGet, "/features", "secret"))
+	var statuses []FeatureStatus
+	if err = json.Unmarshal(w.Body.Bytes(), &statuses); err != nil {
+		t.Fatalf("Failed to decode features: %+v", err)
+	}
+	if len(statuses) != 3 || statuses[0].Default || !statuses[1].Default || statuses[2].Percent != 0 {
+		t.Errorf("Unexpected features: %+v", statuses)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newAdminRequest(http.MethodDelete, "/features?name=digests", "secret"))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Failed to delete feature flag: %d %s", w.Code, w.Body.String())
+	}
+	if !impl.featureEnabled(FeatureDigests, trsaHash) {
+		t.Errorf("Deleted flag should return the feature to its default")
+	}
+
+	for _, target := range []string{"/features?name=unknown&percent=50", "/features?name=digests&percent=101"} {
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, newAdminRequest(http.MethodPost, target, "secret"))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s should be rejected, got %d", target, w.Code)
+		}
+	}
+}
+
+// Tests that a feature rolled out to a percentage of identities is enabled for
+// about that share of them, always the same ones.
+func TestImpl_featureEnabled_Percent(t *testing.T) {
+	s, err := storage.NewStorage("", "", "TestImpl_featureEnabled_Percent", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+	impl := &Impl{Storage: s, clock: clock.NewFake(time.Now()), features: newFeatureFlags(time.Minute)}
+	err = s.UpsertFeatureFlag(&storage.FeatureFlag{Name: FeatureDigests, Percent: 25, UpdatedAt: time.Now()})
+	if err != nil {
+		t.Fatalf("Failed to set feature flag: %+v", err)
+	}
+
+	enabled := 0
+	for i := 0; i < 1000; i++ {
+		trsaHash := []byte(fmt.Sprintf("identity %d", i))
+		on := impl.featureEnabled(FeatureDigests, trsaHash)
+		if on != impl.featureEnabled(FeatureDigests, trsaHash) {
+			t.Fatalf("Feature should be stable for an identity")
+		}
+		if on {
+			enabled++
+		}
+	}
+	if enabled < 200 || enabled > 300 {
+		t.Errorf("Expected about 250 of 1000 identities enabled, got %d", enabled)
+	}
+}
@@ -0,0 +1,245 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// The registration gateway serves the client registration RPCs over HTTP, at
+// the paths grpc-gateway uses for unannotated methods, so web clients without
+// a gRPC stack can register. Bodies are the protobuf JSON encoding of the
+// RPC's request and replies that of its Ack; requests are verified and
+// handled exactly as they are over gRPC.
+
+package notifications
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	pb "gitlab.com/elixxir/comms/mixmessages"
+	"gitlab.com/xx_network/comms/messages"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// gatewayPrefix is the path prefix of the bot's RPCs on the gateway.
+const gatewayPrefix = "/mixmessages.NotificationBot/"
+
+// registrationAckHeader is the header of the gateway's replies carrying the
+// ack token of a queued request.
+const registrationAckHeader = "X-Registration-Ack"
+
+// clientRPC runs a client registration RPC named name, signed with the passed
+// in transmission RSA key. If queue is set and asynchronous registration is
+// enabled, fn is queued under ack and its RegistrationAck returned; otherwise
+// it is called before returning.
+func (nb *Impl) clientRPC(name string, transmissionRSA []byte, ack string, queue bool, fn func() error) (*RegistrationAck, error) {
+	var status *RegistrationAck
+	err := nb.intercept(name, clientPeer(transmissionRSA), func() error {
+		return nb.versioned(ProtocolSigned, name, func() error {
+			if !queue {
+				return fn()
+			}
+			var err error
+			status, err = nb.registerAsync(transmissionRSA, ack, fn)
+			return err
+		})
+	})
+	return status, err
+}
+
+// registerTokenRPC handles a RegisterToken RPC from gRPC or the gateway.
+func (nb *Impl) registerTokenRPC(msg *pb.RegisterTokenRequest, queue bool) (*RegistrationAck, error) {
+	return nb.clientRPC("RegisterToken", msg.GetTransmissionRsaPem(), AckToken(msg.GetTokenSignature()), queue, func() error {
+		return nb.RegisterToken(msg)
+	})
+}
+
+// registerTrackedIDRPC handles a RegisterTrackedID RPC from gRPC or the
+// gateway.
+func (nb *Impl) registerTrackedIDRPC(msg *pb.RegisterTrackedIdRequest, queue bool) (*RegistrationAck, error) {
+	return nb.clientRPC("RegisterTrackedID", msg.GetRequest().GetTransmissionRsaPem(), AckToken(msg.GetRequest().GetSignature()), queue, func() error {
+		return nb.RegisterTrackedID(msg)
+	})
+}
+
+// registerIdentityRPC handles a RegisterIdentity request from the gateway. The
+// comms NotificationBot service has no RegisterIdentity method, so it is only
+// served on the gateway until one is added.
+func (nb *Impl) registerIdentityRPC(msg *RegisterIdentityRequest, queue bool) (*RegistrationAck, error) {
+	return nb.clientRPC("RegisterIdentity", msg.Token.GetTransmissionRsaPem(), AckToken(msg.Token.GetTokenSignature()), queue, func() error {
+		return nb.RegisterIdentity(msg.Token, msg.TrackedID)
+	})
+}
+
+// unregisterTokenRPC handles an UnregisterToken RPC from gRPC or the gateway.
+func (nb *Impl) unregisterTokenRPC(msg *pb.UnregisterTokenRequest, queue bool) (*RegistrationAck, error) {
+	return nb.clientRPC("UnregisterToken", msg.GetTransmissionRsaPem(), AckToken(msg.GetTokenSignature()), queue, func() error {
+		return nb.UnregisterToken(msg)
+	})
+}
+
+// unregisterTrackedIDRPC handles an UnregisterTrackedID RPC from gRPC or the
+// gateway.
+func (nb *Impl) unregisterTrackedIDRPC(msg *pb.UnregisterTrackedIdRequest, queue bool) (*RegistrationAck, error) {
+	return nb.clientRPC("UnregisterTrackedID", msg.GetRequest().GetTransmissionRsaPem(), AckToken(msg.GetRequest().GetSignature()), queue, func() error {
+		return nb.UnregisterTrackedID(msg.Request)
+	})
+}
+
+// gatewayHandler returns the handler of the registration gateway. Browsers may
+// call it from the passed in origins, or from any origin if one is "*".
+func (nb *Impl) gatewayHandler(allowedOrigins []string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(gatewayPrefix+"RegisterToken", func(w http.ResponseWriter, r *http.Request) {
+		msg := &pb.RegisterTokenRequest{}
+		if decodeGateway(w, r, msg) {
+			status, err := nb.registerTokenRPC(msg, true)
+			replyGateway(w, status, err)
+		}
+	})
+	mux.HandleFunc(gatewayPrefix+"RegisterTrackedID", func(w http.ResponseWriter, r *http.Request) {
+		msg := &pb.RegisterTrackedIdRequest{}
+		if decodeGateway(w, r, msg) {
+			status, err := nb.registerTrackedIDRPC(msg, true)
+			replyGateway(w, status, err)
+		}
+	})
+	mux.HandleFunc(gatewayPrefix+"RegisterIdentity", func(w http.ResponseWriter, r *http.Request) {
+		msg := &RegisterIdentityRequest{}
+		if decodeGateway(w, r, msg) {
+			status, err := nb.registerIdentityRPC(msg, true)
+			replyGateway(w, status, err)
+		}
+	})
+	mux.HandleFunc(gatewayPrefix+"UnregisterToken", func(w http.ResponseWriter, r *http.Request) {
+		msg := &pb.UnregisterTokenRequest{}
+		if decodeGateway(w, r, msg) {
+			status, err := nb.unregisterTokenRPC(msg, true)
+			replyGateway(w, status, err)
+		}
+	})
+	mux.HandleFunc(gatewayPrefix+"UnregisterTrackedID", func(w http.ResponseWriter, r *http.Request) {
+		msg := &pb.UnregisterTrackedIdRequest{}
+		if decodeGateway(w, r, msg) {
+			status, err := nb.unregisterTrackedIDRPC(msg, true)
+			replyGateway(w, status, err)
+		}
+	})
+	return allowOrigins(allowedOrigins, mux)
+}
+
+// RegisterIdentityRequest is the body of a RegisterIdentity request: the
+// requests registering a token and the first IDs it tracks, each in their
+// protobuf JSON encoding.
+type RegisterIdentityRequest struct {
+	Token     *pb.RegisterTokenRequest
+	TrackedID *pb.RegisterTrackedIdRequest
+}
+
+// UnmarshalJSON decodes a RegisterIdentity body of the form
+// {"token": <RegisterTokenRequest>, "trackedId": <RegisterTrackedIdRequest>}.
+func (r *RegisterIdentityRequest) UnmarshalJSON(data []byte) error {
+	var body struct {
+		Token     json.RawMessage `json:"token"`
+		TrackedID json.RawMessage `json:"trackedId"`
+	}
+	err := json.Unmarshal(data, &body)
+	if err != nil {
+		return err
+	}
+	if len(body.Token) == 0 || len(body.TrackedID) == 0 {
+		return errors.New("Both a token and a tracked ID request are required")
+	}
+	r.Token, r.TrackedID = &pb.RegisterTokenRequest{}, &pb.RegisterTrackedIdRequest{}
+	unmarshal := protojson.UnmarshalOptions{DiscardUnknown: true}
+	err = unmarshal.Unmarshal(body.Token, r.Token)
+	if err != nil {
+		return errors.WithMessage(err, "Invalid token request")
+	}
+	err = unmarshal.Unmarshal(body.TrackedID, r.TrackedID)
+	if err != nil {
+		return errors.WithMessage(err, "Invalid tracked ID request")
+	}
+	return nil
+}
+
+// decodeGateway reads the protobuf JSON request posted in the body of r into
+// msg, writing an error response and returning false if there is none. A
+// RegisterIdentityRequest is decoded from its own JSON form.
+func decodeGateway(w http.ResponseWriter, r *http.Request, msg interface{}) bool {
+	if r.Method != http.MethodPost {
+		adminError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+		return false
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRegistrationBytes))
+	if err != nil {
+		adminError(w, http.StatusBadRequest, errors.WithMessage(err, "Failed to read request"))
+		return false
+	}
+	switch m := msg.(type) {
+	case proto.Message:
+		err = protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(body, m)
+	default:
+		err = json.Unmarshal(body, m)
+	}
+	if err != nil {
+		adminError(w, http.StatusBadRequest, errors.WithMessage(err, "Invalid request"))
+		return false
+	}
+	return true
+}
+
+// replyGateway writes the reply to an RPC which returned status and err: an
+// empty Ack if it succeeded. If the request was queued, the reply is 202
+// Accepted and carries its ack token in the X-Registration-Ack header.
+func replyGateway(w http.ResponseWriter, status *RegistrationAck, err error) {
+	if err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+	ack, err := protojson.Marshal(&messages.Ack{})
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if status != nil {
+		w.Header().Set(registrationAckHeader, status.Ack)
+		w.WriteHeader(http.StatusAccepted)
+	}
+	_, _ = w.Write(ack)
+}
+
+// allowOrigins wraps handler so browsers on the passed in origins, or any
+// origin if one is "*", may call it, answering their preflight requests.
+func allowOrigins(origins []string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin != "" && originAllowed(origins, origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Expose-Headers", registrationAckHeader)
+			w.Header().Add("Vary", "Origin")
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Set("Access-Control-Allow-Methods", http.MethodPost)
+				w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// originAllowed returns true if origin is one of the allowed origins.
+func originAllowed(allowed []string, origin string) bool {
+	for _, a := range allowed {
+		if a == "*" || strings.EqualFold(a, origin) {
+			return true
+		}
+	}
+	return false
+}
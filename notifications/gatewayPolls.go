@@ -0,0 +1,169 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// The most recent notification batches received from gateways are kept in
+// memory with the ephemeral IDs they carried and what became of them, so
+// network operators can see through the admin API which gateways contributed
+// which ephemeral IDs for a round or time range when debugging reports of a
+// gateway never causing notifications.
+
+package notifications
+
+import (
+	"github.com/pkg/errors"
+	pb "gitlab.com/elixxir/comms/mixmessages"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// PollOutcome is what became of a batch received from a gateway.
+type PollOutcome string
+
+const (
+	// PollAccepted batches were buffered or queued to be sent
+	PollAccepted PollOutcome = "accepted"
+	// PollDuplicate batches were dropped as their round was already accepted
+	PollDuplicate PollOutcome = "duplicate"
+	// PollFailed batches were refused, to be retried by the gateway
+	PollFailed PollOutcome = "failed"
+)
+
+// GatewayPoll is a notification batch received from a gateway.
+type GatewayPoll struct {
+	Gateway  string      `json:"gateway"`
+	Round    uint64      `json:"round"`
+	Received time.Time   `json:"received"`
+	Outcome  PollOutcome `json:"outcome"`
+	Error    string      `json:"error,omitempty"`
+	// Notifications is the number of notifications in the batch and
+	// EphemeralIDs the distinct ephemeral IDs they were for, in order
+	Notifications int     `json:"notifications"`
+	EphemeralIDs  []int64 `json:"ephemeralIds"`
+}
+
+// gatewayPolls holds the most recent batches received from gateways.
+type gatewayPolls struct {
+	mux   sync.Mutex
+	polls []GatewayPoll
+	// next is the index the next poll is written to once polls is full
+	next int
+	size int
+}
+
+// newGatewayPolls returns a history of the last size batches, or nil if no
+// batches are kept.
+func newGatewayPolls(size int) *gatewayPolls {
+	if size <= 0 {
+		return nil
+	}
+	return &gatewayPolls{size: size}
+}
+
+// add records a poll, replacing the oldest once the history is full.
+func (p *gatewayPolls) add(poll GatewayPoll) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if len(p.polls) < p.size {
+		p.polls = append(p.polls, poll)
+		return
+	}
+	p.polls[p.next] = poll
+	p.next = (p.next + 1) % p.size
+}
+
+// find returns the recorded polls matching filter, oldest first.
+func (p *gatewayPolls) find(filter func(GatewayPoll) bool) []GatewayPoll {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	found := []GatewayPoll{}
+	for i := range p.polls {
+		poll := p.polls[(p.next+i)%len(p.polls)]
+		if filter(poll) {
+			found = append(found, poll)
+		}
+	}
+	return found
+}
+
+// recordPoll records a batch received from the gateway gwID and what became
+// of it, if batches are kept.
+func (nb *Impl) recordPoll(notifBatch *pb.NotificationBatch, gwID string, accepted bool, err error) {
+	if nb.gatewayPolls == nil {
+		return
+	}
+	poll := GatewayPoll{
+		Gateway:       gwID,
+		Round:         notifBatch.GetRoundID(),
+		Received:      nb.now(),
+		Outcome:       PollAccepted,
+		Notifications: len(notifBatch.GetNotifications()),
+		EphemeralIDs:  []int64{},
+	}
+	if err != nil {
+		poll.Outcome, poll.Error = PollFailed, err.Error()
+	} else if !accepted {
+		poll.Outcome = PollDuplicate
+	}
+	seen := map[int64]bool{}
+	for _, n := range notifBatch.GetNotifications() {
+		if !seen[n.EphemeralID] {
+			seen[n.EphemeralID] = true
+			poll.EphemeralIDs = append(poll.EphemeralIDs, n.EphemeralID)
+		}
+	}
+	nb.gatewayPolls.add(poll)
+}
+
+// handleGatewayPolls lists the recorded batches received from gateways,
+// oldest first. The optional query parameters filter them:
+//   - round: the round of the batch
+//   - from and to: RFC 3339 times the batch was received between, inclusive
+//   - gateway: the ID of the gateway which sent it
+func (nb *Impl) handleGatewayPolls(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		adminError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	if nb.gatewayPolls == nil {
+		adminError(w, http.StatusNotFound, errors.New("gateway poll history is disabled"))
+		return
+	}
+	query := r.URL.Query()
+	var round *uint64
+	if raw := query.Get("round"); raw != "" {
+		parsed, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			adminError(w, http.StatusBadRequest, errors.Errorf("invalid round %q", raw))
+			return
+		}
+		round = &parsed
+	}
+	var from, to time.Time
+	for param, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		raw := query.Get(param)
+		if raw == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			adminError(w, http.StatusBadRequest, errors.Errorf("%s must be an RFC 3339 time", param))
+			return
+		}
+		*t = parsed
+	}
+	gateway := query.Get("gateway")
+
+	polls := nb.gatewayPolls.find(func(p GatewayPoll) bool {
+		return (round == nil || p.Round == *round) &&
+			(from.IsZero() || !p.Received.Before(from)) &&
+			(to.IsZero() || !p.Received.After(to)) &&
+			(gateway == "" || p.Gateway == gateway)
+	})
+	writeJSON(w, polls)
+}
@@ -0,0 +1,86 @@
+package notifications
+
+import (
+	"encoding/json"
+	pb "gitlab.com/elixxir/comms/mixmessages"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gitlab.com/xx_network/comms/connect"
+	"gitlab.com/xx_network/primitives/id"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// Tests that batches received from gateways are recorded with their ephemeral
+// IDs and outcome, the oldest dropped once the history is full, and listed by
+// round and gateway through the admin API.
+func TestImpl_handleGatewayPolls(t *testing.T) {
+	s, err := storage.NewStorage("", "", "TestImpl_handleGatewayPolls", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+	impl := &Impl{Storage: s, gatewayPolls: newGatewayPolls(3)}
+	handler := impl.adminHandler("secret")
+
+	auth := func(name string) *connect.Auth {
+		host, err := connect.NewHost(id.NewIdFromString(name, id.Gateway, t), "0.0.0.0:11420", nil,
+			connect.GetDefaultHostParams())
+		if err != nil {
+			t.Fatalf("Failed to create gateway host: %+v", err)
+		}
+		return &connect.Auth{IsAuthenticated: true, Sender: host}
+	}
+	receive := func(gateway string, rid uint64, ephemerals ...int64) {
+		batch := &pb.NotificationBatch{RoundID: rid}
+		for _, eid := range ephemerals {
+			batch.Notifications = append(batch.Notifications, &pb.NotificationData{EphemeralID: eid})
+		}
+		if err := impl.ReceiveNotificationBatch(batch, auth(gateway)); err != nil {
+			t.Fatalf("Failed to receive batch: %+v", err)
+		}
+	}
+	receive("first", 1, 5)
+	receive("first", 2, 5, 6, 5)
+	receive("second", 2, 7)
+	receive("second", 3, 8)
+
+	list := func(query string) []GatewayPoll {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newAdminRequest(http.MethodGet, "/gateways/polls"+query, "secret"))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Unexpected status %d: %s", w.Code, w.Body.String())
+		}
+		var polls []GatewayPoll
+		if err := json.Unmarshal(w.Body.Bytes(), &polls); err != nil {
+			t.Fatalf("Failed to decode polls: %+v", err)
+		}
+		return polls
+	}
+
+	if polls := list(""); len(polls) != 3 || polls[0].Round != 2 || polls[2].Round != 3 {
+		t.Errorf("History should hold the last 3 batches, oldest first: %+v", polls)
+	}
+	polls := list("?round=2")
+	if len(polls) != 2 {
+		t.Fatalf("Expected both batches of round 2, got %+v", polls)
+	}
+	first, second := polls[0], polls[1]
+	if first.Gateway != id.NewIdFromString("first", id.Gateway, t).String() || first.Outcome != PollAccepted ||
+		first.Notifications != 3 || len(first.EphemeralIDs) != 2 || first.EphemeralIDs[1] != 6 {
+		t.Errorf("Unexpected accepted batch: %+v", first)
+	}
+	if second.Outcome != PollDuplicate || len(second.EphemeralIDs) != 1 || second.EphemeralIDs[0] != 7 {
+		t.Errorf("Unexpected duplicate batch: %+v", second)
+	}
+	gateway := id.NewIdFromString("second", id.Gateway, t).String()
+	if polls = list("?gateway=" + url.QueryEscape(gateway) + "&round=3"); len(polls) != 1 || polls[0].Round != 3 {
+		t.Errorf("Unexpected batches of gateway %s: %+v", gateway, polls)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newAdminRequest(http.MethodGet, "/gateways/polls?from=yesterday", "secret"))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Invalid time should be rejected, got %d", w.Code)
+	}
+}
@@ -0,0 +1,190 @@
+package notifications
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gitlab.com/elixxir/notifications-bot/testutil"
+	"gitlab.com/xx_network/primitives/id"
+	"gitlab.com/xx_network/primitives/id/ephemeral"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Tests that a protobuf JSON request posted to the gateway is verified and
+// registered as over gRPC, and that a badly signed one is rejected.
+func TestImpl_gatewayHandler(t *testing.T) {
+	impl := &Impl{
+		Storage: testutil.NewStorage(t),
+		comms:   testutil.NewPermissioningComms(t),
+	}
+	handler := impl.gatewayHandler(nil)
+	c := testutil.NewClient(t)
+	app := constants.MessengerAndroid.String()
+
+	body, err := protojson.Marshal(c.RegisterTokenRequest(t, "token", app, time.Now()))
+	if err != nil {
+		t.Fatalf("Failed to marshal request: %+v", err)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, gatewayPrefix+"RegisterToken", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	if _, err = impl.Storage.GetToken("token", app); err != nil {
+		t.Errorf("Token should be registered: %+v", err)
+	}
+
+	bad := c.RegisterTokenRequest(t, "other", app, time.Now())
+	bad.TokenSignature = []byte("bad")
+	body, _ = protojson.Marshal(bad)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, gatewayPrefix+"RegisterToken", bytes.NewReader(body)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a bad signature to be rejected, got %d", w.Code)
+	}
+}
+
+// Tests that with asynchronous registration on, gateway registrations and
+// unregistrations are queued, answered with their ack token and processed in
+// order.
+func TestImpl_gatewayHandler_Async(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	impl := &Impl{
+		Storage: testutil.NewStorage(t),
+		comms:   testutil.NewPermissioningComms(t),
+		ctx:     ctx,
+		asyncRegistrations: newAsyncRegistrations(AsyncRegistrationParams{
+			QueueSize: 4, Workers: 2, StatusTTL: time.Minute,
+		}),
+	}
+	handler := impl.gatewayHandler(nil)
+	c := testutil.NewClient(t)
+	app := constants.MessengerAndroid.String()
+
+	register := c.RegisterTokenRequest(t, "token", app, time.Now())
+	unregister := c.UnregisterTokenRequest(t, "token", app, time.Now().Add(time.Second))
+	for _, rpc := range []struct {
+		name string
+		msg  proto.Message
+		ack  string
+	}{
+		{"RegisterToken", register, AckToken(register.TokenSignature)},
+		{"UnregisterToken", unregister, AckToken(unregister.TokenSignature)},
+	} {
+		body, err := protojson.Marshal(rpc.msg)
+		if err != nil {
+			t.Fatalf("Failed to marshal request: %+v", err)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, gatewayPrefix+rpc.name, bytes.NewReader(body)))
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("Expected %s to be queued, got %d: %s", rpc.name, w.Code, w.Body.String())
+		}
+		if ack := w.Header().Get(registrationAckHeader); ack != rpc.ack {
+			t.Errorf("Expected %s ack token %s, got %q", rpc.name, rpc.ack, ack)
+		}
+	}
+	if _, err := impl.Storage.GetToken("token", app); err == nil {
+		t.Errorf("Queued registration should not be stored before it is processed")
+	}
+
+	for _, queue := range impl.asyncRegistrations.queues {
+		go impl.processRegistrations(queue)
+	}
+	waitForAck(t, impl.asyncRegistrations, AckToken(register.TokenSignature), AckRegistered)
+	waitForAck(t, impl.asyncRegistrations, AckToken(unregister.TokenSignature), AckRegistered)
+	if _, err := impl.Storage.GetToken("token", app); err == nil {
+		t.Errorf("Token should be unregistered after its registration")
+	}
+}
+
+// Tests that a token and tracked ID posted together to the gateway's
+// RegisterIdentity are both registered, and that neither is stored if either
+// request does not verify.
+func TestImpl_gatewayHandler_RegisterIdentity(t *testing.T) {
+	impl := getNewImpl()
+	impl.comms = testutil.NewPermissioningComms(t)
+	handler := impl.gatewayHandler(nil)
+	c := testutil.NewClient(t)
+	app := constants.MessengerAndroid.String()
+	iid, err := ephemeral.GetIntermediaryId(id.NewIdFromString("zezima", id.User, t))
+	if err != nil {
+		t.Fatalf("Failed to get intermediary ID: %+v", err)
+	}
+
+	post := func(token string, badTrackedSig bool) int {
+		tokenReq, err := protojson.Marshal(c.RegisterTokenRequest(t, token, app, time.Now()))
+		if err != nil {
+			t.Fatalf("Failed to marshal request: %+v", err)
+		}
+		trackedMsg := c.RegisterTrackedIDRequest(t, [][]byte{iid}, time.Now())
+		if badTrackedSig {
+			trackedMsg.Request.Signature = []byte("bad")
+		}
+		trackedReq, err := protojson.Marshal(trackedMsg)
+		if err != nil {
+			t.Fatalf("Failed to marshal request: %+v", err)
+		}
+		body, err := json.Marshal(map[string]json.RawMessage{"token": tokenReq, "trackedId": trackedReq})
+		if err != nil {
+			t.Fatalf("Failed to marshal body: %+v", err)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, gatewayPrefix+"RegisterIdentity", bytes.NewReader(body)))
+		return w.Code
+	}
+
+	if code := post("other", true); code != http.StatusBadRequest {
+		t.Errorf("Expected a bad tracked ID signature to be rejected, got %d", code)
+	}
+	if _, err = impl.Storage.GetToken("other", app); err == nil {
+		t.Errorf("Token should not be registered when its tracked ID is rejected")
+	}
+	if code := post("token", false); code != http.StatusOK {
+		t.Fatalf("Unexpected status %d", code)
+	}
+	if _, err = impl.Storage.GetToken("token", app); err != nil {
+		t.Errorf("Token should be registered: %+v", err)
+	}
+	trsaHash, err := storage.HashTransmissionRSA(c.TransmissionRsaPem)
+	if err != nil {
+		t.Fatalf("Failed to hash transmission RSA: %+v", err)
+	}
+	u, err := impl.Storage.GetUser(trsaHash)
+	if err != nil {
+		t.Fatalf("Failed to get user: %+v", err)
+	}
+	if len(u.Identities) != 1 {
+		t.Errorf("Tracked ID should be registered with the token: %+v", u.Identities)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, gatewayPrefix+"RegisterIdentity",
+		bytes.NewReader([]byte(`{"token": {}}`))))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Body without a tracked ID request should be rejected, got %d", w.Code)
+	}
+}
+
+// Tests that preflight requests are only answered for allowed origins.
+func Test_allowOrigins(t *testing.T) {
+	handler := (&Impl{}).gatewayHandler([]string{"https://app.example.com"})
+	for origin, allowed := range map[string]bool{"https://app.example.com": true, "https://evil.example.com": false} {
+		r := httptest.NewRequest(http.MethodOptions, gatewayPrefix+"RegisterToken", nil)
+		r.Header.Set("Origin", origin)
+		r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if got := w.Header().Get("Access-Control-Allow-Origin") == origin; got != allowed {
+			t.Errorf("Origin %s allowed: %t, expected %t", origin, got, allowed)
+		}
+	}
+}
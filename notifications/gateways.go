@@ -0,0 +1,119 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package notifications
+
+import (
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	pb "gitlab.com/elixxir/comms/mixmessages"
+	"gitlab.com/elixxir/notifications-bot/batchsig"
+	"gitlab.com/xx_network/comms/connect"
+	"gitlab.com/xx_network/crypto/signature/rsa"
+	"gitlab.com/xx_network/crypto/tls"
+	"gitlab.com/xx_network/primitives/id"
+	"gitlab.com/xx_network/primitives/ndf"
+	"sync"
+)
+
+// gatewayAllowlist holds the IDs of all gateways in the most recently received
+// NDF and the public keys of their certificates. It is used to reject
+// notification batches from hosts which are not part of the current network
+// definition, or which were not signed by the gateway.
+type gatewayAllowlist struct {
+	sync.RWMutex
+	ids map[id.ID]*rsa.PublicKey
+}
+
+// update replaces the contents of the allowlist with the gateways in the
+// passed in network definition, returning the IDs of the gateways which were
+// in the previous network definition but are not in this one.
+func (g *gatewayAllowlist) update(def *ndf.NetworkDefinition) []*id.ID {
+	ids := make(map[id.ID]*rsa.PublicKey, len(def.Gateways))
+	for _, gw := range def.Gateways {
+		gwID, err := gw.GetGatewayId()
+		if err != nil {
+			jww.WARN.Printf("Failed to parse gateway ID %v from NDF: %+v", gw.ID, err)
+			continue
+		}
+		var key *rsa.PublicKey
+		if gw.TlsCertificate != "" {
+			key, err = tls.NewPublicKeyFromPEM([]byte(gw.TlsCertificate))
+			if err != nil {
+				jww.WARN.Printf("Failed to load key of gateway %s from NDF: %+v", gwID, err)
+			}
+		}
+		ids[*gwID] = key
+	}
+
+	g.Lock()
+	defer g.Unlock()
+	var removed []*id.ID
+	for gwID := range g.ids {
+		if _, ok := ids[gwID]; !ok {
+			removed = append(removed, gwID.DeepCopy())
+		}
+	}
+	g.ids = ids
+	return removed
+}
+
+// has returns true if the passed in ID belongs to a gateway in the current NDF.
+func (g *gatewayAllowlist) has(gwID *id.ID) bool {
+	g.RLock()
+	defer g.RUnlock()
+	_, ok := g.ids[*gwID]
+	return ok
+}
+
+// key returns the public key of the gateway with the passed in ID, or nil if
+// the gateway is not in the current NDF or its certificate could not be read.
+func (g *gatewayAllowlist) key(gwID *id.ID) *rsa.PublicKey {
+	g.RLock()
+	defer g.RUnlock()
+	return g.ids[*gwID]
+}
+
+// checkGatewayAuth verifies that a notification batch was sent over an
+// authenticated connection by a gateway present in the current NDF.
+func (nb *Impl) checkGatewayAuth(auth *connect.Auth) error {
+	if auth == nil || !auth.IsAuthenticated {
+		reason, ip := "no auth state", ""
+		if auth != nil {
+			reason, ip = auth.Reason, auth.IpAddress
+		}
+		return errors.Errorf("Rejecting unauthenticated notification batch from %q: %s", ip, reason)
+	}
+	if auth.Sender == nil || auth.Sender.GetId() == nil {
+		return errors.Errorf("Rejecting notification batch from %q with no sender", auth.IpAddress)
+	}
+	if !nb.gateways.has(auth.Sender.GetId()) {
+		return errors.Errorf("Rejecting notification batch from %s (%q): sender is not a gateway in the current NDF",
+			auth.Sender.GetId(), auth.IpAddress)
+	}
+	return nil
+}
+
+// checkBatchSignature verifies that a notification batch was signed with the
+// NDF key of the gateway which sent it.
+func (nb *Impl) checkBatchSignature(batch *pb.NotificationBatch, auth *connect.Auth) error {
+	if auth == nil || auth.Sender == nil || auth.Sender.GetId() == nil {
+		return errors.Errorf("Rejecting notification batch for round %d with no sender", batch.RoundID)
+	}
+	gwID := auth.Sender.GetId()
+	key := nb.gateways.key(gwID)
+	if key == nil {
+		return errors.Errorf("Rejecting notification batch for round %d from %s (%q): no NDF key for sender",
+			batch.RoundID, gwID, auth.IpAddress)
+	}
+	err := batchsig.Verify(batch, key)
+	if err != nil {
+		return errors.WithMessagef(err, "Rejecting notification batch for round %d from %s (%q)",
+			batch.RoundID, gwID, auth.IpAddress)
+	}
+	return nil
+}
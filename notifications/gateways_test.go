@@ -0,0 +1,149 @@
+package notifications
+
+import (
+	pb "gitlab.com/elixxir/comms/mixmessages"
+	"gitlab.com/elixxir/notifications-bot/batchsig"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gitlab.com/xx_network/comms/connect"
+	"gitlab.com/xx_network/crypto/signature/rsa"
+	"gitlab.com/xx_network/primitives/id"
+	"gitlab.com/xx_network/primitives/ndf"
+	"gitlab.com/xx_network/primitives/utils"
+	"os"
+	"testing"
+)
+
+// Tests that checkGatewayAuth only accepts authenticated batches sent by
+// gateways in the current NDF.
+func TestImpl_checkGatewayAuth(t *testing.T) {
+	gwID := id.NewIdFromString("gateway", id.Gateway, t)
+	badID := id.NewIdFromString("imposter", id.Gateway, t)
+
+	impl := &Impl{}
+	impl.gateways.update(&ndf.NetworkDefinition{
+		Gateways: []ndf.Gateway{{ID: gwID.Marshal()}},
+	})
+
+	gwHost, err := connect.NewHost(gwID, "0.0.0.0:11420", nil, connect.GetDefaultHostParams())
+	if err != nil {
+		t.Fatalf("Failed to create gateway host: %+v", err)
+	}
+	badHost, err := connect.NewHost(badID, "0.0.0.0:11421", nil, connect.GetDefaultHostParams())
+	if err != nil {
+		t.Fatalf("Failed to create gateway host: %+v", err)
+	}
+
+	err = impl.checkGatewayAuth(&connect.Auth{IsAuthenticated: true, Sender: gwHost})
+	if err != nil {
+		t.Errorf("Failed to accept batch from known gateway: %+v", err)
+	}
+
+	err = impl.checkGatewayAuth(&connect.Auth{IsAuthenticated: false, Sender: gwHost})
+	if err == nil {
+		t.Errorf("Should have rejected unauthenticated batch")
+	}
+
+	err = impl.checkGatewayAuth(&connect.Auth{IsAuthenticated: true, Sender: badHost})
+	if err == nil {
+		t.Errorf("Should have rejected batch from gateway not in NDF")
+	}
+
+	err = impl.checkGatewayAuth(nil)
+	if err == nil {
+		t.Errorf("Should have rejected batch with no auth state")
+	}
+}
+
+// Tests that ReceiveNotificationBatch drops batches from unknown senders when
+// gateway authentication is enforced.
+func TestImpl_ReceiveNotificationBatch_EnforceGatewayAuth(t *testing.T) {
+	s, err := storage.NewStorage("", "", "", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+	impl := &Impl{
+		Storage:            s,
+		enforceGatewayAuth: true,
+	}
+
+	notifBatch := &pb.NotificationBatch{
+		RoundID:       42,
+		Notifications: []*pb.NotificationData{{EphemeralID: 5}},
+	}
+
+	err = impl.ReceiveNotificationBatch(notifBatch, &connect.Auth{IsAuthenticated: false})
+	if err == nil {
+		t.Errorf("ReceiveNotificationBatch() should have rejected unauthenticated batch")
+	}
+
+	nbm := impl.Storage.GetNotificationBuffer().Swap()
+	if len(nbm) != 0 {
+		t.Errorf("Rejected batch was added to notification buffer: %+v", nbm)
+	}
+}
+
+// Tests that checkBatchSignature only accepts batches signed with the sending
+// gateway's NDF key.
+func TestImpl_checkBatchSignature(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Failed to get working directory: %+v", err)
+	}
+	cert, err := utils.ReadFile(wd + "/../testutil/cmix.rip.crt")
+	if err != nil {
+		t.Fatalf("Failed to read certificate: %+v", err)
+	}
+	keyPem, err := utils.ReadFile(wd + "/../testutil/cmix.rip.key")
+	if err != nil {
+		t.Fatalf("Failed to read key: %+v", err)
+	}
+	key, err := rsa.LoadPrivateKeyFromPem(keyPem)
+	if err != nil {
+		t.Fatalf("Failed to load key: %+v", err)
+	}
+
+	gwID := id.NewIdFromString("gateway", id.Gateway, t)
+	unkeyedID := id.NewIdFromString("unkeyed", id.Gateway, t)
+	impl := &Impl{}
+	impl.gateways.update(&ndf.NetworkDefinition{
+		Gateways: []ndf.Gateway{
+			{ID: gwID.Marshal(), TlsCertificate: string(cert)},
+			{ID: unkeyedID.Marshal()},
+		},
+	})
+	gwHost, err := connect.NewHost(gwID, "0.0.0.0:11420", nil, connect.GetDefaultHostParams())
+	if err != nil {
+		t.Fatalf("Failed to create gateway host: %+v", err)
+	}
+	unkeyedHost, err := connect.NewHost(unkeyedID, "0.0.0.0:11421", nil, connect.GetDefaultHostParams())
+	if err != nil {
+		t.Fatalf("Failed to create gateway host: %+v", err)
+	}
+
+	batch := &pb.NotificationBatch{
+		RoundID:       42,
+		Notifications: []*pb.NotificationData{{EphemeralID: 5}},
+	}
+	err = impl.checkBatchSignature(batch, &connect.Auth{Sender: gwHost})
+	if err == nil {
+		t.Errorf("Should have rejected unsigned batch")
+	}
+
+	if err = batchsig.Sign(batch, key); err != nil {
+		t.Fatalf("Failed to sign batch: %+v", err)
+	}
+	err = impl.checkBatchSignature(batch, &connect.Auth{Sender: gwHost})
+	if err != nil {
+		t.Errorf("Failed to accept signed batch: %+v", err)
+	}
+
+	err = impl.checkBatchSignature(batch, &connect.Auth{Sender: unkeyedHost})
+	if err == nil {
+		t.Errorf("Should have rejected batch from gateway with no NDF key")
+	}
+
+	err = impl.checkBatchSignature(batch, nil)
+	if err == nil {
+		t.Errorf("Should have rejected batch with no sender")
+	}
+}
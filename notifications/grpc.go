@@ -0,0 +1,76 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Tuning of the gRPC connections of the comms. The comms library reads its
+// server keepalive options from package variables when the server is started,
+// so they are set before the comms are started or restarted. Message size
+// limits are fixed by the comms library at the gRPC maximum of 2 GiB in both
+// directions and cannot be tuned.
+
+package notifications
+
+import (
+	"gitlab.com/xx_network/comms/connect"
+	"time"
+)
+
+// GRPCParams configures the keepalives and connection lifetimes of the gRPC
+// server the comms run and of the connections the bot opens.
+type GRPCParams struct {
+	// KeepaliveTime is how long a connection to the server is idle before it
+	// is pinged, and KeepaliveTimeout how long the ping may go unanswered
+	// before the connection is closed
+	KeepaliveTime    time.Duration
+	KeepaliveTimeout time.Duration
+	// MinClientKeepalive is the shortest interval clients may ping the server
+	// at without their connection being closed
+	MinClientKeepalive time.Duration
+	// MaxConnectionIdle closes connections without calls for this long, and
+	// MaxConnectionAge closes connections this old, allowing
+	// MaxConnectionAgeGrace for calls to finish; 0 leaves connections open
+	MaxConnectionIdle     time.Duration
+	MaxConnectionAge      time.Duration
+	MaxConnectionAgeGrace time.Duration
+	// MaxConcurrentStreams limits the concurrent calls on a connection
+	MaxConcurrentStreams uint32
+
+	// ClientKeepaliveTime and ClientKeepaliveTimeout are the keepalives of the
+	// connections the bot opens, such as to the permissioning server
+	ClientKeepaliveTime    time.Duration
+	ClientKeepaliveTimeout time.Duration
+}
+
+// applyServer sets the options of the gRPC server the comms start. Unset
+// durations keep the comms library's defaults.
+func (p GRPCParams) applyServer() {
+	if p.KeepaliveTime > 0 {
+		connect.KaOpts.Time = p.KeepaliveTime
+	}
+	if p.KeepaliveTimeout > 0 {
+		connect.KaOpts.Timeout = p.KeepaliveTimeout
+	}
+	if p.MinClientKeepalive > 0 {
+		connect.KaEnforcement.MinTime = p.MinClientKeepalive
+	}
+	connect.KaOpts.MaxConnectionIdle = p.MaxConnectionIdle
+	connect.KaOpts.MaxConnectionAge = p.MaxConnectionAge
+	connect.KaOpts.MaxConnectionAgeGrace = p.MaxConnectionAgeGrace
+	if p.MaxConcurrentStreams > 0 {
+		connect.MaxConcurrentStreams = p.MaxConcurrentStreams
+	}
+}
+
+// ApplyClient sets the keepalives of the connections to a host created with
+// the passed in params. Unset durations keep the params' values.
+func (p GRPCParams) ApplyClient(params *connect.HostParams) {
+	if p.ClientKeepaliveTime > 0 {
+		params.KaClientOpts.Time = p.ClientKeepaliveTime
+	}
+	if p.ClientKeepaliveTimeout > 0 {
+		params.KaClientOpts.Timeout = p.ClientKeepaliveTimeout
+	}
+}
@@ -0,0 +1,40 @@
+package notifications
+
+import (
+	"gitlab.com/xx_network/comms/connect"
+	"testing"
+	"time"
+)
+
+// Tests that configured keepalives replace the comms defaults and unset ones
+// keep them.
+func TestGRPCParams(t *testing.T) {
+	kaOpts, kaEnforcement, streams := connect.KaOpts, connect.KaEnforcement, connect.MaxConcurrentStreams
+	defer func() {
+		connect.KaOpts, connect.KaEnforcement, connect.MaxConcurrentStreams = kaOpts, kaEnforcement, streams
+	}()
+
+	p := GRPCParams{
+		KeepaliveTime:       10 * time.Second,
+		MinClientKeepalive:  time.Second,
+		MaxConnectionAge:    2 * time.Hour,
+		ClientKeepaliveTime: 20 * time.Second,
+	}
+	p.applyServer()
+	if connect.KaOpts.Time != 10*time.Second || connect.KaOpts.Timeout != kaOpts.Timeout {
+		t.Errorf("Unexpected server keepalive: %+v", connect.KaOpts)
+	}
+	if connect.KaOpts.MaxConnectionAge != 2*time.Hour || connect.KaOpts.MaxConnectionIdle != 0 {
+		t.Errorf("Unexpected connection lifetimes: %+v", connect.KaOpts)
+	}
+	if connect.KaEnforcement.MinTime != time.Second || connect.MaxConcurrentStreams != streams {
+		t.Errorf("Unexpected enforcement %+v or streams %d", connect.KaEnforcement, connect.MaxConcurrentStreams)
+	}
+
+	hostParams := connect.GetDefaultHostParams()
+	defaultTimeout := hostParams.KaClientOpts.Timeout
+	p.ApplyClient(&hostParams)
+	if hostParams.KaClientOpts.Time != 20*time.Second || hostParams.KaClientOpts.Timeout != defaultTimeout {
+		t.Errorf("Unexpected client keepalive: %+v", hostParams.KaClientOpts)
+	}
+}
@@ -0,0 +1,113 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// The push history keeps the most recent pushes sent to each user, so a client
+// woken by a push for which it finds no message can check which rounds the
+// push was for and whether later pushes failed.
+
+package notifications
+
+import (
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"net/http"
+	"time"
+)
+
+// PushRecord describes a push sent to a client.
+type PushRecord struct {
+	App         string   `json:"app"`
+	EphemeralId int64    `json:"ephemeralId"`
+	Rounds      []uint64 `json:"rounds"`
+	// Count is the number of notifications carried by the push
+	Count     int       `json:"count"`
+	MessageId string    `json:"messageId,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// recordPush adds a send to the push history of its user, dropping their
+// oldest push beyond the configured history size.
+func (nb *Impl) recordPush(req NotificationRequest, res NotificationResult) {
+	if nb.pushHistorySize <= 0 {
+		return
+	}
+	e := &storage.PushEvent{
+		TransmissionRSAHash: req.Target.TransmissionRSAHash,
+		App:                 req.Target.App,
+		EphemeralId:         req.Target.EphemeralId,
+		Rounds:              req.Rounds,
+		Count:               req.Target.Count,
+		MessageId:           res.Receipt.MessageID,
+		Timestamp:           nb.now(),
+	}
+	if res.Err != nil {
+		e.Error = res.Err.Error()
+	}
+	err := nb.Storage.InsertPushEvent(e, nb.pushHistorySize)
+	if err != nil {
+		jww.WARN.Printf("Failed to record %s push in history of tRSA hash %+v: %+v", e.App, e.TransmissionRSAHash, err)
+	}
+}
+
+// PushHistory returns the most recent pushes sent to the client which signed
+// the request, most recent first. Pushes are only kept within the delivery log
+// retention period.
+func (nb *Impl) PushHistory(msg *AccountRequest) ([]PushRecord, error) {
+	jww.INFO.Println("PushHistory")
+	err := nb.verifyAccountRequest(msg, PushHistoryTag)
+	if err != nil {
+		return nil, err
+	}
+	return nb.pushHistory(msg.TransmissionRsaPem)
+}
+
+// pushHistory returns the push history of the user with the passed in
+// transmission key.
+func (nb *Impl) pushHistory(transmissionRsaPem []byte) ([]PushRecord, error) {
+	trsaHash, err := storage.HashTransmissionRSA(transmissionRsaPem)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to hash transmission RSA")
+	}
+	events, err := nb.Storage.GetPushHistory(trsaHash)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to get push history")
+	}
+	history := make([]PushRecord, 0, len(events))
+	for _, e := range events {
+		history = append(history, PushRecord{
+			App:         e.App,
+			EphemeralId: e.EphemeralId,
+			Rounds:      e.Rounds,
+			Count:       e.Count,
+			MessageId:   e.MessageId,
+			Error:       e.Error,
+			Timestamp:   e.Timestamp,
+		})
+	}
+	return history, nil
+}
+
+// handlePushHistory serves PushHistory for a JSON encoded AccountRequest.
+func (nb *Impl) handlePushHistory(w http.ResponseWriter, r *http.Request) {
+	msg, ok := decodeAccountRequest(w, r)
+	if !ok {
+		return
+	}
+	err := nb.verifyAccountRequest(msg, PushHistoryTag)
+	if err != nil {
+		adminError(w, http.StatusUnauthorized, err)
+		return
+	}
+	history, err := nb.pushHistory(msg.TransmissionRsaPem)
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, history)
+}
@@ -0,0 +1,40 @@
+package notifications
+
+import (
+	"gitlab.com/elixxir/notifications-bot/notifications/providers"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gitlab.com/elixxir/notifications-bot/testutil"
+	"testing"
+	"time"
+)
+
+// Tests that sends are recorded in the push history of their user, which is
+// returned to the client only for requests signed with PushHistoryTag.
+func TestImpl_PushHistory(t *testing.T) {
+	s := testutil.NewStorage(t)
+	impl := &Impl{Storage: s, pushHistorySize: 2}
+	c := testutil.NewClient(t)
+	trsaHash, err := storage.HashTransmissionRSA(c.TransmissionRsaPem)
+	if err != nil {
+		t.Fatalf("Failed to hash transmission RSA: %+v", err)
+	}
+
+	for i := uint64(1); i <= 3; i++ {
+		req := NotificationRequest{
+			Target: storage.GTNResult{TransmissionRSAHash: trsaHash, App: "HavenIOS", Count: int(i)},
+			Rounds: []uint64{i},
+		}
+		impl.recordPush(req, NotificationResult{Receipt: providers.Receipt{MessageID: "message"}})
+	}
+
+	if _, err = impl.PushHistory(accountRequest(t, c, RegistrationStatusTag, time.Now())); err == nil {
+		t.Errorf("Request signed with another tag should be rejected")
+	}
+	history, err := impl.PushHistory(accountRequest(t, c, PushHistoryTag, time.Now()))
+	if err != nil {
+		t.Fatalf("Failed to get push history: %+v", err)
+	}
+	if len(history) != 2 || history[0].Rounds[0] != 3 || history[1].Count != 2 || history[0].MessageId != "message" {
+		t.Errorf("Expected the 2 most recent pushes, got %+v", history)
+	}
+}
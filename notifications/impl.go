@@ -12,21 +12,30 @@
 package notifications
 
 import (
+	"context"
 	"crypto/tls"
 	"github.com/pkg/errors"
 	jww "github.com/spf13/jwalterweatherman"
 	pb "gitlab.com/elixxir/comms/mixmessages"
 	"gitlab.com/elixxir/comms/network"
 	"gitlab.com/elixxir/comms/notificationBot"
+	"gitlab.com/elixxir/notifications-bot/clock"
 	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/elixxir/notifications-bot/events"
+	"gitlab.com/elixxir/notifications-bot/faults"
+	"gitlab.com/elixxir/notifications-bot/io"
 	"gitlab.com/elixxir/notifications-bot/notifications/providers"
+	"gitlab.com/elixxir/notifications-bot/proxy"
 	"gitlab.com/elixxir/notifications-bot/storage"
 	"gitlab.com/xx_network/comms/connect"
+	"gitlab.com/xx_network/crypto/signature/rsa"
 	"gitlab.com/xx_network/primitives/id"
 	"gitlab.com/xx_network/primitives/ndf"
 	"gitlab.com/xx_network/primitives/netTime"
 	"gitlab.com/xx_network/primitives/utils"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Impl for notifications; holds comms, storage object, creds and main functions
@@ -38,10 +47,178 @@ type Impl struct {
 	roundStore       sync.Map
 	maxNotifications int
 	maxPayloadBytes  int
+	maxSendAttempts  int
+	// maxPushesPerToken is the number of pushes a single token is sent per
+	// batch before remaining notifications are truncated
+	maxPushesPerToken int
+	// pushHistorySize is the number of most recent pushes kept for each user
+	pushHistorySize int
+	// testPushes limits how often each user may request a test push
+	testPushes *testPushLimiter
+	// reregistrationNudges asks the other devices of an identity to refresh
+	// the registration of a device whose token was purged
+	reregistrationNudges bool
+	// quietRepeatPushes sends silent pushes to users already notified since
+	// they last opened the app
+	quietRepeatPushes bool
+	// digest holds the non-urgent notifications of users in digest mode for
+	// a summary push each interval
+	digest DigestParams
+	// pushQuotas caps the daily pushes per tracked identity of each app
+	pushQuotas map[string]PushQuota
+	// conversations holds the priority tier and alert text of the pushes for
+	// each conversation
+	conversations map[string]ConversationParams
+	// backfillSource serves the batches of rounds missed while the bot was
+	// down; nil if backfill is disabled
+	backfillSource BatchSource
+	backfill       BackfillParams
+	// writeAhead buffers registrations while the database is read-only and
+	// lookups caches token lookups to send from; nil if disabled
+	writeAhead *writeAheadBuffer
+	lookups    *lookupCache
+	degraded   DegradedParams
 
 	providers map[string]providers.Provider
+	events    events.Publisher
+	// lease holds the sender lease state in failover mode; nil if the
+	// instance always sends
+	lease *failover
+	// tenants holds the limits and counters of each configured tenant by
+	// name; see startTenants
+	tenants map[string]*tenant
+
+	// The bot's certificate and key, used to sign its attestation
+	certificate []byte
+	keyPem      []byte
+	signingKey  *rsa.PrivateKey
+	// rotation holds the certificate and key being rotated out; nil if no
+	// rotation is in its grace period
+	rotation *keyRotation
+	// pinnedKeys are the permissioning keys registrations are verified
+	// against; the permissioning host's key if empty
+	pinnedKeys []pinnedKey
+	// commsMux guards replacing Comms and inst when the comms are
+	// re-registered with a new certificate; startComms starts them
+	commsMux      sync.RWMutex
+	startComms    func(cert, key []byte) *notificationBot.Comms
+	permissioning *permissioningHost
+	// receiptTTL is how long signed registration receipts are valid
+	receiptTTL time.Duration
+
+	// minProtocol is the oldest client protocol version served; all
+	// versions are served if 0
+	minProtocol int
+
+	enforceGatewayAuth bool
+	// requireBatchSignatures rejects batches not signed by the sending
+	// gateway's NDF key
+	requireBatchSignatures bool
+	gateways               gatewayAllowlist
+	// addressFamily is preferred when resolving dual-stack gateway host names
+	addressFamily AddressFamily
+	// gatewayStaleAfter is how long since its last batch a gateway is
+	// reported as stale; never if 0
+	gatewayStaleAfter time.Duration
+	// gatewayPolls holds the most recent batches received from gateways; nil
+	// if none are kept
+	gatewayPolls *gatewayPolls
+	// profileDir is where heap profiles triggered through the admin API are
+	// written; they are returned in the response if empty
+	profileDir string
 
 	ndfStopper Stopper
+	// ndfStream streams NDF updates in place of polling; nil if the NDF is
+	// polled
+	ndfStream io.NdfStream
+
+	// comms replaces Comms for host lookups in tests; see hosts
+	comms NotificationComms
+
+	// maxBuffered bounds the notifications waiting to be sent; batches which
+	// would exceed it are delayed up to backpressureDelay, then rejected
+	maxBuffered       int
+	backpressureDelay time.Duration
+	ingestion         ingestionStats
+	// maxNotificationAge is the age after which pending notifications are
+	// dropped rather than sent; droppedStale counts them
+	maxNotificationAge time.Duration
+	droppedStale       uint64
+	// rpcs holds the latency and outcome metrics of handled RPCs
+	rpcs rpcMetrics
+
+	// outbox is set when pushes are written to the outbox and sent by the
+	// outbox dispatcher rather than sent directly
+	outbox bool
+
+	// maintenance is 1 while sends are paused and draining is 1 while queued
+	// notifications are being released
+	maintenance   uint32
+	draining      uint32
+	drainRounds   int
+	drainInterval time.Duration
+
+	// schedule aligns sends to the round cadence and adaptive adapts the
+	// interval between sends to the notifications buffered; sends are made
+	// every NotificationRate seconds if both are nil
+	schedule *roundSchedule
+	adaptive *adaptiveInterval
+
+	// stats holds the latest *Stats collected by the stats reporter
+	stats atomic.Value
+
+	// broadcastRate is the maximum pushes per second of operator broadcasts
+	// and broadcast tracks the running or most recent one
+	broadcastRate int
+	broadcast     broadcastState
+
+	// canaries holds the heartbeat results of each canary token
+	canaries canaryState
+
+	// registrarParams configures re-verifying stored registrar signatures and
+	// registrar tracks the running or most recent re-verification
+	registrarParams RegistrarParams
+	registrar       registrarState
+
+	// registrationBans refuses registrations from sources with repeated
+	// invalid signatures; nil if disabled
+	registrationBans *registrationBans
+
+	// asyncRegistrations queues registrations to be processed in the
+	// background; nil if disabled
+	asyncRegistrations *asyncRegistrations
+
+	// features caches the feature flags gating risky behaviors
+	features *featureFlags
+
+	// proxies routes push provider requests through egress proxies
+	proxies *proxy.Proxies
+
+	// Set when fault injection is enabled, to fail sends and storage writes
+	// at rates set through the admin API
+	sendFaults  *faults.Injector
+	writeFaults *faults.Injector
+
+	// ctx is cancelled by Shutdown, abandoning in-flight lookups and sends;
+	// each lookup and send attempt is further bounded by its timeout
+	ctx           context.Context
+	cancel        context.CancelFunc
+	lookupTimeout time.Duration
+	sendTimeout   time.Duration
+
+	// clock is the time source of the ephemeral creator and deleter and of
+	// request timestamp checks; the system time if nil
+	clock clock.Clock
+
+	// ephemeral holds the ephemeral ID timing; defaults are used if unset
+	ephemeral EphemeralParams
+
+	// nextOffsetTime is a time within the next offset bucket the ephemeral
+	// creator will generate ephemerals for
+	nextOffsetTime time.Time
+	// reconcileInterval is how often every identity is checked for a current
+	// ephemeral; never if 0
+	reconcileInterval time.Duration
 }
 
 // StartNotifications creates an Impl from the information passed in
@@ -67,30 +244,171 @@ func StartNotifications(params Params, noTLS, noFirebase bool) (*Impl, error) {
 		}
 	}
 
+	if err = validateMinProtocolVersion(params.MinProtocolVersion); err != nil {
+		return nil, err
+	}
+	if err = params.AddressFamily.Validate(); err != nil {
+		return nil, err
+	}
+	if err = params.Ephemeral.Validate(); err != nil {
+		return nil, errors.WithMessage(err, "Invalid ephemeral ID timing")
+	}
+
 	receivedNdf := uint32(0)
+	ctx, cancel := context.WithCancel(context.Background())
 
 	impl := &Impl{
+		certificate:   cert,
+		keyPem:        key,
+		receiptTTL:    params.ReceiptTTL,
+		ctx:           ctx,
+		cancel:        cancel,
+		lookupTimeout: params.LookupTimeout,
+		sendTimeout:   params.SendTimeout,
+
 		providers:        map[string]providers.Provider{},
 		receivedNdf:      &receivedNdf,
 		maxNotifications: params.NotificationsPerBatch,
 		maxPayloadBytes:  params.MaxNotificationPayload,
+		maxSendAttempts:  params.MaxSendAttempts,
+
+		maxPushesPerToken:    params.MaxPushesPerToken,
+		pushHistorySize:      params.PushHistorySize,
+		testPushes:           newTestPushLimiter(params.TestPushInterval),
+		reregistrationNudges: params.ReregistrationNudges,
+		quietRepeatPushes:    params.QuietRepeatPushes,
+		digest:               params.Digest,
+		conversations:        params.Conversations,
+		pushQuotas:           params.PushQuotas,
+		backfill:             params.Backfill,
+		degraded:             params.Degraded,
+
+		maxBuffered:       params.MaxBufferedNotifications,
+		backpressureDelay: params.BackpressureDelay,
+
+		maxNotificationAge: params.MaxNotificationAge,
+
+		broadcastRate: params.BroadcastRate,
+
+		registrarParams:    params.Registrar,
+		registrationBans:   newRegistrationBans(params.RegistrationBans),
+		asyncRegistrations: newAsyncRegistrations(params.AsyncRegistration),
+		features:           newFeatureFlags(params.FeatureFlagRefresh),
+
+		drainRounds:   params.MaintenanceDrainRounds,
+		drainInterval: time.Duration(params.NotificationRate) * time.Second,
+
+		minProtocol:            params.MinProtocolVersion,
+		enforceGatewayAuth:     params.EnforceGatewayAuth,
+		requireBatchSignatures: params.RequireBatchSignatures,
+		gatewayStaleAfter:      params.GatewayStaleAfter,
+		gatewayPolls:           newGatewayPolls(params.GatewayPollHistory),
+		addressFamily:          params.AddressFamily,
+		profileDir:             params.ProfileDir,
+		outbox:                 params.Outbox,
+
+		ephemeral:         params.Ephemeral,
+		reconcileInterval: params.EphemeralReconcileInterval,
+		clock:             clock.Real{},
+	}
+
+	if key != nil {
+		impl.signingKey, err = rsa.LoadPrivateKeyFromPem(key)
+		if err != nil {
+			return nil, errors.WithMessage(err, "Failed to load private key")
+		}
+	}
+
+	impl.rotation, err = loadKeyRotation(params.KeyRotation, impl.now())
+	if err != nil {
+		return nil, err
+	}
+	impl.pinnedKeys, err = loadPermissioningKeys(params.PermissioningKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	if params.NdfStreamURL != "" {
+		impl.ndfStream, err = io.NewHttpNdfStream(params.NdfStreamURL)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if params.Backfill.URL != "" {
+		impl.backfillSource, err = newHTTPBatchSource(params.Backfill.URL)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if params.Degraded.Enabled {
+		if params.Degraded.LookupCacheTTL > 0 {
+			impl.lookups = &lookupCache{ttl: params.Degraded.LookupCacheTTL}
+		}
+	}
+
+	impl.lease, err = newFailover(params.Failover)
+	if err != nil {
+		return nil, err
+	}
+
+	impl.events, err = events.NewPublisher(params.Events)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to set up event publisher")
+	}
+
+	impl.proxies, err = proxy.New(params.Proxy)
+	if err != nil {
+		return nil, err
 	}
 
 	// Set up firebase messaging client
 	if !noFirebase {
-		impl.providers[constants.MessengerAndroid.String()], err = providers.NewFCM(params.FBCreds)
+		impl.providers[constants.MessengerAndroid.String()], err = providers.NewFCM(providers.FCMParams{
+			CredentialsPath: params.FBCreds,
+			ChannelID:       params.FCMChannel.ChannelID,
+			Sound:           params.FCMChannel.Sound,
+			TTL:             params.PushTTL,
+			AnalyticsLabel:  params.FCMAnalyticsLabel,
+			Proxy:           impl.proxies,
+		})
 		if err != nil {
 			jww.WARN.Printf("Failed to start firebase provider for %s", constants.MessengerAndroid)
 		}
 
 		if params.HavenFBCreds != "" {
-			impl.providers[constants.HavenAndroid.String()], err = providers.NewFCM(params.HavenFBCreds)
+			impl.providers[constants.HavenAndroid.String()], err = providers.NewFCM(providers.FCMParams{
+				CredentialsPath: params.HavenFBCreds,
+				ChannelID:       params.HavenFCMChannel.ChannelID,
+				Sound:           params.HavenFCMChannel.Sound,
+				TTL:             params.PushTTL,
+				AnalyticsLabel:  params.FCMAnalyticsLabel,
+				Proxy:           impl.proxies,
+			})
 			if err != nil {
 				jww.WARN.Printf("Failed to start firebase provider for %s", constants.HavenAndroid)
 			}
 		}
 	}
 
+	var translations providers.Translations
+	if params.TranslationsPath != "" {
+		translations, err = providers.LoadTranslations(params.TranslationsPath)
+		if err != nil {
+			return nil, err
+		}
+		params.APNS.Translations = translations
+		params.HavenAPNS.Translations = translations
+	}
+
+	params.APNS.TTL = params.PushTTL
+	params.HavenAPNS.TTL = params.PushTTL
+	params.WebPush.TTL = params.PushTTL
+	params.APNS.Proxy = impl.proxies
+	params.HavenAPNS.Proxy = impl.proxies
+	params.WebPush.Proxy = impl.proxies
+
 	if params.KeyPath == "" {
 		jww.WARN.Println("WARNING: RUNNING WITHOUT APNS")
 	} else {
@@ -109,10 +427,50 @@ func StartNotifications(params Params, noTLS, noFirebase bool) (*Impl, error) {
 		}
 	}
 
+	if params.WebPush.VAPIDPrivateKey == "" {
+		jww.WARN.Println("WARNING: RUNNING WITHOUT WEB PUSH")
+	} else {
+		impl.providers[constants.MessengerWeb.String()], err = providers.NewWebPush(params.WebPush)
+		if err != nil {
+			jww.WARN.Printf("Failed to start web push provider for %s", constants.MessengerWeb)
+		}
+	}
+
+	err = impl.startTenants(params.Tenants, params, translations)
+	if err != nil {
+		return nil, err
+	}
+	impl.limitProviders(params.ProviderLimits)
+
+	if params.FaultInjection {
+		jww.WARN.Println("WARNING: FAULT INJECTION ENABLED, DO NOT RUN IN PRODUCTION")
+		impl.enableFaultInjection()
+	}
+
 	// Start notification comms server
+	commsID := params.CommsID
+	if commsID == nil {
+		commsID = &id.NotificationBot
+	} else if !commsID.Cmp(&id.NotificationBot) {
+		jww.INFO.Printf("Running comms under ID %s", commsID)
+	}
 	handler := NewImplementation(impl)
-	comms := notificationBot.StartNotificationBot(&id.NotificationBot, params.Address, handler, cert, key)
-	impl.Comms = comms
+	params.GRPC.applyServer()
+	impl.startComms = func(cert, key []byte) *notificationBot.Comms {
+		comms := notificationBot.StartNotificationBot(commsID, params.Address, handler, cert, key)
+		go serveHTTPS(comms, params.HttpsCertPath, params.HttpsKeyPath)
+		return comms
+	}
+	// During a key rotation's grace period the comms keep the previous
+	// identity, which is in the NDF, until KeyRotator re-registers them
+	commsCert, commsKey := cert, key
+	if impl.rotation != nil {
+		commsKey = impl.rotation.keyPem
+		if !noTLS {
+			commsCert = impl.rotation.certificate
+		}
+	}
+	impl.Comms = impl.startComms(commsCert, commsKey)
 	i, err := network.NewInstance(impl.Comms.ProtoComms, &ndf.NetworkDefinition{AddressSpace: []ndf.AddressSpace{{Size: 16, Timestamp: netTime.Now()}}}, nil, nil, network.None, false)
 	if err != nil {
 		return nil, errors.WithMessage(err, "Failed to start instance")
@@ -121,68 +479,116 @@ func StartNotifications(params Params, noTLS, noFirebase bool) (*Impl, error) {
 	impl.inst = i
 
 	go impl.Cleaner()
+	if params.AlignSendsToRounds {
+		impl.schedule = newRoundSchedule(params.RoundSettleDelay, params.MinSendInterval,
+			time.Duration(params.NotificationRate)*time.Second)
+	} else if params.AdaptiveSendInterval {
+		impl.adaptive = newAdaptiveInterval(params.MinSendInterval,
+			time.Duration(params.NotificationRate)*time.Second)
+	}
 	go impl.Sender(params.NotificationRate)
 
-	go func() {
-		if params.HttpsKeyPath == "" || params.HttpsCertPath == "" {
-			jww.WARN.Println("Running without HTTPS")
-			return
-		}
-		httpsCertificate, err := tls.LoadX509KeyPair(params.HttpsCertPath, params.HttpsKeyPath)
-		if err != nil {
-			jww.ERROR.Printf("Failed to load https certificate: %+v", err)
-			return
-		}
-		err = comms.ServeHttps(httpsCertificate)
-		if err != nil {
-			jww.ERROR.Printf("Failed to serve HTTPS: %+v", err)
-		}
-	}()
+	if params.AdminAddress != "" {
+		impl.startAdmin(params.AdminAddress, params.AdminToken)
+	}
+	if params.AttestationAddress != "" {
+		impl.startAttestation(params.AttestationAddress, params.GatewayAllowedOrigins)
+	}
+	if params.MetricsAddress != "" {
+		impl.startMetrics(params.MetricsAddress)
+	}
 
 	return impl, nil
 }
 
+// serveHTTPS serves the comms over HTTPS with the certificate and key at the
+// passed in paths, if both are set.
+func serveHTTPS(comms *notificationBot.Comms, certPath, keyPath string) {
+	if keyPath == "" || certPath == "" {
+		jww.WARN.Println("Running without HTTPS")
+		return
+	}
+	httpsCertificate, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		jww.ERROR.Printf("Failed to load https certificate: %+v", err)
+		return
+	}
+	err = comms.ServeHttps(httpsCertificate)
+	if err != nil {
+		jww.ERROR.Printf("Failed to serve HTTPS: %+v", err)
+	}
+}
+
+// Shutdown cancels the notification lookups and provider sends in progress.
+func (nb *Impl) Shutdown() {
+	if nb.cancel != nil {
+		nb.cancel()
+	}
+	nb.releaseLease()
+}
+
+// context returns the context notification lookups and sends are run under.
+func (nb *Impl) context() context.Context {
+	if nb.ctx == nil {
+		return context.Background()
+	}
+	return nb.ctx
+}
+
+// SetClock replaces the time source of the Impl.
+func (nb *Impl) SetClock(c clock.Clock) {
+	nb.clock = c
+}
+
+// now returns the current time on the Impl's clock.
+func (nb *Impl) now() time.Time {
+	if nb.clock == nil {
+		return time.Now()
+	}
+	return nb.clock.Now()
+}
+
 // NewImplementation initializes impl object
 func NewImplementation(instance *Impl) *notificationBot.Implementation {
 	impl := notificationBot.NewImplementation()
 
 	impl.Functions.RegisterForNotifications = func(request *pb.NotificationRegisterRequest) error {
-		return instance.RegisterForNotifications(request)
+		return instance.intercept("RegisterForNotifications", clientPeer(request.GetTransmissionRsa()), func() error {
+			return instance.versioned(ProtocolLegacy, "RegisterForNotifications", func() error {
+				return instance.RegisterForNotifications(request)
+			})
+		})
 	}
 
 	impl.Functions.UnregisterForNotifications = func(request *pb.NotificationUnregisterRequest) error {
-		return instance.UnregisterForNotifications(request)
+		return instance.intercept("UnregisterForNotifications", "legacy-client", func() error {
+			return instance.versioned(ProtocolLegacy, "UnregisterForNotifications", func() error {
+				return instance.UnregisterForNotifications(request)
+			})
+		})
 	}
 
 	impl.Functions.ReceiveNotificationBatch = func(data *pb.NotificationBatch, auth *connect.Auth) error {
-		return instance.ReceiveNotificationBatch(data, auth)
+		return instance.intercept("ReceiveNotificationBatch", gatewayPeer(auth), func() error {
+			return instance.ReceiveNotificationBatch(data, auth)
+		})
 	}
+
+	// gRPC replies have no room for an ack token, so requests are never queued
 	impl.Functions.RegisterToken = func(msg *pb.RegisterTokenRequest) error {
-		err := instance.RegisterToken(msg)
-		if err != nil {
-			jww.ERROR.Printf("Failed to RegisterToken: %+v", err)
-		}
+		_, err := instance.registerTokenRPC(msg, false)
 		return err
 	}
 	impl.Functions.RegisterTrackedID = func(msg *pb.RegisterTrackedIdRequest) error {
-		err := instance.RegisterTrackedID(msg)
-		if err != nil {
-			jww.ERROR.Printf("Failed to RegisterTrackedID: %+v", err)
-		}
+		_, err := instance.registerTrackedIDRPC(msg, false)
 		return err
 	}
 	impl.Functions.UnregisterToken = func(msg *pb.UnregisterTokenRequest) error {
-		err := instance.UnregisterToken(msg)
-		if err != nil {
-			jww.ERROR.Printf("Failed to UnregisterToken: %+v", err)
-		}
+		_, err := instance.unregisterTokenRPC(msg, false)
 		return err
 	}
 	impl.Functions.UnregisterTrackedID = func(msg *pb.UnregisterTrackedIdRequest) error {
-		err := instance.UnregisterTrackedID(msg.Request)
-		if err != nil {
-			jww.ERROR.Printf("Failed to UnregisterTrackedID: %+v", err)
-		}
+		_, err := instance.unregisterTrackedIDRPC(msg, false)
 		return err
 	}
 
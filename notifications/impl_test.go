@@ -1,6 +1,7 @@
 package notifications
 
 import (
+	"context"
 	"fmt"
 	"gitlab.com/elixxir/notifications-bot/notifications/providers"
 	"gitlab.com/elixxir/notifications-bot/storage"
@@ -15,9 +16,9 @@ type MockProvider struct {
 	donech chan string
 }
 
-func (mp *MockProvider) Notify(csv string, target storage.GTNResult) (bool, error) {
+func (mp *MockProvider) Notify(_ context.Context, csv string, target storage.GTNResult) (providers.Receipt, bool, error) {
 	mp.donech <- csv
-	return true, nil
+	return providers.Receipt{}, true, nil
 }
 
 // Unit test for startnotifications
@@ -0,0 +1,248 @@
+//go:build integration
+
+// End-to-end tests of the bot against Postgres, a gateway comms server and a
+// fake FCM endpoint. Run with
+//
+//	go test -tags integration ./notifications -run Integration
+//
+// Postgres is started with docker unless INTEGRATION_POSTGRES is set to the
+// host:port of a database to use instead, with the user and database named by
+// INTEGRATION_POSTGRES_USER and INTEGRATION_POSTGRES_DB (both postgres if
+// unset), which should be empty.
+
+package notifications
+
+import (
+	crand "crypto/rand"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/comms/gateway"
+	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/elixxir/notifications-bot/notifications/providers"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gitlab.com/elixxir/notifications-bot/testutil"
+	"gitlab.com/xx_network/comms/connect"
+	"gitlab.com/xx_network/comms/gossip"
+	"gitlab.com/xx_network/primitives/id"
+	"gitlab.com/xx_network/primitives/id/ephemeral"
+	"gorm.io/gorm"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fcmMessage is the part of an FCM v1 send request checked by the tests.
+type fcmMessage struct {
+	Message struct {
+		Token string            `json:"token"`
+		Data  map[string]string `json:"data"`
+	} `json:"message"`
+}
+
+// fakeFCM is an httptest server accepting FCM v1 sends.
+type fakeFCM struct {
+	*httptest.Server
+	messages chan fcmMessage
+}
+
+func newFakeFCM(t *testing.T) *fakeFCM {
+	f := &fakeFCM{messages: make(chan fcmMessage, 16)}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || !strings.HasSuffix(r.URL.Path, "/messages:send") {
+			http.NotFound(w, r)
+			return
+		}
+		var m fcmMessage
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.messages <- m
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"name": "projects/integration/messages/1"}`))
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// next returns the next push received, failing the test if none arrives.
+func (f *fakeFCM) next(t *testing.T) fcmMessage {
+	t.Helper()
+	select {
+	case m := <-f.messages:
+		return m
+	case <-time.After(10 * time.Second):
+		t.Fatal("No push received by fake FCM")
+		return fcmMessage{}
+	}
+}
+
+// none fails the test if a push is received within the passed in duration.
+func (f *fakeFCM) none(t *testing.T, wait time.Duration) {
+	t.Helper()
+	select {
+	case m := <-f.messages:
+		t.Fatalf("Unexpected push received: %+v", m)
+	case <-time.After(wait):
+	}
+}
+
+// startPostgres returns storage params for a fresh Postgres database.
+func startPostgres(t *testing.T) storage.Params {
+	user, dbName := os.Getenv("INTEGRATION_POSTGRES_USER"), os.Getenv("INTEGRATION_POSTGRES_DB")
+	if user == "" {
+		user = "postgres"
+	}
+	if dbName == "" {
+		dbName = "postgres"
+	}
+	address := os.Getenv("INTEGRATION_POSTGRES")
+	if address == "" {
+		out, err := exec.Command("docker", "run", "-d", "--rm", "-e", "POSTGRES_HOST_AUTH_METHOD=trust",
+			"-p", "127.0.0.1::5432", "postgres:15-alpine").Output()
+		if err != nil {
+			t.Skipf("Could not start Postgres with docker: %+v", err)
+		}
+		container := strings.TrimSpace(string(out))
+		t.Cleanup(func() { _ = exec.Command("docker", "rm", "-f", container).Run() })
+		out, err = exec.Command("docker", "port", container, "5432/tcp").Output()
+		if err != nil {
+			t.Fatalf("Failed to get Postgres port: %+v", err)
+		}
+		address = strings.TrimSpace(strings.Split(string(out), "\n")[0])
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		t.Fatalf("Invalid Postgres address %q: %+v", address, err)
+	}
+	return storage.Params{Username: user, DBName: dbName, Address: host, Port: port}
+}
+
+// newPostgresStorage connects to the database once it accepts connections.
+func newPostgresStorage(t *testing.T, params storage.Params) *storage.Storage {
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		s, err := storage.NewStorageFromParams(params)
+		if err == nil {
+			return s
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Failed to connect to Postgres: %+v", err)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// freeAddress returns a local address nothing is listening on.
+func freeAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %+v", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// Drives a client through registration, a gateway batch reaching the fake
+// FCM endpoint as a push, and unregistration, checking storage at each step.
+func TestIntegration_RegisterNotifyUnregister(t *testing.T) {
+	s := newPostgresStorage(t, startPostgres(t))
+	fcm := newFakeFCM(t)
+
+	botAddress := freeAddress(t)
+	impl, err := StartNotifications(Params{
+		Address:               botAddress,
+		KeyPath:               testutil.Path(testutil.PermissioningKey),
+		CertPath:              testutil.Path(testutil.PermissioningCert),
+		NotificationsPerBatch: 20,
+		NotificationRate:      1,
+		MaxSendAttempts:       1,
+	}, false, true)
+	if err != nil {
+		t.Fatalf("Failed to start bot: %+v", err)
+	}
+	defer impl.Shutdown()
+	impl.Storage = s
+	impl.maxPayloadBytes = 4096
+	impl.providers[constants.MessengerAndroid.String()], err = providers.NewFCM(providers.FCMParams{
+		Endpoint:  fcm.URL,
+		ProjectID: "integration",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create FCM provider: %+v", err)
+	}
+	impl.comms = testutil.NewPermissioningComms(t)
+
+	// Register
+	client := testutil.NewClient(t)
+	app := constants.MessengerAndroid.String()
+	token := "integration-token"
+	if err = impl.RegisterToken(client.RegisterTokenRequest(t, token, app, time.Now())); err != nil {
+		t.Fatalf("Failed to register token: %+v", err)
+	}
+	iid, err := ephemeral.GetIntermediaryId(id.NewIdFromString("integration", id.User, t))
+	if err != nil {
+		t.Fatalf("Failed to get intermediary ID: %+v", err)
+	}
+	if err = impl.RegisterTrackedID(client.RegisterTrackedIDRequest(t, [][]byte{iid}, time.Now())); err != nil {
+		t.Fatalf("Failed to register tracked ID: %+v", err)
+	}
+	if _, err = s.GetToken(token, app); err != nil {
+		t.Fatalf("Registered token not in storage: %+v", err)
+	}
+	eph, err := s.GetLatestEphemeral()
+	if err != nil {
+		t.Fatalf("No ephemeral ID generated for tracked ID: %+v", err)
+	}
+
+	// A gateway pushes a batch for the client's ephemeral ID
+	gwID, err := id.NewRandomID(crand.Reader, id.Gateway)
+	if err != nil {
+		t.Fatalf("Failed to generate gateway ID: %+v", err)
+	}
+	gw := gateway.StartGateway(gwID, freeAddress(t), gateway.NewImplementation(), nil, nil,
+		gossip.DefaultManagerFlags())
+	defer gw.Shutdown()
+	hostParams := connect.GetDefaultHostParams()
+	hostParams.AuthEnabled = false
+	botHost, err := gw.AddHost(&id.NotificationBot, botAddress, testutil.ReadFile(t, testutil.PermissioningCert), hostParams)
+	if err != nil {
+		t.Fatalf("Failed to add bot host: %+v", err)
+	}
+	if err = gw.SendNotificationBatch(botHost, testutil.NotificationBatch(1, eph.EphemeralId)); err != nil {
+		t.Fatalf("Failed to send notification batch: %+v", err)
+	}
+
+	push := fcm.next(t)
+	if push.Message.Token != token {
+		t.Errorf("Push sent to %q, expected %q", push.Message.Token, token)
+	}
+	if push.Message.Data["notificationsTag"] == "" || push.Message.Data[constants.NotificationsCountTag] != "1" {
+		t.Errorf("Push did not carry the notification: %+v", push.Message.Data)
+	}
+	trsaHash, err := storage.HashTransmissionRSA(client.TransmissionRsaPem)
+	if err != nil {
+		t.Fatalf("Failed to hash transmission RSA: %+v", err)
+	}
+	logs, err := s.GetDeliveryLogs(trsaHash)
+	if err != nil || len(logs) == 0 {
+		t.Errorf("Delivery was not logged: %+v %+v", logs, err)
+	}
+
+	// Unregister; later batches are not pushed
+	if err = impl.UnregisterToken(client.UnregisterTokenRequest(t, token, app, time.Now())); err != nil {
+		t.Fatalf("Failed to unregister token: %+v", err)
+	}
+	if _, err = s.GetToken(token, app); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("Unregistered token still in storage: %+v", err)
+	}
+	if err = gw.SendNotificationBatch(botHost, testutil.NotificationBatch(2, eph.EphemeralId)); err != nil {
+		t.Fatalf("Failed to send notification batch: %+v", err)
+	}
+	fcm.none(t, 3*time.Second)
+}
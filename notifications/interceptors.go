@@ -0,0 +1,161 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// The gRPC server is owned by the comms library, so the interceptor chain is
+// applied by wrapping each handler registered in NewImplementation: panics are
+// recovered, and every RPC is logged with its peer and timed.
+
+package notifications
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gitlab.com/xx_network/comms/connect"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rpcLatencyBuckets are the upper bounds in seconds of the RPC latency
+// histogram buckets.
+var rpcLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// rpcStat holds the latency histogram and outcome counts of an RPC.
+type rpcStat struct {
+	buckets []uint64
+	sum     float64
+	count   uint64
+	errors  uint64
+	panics  uint64
+}
+
+// rpcMetrics holds the stats of each RPC by name.
+type rpcMetrics struct {
+	mux  sync.Mutex
+	rpcs map[string]*rpcStat
+}
+
+// observe records a handled RPC.
+func (m *rpcMetrics) observe(rpc string, elapsed time.Duration, failed, panicked bool) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if m.rpcs == nil {
+		m.rpcs = make(map[string]*rpcStat)
+	}
+	s, ok := m.rpcs[rpc]
+	if !ok {
+		s = &rpcStat{buckets: make([]uint64, len(rpcLatencyBuckets))}
+		m.rpcs[rpc] = s
+	}
+	seconds := elapsed.Seconds()
+	for i, bound := range rpcLatencyBuckets {
+		if seconds <= bound {
+			s.buckets[i]++
+		}
+	}
+	s.sum += seconds
+	s.count++
+	if failed {
+		s.errors++
+	}
+	if panicked {
+		s.panics++
+	}
+}
+
+// format renders the RPC stats as Prometheus metrics.
+func (m *rpcMetrics) format() string {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if len(m.rpcs) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(m.rpcs))
+	for name := range m.rpcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("# HELP notifications_rpc_duration_seconds Time taken to handle RPCs.\n" +
+		"# TYPE notifications_rpc_duration_seconds histogram\n")
+	for _, name := range names {
+		s := m.rpcs[name]
+		for i, bound := range rpcLatencyBuckets {
+			fmt.Fprintf(&b, "notifications_rpc_duration_seconds_bucket{rpc=%q,le=\"%g\"} %d\n", name, bound, s.buckets[i])
+		}
+		fmt.Fprintf(&b, "notifications_rpc_duration_seconds_bucket{rpc=%q,le=\"+Inf\"} %d\n", name, s.count)
+		fmt.Fprintf(&b, "notifications_rpc_duration_seconds_sum{rpc=%q} %g\n", name, s.sum)
+		fmt.Fprintf(&b, "notifications_rpc_duration_seconds_count{rpc=%q} %d\n", name, s.count)
+	}
+	b.WriteString("# HELP notifications_rpc_errors_total RPCs which returned an error, including panics.\n" +
+		"# TYPE notifications_rpc_errors_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "notifications_rpc_errors_total{rpc=%q} %d\n", name, m.rpcs[name].errors)
+	}
+	b.WriteString("# HELP notifications_rpc_panics_total RPCs whose handler panicked.\n" +
+		"# TYPE notifications_rpc_panics_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "notifications_rpc_panics_total{rpc=%q} %d\n", name, m.rpcs[name].panics)
+	}
+	return b.String()
+}
+
+// intercept runs the handler of an RPC from the passed in peer. A panic in the
+// handler is recovered and returned to the caller as an error, so one bad
+// request cannot crash the bot. Every RPC is timed and logged.
+func (nb *Impl) intercept(rpc, peer string, handler func() error) (err error) {
+	start := time.Now()
+	panicked := false
+	defer func() {
+		if r := recover(); r != nil {
+			panicked = true
+			jww.ERROR.Printf("Recovered from panic handling %s from %s: %v\n%s", rpc, peer, r, debug.Stack())
+			err = errors.Errorf("Internal error handling %s", rpc)
+		}
+		elapsed := time.Since(start)
+		nb.rpcs.observe(rpc, elapsed, err != nil, panicked)
+		if err != nil {
+			jww.WARN.Printf("rpc=%s peer=%s duration=%s result=error panic=%t error=%q",
+				rpc, peer, elapsed, panicked, err.Error())
+		} else {
+			jww.DEBUG.Printf("rpc=%s peer=%s duration=%s result=ok", rpc, peer, elapsed)
+		}
+	}()
+	return handler()
+}
+
+// gatewayPeer identifies the gateway which sent an RPC, and whether it
+// authenticated.
+func gatewayPeer(auth *connect.Auth) string {
+	sender := batchSender(auth)
+	if sender == "" {
+		return "unknown-gateway"
+	}
+	if !auth.IsAuthenticated {
+		return sender + "(unauthenticated)"
+	}
+	return sender
+}
+
+// clientPeer identifies the client which sent an RPC by a prefix of its
+// transmission RSA hash, so logs can be correlated without revealing the key.
+func clientPeer(transmissionRSA []byte) string {
+	if len(transmissionRSA) == 0 {
+		return "unknown-client"
+	}
+	h, err := storage.HashTransmissionRSA(transmissionRSA)
+	if err != nil {
+		return "unknown-client"
+	}
+	return "trsa:" + base64.RawStdEncoding.EncodeToString(h[:8])
+}
@@ -0,0 +1,57 @@
+package notifications
+
+import (
+	"github.com/pkg/errors"
+	"strings"
+	"testing"
+)
+
+// Tests that a panicking handler is returned as an error rather than crashing
+// the bot, and that every RPC is counted in the metrics.
+func TestImpl_intercept(t *testing.T) {
+	impl := &Impl{}
+	err := impl.intercept("RegisterToken", "peer", func() error {
+		var m map[string]int
+		m["crash"] = 1
+		return nil
+	})
+	if err == nil {
+		t.Fatalf("Panicking handler should return an error")
+	}
+	if err = impl.intercept("RegisterToken", "peer", func() error { return nil }); err != nil {
+		t.Errorf("Unexpected error: %+v", err)
+	}
+	expected := errors.New("rejected")
+	if err = impl.intercept("ReceiveNotificationBatch", "peer", func() error { return expected }); err != expected {
+		t.Errorf("Handler error should be returned unchanged, got %+v", err)
+	}
+
+	metrics := impl.rpcs.format()
+	for _, line := range []string{
+		`notifications_rpc_duration_seconds_count{rpc="RegisterToken"} 2`,
+		`notifications_rpc_duration_seconds_bucket{rpc="RegisterToken",le="+Inf"} 2`,
+		`notifications_rpc_errors_total{rpc="RegisterToken"} 1`,
+		`notifications_rpc_panics_total{rpc="RegisterToken"} 1`,
+		`notifications_rpc_errors_total{rpc="ReceiveNotificationBatch"} 1`,
+		`notifications_rpc_panics_total{rpc="ReceiveNotificationBatch"} 0`,
+	} {
+		if !strings.Contains(metrics, line) {
+			t.Errorf("Metrics missing %q:\n%s", line, metrics)
+		}
+	}
+}
+
+// Tests that clients are identified without logging their key.
+func Test_clientPeer(t *testing.T) {
+	key := []byte("-----BEGIN PUBLIC KEY-----")
+	peer := clientPeer(key)
+	if !strings.HasPrefix(peer, "trsa:") || strings.Contains(peer, string(key)) {
+		t.Errorf("Unexpected peer %q", peer)
+	}
+	if peer != clientPeer(key) {
+		t.Errorf("Peer of a key should be stable")
+	}
+	if clientPeer(nil) != "unknown-client" {
+		t.Errorf("Missing key should give an unknown client")
+	}
+}
@@ -0,0 +1,216 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Rotating the bot's certificate and key has a grace period while the NDF
+// gateways and clients hold still has the old certificate. Until it ends the
+// bot keeps its comms identity, and receipts and attestations are signed with
+// the old key, which running clients verify against, as well as the new one,
+// which clients can start trusting. When it ends the comms are re-registered
+// with the new certificate and only the new key signs.
+
+package notifications
+
+import (
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/comms/network"
+	"gitlab.com/elixxir/comms/notificationBot"
+	"gitlab.com/elixxir/crypto/hash"
+	"gitlab.com/xx_network/comms/connect"
+	"gitlab.com/xx_network/crypto/csprng"
+	"gitlab.com/xx_network/crypto/signature/rsa"
+	"gitlab.com/xx_network/primitives/id"
+	"gitlab.com/xx_network/primitives/utils"
+	"time"
+)
+
+// KeyRotationParams configures rotating the bot's certificate and key. The
+// new ones are configured as CertPath and KeyPath, and the ones being rotated
+// out here.
+type KeyRotationParams struct {
+	PreviousCertPath string
+	PreviousKeyPath  string
+	// GraceUntil is when the previous certificate and key stop being used
+	GraceUntil time.Time
+}
+
+// keyRotation holds the certificate and key being rotated out.
+type keyRotation struct {
+	certificate []byte
+	keyPem      []byte
+	key         *rsa.PrivateKey
+	graceUntil  time.Time
+}
+
+// loadKeyRotation reads the previous certificate and key; it returns nil if
+// no rotation is configured or its grace period has passed.
+func loadKeyRotation(params KeyRotationParams, now time.Time) (*keyRotation, error) {
+	if params.PreviousKeyPath == "" {
+		return nil, nil
+	}
+	if !now.Before(params.GraceUntil) {
+		jww.INFO.Printf("Key rotation grace period ended at %s, ignoring the previous key", params.GraceUntil)
+		return nil, nil
+	}
+	r := &keyRotation{graceUntil: params.GraceUntil}
+	var err error
+	r.keyPem, err = utils.ReadFile(params.PreviousKeyPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read previous key at %+v", params.PreviousKeyPath)
+	}
+	r.key, err = rsa.LoadPrivateKeyFromPem(r.keyPem)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to load previous private key")
+	}
+	if params.PreviousCertPath != "" {
+		r.certificate, err = utils.ReadFile(params.PreviousCertPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read previous certificate at %+v", params.PreviousCertPath)
+		}
+	}
+	return r, nil
+}
+
+// inGrace returns true if the previous key is still in use at now.
+func (r *keyRotation) inGrace(now time.Time) bool {
+	return r != nil && now.Before(r.graceUntil)
+}
+
+// signingKeys returns the key clients verify the bot's signatures against,
+// and during a rotation's grace period the new key which signs as well.
+func (nb *Impl) signingKeys() (current, next *rsa.PrivateKey) {
+	if nb.rotation.inGrace(nb.now()) {
+		return nb.rotation.key, nb.signingKey
+	}
+	return nb.signingKey, nil
+}
+
+// currentCertificate returns the bot's certificate in the NDF, which is the
+// previous one during a rotation's grace period.
+func (nb *Impl) currentCertificate() []byte {
+	if nb.rotation.inGrace(nb.now()) {
+		return nb.rotation.certificate
+	}
+	return nb.certificate
+}
+
+// sign signs digest with the bot's signing keys; next is nil outside of a
+// rotation's grace period.
+func (nb *Impl) sign(digest []byte) (sig, next []byte, err error) {
+	current, nextKey := nb.signingKeys()
+	if current == nil {
+		return nil, nil, errors.New("bot is running without a key")
+	}
+	sig, err = rsa.Sign(csprng.NewSystemRNG(), current, hash.CMixHash, digest, nil)
+	if err != nil || nextKey == nil {
+		return sig, nil, err
+	}
+	next, err = rsa.Sign(csprng.NewSystemRNG(), nextKey, hash.CMixHash, digest, nil)
+	return sig, next, err
+}
+
+// verifyEither checks digest against key using sig, or next if it is set.
+func verifyEither(key *rsa.PublicKey, digest, sig, next []byte) error {
+	err := rsa.Verify(key, hash.CMixHash, digest, sig, nil)
+	if err != nil && len(next) > 0 {
+		err = rsa.Verify(key, hash.CMixHash, digest, next, nil)
+	}
+	return err
+}
+
+// permissioningHost is how the permissioning server is reached, kept so the
+// host can be added again when the comms are re-registered.
+type permissioningHost struct {
+	address string
+	cert    []byte
+	params  connect.HostParams
+}
+
+// AddPermissioningHost adds the host of the permissioning server the bot
+// polls for the NDF.
+func (nb *Impl) AddPermissioningHost(address string, cert []byte, params connect.HostParams) error {
+	_, err := nb.server().AddHost(&id.Permissioning, address, cert, params)
+	if err != nil {
+		return err
+	}
+	nb.permissioning = &permissioningHost{address: address, cert: cert, params: params}
+	return nil
+}
+
+// server returns the bot's comms.
+func (nb *Impl) server() *notificationBot.Comms {
+	nb.commsMux.RLock()
+	defer nb.commsMux.RUnlock()
+	return nb.Comms
+}
+
+// instance returns the network instance holding the NDF.
+func (nb *Impl) instance() *network.Instance {
+	nb.commsMux.RLock()
+	defer nb.commsMux.RUnlock()
+	return nb.inst
+}
+
+// KeyRotator is a long-running thread which re-registers the bot's comms with
+// its new certificate once a key rotation's grace period ends.
+func (nb *Impl) KeyRotator() {
+	if !nb.rotation.inGrace(nb.now()) {
+		return
+	}
+	jww.INFO.Printf("Serving the previous certificate until %s", nb.rotation.graceUntil)
+	timer := time.NewTimer(nb.rotation.graceUntil.Sub(nb.now()))
+	defer timer.Stop()
+	select {
+	case <-nb.context().Done():
+		return
+	case <-timer.C:
+	}
+	if err := nb.reregisterComms(); err != nil {
+		jww.FATAL.Panicf("Failed to re-register comms with the new certificate: %+v", err)
+	}
+	jww.INFO.Printf("Key rotation complete, comms re-registered with the new certificate")
+}
+
+// reregisterComms replaces the comms server and network instance with ones
+// using the bot's new certificate and key, carrying over the current NDF.
+func (nb *Impl) reregisterComms() error {
+	if nb.startComms == nil {
+		return errors.New("comms were not started by the bot")
+	}
+	partial := nb.instance().GetPartialNdf().Get()
+	if nb.ndfStopper != nil && !nb.ndfStopper(5*time.Second) {
+		return errors.New("Failed to stop NDF tracking")
+	}
+	nb.server().Shutdown()
+
+	comms := nb.startComms(nb.certificate, nb.keyPem)
+	if nb.permissioning != nil {
+		_, err := comms.AddHost(&id.Permissioning, nb.permissioning.address, nb.permissioning.cert,
+			nb.permissioning.params)
+		if err != nil {
+			return errors.WithMessage(err, "Failed to add permissioning host")
+		}
+	}
+	inst, err := network.NewInstance(comms.ProtoComms, partial, nil, nil, network.None, false)
+	if err != nil {
+		return errors.WithMessage(err, "Failed to start instance")
+	}
+	inst.SetGatewayAuthentication()
+
+	nb.commsMux.Lock()
+	nb.Comms = comms
+	nb.inst = inst
+	nb.commsMux.Unlock()
+
+	nb.overrideGatewayAddresses(partial)
+	err = inst.UpdateGatewayConnections()
+	if err != nil {
+		return errors.WithMessage(err, "Failed to update gateway connections")
+	}
+	nb.TrackNdf()
+	return nil
+}
@@ -0,0 +1,72 @@
+package notifications
+
+import (
+	"gitlab.com/elixxir/notifications-bot/clock"
+	"gitlab.com/elixxir/notifications-bot/testutil"
+	"gitlab.com/xx_network/crypto/csprng"
+	"gitlab.com/xx_network/crypto/signature/rsa"
+	"testing"
+	"time"
+)
+
+// Tests that during a key rotation's grace period receipts and attestations
+// verify against both the previous and the new key, and afterwards only
+// against the new one.
+func TestImpl_sign_KeyRotation(t *testing.T) {
+	previous := testutil.LoadPermissioningKey(t)
+	key, err := rsa.GenerateKey(csprng.NewSystemRNG(), 1024)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %+v", err)
+	}
+	now := time.Unix(1700000000, 0)
+	fake := clock.NewFake(now)
+	impl := &Impl{
+		signingKey:  key,
+		certificate: []byte("new"),
+		receiptTTL:  time.Hour,
+		clock:       fake,
+		rotation: &keyRotation{
+			certificate: []byte("previous"),
+			key:         previous,
+			graceUntil:  now.Add(time.Minute),
+		},
+	}
+
+	receipt, err := impl.signReceipt(TokenReceipt, TokenSubject("token"), []byte("trsa"))
+	if err != nil {
+		t.Fatalf("Failed to sign receipt: %+v", err)
+	}
+	for name, pub := range map[string]*rsa.PublicKey{"previous": previous.GetPublic(), "new": key.GetPublic()} {
+		if err = receipt.Verify(pub, now); err != nil {
+			t.Errorf("Receipt should verify against the %s key during the grace period: %+v", name, err)
+		}
+	}
+	a, err := impl.Attestation()
+	if err != nil {
+		t.Fatalf("Failed to sign attestation: %+v", err)
+	}
+	if a.Certificate != "previous" {
+		t.Errorf("Attestation should carry the previous certificate, got %q", a.Certificate)
+	}
+	if err = a.Verify(previous.GetPublic()); err != nil {
+		t.Errorf("Attestation should verify against the previous key: %+v", err)
+	}
+	if err = a.Verify(key.GetPublic()); err != nil {
+		t.Errorf("Attestation should verify against the new key: %+v", err)
+	}
+
+	fake.Advance(2 * time.Minute)
+	receipt, err = impl.signReceipt(TokenReceipt, TokenSubject("token"), []byte("trsa"))
+	if err != nil {
+		t.Fatalf("Failed to sign receipt: %+v", err)
+	}
+	if receipt.NextSignature != nil {
+		t.Errorf("Receipts should only be signed once after the grace period")
+	}
+	if err = receipt.Verify(previous.GetPublic(), fake.Now()); err == nil {
+		t.Errorf("Receipt should not verify against the previous key after the grace period")
+	}
+	if err = receipt.Verify(key.GetPublic(), fake.Now()); err != nil {
+		t.Errorf("Receipt should verify against the new key: %+v", err)
+	}
+}
@@ -13,11 +13,10 @@ import (
 	"gitlab.com/elixxir/crypto/hash"
 	"gitlab.com/elixxir/crypto/registration"
 	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/elixxir/notifications-bot/errs"
+	"gitlab.com/elixxir/notifications-bot/storage"
 	"gitlab.com/xx_network/crypto/signature/rsa"
 	"gitlab.com/xx_network/primitives/id"
-	"gitlab.com/xx_network/primitives/id/ephemeral"
-	"strings"
-	"time"
 )
 
 // RegisterForNotifications is called by the client, and adds a user registration to our database
@@ -29,14 +28,9 @@ func (nb *Impl) RegisterForNotifications(request *pb.NotificationRegisterRequest
 	}
 
 	// Verify permissioning RSA signature
-	permHost, ok := nb.Comms.GetHost(&id.Permissioning)
-	if !ok {
-		return errors.New("Could not find permissioning host to verify client signature")
-	}
-	err = registration.VerifyWithTimestamp(permHost.GetPubKey(), request.RegistrationTimestamp,
-		string(request.TransmissionRsa), request.TransmissionRsaSig)
+	err = nb.verifyRegistrar(request.RegistrationTimestamp, request.TransmissionRsa, request.TransmissionRsaSig)
 	if err != nil {
-		return errors.WithMessage(err, "Failed to verify perm sig with timestamp")
+		return errs.Mark(errors.WithMessage(err, "Failed to verify perm sig with timestamp"), errs.ErrInvalidSignature)
 	}
 
 	// Verify IID transmission RSA signature
@@ -54,23 +48,24 @@ func (nb *Impl) RegisterForNotifications(request *pb.NotificationRegisterRequest
 	}
 	err = rsa.Verify(pub, hash.CMixHash, h.Sum(nil), request.IIDTransmissionRsaSig, nil)
 	if err != nil {
-		return errors.Wrap(err, "Failed to verify IID signature from client")
+		return errs.Mark(errors.Wrap(err, "Failed to verify IID signature from client"), errs.ErrInvalidSignature)
+	}
+
+	err = nb.checkBlocked(request.TransmissionRsa)
+	if err != nil {
+		return err
 	}
 
 	// Add the user to storage
-	_, epoch := ephemeral.HandleQuantization(time.Now())
+	_, epoch := nb.quantize(nb.now())
 
-	var app string
-	if strings.Contains(request.Token, ":") {
-		app = constants.MessengerAndroid.String()
-	} else {
-		app = constants.MessengerIOS.String()
-	}
+	app := constants.LegacyApp(request.Token).String()
 
-	_, err = nb.Storage.RegisterForNotifications(request.IntermediaryId, request.TransmissionRsa, request.Token, app, epoch, nb.inst.GetPartialNdf().Get().AddressSpace[0].Size)
+	_, err = nb.Storage.RegisterForNotifications(request.IntermediaryId, request.TransmissionRsa, request.Token, app, epoch, nb.instance().GetPartialNdf().Get().AddressSpace[0].Size)
 	if err != nil {
 		return errors.Wrap(err, "Failed to register user with notifications")
 	}
+	nb.publishRegistration(app, request.TransmissionRsa)
 
 	return nil
 }
@@ -91,22 +86,35 @@ func (nb *Impl) UnregisterForNotifications(request *pb.NotificationUnregisterReq
 		return errors.WithMessagef(err, "Failed to find user with intermediary ID %+v", request.IntermediaryId)
 	}
 
-	// Get the user by identity
-	// Error if the identity has more than one registered user
-	if len(ident.Users) != 1 {
-		return errors.Errorf("Cannot legacy unregister an IID with more than one active user")
+	// The legacy request does not say which user it is from, so find the
+	// user whose key signed it. Users migrated from the original schema have
+	// no key
+	var u *storage.User
+	for i := range ident.Users {
+		candidate := &ident.Users[i]
+		if candidate.LegacyV0 {
+			continue
+		}
+		pub, err := rsa.LoadPublicKeyFromPem(candidate.TransmissionRSA)
+		if err != nil {
+			return errors.WithMessage(err, "Failed to load public key from database")
+		}
+		if rsa.Verify(pub, hash.CMixHash, h.Sum(nil), request.IIDTransmissionRsaSig, nil) == nil {
+			u = candidate
+			break
+		}
+	}
+	if u == nil {
+		return errors.WithMessage(errs.ErrInvalidSignature, "Failed to verify IID signature from client")
 	}
-	u := ident.Users[0]
 
-	pub, err := rsa.LoadPublicKeyFromPem(u.TransmissionRSA)
-	if err != nil {
-		return errors.WithMessage(err, "Failed to load public key from database")
-	}
-	err = rsa.Verify(pub, hash.CMixHash, h.Sum(nil), request.IIDTransmissionRsaSig, nil)
-	if err != nil {
-		return errors.Wrap(err, "Failed to verify IID signature from client")
+	if len(ident.Users) == 1 {
+		err = nb.Storage.LegacyUnregister(request.IntermediaryId)
+	} else {
+		// Other users track the ID through the signed protocol, so only
+		// stop this user tracking it
+		err = nb.Storage.UnregisterTrackedIDs([][]byte{request.IntermediaryId}, u.TransmissionRSA)
 	}
-	err = nb.Storage.LegacyUnregister(request.IntermediaryId)
 	if err != nil {
 		return errors.Wrap(err, "Failed to unregister user with notifications")
 	}
@@ -0,0 +1,160 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package notifications
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/elixxir/notifications-bot/notifications/providers"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"golang.org/x/time/rate"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// adaptInterval is the minimum time between adjustments of a provider's
+	// send rate, so a burst of quota errors only slows sends once
+	adaptInterval = time.Second
+	// minRateFraction is the lowest fraction of the configured rate sends
+	// are slowed to when quota errors are observed
+	minRateFraction = 1.0 / 16
+	// recoveryFraction of the configured rate is restored every
+	// adaptInterval while sends succeed
+	recoveryFraction = 0.1
+)
+
+// ProviderLimits bounds the sends made through a provider.
+type ProviderLimits struct {
+	// Rate is the maximum sends per second; unlimited if 0
+	Rate float64 `mapstructure:"rate"`
+	// Concurrency is the maximum sends in flight; unlimited if 0
+	Concurrency int `mapstructure:"concurrency"`
+}
+
+// limitedProvider wraps a provider, bounding the rate and concurrency of its
+// sends. The rate is halved when the provider reports its quota was exceeded
+// and gradually restored while sends succeed.
+type limitedProvider struct {
+	providers.Provider
+	app     string
+	sem     chan struct{}
+	limiter *rate.Limiter
+	// tenant is set on the providers of a tenant, whose sends also wait for
+	// the tenant's rate limit and are counted for it
+	tenant *tenant
+
+	// configured is the rate set in the config and lastAdapt the time the
+	// limiter's rate was last changed
+	configured float64
+	lastAdapt  time.Time
+	mux        sync.Mutex
+}
+
+// newLimitedProvider wraps p with the passed in limits.
+func newLimitedProvider(app string, p providers.Provider, limits ProviderLimits) *limitedProvider {
+	lp := &limitedProvider{Provider: p, app: app, configured: limits.Rate}
+	if limits.Concurrency > 0 {
+		lp.sem = make(chan struct{}, limits.Concurrency)
+	}
+	if limits.Rate > 0 {
+		lp.limiter = rate.NewLimiter(rate.Limit(limits.Rate), int(math.Max(1, limits.Rate/10)))
+	}
+	return lp
+}
+
+// Notify waits for a free send slot and passes the send to the provider.
+func (lp *limitedProvider) Notify(ctx context.Context, csv string, target storage.GTNResult) (providers.Receipt, bool, error) {
+	if lp.sem != nil {
+		select {
+		case lp.sem <- struct{}{}:
+			defer func() { <-lp.sem }()
+		case <-ctx.Done():
+			return providers.Receipt{}, true, errors.WithMessagef(ctx.Err(), "Send to %s abandoned waiting for a free connection", lp.app)
+		}
+	}
+	if lp.limiter != nil {
+		if err := lp.limiter.Wait(ctx); err != nil {
+			return providers.Receipt{}, true, errors.WithMessagef(err, "Send to %s abandoned waiting for rate limit", lp.app)
+		}
+	}
+	if lp.tenant != nil && lp.tenant.limiter != nil {
+		if err := lp.tenant.limiter.Wait(ctx); err != nil {
+			return providers.Receipt{}, true, errors.WithMessagef(err, "Send to %s abandoned waiting for tenant rate limit", lp.app)
+		}
+	}
+	receipt, tokenValid, err := lp.Provider.Notify(ctx, csv, target)
+	lp.adapt(err, time.Now())
+	if lp.tenant != nil {
+		lp.tenant.count(err)
+	}
+	return receipt, tokenValid, err
+}
+
+// MaxCSV returns the payload limit of the wrapped provider, if it has one.
+func (lp *limitedProvider) MaxCSV(target storage.GTNResult) int {
+	if pl, ok := lp.Provider.(providers.PayloadLimiter); ok {
+		return pl.MaxCSV(target)
+	}
+	return math.MaxInt
+}
+
+// adapt halves the send rate if sendErr reports the provider's quota was
+// exceeded, or restores part of the configured rate after a successful send.
+// The rate is changed at most once every adaptInterval.
+func (lp *limitedProvider) adapt(sendErr error, now time.Time) {
+	if lp.limiter == nil {
+		return
+	}
+	quotaExceeded := errors.Is(sendErr, providers.ErrQuotaExceeded)
+	if sendErr != nil && !quotaExceeded {
+		return
+	}
+
+	lp.mux.Lock()
+	defer lp.mux.Unlock()
+	if now.Sub(lp.lastAdapt) < adaptInterval {
+		return
+	}
+	current := float64(lp.limiter.Limit())
+	if quotaExceeded {
+		slowed := math.Max(current/2, lp.configured*minRateFraction)
+		if slowed < current {
+			jww.WARN.Printf("%s quota exceeded, slowing sends to %.1f/s", lp.app, slowed)
+			lp.limiter.SetLimitAt(now, rate.Limit(slowed))
+			lp.lastAdapt = now
+		}
+		return
+	}
+	if current < lp.configured {
+		restored := math.Min(current+lp.configured*recoveryFraction, lp.configured)
+		lp.limiter.SetLimitAt(now, rate.Limit(restored))
+		lp.lastAdapt = now
+		if restored == lp.configured {
+			jww.INFO.Printf("%s send rate restored to %.1f/s", lp.app, restored)
+		}
+	}
+}
+
+// limitProviders wraps the provider of each app with the limits configured for
+// its push service. Apps sharing a push service are limited separately, as
+// they use separate credentials and quotas.
+func (nb *Impl) limitProviders(limits map[string]ProviderLimits) {
+	for _, app := range constants.Apps {
+		p := nb.providers[app.String()]
+		l, ok := limits[app.Provider()]
+		if p == nil || !ok || (l.Rate <= 0 && l.Concurrency <= 0) {
+			continue
+		}
+		jww.INFO.Printf("Limiting %s sends to %.1f/s with %d in flight", app, l.Rate, l.Concurrency)
+		nb.providers[app.String()] = newLimitedProvider(app.String(), p, l)
+	}
+}
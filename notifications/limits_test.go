@@ -0,0 +1,99 @@
+package notifications
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/notifications-bot/notifications/providers"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// concurrencyProvider records the most sends it had in flight at once.
+type concurrencyProvider struct {
+	inFlight, max int32
+}
+
+func (cp *concurrencyProvider) Notify(_ context.Context, _ string, _ storage.GTNResult) (providers.Receipt, bool, error) {
+	n := atomic.AddInt32(&cp.inFlight, 1)
+	for {
+		max := atomic.LoadInt32(&cp.max)
+		if n <= max || atomic.CompareAndSwapInt32(&cp.max, max, n) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	atomic.AddInt32(&cp.inFlight, -1)
+	return providers.Receipt{}, true, nil
+}
+
+// quotaProvider fails every send with providers.ErrQuotaExceeded.
+type quotaProvider struct{}
+
+func (quotaProvider) Notify(_ context.Context, _ string, _ storage.GTNResult) (providers.Receipt, bool, error) {
+	return providers.Receipt{}, true, errors.WithMessage(providers.ErrQuotaExceeded, "429")
+}
+
+// Tests that a limited provider never has more sends in flight than its
+// concurrency limit.
+func TestLimitedProvider_Concurrency(t *testing.T) {
+	cp := &concurrencyProvider{}
+	lp := newLimitedProvider("app", cp, ProviderLimits{Concurrency: 2})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := lp.Notify(context.Background(), "csv", storage.GTNResult{}); err != nil {
+				t.Errorf("Send failed: %+v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if cp.max != 2 {
+		t.Errorf("Expected at most %d sends in flight, saw %d", 2, cp.max)
+	}
+}
+
+// Tests that quota errors halve the send rate down to its floor at most once
+// per interval, and that successful sends restore it.
+func TestLimitedProvider_adapt(t *testing.T) {
+	lp := newLimitedProvider("app", quotaProvider{}, ProviderLimits{Rate: 100})
+
+	_, _, err := lp.Notify(context.Background(), "csv", storage.GTNResult{})
+	if !errors.Is(err, providers.ErrQuotaExceeded) {
+		t.Fatalf("Expected quota error, received %+v", err)
+	}
+	if limit := float64(lp.limiter.Limit()); limit != 50 {
+		t.Fatalf("Rate should be halved after a quota error, is %f", limit)
+	}
+	now := lp.lastAdapt
+	lp.adapt(providers.ErrQuotaExceeded, now.Add(adaptInterval/2))
+	if limit := float64(lp.limiter.Limit()); limit != 50 {
+		t.Errorf("Rate should not change again within the adapt interval, is %f", limit)
+	}
+
+	for i := 1; i <= 10; i++ {
+		now = now.Add(adaptInterval)
+		lp.adapt(providers.ErrQuotaExceeded, now)
+	}
+	if limit := float64(lp.limiter.Limit()); limit != 100*minRateFraction {
+		t.Errorf("Rate should not drop below %f, is %f", 100*minRateFraction, limit)
+	}
+
+	now = now.Add(adaptInterval)
+	lp.adapt(nil, now)
+	if limit := float64(lp.limiter.Limit()); limit != 100*minRateFraction+10 {
+		t.Errorf("Successful send should restore part of the rate, is %f", limit)
+	}
+	for i := 0; i < 20; i++ {
+		now = now.Add(adaptInterval)
+		lp.adapt(nil, now)
+	}
+	if limit := float64(lp.limiter.Limit()); limit != 100 {
+		t.Errorf("Rate should be restored to %d, is %f", 100, limit)
+	}
+}
@@ -0,0 +1,79 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package notifications
+
+import (
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// unixPrefix marks a listening address as the path of a unix socket.
+const unixPrefix = "unix:"
+
+// unixSocketMode restricts unix sockets to the bot's user and group.
+const unixSocketMode = 0660
+
+// listen opens a listener on the passed in address, which is either a TCP
+// host:port or a unix socket path prefixed with "unix:". A stale socket left
+// at the path by a previous run is removed.
+func listen(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, unixPrefix) {
+		return net.Listen("tcp", address)
+	}
+	path := strings.TrimPrefix(address, unixPrefix)
+	if path == "" {
+		return nil, errors.New("unix socket address has no path")
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, errors.Errorf("%s exists and is not a socket", path)
+		}
+		if err = os.Remove(path); err != nil {
+			return nil, errors.WithMessagef(err, "Failed to remove stale socket %s", path)
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(path, unixSocketMode); err != nil {
+		_ = l.Close()
+		return nil, errors.WithMessagef(err, "Failed to set permissions of socket %s", path)
+	}
+	return l, nil
+}
+
+// serveHTTP serves handler on the passed in address in a new thread, logging
+// under the passed in name.
+func serveHTTP(name, address string, handler http.Handler) {
+	l, err := listen(address)
+	if err != nil {
+		jww.ERROR.Printf("Failed to listen for %s on %s: %+v", name, address, err)
+		return
+	}
+	go func() {
+		jww.INFO.Printf("Serving %s on %s", name, address)
+		err := http.Serve(l, handler)
+		if err != nil {
+			jww.ERROR.Printf("Failed to serve %s: %+v", name, err)
+		}
+	}()
+}
+
+// startMetrics serves the metrics endpoint without authentication on the
+// passed in address, so it can be scraped from a separate, restricted
+// interface.
+func (nb *Impl) startMetrics(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", nb.handleMetrics)
+	serveHTTP("metrics", address, mux)
+}
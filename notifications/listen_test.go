@@ -0,0 +1,45 @@
+package notifications
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Tests that listen opens unix sockets, replacing a stale socket but refusing
+// to remove any other file.
+func Test_listen_Unix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	l, err := listen(unixPrefix + path)
+	if err != nil {
+		t.Fatalf("Failed to listen on unix socket: %+v", err)
+	}
+	if l.Addr().Network() != "unix" {
+		t.Errorf("Expected unix listener, got %s", l.Addr().Network())
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat socket: %+v", err)
+	}
+	if fi.Mode().Perm() != unixSocketMode {
+		t.Errorf("Expected socket permissions %o, got %o", unixSocketMode, fi.Mode().Perm())
+	}
+
+	// Leave the socket behind as a crashed process would
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = l.Close()
+	l, err = listen(unixPrefix + path)
+	if err != nil {
+		t.Fatalf("Failed to replace stale socket: %+v", err)
+	}
+	_ = l.Close()
+
+	file := filepath.Join(t.TempDir(), "file")
+	if err = os.WriteFile(file, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = listen(unixPrefix + file); err == nil {
+		t.Errorf("Listening should not replace a regular file")
+	}
+}
@@ -0,0 +1,198 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Maintenance mode: notification batches from gateways are persisted instead
+// of sent, then released to the sender a few rounds at a time once
+// maintenance ends.
+
+package notifications
+
+import (
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gitlab.com/elixxir/primitives/notifications"
+	"gitlab.com/xx_network/primitives/id"
+	"gorm.io/gorm"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const maintenanceStateKey = "maintenanceMode"
+
+// inMaintenance returns true if sends are currently paused.
+func (nb *Impl) inMaintenance() bool {
+	return atomic.LoadUint32(&nb.maintenance) == 1
+}
+
+// SetMaintenance enters or exits maintenance mode. While in maintenance,
+// received notifications are persisted and nothing is sent. On exit, queued
+// notifications are released to the sender at a limited rate.
+func (nb *Impl) SetMaintenance(enabled bool) error {
+	err := nb.Storage.UpsertState(&storage.State{Key: maintenanceStateKey, Value: strconv.FormatBool(enabled)})
+	if err != nil {
+		return errors.WithMessage(err, "Failed to store maintenance state")
+	}
+
+	if enabled {
+		if atomic.SwapUint32(&nb.maintenance, 1) == 1 {
+			return nil
+		}
+		jww.INFO.Println("Entering maintenance mode")
+		// Persist anything already buffered so it is not sent during maintenance
+		var buffered []*notifications.Data
+		for _, l := range nb.Storage.GetNotificationBuffer().Swap() {
+			buffered = append(buffered, l...)
+		}
+		return nb.queueNotifications(buffered)
+	}
+
+	if atomic.CompareAndSwapUint32(&nb.maintenance, 1, 0) {
+		jww.INFO.Println("Exiting maintenance mode")
+		go nb.drainQueue()
+	}
+	return nil
+}
+
+// RestoreMaintenance restores the maintenance state stored before a restart,
+// and resumes releasing queued notifications if maintenance had ended.
+func (nb *Impl) RestoreMaintenance() error {
+	value, err := nb.Storage.GetStateValue(maintenanceStateKey)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return errors.WithMessage(err, "Failed to get maintenance state")
+	}
+	if value == "true" {
+		jww.INFO.Println("Resuming maintenance mode")
+		atomic.StoreUint32(&nb.maintenance, 1)
+		return nil
+	}
+	go nb.drainQueue()
+	return nil
+}
+
+// queueNotifications persists notifications received during maintenance.
+func (nb *Impl) queueNotifications(data []*notifications.Data) error {
+	now := time.Now()
+	queued := make([]*storage.QueuedNotification, 0, len(data))
+	for _, n := range data {
+		queued = append(queued, &storage.QueuedNotification{
+			RoundId:     n.RoundID,
+			EphemeralId: n.EphemeralID,
+			IdentityFP:  n.IdentityFP,
+			MessageHash: n.MessageHash,
+			Timestamp:   now,
+		})
+	}
+	return nb.Storage.InsertQueuedNotifications(queued)
+}
+
+// drainQueue releases queued notifications to the sender every drain interval
+// until the queue is empty or maintenance is entered again. Only one drain
+// runs at a time.
+func (nb *Impl) drainQueue() {
+	if !atomic.CompareAndSwapUint32(&nb.draining, 0, 1) {
+		return
+	}
+	defer atomic.StoreUint32(&nb.draining, 0)
+
+	interval := nb.drainInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for !nb.inMaintenance() {
+		done, err := nb.releaseQueued(nb.drainRounds)
+		if err != nil {
+			jww.ERROR.Printf("Failed to release queued notifications: %+v", err)
+		} else if done {
+			return
+		}
+		<-ticker.C
+	}
+}
+
+// releaseQueued moves the queued notifications of up to n rounds into the
+// notification buffer. It returns true once the queue is empty.
+func (nb *Impl) releaseQueued(n int) (bool, error) {
+	if n < 1 {
+		n = 1
+	}
+	// Leave notifications queued until the sender frees buffer space
+	if !nb.hasCapacity(0) {
+		return false, nil
+	}
+	rounds, err := nb.Storage.GetQueuedRounds(n)
+	if err != nil {
+		return false, errors.WithMessage(err, "Failed to get queued rounds")
+	}
+	if len(rounds) == 0 {
+		return true, nil
+	}
+	queued, err := nb.Storage.GetQueuedNotifications(rounds)
+	if err != nil {
+		return false, errors.WithMessage(err, "Failed to get queued notifications")
+	}
+
+	byRound := map[uint64][]*notifications.Data{}
+	stale := 0
+	for _, q := range queued {
+		if nb.isStale(q.Timestamp) {
+			stale++
+			continue
+		}
+		byRound[q.RoundId] = append(byRound[q.RoundId], &notifications.Data{
+			EphemeralID: q.EphemeralId,
+			RoundID:     q.RoundId,
+			IdentityFP:  q.IdentityFP,
+			MessageHash: q.MessageHash,
+		})
+	}
+	buffer := nb.Storage.GetNotificationBuffer()
+	for rid, data := range byRound {
+		buffer.Add(id.Round(rid), data)
+	}
+	nb.countStale(stale)
+	jww.INFO.Printf("Released %d queued notifications from %d rounds", len(queued)-stale, len(rounds))
+
+	err = nb.Storage.DeleteQueuedNotifications(rounds)
+	if err != nil {
+		return false, errors.WithMessage(err, "Failed to delete released notifications")
+	}
+	return len(rounds) < n, nil
+}
+
+// handleMaintenance reports the maintenance state and queue depth on GET, and
+// enters or exits maintenance on POST with the enabled query parameter.
+func (nb *Impl) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			adminError(w, http.StatusBadRequest, errors.New("enabled must be true or false"))
+			return
+		}
+		err = nb.SetMaintenance(enabled)
+		if err != nil {
+			adminError(w, http.StatusInternalServerError, err)
+			return
+		}
+	default:
+		adminError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	queued, err := nb.Storage.CountQueuedNotifications()
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, errors.WithMessage(err, "Failed to count queued notifications"))
+		return
+	}
+	writeJSON(w, map[string]interface{}{"enabled": nb.inMaintenance(), "queued": queued})
+}
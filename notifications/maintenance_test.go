@@ -0,0 +1,59 @@
+package notifications
+
+import (
+	pb "gitlab.com/elixxir/comms/mixmessages"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"testing"
+)
+
+// Tests that batches received during maintenance are persisted instead of
+// buffered, and are released to the buffer afterwards.
+func TestImpl_Maintenance(t *testing.T) {
+	s, err := storage.NewStorage("", "", "TestImpl_Maintenance", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+	impl := &Impl{Storage: s}
+
+	err = impl.SetMaintenance(true)
+	if err != nil {
+		t.Fatalf("Failed to enter maintenance: %+v", err)
+	}
+
+	for rid := uint64(1); rid <= 3; rid++ {
+		err = impl.ReceiveNotificationBatch(&pb.NotificationBatch{
+			RoundID: rid,
+			Notifications: []*pb.NotificationData{
+				{EphemeralID: 5, IdentityFP: []byte("fp"), MessageHash: []byte("hash")},
+			},
+		}, nil)
+		if err != nil {
+			t.Fatalf("Failed to receive batch: %+v", err)
+		}
+	}
+
+	if buffered := s.GetNotificationBuffer().Swap(); len(buffered) != 0 {
+		t.Errorf("Notifications should not be buffered during maintenance: %+v", buffered)
+	}
+	queued, err := s.CountQueuedNotifications()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queued != 3 {
+		t.Fatalf("Expected %d queued notifications, received %d", 3, queued)
+	}
+
+	// Release two rounds at a time, as the drain would after maintenance
+	impl.maintenance = 0
+	done, err := impl.releaseQueued(2)
+	if err != nil || done {
+		t.Fatalf("Expected queue to have rounds remaining, done: %t, err: %+v", done, err)
+	}
+	if buffered := s.GetNotificationBuffer().Swap(); len(buffered[5]) != 2 {
+		t.Errorf("Expected 2 notifications released, received %+v", buffered)
+	}
+	done, err = impl.releaseQueued(2)
+	if err != nil || !done {
+		t.Errorf("Expected queue to be drained, done: %t, err: %+v", done, err)
+	}
+}
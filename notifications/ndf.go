@@ -12,10 +12,12 @@ package notifications
 import (
 	//"github.com/pkg/errors"
 	"bytes"
+	"context"
 	"github.com/pkg/errors"
 	jww "github.com/spf13/jwalterweatherman"
 	pb "gitlab.com/elixxir/comms/mixmessages"
 	"gitlab.com/elixxir/notifications-bot/io"
+	"gitlab.com/xx_network/primitives/id"
 	"sync/atomic"
 	"time"
 )
@@ -33,16 +35,19 @@ func (nb *Impl) TrackNdf() {
 	gatewayEventHandler := func(ndf pb.NDF) ([]byte, error) {
 		jww.DEBUG.Printf("Updating Gateways with new NDF")
 		// TODO: If this returns an error, print that error if it occurs
-		err := nb.inst.UpdatePartialNdf(&ndf)
+		err := nb.instance().UpdatePartialNdf(&ndf)
 		if err != nil {
 			return nil, errors.WithMessage(err, "Failed to update partial NDF")
 		}
-		err = nb.inst.UpdateGatewayConnections()
+		removed := nb.gateways.update(nb.instance().GetPartialNdf().Get())
+		nb.evictGateways(removed)
+		nb.overrideGatewayAddresses(nb.instance().GetPartialNdf().Get())
+		err = nb.instance().UpdateGatewayConnections()
 		if err != nil {
 			return nil, errors.WithMessage(err, "Failed to update gateway connections")
 		}
 		atomic.SwapUint32(nb.receivedNdf, 1)
-		return nb.inst.GetPartialNdf().GetHash(), nil
+		return nb.instance().GetPartialNdf().GetHash(), nil
 	}
 
 	// Stopping function for the thread
@@ -58,12 +63,86 @@ func (nb *Impl) TrackNdf() {
 	}
 
 	// Polling object
-	permHost, _ := nb.Comms.GetHost(nb.inst.GetPermissioningId())
-	poller := io.NewNdfPoller(nb.Comms, permHost)
+	permHost, _ := nb.hosts().GetHost(nb.instance().GetPermissioningId())
+	poller := io.NewNdfPoller(nb.server(), permHost)
 
+	if nb.ndfStream != nil {
+		go streamNdf(nb.ndfStream, poller, quitCh, gatewayEventHandler)
+		return
+	}
 	go trackNdf(poller, quitCh, gatewayEventHandler)
 }
 
+// Bounds of the delay before reconnecting a broken NDF stream, which doubles
+// with each consecutive failure.
+const (
+	ndfStreamMinBackoff = time.Second
+	ndfStreamMaxBackoff = 30 * time.Second
+)
+
+// streamNdf applies NDF updates as they are streamed. The NDF is polled once
+// before each connection, so updates published while the stream was down are
+// not missed.
+func streamNdf(stream io.NdfStream, poller io.PollingConn, quitCh chan bool, gwEvt GatewaysChanged) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := make(chan *pb.NDF)
+	errCh := make(chan error, 1)
+	lastNdf := pb.NDF{Ndf: []byte{}}
+	lastNdfHash := []byte{}
+	apply := func(ndf *pb.NDF) {
+		if ndf == nil || len(ndf.Ndf) == 0 || bytes.Equal(ndf.Ndf, lastNdf.Ndf) {
+			return
+		}
+		h, err := gwEvt(*ndf)
+		if err != nil {
+			jww.ERROR.Println(err)
+			return
+		}
+		lastNdf = *ndf
+		lastNdfHash = h
+	}
+
+	delay := ndfStreamMinBackoff
+	for {
+		ndf, err := poller.PollNdf(lastNdfHash)
+		if err != nil {
+			jww.ERROR.Printf("polling ndf: %+v", err)
+		} else {
+			apply(ndf)
+		}
+
+		connected := time.Now()
+		go func(hash []byte) { errCh <- stream.StreamNdf(ctx, hash, updates) }(lastNdfHash)
+	receive:
+		for {
+			select {
+			case ndf := <-updates:
+				apply(ndf)
+			case err = <-errCh:
+				break receive
+			case <-quitCh:
+				jww.DEBUG.Printf("Exiting NDF stream thread...")
+				return
+			}
+		}
+
+		if time.Since(connected) > ndfStreamMaxBackoff {
+			delay = ndfStreamMinBackoff
+		}
+		jww.WARN.Printf("NDF stream ended, reconnecting in %s: %+v", delay, err)
+		select {
+		case <-quitCh:
+			jww.DEBUG.Printf("Exiting NDF stream thread...")
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > ndfStreamMaxBackoff {
+			delay = ndfStreamMaxBackoff
+		}
+	}
+}
+
 func trackNdf(poller io.PollingConn, quitCh chan bool, gwEvt GatewaysChanged) {
 	pollDelay := 1 * time.Second
 	hashCh := make(chan []byte, 1)
@@ -118,6 +197,23 @@ func trackNdf(poller io.PollingConn, quitCh chan bool, gwEvt GatewaysChanged) {
 	}
 }
 
+// evictGateways closes the connections to gateways which have left the NDF
+// and removes their hosts, which the NDF update would otherwise keep forever,
+// along with their watermarks.
+func (nb *Impl) evictGateways(removed []*id.ID) {
+	for _, gwID := range removed {
+		if host, ok := nb.hosts().GetHost(gwID); ok {
+			host.Disconnect()
+			nb.hosts().RemoveHost(gwID)
+		}
+		err := nb.Storage.DeleteGatewayWatermark(gwID.String())
+		if err != nil {
+			jww.WARN.Printf("Failed to delete watermark of gateway %s: %+v", gwID, err)
+		}
+		jww.INFO.Printf("Evicted gateway %s which is no longer in the NDF", gwID)
+	}
+}
+
 func (nb *Impl) ReceivedNdf() *uint32 {
 	return nb.receivedNdf
 }
@@ -137,6 +233,10 @@ func (nb *Impl) Cleaner() {
 		select {
 		case <-cleanTicker.C:
 			nb.roundStore.Range(cleanF)
+			err := nb.Storage.DeleteBatchKeys(time.Now().Add(-batchKeyRetention))
+			if err != nil {
+				jww.WARN.Printf("Failed to delete expired batch keys: %+v", err)
+			}
 		}
 	}
 }
@@ -11,6 +11,9 @@ import (
 	"bytes"
 	pb "gitlab.com/elixxir/comms/mixmessages"
 	"gitlab.com/elixxir/comms/testutils"
+	"gitlab.com/elixxir/notifications-bot/testutil"
+	"gitlab.com/xx_network/primitives/id"
+	"gitlab.com/xx_network/primitives/ndf"
 	"sync"
 	"testing"
 	"time"
@@ -88,3 +91,48 @@ func TestTrackNdf(t *testing.T) {
 	}
 
 }
+
+// Tests that gateways which leave the NDF have their hosts and watermarks
+// removed, while gateways still in the NDF are kept.
+func TestImpl_evictGateways(t *testing.T) {
+	s := testutil.NewStorage(t)
+	comms := testutil.NewComms()
+	impl := &Impl{Storage: s, comms: comms}
+
+	kept := id.NewIdFromString("kept", id.Gateway, t)
+	left := id.NewIdFromString("left", id.Gateway, t)
+	for _, gwID := range []*id.ID{kept, left} {
+		comms.AddHost(t, gwID, nil)
+		if err := s.UpsertGatewayWatermark(gwID.String(), 1, time.Now()); err != nil {
+			t.Fatalf("Failed to add watermark: %+v", err)
+		}
+	}
+
+	removed := impl.gateways.update(&ndf.NetworkDefinition{
+		Gateways: []ndf.Gateway{{ID: kept.Marshal()}, {ID: left.Marshal()}},
+	})
+	if len(removed) != 0 {
+		t.Errorf("No gateways should be removed by the first NDF: %v", removed)
+	}
+	removed = impl.gateways.update(&ndf.NetworkDefinition{
+		Gateways: []ndf.Gateway{{ID: kept.Marshal()}},
+	})
+	if len(removed) != 1 || !removed[0].Cmp(left) {
+		t.Fatalf("Expected %s to be removed, removed %v", left, removed)
+	}
+	impl.evictGateways(removed)
+
+	if _, ok := comms.GetHost(left); ok {
+		t.Errorf("Host of removed gateway %s was not evicted", left)
+	}
+	if _, ok := comms.GetHost(kept); !ok {
+		t.Errorf("Host of gateway %s still in the NDF was evicted", kept)
+	}
+	watermarks, err := s.GetGatewayWatermarks()
+	if err != nil {
+		t.Fatalf("Failed to get watermarks: %+v", err)
+	}
+	if len(watermarks) != 1 || watermarks[0].GatewayID != kept.String() {
+		t.Errorf("Only the watermark of %s should remain: %+v", kept, watermarks)
+	}
+}
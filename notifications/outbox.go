@@ -0,0 +1,93 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package notifications
+
+import (
+	"context"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"time"
+)
+
+const (
+	// outboxPollFreq is how often the dispatcher checks for outbox entries
+	outboxPollFreq = time.Second
+	// outboxBatchSize is the number of entries claimed per poll
+	outboxBatchSize = 500
+	// outboxLease is how long a claimed entry is left alone before it is
+	// dispatched again; it must outlast every send attempt and retry delay
+	outboxLease = 5 * time.Minute
+	// processedRoundRetention is how long processed rounds are remembered to
+	// drop batches resent by gateways
+	processedRoundRetention = time.Hour
+)
+
+// enqueuePushes writes the pushes built for a batch to the outbox and marks
+// the rounds they cover as processed.
+func (nb *Impl) enqueuePushes(ctx context.Context, entries []*storage.OutboxEntry) error {
+	seen := map[uint64]struct{}{}
+	var rounds []uint64
+	for _, e := range entries {
+		for _, rid := range e.Rounds {
+			if _, ok := seen[rid]; !ok {
+				seen[rid] = struct{}{}
+				rounds = append(rounds, rid)
+			}
+		}
+	}
+	return nb.Storage.WithContext(ctx).EnqueueOutbox(entries, rounds)
+}
+
+// OutboxDispatcher is a long-running thread which sends the pushes written to
+// the outbox. An entry is only removed once its send has completed, having
+// either succeeded, been dead-lettered or purged its token, so pushes are
+// delivered at least once even if the bot stops mid-send.
+func (nb *Impl) OutboxDispatcher() {
+	ticker := time.NewTicker(outboxPollFreq)
+	lastCleanup := time.Time{}
+	for {
+		nb.dispatchOutbox()
+
+		if now := nb.now(); now.Sub(lastCleanup) > processedRoundRetention/4 {
+			err := nb.Storage.DeleteProcessedRounds(now.Add(-processedRoundRetention))
+			if err != nil {
+				jww.WARN.Printf("Failed to delete expired processed rounds: %+v", err)
+			}
+			lastCleanup = now
+		}
+		<-ticker.C
+	}
+}
+
+// dispatchOutbox claims the pending outbox entries and sends each of them in
+// its own thread.
+func (nb *Impl) dispatchOutbox() {
+	if nb.inMaintenance() {
+		return
+	}
+	entries, err := nb.Storage.ClaimOutboxEntries(outboxBatchSize, nb.now(), outboxLease)
+	if err != nil {
+		jww.ERROR.Printf("Failed to claim outbox entries: %+v", err)
+	}
+	for _, e := range entries {
+		go nb.dispatch(e)
+	}
+}
+
+// dispatch sends an outbox entry and removes it once the send is complete.
+func (nb *Impl) dispatch(e *storage.OutboxEntry) {
+	if nb.isStale(e.CreatedAt) {
+		nb.countStale(e.Target.Count)
+	} else {
+		nb.notify(nb.context(), NotificationRequest{Target: e.Target, Payload: e.Payload, Rounds: e.Rounds})
+	}
+	err := nb.Storage.DeleteOutboxEntry(e.ID)
+	if err != nil {
+		jww.WARN.Printf("Failed to remove outbox entry %d, it will be sent again: %+v", e.ID, err)
+	}
+}
@@ -0,0 +1,91 @@
+package notifications
+
+import (
+	"context"
+	pb "gitlab.com/elixxir/comms/mixmessages"
+	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/elixxir/notifications-bot/notifications/providers"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gitlab.com/elixxir/primitives/notifications"
+	"gitlab.com/xx_network/primitives/id"
+	"gitlab.com/xx_network/primitives/id/ephemeral"
+	"testing"
+	"time"
+)
+
+// Tests that with the outbox enabled, SendBatch writes pushes to the outbox
+// instead of sending them, and that dispatching sends and removes them.
+func TestImpl_SendBatch_Outbox(t *testing.T) {
+	s, err := storage.NewStorage("", "", "TestImpl_SendBatch_Outbox", "", "")
+	if err != nil {
+		t.Fatalf("Failed to make new storage: %+v", err)
+	}
+	dchan := make(chan string, 10)
+	i := &Impl{
+		providers:        map[string]providers.Provider{constants.MessengerAndroid.String(): &MockProvider{donech: dchan}},
+		Storage:          s,
+		maxNotifications: 20,
+		maxPayloadBytes:  4096,
+		outbox:           true,
+	}
+
+	iid, err := ephemeral.GetIntermediaryId(id.NewIdFromString("outbox", id.User, t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, epoch := ephemeral.HandleQuantization(time.Now())
+	_, err = s.RegisterForNotifications(iid, []byte("rsacert"), "fcm:token", constants.MessengerAndroid.String(), epoch, 16)
+	if err != nil {
+		t.Fatalf("Failed to add fake user: %+v", err)
+	}
+	eph, err := s.GetLatestEphemeral()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = i.SendBatch(context.Background(), map[int64][]*notifications.Data{
+		eph.EphemeralId: {{EphemeralID: eph.EphemeralId, RoundID: 3, MessageHash: []byte("hello"), IdentityFP: []byte("identity")}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to send batch: %+v", err)
+	}
+	select {
+	case <-dchan:
+		t.Fatal("Push should not be sent before it is dispatched")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	processed, err := s.IsRoundProcessed(3)
+	if err != nil || !processed {
+		t.Errorf("Round should be marked processed: %+v", err)
+	}
+	err = i.ReceiveNotificationBatch(&pb.NotificationBatch{
+		RoundID:       3,
+		Notifications: []*pb.NotificationData{{EphemeralID: eph.EphemeralId}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buffered := s.GetNotificationBuffer().Len(); buffered != 0 {
+		t.Errorf("Batch for a processed round should be dropped, %d buffered", buffered)
+	}
+
+	now := time.Now()
+	entries, err := s.ClaimOutboxEntries(10, now, outboxLease)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Expected one outbox entry, got %d: %+v", len(entries), err)
+	}
+	again, err := s.ClaimOutboxEntries(10, now, outboxLease)
+	if err != nil || len(again) != 0 {
+		t.Errorf("Claimed entries should not be claimed again within the lease, got %d: %+v", len(again), err)
+	}
+
+	i.dispatch(entries[0])
+	if len(dchan) != 1 {
+		t.Errorf("Dispatch should have sent the push")
+	}
+	remaining, err := s.ClaimOutboxEntries(10, now.Add(2*outboxLease), outboxLease)
+	if err != nil || len(remaining) != 0 {
+		t.Errorf("Dispatched entry should be removed, %d remaining: %+v", len(remaining), err)
+	}
+}
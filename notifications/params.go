@@ -7,7 +7,20 @@
 
 package notifications
 
-import "gitlab.com/elixxir/notifications-bot/notifications/providers"
+import (
+	"gitlab.com/elixxir/notifications-bot/events"
+	"gitlab.com/elixxir/notifications-bot/notifications/providers"
+	"gitlab.com/elixxir/notifications-bot/proxy"
+	"gitlab.com/xx_network/primitives/id"
+	"time"
+)
+
+// ChannelParams holds the notification channel and sound an app uses for
+// tokens which do not set their own.
+type ChannelParams struct {
+	ChannelID string
+	Sound     string
+}
 
 // Params struct holds info passed in for configuration
 type Params struct {
@@ -23,4 +36,231 @@ type Params struct {
 	HavenAPNS              providers.APNSParams
 	HttpsCertPath          string
 	HttpsKeyPath           string
+
+	// CommsID is the ID the bot's comms run under; id.NotificationBot if nil
+	CommsID *id.ID
+
+	// WebPush configures the web push provider used for browser fallback
+	// registrations; it is disabled if no VAPID key is set
+	WebPush providers.WebPushParams
+
+	// Proxy routes push provider requests through egress proxies
+	Proxy proxy.Params
+	// GRPC tunes the keepalives and connection lifetimes of the comms
+	GRPC GRPCParams
+
+	// PushTTL is how long push services hold a push for an offline device
+	// before dropping it, so notifications of messages which are no longer
+	// retrievable are not delivered late; providers.DefaultPushTTL if unset
+	PushTTL time.Duration
+
+	// ProviderLimits bounds the send rate and concurrency of each app using
+	// a push service, keyed by push service name (apns, fcm or webpush)
+	ProviderLimits map[string]ProviderLimits
+
+	// Tenants are independent apps served alongside the bot's own, each
+	// with its own credentials and limits; see TenantParams
+	Tenants []TenantParams
+
+	// TranslationsPath is the JSON file of localized notification text picked
+	// by token locale; the default text is always used if empty
+	TranslationsPath string
+
+	// Default Android notification channel and sound of each FCM app
+	FCMChannel      ChannelParams
+	HavenFCMChannel ChannelParams
+	// FCMAnalyticsLabel segments FCM deliveries in the Firebase console by
+	// app and push type; see providers.FCMParams
+	FCMAnalyticsLabel string
+
+	// MinProtocolVersion is the oldest client protocol version served, so
+	// legacy registrations can be turned off once clients have upgraded;
+	// every version is served if 0
+	MinProtocolVersion int
+
+	// EnforceGatewayAuth rejects notification batches which were not received
+	// over an authenticated connection from a gateway in the current NDF
+	EnforceGatewayAuth bool
+
+	// RequireBatchSignatures rejects notification batches which were not
+	// signed with the NDF key of the gateway sending them
+	RequireBatchSignatures bool
+
+	// AddressFamily is preferred when connecting to dual-stack hosts: any,
+	// ipv4 or ipv6. Other families are fallen back to after
+	// HappyEyeballsDelay, or DefaultHappyEyeballsDelay if unset
+	AddressFamily      AddressFamily
+	HappyEyeballsDelay time.Duration
+
+	// GatewayStaleAfter is how long since the last batch accepted from a
+	// gateway it is flagged as stale by the admin API; never if 0
+	GatewayStaleAfter time.Duration
+	// GatewayPollHistory is the number of most recent batches received from
+	// gateways kept for debugging through the admin API; none if 0
+	GatewayPollHistory int
+
+	// Address and bearer token for the admin API; it is disabled if either is
+	// empty. The address may be a unix socket path prefixed with "unix:"
+	AdminAddress string
+	AdminToken   string
+	// ProfileDir is where heap profiles triggered through the admin API are
+	// written; they are returned in the response if empty
+	ProfileDir string
+
+	// MetricsAddress serves /metrics without the admin token, so it can be
+	// scraped on a separate interface; it is not served if empty. The address
+	// may be a unix socket path prefixed with "unix:"
+	MetricsAddress string
+
+	// AttestationAddress is the public address clients fetch the bot's
+	// signed attestation from; it is not served if empty
+	AttestationAddress string
+	// GatewayAllowedOrigins are the origins browsers may call the
+	// registration gateway on the attestation address from; "*" allows any
+	GatewayAllowedOrigins []string
+	// PermissioningKeys pins the permissioning certificates client
+	// registrations are verified against, such as the old and new ones
+	// during a permissioning key rotation; the permissioning host's is used
+	// if empty
+	PermissioningKeys []PermissioningKey
+	// Registrar configures re-verifying stored registrar signatures when the
+	// permissioning keys change
+	Registrar RegistrarParams
+	// RegistrationBans configures banning sources whose registrations
+	// repeatedly fail signature verification
+	RegistrationBans RegistrationBanParams
+	// AsyncRegistration configures queueing registrations to be verified and
+	// stored in the background
+	AsyncRegistration AsyncRegistrationParams
+	// FeatureFlagRefresh is how often the feature flags set through the admin
+	// API are reloaded from storage, so changes made on another instance apply
+	FeatureFlagRefresh time.Duration
+	// KeyRotation configures rotating the bot's certificate and key
+	KeyRotation KeyRotationParams
+	// ReceiptTTL is how long the registration receipts returned by the
+	// registration endpoints on the attestation address are valid
+	ReceiptTTL time.Duration
+
+	// DeliveryLogRetention is how long delivery receipts are kept in storage
+	DeliveryLogRetention time.Duration
+	// PushHistorySize is the number of most recent pushes kept for each user
+	// and returned to clients requesting their push history; none are kept if
+	// it is 0
+	PushHistorySize int
+	// TestPushInterval is the minimum time between the test pushes a user
+	// may request; they are not limited if it is 0
+	TestPushInterval time.Duration
+
+	// DeletedTokenRetention is how long unregistered and purged tokens can be
+	// restored before they are hard deleted
+	DeletedTokenRetention time.Duration
+
+	// MaxSendAttempts is the number of times a send is attempted before the
+	// notification is moved to the dead-letter queue
+	MaxSendAttempts int
+	// ReregistrationNudges sends a data push to the other devices of an
+	// identity when one of its tokens is purged, so the app can refresh the
+	// purged device's registration
+	ReregistrationNudges bool
+	// QuietRepeatPushes makes pushes silent once a user has had a visible
+	// push since their client last reported the app was opened
+	QuietRepeatPushes bool
+	// Digest configures the summary pushes sent to users who turned on
+	// digest mode
+	Digest DigestParams
+	// PushQuotas caps the daily pushes of each app, keyed by app
+	PushQuotas map[string]PushQuota
+	// Conversations configures the pushes for each conversation tracked IDs
+	// are tagged with, keyed by constants.Conversation
+	Conversations map[string]ConversationParams
+	// NdfStreamURL is the server-sent events endpoint NDF updates are
+	// streamed from; the NDF is polled from permissioning if empty
+	NdfStreamURL string
+	// Backfill configures catching up on rounds completed while the bot was
+	// down
+	Backfill BackfillParams
+	// Degraded configures buffering registrations and sending from cached
+	// lookups while the database is read-only
+	Degraded DegradedParams
+
+	// MaxNotificationAge is the age after which notifications still waiting
+	// to be sent, after being held back or retried, are dropped; they are
+	// never dropped if 0
+	MaxNotificationAge time.Duration
+
+	// LookupTimeout bounds the token lookup of each notification batch and
+	// SendTimeout each provider send attempt; unbounded if 0
+	LookupTimeout time.Duration
+	SendTimeout   time.Duration
+
+	// Outbox writes pushes to an outbox table in the same transaction as
+	// marking their rounds processed, and sends them from a dispatcher, so a
+	// crash before a push reaches the provider does not lose it
+	Outbox bool
+
+	// MaxPushesPerToken is the number of pushes notifications for a single
+	// token are split across per batch; anything left over is dropped and the
+	// last push is flagged as having more available
+	MaxPushesPerToken int
+
+	// CanaryInterval is how often canary tokens registered through the admin
+	// API are sent a heartbeat push; canaries are not monitored if 0. An
+	// alert is raised after CanaryAlertFailures failed heartbeats in a row
+	CanaryInterval      time.Duration
+	CanaryAlertFailures int
+
+	// BroadcastRate is the maximum pushes per second sent by operator
+	// broadcasts through the admin API
+	BroadcastRate int
+
+	// AlignSendsToRounds sends notifications RoundSettleDelay after each
+	// round's batch arrives, or after the next round expected from the
+	// observed round cadence, rather than every NotificationRate seconds.
+	// Sends are at least MinSendInterval and at most NotificationRate
+	// seconds apart.
+	AlignSendsToRounds bool
+	RoundSettleDelay   time.Duration
+	MinSendInterval    time.Duration
+	// AdaptiveSendInterval, when sends are not aligned to rounds, halves the
+	// interval between sends after each which found notifications buffered,
+	// down to MinSendInterval, and doubles it after each which found none, up
+	// to NotificationRate seconds
+	AdaptiveSendInterval bool
+
+	// MaintenanceDrainRounds is the number of queued rounds released to the
+	// sender every NotificationRate seconds after maintenance ends
+	MaintenanceDrainRounds int
+
+	// MaxBufferedNotifications bounds the notifications waiting to be sent;
+	// unbounded if 0. Batches which would exceed it wait up to
+	// BackpressureDelay for space before being rejected.
+	MaxBufferedNotifications int
+	BackpressureDelay        time.Duration
+
+	// StatsInterval is how often registration counts are logged and
+	// refreshed for the admin metrics endpoint
+	StatsInterval time.Duration
+	// AnalyticsInterval is how often the delivery log is rolled up into the
+	// daily counters served by the admin API; never if 0
+	AnalyticsInterval time.Duration
+
+	// FaultInjection allows provider sends and storage writes to be failed
+	// at rates set through the admin API; for staging only
+	FaultInjection bool
+
+	// Failover runs the instance on standby until it holds the sender lease,
+	// so a second instance can take over quickly if the active one fails
+	Failover FailoverParams
+
+	// Ephemeral overrides the ephemeral ID timing for networks which do not
+	// use the standard period
+	Ephemeral EphemeralParams
+	// EphemeralReconcileInterval is how often every tracked identity is
+	// checked for an ephemeral for the current period, adding those missing;
+	// never if 0
+	EphemeralReconcileInterval time.Duration
+
+	// Events configures the optional event bus notification events are
+	// published to
+	Events events.Params
 }
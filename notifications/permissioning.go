@@ -0,0 +1,132 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Clients are registered with the bot by the permissioning server's signature
+// on their transmission key. By default it is verified against the key of the
+// permissioning host, so when permissioning rotates its key every client
+// registered under the old one is rejected. Pinning a key set of the old and
+// new keys keeps both accepted until the old one is retired.
+
+package notifications
+
+import (
+	"encoding/base64"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/crypto/registration"
+	"gitlab.com/xx_network/crypto/signature/rsa"
+	"gitlab.com/xx_network/crypto/tls"
+	"gitlab.com/xx_network/primitives/id"
+	"gitlab.com/xx_network/primitives/utils"
+	"time"
+)
+
+// PermissioningKey is a pinned permissioning certificate client registrations
+// are verified against.
+type PermissioningKey struct {
+	CertPath string
+	// Until is when the key stops being accepted, as when it has been
+	// rotated out; it is accepted indefinitely if zero
+	Until time.Time
+}
+
+// pinnedKey is the public key of a pinned permissioning certificate.
+type pinnedKey struct {
+	path  string
+	key   *rsa.PublicKey
+	until time.Time
+}
+
+// loadPermissioningKeys reads the public keys of the pinned permissioning
+// certificates.
+func loadPermissioningKeys(keys []PermissioningKey) ([]pinnedKey, error) {
+	pinned := make([]pinnedKey, 0, len(keys))
+	for _, k := range keys {
+		certPEM, err := utils.ReadFile(k.CertPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read permissioning certificate at %+v", k.CertPath)
+		}
+		cert, err := tls.LoadCertificate(string(certPEM))
+		if err != nil {
+			return nil, errors.WithMessagef(err, "Failed to parse permissioning certificate %s", k.CertPath)
+		}
+		key, err := tls.ExtractPublicKey(cert)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "Failed to get key of permissioning certificate %s", k.CertPath)
+		}
+		pinned = append(pinned, pinnedKey{path: k.CertPath, key: key, until: k.Until})
+	}
+	return pinned, nil
+}
+
+// permissioningKeys returns the keys registrations are verified against as of
+// now: the pinned keys not yet retired, or the key of the permissioning host
+// if none are pinned.
+func (nb *Impl) permissioningKeys() ([]*rsa.PublicKey, error) {
+	if len(nb.pinnedKeys) == 0 {
+		permHost, ok := nb.hosts().GetHost(&id.Permissioning)
+		if !ok {
+			return nil, errors.New("Could not find permissioning host to verify client signature")
+		}
+		return []*rsa.PublicKey{permHost.GetPubKey()}, nil
+	}
+	now := nb.now()
+	keys := make([]*rsa.PublicKey, 0, len(nb.pinnedKeys))
+	for _, k := range nb.pinnedKeys {
+		if k.until.IsZero() || now.Before(k.until) {
+			keys = append(keys, k.key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("Every pinned permissioning key has been retired")
+	}
+	return keys, nil
+}
+
+// verifyRegistrar checks the permissioning server's signature registering the
+// transmission key at the passed in timestamp, accepting it from any of the
+// permissioning keys.
+func (nb *Impl) verifyRegistrar(timestamp int64, transmissionRsaPem, sig []byte) error {
+	keys, err := nb.permissioningKeys()
+	if err != nil {
+		return err
+	}
+	jww.INFO.Printf("Verifying perm sig against %d keys with params:\n\tTimestamp: %d\n\tTRSA: %s\n\tSIG: %s\n",
+		len(keys), timestamp, base64.StdEncoding.EncodeToString(transmissionRsaPem),
+		base64.StdEncoding.EncodeToString(sig))
+	return verifyRegistrarWith(keys, timestamp, transmissionRsaPem, sig)
+}
+
+// verifyRegistrarWith checks the permissioning server's signature registering
+// the transmission key against each of the passed in keys.
+func verifyRegistrarWith(keys []*rsa.PublicKey, timestamp int64, transmissionRsaPem, sig []byte) error {
+	err := errors.New("No permissioning keys to verify against")
+	for _, key := range keys {
+		err = registration.VerifyWithTimestamp(key, timestamp, string(transmissionRsaPem), sig)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// checkPermissioningPinned returns an error if the key of the permissioning
+// host is not among the pinned keys, as the host was configured with a
+// certificate permissioning no longer signs with.
+func (nb *Impl) checkPermissioningPinned() error {
+	permHost, ok := nb.hosts().GetHost(&id.Permissioning)
+	if !ok {
+		return errors.New("No permissioning host is configured")
+	}
+	hostKey := permHost.GetPubKey()
+	for _, k := range nb.pinnedKeys {
+		if hostKey != nil && k.key.N.Cmp(hostKey.N) == 0 && k.key.E == hostKey.E {
+			return nil
+		}
+	}
+	return errors.New("The permissioning host's certificate is not among the pinned permissioning keys")
+}
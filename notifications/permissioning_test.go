@@ -0,0 +1,47 @@
+package notifications
+
+import (
+	"gitlab.com/elixxir/notifications-bot/clock"
+	"gitlab.com/elixxir/notifications-bot/testutil"
+	"gitlab.com/xx_network/crypto/csprng"
+	"gitlab.com/xx_network/crypto/signature/rsa"
+	"testing"
+	"time"
+)
+
+// Tests that registrations signed by a pinned permissioning key are accepted
+// until it is retired, alongside the key it is rotated to.
+func TestImpl_verifyRegistrar_Pinned(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	old, err := loadPermissioningKeys([]PermissioningKey{
+		{CertPath: testutil.Path(testutil.PermissioningCert), Until: now.Add(time.Hour)},
+	})
+	if err != nil {
+		t.Fatalf("Failed to load permissioning keys: %+v", err)
+	}
+	key, err := rsa.GenerateKey(csprng.NewSystemRNG(), 1024)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %+v", err)
+	}
+	rotated := pinnedKey{path: "new", key: key.GetPublic()}
+	fake := clock.NewFake(now)
+	impl := &Impl{clock: fake, pinnedKeys: []pinnedKey{rotated, old[0]}}
+	c := testutil.NewClient(t)
+
+	err = impl.verifyRegistrar(c.RegistrationTimestamp, c.TransmissionRsaPem, c.TransmissionRsaRegistrarSig)
+	if err != nil {
+		t.Errorf("Registration signed by the old key should be accepted: %+v", err)
+	}
+
+	fake.Advance(2 * time.Hour)
+	err = impl.verifyRegistrar(c.RegistrationTimestamp, c.TransmissionRsaPem, c.TransmissionRsaRegistrarSig)
+	if err == nil {
+		t.Errorf("Registration signed by the retired key should be rejected")
+	}
+
+	impl.pinnedKeys = []pinnedKey{rotated}
+	err = impl.verifyRegistrar(c.RegistrationTimestamp, c.TransmissionRsaPem, c.TransmissionRsaRegistrarSig)
+	if err == nil {
+		t.Errorf("Registration signed by an unpinned key should be rejected")
+	}
+}
@@ -0,0 +1,108 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Identity preimages let the bot tell apart identities which share an
+// ephemeral ID. Gateways send the identity fingerprint (SIH) of each message,
+// which only the preimages of its recipient reproduce. Registering them is
+// optional: it stops spurious pushes at the cost of the bot being able to
+// link an identity's messages across ephemeral IDs.
+
+package notifications
+
+import (
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/crypto/notifications"
+	"gitlab.com/elixxir/crypto/rsa"
+	"gitlab.com/elixxir/crypto/sih"
+	"gitlab.com/elixxir/notifications-bot/errs"
+	"gorm.io/gorm"
+	"net/http"
+	"time"
+)
+
+// maxIdentityPreimages limits the number of preimages registered for an
+// identity.
+const maxIdentityPreimages = 16
+
+// IdentityPreimagesRequest registers the message identification preimages of
+// a tracked identity, replacing any registered before; an empty list removes
+// them. Signature is made with notifications.SignIdentity over the
+// intermediary ID followed by the preimages, the request timestamp and
+// IdentityPreimagesTag.
+type IdentityPreimagesRequest struct {
+	TransmissionRsaPem []byte
+	IntermediaryId     []byte
+	Preimages          [][]byte
+	RequestTimestamp   int64
+	Signature          []byte
+}
+
+// verifyIdentityPreimages checks the preimages, request timestamp and
+// signature of an IdentityPreimagesRequest.
+func (nb *Impl) verifyIdentityPreimages(msg *IdentityPreimagesRequest) error {
+	if msg == nil || len(msg.TransmissionRsaPem) == 0 || len(msg.IntermediaryId) == 0 {
+		return errors.New("Request must include a transmission RSA key and intermediary ID")
+	}
+	if len(msg.Preimages) > maxIdentityPreimages {
+		return errors.Errorf("Request has %d preimages, at most %d are allowed", len(msg.Preimages), maxIdentityPreimages)
+	}
+	for _, p := range msg.Preimages {
+		if len(p) != len(sih.Preimage{}) {
+			return errors.Errorf("Preimages must be %d bytes, received %d", len(sih.Preimage{}), len(p))
+		}
+	}
+	requestTimestamp := time.Unix(0, msg.RequestTimestamp)
+	if err := nb.checkRequestTimestamp(requestTimestamp); err != nil {
+		return err
+	}
+
+	pub, err := rsa.GetScheme().UnmarshalPublicKeyPEM(msg.TransmissionRsaPem)
+	if err != nil {
+		return errors.WithMessage(err, "Failed to unmarshal public key")
+	}
+	signed := append([][]byte{msg.IntermediaryId}, msg.Preimages...)
+	err = notifications.VerifyIdentity(pub, signed, requestTimestamp, IdentityPreimagesTag, msg.Signature)
+	if err != nil {
+		return errs.Mark(errors.WithMessage(err, "Failed to verify request signature"), errs.ErrInvalidSignature)
+	}
+	return nil
+}
+
+// SetIdentityPreimages registers the preimages of an identity tracked by the
+// client which signed the request.
+func (nb *Impl) SetIdentityPreimages(msg *IdentityPreimagesRequest) error {
+	jww.DEBUG.Println("SetIdentityPreimages")
+	err := nb.verifyIdentityPreimages(msg)
+	if err != nil {
+		return err
+	}
+	return nb.Storage.SetIdentityPreimages(msg.IntermediaryId, msg.TransmissionRsaPem, msg.Preimages)
+}
+
+// handleSetIdentityPreimages serves SetIdentityPreimages for a JSON encoded
+// IdentityPreimagesRequest.
+func (nb *Impl) handleSetIdentityPreimages(w http.ResponseWriter, r *http.Request) {
+	msg := &IdentityPreimagesRequest{}
+	if !decodeRegistration(w, r, msg) {
+		return
+	}
+	err := nb.verifyIdentityPreimages(msg)
+	if err != nil {
+		adminError(w, http.StatusUnauthorized, err)
+		return
+	}
+	err = nb.Storage.SetIdentityPreimages(msg.IntermediaryId, msg.TransmissionRsaPem, msg.Preimages)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		adminError(w, http.StatusNotFound, errors.New("identity not tracked"))
+		return
+	} else if err != nil {
+		adminError(w, http.StatusInternalServerError, errors.WithMessage(err, "Failed to set preimages"))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,64 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package notifications
+
+import (
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+// Versions of the client registration protocol. Both are translated into the
+// same token, user and identity storage model, so a client may move between
+// them without re-registering.
+const (
+	// ProtocolLegacy registers a single token and intermediary ID per request
+	// through RegisterForNotifications, authenticated by the client's
+	// permissioning signature
+	ProtocolLegacy = 1
+	// ProtocolSigned registers tokens and tracked IDs through separate
+	// requests, each signed with the client's transmission key
+	ProtocolSigned = 2
+
+	// ProtocolVersion is the newest version served
+	ProtocolVersion = ProtocolSigned
+)
+
+// minProtocolVersion returns the oldest protocol version still served.
+func (nb *Impl) minProtocolVersion() int {
+	if nb.minProtocol == 0 {
+		return ProtocolLegacy
+	}
+	return nb.minProtocol
+}
+
+// validateMinProtocolVersion returns an error if the version is not one the
+// bot can serve.
+func validateMinProtocolVersion(version int) error {
+	if version != 0 && (version < ProtocolLegacy || version > ProtocolVersion) {
+		return errors.Errorf("minimum protocol version %d must be between %d and %d",
+			version, ProtocolLegacy, ProtocolVersion)
+	}
+	return nil
+}
+
+// versioned runs the handler of a client RPC belonging to the passed in
+// protocol version, rejecting it if the version is no longer served and
+// logging any error it returns.
+func (nb *Impl) versioned(version int, rpc string, handler func() error) error {
+	if min := nb.minProtocolVersion(); version < min {
+		err := errors.Errorf("%s belongs to protocol version %d, which is no longer served; "+
+			"clients must use protocol version %d or later", rpc, version, min)
+		jww.DEBUG.Printf("%+v", err)
+		return err
+	}
+	err := handler()
+	if err != nil {
+		jww.ERROR.Printf("Failed to %s (protocol version %d): %+v", rpc, version, err)
+	}
+	return err
+}
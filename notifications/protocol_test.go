@@ -0,0 +1,45 @@
+package notifications
+
+import (
+	"github.com/pkg/errors"
+	"testing"
+)
+
+// Tests that handlers of protocol versions older than the minimum are not run.
+func TestImpl_versioned(t *testing.T) {
+	impl := &Impl{}
+	calls := 0
+	handler := func() error {
+		calls++
+		return nil
+	}
+
+	for _, version := range []int{ProtocolLegacy, ProtocolSigned} {
+		if err := impl.versioned(version, "rpc", handler); err != nil {
+			t.Errorf("Protocol version %d should be served by default: %+v", version, err)
+		}
+	}
+
+	impl.minProtocol = ProtocolSigned
+	if err := impl.versioned(ProtocolLegacy, "rpc", handler); err == nil {
+		t.Errorf("Legacy protocol should be rejected once the minimum is raised")
+	}
+	if err := impl.versioned(ProtocolSigned, "rpc", handler); err != nil {
+		t.Errorf("Signed protocol should be served: %+v", err)
+	}
+	if calls != 3 {
+		t.Errorf("Expected handler to run %d times, ran %d", 3, calls)
+	}
+
+	expected := errors.New("handler failed")
+	err := impl.versioned(ProtocolSigned, "rpc", func() error { return expected })
+	if err != expected {
+		t.Errorf("Handler error was not returned: %+v", err)
+	}
+
+	for _, v := range []int{-1, ProtocolVersion + 1} {
+		if validateMinProtocolVersion(v) == nil {
+			t.Errorf("Minimum protocol version %d should be invalid", v)
+		}
+	}
+}
@@ -8,14 +8,18 @@
 package providers
 
 import (
+	"context"
 	"encoding/base64"
+	"encoding/json"
 	"github.com/pkg/errors"
 	"github.com/sideshow/apns2"
 	"github.com/sideshow/apns2/payload"
 	apnstoken "github.com/sideshow/apns2/token"
 	jww "github.com/spf13/jwalterweatherman"
 	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/elixxir/notifications-bot/proxy"
 	"gitlab.com/elixxir/notifications-bot/storage"
+	"net/http"
 	"time"
 )
 
@@ -26,12 +30,54 @@ type APNSParams struct {
 	Issuer   string
 	BundleID string
 	Dev      bool
+	// MaxPayload is the payload size limit in bytes; APNSMaxPayload if unset
+	MaxPayload int
+	// Sound is the sound played for pushes to tokens without their own sound
+	Sound string
+	// Translations holds the localized alert text picked by token locale
+	Translations Translations
+	// Tiers configures the interruption level and relevance score of pushes
+	// to tokens, keyed by the token's priority tier
+	Tiers map[string]APNSTier
+	// TTL is how long APNS holds a push for an offline device before
+	// dropping it; DefaultPushTTL if unset
+	TTL time.Duration
+	// Proxy routes requests to APNS through an egress proxy; nil connects
+	// directly
+	Proxy *proxy.Proxies
+}
+
+// APNSTier holds the APNS fields applied to pushes for a priority tier.
+type APNSTier struct {
+	// InterruptionLevel is one of passive, active, time-sensitive or critical;
+	// time-sensitive pushes break through Focus modes
+	InterruptionLevel string `mapstructure:"interruptionLevel"`
+	// RelevanceScore between 0 and 1 ranks the push in the notification summary
+	RelevanceScore float64 `mapstructure:"relevanceScore"`
+}
+
+// validate returns an error if the tier holds values APNS would reject.
+func (t APNSTier) validate() error {
+	switch t.InterruptionLevel {
+	case "", "passive", "active", "time-sensitive", "critical":
+	default:
+		return errors.Errorf("unknown interruption level %q", t.InterruptionLevel)
+	}
+	if t.RelevanceScore < 0 || t.RelevanceScore > 1 {
+		return errors.Errorf("relevance score %f must be between 0 and 1", t.RelevanceScore)
+	}
+	return nil
 }
 
 // apns struct represents an APNS provider
 type apns struct {
 	*apns2.Client
-	topic string
+	topic        string
+	maxPayload   int
+	sound        string
+	tiers        map[string]APNSTier
+	translations Translations
+	ttl          time.Duration
 }
 
 // NewApns returns an APNS-backed provider interface.
@@ -40,6 +86,11 @@ func NewApns(params APNSParams) (Provider, error) {
 	if params.KeyID == "" || params.Issuer == "" || params.BundleID == "" {
 		return nil, errors.Errorf("APNS not properly configured: %+v", params)
 	}
+	for name, tier := range params.Tiers {
+		if err := tier.validate(); err != nil {
+			return nil, errors.WithMessagef(err, "Invalid APNS priority tier %s", name)
+		}
+	}
 
 	jww.INFO.Printf("Initializing APNS provider for %s (%s) with key ID %s", params.BundleID, params.Issuer, params.KeyID)
 	if params.Dev {
@@ -64,38 +115,170 @@ func NewApns(params APNSParams) (Provider, error) {
 	} else {
 		apnsClient.Production()
 	}
+	if params.Proxy != nil {
+		// The HTTP/2 transport of the apns2 client cannot use a proxy, so it
+		// is replaced by one negotiating HTTP/2 over the proxied connection
+		apnsClient.HTTPClient.Transport = params.Proxy.Transport()
+	}
+
+	maxPayload := params.MaxPayload
+	if maxPayload <= 0 {
+		maxPayload = APNSMaxPayload
+	}
 
 	return &apns{
-		Client: apnsClient,
-		topic:  params.BundleID,
+		Client:       apnsClient,
+		topic:        params.BundleID,
+		maxPayload:   maxPayload,
+		sound:        params.Sound,
+		tiers:        params.Tiers,
+		translations: params.Translations,
+		ttl:          pushTTL(params.TTL),
 	}, nil
 }
 
 // Notify implements the Provider interface for APNS, sending the notifications to the provider.
-func (a *apns) Notify(csv string, target storage.GTNResult) (bool, error) {
-	notifPayload := payload.NewPayload().AlertTitle(constants.NotificationTitle).AlertBody(
-		constants.NotificationBody).MutableContent().Custom(
-		constants.NotificationsTag, csv)
+func (a *apns) Notify(ctx context.Context, csv string, target storage.GTNResult) (Receipt, bool, error) {
+	return categorise(a.notify(ctx, csv, target))
+}
+
+// notify sends the notifications to APNS, returning the receipt, whether the
+// token is still valid and the error of a failed send.
+func (a *apns) notify(ctx context.Context, csv string, target storage.GTNResult) (Receipt, bool, error) {
+	notifPayload, err := a.buildPayload(csv, target)
+	if err != nil {
+		return Receipt{}, true, errors.WithMessage(err, "Failed to build APNS payload")
+	}
 	notif := &apns2.Notification{
 		CollapseID:  base64.StdEncoding.EncodeToString(target.TransmissionRSAHash),
 		DeviceToken: target.Token,
-		Expiration:  time.Now().Add(time.Hour * 24 * 7),
+		Expiration:  time.Now().Add(a.ttl),
 		Priority:    apns2.PriorityHigh,
 		Payload:     notifPayload,
 		PushType:    apns2.PushTypeAlert,
 		Topic:       a.topic,
 	}
-	resp, err := a.Client.Push(notif)
+	// APNS requires background pushes to be sent at low priority
+	if target.Silent {
+		notif.Priority, notif.PushType = apns2.PriorityLow, apns2.PushTypeBackground
+	}
+	resp, err := a.Client.PushWithContext(ctx, notif)
 	if err != nil {
-		return true, errors.WithMessagef(err, "Failed to send notification via APNS: %+v", resp)
+		return Receipt{}, true, errors.WithMessagef(err, "Failed to send notification via APNS: %+v", resp)
 		// TODO : Should be re-enabled for specific error cases? deep dive on apns docs may be helpful
 		//err := db.DeleteUserByHash(u.TransmissionRSAHash)
 		//if err != nil {
 		//	return errors.WithMessagef(err, "Failed to remove user registration tRSA hash: %+v", u.TransmissionRSAHash)
 		//}
 	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return Receipt{MessageID: resp.ApnsID, Status: resp.StatusCode}, true,
+			errors.WithMessagef(ErrQuotaExceeded, "APNS rejected notification: %s", resp.Reason)
+	}
 	jww.DEBUG.Printf("Notified ephemeral ID %+v [%+v] via APNS and received response %+v", target.EphemeralId, target.Token, resp)
-	return true, nil
+	return Receipt{MessageID: resp.ApnsID, Status: resp.StatusCode}, true, nil
+}
+
+// MaxCSV returns the number of bytes of notification CSV which fit in a push
+// to target alongside the rest of the APNS payload.
+func (a *apns) MaxCSV(target storage.GTNResult) int {
+	target.Count = maxCount
+	target.MoreAvailable = true
+	envelope, err := a.buildPayload("", target)
+	if err != nil {
+		jww.ERROR.Printf("Failed to build APNS payload: %+v", err)
+		return 0
+	}
+	marshalled, err := json.Marshal(envelope)
+	if err != nil {
+		jww.ERROR.Printf("Failed to marshal APNS payload: %+v", err)
+		return 0
+	}
+	return csvBudget(a.maxPayload, len(marshalled))
+}
+
+// buildPayload builds the payload carrying csv to target, applying the
+// target's priority tier if one is configured.
+func (a *apns) buildPayload(csv string, target storage.GTNResult) (interface{}, error) {
+	title, body := a.translations.Lookup(target.Locale)
+	title, body = alertText(title, body, target)
+	p := buildAPNSPayload(csv, title, body, target)
+	if target.Silent {
+		return p, nil
+	}
+	sound := a.sound
+	if target.Sound != "" {
+		sound = target.Sound
+	}
+	if sound != "" {
+		p.Sound(sound)
+	}
+	tier, ok := a.tiers[target.Priority]
+	if !ok || (tier.InterruptionLevel == "" && tier.RelevanceScore == 0) {
+		return p, nil
+	}
+	return applyTier(p, tier)
+}
+
+// applyTier adds the tier's fields to the aps dictionary of the payload. The
+// payload builder in the pinned apns2 version has no setters for them, so the
+// payload is round-tripped through a map.
+func applyTier(p *payload.Payload, tier APNSTier) (map[string]interface{}, error) {
+	marshalled, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	if err = json.Unmarshal(marshalled, &m); err != nil {
+		return nil, err
+	}
+	aps, ok := m["aps"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("payload has no aps dictionary")
+	}
+	if tier.InterruptionLevel != "" {
+		aps["interruption-level"] = tier.InterruptionLevel
+	}
+	if tier.RelevanceScore != 0 {
+		aps["relevance-score"] = tier.RelevanceScore
+	}
+	return m, nil
+}
+
+// buildAPNSPayload builds the alert payload carrying csv to target, or a
+// background payload without an alert if the push is silent.
+func buildAPNSPayload(csv, title, body string, target storage.GTNResult) *payload.Payload {
+	p := payload.NewPayload()
+	if target.Silent {
+		p.ContentAvailable().Custom(constants.NotificationSilentTag, true)
+	} else {
+		if title != "" {
+			p.AlertTitle(title)
+		}
+		p.AlertBody(body).MutableContent()
+	}
+	p.Custom(
+		constants.NotificationsTag, csv).Custom(
+		constants.NotificationsMoreTag, target.MoreAvailable)
+	if revealsCount(target) {
+		p.Custom(constants.NotificationsCountTag, target.Count)
+	}
+	for k, v := range privacyFields(target) {
+		p.Custom(k, v)
+	}
+	if target.Broadcast != "" {
+		p.Custom(constants.NotificationBroadcastTag, target.Broadcast)
+	}
+	if target.Reregister != "" {
+		p.Custom(constants.NotificationReregisterTag, target.Reregister)
+	}
+	if target.Digested {
+		p.Custom(constants.NotificationDigestTag, true)
+	}
+	if target.Test {
+		p.Custom(constants.NotificationTestTag, true)
+	}
+	return p
 }
 
 func (a *apns) GetTopic() string {
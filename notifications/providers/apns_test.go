@@ -0,0 +1,165 @@
+package providers
+
+import (
+	"encoding/json"
+	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"testing"
+)
+
+// Tests that the priority tier of the target is applied to the aps dictionary
+// and that targets in the default tier are left untouched.
+func TestApns_buildPayload_Tier(t *testing.T) {
+	a := &apns{
+		maxPayload: APNSMaxPayload,
+		tiers: map[string]APNSTier{
+			"calls": {InterruptionLevel: "time-sensitive", RelevanceScore: 1},
+		},
+	}
+
+	for priority, expected := range map[string]string{"calls": "time-sensitive", "": ""} {
+		p, err := a.buildPayload("csv", storage.GTNResult{Priority: priority})
+		if err != nil {
+			t.Fatalf("Failed to build payload: %+v", err)
+		}
+		marshalled, err := json.Marshal(p)
+		if err != nil {
+			t.Fatalf("Failed to marshal payload: %+v", err)
+		}
+		var decoded struct {
+			Aps struct {
+				InterruptionLevel string  `json:"interruption-level"`
+				RelevanceScore    float64 `json:"relevance-score"`
+			} `json:"aps"`
+		}
+		if err = json.Unmarshal(marshalled, &decoded); err != nil {
+			t.Fatalf("Failed to unmarshal payload: %+v", err)
+		}
+		if decoded.Aps.InterruptionLevel != expected {
+			t.Errorf("Unexpected interruption level for priority %q\n\tExpected: %q\n\tReceived: %q",
+				priority, expected, decoded.Aps.InterruptionLevel)
+		}
+	}
+}
+
+// Tests that silent pushes are built as background pushes without an alert,
+// sound or tier.
+func TestApns_buildPayload_Silent(t *testing.T) {
+	a := &apns{
+		maxPayload: APNSMaxPayload,
+		sound:      "default",
+		tiers:      map[string]APNSTier{"calls": {InterruptionLevel: "time-sensitive"}},
+	}
+	p, err := a.buildPayload("csv", storage.GTNResult{Priority: "calls", Silent: true})
+	if err != nil {
+		t.Fatalf("Failed to build payload: %+v", err)
+	}
+	marshalled, err := json.Marshal(p)
+	if err != nil {
+		t.Fatalf("Failed to marshal payload: %+v", err)
+	}
+	var decoded struct {
+		Aps map[string]interface{} `json:"aps"`
+	}
+	if err = json.Unmarshal(marshalled, &decoded); err != nil {
+		t.Fatalf("Failed to unmarshal payload: %+v", err)
+	}
+	if decoded.Aps["content-available"] != float64(1) {
+		t.Errorf("Silent push should be a background push: %s", marshalled)
+	}
+	for _, key := range []string{"alert", "sound", "interruption-level", "mutable-content"} {
+		if _, ok := decoded.Aps[key]; ok {
+			t.Errorf("Silent push should not set %s: %s", key, marshalled)
+		}
+	}
+}
+
+// Tests that the alert and data of a push reveal only what the target's
+// privacy level allows.
+func TestApns_buildPayload_Privacy(t *testing.T) {
+	a := &apns{maxPayload: APNSMaxPayload}
+	tests := []struct {
+		level   constants.PrivacyLevel
+		body    string
+		count   bool
+		service string
+	}{
+		{constants.PrivacyDefault, constants.NotificationBody, true, ""},
+		{constants.PrivacyGeneric, constants.NotificationGenericBody, false, ""},
+		{constants.PrivacyCount, "You have 3 new messages", true, ""},
+		{constants.PrivacyService, "You have 3 new messages", true, "acme"},
+	}
+	for _, tt := range tests {
+		target := storage.GTNResult{App: "acme/apns", Count: 3, Privacy: string(tt.level)}
+		p, err := a.buildPayload("csv", target)
+		if err != nil {
+			t.Fatalf("Failed to build payload: %+v", err)
+		}
+		marshalled, err := json.Marshal(p)
+		if err != nil {
+			t.Fatalf("Failed to marshal payload: %+v", err)
+		}
+		var decoded map[string]interface{}
+		if err = json.Unmarshal(marshalled, &decoded); err != nil {
+			t.Fatalf("Failed to unmarshal payload: %+v", err)
+		}
+		alert := decoded["aps"].(map[string]interface{})["alert"].(map[string]interface{})
+		if alert["body"] != tt.body {
+			t.Errorf("Unexpected body at level %q\n\tExpected: %q\n\tReceived: %q", tt.level, tt.body, alert["body"])
+		}
+		if _, ok := decoded[constants.NotificationsCountTag]; ok != tt.count {
+			t.Errorf("Count should be sent at level %q: %t, payload: %s", tt.level, tt.count, marshalled)
+		}
+		if service, _ := decoded[constants.NotificationServiceTag].(string); service != tt.service {
+			t.Errorf("Unexpected service tag at level %q\n\tExpected: %q\n\tReceived: %q", tt.level, tt.service, service)
+		}
+	}
+}
+
+// Tests that a push carries the alert text and conversation of its target,
+// withholding the conversation at the generic privacy level.
+func TestApns_buildPayload_Conversation(t *testing.T) {
+	a := &apns{maxPayload: APNSMaxPayload}
+	for _, level := range []constants.PrivacyLevel{constants.PrivacyDefault, constants.PrivacyGeneric} {
+		target := storage.GTNResult{App: "app", Privacy: string(level), Conversation: "group", AlertBody: "New group message"}
+		p, err := a.buildPayload("csv", target)
+		if err != nil {
+			t.Fatalf("Failed to build payload: %+v", err)
+		}
+		marshalled, err := json.Marshal(p)
+		if err != nil {
+			t.Fatalf("Failed to marshal payload: %+v", err)
+		}
+		var decoded map[string]interface{}
+		if err = json.Unmarshal(marshalled, &decoded); err != nil {
+			t.Fatalf("Failed to unmarshal payload: %+v", err)
+		}
+		body := decoded["aps"].(map[string]interface{})["alert"].(map[string]interface{})["body"]
+		conversation, _ := decoded[constants.NotificationConversationTag].(string)
+		if level == constants.PrivacyGeneric {
+			if body != constants.NotificationGenericBody || conversation != "" {
+				t.Errorf("Generic push should reveal nothing: %s", marshalled)
+			}
+		} else if body != "New group message" || conversation != "group" {
+			t.Errorf("Push should carry its conversation: %s", marshalled)
+		}
+	}
+}
+
+// Tests that tiers with unknown interruption levels or out of range relevance
+// scores are rejected.
+func TestAPNSTier_validate(t *testing.T) {
+	invalid := []APNSTier{
+		{InterruptionLevel: "urgent"},
+		{RelevanceScore: 1.5},
+		{RelevanceScore: -0.1},
+	}
+	for _, tier := range invalid {
+		if err := tier.validate(); err == nil {
+			t.Errorf("Expected error validating %+v", tier)
+		}
+	}
+	if err := (APNSTier{InterruptionLevel: "critical", RelevanceScore: 0.5}).validate(); err != nil {
+		t.Errorf("Unexpected error validating valid tier: %+v", err)
+	}
+}
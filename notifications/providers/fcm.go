@@ -9,26 +9,117 @@ package providers
 
 import (
 	"context"
+	"encoding/json"
 	firebase "firebase.google.com/go"
 	"firebase.google.com/go/messaging"
 	"github.com/pkg/errors"
 	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/elixxir/notifications-bot/proxy"
 	"gitlab.com/elixxir/notifications-bot/storage"
 	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
 
+// FCMParams holds the configuration of an FCM provider.
+type FCMParams struct {
+	// CredentialsPath is the path to the firebase service account key
+	CredentialsPath string
+	// ChannelID is the Android notification channel the client should post
+	// pushes to, for tokens without their own channel
+	ChannelID string
+	// Sound is the sound the client should play, for tokens without their
+	// own sound
+	Sound string
+	// TTL is how long FCM holds a push for an offline device before dropping
+	// it; DefaultPushTTL if unset
+	TTL time.Duration
+	// AnalyticsLabel segments deliveries in the Firebase console. {app} is
+	// replaced by the target's app and {type} by the kind of push:
+	// notification, broadcast, reregister or heartbeat. Characters FCM does
+	// not allow in labels are replaced by underscores. No label is set if
+	// empty.
+	AnalyticsLabel string
+
+	// Endpoint replaces the scheme and host of the FCM API, so pushes can be
+	// sent to a fake FCM server in tests. Requests to it are not
+	// authenticated, and ProjectID is used in place of the credentials'.
+	Endpoint  string
+	ProjectID string
+
+	// Proxy routes requests to FCM through an egress proxy; nil connects
+	// directly
+	Proxy *proxy.Proxies
+}
+
+// fcmScopes are the OAuth scopes requested for the credentials when FCM
+// requests are sent through a proxy.
+var fcmScopes = []string{"https://www.googleapis.com/auth/firebase.messaging"}
+
+// endpointTransport sends FCM API requests to another scheme and host.
+type endpointTransport struct {
+	endpoint *url.URL
+	base     http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t endpointTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.URL.Scheme = t.endpoint.Scheme
+	r.URL.Host = t.endpoint.Host
+	r.Host = t.endpoint.Host
+	return t.base.RoundTrip(r)
+}
+
 // fcm struct representing Firebase cloud messaging providers
 type fcm struct {
-	client *messaging.Client
+	client    *messaging.Client
+	channelID string
+	sound     string
+	ttl       time.Duration
+	// analyticsLabel is the label template; see FCMParams
+	analyticsLabel string
 }
 
+// fcmLabelLength is the longest analytics label FCM accepts.
+const fcmLabelLength = 50
+
+// fcmLabelReplacer replaces characters FCM does not allow in analytics labels.
+var fcmLabelReplacer = regexp.MustCompile(`[^a-zA-Z0-9\-_.~%]`)
+
 // NewFCM returns an FCM-backed provider interface.
-func NewFCM(serviceKeyPath string) (Provider, error) {
+func NewFCM(params FCMParams) (Provider, error) {
+	serviceKeyPath := params.CredentialsPath
 	ctx := context.Background()
-	opt := option.WithCredentialsFile(serviceKeyPath)
-	app, err := firebase.NewApp(context.Background(), nil, opt)
+	opts := []option.ClientOption{option.WithCredentialsFile(serviceKeyPath)}
+	var config *firebase.Config
+	if params.Endpoint != "" {
+		endpoint, err := url.Parse(params.Endpoint)
+		if err != nil || endpoint.Host == "" {
+			return nil, errors.Errorf("Invalid FCM endpoint %q", params.Endpoint)
+		}
+		jww.WARN.Printf("Sending FCM pushes to %s", endpoint)
+		opts = []option.ClientOption{option.WithHTTPClient(&http.Client{
+			Transport: endpointTransport{endpoint: endpoint, base: params.Proxy.Transport()},
+		})}
+		config = &firebase.Config{ProjectID: params.ProjectID}
+	} else if params.Proxy != nil {
+		// A client passed in is used as is, so it is authorised with the
+		// credentials here; they are still read by the app for the project ID
+		transport, err := htransport.NewTransport(ctx, params.Proxy.Transport(),
+			option.WithCredentialsFile(serviceKeyPath), option.WithScopes(fcmScopes...))
+		if err != nil {
+			return nil, errors.WithMessage(err, "Failed to set up proxied FCM transport")
+		}
+		opts = append(opts, option.WithHTTPClient(&http.Client{Transport: transport}))
+	}
+	app, err := firebase.NewApp(context.Background(), config, opts...)
 	if err != nil {
 		return nil, errors.Errorf("Error initializing app: %v", err)
 	}
@@ -39,41 +130,153 @@ func NewFCM(serviceKeyPath string) (Provider, error) {
 	}
 
 	return &fcm{
-		client: cl,
+		client:    cl,
+		channelID: params.ChannelID,
+		sound:     params.Sound,
+		ttl:       pushTTL(params.TTL),
+
+		analyticsLabel: params.AnalyticsLabel,
 	}, nil
 }
 
 // Notify implements the Provider interface for FCM, sending the notifications to the provider.
-func (f *fcm) Notify(csv string, target storage.GTNResult) (bool, error) {
-	ctx := context.Background()
-	ttl := 7 * 24 * time.Hour
+func (f *fcm) Notify(ctx context.Context, csv string, target storage.GTNResult) (Receipt, bool, error) {
+	return categorise(f.notify(ctx, csv, target))
+}
+
+// notify sends the notifications to FCM, returning the receipt, whether the
+// token is still valid and the error of a failed send.
+func (f *fcm) notify(ctx context.Context, csv string, target storage.GTNResult) (Receipt, bool, error) {
+	ttl := f.ttl
 	message := &messaging.Message{
-		Data: map[string]string{
-			"notificationsTag": csv, // TODO: swap to notificationsTag constant from notifications package (move to avoid circular dep)
-		},
+		Data: f.buildData(csv, target),
 		Android: &messaging.AndroidConfig{
 			Priority: "high",
 			TTL:      &ttl,
 		},
 		Token: target.Token,
 	}
+	if label := f.buildLabel(csv, target); label != "" {
+		message.FCMOptions = &messaging.FCMOptions{AnalyticsLabel: label}
+	}
 
 	resp, err := f.client.Send(ctx, message)
 	if err != nil {
-		// Check token validity
-		validToken := true
-		invalidToken := strings.Contains(err.Error(), "400") &&
-			strings.Contains(err.Error(), "Invalid registration")
-
-		if strings.Contains(err.Error(), "404") || invalidToken {
-			validToken = false
-			err = errors.WithMessagef(err, "Failed to notify user with Transmission RSA hash %+v due to invalid token", target.TransmissionRSAHash)
-		} else {
-			err = errors.WithMessagef(err, "Failed to notify user with Transmission RSA hash %+v", target.TransmissionRSAHash)
-		}
-
-		return validToken, err
+		validToken, err := classifyFCMError(err)
+		return Receipt{}, validToken, errors.WithMessagef(err, "Failed to notify user with Transmission RSA hash %+v", target.TransmissionRSAHash)
 	}
 	jww.DEBUG.Printf("Notified ephemeral ID %+v [%+v] via fcm and received response %+v", target.EphemeralId, target.Token, resp)
-	return true, nil
+	return Receipt{MessageID: resp, Status: http.StatusOK}, true, nil
+}
+
+// checkToken is the placeholder token validated by Check.
+const checkToken = "notifications-bot-self-check"
+
+// Check verifies the provider's credentials by validating a message to a
+// placeholder token without sending it. FCM only gets to rejecting the token
+// once it has accepted the credentials.
+func (f *fcm) Check(ctx context.Context) error {
+	_, err := f.client.SendDryRun(ctx, &messaging.Message{Token: checkToken})
+	if err == nil || messaging.IsInvalidArgument(err) || messaging.IsRegistrationTokenNotRegistered(err) {
+		return nil
+	}
+	return errors.WithMessage(err, "FCM rejected the credentials")
+}
+
+// buildLabel returns the analytics label of a push carrying csv to target, or
+// an empty string if no label is configured.
+func (f *fcm) buildLabel(csv string, target storage.GTNResult) string {
+	if f.analyticsLabel == "" {
+		return ""
+	}
+	label := strings.NewReplacer("{app}", target.App, "{type}", pushType(csv, target)).Replace(f.analyticsLabel)
+	label = fcmLabelReplacer.ReplaceAllString(label, "_")
+	if len(label) > fcmLabelLength {
+		label = label[:fcmLabelLength]
+	}
+	return label
+}
+
+// classifyFCMError returns whether the token of a send which failed with err
+// is still valid, and err wrapped with the class of failure it is handled as:
+//   - Tokens which are no longer registered, belong to another firebase
+//     project or are malformed are invalid and purged. The bot builds every
+//     message the same way, so an invalid argument is blamed on the token.
+//   - Quota errors wrap ErrQuotaExceeded, slowing sends down before they are
+//     retried.
+//   - Rejected APNS credentials of the firebase project wrap ErrMisconfigured
+//     and are raised as alerts without being retried.
+//   - Anything else, such as FCM being unavailable, is retried.
+func classifyFCMError(err error) (bool, error) {
+	switch {
+	case messaging.IsRegistrationTokenNotRegistered(err), messaging.IsMismatchedCredential(err),
+		messaging.IsInvalidArgument(err):
+		return false, errors.WithMessage(err, "invalid token")
+	case messaging.IsMessageRateExceeded(err):
+		return true, errors.WithMessage(ErrQuotaExceeded, err.Error())
+	case messaging.IsInvalidAPNSCredentials(err):
+		return true, errors.WithMessage(ErrMisconfigured, err.Error())
+	default:
+		return true, err
+	}
+}
+
+// MaxCSV returns the number of bytes of notification CSV which fit in the data
+// of an FCM message to target alongside the other data fields.
+func (f *fcm) MaxCSV(target storage.GTNResult) int {
+	target.Count = maxCount
+	target.MoreAvailable = true
+	envelope, err := json.Marshal(f.buildData("", target))
+	if err != nil {
+		jww.ERROR.Printf("Failed to marshal FCM data: %+v", err)
+		return 0
+	}
+	return csvBudget(FCMMaxPayload, len(envelope))
+}
+
+// buildData builds the data fields of a message carrying csv to target. The
+// client builds the displayed notification itself, so the channel and sound
+// are passed as data, preferring the target's own over the provider defaults.
+// The client renders at the privacy level passed along, and the count is
+// withheld if the level does not reveal it.
+func (f *fcm) buildData(csv string, target storage.GTNResult) map[string]string {
+	data := map[string]string{
+		"notificationsTag":             csv, // TODO: swap to notificationsTag constant from notifications package (move to avoid circular dep)
+		constants.NotificationsMoreTag: strconv.FormatBool(target.MoreAvailable),
+	}
+	if revealsCount(target) {
+		data[constants.NotificationsCountTag] = strconv.Itoa(target.Count)
+	}
+	for k, v := range privacyFields(target) {
+		data[k] = v
+	}
+	channelID, sound := f.channelID, f.sound
+	if target.ChannelID != "" {
+		channelID = target.ChannelID
+	}
+	if target.Sound != "" {
+		sound = target.Sound
+	}
+	if channelID != "" {
+		data[constants.NotificationChannelTag] = channelID
+	}
+	if sound != "" {
+		data[constants.NotificationSoundTag] = sound
+	}
+	if target.Broadcast != "" {
+		data[constants.NotificationBroadcastTag] = target.Broadcast
+	}
+	if target.Reregister != "" {
+		data[constants.NotificationReregisterTag] = target.Reregister
+	}
+	if target.Silent {
+		data[constants.NotificationSilentTag] = "true"
+	}
+	if target.Digested {
+		data[constants.NotificationDigestTag] = "true"
+	}
+	if target.Test {
+		data[constants.NotificationTestTag] = "true"
+	}
+	return data
 }
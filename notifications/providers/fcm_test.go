@@ -0,0 +1,107 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/notifications-bot/errs"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+// fcmLabelPattern matches the analytics labels FCM accepts.
+var fcmLabelPattern = regexp.MustCompile(`^[a-zA-Z0-9\-_.~%]{1,50}$`)
+
+// fcmErrors maps the tokens sent to the fake FCM server to the HTTP status,
+// status and FCM error code it rejects them with.
+var fcmErrors = map[string]struct {
+	httpStatus      int
+	status, fcmCode string
+}{
+	"unregistered": {http.StatusNotFound, "NOT_FOUND", "UNREGISTERED"},
+	"mismatch":     {http.StatusForbidden, "PERMISSION_DENIED", "SENDER_ID_MISMATCH"},
+	"quota":        {http.StatusTooManyRequests, "RESOURCE_EXHAUSTED", "QUOTA_EXCEEDED"},
+	"apnsAuth":     {http.StatusUnauthorized, "UNAUTHENTICATED", "THIRD_PARTY_AUTH_ERROR"},
+}
+
+// Tests that FCM errors are classified by their error code: unregistered and
+// mismatched tokens are invalid, quota errors wrap ErrQuotaExceeded and
+// rejected APNS credentials wrap ErrMisconfigured. Invalid tokens are
+// categorised as permanent and quota errors as transient.
+func TestFCM_Notify_Errors(t *testing.T) {
+	var token string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := fcmErrors[token]
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(e.httpStatus)
+		_, _ = fmt.Fprintf(w, `{"error": {"code": %d, "message": "rejected", "status": %q, "details": [`+
+			`{"@type": "type.googleapis.com/google.firebase.fcm.v1.FcmError", "errorCode": %q}]}}`,
+			e.httpStatus, e.status, e.fcmCode)
+	}))
+	defer server.Close()
+	p, err := NewFCM(FCMParams{Endpoint: server.URL, ProjectID: "test"})
+	if err != nil {
+		t.Fatalf("Failed to create FCM provider: %+v", err)
+	}
+
+	expected := map[string]struct {
+		valid           bool
+		class, category error
+	}{
+		"unregistered": {false, nil, errs.ErrProviderPermanent},
+		"mismatch":     {false, nil, errs.ErrProviderPermanent},
+		"quota":        {true, ErrQuotaExceeded, errs.ErrProviderTransient},
+		"apnsAuth":     {true, ErrMisconfigured, nil},
+	}
+	for token = range fcmErrors {
+		_, valid, err := p.Notify(context.Background(), "csv", storage.GTNResult{Token: token})
+		if err == nil {
+			t.Errorf("%s: send should fail", token)
+			continue
+		}
+		e := expected[token]
+		if valid != e.valid {
+			t.Errorf("%s: expected token validity %t, got %t", token, e.valid, valid)
+		}
+		if e.class != nil && !errors.Is(err, e.class) {
+			t.Errorf("%s: expected error wrapping %v, got %+v", token, e.class, err)
+		}
+		for _, category := range []error{errs.ErrProviderPermanent, errs.ErrProviderTransient} {
+			if errors.Is(err, category) != (category == e.category) {
+				t.Errorf("%s: expected error category %v, got %+v", token, e.category, err)
+			}
+		}
+	}
+}
+
+// Tests that analytics labels are filled in by app and push type, with
+// characters FCM rejects replaced and long labels truncated.
+func TestFcm_buildLabel(t *testing.T) {
+	f := &fcm{analyticsLabel: "{app}_{type}"}
+	labels := map[string]storage.GTNResult{
+		"messengerAndroid_notification": {App: "messengerAndroid"},
+		"acme_fcm_broadcast":            {App: "acme/fcm", Broadcast: "hello"},
+		"havenAndroid_reregister":       {App: "havenAndroid", Reregister: "havenIOS"},
+	}
+	for expected, target := range labels {
+		if label := f.buildLabel("csv", target); label != expected {
+			t.Errorf("Expected label %q, got %q", expected, label)
+		}
+	}
+	if label := f.buildLabel("", storage.GTNResult{App: "messengerAndroid"}); label != "messengerAndroid_heartbeat" {
+		t.Errorf("Pushes without notifications should be labelled as heartbeats, got %q", label)
+	}
+
+	f.analyticsLabel = "{app} {type} with a very long suffix exceeding the limit"
+	label := f.buildLabel("csv", storage.GTNResult{App: "messengerAndroid"})
+	if len(label) != fcmLabelLength || !fcmLabelPattern.MatchString(label) {
+		t.Errorf("Label %q is not valid for FCM", label)
+	}
+
+	if label = (&fcm{}).buildLabel("csv", storage.GTNResult{App: "messengerAndroid"}); label != "" {
+		t.Errorf("No label should be set when unconfigured, got %q", label)
+	}
+}
@@ -0,0 +1,65 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package providers
+
+import "gitlab.com/elixxir/notifications-bot/storage"
+
+// Maximum payload sizes accepted by the providers, in bytes.
+const (
+	// APNSMaxPayload is the limit for regular remote notifications
+	APNSMaxPayload = 4096
+	// APNSLegacyMaxPayload is the limit applied by the legacy APNS interface
+	APNSLegacyMaxPayload = 2048
+	// FCMMaxPayload is the limit for the data of an FCM message
+	FCMMaxPayload = 4096
+)
+
+// maxCount is used in place of the notification count when sizing the
+// payload envelope, so any real count fits.
+const maxCount = 99999
+
+// pushType returns the kind of push carrying csv to target: a broadcast, a
+// nudge to re-register a sibling device, a digest summary, a test push
+// requested by the user, a canary heartbeat (which carries no notifications)
+// or a regular notification.
+func pushType(csv string, target storage.GTNResult) string {
+	switch {
+	case target.Broadcast != "":
+		return "broadcast"
+	case target.Reregister != "":
+		return "reregister"
+	case target.Digested:
+		return "digest"
+	case target.Test:
+		return "test"
+	case csv == "":
+		return "heartbeat"
+	default:
+		return "notification"
+	}
+}
+
+// PayloadLimiter is implemented by providers which cap the size of a push.
+type PayloadLimiter interface {
+	// MaxCSV returns the number of bytes of notification CSV which fit in a
+	// single push to target
+	MaxCSV(target storage.GTNResult) int
+}
+
+// csvBudget returns the space left for CSV in a payload of maxPayload bytes
+// once the envelope is accounted for. CSV rows are newline separated and each
+// newline is escaped to two bytes in JSON; rows are longer than 64 bytes, so
+// one byte in 64 is reserved for escaping.
+func csvBudget(maxPayload, envelope int) int {
+	budget := maxPayload - envelope
+	budget -= budget / 64
+	if budget < 0 {
+		return 0
+	}
+	return budget
+}
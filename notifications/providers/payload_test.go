@@ -0,0 +1,91 @@
+package providers
+
+import (
+	"encoding/json"
+	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gitlab.com/elixxir/primitives/notifications"
+	"math/rand"
+	"testing"
+)
+
+// generateNotifications returns n notifications with random contents.
+func generateNotifications(t *testing.T, n int) []*notifications.Data {
+	rng := rand.New(rand.NewSource(42))
+	var data []*notifications.Data
+	for i := 0; i < n; i++ {
+		msgHash := make([]byte, 32)
+		identityFP := make([]byte, 25)
+		rng.Read(msgHash)
+		rng.Read(identityFP)
+		data = append(data, &notifications.Data{
+			EphemeralID: rng.Int63(),
+			RoundID:     rng.Uint64(),
+			MessageHash: msgHash,
+			IdentityFP:  identityFP,
+		})
+	}
+	return data
+}
+
+// Tests that a full CSV built to the MaxCSV budget fits within the APNS 4KB
+// and legacy 2KB limits.
+func TestApns_MaxCSV(t *testing.T) {
+	data := generateNotifications(t, 200)
+	for _, limit := range []int{APNSMaxPayload, APNSLegacyMaxPayload} {
+		a := &apns{maxPayload: limit}
+		csv, rest := notifications.BuildNotificationCSV(data, a.MaxCSV(storage.GTNResult{}))
+		if len(rest) == 0 {
+			t.Fatalf("Test data should not fit in a %d byte payload", limit)
+		}
+
+		target := storage.GTNResult{Count: len(data) - len(rest), MoreAvailable: true}
+		p, err := a.buildPayload(string(csv), target)
+		if err != nil {
+			t.Fatalf("Failed to build payload: %+v", err)
+		}
+		marshalled, err := json.Marshal(p)
+		if err != nil {
+			t.Fatalf("Failed to marshal payload: %+v", err)
+		}
+		if len(marshalled) > limit {
+			t.Errorf("Payload of %d bytes exceeds the %d byte limit", len(marshalled), limit)
+		}
+	}
+}
+
+// Tests that a full CSV built to the MaxCSV budget fits within the FCM data
+// limit.
+func TestFcm_MaxCSV(t *testing.T) {
+	data := generateNotifications(t, 200)
+	f := &fcm{}
+	csv, rest := notifications.BuildNotificationCSV(data, f.MaxCSV(storage.GTNResult{}))
+	if len(rest) == 0 {
+		t.Fatal("Test data should not fit in a single payload")
+	}
+
+	target := storage.GTNResult{Count: len(data) - len(rest), MoreAvailable: true}
+	marshalled, err := json.Marshal(f.buildData(string(csv), target))
+	if err != nil {
+		t.Fatalf("Failed to marshal data: %+v", err)
+	}
+	if len(marshalled) > FCMMaxPayload {
+		t.Errorf("Payload of %d bytes exceeds the %d byte limit", len(marshalled), FCMMaxPayload)
+	}
+}
+
+// Tests that the channel and sound of the target override the provider
+// defaults in the FCM data.
+func TestFcm_buildData_Sound(t *testing.T) {
+	f := &fcm{channelID: "default", sound: "chime"}
+
+	data := f.buildData("csv", storage.GTNResult{})
+	if data[constants.NotificationChannelTag] != "default" || data[constants.NotificationSoundTag] != "chime" {
+		t.Errorf("Provider defaults were not used: %+v", data)
+	}
+
+	data = f.buildData("csv", storage.GTNResult{ChannelID: "calls", Sound: "ring"})
+	if data[constants.NotificationChannelTag] != "calls" || data[constants.NotificationSoundTag] != "ring" {
+		t.Errorf("Target overrides were not used: %+v", data)
+	}
+}
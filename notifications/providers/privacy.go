@@ -0,0 +1,84 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package providers
+
+import (
+	"fmt"
+	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/elixxir/notifications-bot/storage"
+)
+
+// alertText returns the alert title and body of a push to target, limited to
+// what the target's privacy level reveals. The passed in title and body are
+// the text shown at the default level, unless the target carries the alert
+// text of its conversation. Broadcasts are operator messages and test pushes
+// reveal nothing, so both are shown at every level.
+func alertText(title, body string, target storage.GTNResult) (string, string) {
+	if target.Broadcast != "" {
+		return title, target.Broadcast
+	}
+	if target.Test {
+		return title, constants.NotificationTestBody
+	}
+	if target.AlertTitle != "" {
+		title = target.AlertTitle
+	}
+	if target.AlertBody != "" {
+		body = target.AlertBody
+	}
+	switch constants.PrivacyLevel(target.Privacy) {
+	case constants.PrivacyGeneric:
+		return "", constants.NotificationGenericBody
+	case constants.PrivacyCount, constants.PrivacyService:
+		if target.Count > 0 {
+			body = fmt.Sprintf(constants.NotificationDigestBody, target.Count)
+		}
+		return title, body
+	}
+	if target.Digested {
+		body = fmt.Sprintf(constants.NotificationDigestBody, target.Count)
+	}
+	return title, body
+}
+
+// revealsCount returns false if the privacy level of target withholds the
+// number of notifications in a push from the client.
+func revealsCount(target storage.GTNResult) bool {
+	return constants.PrivacyLevel(target.Privacy) != constants.PrivacyGeneric
+}
+
+// privacyFields returns the data fields telling the client which privacy
+// level to render a push to target at, and the service tag and conversation
+// if the level reveals them. It returns nil if there are none.
+func privacyFields(target storage.GTNResult) map[string]string {
+	level := constants.PrivacyLevel(target.Privacy)
+	fields := map[string]string{}
+	if level != constants.PrivacyDefault {
+		fields[constants.NotificationPrivacyTag] = string(level)
+	}
+	if level == constants.PrivacyService {
+		fields[constants.NotificationServiceTag] = serviceTag(target.App)
+	}
+	if target.Conversation != "" && level != constants.PrivacyGeneric {
+		fields[constants.NotificationConversationTag] = target.Conversation
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return fields
+}
+
+// serviceTag returns the service pushes for app are from: the tenant of a
+// tenant app, or the app itself.
+func serviceTag(app string) string {
+	tenant, name := constants.SplitTenant(app)
+	if tenant != "" {
+		return tenant
+	}
+	return name
+}
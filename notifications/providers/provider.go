@@ -9,11 +9,72 @@
 
 package providers
 
-import "gitlab.com/elixxir/notifications-bot/storage"
+import (
+	"context"
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/notifications-bot/errs"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"time"
+)
+
+// DefaultPushTTL is how long push services hold a push for an offline device
+// when no TTL is configured.
+const DefaultPushTTL = 7 * 24 * time.Hour
+
+// pushTTL returns the passed in TTL, or DefaultPushTTL if it is not set.
+func pushTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		return DefaultPushTTL
+	}
+	return ttl
+}
+
+// ErrQuotaExceeded is wrapped by the errors providers return when the push
+// service rejected a send because the sender's quota or rate limit was
+// exceeded. The token is still valid and the send can be retried later.
+var ErrQuotaExceeded = errs.Mark(errors.New("push service quota exceeded"), errs.ErrProviderTransient)
+
+// ErrMisconfigured is wrapped by the errors providers return when the push
+// service rejected a send because of the bot's own configuration, such as
+// revoked credentials. Neither retrying nor purging the token helps, so the
+// failure needs an operator's attention.
+var ErrMisconfigured = errors.New("push service rejected the bot's configuration")
+
+// categorise marks the error of a failed send as a permanent rejection of the
+// token if it is no longer valid, or as a transient failure otherwise. Errors
+// caused by the bot's own configuration are neither and are left unmarked.
+func categorise(receipt Receipt, tokenValid bool, err error) (Receipt, bool, error) {
+	switch {
+	case err == nil, errors.Is(err, ErrMisconfigured):
+	case !tokenValid:
+		err = errs.Mark(err, errs.ErrProviderPermanent)
+	default:
+		err = errs.Mark(err, errs.ErrProviderTransient)
+	}
+	return receipt, tokenValid, err
+}
 
 // Provider interface represents an external notification provider, implementing
 // an easy-to-use Notify function for the rest of the repo to call.
 type Provider interface {
-	// Notify sends a notification and returns the token status and an error
-	Notify(csv string, target storage.GTNResult) (bool, error)
+	// Notify sends a notification and returns a delivery receipt, the token
+	// status and an error. The send is abandoned if ctx is done first.
+	// Errors of failed sends are categorised as errs.ErrProviderPermanent
+	// or errs.ErrProviderTransient, unless caused by ErrMisconfigured.
+	Notify(ctx context.Context, csv string, target storage.GTNResult) (Receipt, bool, error)
+}
+
+// Checker is implemented by providers which can verify their credentials
+// with the push service without sending a push.
+type Checker interface {
+	// Check returns an error if the push service rejects the credentials
+	Check(ctx context.Context) error
+}
+
+// Receipt holds the delivery information returned by a provider for a send.
+type Receipt struct {
+	// MessageID is the ID assigned to the push by the provider
+	MessageID string
+	// Status is the HTTP status code returned by the provider, or 0 if unknown
+	Status int
 }
@@ -0,0 +1,76 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package providers
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/xx_network/primitives/utils"
+	"strings"
+)
+
+// Translation holds the localized alert text for a locale. Empty fields fall
+// back to the default text.
+type Translation struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+// Translations maps locales, such as "de" or "pt-BR", to alert text.
+type Translations map[string]Translation
+
+// LoadTranslations reads translations from a JSON file mapping locales to
+// objects with title and body fields.
+func LoadTranslations(path string) (Translations, error) {
+	data, err := utils.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "Failed to read translations file %s", path)
+	}
+	var raw Translations
+	if err = json.Unmarshal(data, &raw); err != nil {
+		return nil, errors.WithMessagef(err, "Failed to parse translations file %s", path)
+	}
+
+	t := make(Translations, len(raw))
+	for locale, tr := range raw {
+		t[normalizeLocale(locale)] = tr
+	}
+	return t, nil
+}
+
+// Lookup returns the alert title and body for locale. A locale without its
+// own translation falls back to its base language, then to the default text.
+func (t Translations) Lookup(locale string) (title, body string) {
+	title, body = constants.NotificationTitle, constants.NotificationBody
+	locale = normalizeLocale(locale)
+	if locale == "" {
+		return
+	}
+
+	tr, ok := t[locale]
+	if !ok {
+		tr, ok = t[strings.SplitN(locale, "-", 2)[0]]
+	}
+	if !ok {
+		return
+	}
+	if tr.Title != "" {
+		title = tr.Title
+	}
+	if tr.Body != "" {
+		body = tr.Body
+	}
+	return
+}
+
+// normalizeLocale lowercases locale and uses "-" as its separator, so that
+// "pt_BR" and "pt-br" match the same translation.
+func normalizeLocale(locale string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(locale), "_", "-"))
+}
@@ -0,0 +1,43 @@
+package providers
+
+import (
+	"gitlab.com/elixxir/notifications-bot/constants"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Tests that translations are loaded from file and looked up by exact locale,
+// then base language, then the default text.
+func TestTranslations_Lookup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "translations.json")
+	err := os.WriteFile(path, []byte(`{
+		"de": {"title": "Privatsphäre: geschützt!", "body": "Neue Nachrichten"},
+		"pt_BR": {"title": "Privacidade: protegida!"}
+	}`), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write translations: %+v", err)
+	}
+
+	translations, err := LoadTranslations(path)
+	if err != nil {
+		t.Fatalf("Failed to load translations: %+v", err)
+	}
+
+	tests := []struct {
+		locale, title, body string
+	}{
+		{"de", "Privatsphäre: geschützt!", "Neue Nachrichten"},
+		{"de-AT", "Privatsphäre: geschützt!", "Neue Nachrichten"},
+		{"pt-br", "Privacidade: protegida!", constants.NotificationBody},
+		{"fr", constants.NotificationTitle, constants.NotificationBody},
+		{"", constants.NotificationTitle, constants.NotificationBody},
+	}
+	for _, tt := range tests {
+		title, body := translations.Lookup(tt.locale)
+		if title != tt.title || body != tt.body {
+			t.Errorf("Unexpected text for locale %q\n\tExpected: %q, %q\n\tReceived: %q, %q",
+				tt.locale, tt.title, tt.body, title, body)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package providers
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/elixxir/notifications-bot/proxy"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	// webPushRecordSize is the aes128gcm record size; payloads are sent as a
+	// single record
+	webPushRecordSize = 4096
+	// webPushOverhead is the aes128gcm header, GCM tag and record delimiter
+	webPushOverhead = 16 + 4 + 1 + 65 + 16 + 1
+	vapidExpiry     = 12 * time.Hour
+)
+
+// WebPushParams holds the VAPID configuration of the web push provider.
+type WebPushParams struct {
+	// VAPIDPrivateKey is the base64url encoded P-256 private key scalar
+	VAPIDPrivateKey string
+	// Subject is the contact URI sent to push services, e.g. mailto:ops@xx.network
+	Subject string
+	// TTL is how long push services hold a push for an offline browser
+	// before dropping it; DefaultPushTTL if unset
+	TTL time.Duration
+	// Proxy routes requests to push services through an egress proxy; nil
+	// connects directly
+	Proxy *proxy.Proxies
+}
+
+// webPushSubscription is the PushSubscription a browser client registers as
+// its token, serialized as JSON.
+type webPushSubscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+// webPush sends encrypted pushes to browser push services (RFC 8030, 8291 and
+// 8292).
+type webPush struct {
+	client  *http.Client
+	key     *ecdsa.PrivateKey
+	subject string
+	ttl     time.Duration
+}
+
+// NewWebPush returns a web push provider signing requests with the configured
+// VAPID key.
+func NewWebPush(params WebPushParams) (Provider, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(params.VAPIDPrivateKey)
+	if err != nil || len(raw) != 32 {
+		return nil, errors.New("VAPID private key must be a base64url encoded 32 byte P-256 scalar")
+	}
+	if params.Subject == "" {
+		return nil, errors.New("Web push requires a VAPID subject")
+	}
+	key := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(raw)}
+	key.PublicKey.Curve = elliptic.P256()
+	key.PublicKey.X, key.PublicKey.Y = key.PublicKey.Curve.ScalarBaseMult(raw)
+
+	return &webPush{
+		client:  &http.Client{Timeout: 30 * time.Second, Transport: params.Proxy.Transport()},
+		key:     key,
+		subject: params.Subject,
+		ttl:     pushTTL(params.TTL),
+	}, nil
+}
+
+// Notify implements the Provider interface for web push, encrypting the
+// notifications to the subscription stored as the target's token.
+func (w *webPush) Notify(ctx context.Context, csv string, target storage.GTNResult) (Receipt, bool, error) {
+	return categorise(w.notify(ctx, csv, target))
+}
+
+// notify sends the notifications to web push, returning the receipt, whether the
+// token is still valid and the error of a failed send.
+func (w *webPush) notify(ctx context.Context, csv string, target storage.GTNResult) (Receipt, bool, error) {
+	var sub webPushSubscription
+	if err := json.Unmarshal([]byte(target.Token), &sub); err != nil || sub.Endpoint == "" {
+		return Receipt{}, false, errors.New("Web push token is not a valid subscription")
+	}
+
+	plaintext, err := json.Marshal(buildWebPushData(csv, target))
+	if err != nil {
+		return Receipt{}, true, errors.WithMessage(err, "Failed to marshal web push payload")
+	}
+	if len(plaintext)+webPushOverhead > webPushRecordSize {
+		return Receipt{}, true, errors.Errorf("Web push payload of %d bytes exceeds the record size", len(plaintext))
+	}
+	body, err := encryptWebPush(plaintext, sub)
+	if err != nil {
+		return Receipt{}, false, errors.WithMessage(err, "Failed to encrypt web push payload")
+	}
+	auth, err := w.vapidAuthorization(sub.Endpoint)
+	if err != nil {
+		return Receipt{}, true, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return Receipt{}, false, errors.WithMessage(err, "Failed to build web push request")
+	}
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.Itoa(int(w.ttl.Seconds())))
+	req.Header.Set("Urgency", "high")
+	req.Header.Set("Authorization", auth)
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return Receipt{}, true, errors.WithMessage(err, "Failed to send web push")
+	}
+	_ = resp.Body.Close()
+	receipt := Receipt{MessageID: resp.Header.Get("Location"), Status: resp.StatusCode}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return receipt, false, errors.Errorf("Web push subscription for tRSA hash %+v has expired: %s",
+			target.TransmissionRSAHash, resp.Status)
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return receipt, true, errors.WithMessagef(ErrQuotaExceeded, "Web push service returned %s", resp.Status)
+	case resp.StatusCode >= 300:
+		return receipt, true, errors.Errorf("Web push service returned %s", resp.Status)
+	}
+	jww.DEBUG.Printf("Notified ephemeral ID %+v via web push and received response %s", target.EphemeralId, resp.Status)
+	return receipt, true, nil
+}
+
+// MaxCSV returns the number of bytes of notification CSV which fit in a
+// single encrypted record alongside the rest of the payload.
+func (w *webPush) MaxCSV(target storage.GTNResult) int {
+	target.Count = maxCount
+	target.MoreAvailable = true
+	envelope, err := json.Marshal(buildWebPushData("", target))
+	if err != nil {
+		jww.ERROR.Printf("Failed to marshal web push payload: %+v", err)
+		return 0
+	}
+	return csvBudget(webPushRecordSize-webPushOverhead, len(envelope))
+}
+
+// buildWebPushData builds the JSON payload delivered to the service worker.
+// The count is withheld if the target's privacy level does not reveal it.
+func buildWebPushData(csv string, target storage.GTNResult) map[string]interface{} {
+	data := map[string]interface{}{
+		constants.NotificationsTag:     csv,
+		constants.NotificationsMoreTag: target.MoreAvailable,
+	}
+	if revealsCount(target) {
+		data[constants.NotificationsCountTag] = target.Count
+	}
+	for k, v := range privacyFields(target) {
+		data[k] = v
+	}
+	if target.Broadcast != "" {
+		data[constants.NotificationBroadcastTag] = target.Broadcast
+	}
+	if target.Reregister != "" {
+		data[constants.NotificationReregisterTag] = target.Reregister
+	}
+	if target.Silent {
+		data[constants.NotificationSilentTag] = true
+	}
+	if target.Digested {
+		data[constants.NotificationDigestTag] = true
+	}
+	if target.Test {
+		data[constants.NotificationTestTag] = true
+	}
+	return data
+}
+
+// vapidAuthorization returns the VAPID Authorization header for a push to
+// endpoint (RFC 8292).
+func (w *webPush) vapidAuthorization(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", errors.WithMessage(err, "Invalid web push endpoint")
+	}
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": time.Now().Add(vapidExpiry).Unix(),
+		"sub": w.subject,
+	})
+	if err != nil {
+		return "", err
+	}
+	signingInput := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, w.key, digest[:])
+	if err != nil {
+		return "", errors.WithMessage(err, "Failed to sign VAPID token")
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+
+	jwt := signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+	pub := elliptic.Marshal(w.key.Curve, w.key.X, w.key.Y)
+	return fmt.Sprintf("vapid t=%s, k=%s", jwt, base64.RawURLEncoding.EncodeToString(pub)), nil
+}
+
+// encryptWebPush encrypts plaintext to the subscription as a single aes128gcm
+// record (RFC 8291).
+func encryptWebPush(plaintext []byte, sub webPushSubscription) ([]byte, error) {
+	uaPublic, err := decodeWebPushKey(sub.Keys.P256dh)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Invalid p256dh key")
+	}
+	authSecret, err := decodeWebPushKey(sub.Keys.Auth)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Invalid auth secret")
+	}
+	curve := elliptic.P256()
+	uaX, uaY := elliptic.Unmarshal(curve, uaPublic)
+	if uaX == nil {
+		return nil, errors.New("p256dh key is not an uncompressed P-256 point")
+	}
+
+	// Ephemeral application server key pair and shared secret
+	asKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := elliptic.Marshal(curve, asKey.X, asKey.Y)
+	sx, _ := curve.ScalarMult(uaX, uaY, asKey.D.Bytes())
+	ecdhSecret := sx.FillBytes(make([]byte, 32))
+
+	keyInfo := append(append([]byte("WebPush: info\x00"), uaPublic...), asPublic...)
+	ikm := hkdf(authSecret, ecdhSecret, keyInfo, 32)
+
+	salt := make([]byte, 16)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// 0x02 marks the last (and only) record
+	record := gcm.Seal(nil, nonce, append(plaintext, 0x02), nil)
+	if len(record) > webPushRecordSize {
+		return nil, errors.Errorf("payload of %d bytes exceeds the record size", len(plaintext))
+	}
+
+	header := make([]byte, 0, 16+4+1+len(asPublic))
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, webPushRecordSize)
+	header = append(header, byte(len(asPublic)))
+	header = append(header, asPublic...)
+	return append(header, record...), nil
+}
+
+// hkdf derives length bytes from ikm with HKDF-SHA256. Every output used by
+// web push fits in a single HMAC block.
+func hkdf(salt, ikm, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(ikm)
+	prk := extract.Sum(nil)
+
+	expand := hmac.New(sha256.New, prk)
+	expand.Write(info)
+	expand.Write([]byte{0x01})
+	return expand.Sum(nil)[:length]
+}
+
+// decodeWebPushKey decodes a key from a subscription, which browsers encode
+// as unpadded base64url.
+func decodeWebPushKey(key string) ([]byte, error) {
+	if decoded, err := base64.RawURLEncoding.DecodeString(key); err == nil {
+		return decoded, nil
+	}
+	return base64.URLEncoding.DecodeString(key)
+}
@@ -0,0 +1,127 @@
+package providers
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tests that a payload encrypted by encryptWebPush can be decrypted by the
+// user agent holding the subscription's private key.
+func Test_encryptWebPush(t *testing.T) {
+	uaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authSecret := make([]byte, 16)
+	_, _ = rand.Read(authSecret)
+	uaPublic := elliptic.Marshal(elliptic.P256(), uaKey.X, uaKey.Y)
+
+	var sub webPushSubscription
+	sub.Endpoint = "https://push.example.com/send/abc"
+	sub.Keys.P256dh = base64.RawURLEncoding.EncodeToString(uaPublic)
+	sub.Keys.Auth = base64.RawURLEncoding.EncodeToString(authSecret)
+
+	plaintext := []byte(`{"notificationData":"csv"}`)
+	body, err := encryptWebPush(plaintext, sub)
+	if err != nil {
+		t.Fatalf("Failed to encrypt: %+v", err)
+	}
+
+	// Parse the aes128gcm header
+	salt := body[:16]
+	if rs := binary.BigEndian.Uint32(body[16:20]); rs != webPushRecordSize {
+		t.Errorf("Unexpected record size %d", rs)
+	}
+	idLen := int(body[20])
+	asPublic := body[21 : 21+idLen]
+	record := body[21+idLen:]
+
+	// Derive the keys as the user agent would
+	asX, asY := elliptic.Unmarshal(elliptic.P256(), asPublic)
+	sx, _ := elliptic.P256().ScalarMult(asX, asY, uaKey.D.Bytes())
+	keyInfo := append(append([]byte("WebPush: info\x00"), uaPublic...), asPublic...)
+	ikm := hkdf(authSecret, sx.FillBytes(make([]byte, 32)), keyInfo, 32)
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := gcm.Open(nil, nonce, record, nil)
+	if err != nil {
+		t.Fatalf("Failed to decrypt record: %+v", err)
+	}
+	if !bytes.Equal(decrypted, append(plaintext, 0x02)) {
+		t.Errorf("Decrypted payload did not match.\nexpected: %q\nreceived: %q", plaintext, decrypted)
+	}
+}
+
+// Tests that the VAPID header carries a three part JWT and the public key.
+func Test_webPush_vapidAuthorization(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewWebPush(WebPushParams{
+		VAPIDPrivateKey: base64.RawURLEncoding.EncodeToString(key.D.FillBytes(make([]byte, 32))),
+		Subject:         "mailto:test@example.com",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create web push provider: %+v", err)
+	}
+
+	auth, err := p.(*webPush).vapidAuthorization("https://push.example.com/send/abc")
+	if err != nil {
+		t.Fatalf("Failed to build VAPID header: %+v", err)
+	}
+	pub := base64.RawURLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), key.X, key.Y))
+	if !strings.HasSuffix(auth, ", k="+pub) {
+		t.Errorf("VAPID header does not carry the public key: %s", auth)
+	}
+	jwt := strings.TrimSuffix(strings.TrimPrefix(auth, "vapid t="), ", k="+pub)
+	if len(strings.Split(jwt, ".")) != 3 {
+		t.Errorf("Malformed VAPID JWT: %s", jwt)
+	}
+}
+
+// Tests that the web push TTL defaults to DefaultPushTTL when not configured.
+func TestNewWebPush_TTL(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := WebPushParams{
+		VAPIDPrivateKey: base64.RawURLEncoding.EncodeToString(key.D.FillBytes(make([]byte, 32))),
+		Subject:         "mailto:test@example.com",
+	}
+	p, err := NewWebPush(params)
+	if err != nil {
+		t.Fatalf("Failed to create web push provider: %+v", err)
+	}
+	if ttl := p.(*webPush).ttl; ttl != DefaultPushTTL {
+		t.Errorf("Expected default TTL %s, got %s", DefaultPushTTL, ttl)
+	}
+
+	params.TTL = 10 * time.Minute
+	p, err = NewWebPush(params)
+	if err != nil {
+		t.Fatalf("Failed to create web push provider: %+v", err)
+	}
+	if ttl := p.(*webPush).ttl; ttl != params.TTL {
+		t.Errorf("Expected TTL %s, got %s", params.TTL, ttl)
+	}
+}
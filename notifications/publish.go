@@ -0,0 +1,45 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package notifications
+
+import (
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/notifications-bot/events"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"time"
+)
+
+// publish sends an event to the event bus, if one is configured.
+func (nb *Impl) publish(e events.Event) {
+	if nb.events == nil {
+		return
+	}
+	e.Timestamp = time.Now()
+	err := nb.events.Publish(e)
+	if err != nil {
+		jww.WARN.Printf("Failed to publish %s event: %+v", e.Type, err)
+	}
+}
+
+// publishRegistration publishes a registration event for the passed in
+// transmission RSA public key.
+func (nb *Impl) publishRegistration(app string, transmissionRSA []byte) {
+	if nb.events == nil {
+		return
+	}
+	transmissionRSAHash, err := storage.HashTransmissionRSA(transmissionRSA)
+	if err != nil {
+		jww.WARN.Printf("Failed to hash transmission RSA for registration event: %+v", err)
+		return
+	}
+	nb.publish(events.Event{
+		Type:                events.Registration,
+		App:                 app,
+		TransmissionRSAHash: transmissionRSAHash,
+	})
+}
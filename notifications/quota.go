@@ -0,0 +1,159 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Daily push quotas protect users tracking very busy identities, such as
+// large channels, from being pushed for every batch. Each app can cap the
+// pushes a user receives for each of their tracked identities per UTC day;
+// notifications over the cap are dropped, the client retrieving them from the
+// network when next woken, or held for a summary push.
+
+package notifications
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gitlab.com/elixxir/primitives/notifications"
+	"strings"
+)
+
+// QuotaOverflow is what happens to notifications over a push quota.
+type QuotaOverflow string
+
+const (
+	// OverflowDrop drops the notifications
+	OverflowDrop QuotaOverflow = "drop"
+	// OverflowDigest holds the notifications for a summary push every digest
+	// interval, as for users in digest mode
+	OverflowDigest QuotaOverflow = "digest"
+)
+
+// Validate returns an error if the overflow is not recognised. An empty
+// overflow drops notifications.
+func (o QuotaOverflow) Validate() error {
+	switch o {
+	case "", OverflowDrop, OverflowDigest:
+		return nil
+	}
+	return errors.Errorf("unknown overflow %q, expected %s or %s", o, OverflowDrop, OverflowDigest)
+}
+
+// PushQuota caps the pushes sent through an app.
+type PushQuota struct {
+	// Daily is the maximum pushes a user receives for each of their tracked
+	// identities per UTC day; unlimited if 0
+	Daily int `mapstructure:"daily"`
+	// Overflow is what happens to the notifications over the quota
+	Overflow QuotaOverflow `mapstructure:"overflow"`
+}
+
+// pushQuota returns the push quota of app. Apps are matched regardless of
+// case, as the config keys quotas are read from are lowercased.
+func (nb *Impl) pushQuota(app string) PushQuota {
+	for name, quota := range nb.pushQuotas {
+		if strings.EqualFold(name, app) {
+			return quota
+		}
+	}
+	return PushQuota{}
+}
+
+// withinQuota returns the pending notifications of the group's ephemeral IDs,
+// in order, leaving out those of ephemeral IDs whose identities have used up
+// the daily push quota of the group's app, and counts the push against the
+// rest. The notifications left out are dropped or held for a summary push.
+func (nb *Impl) withinQuota(ctx context.Context, g *notificationGroup, ephemerals []int64,
+	pending map[int64][]*notifications.Data) []*notifications.Data {
+	var all []*notifications.Data
+	for _, eid := range ephemerals {
+		all = append(all, pending[eid]...)
+	}
+	quota := nb.pushQuota(g.target.App)
+	if quota.Daily <= 0 || len(all) == 0 {
+		return all
+	}
+
+	seen := map[string]bool{}
+	var iids [][]byte
+	for _, eid := range ephemerals {
+		if len(pending[eid]) == 0 {
+			continue
+		}
+		for _, m := range g.matches[eid] {
+			if len(m.IntermediaryId) > 0 && !seen[string(m.IntermediaryId)] {
+				seen[string(m.IntermediaryId)] = true
+				iids = append(iids, m.IntermediaryId)
+			}
+		}
+	}
+	if len(iids) == 0 {
+		return all
+	}
+	exhausted, err := nb.Storage.WithContext(ctx).TakePushQuota(startOfDay(nb.now()), g.target.App,
+		g.target.TransmissionRSAHash, iids, int64(quota.Daily))
+	if err != nil {
+		jww.WARN.Printf("Failed to check push quota of tRSA hash %+v, pushing: %+v", g.target.TransmissionRSAHash, err)
+		return all
+	}
+	if len(exhausted) == 0 {
+		return all
+	}
+
+	over := make(map[string]bool, len(exhausted))
+	for _, iid := range exhausted {
+		over[string(iid)] = true
+	}
+	var within []*notifications.Data
+	overflow := 0
+	for _, eid := range ephemerals {
+		if overQuota(g.matches[eid], over) {
+			overflow += len(pending[eid])
+		} else {
+			within = append(within, pending[eid]...)
+		}
+	}
+	nb.overflowQuota(ctx, g.target, quota, overflow)
+	return within
+}
+
+// overQuota returns true if every identity an ephemeral ID matched has used
+// up its quota.
+func overQuota(matches []storage.GTNResult, over map[string]bool) bool {
+	for _, m := range matches {
+		if !over[string(m.IntermediaryId)] {
+			return false
+		}
+	}
+	return len(matches) > 0
+}
+
+// overflowQuota holds count notifications over the quota for target's next
+// summary push if the quota's overflow is digest and digests are sent, and
+// drops them otherwise.
+func (nb *Impl) overflowQuota(ctx context.Context, target storage.GTNResult, quota PushQuota, count int) {
+	if count == 0 {
+		return
+	}
+	if quota.Overflow == OverflowDigest && nb.digest.Interval > 0 {
+		err := nb.Storage.WithContext(ctx).AddToDigest(&storage.DigestEntry{
+			Token:               target.Token,
+			App:                 target.App,
+			TransmissionRsaHash: target.TransmissionRSAHash,
+			Target:              target,
+			Count:               int64(count),
+			HeldSince:           nb.now(),
+		})
+		if err == nil {
+			return
+		}
+		jww.ERROR.Printf("Failed to hold notifications over the push quota of tRSA hash %+v, dropping: %+v",
+			target.TransmissionRSAHash, err)
+	}
+	jww.DEBUG.Printf("Dropped %d notifications over the daily push quota of tRSA hash %+v",
+		count, target.TransmissionRSAHash)
+}
@@ -0,0 +1,81 @@
+package notifications
+
+import (
+	"context"
+	"gitlab.com/elixxir/notifications-bot/clock"
+	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/elixxir/notifications-bot/notifications/providers"
+	"gitlab.com/elixxir/notifications-bot/testutil"
+	"gitlab.com/elixxir/primitives/notifications"
+	"gitlab.com/xx_network/primitives/id"
+	"gitlab.com/xx_network/primitives/id/ephemeral"
+	"testing"
+	"time"
+)
+
+// Tests that pushes over an app's daily quota are dropped, or held for a
+// digest, until the next day.
+func TestImpl_SendBatch_PushQuota(t *testing.T) {
+	s := testutil.NewStorage(t)
+	android := constants.MessengerAndroid.String()
+	rp := &recordingProvider{}
+	fake := clock.NewFake(time.Now())
+	impl := &Impl{
+		Storage:          s,
+		maxSendAttempts:  1,
+		maxNotifications: 20,
+		maxPayloadBytes:  4096,
+		providers:        map[string]providers.Provider{android: rp},
+		// Quota keys are lowercased by the config
+		pushQuotas: map[string]PushQuota{"messengerandroid": {Daily: 2, Overflow: OverflowDigest}},
+		digest:     DigestParams{Interval: time.Hour},
+		clock:      fake,
+	}
+
+	trsa := []byte("trsa")
+	iid, err := ephemeral.GetIntermediaryId(id.NewIdFromString("channel", id.User, t))
+	if err != nil {
+		t.Fatalf("Failed to get intermediary ID: %+v", err)
+	}
+	if err = s.RegisterToken("token", android, trsa); err != nil {
+		t.Fatalf("Failed to register token: %+v", err)
+	}
+	if err = s.RegisterTrackedID([][]byte{iid}, trsa, 0, 8); err != nil {
+		t.Fatalf("Failed to register tracked ID: %+v", err)
+	}
+	eph, err := s.GetLatestEphemeral()
+	if err != nil {
+		t.Fatalf("Failed to get ephemeral: %+v", err)
+	}
+
+	send := func(round uint64) {
+		ctx, cycle := withSendCycle(context.Background())
+		_, err := impl.SendBatch(ctx, map[int64][]*notifications.Data{
+			eph.EphemeralId: {{EphemeralID: eph.EphemeralId, RoundID: round, MessageHash: []byte("hello"), IdentityFP: []byte("identity")}},
+		})
+		if err != nil {
+			t.Fatalf("Failed to send batch: %+v", err)
+		}
+		cycle.summary()
+	}
+
+	for round := uint64(1); round <= 4; round++ {
+		send(round)
+	}
+	if len(rp.targets) != 2 {
+		t.Errorf("Expected the quota of 2 pushes to be sent, got %d", len(rp.targets))
+	}
+	digests, err := s.TakeDigests()
+	if err != nil {
+		t.Fatalf("Failed to take digests: %+v", err)
+	}
+	if len(digests) != 1 || digests[0].Count != 2 {
+		t.Errorf("Expected the 2 notifications over the quota to be held: %+v", digests)
+	}
+
+	fake.Advance(24 * time.Hour)
+	send(5)
+	if len(rp.targets) != 3 {
+		t.Errorf("Quota should reset the next day, got %d pushes", len(rp.targets))
+	}
+}
@@ -0,0 +1,236 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Registration receipts let clients prove, and check offline, that the bot
+// accepted a registration. The gRPC responses are plain acks owned by the
+// comms library, so receipts are returned by the HTTP registration endpoints
+// served alongside the attestation.
+
+package notifications
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	pb "gitlab.com/elixxir/comms/mixmessages"
+	"gitlab.com/elixxir/crypto/hash"
+	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gitlab.com/xx_network/crypto/signature/rsa"
+	"net/http"
+	"time"
+)
+
+// ReceiptKind is the kind of registration a receipt is for.
+type ReceiptKind uint8
+
+const (
+	TokenReceipt ReceiptKind = iota + 1
+	TrackedIDReceipt
+)
+
+// maxRegistrationBytes limits the size of registration request bodies.
+const maxRegistrationBytes = 64 << 10
+
+// RegistrationReceipt is signed by the bot with the key of its certificate
+// when it accepts a registration. Subject is the hash of the registered token,
+// or of the tracked intermediary IDs; clients compare it against their own
+// hash rather than the bot storing what it signed.
+type RegistrationReceipt struct {
+	Kind                ReceiptKind
+	Subject             []byte
+	TransmissionRsaHash []byte
+	// Timestamp is when the registration was accepted and Expiry when the
+	// receipt stops being valid, both in Unix seconds
+	Timestamp int64
+	Expiry    int64
+	Signature []byte
+	// NextSignature is by the key the bot is rotating to, during the grace
+	// period of a key rotation
+	NextSignature []byte
+}
+
+// digest returns the hash of the receipt's fields which is signed.
+func (r *RegistrationReceipt) digest() ([]byte, error) {
+	h, err := hash.NewCMixHash()
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to create hash")
+	}
+	h.Write([]byte{byte(r.Kind)})
+	for _, b := range [][]byte{r.Subject, r.TransmissionRsaHash} {
+		var l [4]byte
+		binary.BigEndian.PutUint32(l[:], uint32(len(b)))
+		h.Write(l[:])
+		h.Write(b)
+	}
+	var ts [16]byte
+	binary.BigEndian.PutUint64(ts[:8], uint64(r.Timestamp))
+	binary.BigEndian.PutUint64(ts[8:], uint64(r.Expiry))
+	h.Write(ts[:])
+	return h.Sum(nil), nil
+}
+
+// Verify checks the receipt's signature against the passed in public key of
+// the notification bot, or the key it is rotating to, and that it has not
+// expired as of now.
+func (r *RegistrationReceipt) Verify(key *rsa.PublicKey, now time.Time) error {
+	if now.Unix() > r.Expiry {
+		return errors.Errorf("Receipt expired at %s", time.Unix(r.Expiry, 0))
+	}
+	digest, err := r.digest()
+	if err != nil {
+		return err
+	}
+	return verifyEither(key, digest, r.Signature, r.NextSignature)
+}
+
+// TokenSubject returns the subject of a receipt for the registration of token.
+func TokenSubject(token string) []byte {
+	h, _ := hash.NewCMixHash()
+	h.Write([]byte(token))
+	return h.Sum(nil)
+}
+
+// TrackedIDSubject returns the subject of a receipt for the registration of
+// the passed in intermediary IDs, in the order they were sent.
+func TrackedIDSubject(iids [][]byte) []byte {
+	h, _ := hash.NewCMixHash()
+	for _, iid := range iids {
+		var l [4]byte
+		binary.BigEndian.PutUint32(l[:], uint32(len(iid)))
+		h.Write(l[:])
+		h.Write(iid)
+	}
+	return h.Sum(nil)
+}
+
+// signReceipt returns a receipt for a registration accepted now, valid for
+// the receipt TTL.
+func (nb *Impl) signReceipt(kind ReceiptKind, subject, transmissionRsaPem []byte) (*RegistrationReceipt, error) {
+	if nb.signingKey == nil {
+		return nil, errors.New("bot is running without a key, cannot sign receipts")
+	}
+	trsaHash, err := storage.HashTransmissionRSA(transmissionRsaPem)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to hash transmission RSA")
+	}
+	now := nb.now()
+	r := &RegistrationReceipt{
+		Kind:                kind,
+		Subject:             subject,
+		TransmissionRsaHash: trsaHash,
+		Timestamp:           now.Unix(),
+		Expiry:              now.Add(nb.receiptTTL).Unix(),
+	}
+	digest, err := r.digest()
+	if err != nil {
+		return nil, err
+	}
+	r.Signature, r.NextSignature, err = nb.sign(digest)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to sign receipt")
+	}
+	return r, nil
+}
+
+// RegisterTokenWithReceipt registers the token as RegisterToken does, applying
+// the options sent by the client, and returns a signed receipt for the
+// registration.
+func (nb *Impl) RegisterTokenWithReceipt(msg *pb.RegisterTokenRequest, opts TokenOptions) (*RegistrationReceipt, error) {
+	if nb.signingKey == nil {
+		return nil, errors.New("bot is running without a key, cannot sign receipts")
+	}
+	err := nb.registerToken(msg, opts)
+	if err != nil {
+		return nil, err
+	}
+	return nb.signReceipt(TokenReceipt, TokenSubject(msg.Token), msg.TransmissionRsaPem)
+}
+
+// RegisterTrackedIDWithReceipt registers the tracked IDs as RegisterTrackedID
+// does and returns a signed receipt for the registration.
+func (nb *Impl) RegisterTrackedIDWithReceipt(msg *pb.RegisterTrackedIdRequest) (*RegistrationReceipt, error) {
+	if nb.signingKey == nil {
+		return nil, errors.New("bot is running without a key, cannot sign receipts")
+	}
+	if msg.Request == nil {
+		return nil, errors.New("Request must include the tracked IDs")
+	}
+	err := nb.RegisterTrackedID(msg)
+	if err != nil {
+		return nil, err
+	}
+	return nb.signReceipt(TrackedIDReceipt, TrackedIDSubject(msg.Request.TrackedIntermediaryID),
+		msg.Request.TransmissionRsaPem)
+}
+
+// TokenOptions are the settings a client may send alongside a token
+// registered through the HTTP endpoint. They are not covered by the token
+// signature.
+type TokenOptions struct {
+	// Platform and versions of the client, only used to diagnose rollouts
+	storage.TokenProvenance
+	// Privacy limits what pushes to the token reveal on the lock screen; it
+	// is left unchanged if nil
+	Privacy *constants.PrivacyLevel `json:"privacy,omitempty"`
+}
+
+// registerTokenBody is the body of a registration with receipt: a
+// RegisterTokenRequest and the client's options.
+type registerTokenBody struct {
+	*pb.RegisterTokenRequest
+	TokenOptions
+}
+
+// handleRegisterToken serves RegisterTokenWithReceipt for a JSON encoded
+// RegisterTokenRequest, optionally with the client's platform, appVersion,
+// sdkVersion and privacy level.
+func (nb *Impl) handleRegisterToken(w http.ResponseWriter, r *http.Request) {
+	msg := &registerTokenBody{RegisterTokenRequest: &pb.RegisterTokenRequest{}}
+	if !decodeRegistration(w, r, msg) {
+		return
+	}
+	receipt, err := nb.RegisterTokenWithReceipt(msg.RegisterTokenRequest, msg.TokenOptions)
+	if err != nil {
+		jww.DEBUG.Printf("Rejected token registration with receipt: %+v", err)
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, receipt)
+}
+
+// handleRegisterTrackedID serves RegisterTrackedIDWithReceipt for a JSON
+// encoded RegisterTrackedIdRequest.
+func (nb *Impl) handleRegisterTrackedID(w http.ResponseWriter, r *http.Request) {
+	msg := &pb.RegisterTrackedIdRequest{}
+	if !decodeRegistration(w, r, msg) {
+		return
+	}
+	receipt, err := nb.RegisterTrackedIDWithReceipt(msg)
+	if err != nil {
+		jww.DEBUG.Printf("Rejected tracked ID registration with receipt: %+v", err)
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, receipt)
+}
+
+// decodeRegistration reads the registration request posted in the body of r
+// into msg, writing an error response and returning false if there is none.
+func decodeRegistration(w http.ResponseWriter, r *http.Request, msg interface{}) bool {
+	if r.Method != http.MethodPost {
+		adminError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+		return false
+	}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRegistrationBytes)).Decode(msg)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, errors.WithMessage(err, "Invalid request"))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,85 @@
+package notifications
+
+import (
+	"bytes"
+	"encoding/json"
+	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gitlab.com/elixxir/notifications-bot/testutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Tests that registering through the HTTP endpoint stores the token and
+// returns a receipt which verifies against the bot's key until it expires,
+// and that altering it is detected.
+func TestImpl_handleRegisterToken(t *testing.T) {
+	key := testutil.LoadPermissioningKey(t)
+	impl := &Impl{
+		Storage:    testutil.NewStorage(t),
+		comms:      testutil.NewPermissioningComms(t),
+		signingKey: key,
+		receiptTTL: time.Hour,
+	}
+	c := testutil.NewClient(t)
+	app := constants.MessengerAndroid.String()
+	provenance := storage.TokenProvenance{Platform: "android", AppVersion: "1.2.0", SDKVersion: "4.6.3"}
+	privacy := constants.PrivacyGeneric
+	body, err := json.Marshal(registerTokenBody{c.RegisterTokenRequest(t, "token", app, time.Now()),
+		TokenOptions{TokenProvenance: provenance, Privacy: &privacy}})
+	if err != nil {
+		t.Fatalf("Failed to marshal request: %+v", err)
+	}
+
+	resp := httptest.NewRecorder()
+	impl.handleRegisterToken(resp, httptest.NewRequest(http.MethodPost, "/registerToken", bytes.NewReader(body)))
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", resp.Code, resp.Body.String())
+	}
+	token, err := impl.Storage.GetToken("token", app)
+	if err != nil {
+		t.Fatalf("Token should be registered: %+v", err)
+	}
+	if token.Platform != provenance.Platform || token.AppVersion != provenance.AppVersion ||
+		token.SDKVersion != provenance.SDKVersion {
+		t.Errorf("Token should record the client's versions, got %+v", token)
+	}
+	if token.Privacy != string(privacy) {
+		t.Errorf("Token should have privacy level %q, got %q", privacy, token.Privacy)
+	}
+
+	receipt := &RegistrationReceipt{}
+	if err = json.Unmarshal(resp.Body.Bytes(), receipt); err != nil {
+		t.Fatalf("Failed to unmarshal receipt: %+v", err)
+	}
+	trsaHash, err := storage.HashTransmissionRSA(c.TransmissionRsaPem)
+	if err != nil {
+		t.Fatalf("Failed to hash transmission RSA: %+v", err)
+	}
+	if receipt.Kind != TokenReceipt || !bytes.Equal(receipt.Subject, TokenSubject("token")) ||
+		!bytes.Equal(receipt.TransmissionRsaHash, trsaHash) {
+		t.Errorf("Receipt does not describe the registration: %+v", receipt)
+	}
+	if err = receipt.Verify(key.GetPublic(), time.Now()); err != nil {
+		t.Errorf("Receipt should verify: %+v", err)
+	}
+	if err = receipt.Verify(key.GetPublic(), time.Now().Add(2*time.Hour)); err == nil {
+		t.Errorf("Expired receipt should not verify")
+	}
+	receipt.Subject = TokenSubject("other")
+	if err = receipt.Verify(key.GetPublic(), time.Now()); err == nil {
+		t.Errorf("Altered receipt should not verify")
+	}
+
+	// Rejected registrations are not given a receipt
+	resp = httptest.NewRecorder()
+	bad := c.RegisterTokenRequest(t, "token", app, time.Now())
+	bad.TokenSignature = []byte("bad")
+	body, _ = json.Marshal(bad)
+	impl.handleRegisterToken(resp, httptest.NewRequest(http.MethodPost, "/registerToken", bytes.NewReader(body)))
+	if resp.Code != http.StatusBadRequest {
+		t.Errorf("Expected a bad signature to be rejected, got %d", resp.Code)
+	}
+}
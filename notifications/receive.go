@@ -8,6 +8,7 @@
 package notifications
 
 import (
+	"github.com/pkg/errors"
 	jww "github.com/spf13/jwalterweatherman"
 	pb "gitlab.com/elixxir/comms/mixmessages"
 	"gitlab.com/elixxir/primitives/notifications"
@@ -16,23 +17,116 @@ import (
 	"time"
 )
 
+// batchKeyRetention is how long the idempotency keys of accepted batches are
+// kept, acknowledging batches resent by gateways within it without processing
+// them again
+const batchKeyRetention = time.Hour
+
 // ReceiveNotificationBatch receives the batch of notification data from gateway.
 func (nb *Impl) ReceiveNotificationBatch(notifBatch *pb.NotificationBatch, auth *connect.Auth) error {
+	// Leave the batch to the gateway to retry against the active instance
+	if !nb.isActive() {
+		return errors.New("Instance is on standby")
+	}
+	if nb.enforceGatewayAuth {
+		err := nb.checkGatewayAuth(auth)
+		if err != nil {
+			jww.WARN.Printf("%+v", err)
+			return err
+		}
+	}
+	if nb.requireBatchSignatures {
+		err := nb.checkBatchSignature(notifBatch, auth)
+		if err != nil {
+			jww.WARN.Printf("%+v", err)
+			return err
+		}
+	}
+
+	accepted, err := nb.acceptBatch(notifBatch, batchSender(auth))
+	nb.recordPoll(notifBatch, batchSender(auth), accepted, err)
+	if accepted {
+		nb.recordWatermark(auth, notifBatch.RoundID)
+	}
+	return err
+}
+
+// acceptBatch buffers the notifications of a batch from the passed in
+// sender, or queues them during maintenance. It returns false without an
+// error if the batch's round was already accepted.
+func (nb *Impl) acceptBatch(notifBatch *pb.NotificationBatch, gwID string) (bool, error) {
 	rid := notifBatch.RoundID
 
 	_, loaded := nb.roundStore.LoadOrStore(rid, time.Now())
 	if loaded {
 		jww.DEBUG.Printf("Dropping duplicate notification batch for round %+v", notifBatch.RoundID)
-		return nil
+		return false, nil
+	}
+	nb.schedule.observe(time.Now())
+
+	if nb.outbox {
+		processed, err := nb.Storage.IsRoundProcessed(rid)
+		if err != nil {
+			nb.roundStore.Delete(rid)
+			return false, errors.WithMessagef(err, "Failed to check if round %d was processed", rid)
+		}
+		if processed {
+			jww.DEBUG.Printf("Dropping notification batch for already processed round %+v", rid)
+			return false, nil
+		}
+	}
+
+	fresh, err := nb.Storage.InsertBatchKey(gwID, rid, time.Now())
+	if err != nil {
+		nb.roundStore.Delete(rid)
+		return false, errors.WithMessagef(err, "Failed to record batch for round %d", rid)
+	}
+	if !fresh {
+		jww.DEBUG.Printf("Dropping notification batch for round %d resent by gateway %s", rid, gwID)
+		return false, nil
 	}
 
 	jww.INFO.Printf("Received notification batch for round %+v", notifBatch.RoundID)
 
-	buffer := nb.Storage.GetNotificationBuffer()
 	data := processNotificationBatch(notifBatch)
+	if nb.inMaintenance() {
+		err = nb.queueNotifications(data)
+		if err != nil {
+			// Allow the gateway to retry the batch
+			nb.releaseBatch(gwID, rid)
+			return false, errors.WithMessagef(err, "Failed to queue notification batch for round %d", rid)
+		}
+		return true, nil
+	}
+
+	err = nb.admitBatch(len(data))
+	if err != nil {
+		nb.releaseBatch(gwID, rid)
+		return false, err
+	}
+
+	buffer := nb.Storage.GetNotificationBuffer()
 	buffer.Add(id.Round(notifBatch.RoundID), data)
+	return true, nil
+}
+
+// releaseBatch forgets a batch which was not accepted, so it is processed if
+// the gateway resends it.
+func (nb *Impl) releaseBatch(gwID string, rid uint64) {
+	nb.roundStore.Delete(rid)
+	err := nb.Storage.DeleteBatchKey(gwID, rid)
+	if err != nil {
+		jww.WARN.Printf("Failed to release batch for round %d from gateway %s: %+v", rid, gwID, err)
+	}
+}
 
-	return nil
+// batchSender returns the ID of the gateway which sent a batch, or an empty
+// string if the sender is unknown.
+func batchSender(auth *connect.Auth) string {
+	if auth == nil || auth.Sender == nil || auth.Sender.GetId() == nil {
+		return ""
+	}
+	return auth.Sender.GetId().String()
 }
 
 func processNotificationBatch(l *pb.NotificationBatch) []*notifications.Data {
@@ -4,8 +4,10 @@ import (
 	pb "gitlab.com/elixxir/comms/mixmessages"
 	"gitlab.com/elixxir/notifications-bot/storage"
 	"gitlab.com/xx_network/comms/connect"
+	"gitlab.com/xx_network/primitives/id"
 	"sync"
 	"testing"
+	"time"
 )
 
 // Happy path.
@@ -43,3 +45,57 @@ func TestImpl_ReceiveNotificationBatch(t *testing.T) {
 		t.Errorf("Notification was not added to notification buffer: %+v", nbm[5])
 	}
 }
+
+// Tests that a batch resent by a gateway is acknowledged without being
+// processed again once the round has been forgotten in memory, as after a
+// restart, while the same round from another gateway is still accepted.
+func TestImpl_ReceiveNotificationBatch_Idempotent(t *testing.T) {
+	s, err := storage.NewStorage("", "", "TestImpl_ReceiveNotificationBatch_Idempotent", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+	impl := &Impl{Storage: s}
+
+	auth := func(name string) *connect.Auth {
+		host, err := connect.NewHost(id.NewIdFromString(name, id.Gateway, t), "0.0.0.0:11420", nil,
+			connect.GetDefaultHostParams())
+		if err != nil {
+			t.Fatalf("Failed to create gateway host: %+v", err)
+		}
+		return &connect.Auth{IsAuthenticated: true, Sender: host}
+	}
+	batch := &pb.NotificationBatch{
+		RoundID:       42,
+		Notifications: []*pb.NotificationData{{EphemeralID: 5}},
+	}
+
+	if err = impl.ReceiveNotificationBatch(batch, auth("gateway")); err != nil {
+		t.Fatalf("Failed to receive batch: %+v", err)
+	}
+	impl.roundStore.Delete(batch.RoundID)
+	if err = impl.ReceiveNotificationBatch(batch, auth("gateway")); err != nil {
+		t.Errorf("Resent batch should be acknowledged: %+v", err)
+	}
+	if buffered := s.GetNotificationBuffer().Swap(); len(buffered[5]) != 1 {
+		t.Errorf("Resent batch should not be buffered again: %+v", buffered[5])
+	}
+
+	impl.roundStore.Delete(batch.RoundID)
+	if err = impl.ReceiveNotificationBatch(batch, auth("other")); err != nil {
+		t.Fatalf("Failed to receive batch: %+v", err)
+	}
+	if buffered := s.GetNotificationBuffer().Swap(); len(buffered[5]) != 1 {
+		t.Errorf("Batch from another gateway should be buffered: %+v", buffered[5])
+	}
+
+	if err = s.DeleteBatchKeys(time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("Failed to delete batch keys: %+v", err)
+	}
+	impl.roundStore.Delete(batch.RoundID)
+	if err = impl.ReceiveNotificationBatch(batch, auth("gateway")); err != nil {
+		t.Fatalf("Failed to receive batch: %+v", err)
+	}
+	if buffered := s.GetNotificationBuffer().Swap(); len(buffered[5]) != 1 {
+		t.Errorf("Batch should be processed once its key has expired: %+v", buffered[5])
+	}
+}
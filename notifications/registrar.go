@@ -0,0 +1,255 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Registrations are only verified against the permissioning keys when they
+// are made. The registrar verifier re-verifies the stored registrar signatures
+// when the keys change, as when a rotated out key is retired, or on operator
+// request, and quarantines users whose registration no longer verifies so they
+// are not pushed to until they register again.
+
+package notifications
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gitlab.com/xx_network/crypto/signature/rsa"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// registrarKeysStateKey is the state key of the fingerprint of the
+// permissioning keys registrations were last re-verified against.
+const registrarKeysStateKey = "registrarKeys"
+
+// registrarBatchSize is the number of users read from storage at a time while
+// re-verifying registrations.
+const registrarBatchSize = 1000
+
+// RegistrarParams configures re-verifying stored registrar signatures.
+type RegistrarParams struct {
+	// CheckInterval is how often the permissioning keys are checked for
+	// changes; they are only checked on request if zero
+	CheckInterval time.Duration
+	// Quarantine stops pushes to users whose registration no longer
+	// verifies; they are only counted and logged if false
+	Quarantine bool
+}
+
+// RegistrarStatus reports the progress of the running or most recent
+// re-verification.
+type RegistrarStatus struct {
+	Trigger     string    `json:"trigger"`
+	Running     bool      `json:"running"`
+	Started     time.Time `json:"started"`
+	Finished    time.Time `json:"finished,omitempty"`
+	Checked     int64     `json:"checked"`
+	Failed      int64     `json:"failed"`
+	Quarantined int64     `json:"quarantined"`
+	Restored    int64     `json:"restored"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// errReverifyRunning is returned when a re-verification is requested while
+// another is still running.
+var errReverifyRunning = errors.New("a registrar re-verification is already running")
+
+// registrarState holds the status of the current re-verification.
+type registrarState struct {
+	sync.Mutex
+	status RegistrarStatus
+}
+
+// get returns a copy of the current status.
+func (r *registrarState) get() RegistrarStatus {
+	r.Lock()
+	defer r.Unlock()
+	return r.status
+}
+
+// ReverifyRegistrars re-verifies the registrar signature of every user against
+// the current permissioning keys. Users who fail are quarantined if enabled,
+// and quarantined users who pass are restored. The trigger is recorded in the
+// status. Only one re-verification runs at a time.
+func (nb *Impl) ReverifyRegistrars(trigger string) (RegistrarStatus, error) {
+	keys, err := nb.permissioningKeys()
+	if err != nil {
+		return RegistrarStatus{}, err
+	}
+
+	nb.registrar.Lock()
+	if nb.registrar.status.Running {
+		nb.registrar.Unlock()
+		return RegistrarStatus{}, errReverifyRunning
+	}
+	nb.registrar.status = RegistrarStatus{Trigger: trigger, Running: true, Started: nb.now()}
+	nb.registrar.Unlock()
+
+	jww.INFO.Printf("Re-verifying registrar signatures against %d permissioning keys (%s)", len(keys), trigger)
+	err = nb.Storage.IterateRegistrars(registrarBatchSize, func(users []*storage.User) error {
+		for _, u := range users {
+			if err := nb.reverifyUser(keys, u); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	nb.registrar.Lock()
+	nb.registrar.status.Running = false
+	nb.registrar.status.Finished = nb.now()
+	if err != nil {
+		nb.registrar.status.Error = err.Error()
+	}
+	status := nb.registrar.status
+	nb.registrar.Unlock()
+
+	if err != nil {
+		jww.ERROR.Printf("Registrar re-verification stopped after %d users: %+v", status.Checked, err)
+		return status, err
+	}
+	jww.INFO.Printf("Registrar re-verification complete: %d checked, %d failed, %d quarantined, %d restored",
+		status.Checked, status.Failed, status.Quarantined, status.Restored)
+	return status, nil
+}
+
+// reverifyUser checks the stored registrar signature of u against keys,
+// updating its quarantine and the status.
+func (nb *Impl) reverifyUser(keys []*rsa.PublicKey, u *storage.User) error {
+	verifyErr := verifyRegistrarWith(keys, u.RegistrationTimestamp, u.TransmissionRSA, u.RegistrarSig)
+
+	var quarantine, restore bool
+	if verifyErr != nil {
+		jww.WARN.Printf("Registrar signature of user %s no longer verifies: %+v",
+			base64.StdEncoding.EncodeToString(u.TransmissionRSAHash), verifyErr)
+		quarantine = nb.registrarParams.Quarantine && !u.Quarantined
+	} else {
+		restore = u.Quarantined
+	}
+	if quarantine || restore {
+		err := nb.Storage.SetUserQuarantined(u.TransmissionRSAHash, quarantine)
+		if err != nil {
+			return errors.WithMessagef(err, "Failed to update quarantine of user %s",
+				base64.StdEncoding.EncodeToString(u.TransmissionRSAHash))
+		}
+	}
+
+	nb.registrar.Lock()
+	defer nb.registrar.Unlock()
+	nb.registrar.status.Checked++
+	if verifyErr != nil {
+		nb.registrar.status.Failed++
+	}
+	if quarantine {
+		nb.registrar.status.Quarantined++
+	}
+	if restore {
+		nb.registrar.status.Restored++
+	}
+	return nil
+}
+
+// keysFingerprint returns a fingerprint of the passed in set of keys which
+// does not depend on their order.
+func keysFingerprint(keys []*rsa.PublicKey) string {
+	sums := make([][]byte, 0, len(keys))
+	for _, k := range keys {
+		sum := sha256.Sum256(append(k.N.Bytes(), byte(k.E>>24), byte(k.E>>16), byte(k.E>>8), byte(k.E)))
+		sums = append(sums, sum[:])
+	}
+	sort.Slice(sums, func(i, j int) bool { return bytes.Compare(sums[i], sums[j]) < 0 })
+	h := sha256.New()
+	for _, sum := range sums {
+		h.Write(sum)
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// checkRegistrarKeys re-verifies registrations if the permissioning keys have
+// changed since they were last re-verified.
+func (nb *Impl) checkRegistrarKeys() {
+	if !nb.isActive() {
+		return
+	}
+	keys, err := nb.permissioningKeys()
+	if err != nil {
+		jww.WARN.Printf("Failed to get permissioning keys to check for changes: %+v", err)
+		return
+	}
+	fingerprint := keysFingerprint(keys)
+	last, err := nb.Storage.GetStateValue(registrarKeysStateKey)
+	if err == nil && last == fingerprint {
+		return
+	}
+
+	_, err = nb.ReverifyRegistrars("permissioning keys changed")
+	if err != nil {
+		if !errors.Is(err, errReverifyRunning) {
+			jww.ERROR.Printf("Failed to re-verify registrations after permissioning key change: %+v", err)
+		}
+		return
+	}
+	err = nb.Storage.UpsertState(&storage.State{Key: registrarKeysStateKey, Value: fingerprint})
+	if err != nil {
+		jww.ERROR.Printf("Failed to store permissioning keys fingerprint: %+v", err)
+	}
+}
+
+// RegistrarVerifier is a long-running thread which re-verifies registrations
+// whenever the permissioning keys change, checking every check interval.
+func (nb *Impl) RegistrarVerifier() {
+	if nb.registrarParams.CheckInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(nb.registrarParams.CheckInterval)
+	defer ticker.Stop()
+	for {
+		nb.checkRegistrarKeys()
+		select {
+		case <-nb.context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// handleReverifyRegistrars serves the registrar re-verification admin
+// endpoint.
+//   - GET returns the status of the running or most recent re-verification
+//   - POST starts a re-verification against the current permissioning keys
+func (nb *Impl) handleReverifyRegistrars(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, nb.registrar.get())
+	case http.MethodPost:
+		if _, err := nb.permissioningKeys(); err != nil {
+			adminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		nb.registrar.Lock()
+		running := nb.registrar.status.Running
+		nb.registrar.Unlock()
+		if running {
+			adminError(w, http.StatusConflict, errReverifyRunning)
+			return
+		}
+		go func() {
+			if _, err := nb.ReverifyRegistrars("operator request"); err != nil &&
+				!errors.Is(err, errReverifyRunning) {
+				jww.ERROR.Printf("Requested registrar re-verification failed: %+v", err)
+			}
+		}()
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		adminError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+	}
+}
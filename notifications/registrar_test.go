@@ -0,0 +1,100 @@
+package notifications
+
+import (
+	"gitlab.com/elixxir/notifications-bot/clock"
+	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gitlab.com/elixxir/notifications-bot/testutil"
+	"gitlab.com/xx_network/crypto/csprng"
+	"gitlab.com/xx_network/crypto/signature/rsa"
+	"testing"
+	"time"
+)
+
+// Tests that registrations are quarantined once the key their registrar
+// signature was verified against is retired, and restored when it verifies
+// again.
+func TestImpl_ReverifyRegistrars(t *testing.T) {
+	now := time.Now()
+	old, err := loadPermissioningKeys([]PermissioningKey{
+		{CertPath: testutil.Path(testutil.PermissioningCert), Until: now.Add(time.Hour)},
+	})
+	if err != nil {
+		t.Fatalf("Failed to load permissioning keys: %+v", err)
+	}
+	key, err := rsa.GenerateKey(csprng.NewSystemRNG(), 1024)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %+v", err)
+	}
+	rotated := pinnedKey{path: "new", key: key.GetPublic()}
+	fake := clock.NewFake(now)
+	impl := &Impl{
+		Storage:         testutil.NewStorage(t),
+		comms:           testutil.NewPermissioningComms(t),
+		clock:           fake,
+		pinnedKeys:      []pinnedKey{rotated, old[0]},
+		registrarParams: RegistrarParams{Quarantine: true},
+	}
+	c := testutil.NewClient(t)
+	err = impl.RegisterToken(c.RegisterTokenRequest(t, "token", constants.MessengerAndroid.String(), now))
+	if err != nil {
+		t.Fatalf("Failed to register token: %+v", err)
+	}
+	trsaHash, err := storage.HashTransmissionRSA(c.TransmissionRsaPem)
+	if err != nil {
+		t.Fatalf("Failed to hash transmission RSA: %+v", err)
+	}
+	quarantined := func() bool {
+		u, err := impl.Storage.GetUser(trsaHash)
+		if err != nil {
+			t.Fatalf("Failed to get user: %+v", err)
+		}
+		return u.Quarantined
+	}
+
+	status, err := impl.ReverifyRegistrars("test")
+	if err != nil {
+		t.Fatalf("Failed to re-verify registrars: %+v", err)
+	}
+	if status.Checked != 1 || status.Failed != 0 || status.Running {
+		t.Errorf("Registration should verify against the old key, got %+v", status)
+	}
+
+	fake.Advance(2 * time.Hour)
+	status, err = impl.ReverifyRegistrars("test")
+	if err != nil {
+		t.Fatalf("Failed to re-verify registrars: %+v", err)
+	}
+	if status.Failed != 1 || status.Quarantined != 1 || !quarantined() {
+		t.Errorf("Registration should be quarantined once the old key is retired, got %+v", status)
+	}
+
+	impl.pinnedKeys = []pinnedKey{{path: old[0].path, key: old[0].key}}
+	status, err = impl.ReverifyRegistrars("test")
+	if err != nil {
+		t.Fatalf("Failed to re-verify registrars: %+v", err)
+	}
+	if status.Restored != 1 || quarantined() {
+		t.Errorf("Registration should be restored once it verifies, got %+v", status)
+	}
+}
+
+// Tests that the fingerprint of the permissioning keys does not depend on
+// their order but changes with the set.
+func TestKeysFingerprint(t *testing.T) {
+	a, err := rsa.GenerateKey(csprng.NewSystemRNG(), 1024)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %+v", err)
+	}
+	b, err := rsa.GenerateKey(csprng.NewSystemRNG(), 1024)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %+v", err)
+	}
+	ab := keysFingerprint([]*rsa.PublicKey{a.GetPublic(), b.GetPublic()})
+	if ab != keysFingerprint([]*rsa.PublicKey{b.GetPublic(), a.GetPublic()}) {
+		t.Errorf("Fingerprint should not depend on the order of the keys")
+	}
+	if ab == keysFingerprint([]*rsa.PublicKey{a.GetPublic()}) {
+		t.Errorf("Fingerprint should change when a key is removed")
+	}
+}
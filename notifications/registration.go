@@ -8,39 +8,78 @@
 package notifications
 
 import (
-	"encoding/base64"
+	"bytes"
 	"github.com/pkg/errors"
 	jww "github.com/spf13/jwalterweatherman"
 	pb "gitlab.com/elixxir/comms/mixmessages"
 	"gitlab.com/elixxir/crypto/notifications"
 	"gitlab.com/elixxir/crypto/registration"
 	"gitlab.com/elixxir/crypto/rsa"
+	"gitlab.com/elixxir/notifications-bot/errs"
 	"gitlab.com/xx_network/primitives/id"
-	"gitlab.com/xx_network/primitives/id/ephemeral"
 	"time"
 )
 
 var timestampError = "Timestamp of request must be within last 5 seconds.  Request timestamp: %s, current time: %s"
 
+// checkRequestTimestamp returns an error if a request was signed more than 5
+// seconds ago.
+func (nb *Impl) checkRequestTimestamp(requestTimestamp time.Time) error {
+	now := nb.now()
+	if now.Sub(requestTimestamp) > time.Second*5 {
+		return errs.Mark(errors.Errorf(timestampError, requestTimestamp.String(), now.String()), errs.ErrStaleTimestamp)
+	}
+	return nil
+}
+
 // RegisterToken registers the given token. It evaluates that the TransmissionRsaRegistarSig is
 // correct. The RSA->PEM relationship is one to many. It will succeed if the token is already
 // registered.
 func (nb *Impl) RegisterToken(msg *pb.RegisterTokenRequest) error {
+	return nb.registerToken(msg, TokenOptions{})
+}
+
+// registerToken registers the token as RegisterToken does, applying the
+// options sent by the client.
+func (nb *Impl) registerToken(msg *pb.RegisterTokenRequest, opts TokenOptions) error {
 	jww.INFO.Println("RegisterToken")
+	err := nb.verifySource(msg.TransmissionRsaPem, func() error { return nb.verifyRegisterToken(msg) })
+	if err != nil {
+		return err
+	}
+	err = nb.checkBlocked(msg.TransmissionRsaPem)
+	if err != nil {
+		return err
+	}
+	err = nb.checkTenantApp(msg.Token, msg.App)
+	if err != nil {
+		return err
+	}
+	if opts.Privacy != nil && !opts.Privacy.Valid() {
+		return errors.Errorf("Unknown privacy level %q", *opts.Privacy)
+	}
+
+	err = nb.write(pendingWrite{Kind: registerTokenWrite, Token: msg.Token, App: msg.App,
+		TransmissionRsaPem: msg.TransmissionRsaPem, Options: opts,
+		RegistrationTimestamp: msg.RegistrationTimestamp, RegistrarSig: msg.TransmissionRsaRegistrarSig})
+	if err != nil {
+		return err
+	}
+	nb.publishRegistration(msg.App, msg.TransmissionRsaPem)
+	return nil
+}
+
+// verifyRegisterToken checks the request timestamp, permissioning signature
+// and token signature of a RegisterTokenRequest.
+func (nb *Impl) verifyRegisterToken(msg *pb.RegisterTokenRequest) error {
 	requestTimestamp := time.Unix(0, msg.RequestTimestamp)
-	if time.Now().Sub(requestTimestamp) > time.Second*5 {
-		return errors.Errorf(timestampError, requestTimestamp.String(), time.Now().String())
+	if err := nb.checkRequestTimestamp(requestTimestamp); err != nil {
+		return err
 	}
 	// Verify permissioning RSA signature
-	permHost, ok := nb.Comms.GetHost(&id.Permissioning)
-	if !ok {
-		return errors.New("Could not find permissioning host to verify client signature")
-	}
-	jww.INFO.Printf("Verifying perm sig with params:\n\tPubKey: %s\n\tTimestamp: %d\n\tTRSA: %s\n\tSIG: %s\n", base64.StdEncoding.EncodeToString(permHost.GetPubKey().Bytes()), msg.RegistrationTimestamp, base64.StdEncoding.EncodeToString(msg.TransmissionRsaPem), base64.StdEncoding.EncodeToString(msg.TransmissionRsaRegistrarSig))
-	err := registration.VerifyWithTimestamp(permHost.GetPubKey(), msg.RegistrationTimestamp,
-		string(msg.TransmissionRsaPem), msg.TransmissionRsaRegistrarSig)
+	err := nb.verifyRegistrar(msg.RegistrationTimestamp, msg.TransmissionRsaPem, msg.TransmissionRsaRegistrarSig)
 	if err != nil {
-		return errors.WithMessage(err, "Failed to verify permissioning signature")
+		return errs.Mark(errors.WithMessage(err, "Failed to verify permissioning signature"), errs.ErrInvalidSignature)
 	}
 
 	// Verify token signature
@@ -50,10 +89,9 @@ func (nb *Impl) RegisterToken(msg *pb.RegisterTokenRequest) error {
 	}
 	err = notifications.VerifyToken(pub, msg.Token, msg.App, requestTimestamp, notifications.RegisterTokenTag, msg.TokenSignature)
 	if err != nil {
-		return errors.WithMessage(err, "Failed to verify token signature")
+		return errs.Mark(errors.WithMessage(err, "Failed to verify token signature"), errs.ErrInvalidSignature)
 	}
-
-	return nb.Storage.RegisterToken(msg.Token, msg.App, msg.TransmissionRsaPem)
+	return nil
 }
 
 // RegisterTrackedID registers the given ID to be tracked. The request is signed
@@ -62,21 +100,33 @@ func (nb *Impl) RegisterToken(msg *pb.RegisterTokenRequest) error {
 // be revered to get the ID, but is repeatable. So it can be rainbow-tabled.
 func (nb *Impl) RegisterTrackedID(msg *pb.RegisterTrackedIdRequest) error {
 	jww.INFO.Println("RegisterTrackedID")
+	err := nb.verifySource(msg.Request.TransmissionRsaPem, func() error { return nb.verifyRegisterTrackedID(msg) })
+	if err != nil {
+		return err
+	}
+	err = nb.checkBlocked(msg.Request.TransmissionRsaPem)
+	if err != nil {
+		return err
+	}
+
+	return nb.write(pendingWrite{Kind: registerTrackedIDWrite, IntermediaryIDs: msg.Request.TrackedIntermediaryID,
+		TransmissionRsaPem:    msg.Request.TransmissionRsaPem,
+		RegistrationTimestamp: msg.RegistrationTimestamp, RegistrarSig: msg.TransmissionRsaRegistrarSig})
+}
+
+// verifyRegisterTrackedID checks the request timestamp, permissioning
+// signature and identity signature of a RegisterTrackedIdRequest.
+func (nb *Impl) verifyRegisterTrackedID(msg *pb.RegisterTrackedIdRequest) error {
 	requestTimestamp := time.Unix(0, msg.Request.RequestTimestamp)
-	if time.Now().Sub(requestTimestamp) > time.Second*5 {
-		return errors.Errorf(timestampError, requestTimestamp.String(), time.Now().String())
+	if err := nb.checkRequestTimestamp(requestTimestamp); err != nil {
+		return err
 	}
 
 	// Verify permissioning RSA signature
-	permHost, ok := nb.Comms.GetHost(&id.Permissioning)
-	if !ok {
-		return errors.New("Could not find permissioning host to verify client signature")
-	}
-	jww.INFO.Printf("Verifying perm sig with params:\n\tPubKey: %s\n\tTimestamp: %d\n\tTRSA: %s\n\tSIG: %s\n", base64.StdEncoding.EncodeToString(permHost.GetPubKey().Bytes()), msg.RegistrationTimestamp, base64.StdEncoding.EncodeToString(msg.Request.TransmissionRsaPem), base64.StdEncoding.EncodeToString(msg.TransmissionRsaRegistrarSig))
-	err := registration.VerifyWithTimestamp(permHost.GetPubKey(), msg.RegistrationTimestamp,
-		string(msg.Request.TransmissionRsaPem), msg.TransmissionRsaRegistrarSig)
+	err := nb.verifyRegistrar(msg.RegistrationTimestamp, msg.Request.TransmissionRsaPem,
+		msg.TransmissionRsaRegistrarSig)
 	if err != nil {
-		return errors.WithMessage(err, "Failed to verify permissioning signature")
+		return errs.Mark(errors.WithMessage(err, "Failed to verify permissioning signature"), errs.ErrInvalidSignature)
 	}
 
 	pub, err := rsa.GetScheme().UnmarshalPublicKeyPEM(msg.Request.TransmissionRsaPem)
@@ -86,11 +136,75 @@ func (nb *Impl) RegisterTrackedID(msg *pb.RegisterTrackedIdRequest) error {
 
 	err = notifications.VerifyIdentity(pub, msg.Request.TrackedIntermediaryID, requestTimestamp, notifications.RegisterTrackedIDTag, msg.Request.Signature)
 	if err != nil {
-		return errors.WithMessage(err, "Failed to verify identity signature")
+		return errs.Mark(errors.WithMessage(err, "Failed to verify identity signature"), errs.ErrInvalidSignature)
+	}
+	return nil
+}
+
+// RegisterIdentity registers a token together with the first IDs it tracks.
+// Both requests are verified before anything is stored, and the token and
+// tracked IDs are written in a single transaction, so a failure at any step
+// leaves no partial registration behind.
+func (nb *Impl) RegisterIdentity(tokenMsg *pb.RegisterTokenRequest, trackedMsg *pb.RegisterTrackedIdRequest) error {
+	jww.INFO.Println("RegisterIdentity")
+	if tokenMsg == nil || trackedMsg == nil || trackedMsg.Request == nil {
+		return errors.New("Both a token and a tracked ID request are required")
+	}
+	if !bytes.Equal(tokenMsg.TransmissionRsaPem, trackedMsg.Request.TransmissionRsaPem) {
+		return errors.New("Token and tracked ID requests must be signed by the same transmission RSA key")
+	}
+	err := nb.verifySource(tokenMsg.TransmissionRsaPem, func() error {
+		if err := nb.verifyRegisterToken(tokenMsg); err != nil {
+			return err
+		}
+		return nb.verifyRegisterTrackedID(trackedMsg)
+	})
+	if err != nil {
+		return err
+	}
+	err = nb.checkBlocked(tokenMsg.TransmissionRsaPem)
+	if err != nil {
+		return err
+	}
+	err = nb.checkTenantApp(tokenMsg.Token, tokenMsg.App)
+	if err != nil {
+		return err
+	}
+
+	err = nb.write(pendingWrite{Kind: registerIdentityWrite, Token: tokenMsg.Token, App: tokenMsg.App,
+		TransmissionRsaPem: tokenMsg.TransmissionRsaPem, IntermediaryIDs: trackedMsg.Request.TrackedIntermediaryID,
+		RegistrationTimestamp: tokenMsg.RegistrationTimestamp, RegistrarSig: tokenMsg.TransmissionRsaRegistrarSig})
+	if err != nil {
+		return err
+	}
+	nb.publishRegistration(tokenMsg.App, tokenMsg.TransmissionRsaPem)
+	return nil
+}
+
+// RegisterFallbackToken registers the token in msg as the fallback of
+// primaryToken, which must already be registered by the same user. Pushes go
+// to the fallback instead once the primary's provider rejects it permanently.
+func (nb *Impl) RegisterFallbackToken(msg *pb.RegisterTokenRequest, primaryToken string) error {
+	jww.INFO.Println("RegisterFallbackToken")
+	err := nb.verifySource(msg.TransmissionRsaPem, func() error { return nb.verifyRegisterToken(msg) })
+	if err != nil {
+		return err
+	}
+	if _, ok := nb.providers[msg.App]; !ok {
+		return errors.Errorf("No provider is configured for app %s", msg.App)
+	}
+	err = nb.checkBlocked(msg.TransmissionRsaPem)
+	if err != nil {
+		return err
+	}
+	err = nb.checkTenantApp(msg.Token, msg.App)
+	if err != nil {
+		return err
 	}
-	_, epoch := ephemeral.HandleQuantization(time.Now())
 
-	return nb.Storage.RegisterTrackedID(msg.Request.TrackedIntermediaryID, msg.Request.TransmissionRsaPem, epoch, nb.inst.GetPartialNdf().Get().AddressSpace[0].Size)
+	return nb.write(pendingWrite{Kind: registerFallbackWrite, PrimaryToken: primaryToken, Token: msg.Token,
+		App: msg.App, TransmissionRsaPem: msg.TransmissionRsaPem,
+		RegistrationTimestamp: msg.RegistrationTimestamp, RegistrarSig: msg.TransmissionRsaRegistrarSig})
 }
 
 // UnregisterToken unregisters the given device token. The request is signed.
@@ -98,8 +212,8 @@ func (nb *Impl) RegisterTrackedID(msg *pb.RegisterTrackedIdRequest) error {
 func (nb *Impl) UnregisterToken(msg *pb.UnregisterTokenRequest) error {
 	jww.INFO.Println("UnregisterToken")
 	requestTimestamp := time.Unix(0, msg.RequestTimestamp)
-	if time.Now().Sub(requestTimestamp) > time.Second*5 {
-		return errors.Errorf(timestampError, requestTimestamp.String(), time.Now().String())
+	if err := nb.checkRequestTimestamp(requestTimestamp); err != nil {
+		return err
 	}
 
 	pub, err := rsa.GetScheme().UnmarshalPublicKeyPEM(msg.TransmissionRsaPem)
@@ -109,10 +223,11 @@ func (nb *Impl) UnregisterToken(msg *pb.UnregisterTokenRequest) error {
 
 	err = notifications.VerifyToken(pub, msg.Token, msg.App, requestTimestamp, notifications.UnregisterTokenTag, msg.TokenSignature)
 	if err != nil {
-		return errors.WithMessage(err, "Failed to verify token signature")
+		return errs.Mark(errors.WithMessage(err, "Failed to verify token signature"), errs.ErrInvalidSignature)
 	}
 
-	return nb.Storage.UnregisterToken(msg.Token, msg.TransmissionRsaPem)
+	return nb.write(pendingWrite{Kind: unregisterTokenWrite, Token: msg.Token,
+		TransmissionRsaPem: msg.TransmissionRsaPem})
 }
 
 // UnregisterTrackedID unregisters the given tracked ID. The request is signed.
@@ -120,8 +235,8 @@ func (nb *Impl) UnregisterToken(msg *pb.UnregisterTokenRequest) error {
 func (nb *Impl) UnregisterTrackedID(msg *pb.TrackedIntermediaryIdRequest) error {
 	jww.INFO.Println("UnregisterTrackedID")
 	requestTimestamp := time.Unix(0, msg.RequestTimestamp)
-	if time.Now().Sub(requestTimestamp) > time.Second*5 {
-		return errors.Errorf(timestampError, requestTimestamp.String(), time.Now().String())
+	if err := nb.checkRequestTimestamp(requestTimestamp); err != nil {
+		return err
 	}
 
 	pub, err := rsa.GetScheme().UnmarshalPublicKeyPEM(msg.TransmissionRsaPem)
@@ -131,8 +246,9 @@ func (nb *Impl) UnregisterTrackedID(msg *pb.TrackedIntermediaryIdRequest) error
 
 	err = notifications.VerifyIdentity(pub, msg.TrackedIntermediaryID, requestTimestamp, notifications.UnregisterTrackedIDTag, msg.Signature)
 	if err != nil {
-		return errors.WithMessage(err, "Failed to verify identity signature")
+		return errs.Mark(errors.WithMessage(err, "Failed to verify identity signature"), errs.ErrInvalidSignature)
 	}
 
-	return nb.Storage.UnregisterTrackedIDs(msg.TrackedIntermediaryID, msg.TransmissionRsaPem)
+	return nb.write(pendingWrite{Kind: unregisterTrackedIDWrite, IntermediaryIDs: msg.TrackedIntermediaryID,
+		TransmissionRsaPem: msg.TransmissionRsaPem})
 }
@@ -0,0 +1,236 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Sources, identified by their transmission RSA key as in the RPC logs, whose
+// registrations repeatedly fail signature verification are banned from
+// registering for a time, which doubles with each ban until the source has
+// gone a MaxDuration without failing. Bans are held in memory, so each
+// instance bans the sources it sees, and are listed and lifted through the
+// admin API.
+
+package notifications
+
+import (
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/notifications-bot/errs"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RegistrationBanParams configures banning sources whose registrations
+// repeatedly fail signature verification.
+type RegistrationBanParams struct {
+	// Threshold is the number of failed verifications within Window which
+	// bans a source; sources are never banned if 0
+	Threshold int
+	Window    time.Duration
+	// Duration is the length of a source's first ban, doubled for each
+	// further ban up to MaxDuration
+	Duration    time.Duration
+	MaxDuration time.Duration
+}
+
+// RegistrationBan describes a source with recent failed verifications, as
+// listed by the admin API.
+type RegistrationBan struct {
+	Source      string     `json:"source"`
+	Failures    int        `json:"failures"`
+	Bans        int        `json:"bans"`
+	LastFailure time.Time  `json:"lastFailure"`
+	BannedUntil *time.Time `json:"bannedUntil,omitempty"`
+}
+
+// banRecord holds the failed verifications and bans of a source.
+type banRecord struct {
+	// failures counts the failures since windowStart
+	failures    int
+	windowStart time.Time
+	lastFailure time.Time
+	bans        int
+	until       time.Time
+}
+
+// registrationBans tracks the failed verifications of each source.
+type registrationBans struct {
+	params RegistrationBanParams
+
+	mux       sync.Mutex
+	sources   map[string]*banRecord
+	lastSweep time.Time
+}
+
+// newRegistrationBans returns a tracker banning sources as configured by
+// params, or nil if banning is disabled.
+func newRegistrationBans(params RegistrationBanParams) *registrationBans {
+	if params.Threshold <= 0 {
+		return nil
+	}
+	return &registrationBans{params: params, sources: map[string]*banRecord{}}
+}
+
+// check returns an error if source is banned at now.
+func (b *registrationBans) check(source string, now time.Time) error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	r, ok := b.sources[source]
+	if ok && now.Before(r.until) {
+		return errors.Errorf("Registrations from %s are refused until %s after repeated invalid signatures",
+			source, r.until.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// observe records the result of verifying a registration from source at now.
+// A verification failing on its signature counts towards a ban, while one
+// which succeeds clears the source's record.
+func (b *registrationBans) observe(source string, err error, now time.Time) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.sweep(now)
+	if err == nil {
+		delete(b.sources, source)
+		return
+	}
+	if !errors.Is(err, errs.ErrInvalidSignature) {
+		return
+	}
+
+	r, ok := b.sources[source]
+	if !ok {
+		r = &banRecord{}
+		b.sources[source] = r
+	}
+	if now.Sub(r.windowStart) > b.params.Window {
+		r.failures = 0
+		r.windowStart = now
+	}
+	r.failures++
+	r.lastFailure = now
+	if r.failures < b.params.Threshold {
+		return
+	}
+
+	r.bans++
+	d := b.params.Duration
+	for i := 1; i < r.bans; i++ {
+		d *= 2
+		if b.params.MaxDuration > 0 && d >= b.params.MaxDuration {
+			d = b.params.MaxDuration
+			break
+		}
+	}
+	r.until = now.Add(d)
+	r.failures = 0
+	jww.WARN.Printf("Banning registrations from %s for %s after %d invalid signatures (ban %d)",
+		source, d, b.params.Threshold, r.bans)
+}
+
+// sweep forgets sources which are not banned and have not failed for a
+// MaxDuration, resetting their ban length. It runs at most once a Window.
+// The caller must hold the lock.
+func (b *registrationBans) sweep(now time.Time) {
+	if now.Sub(b.lastSweep) < b.params.Window {
+		return
+	}
+	b.lastSweep = now
+	forget := b.params.MaxDuration
+	if forget < b.params.Window {
+		forget = b.params.Window
+	}
+	for source, r := range b.sources {
+		if !now.Before(r.until) && now.Sub(r.lastFailure) > forget {
+			delete(b.sources, source)
+		}
+	}
+}
+
+// list returns the sources with recent failures or bans, ordered by source.
+func (b *registrationBans) list(now time.Time) []RegistrationBan {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	bans := make([]RegistrationBan, 0, len(b.sources))
+	for source, r := range b.sources {
+		ban := RegistrationBan{Source: source, Failures: r.failures, Bans: r.bans, LastFailure: r.lastFailure}
+		if now.Before(r.until) {
+			until := r.until
+			ban.BannedUntil = &until
+		}
+		bans = append(bans, ban)
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Source < bans[j].Source })
+	return bans
+}
+
+// lift ends the ban of source, keeping its ban count. It returns false if the
+// source is not banned at now.
+func (b *registrationBans) lift(source string, now time.Time) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	r, ok := b.sources[source]
+	if !ok || !now.Before(r.until) {
+		return false
+	}
+	r.until = time.Time{}
+	r.failures = 0
+	return true
+}
+
+// checkBanned returns an error if registrations signed with the passed in
+// transmission RSA key are banned.
+func (nb *Impl) checkBanned(transmissionRSA []byte) error {
+	if nb.registrationBans == nil {
+		return nil
+	}
+	return nb.registrationBans.check(clientPeer(transmissionRSA), nb.now())
+}
+
+// verifySource runs verify on a registration signed with the passed in
+// transmission RSA key, refusing it without verifying if the key is banned
+// and counting failed signatures towards a ban.
+func (nb *Impl) verifySource(transmissionRSA []byte, verify func() error) error {
+	if nb.registrationBans == nil {
+		return verify()
+	}
+	if err := nb.checkBanned(transmissionRSA); err != nil {
+		return err
+	}
+	source, now := clientPeer(transmissionRSA), nb.now()
+	err := verify()
+	nb.registrationBans.observe(source, err, now)
+	return err
+}
+
+// handleRegistrationBans serves the registration bans admin endpoint. A GET
+// lists the sources with recent invalid signatures and their bans, and a
+// DELETE lifts the ban of the passed in source.
+func (nb *Impl) handleRegistrationBans(w http.ResponseWriter, r *http.Request) {
+	if nb.registrationBans == nil {
+		adminError(w, http.StatusNotFound, errors.New("registration bans are disabled"))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, nb.registrationBans.list(nb.now()))
+	case http.MethodDelete:
+		source := r.URL.Query().Get("source")
+		if source == "" {
+			adminError(w, http.StatusBadRequest, errors.New("source is required"))
+			return
+		}
+		if !nb.registrationBans.lift(source, nb.now()) {
+			adminError(w, http.StatusNotFound, errors.New("source is not banned"))
+			return
+		}
+		jww.INFO.Printf("Lifted registration ban of %s", source)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		adminError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+	}
+}
@@ -0,0 +1,103 @@
+package notifications
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/notifications-bot/clock"
+	"gitlab.com/elixxir/notifications-bot/errs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// Tests that a source is banned once its invalid signatures reach the
+// threshold, for a time doubling with each ban up to the maximum.
+func TestImpl_verifySource(t *testing.T) {
+	fake := clock.NewFake(time.Now())
+	impl := &Impl{clock: fake, registrationBans: newRegistrationBans(RegistrationBanParams{
+		Threshold: 2, Window: time.Minute, Duration: time.Minute, MaxDuration: 3 * time.Minute,
+	})}
+	trsa := []byte("transmission RSA")
+	invalid := func() error { return errs.Mark(errors.New("bad signature"), errs.ErrInvalidSignature) }
+	valid := func() error { return nil }
+
+	bans, source := impl.registrationBans, clientPeer(trsa)
+
+	// Errors other than invalid signatures do not count
+	_ = impl.verifySource(trsa, func() error { return errs.ErrStaleTimestamp })
+	for _, expected := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute} {
+		_ = impl.verifySource(trsa, invalid)
+		if err := bans.check(source, fake.Now()); err != nil {
+			t.Fatalf("Source should not be banned below the threshold: %+v", err)
+		}
+		_ = impl.verifySource(trsa, invalid)
+		if err := impl.verifySource(trsa, valid); err == nil {
+			t.Fatalf("Source should be banned once the threshold is reached")
+		}
+		fake.Advance(expected - time.Second)
+		if err := bans.check(source, fake.Now()); err == nil {
+			t.Fatalf("Source should be banned for %s", expected)
+		}
+		fake.Advance(time.Second)
+		if err := bans.check(source, fake.Now()); err != nil {
+			t.Fatalf("Ban should end after %s: %+v", expected, err)
+		}
+	}
+
+	// A successful verification resets the ban length
+	if err := impl.verifySource(trsa, valid); err != nil {
+		t.Fatalf("Failed to verify: %+v", err)
+	}
+	_ = impl.verifySource(trsa, invalid)
+	_ = impl.verifySource(trsa, invalid)
+	fake.Advance(time.Minute)
+	if err := bans.check(source, fake.Now()); err != nil {
+		t.Errorf("Ban after a successful verification should be the shortest: %+v", err)
+	}
+
+	if err := impl.verifySource([]byte("other RSA"), valid); err != nil {
+		t.Errorf("Other sources should not be banned: %+v", err)
+	}
+	disabled := &Impl{}
+	if err := disabled.verifySource(trsa, invalid); !errors.Is(err, errs.ErrInvalidSignature) {
+		t.Errorf("Verification error should be returned with bans disabled, got %+v", err)
+	}
+}
+
+// Tests that bans are listed and lifted through the admin API.
+func TestImpl_handleRegistrationBans(t *testing.T) {
+	impl := &Impl{clock: clock.NewFake(time.Now()), registrationBans: newRegistrationBans(RegistrationBanParams{
+		Threshold: 1, Window: time.Minute, Duration: time.Hour, MaxDuration: time.Hour,
+	})}
+	handler := impl.adminHandler("secret")
+	trsa := []byte("transmission RSA")
+	_ = impl.verifySource(trsa, func() error { return errs.ErrInvalidSignature })
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newAdminRequest(http.MethodGet, "/registrationBans", "secret"))
+	var bans []RegistrationBan
+	if err := json.Unmarshal(w.Body.Bytes(), &bans); err != nil {
+		t.Fatalf("Failed to decode bans: %+v", err)
+	}
+	if len(bans) != 1 || bans[0].Source != clientPeer(trsa) || bans[0].Bans != 1 || bans[0].BannedUntil == nil {
+		t.Fatalf("Unexpected bans: %+v", bans)
+	}
+
+	target := "/registrationBans?source=" + url.QueryEscape(bans[0].Source)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newAdminRequest(http.MethodDelete, target, "secret"))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Failed to lift ban: %d %s", w.Code, w.Body.String())
+	}
+	if err := impl.verifySource(trsa, func() error { return nil }); err != nil {
+		t.Errorf("Lifted source should be verified: %+v", err)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newAdminRequest(http.MethodDelete, target, "secret"))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Lifting a source which is not banned should 404, got %d", w.Code)
+	}
+}
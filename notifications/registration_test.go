@@ -1,12 +1,15 @@
 package notifications
 
 import (
+	"github.com/pkg/errors"
 	"gitlab.com/elixxir/comms/mixmessages"
 	"gitlab.com/elixxir/crypto/notifications"
 	"gitlab.com/elixxir/crypto/registration"
 	rsa2 "gitlab.com/elixxir/crypto/rsa"
 	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/elixxir/notifications-bot/errs"
 	"gitlab.com/elixxir/notifications-bot/storage"
+	"gitlab.com/elixxir/notifications-bot/testutil"
 	"gitlab.com/xx_network/comms/connect"
 	"gitlab.com/xx_network/crypto/csprng"
 	"gitlab.com/xx_network/crypto/signature/rsa"
@@ -377,3 +380,64 @@ func TestImpl_UnregisterTrackedID(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// Tests token registration against the comms and storage test doubles, without
+// starting a server.
+func TestImpl_RegisterToken_TestDoubles(t *testing.T) {
+	impl := &Impl{
+		Storage: testutil.NewStorage(t),
+		comms:   testutil.NewComms(),
+	}
+	client := testutil.NewClient(t)
+	app := constants.MessengerAndroid.String()
+
+	err := impl.RegisterToken(client.RegisterTokenRequest(t, "token", app, time.Now()))
+	if err == nil {
+		t.Fatal("Registration should fail without a permissioning host")
+	}
+
+	impl.comms = testutil.NewPermissioningComms(t)
+	err = impl.RegisterToken(client.RegisterTokenRequest(t, "token", app, time.Now().Add(-time.Minute)))
+	if err == nil {
+		t.Fatal("Registration should fail with a stale request timestamp")
+	}
+	err = impl.RegisterToken(client.RegisterTokenRequest(t, "token", app, time.Now()))
+	if err != nil {
+		t.Fatalf("Failed to register token: %+v", err)
+	}
+	if _, err = impl.Storage.GetToken("token", app); err != nil {
+		t.Errorf("Registered token not found in storage: %+v", err)
+	}
+}
+
+// Tests that rejected registrations can be told apart by their error
+// category.
+func TestImpl_RegisterToken_ErrorCategories(t *testing.T) {
+	impl := &Impl{
+		Storage: testutil.NewStorage(t),
+		comms:   testutil.NewPermissioningComms(t),
+	}
+	c := testutil.NewClient(t)
+	app := constants.MessengerAndroid.String()
+
+	err := impl.RegisterToken(c.RegisterTokenRequest(t, "token", app, time.Now().Add(-time.Minute)))
+	if !errors.Is(err, errs.ErrStaleTimestamp) || errors.Is(err, errs.ErrInvalidSignature) {
+		t.Errorf("Expected a stale timestamp error, got %+v", err)
+	}
+
+	msg := c.RegisterTokenRequest(t, "token", app, time.Now())
+	msg.TokenSignature = []byte("bad")
+	err = impl.RegisterToken(msg)
+	if !errors.Is(err, errs.ErrInvalidSignature) || errors.Is(err, errs.ErrStaleTimestamp) {
+		t.Errorf("Expected an invalid signature error, got %+v", err)
+	}
+
+	trsaHash, err := storage.HashTransmissionRSA(c.TransmissionRsaPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = impl.Storage.SetTokenPriority("token", app, trsaHash, "high")
+	if !errors.Is(err, errs.ErrNotRegistered) {
+		t.Errorf("Expected a not registered error for an unregistered token, got %+v", err)
+	}
+}
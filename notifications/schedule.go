@@ -0,0 +1,143 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package notifications
+
+import (
+	"sync"
+	"time"
+)
+
+// cadenceSmoothing is the weight given to the estimated round cadence against
+// each newly observed interval between rounds.
+const cadenceSmoothing = 8
+
+// roundSchedule estimates the cadence at which rounds complete from the
+// arrival of their notification batches, so the sender can flush shortly after
+// each round rather than on a fixed interval. Flushes wait settle after a
+// round arrives, so rounds completing together are sent together, and are
+// kept between min and max apart.
+type roundSchedule struct {
+	settle, min, max time.Duration
+
+	// arrived is signalled each time a round is observed
+	arrived chan struct{}
+
+	// last is the arrival of the most recent round and cadence the smoothed
+	// interval between rounds; 0 until two rounds have been observed
+	last    time.Time
+	cadence time.Duration
+	mux     sync.Mutex
+}
+
+// newRoundSchedule creates a roundSchedule with the passed in bounds.
+func newRoundSchedule(settle, min, max time.Duration) *roundSchedule {
+	if min > max {
+		min = max
+	}
+	return &roundSchedule{
+		settle:  settle,
+		min:     min,
+		max:     max,
+		arrived: make(chan struct{}, 1),
+	}
+}
+
+// observe records the arrival of a round's notification batch at the passed in
+// time. Gaps longer than max, such as while the network is stopped, are not
+// counted towards the cadence.
+func (rs *roundSchedule) observe(at time.Time) {
+	if rs == nil {
+		return
+	}
+	rs.mux.Lock()
+	if !rs.last.IsZero() {
+		interval := at.Sub(rs.last)
+		if interval > 0 && interval <= rs.max {
+			if rs.cadence == 0 {
+				rs.cadence = interval
+			} else {
+				rs.cadence += (interval - rs.cadence) / cadenceSmoothing
+			}
+		}
+	}
+	if at.After(rs.last) {
+		rs.last = at
+	}
+	rs.mux.Unlock()
+
+	select {
+	case rs.arrived <- struct{}{}:
+	default:
+	}
+}
+
+// next returns when the sender should next flush, given when it last did.
+// It is settle after a round which arrived since the last flush, otherwise
+// settle after the next expected round, or max after the last flush if the
+// cadence is not yet known.
+func (rs *roundSchedule) next(now, lastSend time.Time) time.Time {
+	rs.mux.Lock()
+	defer rs.mux.Unlock()
+
+	var at time.Time
+	switch {
+	case rs.last.After(lastSend):
+		at = rs.last.Add(rs.settle)
+	case rs.cadence > 0:
+		// Skip forward over rounds expected before now which did not arrive
+		expected := rs.last.Add(rs.cadence)
+		if behind := now.Sub(expected.Add(rs.settle)); behind >= 0 {
+			expected = expected.Add((behind/rs.cadence + 1) * rs.cadence)
+		}
+		at = expected.Add(rs.settle)
+	default:
+		at = lastSend.Add(rs.max)
+	}
+
+	if earliest := lastSend.Add(rs.min); at.Before(earliest) {
+		at = earliest
+	}
+	if latest := lastSend.Add(rs.max); at.After(latest) {
+		at = latest
+	}
+	return at
+}
+
+// adaptiveInterval is the interval between sends when they are not aligned to
+// rounds. It halves after each send which found notifications buffered, so
+// bursts are sent with little delay, and doubles after each which found none,
+// so an idle bot rarely wakes, kept between min and max.
+type adaptiveInterval struct {
+	min, max, current time.Duration
+}
+
+// newAdaptiveInterval creates an adaptiveInterval with the passed in bounds,
+// starting at max.
+func newAdaptiveInterval(min, max time.Duration) *adaptiveInterval {
+	if min <= 0 || min > max {
+		min = max
+	}
+	return &adaptiveInterval{min: min, max: max, current: max}
+}
+
+// next returns the interval until the next send, given whether the send just
+// made found notifications buffered.
+func (ai *adaptiveInterval) next(busy bool) time.Duration {
+	if busy {
+		ai.current /= 2
+	} else {
+		ai.current *= 2
+	}
+	if ai.current < ai.min {
+		ai.current = ai.min
+	}
+	if ai.current > ai.max {
+		ai.current = ai.max
+	}
+	return ai.current
+}
@@ -0,0 +1,81 @@
+package notifications
+
+import (
+	"testing"
+	"time"
+)
+
+// Tests that the round schedule flushes shortly after an arrived round, then
+// at the next round expected from the observed cadence, within its bounds.
+func TestRoundSchedule_next(t *testing.T) {
+	rs := newRoundSchedule(500*time.Millisecond, time.Second, 30*time.Second)
+	start := time.Unix(1000, 0)
+
+	if at := rs.next(start, start); !at.Equal(start.Add(30 * time.Second)) {
+		t.Errorf("Without rounds sends should wait the maximum interval, next at %s", at.Sub(start))
+	}
+
+	for i := 0; i < 4; i++ {
+		rs.observe(start.Add(time.Duration(i) * 5 * time.Second))
+	}
+	if rs.cadence != 5*time.Second {
+		t.Fatalf("Expected cadence of %s, estimated %s", 5*time.Second, rs.cadence)
+	}
+	select {
+	case <-rs.arrived:
+	default:
+		t.Errorf("Observing a round should signal its arrival")
+	}
+
+	last := start.Add(15 * time.Second)
+	if at := rs.next(last, start); !at.Equal(last.Add(500 * time.Millisecond)) {
+		t.Errorf("Send should follow the arrived round, next at %s", at.Sub(last))
+	}
+	lastSend := last.Add(500 * time.Millisecond)
+	if at := rs.next(lastSend, lastSend); !at.Equal(last.Add(5500 * time.Millisecond)) {
+		t.Errorf("Send should follow the expected round, next at %s", at.Sub(last))
+	}
+	now := last.Add(12 * time.Second)
+	if at := rs.next(now, lastSend); !at.Equal(last.Add(15500 * time.Millisecond)) {
+		t.Errorf("Missed rounds should be skipped, next at %s", at.Sub(last))
+	}
+
+	// Rounds arriving in quick succession are held to the minimum interval
+	rs.observe(lastSend.Add(100 * time.Millisecond))
+	if at := rs.next(lastSend.Add(100*time.Millisecond), lastSend); !at.Equal(lastSend.Add(time.Second)) {
+		t.Errorf("Sends should be at least %s apart, next at %s", time.Second, at.Sub(lastSend))
+	}
+
+	// A long gap is not counted towards the cadence
+	cadence := rs.cadence
+	rs.observe(lastSend.Add(time.Hour))
+	if rs.cadence != cadence {
+		t.Errorf("Gap longer than the maximum interval changed cadence to %s", rs.cadence)
+	}
+}
+
+// Tests that the adaptive interval shortens while sends find notifications
+// and lengthens while they find none, within its bounds.
+func TestAdaptiveInterval_next(t *testing.T) {
+	ai := newAdaptiveInterval(time.Second, 30*time.Second)
+	if ai.current != 30*time.Second {
+		t.Errorf("Interval should start at the maximum, got %s", ai.current)
+	}
+
+	for _, expected := range []time.Duration{15 * time.Second, 7500 * time.Millisecond, 3750 * time.Millisecond,
+		1875 * time.Millisecond, time.Second, time.Second} {
+		if next := ai.next(true); next != expected {
+			t.Errorf("Busy sends should shorten the interval to %s, got %s", expected, next)
+		}
+	}
+	for _, expected := range []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second,
+		16 * time.Second, 30 * time.Second, 30 * time.Second} {
+		if next := ai.next(false); next != expected {
+			t.Errorf("Idle sends should lengthen the interval to %s, got %s", expected, next)
+		}
+	}
+
+	if ai = newAdaptiveInterval(time.Minute, 30*time.Second); ai.next(true) != 30*time.Second {
+		t.Errorf("A minimum above the maximum should be clamped to it")
+	}
+}
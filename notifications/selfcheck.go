@@ -0,0 +1,142 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// The startup self-check verifies the configuration against the outside world
+// before the bot starts serving, so a bad deployment fails at once with a
+// report of everything wrong with it instead of on the first push.
+
+package notifications
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/notifications-bot/io"
+	"gitlab.com/elixxir/notifications-bot/notifications/providers"
+	"gitlab.com/xx_network/primitives/id"
+	"net"
+	"sort"
+	"time"
+)
+
+// CheckResult is the outcome of a single startup check.
+type CheckResult struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	// Hard checks prevent the bot from starting when they fail; the others
+	// are reported as warnings
+	Hard   bool   `json:"hard"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// SelfCheckReport holds the results of the startup checks in the order they
+// ran.
+type SelfCheckReport struct {
+	Checks []CheckResult `json:"checks"`
+}
+
+// Failed returns the hard checks which failed.
+func (r SelfCheckReport) Failed() []CheckResult {
+	var failed []CheckResult
+	for _, c := range r.Checks {
+		if c.Hard && !c.Passed {
+			failed = append(failed, c)
+		}
+	}
+	return failed
+}
+
+// add records the outcome of a check.
+func (r *SelfCheckReport) add(name string, hard bool, err error) {
+	c := CheckResult{Name: name, Passed: err == nil, Hard: hard}
+	if err != nil {
+		c.Detail = err.Error()
+	}
+	r.Checks = append(r.Checks, c)
+}
+
+// SelfCheck runs the startup checks, each bounded by the timeout:
+//   - the gRPC and HTTPS certificates match their keys
+//   - providers which can check their credentials have them accepted
+//   - the database schema is current
+//   - the permissioning server is reachable and serves the NDF
+//   - the permissioning host's certificate is pinned, if keys are pinned
+//
+// The permissioning checks are soft failures, as the bot keeps polling for
+// the NDF until it is available.
+func (nb *Impl) SelfCheck(params Params, timeout time.Duration) SelfCheckReport {
+	var report SelfCheckReport
+	if params.CertPath != "" || params.KeyPath != "" {
+		report.add("gRPC certificate", true, checkKeyPair(params.CertPath, params.KeyPath))
+	}
+	if params.KeyRotation.PreviousCertPath != "" || params.KeyRotation.PreviousKeyPath != "" {
+		report.add("Previous gRPC certificate", true, checkKeyPair(params.KeyRotation.PreviousCertPath,
+			params.KeyRotation.PreviousKeyPath))
+	}
+	if len(nb.pinnedKeys) > 0 {
+		report.add("Permissioning key pinned", false, nb.checkPermissioningPinned())
+	}
+	if params.HttpsCertPath != "" || params.HttpsKeyPath != "" {
+		report.add("HTTPS certificate", true, checkKeyPair(params.HttpsCertPath, params.HttpsKeyPath))
+	}
+
+	apps := make([]string, 0, len(nb.providers))
+	for app := range nb.providers {
+		apps = append(apps, app)
+	}
+	sort.Strings(apps)
+	for _, app := range apps {
+		p := nb.providers[app]
+		if lp, ok := p.(*limitedProvider); ok {
+			p = lp.Provider
+		}
+		checker, ok := p.(providers.Checker)
+		if !ok {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(nb.context(), timeout)
+		report.add(fmt.Sprintf("%s credentials", app), true, checker.Check(ctx))
+		cancel()
+	}
+
+	if nb.Storage != nil {
+		report.add("Database schema", true, nb.Storage.CheckSchema())
+	}
+
+	permHost, ok := nb.hosts().GetHost(&id.Permissioning)
+	if !ok {
+		report.add("Permissioning reachable", false, errors.New("No permissioning host is configured"))
+		return report
+	}
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(nb.context(), "tcp", permHost.GetAddress())
+	if err == nil {
+		_ = conn.Close()
+	}
+	report.add("Permissioning reachable", false, errors.WithMessagef(err, "Failed to connect to %s",
+		permHost.GetAddress()))
+	if err != nil || nb.server() == nil {
+		return report
+	}
+	ndf, err := io.NewNdfPoller(nb.server(), permHost).PollNdf(nil)
+	if err == nil && (ndf == nil || len(ndf.Ndf) == 0) {
+		err = errors.New("Permissioning returned an empty NDF")
+	}
+	report.add("NDF retrievable", false, err)
+	return report
+}
+
+// checkKeyPair returns an error if the certificate and key files cannot be
+// read or do not match.
+func checkKeyPair(certPath, keyPath string) error {
+	if certPath == "" || keyPath == "" {
+		return errors.New("Both a certificate and a key must be set")
+	}
+	_, err := tls.LoadX509KeyPair(certPath, keyPath)
+	return errors.WithMessagef(err, "Certificate %s does not match key %s", certPath, keyPath)
+}
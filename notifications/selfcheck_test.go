@@ -0,0 +1,68 @@
+package notifications
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/notifications-bot/notifications/providers"
+	"gitlab.com/elixxir/notifications-bot/testutil"
+	"testing"
+	"time"
+)
+
+// checkedProvider is a provider whose credential check returns err.
+type checkedProvider struct {
+	*testutil.Provider
+	err error
+}
+
+func (p checkedProvider) Check(context.Context) error {
+	return p.err
+}
+
+// Tests that mismatched certificates and rejected credentials fail the check
+// as hard failures, while an unreachable permissioning server is only
+// reported.
+func TestImpl_SelfCheck(t *testing.T) {
+	impl := &Impl{
+		Storage: testutil.NewStorage(t),
+		providers: map[string]providers.Provider{
+			"good": newLimitedProvider("good", checkedProvider{testutil.NewProvider(), nil}, ProviderLimits{}),
+			"bad":  checkedProvider{testutil.NewProvider(), errors.New("rejected")},
+			"none": testutil.NewProvider(),
+		},
+		comms: testutil.NewPermissioningComms(t),
+	}
+	params := Params{
+		CertPath:      testutil.Path(testutil.PermissioningCert),
+		KeyPath:       testutil.Path(testutil.PermissioningKey),
+		HttpsCertPath: testutil.Path(testutil.PermissioningCert),
+		HttpsKeyPath:  testutil.Path("badkey"),
+	}
+
+	report := impl.SelfCheck(params, time.Second)
+	passed := map[string]bool{}
+	for _, c := range report.Checks {
+		passed[c.Name] = c.Passed
+	}
+	expected := map[string]bool{
+		"gRPC certificate":        true,
+		"HTTPS certificate":       false,
+		"good credentials":        true,
+		"bad credentials":         false,
+		"Database schema":         true,
+		"Permissioning reachable": false,
+	}
+	if len(passed) != len(expected) {
+		t.Errorf("Expected checks %v, got %v", expected, passed)
+	}
+	for name, ok := range expected {
+		if passed[name] != ok {
+			t.Errorf("Expected check %q to pass: %t, got %t", name, ok, passed[name])
+		}
+	}
+
+	failed := report.Failed()
+	if len(failed) != 2 || failed[0].Name != "HTTPS certificate" || failed[1].Name != "bad credentials" {
+		t.Errorf("Expected the HTTPS certificate and bad credentials to fail hard, got %+v", failed)
+	}
+}
@@ -8,8 +8,13 @@
 package notifications
 
 import (
+	"context"
 	"github.com/pkg/errors"
 	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/crypto/sih"
+	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/elixxir/notifications-bot/events"
+	"gitlab.com/elixxir/notifications-bot/notifications/providers"
 	"gitlab.com/elixxir/notifications-bot/storage"
 	"gitlab.com/elixxir/primitives/notifications"
 	"gitlab.com/xx_network/primitives/id"
@@ -18,51 +23,126 @@ import (
 
 const notificationsTag = "notificationData"
 
+// sendRetryDelay is the base delay between attempts to send a notification to
+// a provider; it grows linearly with each attempt.
+const sendRetryDelay = 500 * time.Millisecond
+
 // Sender is a long-running thread which sends out received notifications to
-// the appropriate providers every sendFreq seconds.
+// the appropriate providers. Sends are aligned to the round schedule if one is
+// set, adapted to the notifications buffered if the interval is adaptive, and
+// otherwise made every sendFreq seconds.
 func (nb *Impl) Sender(sendFreq int) {
+	if nb.schedule != nil {
+		nb.scheduledSender()
+		return
+	}
+	if nb.adaptive != nil {
+		nb.adaptiveSender()
+		return
+	}
 	sendTicker := time.NewTicker(time.Duration(sendFreq) * time.Second)
+	defer sendTicker.Stop()
 	for {
 		select {
+		case <-nb.context().Done():
+			return
 		case <-sendTicker.C:
-			go func() {
-				// Retreive & swap notification buffer
-				notifBuf := nb.Storage.GetNotificationBuffer()
-				notifMap := notifBuf.Swap()
-
-				if len(notifMap) == 0 {
-					return
-				}
-
-				unsent := map[uint64][]*notifications.Data{}
-				rest, err := nb.SendBatch(notifMap)
-				if err != nil {
-					jww.ERROR.Printf("Failed to send notification batch: %+v", err)
-					// If we fail to run SendBatch, put everything back in unsent
-					for _, elist := range notifMap {
-						for _, n := range elist {
-							unsent[n.RoundID] = append(unsent[n.RoundID], n)
-						}
-					}
-				} else {
-					// Loop through rest and add to unsent map
-					for _, n := range rest {
-						unsent[n.RoundID] = append(unsent[n.RoundID], n)
-					}
-				}
-				// Re-add unsent notifications to the buffer
-				for rid, nd := range unsent {
-					notifBuf.Add(id.Round(rid), nd)
-				}
-			}()
+			go nb.flushBuffer()
+		}
+	}
+}
+
+// scheduledSender sends buffered notifications shortly after each round's
+// batch arrives, or after the next expected round if none has.
+func (nb *Impl) scheduledSender() {
+	lastSend := time.Now()
+	timer := time.NewTimer(time.Until(nb.schedule.next(lastSend, lastSend)))
+	defer timer.Stop()
+	for {
+		select {
+		case <-nb.context().Done():
+			return
+		case <-nb.schedule.arrived:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-timer.C:
+			lastSend = time.Now()
+			go nb.flushBuffer()
+		}
+		now := time.Now()
+		timer.Reset(nb.schedule.next(now, lastSend).Sub(now))
+	}
+}
+
+// adaptiveSender sends buffered notifications at the adaptive interval,
+// shortening it while sends find notifications buffered and lengthening it
+// while they find none.
+func (nb *Impl) adaptiveSender() {
+	timer := time.NewTimer(nb.adaptive.current)
+	defer timer.Stop()
+	for {
+		select {
+		case <-nb.context().Done():
+			return
+		case <-timer.C:
 		}
+		busy := nb.Storage.GetNotificationBuffer().Len() > 0 && !nb.inMaintenance()
+		go nb.flushBuffer()
+		timer.Reset(nb.adaptive.next(busy))
 	}
 }
 
+// flushBuffer swaps out the notification buffer and sends its contents,
+// returning anything which could not be sent to the buffer.
+func (nb *Impl) flushBuffer() {
+	// Leave notifications buffered while sends are paused
+	if nb.inMaintenance() || !nb.isActive() {
+		return
+	}
+
+	// Retreive & swap notification buffer
+	notifBuf := nb.Storage.GetNotificationBuffer()
+	notifMap := notifBuf.Swap()
+
+	if len(notifMap) == 0 {
+		return
+	}
+
+	ctx, cycle := withSendCycle(nb.context())
+	unsent := map[uint64][]*notifications.Data{}
+	rest, err := nb.SendBatch(ctx, notifMap)
+	if err != nil {
+		jww.ERROR.Printf("Failed to send notification batch: %+v", err)
+		// If we fail to run SendBatch, put everything back in unsent
+		for _, elist := range notifMap {
+			for _, n := range elist {
+				unsent[n.RoundID] = append(unsent[n.RoundID], n)
+			}
+		}
+	} else {
+		// Loop through rest and add to unsent map
+		for _, n := range rest {
+			unsent[n.RoundID] = append(unsent[n.RoundID], n)
+		}
+	}
+	// Re-add unsent notifications to the buffer
+	for rid, nd := range unsent {
+		notifBuf.Add(id.Round(rid), nd)
+	}
+	jww.INFO.Print(cycle.summary())
+}
+
 // SendBatch accepts the map of ephemeralID:list[notifications.Data]
-// It handles logic for building the CSV & sending to devices
-func (nb *Impl) SendBatch(data map[int64][]*notifications.Data) ([]*notifications.Data, error) {
-	csvs := map[int64]string{}
+// It handles logic for building the CSV & sending to devices. Matches for
+// several ephemeral IDs belonging to the same token are combined into a single
+// push carrying the total notification count. Notifications for users in
+// digest mode are held for their summary push instead. With the outbox enabled, pushes
+// are written to the outbox for the dispatcher instead of being sent directly.
+// The token lookup and sends are abandoned if ctx is done first.
+func (nb *Impl) SendBatch(ctx context.Context, data map[int64][]*notifications.Data) ([]*notifications.Data, error) {
+	data = nb.dropStale(data)
+	sent := map[int64][]*notifications.Data{}
 	var ephemerals []int64
 	var unsent []*notifications.Data
 	jww.INFO.Printf("data: %+v", data)
@@ -75,40 +155,477 @@ func (nb *Impl) SendBatch(data map[int64][]*notifications.Data) ([]*notification
 			toSend = ilist[:]
 		}
 
-		notifs, rest := notifications.BuildNotificationCSV(toSend, nb.maxPayloadBytes-len([]byte(notificationsTag)))
+		_, rest := notifications.BuildNotificationCSV(toSend, nb.maxPayloadBytes-len([]byte(notificationsTag)))
 		overflow = append(overflow, rest...)
-		csvs[i] = string(notifs)
+		sent[i] = withoutOverflow(toSend, rest)
 		ephemerals = append(ephemerals, i)
 		unsent = append(unsent, overflow...)
 	}
-	toNotify, err := nb.Storage.GetToNotify(ephemerals)
+	cycle := sendCycleFrom(ctx)
+	lookupCtx, cancel := withTimeout(ctx, nb.lookupTimeout)
+	toNotify, err := nb.Storage.WithContext(lookupCtx).GetToNotify(ephemerals)
+	cancel()
 	if err != nil {
-		return nil, errors.WithMessage(err, "Failed to get list of tokens to notify")
+		cached, ok := nb.cachedLookup(ephemerals)
+		if !ok {
+			return nil, errors.WithMessage(err, "Failed to get list of tokens to notify")
+		}
+		jww.WARN.Printf("Failed to get list of tokens to notify, using cached results: %+v", err)
+		toNotify = cached
+	} else if nb.lookups != nil {
+		nb.lookups.put(ephemerals, toNotify, nb.now())
 	}
-	for i := range toNotify {
-		go func(res storage.GTNResult) {
-			nb.notify(csvs[res.EphemeralId], res)
-		}(toNotify[i])
+	cycle.lookedUp(ephemerals, toNotify, err != nil)
+	var outbox []*storage.OutboxEntry
+	groups := groupByToken(toNotify)
+	sortByLane(groups)
+	for _, g := range groups {
+		var pending []*notifications.Data
+		ephemerals, conversation := unmuted(g)
+		perEphemeral := make(map[int64][]*notifications.Data, len(ephemerals))
+		for _, eid := range ephemerals {
+			perEphemeral[eid] = nb.forIdentities(sent[eid], g.matches[eid])
+			pending = append(pending, perEphemeral[eid]...)
+		}
+		if len(pending) == 0 {
+			continue
+		}
+		g.target = nb.withConversation(g.target, conversation)
+		if g.target.App == constants.MessengerWeb.String() &&
+			!nb.featureEnabled(FeatureWebPush, g.target.TransmissionRSAHash) {
+			jww.DEBUG.Printf("Web push is disabled for tRSA hash %+v, dropping %d notifications",
+				g.target.TransmissionRSAHash, len(pending))
+			continue
+		}
+		if nb.holdForDigest(ctx, g.target, len(pending)) {
+			cycle.heldForDigest()
+			continue
+		}
+		if pending = nb.withinQuota(ctx, g, ephemerals, perEphemeral); len(pending) == 0 {
+			continue
+		}
+
+		maxPushes := nb.maxPushesPerToken
+		if !nb.featureEnabled(FeatureMultiplePushes, g.target.TransmissionRSAHash) {
+			maxPushes = 1
+		}
+		for _, c := range chunkNotifications(pending, nb.payloadLimit(g.target), maxPushes) {
+			target := g.target
+			target.Count = c.count
+			target.MoreAvailable = c.moreAvailable
+			target.Silent = nb.quietRepeatPushes && target.NotifiedSinceOpen
+			if nb.outbox {
+				outbox = append(outbox, &storage.OutboxEntry{Target: target, Rounds: c.rounds, Payload: c.csv})
+				continue
+			}
+			req := NotificationRequest{Target: target, Payload: c.csv, Rounds: c.rounds}
+			cycle.goSend(func() { nb.notify(ctx, req) })
+		}
+	}
+	if nb.outbox {
+		err = nb.enqueuePushes(ctx, outbox)
+		if storage.IsReadOnly(err) {
+			// The outbox cannot be written until the database accepts
+			// writes again, so push directly rather than not at all
+			jww.WARN.Printf("Database is read-only, pushing %d notifications without the outbox", len(outbox))
+			for _, e := range outbox {
+				req := NotificationRequest{Target: e.Target, Payload: e.Payload, Rounds: e.Rounds}
+				cycle.goSend(func() { nb.notify(ctx, req) })
+			}
+		} else if err != nil {
+			return nil, errors.WithMessage(err, "Failed to write pushes to the outbox")
+		} else {
+			cycle.queuedPushes(len(outbox))
+		}
 	}
 	return unsent, nil
 }
 
-// notify is a helper function which handles sending notifications to either APNS or firebase
-func (nb *Impl) notify(csv string, toNotify storage.GTNResult) {
+// payloadChunk is the notification CSV sent in a single push.
+type payloadChunk struct {
+	csv           string
+	rounds        []uint64
+	count         int
+	moreAvailable bool
+}
+
+// chunkNotifications splits pending into CSVs of at most limit bytes. At most
+// maxPushes chunks are returned; if notifications remain after the last one,
+// it is flagged as having more available and the remainder is dropped, since
+// the client retrieves its messages from the network once woken.
+func chunkNotifications(pending []*notifications.Data, limit, maxPushes int) []payloadChunk {
+	if maxPushes < 1 {
+		maxPushes = 1
+	}
+	var chunks []payloadChunk
+	for len(pending) > 0 && len(chunks) < maxPushes {
+		csv, rest := notifications.BuildNotificationCSV(pending, limit)
+		if len(rest) == len(pending) {
+			jww.WARN.Printf("Could not fit a notification into a %d byte payload, dropping %d", limit, len(rest))
+			break
+		}
+		chunks = append(chunks, payloadChunk{
+			csv:           string(csv),
+			rounds:        sentRounds(pending, rest),
+			count:         len(pending) - len(rest),
+			moreAvailable: len(rest) > 0 && len(chunks) == maxPushes-1,
+		})
+		pending = rest
+	}
+	return chunks
+}
+
+// payloadLimit returns the number of bytes of notification CSV which can be
+// sent to target in a single push: the configured maximum, further capped by
+// the provider's own payload limit.
+func (nb *Impl) payloadLimit(target storage.GTNResult) int {
+	limit := nb.maxPayloadBytes - len([]byte(notificationsTag))
+	if pl, ok := nb.providers[target.App].(providers.PayloadLimiter); ok {
+		if max := pl.MaxCSV(target); max < limit {
+			limit = max
+		}
+	}
+	return limit
+}
+
+// notificationGroup holds every ephemeral ID in a batch which matched a single
+// token registration, so that they can be sent as one push. The results for each ephemeral
+// ID are kept, as several of the token's identities may share it.
+type notificationGroup struct {
+	target     storage.GTNResult
+	ephemerals []int64
+	matches    map[int64][]storage.GTNResult
+}
+
+// groupByToken groups the results of GetToNotify by the token, app and owner
+// of the registration, preserving the order in which each was first seen. A
+// token registered by several users is pushed to once for each of them.
+// Standby fallback tokens are left out.
+func groupByToken(toNotify []storage.GTNResult) []*notificationGroup {
+	groups := map[string]*notificationGroup{}
+	var ordered []*notificationGroup
+	for _, res := range toNotify {
+		// Fallback tokens are only pushed to once their primary has failed
+		if res.Standby {
+			continue
+		}
+		key := res.Token + "\x00" + res.App + "\x00" + string(res.TransmissionRSAHash)
+		g, ok := groups[key]
+		if !ok {
+			g = &notificationGroup{target: res, matches: map[int64][]storage.GTNResult{}}
+			groups[key] = g
+			ordered = append(ordered, g)
+		}
+		if _, ok = g.matches[res.EphemeralId]; !ok {
+			g.ephemerals = append(g.ephemerals, res.EphemeralId)
+		}
+		g.matches[res.EphemeralId] = append(g.matches[res.EphemeralId], res)
+	}
+	return ordered
+}
+
+// forIdentities returns the notifications for an ephemeral ID which are meant
+// for one of the identities it matched. Ephemeral IDs are short, so unrelated
+// identities may share one; when every matched identity has registered its
+// message identification preimages, notifications whose identity fingerprint
+// was made with none of them are dropped. Otherwise all are returned.
+func (nb *Impl) forIdentities(ndata []*notifications.Data, matches []storage.GTNResult) []*notifications.Data {
+	var preimages []sih.Preimage
+	for _, m := range matches {
+		opened, err := nb.Storage.OpenPreimages(m)
+		if err != nil {
+			jww.WARN.Printf("Failed to open preimages for tRSA hash %+v, not filtering: %+v", m.TransmissionRSAHash, err)
+			return ndata
+		}
+		if len(opened) == 0 {
+			return ndata
+		}
+		for _, p := range opened {
+			var preimage sih.Preimage
+			copy(preimage[:], p)
+			preimages = append(preimages, preimage)
+		}
+	}
+
+	var mine []*notifications.Data
+	for _, n := range ndata {
+		for _, preimage := range preimages {
+			if sih.ForMeFromMessageHash(preimage, n.MessageHash, n.IdentityFP) {
+				mine = append(mine, n)
+				break
+			}
+		}
+	}
+	if dropped := len(ndata) - len(mine); dropped > 0 {
+		jww.DEBUG.Printf("Dropped %d notifications for colliding identities", dropped)
+	}
+	return mine
+}
+
+// withoutOverflow returns the notifications in toSend which were not returned
+// as overflow in rest.
+func withoutOverflow(toSend, rest []*notifications.Data) []*notifications.Data {
+	overflow := make(map[*notifications.Data]struct{}, len(rest))
+	for _, n := range rest {
+		overflow[n] = struct{}{}
+	}
+	var fit []*notifications.Data
+	for _, n := range toSend {
+		if _, ok := overflow[n]; !ok {
+			fit = append(fit, n)
+		}
+	}
+	return fit
+}
+
+// NotificationRequest is a single push to a token: the notifications it
+// carries and how they are delivered. Target carries the ephemeral ID and
+// priority the push is for, and the hints the provider delivers it with, such
+// as its channel, sound and locale and whether it is silent, a digest or a
+// broadcast.
+type NotificationRequest struct {
+	Target storage.GTNResult
+	// Payload is the notification CSV; it is empty for pushes carrying no
+	// notifications, such as digests and re-registration nudges
+	Payload string
+	// Rounds are the rounds of the notifications in Payload
+	Rounds []uint64
+}
+
+// NotificationResult is the outcome of a NotificationRequest.
+type NotificationResult struct {
+	// Receipt is the provider's receipt for the last attempt
+	Receipt providers.Receipt
+	// Attempts is the number of sends made to the provider
+	Attempts int
+	// TokenValid is false if the provider rejected the token permanently
+	TokenValid bool
+	// Err is the error of the final attempt, nil if the push was delivered
+	Err error
+}
+
+// notify is a helper function which handles sending notifications to either APNS or firebase.
+// Failed sends are retried up to maxSendAttempts times before being moved to the
+// dead-letter queue; the error from the final attempt is in the result. Each
+// attempt is bounded by the send timeout, and no further attempts are made
+// once ctx is done.
+func (nb *Impl) notify(ctx context.Context, req NotificationRequest) NotificationResult {
+	toNotify := req.Target
 	provider, ok := nb.providers[toNotify.App]
 	if !ok {
 		jww.ERROR.Printf("Could not find provider for app %s", toNotify.App)
-		return
+		return NotificationResult{Err: errors.Errorf("Could not find provider for app %s", toNotify.App)}
 	}
-	tokenValid, err := provider.Notify(csv, toNotify)
+
+	// Only the provider sees the device token; storage, logs and the dead
+	// letter queue keep the token as stored
+	target, err := nb.Storage.OpenToken(toNotify)
 	if err != nil {
-		jww.ERROR.Println(err)
-		if !tokenValid {
+		return NotificationResult{Err: errors.WithMessagef(err, "Failed to open %s token for tRSA hash %+v", toNotify.App, toNotify.TransmissionRSAHash)}
+	}
+
+	var res NotificationResult
+	for {
+		res.Attempts++
+		sendCtx, cancel := withTimeout(ctx, nb.sendTimeout)
+		res.Receipt, res.TokenValid, res.Err = provider.Notify(sendCtx, req.Payload, target)
+		cancel()
+		if res.Err == nil || !res.TokenValid || res.Attempts >= nb.maxSendAttempts ||
+			errors.Is(res.Err, providers.ErrMisconfigured) {
+			break
+		}
+		jww.DEBUG.Printf("Send attempt %d for tRSA hash %+v failed, retrying: %+v", res.Attempts, toNotify.TransmissionRSAHash, res.Err)
+		if sleepErr := sleepContext(ctx, time.Duration(res.Attempts)*sendRetryDelay); sleepErr != nil {
+			res.Err = errors.WithMessage(res.Err, sleepErr.Error())
+			break
+		}
+	}
+	sendCycleFrom(ctx).sent(res)
+	nb.logDelivery(req, res)
+	nb.recordPush(req, res)
+	nb.publishSend(req, res)
+	if res.Err == nil {
+		nb.markNotified(req)
+	}
+
+	if res.Err != nil {
+		jww.ERROR.Println(res.Err)
+		if !res.TokenValid {
+			nb.publish(events.Event{
+				Type:                events.TokenPurge,
+				App:                 toNotify.App,
+				TransmissionRSAHash: toNotify.TransmissionRSAHash,
+				Rounds:              req.Rounds,
+				Error:               res.Err.Error(),
+			})
+			if toNotify.Fallback != "" {
+				return nb.failover(ctx, req)
+			}
 			jww.DEBUG.Printf("User with tRSA hash %+v has invalid token [%+v] for app %s - attempting to remove", toNotify.TransmissionRSAHash, toNotify.Token, toNotify.App)
-			err := nb.Storage.DeleteToken(toNotify.Token)
+			err := nb.Storage.DeleteToken(toNotify.Token, toNotify.App)
 			if err != nil {
 				jww.ERROR.Printf("Failed to remove %s token registration tRSA hash %+v: %+v", toNotify.App, toNotify.TransmissionRSAHash, err)
+			} else if nb.reregistrationNudges {
+				nb.nudgeSiblings(ctx, toNotify)
+			}
+		} else {
+			if errors.Is(res.Err, providers.ErrMisconfigured) {
+				jww.ERROR.Printf("ALERT: %s provider rejected the bot's configuration: %+v", toNotify.App, res.Err)
+				nb.publish(events.Event{
+					Type:   events.ProviderMisconfigured,
+					App:    toNotify.App,
+					Rounds: req.Rounds,
+					Error:  res.Err.Error(),
+				})
+			}
+			// Test pushes are reported to the client which requested them
+			// rather than redriven
+			if !toNotify.Test {
+				nb.deadLetter(req, res)
 			}
 		}
 	}
+	return res
+}
+
+// failover replaces a permanently rejected token with its fallback and resends
+// the notifications to it. The delivery log entries of the resend are flagged
+// so it is visible which provider delivered them.
+func (nb *Impl) failover(ctx context.Context, req NotificationRequest) NotificationResult {
+	failed := req.Target
+	jww.DEBUG.Printf("User with tRSA hash %+v has invalid token [%+v] for app %s - failing over to its fallback", failed.TransmissionRSAHash, failed.Token, failed.App)
+	promoted, err := nb.Storage.PromoteFallbackToken(failed.Token, failed.Fallback, failed.App, failed.TransmissionRSAHash)
+	if err != nil {
+		jww.ERROR.Printf("Failed to fail over %s token registration tRSA hash %+v: %+v", failed.App, failed.TransmissionRSAHash, err)
+		return NotificationResult{Err: err}
+	}
+
+	target := failed
+	target.Token = promoted.Token
+	target.SealedToken = promoted.SealedToken
+	target.App = promoted.App
+	target.Priority = promoted.Priority
+	target.ChannelID = promoted.ChannelID
+	target.Sound = promoted.Sound
+	target.Locale = promoted.Locale
+	target.Privacy = promoted.Privacy
+	target.Fallback = promoted.Fallback
+	target.Standby = false
+	target.FailedOver = true
+	req.Target = target
+	return nb.notify(ctx, req)
+}
+
+// markNotified records that the user was sent a visible notification push,
+// so their later pushes are silent until they open the app.
+func (nb *Impl) markNotified(req NotificationRequest) {
+	target := req.Target
+	if !nb.quietRepeatPushes || target.NotifiedSinceOpen || (req.Payload == "" && !target.Digested) ||
+		target.Broadcast != "" || target.Reregister != "" {
+		return
+	}
+	err := nb.Storage.MarkUserNotified(target.TransmissionRSAHash)
+	if err != nil {
+		jww.WARN.Printf("Failed to mark user with tRSA hash %+v as notified: %+v", target.TransmissionRSAHash, err)
+	}
+}
+
+// nudgeSiblings sends a data push to the other devices tracking the identity
+// of a purged token, asking them to have the purged device refresh its
+// registration. Fallback tokens on standby are skipped, as are devices of apps
+// with no provider.
+func (nb *Impl) nudgeSiblings(ctx context.Context, purged storage.GTNResult) {
+	siblings, err := nb.Storage.GetToNotify([]int64{purged.EphemeralId})
+	if err != nil {
+		jww.WARN.Printf("Failed to look up sibling devices of purged %s token for tRSA hash %+v: %+v", purged.App, purged.TransmissionRSAHash, err)
+		return
+	}
+	seen := map[string]struct{}{purged.Token: {}}
+	for _, sibling := range siblings {
+		if _, ok := seen[sibling.Token]; ok || sibling.Token == "" || sibling.Standby {
+			continue
+		}
+		seen[sibling.Token] = struct{}{}
+		provider, ok := nb.providers[sibling.App]
+		if !ok {
+			continue
+		}
+		sibling.Reregister = purged.App
+		target, err := nb.Storage.OpenToken(sibling)
+		if err != nil {
+			jww.WARN.Printf("Failed to open %s token for tRSA hash %+v: %+v", sibling.App, sibling.TransmissionRSAHash, err)
+			continue
+		}
+		sendCtx, cancel := withTimeout(ctx, nb.sendTimeout)
+		_, _, err = provider.Notify(sendCtx, "", target)
+		cancel()
+		if err != nil {
+			jww.DEBUG.Printf("Failed to nudge %s device of tRSA hash %+v to re-register its sibling: %+v", sibling.App, sibling.TransmissionRSAHash, err)
+			continue
+		}
+		nb.publish(events.Event{
+			Type:                events.ReregistrationNudge,
+			App:                 sibling.App,
+			TransmissionRSAHash: sibling.TransmissionRSAHash,
+		})
+	}
+}
+
+// withTimeout returns a context derived from ctx which is done after d; it is
+// only cancelled with ctx if d is not positive.
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// sleepContext waits for d, returning early with the context's error if ctx
+// is done first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// publishSend publishes the outcome of a send to the event bus.
+func (nb *Impl) publishSend(req NotificationRequest, res NotificationResult) {
+	e := events.Event{
+		Type:                events.SendSuccess,
+		App:                 req.Target.App,
+		TransmissionRSAHash: req.Target.TransmissionRSAHash,
+		Rounds:              req.Rounds,
+	}
+	if res.Err != nil {
+		e.Type = events.SendFailure
+		e.Error = res.Err.Error()
+	}
+	nb.publish(e)
+}
+
+// sentRounds returns the unique round IDs of the notifications in toSend which
+// were not returned as overflow in rest.
+func sentRounds(toSend, rest []*notifications.Data) []uint64 {
+	overflow := make(map[*notifications.Data]struct{}, len(rest))
+	for _, n := range rest {
+		overflow[n] = struct{}{}
+	}
+
+	seen := map[uint64]struct{}{}
+	var rounds []uint64
+	for _, n := range toSend {
+		if _, ok := overflow[n]; ok {
+			continue
+		}
+		if _, ok := seen[n.RoundID]; !ok {
+			seen[n.RoundID] = struct{}{}
+			rounds = append(rounds, n.RoundID)
+		}
+	}
+	return rounds
 }
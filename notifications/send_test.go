@@ -1,9 +1,14 @@
 package notifications
 
 import (
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/crypto/sih"
 	"gitlab.com/elixxir/notifications-bot/constants"
 	"gitlab.com/elixxir/notifications-bot/notifications/providers"
 	"gitlab.com/elixxir/notifications-bot/storage"
+	"gitlab.com/elixxir/notifications-bot/testutil"
 	"gitlab.com/elixxir/primitives/notifications"
 	"gitlab.com/xx_network/primitives/id"
 	"gitlab.com/xx_network/primitives/id/ephemeral"
@@ -56,12 +61,12 @@ func TestImpl_SendBatch(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = i.SendBatch(map[int64][]*notifications.Data{})
+	_, err = i.SendBatch(context.Background(), map[int64][]*notifications.Data{})
 	if err != nil {
 		t.Errorf("Error on sending empty batch: %+v", err)
 	}
 
-	unsent, err := i.SendBatch(map[int64][]*notifications.Data{
+	unsent, err := i.SendBatch(context.Background(), map[int64][]*notifications.Data{
 		eph.EphemeralId: {{EphemeralID: eph.EphemeralId, RoundID: 3, MessageHash: []byte("hello"), IdentityFP: []byte("identity")}},
 	})
 	if err != nil {
@@ -73,8 +78,8 @@ func TestImpl_SendBatch(t *testing.T) {
 
 	i.maxPayloadBytes = 4096
 	i.maxNotifications = 20
-	unsent, err = i.SendBatch(map[int64][]*notifications.Data{
-		1: {{EphemeralID: eph.EphemeralId, RoundID: 3, MessageHash: []byte("hello"), IdentityFP: []byte("identity")}},
+	unsent, err = i.SendBatch(context.Background(), map[int64][]*notifications.Data{
+		eph.EphemeralId: {{EphemeralID: eph.EphemeralId, RoundID: 3, MessageHash: []byte("hello"), IdentityFP: []byte("identity")}},
 	})
 	if err != nil {
 		t.Errorf("Error on sending small batch again: %+v", err)
@@ -91,3 +96,326 @@ func TestImpl_SendBatch(t *testing.T) {
 		t.Errorf("Did not receive data before timeout")
 	}
 }
+
+// Tests that sentRounds returns each sent round once, excluding overflow.
+func Test_sentRounds(t *testing.T) {
+	n1 := &notifications.Data{RoundID: 1}
+	n2 := &notifications.Data{RoundID: 1}
+	n3 := &notifications.Data{RoundID: 2}
+	n4 := &notifications.Data{RoundID: 3}
+
+	rounds := sentRounds([]*notifications.Data{n1, n2, n3, n4}, []*notifications.Data{n4})
+	if len(rounds) != 2 || rounds[0] != 1 || rounds[1] != 2 {
+		t.Errorf("Did not receive expected rounds\n\tExpected: %v\n\tReceived: %v", []uint64{1, 2}, rounds)
+	}
+}
+
+// Tests that groupByToken combines results for the same token, preserving the
+// order tokens were first seen in.
+func Test_groupByToken(t *testing.T) {
+	toNotify := []storage.GTNResult{
+		{Token: "a", EphemeralId: 1},
+		{Token: "b", EphemeralId: 1},
+		{Token: "a", EphemeralId: 2},
+		{Token: "a", EphemeralId: 3},
+		{Token: "a", EphemeralId: 3},
+	}
+
+	groups := groupByToken(toNotify)
+	if len(groups) != 2 {
+		t.Fatalf("Expected 2 groups, received %d", len(groups))
+	}
+	if groups[0].target.Token != "a" || len(groups[0].ephemerals) != 3 {
+		t.Errorf("Unexpected first group: %+v", groups[0])
+	}
+	if groups[1].target.Token != "b" || len(groups[1].ephemerals) != 1 {
+		t.Errorf("Unexpected second group: %+v", groups[1])
+	}
+	if len(groups[0].matches[3]) != 2 {
+		t.Errorf("Both identities matching ephemeral ID 3 should be kept: %+v", groups[0].matches)
+	}
+}
+
+// Tests that groupByToken keeps the registrations of a token by different
+// users and apps apart.
+func Test_groupByToken_PerRegistration(t *testing.T) {
+	toNotify := []storage.GTNResult{
+		{Token: "a", App: "app", TransmissionRSAHash: []byte("user0"), EphemeralId: 1},
+		{Token: "a", App: "app", TransmissionRSAHash: []byte("user1"), EphemeralId: 1},
+		{Token: "a", App: "other", TransmissionRSAHash: []byte("user0"), EphemeralId: 1},
+		{Token: "a", App: "app", TransmissionRSAHash: []byte("user0"), EphemeralId: 2},
+	}
+
+	groups := groupByToken(toNotify)
+	if len(groups) != 3 {
+		t.Fatalf("Expected 3 groups, received %d", len(groups))
+	}
+	if len(groups[0].ephemerals) != 2 || len(groups[1].ephemerals) != 1 || len(groups[2].ephemerals) != 1 {
+		t.Errorf("Unexpected groups: %+v, %+v, %+v", groups[0], groups[1], groups[2])
+	}
+}
+
+// Tests that notifications for an ephemeral ID are only filtered by identity
+// fingerprint when every matched identity registered preimages.
+func TestImpl_forIdentities(t *testing.T) {
+	impl := &Impl{Storage: testutil.NewStorage(t)}
+	var mine, theirs sih.Preimage
+	copy(mine[:], "mine")
+	copy(theirs[:], "theirs")
+	hash := []byte("messageHash")
+	forMe := &notifications.Data{MessageHash: hash, IdentityFP: sih.HashFromMessageHash(mine, hash)}
+	forThem := &notifications.Data{MessageHash: hash, IdentityFP: sih.HashFromMessageHash(theirs, hash)}
+	ndata := []*notifications.Data{forMe, forThem}
+
+	registered, err := json.Marshal([][]byte{mine[:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := impl.forIdentities(ndata, []storage.GTNResult{{Preimages: registered}})
+	if len(got) != 1 || got[0] != forMe {
+		t.Errorf("Only the notification for the identity should be kept, got %+v", got)
+	}
+
+	got = impl.forIdentities(ndata, []storage.GTNResult{{Preimages: registered}, {}})
+	if len(got) != 2 {
+		t.Errorf("Notifications should not be filtered for identities without preimages, got %+v", got)
+	}
+}
+
+// Tests that chunkNotifications splits notifications across pushes and flags
+// the last permitted push when notifications are truncated.
+func Test_chunkNotifications(t *testing.T) {
+	var pending []*notifications.Data
+	for i := 0; i < 30; i++ {
+		pending = append(pending, &notifications.Data{
+			EphemeralID: int64(i),
+			RoundID:     uint64(i),
+			MessageHash: make([]byte, 32),
+			IdentityFP:  make([]byte, 25),
+		})
+	}
+	all, _ := notifications.BuildNotificationCSV(pending, 1<<20)
+	limit := len(all) / 4
+
+	chunks := chunkNotifications(pending, limit, 100)
+	total := 0
+	for i, c := range chunks {
+		if len(c.csv) > limit {
+			t.Errorf("Chunk %d of %d bytes exceeds limit of %d", i, len(c.csv), limit)
+		}
+		if c.moreAvailable {
+			t.Errorf("Chunk %d should not be flagged when nothing was truncated", i)
+		}
+		total += c.count
+	}
+	if total != len(pending) {
+		t.Errorf("Chunks did not contain every notification\n\tExpected: %d\n\tReceived: %d", len(pending), total)
+	}
+
+	chunks = chunkNotifications(pending, limit, 2)
+	if len(chunks) != 2 {
+		t.Fatalf("Expected 2 chunks, received %d", len(chunks))
+	}
+	if chunks[0].moreAvailable || !chunks[1].moreAvailable {
+		t.Errorf("Only the last chunk should be flagged as having more available")
+	}
+}
+
+// blockingProvider blocks each send until its context is done.
+type blockingProvider struct {
+	calls int
+}
+
+func (bp *blockingProvider) Notify(ctx context.Context, csv string, target storage.GTNResult) (providers.Receipt, bool, error) {
+	bp.calls++
+	<-ctx.Done()
+	return providers.Receipt{}, true, ctx.Err()
+}
+
+// Tests that each send attempt is abandoned after the send timeout, and that
+// no further attempts are made once the caller's context is cancelled.
+func TestImpl_notify_Timeout(t *testing.T) {
+	s, err := storage.NewStorage("", "", "TestImpl_notify_Timeout", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+	bp := &blockingProvider{}
+	impl := &Impl{
+		Storage:         s,
+		maxSendAttempts: 2,
+		sendTimeout:     10 * time.Millisecond,
+		providers: map[string]providers.Provider{
+			constants.MessengerAndroid.String(): bp,
+		},
+	}
+	target := storage.GTNResult{
+		Token:               "token",
+		App:                 constants.MessengerAndroid.String(),
+		TransmissionRSAHash: []byte("trsaHash"),
+		EphemeralId:         5,
+	}
+
+	err = impl.notify(context.Background(), NotificationRequest{Target: target, Payload: "csv", Rounds: []uint64{1}}).Err
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded, received %+v", err)
+	}
+	if bp.calls != 2 {
+		t.Errorf("Expected %d send attempts, provider received %d", 2, bp.calls)
+	}
+
+	bp.calls = 0
+	impl.sendTimeout = 0
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = impl.notify(ctx, NotificationRequest{Target: target, Payload: "csv", Rounds: []uint64{2}}).Err
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded, received %+v", err)
+	}
+	if bp.calls != 1 {
+		t.Errorf("Expected %d send attempt after cancellation, provider received %d", 1, bp.calls)
+	}
+}
+
+// Tests that when a token is purged the other devices tracking its identity
+// are asked to refresh its registration, and that nothing is sent if nudges
+// are disabled.
+func TestImpl_notify_ReregistrationNudge(t *testing.T) {
+	s := testutil.NewStorage(t)
+	android, ios := constants.MessengerAndroid.String(), constants.MessengerIOS.String()
+	unregistered := testutil.Result{Invalid: true, Err: errors.New("unregistered")}
+	androidProvider := testutil.NewProvider(unregistered, testutil.Result{}, unregistered)
+	iosProvider := testutil.NewProvider()
+	impl := &Impl{
+		Storage:              s,
+		maxSendAttempts:      1,
+		reregistrationNudges: true,
+		providers: map[string]providers.Provider{
+			android: androidProvider,
+			ios:     iosProvider,
+		},
+	}
+
+	trsa := []byte("trsa")
+	iid, err := ephemeral.GetIntermediaryId(id.NewIdFromString("user", id.User, t))
+	if err != nil {
+		t.Fatalf("Failed to get intermediary ID: %+v", err)
+	}
+	for token, app := range map[string]string{"stale": android, "stale2": android, "sibling": ios} {
+		if err = s.RegisterToken(token, app, trsa); err != nil {
+			t.Fatalf("Failed to register token: %+v", err)
+		}
+	}
+	if err = s.RegisterTrackedID([][]byte{iid}, trsa, 0, 8); err != nil {
+		t.Fatalf("Failed to register tracked ID: %+v", err)
+	}
+	eph, err := s.GetLatestEphemeral()
+	if err != nil {
+		t.Fatalf("Failed to get ephemeral: %+v", err)
+	}
+	trsaHash, err := storage.HashTransmissionRSA(trsa)
+	if err != nil {
+		t.Fatalf("Failed to hash transmission RSA: %+v", err)
+	}
+	target := storage.GTNResult{Token: "stale", App: android, TransmissionRSAHash: trsaHash, EphemeralId: eph.EphemeralId}
+
+	if err = impl.notify(context.Background(), NotificationRequest{Target: target, Payload: "csv", Rounds: []uint64{1}}).Err; err == nil {
+		t.Fatal("Send to invalid token should fail")
+	}
+	sends := iosProvider.Sends()
+	if len(sends) != 1 {
+		t.Fatalf("Expected the sibling device to be nudged once, received %d sends", len(sends))
+	}
+	if sends[0].Target.Token != "sibling" || sends[0].Target.Reregister != android || sends[0].CSV != "" {
+		t.Errorf("Unexpected nudge: %+v", sends[0])
+	}
+	sends = androidProvider.Sends()
+	if len(sends) != 2 || sends[1].Target.Token != "stale2" || sends[1].Target.Reregister != android {
+		t.Errorf("Expected the other device of the same app to be nudged: %+v", sends)
+	}
+
+	impl.reregistrationNudges = false
+	target.Token = "stale2"
+	if err = impl.notify(context.Background(), NotificationRequest{Target: target, Payload: "csv", Rounds: []uint64{2}}).Err; err == nil {
+		t.Fatal("Send to invalid token should fail")
+	}
+	if sends = iosProvider.Sends(); len(sends) != 1 {
+		t.Errorf("No nudge should be sent when disabled, received %d sends", len(sends))
+	}
+}
+
+// Tests that with quiet repeat pushes, only the first push after the app is
+// opened is visible.
+func TestImpl_SendBatch_QuietRepeatPushes(t *testing.T) {
+	s := testutil.NewStorage(t)
+	android := constants.MessengerAndroid.String()
+	provider := testutil.NewProvider()
+	impl := &Impl{
+		Storage:           s,
+		maxSendAttempts:   1,
+		maxNotifications:  20,
+		maxPayloadBytes:   4096,
+		maxPushesPerToken: 1,
+		quietRepeatPushes: true,
+		providers:         map[string]providers.Provider{android: provider},
+	}
+
+	trsa := []byte("trsa")
+	iid, err := ephemeral.GetIntermediaryId(id.NewIdFromString("user", id.User, t))
+	if err != nil {
+		t.Fatalf("Failed to get intermediary ID: %+v", err)
+	}
+	if err = s.RegisterToken("token", android, trsa); err != nil {
+		t.Fatalf("Failed to register token: %+v", err)
+	}
+	if err = s.RegisterTrackedID([][]byte{iid}, trsa, 0, 8); err != nil {
+		t.Fatalf("Failed to register tracked ID: %+v", err)
+	}
+	eph, err := s.GetLatestEphemeral()
+	if err != nil {
+		t.Fatalf("Failed to get ephemeral: %+v", err)
+	}
+	trsaHash, err := storage.HashTransmissionRSA(trsa)
+	if err != nil {
+		t.Fatalf("Failed to hash transmission RSA: %+v", err)
+	}
+
+	// send sends a batch and returns whether its push was silent once the
+	// user's notified flag has settled
+	send := func(round uint64) bool {
+		sent := len(provider.Sends())
+		_, err := impl.SendBatch(context.Background(), map[int64][]*notifications.Data{
+			eph.EphemeralId: {{EphemeralID: eph.EphemeralId, RoundID: round, MessageHash: []byte("hello"), IdentityFP: []byte("identity")}},
+		})
+		if err != nil {
+			t.Fatalf("Failed to send batch: %+v", err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			sends := provider.Sends()
+			u, err := s.GetUser(trsaHash)
+			if err != nil {
+				t.Fatalf("Failed to get user: %+v", err)
+			}
+			if len(sends) > sent && u.NotifiedSinceOpen {
+				return sends[len(sends)-1].Target.Silent
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Push for round %d was not sent", round)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if send(1) {
+		t.Errorf("First push should be visible")
+	}
+	if !send(2) {
+		t.Errorf("Push to a user already notified should be silent")
+	}
+	if err = impl.appOpened(trsa); err != nil {
+		t.Fatalf("Failed to record app open: %+v", err)
+	}
+	if send(3) {
+		t.Errorf("First push after the app was opened should be visible")
+	}
+}
@@ -0,0 +1,64 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package notifications
+
+import (
+	"fmt"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/primitives/notifications"
+	"sync/atomic"
+	"time"
+)
+
+// isStale returns true if a notification received at the passed in time is
+// older than the max notification age, and so is no longer worth waking a
+// device for. Nothing is stale if no max age is set.
+func (nb *Impl) isStale(received time.Time) bool {
+	return nb.maxNotificationAge > 0 && nb.now().Sub(received) > nb.maxNotificationAge
+}
+
+// dropStale returns data without the notifications of rounds whose batch was
+// received longer ago than the max notification age, as happens when they
+// are held back by overflow or send failures. Notifications of rounds not
+// in the round store are kept.
+func (nb *Impl) dropStale(data map[int64][]*notifications.Data) map[int64][]*notifications.Data {
+	if nb.maxNotificationAge <= 0 {
+		return data
+	}
+	fresh := make(map[int64][]*notifications.Data, len(data))
+	dropped := 0
+	for eid, ilist := range data {
+		for _, n := range ilist {
+			received, ok := nb.roundStore.Load(n.RoundID)
+			if ok && nb.isStale(received.(time.Time)) {
+				dropped++
+				continue
+			}
+			fresh[eid] = append(fresh[eid], n)
+		}
+	}
+	nb.countStale(dropped)
+	return fresh
+}
+
+// countStale records that n notifications were dropped for being stale.
+func (nb *Impl) countStale(n int) {
+	if n == 0 {
+		return
+	}
+	atomic.AddUint64(&nb.droppedStale, uint64(n))
+	jww.INFO.Printf("Dropped %d notifications older than %s", n, nb.maxNotificationAge)
+}
+
+// formatStaleMetrics renders the number of stale notifications dropped as a
+// Prometheus counter.
+func formatStaleMetrics(dropped uint64) string {
+	return fmt.Sprintf("# HELP notifications_dropped_stale_total Notifications dropped for being older than the max notification age.\n"+
+		"# TYPE notifications_dropped_stale_total counter\n"+
+		"notifications_dropped_stale_total %d\n", dropped)
+}
@@ -0,0 +1,40 @@
+package notifications
+
+import (
+	"gitlab.com/elixxir/notifications-bot/clock"
+	"gitlab.com/elixxir/primitives/notifications"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tests that notifications of rounds received longer ago than the max age are
+// dropped and counted, while fresh and unknown rounds are kept.
+func TestImpl_dropStale(t *testing.T) {
+	now := time.Now()
+	impl := &Impl{clock: clock.NewFake(now), maxNotificationAge: time.Hour}
+	impl.roundStore.Store(uint64(1), now.Add(-2*time.Hour))
+	impl.roundStore.Store(uint64(2), now.Add(-time.Minute))
+
+	stale := &notifications.Data{EphemeralID: 5, RoundID: 1}
+	fresh := &notifications.Data{EphemeralID: 5, RoundID: 2}
+	unknown := &notifications.Data{EphemeralID: 6, RoundID: 3}
+	kept := impl.dropStale(map[int64][]*notifications.Data{
+		5: {stale, fresh},
+		6: {unknown},
+	})
+	if len(kept[5]) != 1 || kept[5][0] != fresh || len(kept[6]) != 1 {
+		t.Errorf("Only the stale notification should be dropped, got %+v", kept)
+	}
+	if impl.droppedStale != 1 {
+		t.Errorf("Expected 1 stale notification to be counted, got %d", impl.droppedStale)
+	}
+	if !strings.Contains(formatStaleMetrics(impl.droppedStale), "notifications_dropped_stale_total 1\n") {
+		t.Errorf("Unexpected metrics: %s", formatStaleMetrics(impl.droppedStale))
+	}
+
+	impl.maxNotificationAge = 0
+	if kept = impl.dropStale(map[int64][]*notifications.Data{5: {stale}}); len(kept[5]) != 1 {
+		t.Errorf("Nothing should be dropped without a max age, got %+v", kept)
+	}
+}
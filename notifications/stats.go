@@ -0,0 +1,154 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package notifications
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of the registrations held in storage.
+type Stats struct {
+	TokensByApp       map[string]int64            `json:"tokensByApp"`
+	TokensByVersion   []storage.TokenVersionCount `json:"tokensByVersion"`
+	Users             int64                       `json:"users"`
+	QuarantinedUsers  int64                       `json:"quarantinedUsers"`
+	TrackedIDs        int64                       `json:"trackedIds"`
+	EphemeralsByEpoch map[int32]int64             `json:"ephemeralsByEpoch"`
+	Timestamp         time.Time                   `json:"timestamp"`
+}
+
+// collectStats counts the registrations held in storage.
+func (nb *Impl) collectStats() (*Stats, error) {
+	var err error
+	stats := &Stats{Timestamp: nb.now()}
+	if stats.TokensByApp, err = nb.Storage.CountTokensByApp(); err != nil {
+		return nil, errors.WithMessage(err, "Failed to count tokens")
+	}
+	if stats.TokensByVersion, err = nb.Storage.CountTokensByVersion(); err != nil {
+		return nil, errors.WithMessage(err, "Failed to count tokens by version")
+	}
+	if stats.Users, err = nb.Storage.CountUsers(); err != nil {
+		return nil, errors.WithMessage(err, "Failed to count users")
+	}
+	if stats.QuarantinedUsers, err = nb.Storage.CountQuarantinedUsers(); err != nil {
+		return nil, errors.WithMessage(err, "Failed to count quarantined users")
+	}
+	if stats.TrackedIDs, err = nb.Storage.CountIdentities(); err != nil {
+		return nil, errors.WithMessage(err, "Failed to count tracked IDs")
+	}
+	if stats.EphemeralsByEpoch, err = nb.Storage.CountEphemeralsByEpoch(); err != nil {
+		return nil, errors.WithMessage(err, "Failed to count ephemerals")
+	}
+	return stats, nil
+}
+
+// StatsReporter is a long-running thread which collects registration stats
+// on startup and every interval, logging them and keeping the latest snapshot
+// for the metrics endpoint.
+func (nb *Impl) StatsReporter(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for {
+		stats, err := nb.collectStats()
+		if err != nil {
+			jww.WARN.Printf("Failed to collect registration stats: %+v", err)
+		} else {
+			nb.stats.Store(stats)
+			var ephemerals int64
+			for _, n := range stats.EphemeralsByEpoch {
+				ephemerals += n
+			}
+			jww.INFO.Printf("Registrations: %d users, %d tracked IDs, %d ephemerals, tokens by app %v",
+				stats.Users, stats.TrackedIDs, ephemerals, stats.TokensByApp)
+		}
+		<-ticker.C
+	}
+}
+
+// handleMetrics serves the latest registration stats in the Prometheus text
+// exposition format. Stats are collected on demand if the reporter has not
+// run yet.
+func (nb *Impl) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		adminError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	stats, ok := nb.stats.Load().(*Stats)
+	if !ok {
+		var err error
+		stats, err = nb.collectStats()
+		if err != nil {
+			adminError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	gateways, err := nb.gatewayStatuses(time.Now())
+	if err != nil {
+		jww.WARN.Printf("Leaving gateway watermarks out of metrics: %+v", err)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, err = w.Write([]byte(formatMetrics(stats) + formatCanaryMetrics(nb.canaries.list()) +
+		formatGatewayMetrics(gateways) + formatTenantMetrics(nb.tenants) + formatFailoverMetrics(nb.lease) +
+		formatStaleMetrics(atomic.LoadUint64(&nb.droppedStale)) + nb.rpcs.format() + nb.Storage.QueryMetrics() +
+		formatDegradedMetrics(nb.writeAhead)))
+	if err != nil {
+		jww.ERROR.Printf("Failed to write metrics response: %+v", err)
+	}
+}
+
+// formatMetrics renders stats as Prometheus gauges.
+func formatMetrics(stats *Stats) string {
+	var b strings.Builder
+	gauge := func(name, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	}
+
+	gauge("notifications_registered_tokens", "Registered tokens by tenant and app.")
+	apps := make([]string, 0, len(stats.TokensByApp))
+	for app := range stats.TokensByApp {
+		apps = append(apps, app)
+	}
+	sort.Strings(apps)
+	for _, app := range apps {
+		tenant, name := constants.SplitTenant(app)
+		fmt.Fprintf(&b, "notifications_registered_tokens{tenant=%q,app=%q} %d\n", tenant, name, stats.TokensByApp[app])
+	}
+
+	gauge("notifications_registered_tokens_by_version", "Registered tokens by app and client reported version.")
+	for _, c := range stats.TokensByVersion {
+		tenant, name := constants.SplitTenant(c.App)
+		fmt.Fprintf(&b, "notifications_registered_tokens_by_version{tenant=%q,app=%q,platform=%q,app_version=%q,sdk_version=%q} %d\n",
+			tenant, name, c.Platform, c.AppVersion, c.SDKVersion, c.Count)
+	}
+
+	gauge("notifications_registered_users", "Registered users.")
+	fmt.Fprintf(&b, "notifications_registered_users %d\n", stats.Users)
+	gauge("notifications_quarantined_users", "Users whose registrar signature no longer verifies.")
+	fmt.Fprintf(&b, "notifications_quarantined_users %d\n", stats.QuarantinedUsers)
+	gauge("notifications_tracked_ids", "Tracked intermediary IDs.")
+	fmt.Fprintf(&b, "notifications_tracked_ids %d\n", stats.TrackedIDs)
+
+	gauge("notifications_ephemerals", "Stored ephemeral IDs by epoch.")
+	epochs := make([]int32, 0, len(stats.EphemeralsByEpoch))
+	for epoch := range stats.EphemeralsByEpoch {
+		epochs = append(epochs, epoch)
+	}
+	sort.Slice(epochs, func(i, j int) bool { return epochs[i] < epochs[j] })
+	for _, epoch := range epochs {
+		fmt.Fprintf(&b, "notifications_ephemerals{epoch=\"%d\"} %d\n", epoch, stats.EphemeralsByEpoch[epoch])
+	}
+	return b.String()
+}
@@ -0,0 +1,41 @@
+package notifications
+
+import (
+	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Tests that the metrics endpoint reports registration counts as gauges.
+func TestImpl_handleMetrics(t *testing.T) {
+	s, err := storage.NewStorage("", "", "TestImpl_handleMetrics", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+	_, err = s.RegisterForNotifications([]byte("iid"), []byte("trsa"), "token",
+		constants.MessengerIOS.String(), 7, 16)
+	if err != nil {
+		t.Fatalf("Failed to register: %+v", err)
+	}
+	impl := &Impl{Storage: s}
+
+	rec := httptest.NewRecorder()
+	impl.adminHandler("secret").ServeHTTP(rec, newAdminRequest(http.MethodGet, "/metrics", "secret"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", rec.Code, rec.Body.String())
+	}
+	body := rec.Body.String()
+	for _, expected := range []string{
+		`notifications_registered_tokens{tenant="",app="messengerIOS"} 1`,
+		"notifications_registered_users 1",
+		"notifications_tracked_ids 1",
+		`notifications_ephemerals{epoch="7"}`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Metrics missing %q:\n%s", expected, body)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Tenants are independent apps hosted by the bot alongside its own. Each has
+// its own push credentials, limits and token quota; their tokens are
+// registered with the app <tenant>/<push service>, e.g. acme/fcm, which scopes
+// their rows in storage.
+
+package notifications
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/elixxir/notifications-bot/notifications/providers"
+	"golang.org/x/time/rate"
+	"gorm.io/gorm"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// tenantName matches valid tenant names. They are used in LIKE patterns, so
+// they may not contain wildcards.
+var tenantName = regexp.MustCompile(`^[a-zA-Z0-9-]+$`)
+
+// TenantParams configures a tenant. Push services without credentials are
+// not served for the tenant.
+type TenantParams struct {
+	Name string `mapstructure:"name"`
+
+	// FBCreds is the path to the tenant's firebase service account key
+	FBCreds    string               `mapstructure:"fbCreds"`
+	FCMChannel ChannelParams        `mapstructure:"fcmChannel"`
+	APNS       providers.APNSParams `mapstructure:"apns"`
+	// WebPush is disabled for the tenant if no VAPID key is set
+	WebPush providers.WebPushParams `mapstructure:"webPush"`
+
+	// ProviderLimits bounds each of the tenant's push services, keyed by
+	// push service name as for the bot's own apps
+	ProviderLimits map[string]ProviderLimits `mapstructure:"providerLimits"`
+	// Rate is the maximum pushes per second across all of the tenant's push
+	// services; unlimited if 0
+	Rate float64 `mapstructure:"rate"`
+	// MaxTokens is the most tokens the tenant may have registered; unlimited
+	// if 0
+	MaxTokens int64 `mapstructure:"maxTokens"`
+}
+
+// tenant holds the limits and push counters shared by a tenant's providers.
+type tenant struct {
+	name      string
+	maxTokens int64
+	limiter   *rate.Limiter
+
+	sent, failed uint64
+}
+
+// count records the outcome of a push sent for the tenant.
+func (t *tenant) count(err error) {
+	if err != nil {
+		atomic.AddUint64(&t.failed, 1)
+	} else {
+		atomic.AddUint64(&t.sent, 1)
+	}
+}
+
+// startTenants creates the providers of each configured tenant. Translations
+// are used for the alert text of the tenants' APNS pushes.
+func (nb *Impl) startTenants(tenants []TenantParams, params Params, translations providers.Translations) error {
+	nb.tenants = make(map[string]*tenant, len(tenants))
+	for _, tp := range tenants {
+		if !tenantName.MatchString(tp.Name) {
+			return errors.Errorf("Invalid tenant name %q, must only contain letters, digits and hyphens", tp.Name)
+		}
+		if _, ok := nb.tenants[tp.Name]; ok {
+			return errors.Errorf("Tenant %s is configured more than once", tp.Name)
+		}
+		t := &tenant{name: tp.Name, maxTokens: tp.MaxTokens}
+		if tp.Rate > 0 {
+			t.limiter = rate.NewLimiter(rate.Limit(tp.Rate), int(math.Max(1, tp.Rate/10)))
+		}
+		nb.tenants[tp.Name] = t
+
+		started := map[string]providers.Provider{}
+		var err error
+		if tp.FBCreds != "" {
+			started["fcm"], err = providers.NewFCM(providers.FCMParams{
+				CredentialsPath: tp.FBCreds,
+				ChannelID:       tp.FCMChannel.ChannelID,
+				Sound:           tp.FCMChannel.Sound,
+				TTL:             params.PushTTL,
+				AnalyticsLabel:  params.FCMAnalyticsLabel,
+				Proxy:           nb.proxies,
+			})
+			if err != nil {
+				return errors.WithMessagef(err, "Failed to start firebase provider of tenant %s", tp.Name)
+			}
+		}
+		if tp.APNS.KeyPath != "" {
+			tp.APNS.TTL, tp.APNS.Translations = params.PushTTL, translations
+			tp.APNS.Proxy = nb.proxies
+			started["apns"], err = providers.NewApns(tp.APNS)
+			if err != nil {
+				return errors.WithMessagef(err, "Failed to start APNS provider of tenant %s", tp.Name)
+			}
+		}
+		if tp.WebPush.VAPIDPrivateKey != "" {
+			tp.WebPush.TTL, tp.WebPush.Proxy = params.PushTTL, nb.proxies
+			started["webpush"], err = providers.NewWebPush(tp.WebPush)
+			if err != nil {
+				return errors.WithMessagef(err, "Failed to start web push provider of tenant %s", tp.Name)
+			}
+		}
+		if len(started) == 0 {
+			jww.WARN.Printf("Tenant %s has no push credentials configured", tp.Name)
+		}
+
+		for service, p := range started {
+			app := constants.TenantApp(tp.Name, service)
+			lp := newLimitedProvider(app, p, tp.ProviderLimits[service])
+			lp.tenant = t
+			nb.providers[app] = lp
+			jww.INFO.Printf("Serving %s for tenant %s", service, tp.Name)
+		}
+	}
+	return nil
+}
+
+// checkTenantApp returns an error if token may not be registered with app:
+// the app belongs to a tenant which is not configured or does not use its
+// push service, or the tenant's token quota is used up. The bot's own apps are
+// always accepted.
+func (nb *Impl) checkTenantApp(token, app string) error {
+	name, _ := constants.SplitTenant(app)
+	if name == "" {
+		return nil
+	}
+	t, ok := nb.tenants[name]
+	if !ok {
+		return errors.Errorf("Unknown tenant %s", name)
+	}
+	if _, ok = nb.providers[app]; !ok {
+		return errors.Errorf("No provider is configured for app %s", app)
+	}
+	if t.maxTokens <= 0 {
+		return nil
+	}
+	// Re-registering a token for the same app does not count towards the quota
+	if _, err := nb.Storage.GetToken(token, app); err == nil {
+		return nil
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return errors.WithMessage(err, "Failed to look up token")
+	}
+	count, err := nb.Storage.CountTenantTokens(name)
+	if err != nil {
+		return errors.WithMessagef(err, "Failed to count tokens of tenant %s", name)
+	}
+	if count >= t.maxTokens {
+		return errors.Errorf("Tenant %s has reached its limit of %d tokens", name, t.maxTokens)
+	}
+	return nil
+}
+
+// formatTenantMetrics renders the pushes sent for each tenant as Prometheus
+// counters.
+func formatTenantMetrics(tenants map[string]*tenant) string {
+	if len(tenants) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(tenants))
+	for name := range tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("# HELP notifications_tenant_pushes_total Pushes sent for tenants by result.\n" +
+		"# TYPE notifications_tenant_pushes_total counter\n")
+	for _, name := range names {
+		t := tenants[name]
+		fmt.Fprintf(&b, "notifications_tenant_pushes_total{tenant=%q,result=\"success\"} %d\n", name, atomic.LoadUint64(&t.sent))
+		fmt.Fprintf(&b, "notifications_tenant_pushes_total{tenant=%q,result=\"failure\"} %d\n", name, atomic.LoadUint64(&t.failed))
+	}
+	return b.String()
+}
@@ -0,0 +1,91 @@
+package notifications
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/elixxir/notifications-bot/notifications/providers"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gitlab.com/elixxir/notifications-bot/testutil"
+	"strings"
+	"testing"
+)
+
+// Tests that tokens are only accepted for configured tenants using the app's
+// push service, and only while the tenant has tokens left in its quota.
+func TestImpl_checkTenantApp(t *testing.T) {
+	s, err := storage.NewStorage("", "", "TestImpl_checkTenantApp", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+	acme := &tenant{name: "acme", maxTokens: 1}
+	impl := &Impl{
+		Storage:   s,
+		providers: map[string]providers.Provider{constants.TenantApp("acme", "fcm"): testutil.NewProvider()},
+		tenants:   map[string]*tenant{"acme": acme},
+	}
+
+	if err = impl.checkTenantApp("token", constants.MessengerIOS.String()); err != nil {
+		t.Errorf("The bot's own apps should always be accepted: %+v", err)
+	}
+	if err = impl.checkTenantApp("token", "other/fcm"); err == nil {
+		t.Errorf("Apps of unknown tenants should be rejected")
+	}
+	if err = impl.checkTenantApp("token", "acme/apns"); err == nil {
+		t.Errorf("Apps of push services the tenant does not use should be rejected")
+	}
+	if err = impl.checkTenantApp("token", "acme/fcm"); err != nil {
+		t.Fatalf("Token within quota should be accepted: %+v", err)
+	}
+
+	if err = s.RegisterToken("token", "acme/fcm", []byte("trsa")); err != nil {
+		t.Fatalf("Failed to register token: %+v", err)
+	}
+	if err = impl.checkTenantApp("token2", "acme/fcm"); err == nil {
+		t.Errorf("Token beyond the tenant's quota should be rejected")
+	}
+	if err = impl.checkTenantApp("token", "acme/fcm"); err != nil {
+		t.Errorf("Re-registering a token should not count towards the quota: %+v", err)
+	}
+}
+
+// Tests that sends through a tenant's providers are counted for the tenant
+// and reported with its label.
+func TestLimitedProvider_tenant(t *testing.T) {
+	acme := &tenant{name: "acme"}
+	lp := newLimitedProvider("acme/fcm", testutil.NewProvider(testutil.Result{Err: errors.New("failed")}), ProviderLimits{})
+	lp.tenant = acme
+
+	for i := 0; i < 3; i++ {
+		_, _, _ = lp.Notify(context.Background(), "csv", storage.GTNResult{})
+	}
+	if acme.sent != 2 || acme.failed != 1 {
+		t.Errorf("Expected 2 sent and 1 failed, counted %d and %d", acme.sent, acme.failed)
+	}
+
+	metrics := formatTenantMetrics(map[string]*tenant{"acme": acme})
+	for _, expected := range []string{
+		`notifications_tenant_pushes_total{tenant="acme",result="success"} 2`,
+		`notifications_tenant_pushes_total{tenant="acme",result="failure"} 1`,
+	} {
+		if !strings.Contains(metrics, expected) {
+			t.Errorf("Metrics missing %q:\n%s", expected, metrics)
+		}
+	}
+}
+
+// Tests that tenant names which would break the app format or storage
+// scoping are rejected.
+func TestImpl_startTenants_InvalidName(t *testing.T) {
+	for _, name := range []string{"", "ac/me", "acme_", "ac%"} {
+		impl := &Impl{providers: map[string]providers.Provider{}}
+		if err := impl.startTenants([]TenantParams{{Name: name}}, Params{}, nil); err == nil {
+			t.Errorf("Tenant name %q should be rejected", name)
+		}
+	}
+	impl := &Impl{providers: map[string]providers.Provider{}}
+	err := impl.startTenants([]TenantParams{{Name: "acme"}, {Name: "acme"}}, Params{}, nil)
+	if err == nil {
+		t.Errorf("Duplicate tenants should be rejected")
+	}
+}
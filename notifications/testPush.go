@@ -0,0 +1,183 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Test pushes let a client check that its devices receive notifications, for
+// a "send test notification" button in its settings. The push is sent to each
+// of the client's devices through the same path as notifications, so it is
+// retried, logged and recorded in the push history, and rejected tokens are
+// purged or failed over. Requests are limited to one per interval for each
+// client, as every request pushes to all of its devices.
+
+package notifications
+
+import (
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/notifications-bot/errs"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TestPushResult is the outcome of the test push sent to a device.
+type TestPushResult struct {
+	Token     string `json:"token"`
+	App       string `json:"app"`
+	Delivered bool   `json:"delivered"`
+	Error     string `json:"error,omitempty"`
+	// Purged is set if the push service rejected the token for good and it
+	// was removed or failed over to its fallback
+	Purged bool `json:"purged,omitempty"`
+}
+
+// testPushLimiter allows each client one test push per interval.
+type testPushLimiter struct {
+	interval time.Duration
+	mux      sync.Mutex
+	// last is when each client, by tRSA hash, was last sent a test push
+	last map[string]time.Time
+}
+
+// newTestPushLimiter returns a limiter allowing one test push per interval;
+// test pushes are not limited if interval is 0.
+func newTestPushLimiter(interval time.Duration) *testPushLimiter {
+	return &testPushLimiter{interval: interval, last: map[string]time.Time{}}
+}
+
+// allow returns an error marked errs.ErrRateLimited if the client with the
+// passed in tRSA hash was sent a test push within the interval before now,
+// and otherwise records now as its last test push.
+func (l *testPushLimiter) allow(transmissionRsaHash []byte, now time.Time) error {
+	if l == nil || l.interval <= 0 {
+		return nil
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if last, ok := l.last[string(transmissionRsaHash)]; ok {
+		if wait := l.interval - now.Sub(last); wait > 0 {
+			return errs.Mark(errors.Errorf("Test push already sent, retry in %s", wait.Round(time.Second)),
+				errs.ErrRateLimited)
+		}
+	}
+	// Forget clients whose interval has passed, so the map only holds
+	// clients which requested a test push recently
+	for k, last := range l.last {
+		if now.Sub(last) >= l.interval {
+			delete(l.last, k)
+		}
+	}
+	l.last[string(transmissionRsaHash)] = now
+	return nil
+}
+
+// RequestTestNotification sends a test push to every device registered with
+// the transmission key which signed the request, returning the outcome for
+// each. Fallback tokens on standby are not pushed to. Returns an error marked
+// errs.ErrRateLimited if the client was sent a test push too recently.
+func (nb *Impl) RequestTestNotification(msg *AccountRequest) ([]TestPushResult, error) {
+	jww.INFO.Println("RequestTestNotification")
+	err := nb.verifyAccountRequest(msg, TestNotificationTag)
+	if err != nil {
+		return nil, err
+	}
+	return nb.sendTestPush(msg.TransmissionRsaPem)
+}
+
+// sendTestPush sends a test push to each device of the user with the passed
+// in transmission key.
+func (nb *Impl) sendTestPush(transmissionRsaPem []byte) ([]TestPushResult, error) {
+	trsaHash, err := storage.HashTransmissionRSA(transmissionRsaPem)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to hash transmission RSA")
+	}
+	u, err := nb.Storage.GetUser(trsaHash)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to get user")
+	}
+
+	// targets holds the devices to push to, by their index in results
+	targets := map[int]storage.GTNResult{}
+	var results []TestPushResult
+	for _, t := range u.Tokens {
+		if t.Standby {
+			continue
+		}
+		target := storage.GTNResult{
+			Token:               t.Token,
+			SealedToken:         t.SealedToken,
+			App:                 t.App,
+			Priority:            t.Priority,
+			ChannelID:           t.ChannelID,
+			Sound:               t.Sound,
+			Locale:              t.Locale,
+			Privacy:             t.Privacy,
+			Fallback:            t.Fallback,
+			TransmissionRSAHash: t.TransmissionRSAHash,
+			Test:                true,
+		}
+		// Report the device tokens rather than their pseudonyms. Tokens which
+		// cannot be opened could not be pushed to either, so they are reported
+		// under the value they are stored under instead
+		opened, err := nb.Storage.OpenToken(target)
+		if err != nil {
+			results = append(results, TestPushResult{Token: t.Token, App: t.App,
+				Error: errors.WithMessage(err, "Failed to open token").Error()})
+			continue
+		}
+		targets[len(results)] = target
+		results = append(results, TestPushResult{Token: opened.Token, App: t.App})
+	}
+	if len(targets) == 0 {
+		return results, nil
+	}
+	// Only requests which push to a device count towards the limit
+	if err = nb.testPushes.allow(trsaHash, nb.now()); err != nil {
+		return nil, err
+	}
+
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func(r *TestPushResult, target storage.GTNResult) {
+			defer wg.Done()
+			res := nb.notify(nb.context(), NotificationRequest{Target: target})
+			r.Delivered = res.Err == nil
+			r.Purged = res.Err != nil && !res.TokenValid
+			if res.Err != nil {
+				r.Error = res.Err.Error()
+			}
+		}(&results[i], target)
+	}
+	wg.Wait()
+	return results, nil
+}
+
+// handleTestNotification serves RequestTestNotification for a JSON encoded
+// AccountRequest.
+func (nb *Impl) handleTestNotification(w http.ResponseWriter, r *http.Request) {
+	msg, ok := decodeAccountRequest(w, r)
+	if !ok {
+		return
+	}
+	err := nb.verifyAccountRequest(msg, TestNotificationTag)
+	if err != nil {
+		adminError(w, http.StatusUnauthorized, err)
+		return
+	}
+	results, err := nb.sendTestPush(msg.TransmissionRsaPem)
+	switch {
+	case errors.Is(err, errs.ErrNotRegistered):
+		adminError(w, http.StatusNotFound, errors.New("not registered"))
+	case errors.Is(err, errs.ErrRateLimited):
+		adminError(w, http.StatusTooManyRequests, err)
+	case err != nil:
+		adminError(w, http.StatusInternalServerError, errors.WithMessage(err, "Failed to send test push"))
+	default:
+		writeJSON(w, results)
+	}
+}
@@ -0,0 +1,144 @@
+package notifications
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/notifications-bot/clock"
+	"gitlab.com/elixxir/notifications-bot/errs"
+	"gitlab.com/elixxir/notifications-bot/notifications/providers"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gitlab.com/elixxir/notifications-bot/testutil"
+	"testing"
+	"time"
+)
+
+// Tests that a test push is sent to every device of the signing client through
+// the regular send path, and that clients may only request one per interval.
+func TestImpl_RequestTestNotification(t *testing.T) {
+	s := testutil.NewStorage(t)
+	fake := clock.NewFake(time.Now())
+	ios, android := testutil.NewProvider(), testutil.NewProvider(testutil.Result{Invalid: true, Err: errors.New("unregistered")})
+	impl := &Impl{
+		Storage:         s,
+		clock:           fake,
+		maxSendAttempts: 1,
+		providers:       map[string]providers.Provider{"HavenIOS": ios, "HavenAndroid": android},
+		testPushes:      newTestPushLimiter(time.Minute),
+	}
+	c := testutil.NewClient(t)
+
+	if _, err := impl.RequestTestNotification(accountRequest(t, c, TestNotificationTag, time.Now())); !errors.Is(err, errs.ErrNotRegistered) {
+		t.Errorf("Unregistered client should be rejected, got %+v", err)
+	}
+	if err := s.RegisterToken("iosToken", "HavenIOS", c.TransmissionRsaPem); err != nil {
+		t.Fatalf("Failed to register token: %+v", err)
+	}
+	if err := s.RegisterToken("androidToken", "HavenAndroid", c.TransmissionRsaPem); err != nil {
+		t.Fatalf("Failed to register token: %+v", err)
+	}
+
+	if _, err := impl.RequestTestNotification(accountRequest(t, c, PushHistoryTag, time.Now())); err == nil {
+		t.Errorf("Request signed with another tag should be rejected")
+	}
+	results, err := impl.RequestTestNotification(accountRequest(t, c, TestNotificationTag, time.Now()))
+	if err != nil {
+		t.Fatalf("Failed to send test push: %+v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("Expected a result for each device: %+v", results)
+	}
+	for _, r := range results {
+		switch r.Token {
+		case "iosToken":
+			if !r.Delivered || r.Error != "" {
+				t.Errorf("Test push should have been delivered: %+v", r)
+			}
+		case "androidToken":
+			if r.Delivered || !r.Purged || r.Error == "" {
+				t.Errorf("Rejected token should be reported purged: %+v", r)
+			}
+		default:
+			t.Errorf("Unexpected token %q", r.Token)
+		}
+	}
+	sends := ios.Sends()
+	if len(sends) != 1 || !sends[0].Target.Test || sends[0].CSV != "" {
+		t.Errorf("Expected a single test push without notifications: %+v", sends)
+	}
+	trsaHash, err := storage.HashTransmissionRSA(c.TransmissionRsaPem)
+	if err != nil {
+		t.Fatalf("Failed to hash transmission RSA: %+v", err)
+	}
+	u, err := s.GetUser(trsaHash)
+	if err != nil {
+		t.Fatalf("Failed to get user: %+v", err)
+	}
+	if len(u.Tokens) != 1 || u.Tokens[0].Token != "iosToken" {
+		t.Errorf("Rejected token should have been removed: %+v", u.Tokens)
+	}
+
+	_, err = impl.RequestTestNotification(accountRequest(t, c, TestNotificationTag, time.Now()))
+	if !errors.Is(err, errs.ErrRateLimited) {
+		t.Errorf("Second test push within the interval should be rate limited, got %+v", err)
+	}
+	fake.Advance(time.Minute)
+	if _, err = impl.RequestTestNotification(accountRequest(t, c, TestNotificationTag, time.Now())); err != nil {
+		t.Errorf("Test push should be allowed once the interval passed: %+v", err)
+	}
+	if len(ios.Sends()) != 2 {
+		t.Errorf("Expected a second test push, got %d", len(ios.Sends()))
+	}
+}
+
+// Tests that tokens stored in the clear before encryption was enabled are
+// reported even once the push purged them, and that requests which push to
+// no device do not count towards the limit.
+func TestImpl_RequestTestNotification_Unsealed(t *testing.T) {
+	name := "TestImpl_RequestTestNotification_Unsealed"
+	plain, err := storage.NewStorage("", "", name, "", "")
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+	c := testutil.NewClient(t)
+	if err = plain.RegisterToken("legacyToken", "HavenAndroid", c.TransmissionRsaPem); err != nil {
+		t.Fatalf("Failed to register token: %+v", err)
+	}
+	s, err := storage.NewStorageFromParams(storage.Params{
+		DBName:         name,
+		TokenLookupKey: bytes.Repeat([]byte{1}, storage.TokenKeySize),
+		TokenKeys:      map[uint8][]byte{1: bytes.Repeat([]byte{2}, storage.TokenKeySize)},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+	android := testutil.NewProvider(testutil.Result{Invalid: true, Err: errors.New("unregistered")})
+	impl := &Impl{
+		Storage:         s,
+		clock:           clock.NewFake(time.Now()),
+		maxSendAttempts: 1,
+		providers:       map[string]providers.Provider{"HavenAndroid": android},
+		testPushes:      newTestPushLimiter(time.Minute),
+	}
+
+	results, err := impl.RequestTestNotification(accountRequest(t, c, TestNotificationTag, time.Now()))
+	if err != nil {
+		t.Fatalf("Failed to send test push: %+v", err)
+	}
+	if len(results) != 1 || results[0].Token != "legacyToken" || !results[0].Purged {
+		t.Errorf("Purged token should be reported: %+v", results)
+	}
+
+	_, err = impl.RequestTestNotification(accountRequest(t, c, TestNotificationTag, time.Now()))
+	if !errors.Is(err, errs.ErrRateLimited) {
+		t.Errorf("Request after a push should be rate limited, got %+v", err)
+	}
+
+	// With its only token purged the client has no device left to push to
+	impl.testPushes = newTestPushLimiter(time.Minute)
+	for i := 0; i < 2; i++ {
+		results, err = impl.RequestTestNotification(accountRequest(t, c, TestNotificationTag, time.Now()))
+		if err != nil || len(results) != 0 {
+			t.Errorf("Request without devices should not be rate limited, got %+v %+v", results, err)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package notifications
+
+import (
+	"encoding/base64"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/notifications-bot/errs"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gorm.io/gorm"
+	"net/http"
+	"time"
+)
+
+// deletedTokenCleanFreq is how often unregistered tokens past their retention
+// period are purged.
+const deletedTokenCleanFreq = time.Hour
+
+// tokenQuery returns the registration named by the token, app and base64
+// encoded transmissionRsaHash query parameters, writing an error and returning
+// false if any is missing.
+func tokenQuery(w http.ResponseWriter, r *http.Request) (token, app string, trsaHash []byte, ok bool) {
+	query := r.URL.Query()
+	token, app = query.Get("token"), query.Get("app")
+	if token == "" || app == "" {
+		adminError(w, http.StatusBadRequest, errors.New("token and app must be set"))
+		return "", "", nil, false
+	}
+	trsaHash, err := base64.StdEncoding.DecodeString(query.Get("transmissionRsaHash"))
+	if err != nil || len(trsaHash) == 0 {
+		adminError(w, http.StatusBadRequest, errors.New("transmissionRsaHash must be a base64 encoded hash"))
+		return "", "", nil, false
+	}
+	return token, app, trsaHash, true
+}
+
+// handleTokenPriority sets the priority tier of the registration passed in the
+// token, app and transmissionRsaHash query parameters to the value of the
+// priority parameter. An empty priority returns the token to the default tier.
+func (nb *Impl) handleTokenPriority(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		adminError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	token, app, trsaHash, ok := tokenQuery(w, r)
+	if !ok {
+		return
+	}
+	priority := r.URL.Query().Get("priority")
+
+	err := nb.Storage.SetTokenPriority(token, app, trsaHash, priority)
+	if err != nil {
+		if errors.Is(err, errs.ErrNotRegistered) {
+			adminError(w, http.StatusNotFound, errors.New("token is not registered"))
+			return
+		}
+		adminError(w, http.StatusInternalServerError, errors.WithMessage(err, "Failed to set token priority"))
+		return
+	}
+	writeJSON(w, map[string]string{"token": token, "priority": priority})
+}
+
+// handleTokenSound sets the notification channel and sound of the registration
+// passed in the token, app and transmissionRsaHash query parameters to the
+// channelId and sound parameters. Empty values return the token to its app's
+// defaults.
+func (nb *Impl) handleTokenSound(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		adminError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	token, app, trsaHash, ok := tokenQuery(w, r)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+	channelID, sound := query.Get("channelId"), query.Get("sound")
+
+	err := nb.Storage.SetTokenSound(token, app, trsaHash, channelID, sound)
+	if err != nil {
+		if errors.Is(err, errs.ErrNotRegistered) {
+			adminError(w, http.StatusNotFound, errors.New("token is not registered"))
+			return
+		}
+		adminError(w, http.StatusInternalServerError, errors.WithMessage(err, "Failed to set token sound"))
+		return
+	}
+	writeJSON(w, map[string]string{"token": token, "channelId": channelID, "sound": sound})
+}
+
+// handleTokenLocale sets the locale of the registration passed in the token,
+// app and transmissionRsaHash query parameters to the locale parameter, used
+// to pick localized notification text.
+func (nb *Impl) handleTokenLocale(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		adminError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	token, app, trsaHash, ok := tokenQuery(w, r)
+	if !ok {
+		return
+	}
+	locale := r.URL.Query().Get("locale")
+
+	err := nb.Storage.SetTokenLocale(token, app, trsaHash, locale)
+	if err != nil {
+		if errors.Is(err, errs.ErrNotRegistered) {
+			adminError(w, http.StatusNotFound, errors.New("token is not registered"))
+			return
+		}
+		adminError(w, http.StatusInternalServerError, errors.WithMessage(err, "Failed to set token locale"))
+		return
+	}
+	writeJSON(w, map[string]string{"token": token, "locale": locale})
+}
+
+// handleTokenRestore restores the unregistered registration passed in the
+// token, app and transmissionRsaHash query parameters, provided it has not yet
+// been purged.
+func (nb *Impl) handleTokenRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		adminError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	token, app, trsaHash, ok := tokenQuery(w, r)
+	if !ok {
+		return
+	}
+
+	err := nb.Storage.RestoreToken(token, app, trsaHash)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			adminError(w, http.StatusNotFound, errors.New("token is not deleted or has been purged"))
+			return
+		}
+		adminError(w, http.StatusInternalServerError, errors.WithMessage(err, "Failed to restore token"))
+		return
+	}
+	writeJSON(w, map[string]string{"token": token})
+}
+
+// handleTokenVersions returns the number of registered tokens by the platform,
+// app version and SDK version clients reported, for the app passed in the app
+// query parameter or all apps if it is empty.
+func (nb *Impl) handleTokenVersions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		adminError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	app := r.URL.Query().Get("app")
+
+	counts, err := nb.Storage.CountTokensByVersion()
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, errors.WithMessage(err, "Failed to count tokens by version"))
+		return
+	}
+	filtered := make([]storage.TokenVersionCount, 0, len(counts))
+	for _, c := range counts {
+		if app == "" || c.App == app {
+			filtered = append(filtered, c)
+		}
+	}
+	writeJSON(w, filtered)
+}
+
+// DecommissionStatus reports the tokens removed, or which would be removed, by
+// decommissioning an app.
+type DecommissionStatus struct {
+	App    string `json:"app"`
+	Tokens int64  `json:"tokens"`
+	DryRun bool   `json:"dryRun,omitempty"`
+}
+
+// DecommissionApp unregisters and purges every token registered for app, for
+// sunsetting an old client app; the tokens cannot be restored. If dryRun is
+// set, only the number of tokens is returned.
+func (nb *Impl) DecommissionApp(app string, dryRun bool) (DecommissionStatus, error) {
+	status := DecommissionStatus{App: app, DryRun: dryRun}
+	var err error
+	if dryRun {
+		status.Tokens, err = nb.Storage.CountAppTokens(app)
+		return status, errors.WithMessage(err, "Failed to count tokens")
+	}
+	status.Tokens, err = nb.Storage.PurgeAppTokens(app)
+	if err != nil {
+		return status, errors.WithMessage(err, "Failed to purge tokens")
+	}
+	jww.INFO.Printf("Decommissioned app %s, purging %d tokens", app, status.Tokens)
+	return status, nil
+}
+
+// handleDecommissionApp serves the decommission admin endpoint. A POST purges
+// every token of the app query parameter; confirm must repeat the app name.
+// With dryRun=true only the number of tokens is returned.
+func (nb *Impl) handleDecommissionApp(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		adminError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	query := r.URL.Query()
+	app := query.Get("app")
+	if app == "" {
+		adminError(w, http.StatusBadRequest, errors.New("app must be set"))
+		return
+	}
+	dryRun := query.Get("dryRun") == "true"
+	if !dryRun && query.Get("confirm") != app {
+		adminError(w, http.StatusBadRequest, errors.New("confirm must be set to the app to decommission"))
+		return
+	}
+
+	status, err := nb.DecommissionApp(app, dryRun)
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, status)
+}
+
+// DeletedTokenCleaner is a long-running thread which hard deletes tokens
+// unregistered longer ago than the passed in retention period.
+func (nb *Impl) DeletedTokenCleaner(retention time.Duration) {
+	ticker := time.NewTicker(deletedTokenCleanFreq)
+	for {
+		purged, err := nb.Storage.PurgeDeletedTokens(nb.now().Add(-retention))
+		if err != nil {
+			jww.WARN.Printf("Failed to purge deleted tokens: %+v", err)
+		} else if purged > 0 {
+			jww.INFO.Printf("Purged %d tokens deleted more than %s ago", purged, retention)
+		}
+		<-ticker.C
+	}
+}
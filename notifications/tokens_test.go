@@ -0,0 +1,160 @@
+package notifications
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// Tests that the token priority endpoint sets the tier of registered tokens
+// and rejects unknown ones.
+func TestImpl_handleTokenPriority(t *testing.T) {
+	s, err := storage.NewStorage("", "", "TestImpl_handleTokenPriority", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+	impl := &Impl{Storage: s}
+	handler := impl.adminHandler("secret")
+
+	err = s.RegisterToken("token", "app", []byte("trsa"))
+	if err != nil {
+		t.Fatalf("Failed to register token: %+v", err)
+	}
+	trsaHash, err := storage.HashTransmissionRSA([]byte("trsa"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := "&app=app&transmissionRsaHash=" + url.QueryEscape(base64.StdEncoding.EncodeToString(trsaHash))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newAdminRequest(http.MethodPost, "/tokens/priority?token=token&priority=calls", "secret"))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d without the app and owner, received %d", http.StatusBadRequest, w.Code)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newAdminRequest(http.MethodPost, "/tokens/priority?token=token&priority=calls"+owner, "secret"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", w.Code, w.Body.String())
+	}
+
+	u, err := s.GetUser(trsaHash)
+	if err != nil {
+		t.Fatalf("Failed to get user: %+v", err)
+	}
+	if len(u.Tokens) != 1 || u.Tokens[0].Priority != "calls" {
+		t.Errorf("Token priority was not set: %+v", u.Tokens)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newAdminRequest(http.MethodPost, "/tokens/priority?token=unknown&priority=calls"+owner, "secret"))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for unknown token, received %d", http.StatusNotFound, w.Code)
+	}
+}
+
+// Tests that the restore endpoint brings back an unregistered token.
+func TestImpl_handleTokenRestore(t *testing.T) {
+	s, err := storage.NewStorage("", "", "TestImpl_handleTokenRestore", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+	impl := &Impl{Storage: s}
+	handler := impl.adminHandler("secret")
+
+	err = s.RegisterToken("token", "app", []byte("trsa"))
+	if err != nil {
+		t.Fatalf("Failed to register token: %+v", err)
+	}
+	err = s.UnregisterToken("token", []byte("trsa"))
+	if err != nil {
+		t.Fatalf("Failed to unregister token: %+v", err)
+	}
+	if _, err = s.GetToken("token", "app"); err == nil {
+		t.Fatalf("Unregistered token should not be returned")
+	}
+	trsaHash, err := storage.HashTransmissionRSA([]byte("trsa"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := "&app=app&transmissionRsaHash=" + url.QueryEscape(base64.StdEncoding.EncodeToString(trsaHash))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newAdminRequest(http.MethodPost, "/tokens/restore?token=token"+owner, "secret"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	if _, err = s.GetToken("token", "app"); err != nil {
+		t.Errorf("Restored token should be returned: %+v", err)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newAdminRequest(http.MethodPost, "/tokens/restore?token=token"+owner, "secret"))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d restoring a live token, received %d", http.StatusNotFound, w.Code)
+	}
+}
+
+// Tests that decommissioning an app requires confirmation, reports the number
+// of its tokens on a dry run and purges only its tokens, including
+// unregistered ones.
+func TestImpl_handleDecommissionApp(t *testing.T) {
+	s, err := storage.NewStorage("", "", "TestImpl_handleDecommissionApp", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+	impl := &Impl{Storage: s}
+	handler := impl.adminHandler("secret")
+
+	for token, app := range map[string]string{"old1": "old", "old2": "old", "deleted": "old", "new": "new"} {
+		if err = s.RegisterToken(token, app, []byte("trsa")); err != nil {
+			t.Fatalf("Failed to register token: %+v", err)
+		}
+	}
+	if err = s.UnregisterToken("deleted", []byte("trsa")); err != nil {
+		t.Fatalf("Failed to unregister token: %+v", err)
+	}
+	decommission := func(query string) (int, DecommissionStatus) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newAdminRequest(http.MethodPost, "/tokens/decommission?"+query, "secret"))
+		var status DecommissionStatus
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+				t.Fatalf("Failed to decode status: %+v", err)
+			}
+		}
+		return w.Code, status
+	}
+
+	if code, _ := decommission("app=old&confirm=new"); code != http.StatusBadRequest {
+		t.Errorf("Decommission without matching confirm should be rejected, got %d", code)
+	}
+	code, status := decommission("app=old&dryRun=true")
+	if code != http.StatusOK || !status.DryRun || status.Tokens != 2 {
+		t.Errorf("Dry run should count the 2 registered tokens, got %d %+v", code, status)
+	}
+	if _, err = s.GetToken("old1", "old"); err != nil {
+		t.Errorf("Dry run should not remove tokens: %+v", err)
+	}
+
+	code, status = decommission("app=old&confirm=old")
+	if code != http.StatusOK || status.DryRun || status.Tokens != 2 {
+		t.Errorf("Expected 2 tokens purged, got %d %+v", code, status)
+	}
+	if _, err = s.GetToken("old1", "old"); err == nil {
+		t.Errorf("Decommissioned app's tokens should be removed")
+	}
+	trsaHash, err := storage.HashTransmissionRSA([]byte("trsa"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.RestoreToken("deleted", "old", trsaHash); err == nil {
+		t.Errorf("Decommissioned app's unregistered tokens should be purged")
+	}
+	if _, err = s.GetToken("new", "new"); err != nil {
+		t.Errorf("Other apps' tokens should be kept: %+v", err)
+	}
+}
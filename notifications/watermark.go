@@ -0,0 +1,109 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package notifications
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/xx_network/comms/connect"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// GatewayStatus holds the last notification batch accepted from a gateway.
+type GatewayStatus struct {
+	ID         string    `json:"id"`
+	LastRound  uint64    `json:"lastRound"`
+	Batches    uint64    `json:"batches"`
+	ReceivedAt time.Time `json:"receivedAt"`
+	// Stale is set if no batch has been accepted from the gateway within the
+	// configured gatewayStaleAfter
+	Stale bool `json:"stale"`
+}
+
+// recordWatermark stores the round of a batch accepted from the gateway which
+// sent it. Failures are logged, as the batch itself has been accepted.
+func (nb *Impl) recordWatermark(auth *connect.Auth, round uint64) {
+	gwID := batchSender(auth)
+	if gwID == "" {
+		return
+	}
+	err := nb.Storage.UpsertGatewayWatermark(gwID, round, time.Now())
+	if err != nil {
+		jww.WARN.Printf("Failed to record round %d from gateway %s: %+v", round, gwID, err)
+	}
+}
+
+// gatewayStatuses returns the watermark of every gateway a batch has been
+// accepted from, flagging those with no batch since staleAfter before now.
+func (nb *Impl) gatewayStatuses(now time.Time) ([]GatewayStatus, error) {
+	watermarks, err := nb.Storage.GetGatewayWatermarks()
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to get gateway watermarks")
+	}
+	statuses := make([]GatewayStatus, 0, len(watermarks))
+	for _, wm := range watermarks {
+		statuses = append(statuses, GatewayStatus{
+			ID:         wm.GatewayID,
+			LastRound:  wm.LastRound,
+			Batches:    wm.Batches,
+			ReceivedAt: wm.ReceivedAt,
+			Stale:      nb.gatewayStaleAfter > 0 && now.Sub(wm.ReceivedAt) > nb.gatewayStaleAfter,
+		})
+	}
+	return statuses, nil
+}
+
+// handleGateways lists the last batch accepted from each gateway.
+func (nb *Impl) handleGateways(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		adminError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	statuses, err := nb.gatewayStatuses(time.Now())
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, statuses)
+}
+
+// formatGatewayMetrics renders gateway watermarks as Prometheus metrics.
+func formatGatewayMetrics(statuses []GatewayStatus) string {
+	if len(statuses) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	metric("notifications_gateway_last_round", "gauge", "Round of the last notification batch accepted from the gateway.")
+	for _, s := range statuses {
+		fmt.Fprintf(&b, "notifications_gateway_last_round{gateway=%q} %d\n", s.ID, s.LastRound)
+	}
+	metric("notifications_gateway_last_batch_timestamp_seconds", "gauge", "Time the last notification batch was accepted from the gateway.")
+	for _, s := range statuses {
+		fmt.Fprintf(&b, "notifications_gateway_last_batch_timestamp_seconds{gateway=%q} %d\n", s.ID, s.ReceivedAt.Unix())
+	}
+	metric("notifications_gateway_batches_total", "counter", "Notification batches accepted from the gateway.")
+	for _, s := range statuses {
+		fmt.Fprintf(&b, "notifications_gateway_batches_total{gateway=%q} %d\n", s.ID, s.Batches)
+	}
+	metric("notifications_gateway_stale", "gauge", "Whether no batch has been accepted from the gateway recently.")
+	for _, s := range statuses {
+		stale := 0
+		if s.Stale {
+			stale = 1
+		}
+		fmt.Fprintf(&b, "notifications_gateway_stale{gateway=%q} %d\n", s.ID, stale)
+	}
+	return b.String()
+}
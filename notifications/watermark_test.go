@@ -0,0 +1,68 @@
+package notifications
+
+import (
+	"encoding/json"
+	pb "gitlab.com/elixxir/comms/mixmessages"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gitlab.com/xx_network/comms/connect"
+	"gitlab.com/xx_network/primitives/id"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tests that the last batch accepted from each gateway is recorded and served
+// by the admin API and metrics, and that quiet gateways are flagged as stale.
+func TestImpl_handleGateways(t *testing.T) {
+	s, err := storage.NewStorage("", "", "TestImpl_handleGateways", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+	impl := &Impl{Storage: s, gatewayStaleAfter: time.Hour}
+	handler := impl.adminHandler("secret")
+
+	gwID := id.NewIdFromString("gateway", id.Gateway, t)
+	gwHost, err := connect.NewHost(gwID, "0.0.0.0:11420", nil, connect.GetDefaultHostParams())
+	if err != nil {
+		t.Fatalf("Failed to create gateway host: %+v", err)
+	}
+	auth := &connect.Auth{IsAuthenticated: true, Sender: gwHost}
+	for _, rid := range []uint64{7, 8} {
+		err = impl.ReceiveNotificationBatch(&pb.NotificationBatch{
+			RoundID:       rid,
+			Notifications: []*pb.NotificationData{{EphemeralID: 5}},
+		}, auth)
+		if err != nil {
+			t.Fatalf("Failed to receive batch: %+v", err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newAdminRequest(http.MethodGet, "/gateways", "secret"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	var statuses []GatewayStatus
+	if err = json.NewDecoder(w.Body).Decode(&statuses); err != nil {
+		t.Fatalf("Failed to decode statuses: %+v", err)
+	}
+	if len(statuses) != 1 || statuses[0].ID != gwID.String() || statuses[0].LastRound != 8 ||
+		statuses[0].Batches != 2 || statuses[0].Stale {
+		t.Fatalf("Unexpected gateway statuses: %+v", statuses)
+	}
+
+	statuses, err = impl.gatewayStatuses(time.Now().Add(2 * time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to get gateway statuses: %+v", err)
+	}
+	if !statuses[0].Stale {
+		t.Errorf("Gateway should be stale after %s without a batch: %+v", time.Hour, statuses[0])
+	}
+	metrics := formatGatewayMetrics(statuses)
+	if !strings.Contains(metrics, `notifications_gateway_last_round{gateway="`+gwID.String()+`"} 8`) ||
+		!strings.Contains(metrics, `notifications_gateway_stale{gateway="`+gwID.String()+`"} 1`) {
+		t.Errorf("Metrics did not include gateway watermark:\n%s", metrics)
+	}
+}
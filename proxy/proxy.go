@@ -0,0 +1,172 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Package proxy routes the bot's outbound connections through egress proxies.
+// Push provider requests are sent through an HTTP CONNECT or SOCKS5 proxy
+// chosen per destination host. The gRPC connections to gateways and
+// permissioning can only be proxied with HTTP CONNECT, through the proxy
+// environment variables gRPC reads.
+
+package proxy
+
+import (
+	"github.com/pkg/errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Direct is the proxy URL of rules whose hosts are connected to without a
+// proxy.
+const Direct = "direct"
+
+// Rule routes connections to the hosts it matches through a proxy.
+type Rule struct {
+	// Hosts are the host names the rule applies to. A name starting with
+	// "*." or "." matches any subdomain of the rest of the name.
+	Hosts []string
+	// URL is the proxy, as http://, https:// or socks5://host:port with an
+	// optional user:password, or Direct
+	URL string
+}
+
+// Params configures the proxies of outbound provider requests.
+type Params struct {
+	// URL is the proxy of hosts not matched by any rule; they are connected
+	// to directly if it is empty
+	URL string
+	// Rules are checked in order, the first rule matching a host applies
+	Rules []Rule
+}
+
+// Proxies picks the proxy for each outbound connection. A nil *Proxies
+// connects directly, unless the proxy environment variables are set.
+type Proxies struct {
+	fallback *url.URL
+	rules    []rule
+}
+
+// rule is a parsed Rule; proxy is nil for direct connections.
+type rule struct {
+	hosts []string
+	proxy *url.URL
+}
+
+// New returns the proxies described by params, or nil if none are set.
+func New(params Params) (*Proxies, error) {
+	if params.URL == "" && len(params.Rules) == 0 {
+		return nil, nil
+	}
+	p := &Proxies{}
+	var err error
+	p.fallback, err = parse(params.URL)
+	if err != nil {
+		return nil, err
+	}
+	for i, r := range params.Rules {
+		if len(r.Hosts) == 0 {
+			return nil, errors.Errorf("proxy rule %d has no hosts", i)
+		}
+		parsed := rule{}
+		parsed.proxy, err = parse(r.URL)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "Invalid proxy rule %d", i)
+		}
+		for _, h := range r.Hosts {
+			parsed.hosts = append(parsed.hosts, strings.ToLower(strings.TrimPrefix(h, "*")))
+		}
+		p.rules = append(p.rules, parsed)
+	}
+	return p, nil
+}
+
+// parse returns the proxy at the passed in URL, or nil if it is empty or
+// Direct.
+func parse(raw string) (*url.URL, error) {
+	if raw == "" || raw == Direct {
+		return nil, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid proxy URL %q", raw)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, errors.Errorf("proxy %q must be an http, https or socks5 URL", raw)
+	}
+	if u.Host == "" {
+		return nil, errors.Errorf("proxy %q has no host", raw)
+	}
+	return u, nil
+}
+
+// For returns the proxy to connect to the passed in host, with or without a
+// port, through, or nil to connect directly.
+func (p *Proxies) For(host string) *url.URL {
+	if p == nil {
+		return nil
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	for _, r := range p.rules {
+		for _, pattern := range r.hosts {
+			if host == pattern || (strings.HasPrefix(pattern, ".") && strings.HasSuffix(host, pattern)) {
+				return r.proxy
+			}
+		}
+	}
+	return p.fallback
+}
+
+// Transport returns a transport configured like http.DefaultTransport which
+// connects through the proxy for each request's host. With a nil *Proxies it
+// uses the proxy environment variables, as http.DefaultTransport does.
+func (p *Proxies) Transport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if p != nil {
+		t.Proxy = func(r *http.Request) (*url.URL, error) {
+			return p.For(r.URL.Host), nil
+		}
+	}
+	return t
+}
+
+// ParseCommsURL returns the proxy at the passed in URL, which must be an
+// http:// URL as gRPC only proxies through HTTP CONNECT, or nil if it is empty.
+func ParseCommsURL(raw string) (*url.URL, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "http" || u.Host == "" {
+		return nil, errors.Errorf("comms proxy %q must be an http://host:port URL", raw)
+	}
+	return u, nil
+}
+
+// ConfigureComms routes the gRPC connections to gateways and permissioning
+// through the HTTP CONNECT proxy at proxyURL, except those to the hosts in
+// bypass, written as for NO_PROXY. gRPC reads its proxy from the environment
+// when connecting, so HTTPS_PROXY and NO_PROXY are set for the process; they
+// also apply to other HTTPS requests made without a configured transport. It
+// must be called before any connection is made. The environment is left as is
+// if proxyURL is empty.
+func ConfigureComms(proxyURL string, bypass []string) error {
+	u, err := ParseCommsURL(proxyURL)
+	if err != nil || u == nil {
+		return err
+	}
+	if err = os.Setenv("HTTPS_PROXY", u.String()); err != nil {
+		return errors.Wrap(err, "Failed to set HTTPS_PROXY")
+	}
+	return errors.Wrap(os.Setenv("NO_PROXY", strings.Join(bypass, ",")), "Failed to set NO_PROXY")
+}
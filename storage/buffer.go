@@ -22,17 +22,20 @@ type NotificationBuffer struct {
 	lock   sync.RWMutex
 	gr     *uint64
 	lr     *uint64
+	size   *int64 // Number of buffered notifications
 	bufMap *sync.Map
 }
 
 // NewNotificationBuffer is the constructor for NotificationBuffers.  Initializes maps & sets initial atomic values
 func NewNotificationBuffer() *NotificationBuffer {
 	gr, lr := uint64(0), uint64(0)
+	size := int64(0)
 
 	nb := &NotificationBuffer{
 		bufMap: &sync.Map{},
 		gr:     &gr,
 		lr:     &lr,
+		size:   &size,
 	}
 	return nb
 }
@@ -48,6 +51,7 @@ func (bnm *NotificationBuffer) Swap() map[int64][]*notifications.Data {
 	m, bnm.bufMap = bnm.bufMap, &sync.Map{}
 	lr := atomic.SwapUint64(bnm.lr, 0)
 	gr := atomic.SwapUint64(bnm.gr, 0)
+	atomic.StoreInt64(bnm.size, 0)
 
 	bnm.lock.Unlock()
 
@@ -92,8 +96,19 @@ func (bnm *NotificationBuffer) Add(rid id.Round, l []*notifications.Data) {
 	// Update stored round IDs
 	bnm.updateRIDs(rid)
 
-	// Store data for round
-	bnm.bufMap.Store(rid, l)
+	// Store data for round, replacing any previous data for it
+	delta := int64(len(l))
+	prev, loaded := bnm.bufMap.LoadOrStore(rid, l)
+	if loaded {
+		bnm.bufMap.Store(rid, l)
+		delta -= int64(len(prev.([]*notifications.Data)))
+	}
+	atomic.AddInt64(bnm.size, delta)
+}
+
+// Len returns the number of notifications currently buffered.
+func (bnm *NotificationBuffer) Len() int64 {
+	return atomic.LoadInt64(bnm.size)
 }
 
 func (bnm *NotificationBuffer) updateRIDs(rid id.Round) {
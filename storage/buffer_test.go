@@ -82,3 +82,24 @@ func TestNotificationBuffer_Sorting(t *testing.T) {
 		}
 	}
 }
+
+// Tests that Len tracks added, replaced and swapped notifications.
+func TestNotificationBuffer_Len(t *testing.T) {
+	nb := NewNotificationBuffer()
+	nb.Add(1, []*notifications.Data{{RoundID: 1}, {RoundID: 1}})
+	nb.Add(2, []*notifications.Data{{RoundID: 2}})
+	if nb.Len() != 3 {
+		t.Errorf("Expected length %d, received %d", 3, nb.Len())
+	}
+
+	// Re-adding a round replaces its notifications
+	nb.Add(1, []*notifications.Data{{RoundID: 1}})
+	if nb.Len() != 2 {
+		t.Errorf("Expected length %d after replacing round, received %d", 2, nb.Len())
+	}
+
+	nb.Swap()
+	if nb.Len() != 0 {
+		t.Errorf("Expected empty buffer after swap, received length %d", nb.Len())
+	}
+}
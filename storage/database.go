@@ -8,13 +8,16 @@
 package storage
 
 import (
+	"context"
 	"fmt"
 	"github.com/pkg/errors"
 	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/notifications-bot/faults"
 	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
+	"sync"
 	"time"
 )
 
@@ -23,6 +26,11 @@ const sqliteDatabasePath = "file:%s?mode=memory&cache=shared"
 
 // interface declaration for storage methods
 type database interface {
+	transaction(fn func(tx database) error) error
+	withContext(ctx context.Context) database
+	injectWriteFaults(inj *faults.Injector) error
+	queryMetrics() *queryMetrics
+
 	UpsertState(state *State) error
 	GetStateValue(key string) (string, error)
 
@@ -30,33 +38,156 @@ type database interface {
 	GetUser(transmissionRsaHash []byte) (*User, error)
 	deleteUser(transmissionRsaHash []byte) error
 	GetAllUsers() ([]*User, error)
+	IterateUsers(batchSize int, fn func([]*User) error) error
 
 	registerTrackedIdentity(user User, identity Identity) error
 	registerTrackedIdentities(user User, ids []Identity) error
 
 	GetIdentity(iid []byte) (*Identity, error)
 	insertIdentity(identity *Identity) error
+	setIdentityPreimages(iid, transmissionRsaHash, preimages []byte) error
+	setIdentityConversation(iid, transmissionRsaHash []byte, conversation string) error
 	getIdentitiesByOffset(offset int64) ([]*Identity, error)
 	GetOrphanedIdentities() ([]*Identity, error)
+	IterateIdentitiesByOffset(offset int64, batchSize int, fn func([]*Identity) error) error
+	IterateOrphanedIdentities(batchSize int, fn func([]*Identity) error) error
+	IterateIdentitiesWithoutEphemeral(since int32, batchSize int, fn func([]*Identity) error) error
 
 	insertEphemeral(ephemeral *Ephemeral) error
+	insertEphemerals(ephemerals []*Ephemeral, batchSize int) error
 	GetEphemeral(ephemeralId int64) ([]*Ephemeral, error)
 	GetLatestEphemeral() (*Ephemeral, error)
 	DeleteOldEphemerals(currentEpoch int32) error
 	GetToNotify(ephemeralIds []int64) ([]GTNResult, error)
 
-	insertToken(token Token) error
-	DeleteToken(token string) error
+	upsertToken(token *Token) error
+	moveToken(token *Token) ([][]byte, error)
+	SetTokenPriority(token, app string, owner []byte, priority string) error
+	SetTokenSound(token, app string, owner []byte, channelID, sound string) error
+	SetTokenLocale(token, app string, owner []byte, locale string) error
+	SetTokenPrivacy(token, app string, owner []byte, privacy string) error
+	SetTokenProvenance(token, app string, owner []byte, provenance TokenProvenance) error
+	RestoreToken(token, app string, owner []byte) error
+	PurgeDeletedTokens(before time.Time) (int64, error)
+	GetToken(token, app string) (*Token, error)
+	GetOwnedToken(token, app string, owner []byte) (*Token, error)
+	CountActiveTokens(app string) (int64, error)
+	IterateActiveTokens(app string, batchSize int, fn func([]*Token) error) error
+	CountAppTokens(app string) (int64, error)
+	PurgeAppTokens(app string) (int64, error)
+	linkFallbackToken(primary, fallback string, owner []byte) error
+	promoteFallbackToken(primary, app, fallback string, owner []byte) (*Token, error)
+	DeleteToken(token, app string) error
 
 	unregisterIdentities(u *User, iids []Identity) error
 	unregisterTokens(u *User, tokens []Token) error
 	registerForNotifications(u *User, identity Identity, token Token) error
 	LegacyUnregister(iid []byte) error
+	getUnsealedIdentities(limit int) ([]*Identity, error)
+	rekeyIdentity(old []byte, updated *Identity) error
+	getTokensAfter(after *Token, limit int) ([]*Token, error)
+	rekeyToken(old string, updated *Token) error
+	updateTransmissionRSA(user *User) error
+	getLegacyUsers(table string, limit int) ([]*UserV1, error)
+	deleteLegacyUser(table string, transmissionRsaHash []byte) error
+	getLegacyV0Users(table, after string, limit int) ([]*UserV0, error)
+	deleteLegacyV0User(table, id string) error
+	markLegacyV0User(transmissionRSAHash []byte) error
+	removeLegacyV0Token(token *Token) ([][]byte, error)
+
+	InsertDeliveryLogs(logs []*DeliveryLog) error
+	GetDeliveryLogs(transmissionRsaHash []byte) ([]*DeliveryLog, error)
+	RollupDeliveryLogs(day time.Time) error
+	GetDeliveryRollups(from, to time.Time, app string) ([]*DeliveryRollup, error)
+	DeleteDeliveryLogs(before time.Time) error
+	InsertPushEvent(e *PushEvent, keep int) error
+	GetPushHistory(transmissionRsaHash []byte) ([]*PushEvent, error)
+	DeletePushEvents(before time.Time) error
+	TakePushQuota(day time.Time, app string, transmissionRsaHash []byte, iids [][]byte, limit int64) ([][]byte, error)
+	DeletePushCounts(before time.Time) error
+
+	InsertDeadLetter(dl *DeadLetter) error
+	GetDeadLetter(id uint) (*DeadLetter, error)
+	GetDeadLetters() ([]*DeadLetter, error)
+	DeleteDeadLetter(id uint) error
+	DeleteAllDeadLetters() error
+
+	upsertCanary(c *Canary) error
+	GetCanaries() ([]*Canary, error)
+	DeleteCanary(token string) error
+
+	UpsertGatewayWatermark(gatewayID string, round uint64, received time.Time) error
+	GetGatewayWatermarks() ([]*GatewayWatermark, error)
+	DeleteGatewayWatermark(gatewayID string) error
+
+	InsertBatchKey(gatewayID string, round uint64, received time.Time) (bool, error)
+	DeleteBatchKey(gatewayID string, round uint64) error
+	DeleteBatchKeys(before time.Time) error
+
+	AcquireLease(name, holder string, now time.Time, ttl time.Duration) (bool, error)
+	ReleaseLease(name, holder string) error
+
+	InsertQueuedNotifications(queued []*QueuedNotification) error
+	GetQueuedRounds(limit int) ([]uint64, error)
+	GetQueuedNotifications(rounds []uint64) ([]*QueuedNotification, error)
+	DeleteQueuedNotifications(rounds []uint64) error
+	CountQueuedNotifications() (int64, error)
+
+	insertOutboxEntries(entries []*OutboxEntry) error
+	ClaimOutboxEntries(limit int, now time.Time, lease time.Duration) ([]*OutboxEntry, error)
+	DeleteOutboxEntry(id uint) error
+	markRoundsProcessed(rounds []uint64, now time.Time) error
+	IsRoundProcessed(roundId uint64) (bool, error)
+	DeleteProcessedRounds(before time.Time) error
+
+	BlockUser(b *BlockedUser) error
+	UnblockUser(transmissionRsaHash []byte) error
+	IsUserBlocked(transmissionRsaHash []byte) (bool, error)
+	GetBlockedUsers() ([]*BlockedUser, error)
+
+	UpsertFeatureFlag(f *FeatureFlag) error
+	DeleteFeatureFlag(name string) error
+	GetFeatureFlags() ([]*FeatureFlag, error)
+
+	CheckSchema() error
+
+	MarkUserNotified(transmissionRsaHash []byte) error
+	MarkAppOpened(transmissionRsaHash []byte) error
+
+	SetUserDigest(transmissionRsaHash []byte, enabled bool) error
+	SetUserMutedConversations(transmissionRsaHash []byte, muted string) error
+	SetUserRegistrar(transmissionRsaHash []byte, timestamp int64, sig []byte) error
+	SetUserQuarantined(transmissionRsaHash []byte, quarantined bool) error
+	CountQuarantinedUsers() (int64, error)
+	AddToDigest(entry *DigestEntry) error
+	TakeDigests() ([]*DigestEntry, error)
+
+	CountTokensByApp() (map[string]int64, error)
+	CountTokensByVersion() ([]TokenVersionCount, error)
+	CountTenantTokens(tenant string) (int64, error)
+	CountUsers() (int64, error)
+	CountIdentities() (int64, error)
+	CountEphemeralsByEpoch() (map[int32]int64, error)
 }
 
 // DatabaseImpl is a struct which implements database on an underlying gorm.DB
 type DatabaseImpl struct {
 	db *gorm.DB // Stored database connection
+
+	// Read replicas used for reads which tolerate lag, in turn
+	replicas    []*gorm.DB
+	nextReplica uint32
+
+	// Set when the ephemerals table is partitioned by epoch
+	partitioned bool
+	// Start of the most recent partition range created ahead of time
+	partitionsThrough int32
+	partitionMux      sync.Mutex
+
+	// Query stats of each method, recorded by callbacks on every connection
+	metrics *queryMetrics
+	// Retries of transient errors on the primary
+	retry RetryParams
 }
 
 // State table
@@ -65,20 +196,52 @@ type State struct {
 	Value string `gorm:"NOT NULL"`
 }
 
+// UserV0 is a row of the original user table, which held a token for each
+// user ID before clients registered their transmission keys. Its rows are
+// converted to the token and tracked ID schema by Storage.MigrateLegacyV0Users.
+type UserV0 struct {
+	Id    string `gorm:"primaryKey"`
+	Token string `gorm:"not null"`
+}
+
+// UserV1 is a row of the legacy user table, which held a single token and
+// intermediary ID per user. Its rows are converted to the token and tracked ID
+// schema by Storage.MigrateLegacyUsers. Only the table's columns are mapped;
+// its ephemerals were keyed on columns the current ephemerals table no longer
+// has, so they are regenerated rather than migrated.
 type UserV1 struct {
-	TransmissionRSAHash []byte      `gorm:"primaryKey"`
-	IntermediaryId      []byte      `gorm:"not null; index"`
-	OffsetNum           int64       `gorm:"not null; index"`
-	TransmissionRSA     []byte      `gorm:"not null"`
-	Signature           []byte      `gorm:"not null"`
-	Token               string      `gorm:"not null"`
-	Ephemerals          []Ephemeral `gorm:"foreignKey:transmission_rsa_hash;references:transmission_rsa_hash;constraint:OnDelete:CASCADE;"`
+	TransmissionRSAHash []byte `gorm:"primaryKey"`
+	IntermediaryId      []byte `gorm:"not null; index"`
+	OffsetNum           int64  `gorm:"not null; index"`
+	TransmissionRSA     []byte `gorm:"not null"`
+	Signature           []byte `gorm:"not null"`
+	Token               string `gorm:"not null"`
 }
 
 type Token struct {
+	// Device token, or its pseudonym if tokens are encrypted at rest. Tokens
+	// are keyed on the token, app and owner, so a device token registered for
+	// several apps, or by several users of one app, keeps each registration.
 	Token               string `gorm:"primaryKey"`
-	App                 string
-	TransmissionRSAHash []byte `gorm:"not null;references users(transmission_rsa_hash)"`
+	SealedToken         []byte // Device token sealed with the token key; empty if stored in the clear
+	App                 string `gorm:"primaryKey"`
+	TransmissionRSAHash []byte `gorm:"primaryKey;not null;references users(transmission_rsa_hash)"`
+	Version             uint64 `gorm:"not null;default:1"` // Incremented each time the token is re-registered
+	Priority            string // Priority tier used when pushing to the token; empty for the default tier
+	ChannelID           string // Android notification channel overriding the app default
+	Sound               string // Notification sound overriding the app default
+	Locale              string // Client locale used to pick localized notification text
+	Fallback            string // Token to fail over to if this one is permanently rejected
+	Standby             bool   // Set on fallback tokens, which are not pushed to until promoted
+	Privacy             string // Limits what pushes reveal on the lock screen; see constants.PrivacyLevel
+	// Client reported platform, app and SDK versions of the last registration.
+	// They are not signed and are only used to diagnose rollouts.
+	Platform   string
+	AppVersion string
+	SDKVersion string `gorm:"column:sdk_version"`
+	// Tombstone set when the token is unregistered or purged; it can be
+	// restored until it is hard deleted after the retention period
+	DeletedAt gorm.DeletedAt `gorm:"index"`
 }
 
 type User struct {
@@ -86,6 +249,27 @@ type User struct {
 	TransmissionRSA     []byte     `gorm:"not null"`
 	Tokens              []Token    `gorm:"foreignKey:TransmissionRSAHash;constraint:OnDelete:CASCADE;"`
 	Identities          []Identity `gorm:"many2many:user_identities;"`
+	// NotifiedSinceOpen is set once the user is sent a visible push and
+	// cleared when their client reports the app was opened
+	NotifiedSinceOpen bool `gorm:"not null;default:false"`
+	// Digest holds the user's non-urgent notifications so they are sent as
+	// a single summary push each digest interval
+	Digest bool `gorm:"not null;default:false"`
+	// RegistrationTimestamp and RegistrarSig are the permissioning server's
+	// signature registering the transmission key, as last accepted, kept so
+	// registrations can be re-verified when the permissioning keys change
+	RegistrationTimestamp int64
+	RegistrarSig          []byte
+	// Quarantined is set when the registrar signature no longer verifies;
+	// the user is not pushed to until they register again
+	Quarantined bool `gorm:"not null;default:false"`
+	// MutedConversations is the comma separated list of conversations the
+	// user is not pushed for; see constants.ParseConversations
+	MutedConversations string
+	// LegacyV0 is set for users migrated from the original schema, which
+	// never registered a transmission key. Their TransmissionRSA holds their
+	// base64 encoded user ID rather than a PEM, so it cannot verify requests
+	LegacyV0 bool `gorm:"not null;default:false"`
 }
 
 // CREATES JOIN TABLE user_identities
@@ -101,48 +285,271 @@ type User struct {
 // "fk_user_identities_user" FOREIGN KEY (user_transmission_rsa_hash) REFERENCES users(transmission_rsa_hash)
 
 type Identity struct {
-	IntermediaryId []byte      `gorm:"primaryKey"`
-	OffsetNum      int64       `gorm:"not null; index"`
-	Users          []User      `gorm:"many2many:user_identities;"`
-	Ephemerals     []Ephemeral `gorm:"foreignKey:intermediary_id;references:intermediary_id;constraint:OnDelete:CASCADE;"`
+	IntermediaryId []byte `gorm:"primaryKey"` // Pseudonym of the intermediary ID if SealedId is set
+	SealedId       []byte // Encrypted intermediary ID, set if stored IDs are protected
+	OffsetNum      int64  `gorm:"not null; index"`
+	// Preimages is the JSON list of message identification preimages the
+	// identity's clients registered to disambiguate colliding ephemeral IDs,
+	// sealed like the intermediary ID if identities are protected
+	Preimages []byte
+	// Conversation is the service tag a client gave the identity; see
+	// constants.Conversation
+	Conversation string
+	Users        []User      `gorm:"many2many:user_identities;"`
+	Ephemerals   []Ephemeral `gorm:"foreignKey:intermediary_id;references:intermediary_id;constraint:OnDelete:CASCADE;"`
 }
 
+// Ephemeral is an ephemeral ID of an identity, generated for the offset
+// bucket of an epoch. An identity has at most one row for each ephemeral ID
+// and epoch, so regenerating a bucket leaves the existing rows in place.
 type Ephemeral struct {
 	ID             uint   `gorm:"primaryKey"`
-	IntermediaryId []byte `gorm:"not null;references identities(intermediary_id)"`
-	EphemeralId    int64  `gorm:"not null; index"`
-	Epoch          int32  `gorm:"not null; index"`
+	IntermediaryId []byte `gorm:"not null;references identities(intermediary_id);uniqueIndex:idx_ephemerals_unique"`
+	EphemeralId    int64  `gorm:"not null; index; uniqueIndex:idx_ephemerals_unique"`
+	Epoch          int32  `gorm:"not null; index; uniqueIndex:idx_ephemerals_unique"`
+}
+
+// TokenProvenance is the platform and versions a client reports when
+// registering a token.
+type TokenProvenance struct {
+	Platform   string `json:"platform,omitempty"`
+	AppVersion string `json:"appVersion,omitempty"`
+	SDKVersion string `json:"sdkVersion,omitempty"`
+}
+
+// Empty returns true if the client reported none of the fields.
+func (p TokenProvenance) Empty() bool {
+	return p == TokenProvenance{}
+}
+
+// TokenVersionCount is the number of tokens of an app registered from a
+// platform, app version and SDK version.
+type TokenVersionCount struct {
+	App        string `json:"app"`
+	Platform   string `json:"platform"`
+	AppVersion string `json:"appVersion"`
+	SDKVersion string `json:"sdkVersion" gorm:"column:sdk_version"`
+	Count      int64  `json:"count"`
+}
+
+// DeliveryLog records the outcome of a push sent to a provider for a round.
+// A single send covering several rounds produces one entry per round.
+type DeliveryLog struct {
+	ID                  uint      `gorm:"primaryKey"`
+	TransmissionRSAHash []byte    `gorm:"not null; index"`
+	Token               string    `gorm:"not null"`
+	App                 string    `gorm:"not null"`
+	EphemeralId         int64     `gorm:"not null"`
+	RoundId             uint64    `gorm:"not null; index"`
+	MessageId           string    // ID assigned to the push by the provider
+	Status              int       // HTTP status returned by the provider, if known
+	Error               string    // Empty if the send succeeded
+	Fallback            bool      // Set if the push went to a fallback token after the primary failed
+	Timestamp           time.Time `gorm:"not null; index"`
+}
+
+// PushEvent records a push sent to a user. The most recent pushes of each user
+// are kept so clients can reconcile the pushes they received with the messages
+// they retrieved.
+type PushEvent struct {
+	ID                  uint      `gorm:"primaryKey"`
+	TransmissionRSAHash []byte    `gorm:"not null; index"`
+	App                 string    `gorm:"not null"`
+	EphemeralId         int64     `gorm:"not null"`
+	Rounds              []uint64  `gorm:"serializer:json"`
+	Count               int       `gorm:"not null"` // Notifications carried by the push
+	MessageId           string    // ID assigned to the push by the provider
+	Error               string    // Empty if the send succeeded
+	Timestamp           time.Time `gorm:"not null; index"`
+}
+
+// PushCount counts the pushes a user received through an app for a tracked
+// identity on a day, enforcing the daily push quota of the app.
+type PushCount struct {
+	Day                 time.Time `gorm:"primaryKey"` // Midnight UTC starting the day
+	App                 string    `gorm:"primaryKey"`
+	TransmissionRSAHash []byte    `gorm:"primaryKey"`
+	IntermediaryId      []byte    `gorm:"primaryKey"` // As stored, see Identity
+	Count               int64     `gorm:"not null"`
+}
+
+// DeliveryRollup holds the delivery counters of an app for a day, aggregated
+// from the delivery log so they outlive its retention period.
+type DeliveryRollup struct {
+	Day    time.Time `gorm:"primaryKey"` // Midnight UTC starting the day
+	App    string    `gorm:"primaryKey"`
+	Sent   int64     `gorm:"not null"`
+	Failed int64     `gorm:"not null"`
+	// FailedByReason counts failed sends by the HTTP status returned by the
+	// provider, or "error" if there was none
+	FailedByReason map[string]int64 `gorm:"serializer:json"`
+	// UniqueIdentities is the number of users successfully pushed to, counted
+	// by transmission key as the delivery log does not hold tracked IDs
+	UniqueIdentities int64     `gorm:"not null"`
+	UpdatedAt        time.Time `gorm:"not null"`
+}
+
+// DeadLetter holds a notification which could not be delivered to a provider
+// after all send attempts were exhausted, so it can be inspected or re-driven.
+type DeadLetter struct {
+	ID                  uint      `gorm:"primaryKey"`
+	TransmissionRSAHash []byte    `gorm:"not null; index"`
+	Token               string    `gorm:"not null"`
+	App                 string    `gorm:"not null"`
+	EphemeralId         int64     `gorm:"not null"`
+	Rounds              []uint64  `gorm:"serializer:json"`
+	Payload             string    `gorm:"not null"` // Notification CSV sent to the provider
+	Attempts            int       `gorm:"not null"`
+	Error               string    `gorm:"not null"` // Error returned by the final attempt
+	Timestamp           time.Time `gorm:"not null; index"`
+}
+
+// Canary is a device token registered by an operator which is sent a
+// heartbeat push at a fixed interval to detect provider delivery problems.
+// Canaries belong to no user, so they are keyed on the token alone; adding a
+// canary again moves it to the new app.
+type Canary struct {
+	// Device token, or its pseudonym if tokens are encrypted at rest
+	Token       string `gorm:"primaryKey"`
+	SealedToken []byte
+	App         string    `gorm:"not null"`
+	CreatedAt   time.Time `gorm:"not null"`
+}
+
+// GatewayWatermark records the last notification batch accepted from a
+// gateway, so gateways whose notifications have stopped can be detected.
+type GatewayWatermark struct {
+	GatewayID  string    `gorm:"primaryKey"`
+	LastRound  uint64    `gorm:"not null"`
+	Batches    uint64    `gorm:"not null"`
+	ReceivedAt time.Time `gorm:"not null"`
+}
+
+// BatchKey is the idempotency key of a notification batch accepted from a
+// gateway, so a batch resent by the gateway after a network error is
+// acknowledged without being processed again.
+type BatchKey struct {
+	GatewayID string    `gorm:"primaryKey"`
+	RoundId   uint64    `gorm:"primaryKey;autoIncrement:false"`
+	Timestamp time.Time `gorm:"not null; index"`
+}
+
+// Lease is held by one of several instances sharing the database, so only the
+// holder performs a role. It is taken over by another instance once it
+// expires without being renewed.
+type Lease struct {
+	Name    string    `gorm:"primaryKey"`
+	Holder  string    `gorm:"not null"`
+	Expires time.Time `gorm:"not null"`
+}
+
+// BlockedUser is a user an operator has barred from registering and receiving
+// pushes, such as an abusive or test identity.
+type BlockedUser struct {
+	TransmissionRsaHash []byte    `gorm:"primaryKey"`
+	Reason              string    `gorm:"not null"`
+	CreatedAt           time.Time `gorm:"not null"`
+}
+
+// FeatureFlag rolls a gated behavior out to the percentage of identities set
+// by an operator.
+type FeatureFlag struct {
+	Name      string    `gorm:"primaryKey"`
+	Percent   float64   `gorm:"not null"`
+	UpdatedAt time.Time `gorm:"not null"`
+}
+
+// DigestEntry holds the notifications received for a token in digest mode
+// since its last summary push. Entries are kept per registration, as a device
+// token may be registered by several users.
+type DigestEntry struct {
+	Token               string    `gorm:"primaryKey"`
+	App                 string    `gorm:"primaryKey"`
+	TransmissionRsaHash []byte    `gorm:"primaryKey"`
+	Target              GTNResult `gorm:"serializer:json;not null"`
+	Count               int64     `gorm:"not null"`
+	HeldSince           time.Time `gorm:"not null"`
+}
+
+// QueuedNotification holds a notification received from a gateway while the
+// bot was in maintenance mode, to be sent once maintenance ends.
+type QueuedNotification struct {
+	ID          uint      `gorm:"primaryKey"`
+	RoundId     uint64    `gorm:"not null; index"`
+	EphemeralId int64     `gorm:"not null"`
+	IdentityFP  []byte    `gorm:"not null"`
+	MessageHash []byte    `gorm:"not null"`
+	Timestamp   time.Time `gorm:"not null"`
+}
+
+// OutboxEntry is a push which has been decided on but not yet handed to a
+// provider. Entries are removed once the send completes, so any left behind
+// by a crash are dispatched again.
+type OutboxEntry struct {
+	ID           uint      `gorm:"primaryKey"`
+	Target       GTNResult `gorm:"serializer:json;not null"`
+	Rounds       []uint64  `gorm:"serializer:json"`
+	Payload      string    `gorm:"not null"`        // Notification CSV to send
+	ClaimedUntil time.Time `gorm:"not null; index"` // The entry is not dispatched again before this time
+	CreatedAt    time.Time `gorm:"not null"`
+}
+
+// ProcessedRound records a gateway notification batch whose pushes have been
+// written to the outbox, so the batch is not processed again if resent.
+type ProcessedRound struct {
+	RoundId   uint64    `gorm:"primaryKey;autoIncrement:false"`
+	Timestamp time.Time `gorm:"not null; index"`
 }
 
 // Initialize the database interface with database backend
 // Returns a database interface, close function, and error
 func newDatabase(username, password, dbName, address,
 	port string) (database, error) {
+	return newDatabaseFromParams(Params{
+		Username: username,
+		Password: password,
+		DBName:   dbName,
+		Address:  address,
+		Port:     port,
+	})
+}
+
+// schemaModels returns the models of the database schema, in the order they
+// are migrated in.
+func schemaModels() []interface{} {
+	// WARNING: Order is important. Do not change without database testing
+	return []interface{}{&Token{}, &User{}, &Identity{}, &Ephemeral{}, &State{}, &DeliveryLog{}, &DeadLetter{}, &QueuedNotification{}, &OutboxEntry{}, &ProcessedRound{}, &Canary{}, &GatewayWatermark{}, &BatchKey{}, &DeliveryRollup{}, &Lease{}, &BlockedUser{}, &DigestEntry{}, &FeatureFlag{}, &PushEvent{}, &PushCount{}}
+}
+
+// newDatabaseFromParams initializes the database interface with the backend
+// described by the passed in Params.
+func newDatabaseFromParams(params Params) (database, error) {
 	var err error
 	var db *gorm.DB
 	var dialector gorm.Dialector
 	// Connect to the database if the correct information is provided
-	usePostgres := address != "" && port != ""
+	usePostgres := params.Address != "" && params.Port != ""
 	if usePostgres {
 		// Create the database connection
 		connectString := fmt.Sprintf(
 			postgresConnectString,
-			address, port, username, dbName)
+			params.Address, params.Port, params.Username, params.DBName)
 		// Handle empty database password
-		if len(password) > 0 {
-			connectString += fmt.Sprintf(" password=%s", password)
+		if len(params.Password) > 0 {
+			connectString += fmt.Sprintf(" password=%s", params.Password)
 		}
 		dialector = postgres.Open(connectString)
 	} else {
 		jww.WARN.Printf("Database backend connection information not provided")
-		temporaryDbPath := fmt.Sprintf(sqliteDatabasePath, dbName)
+		temporaryDbPath := fmt.Sprintf(sqliteDatabasePath, params.DBName)
 		dialector = sqlite.Open(temporaryDbPath)
 	}
 
 	// Create the database connection
-	db, err = gorm.Open(dialector, &gorm.Config{
+	config := &gorm.Config{
 		Logger: logger.New(jww.TRACE, logger.Config{LogLevel: logger.Info}),
-	})
+	}
+	db, err = gorm.Open(dialector, config)
 	if err != nil {
 		return nil, errors.Errorf("Unable to initialize in-memory sqlite database backend: %+v", err)
 	}
@@ -173,19 +580,71 @@ func newDatabase(username, password, dbName, address,
 	// SetConnMaxLifetime sets the maximum amount of time a connection may be reused.
 	sqlDb.SetConnMaxLifetime(12 * time.Hour)
 
+	if err = newRetryingPool(db, params.Retry); err != nil {
+		return nil, errors.Errorf("Unable to configure database retries: %+v", err)
+	}
+
 	// Initialize the database schema
-	// WARNING: Order is important. Do not change without database testing
-	models := []interface{}{&Token{}, &User{}, &Identity{}, &Ephemeral{}, &State{}}
-	for _, model := range models {
-		err = db.AutoMigrate(model)
-		if err != nil {
-			return nil, err
+	if !params.SkipMigration {
+		if err = scopeTokens(db); err != nil {
+			return nil, errors.WithMessage(err, "Failed to key tokens on token, app and owner")
+		}
+		if err = scopeDigests(db); err != nil {
+			return nil, errors.WithMessage(err, "Failed to key digest entries on token, app and owner")
+		}
+		if err = dedupeEphemerals(db); err != nil {
+			return nil, errors.WithMessage(err, "Failed to remove duplicate ephemerals")
+		}
+		for _, model := range schemaModels() {
+			err = db.AutoMigrate(model)
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
 
 	// Build the interface
 	di := &DatabaseImpl{
-		db: db,
+		db:      db,
+		metrics: newQueryMetrics(params.SlowQueryThreshold),
+		retry:   params.Retry,
+	}
+
+	if len(params.ReadReplicas) > 0 {
+		if !usePostgres {
+			jww.WARN.Printf("Read replicas are only supported on postgres, ignoring")
+		} else {
+			di.replicas, err = openReplicas(params.ReadReplicas, config)
+			if err != nil {
+				return nil, err
+			}
+			jww.INFO.Printf("Routing notification lookups to %d read replicas", len(di.replicas))
+		}
+	}
+
+	// Replicas share the primary's config, and with it its callbacks
+	if err = di.metrics.register(db); err != nil {
+		return nil, errors.WithMessage(err, "Failed to register query metrics")
+	}
+
+	if params.PartitionEphemerals {
+		if !usePostgres {
+			jww.WARN.Printf("Ephemeral partitioning is only supported on postgres, ignoring")
+		} else {
+			err = di.partitionEphemerals()
+			if err != nil {
+				return nil, errors.WithMessage(err, "Failed to partition ephemerals table")
+			}
+		}
+	}
+
+	// Fail now with the differences rather than later with the errors of the
+	// queries which run into them
+	if err = di.CheckSchema(); err != nil {
+		if params.SkipMigration {
+			return nil, errors.WithMessage(err, "Schema migration is disabled, migrate the database or enable it")
+		}
+		return nil, errors.WithMessage(err, "Database schema still differs after migration")
 	}
 
 	jww.INFO.Println("Database backend initialized successfully!")
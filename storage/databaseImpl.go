@@ -10,20 +10,85 @@
 package storage
 
 import (
+	"context"
 	"encoding/base64"
+	"fmt"
 	"github.com/pkg/errors"
 	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/elixxir/notifications-bot/errs"
+	"gitlab.com/elixxir/notifications-bot/faults"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// errNotRegistered is returned when a token or user to update is not
+// registered. It is gorm.ErrRecordNotFound, categorised as not registered.
+var errNotRegistered = errs.Mark(gorm.ErrRecordNotFound, errs.ErrNotRegistered)
+
+// notRegistered categorises err as errs.ErrNotRegistered if it is because no
+// record was found.
+func notRegistered(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return errs.Mark(err, errs.ErrNotRegistered)
+	}
+	return err
+}
+
+// transaction runs fn with a database whose calls all go through a single
+// transaction, which is rolled back if fn returns an error.
+func (d *DatabaseImpl) transaction(fn func(tx database) error) error {
+	return d.inTransaction(func(tx *gorm.DB) error {
+		return fn(&DatabaseImpl{db: tx, partitioned: d.partitioned, metrics: d.metrics, retry: d.retry})
+	})
+}
+
+// withContext returns a database whose queries, on the primary and on read
+// replicas, are cancelled once ctx is done.
+func (d *DatabaseImpl) withContext(ctx context.Context) database {
+	replicas := make([]*gorm.DB, len(d.replicas))
+	for i, r := range d.replicas {
+		replicas[i] = r.WithContext(ctx)
+	}
+	return &DatabaseImpl{db: d.db.WithContext(ctx), replicas: replicas, partitioned: d.partitioned,
+		metrics: d.metrics, retry: d.retry}
+}
+
+// queryMetrics returns the query stats of the database's methods.
+func (d *DatabaseImpl) queryMetrics() *queryMetrics {
+	return d.metrics
+}
+
+// injectWriteFaults registers callbacks which fail creates, updates and
+// deletes at the rate set on inj.
+func (d *DatabaseImpl) injectWriteFaults(inj *faults.Injector) error {
+	fail := func(tx *gorm.DB) {
+		if err := inj.Fail(); err != nil {
+			_ = tx.AddError(err)
+		}
+	}
+	cb := d.db.Callback()
+	if err := cb.Create().Before("gorm:create").Register("faults:create", fail); err != nil {
+		return err
+	}
+	if err := cb.Update().Before("gorm:update").Register("faults:update", fail); err != nil {
+		return err
+	}
+	return cb.Delete().Before("gorm:delete").Register("faults:delete", fail)
+}
+
 // UpsertState inserts the given State into Storage if it does not exist,
 // or updates the Database State if its value does not match the given State.
 func (d *DatabaseImpl) UpsertState(state *State) error {
 	jww.TRACE.Printf("Attempting to insert State into DB: %+v", state)
 
 	// Build a transaction to prevent race conditions
-	return d.db.Transaction(func(tx *gorm.DB) error {
+	return d.inTransaction(func(tx *gorm.DB) error {
 		return tx.Clauses(clause.OnConflict{
 			Columns:   []clause.Column{{Name: "key"}},
 			DoUpdates: clause.AssignmentColumns([]string{"value"}),
@@ -40,9 +105,11 @@ func (d *DatabaseImpl) GetStateValue(key string) (string, error) {
 	return result.Value, err
 }
 
-// DeleteToken deletes the given token from storage.
-func (d *DatabaseImpl) DeleteToken(token string) error {
-	return d.db.Where("token = ?", token).Delete(&Token{Token: token}).Error
+// DeleteToken marks the given token of app as deleted for every user it is
+// registered to. It is no longer pushed to, but can be restored until it is
+// purged.
+func (d *DatabaseImpl) DeleteToken(token, app string) error {
+	return d.db.Where("token = ? AND app = ?", token, app).Delete(&Token{}).Error
 }
 
 // insertUser inserts or updates a User in storage.
@@ -55,7 +122,7 @@ func (d *DatabaseImpl) GetUser(transmissionRsaHash []byte) (*User, error) {
 	u := &User{}
 	err := d.db.Preload("Identities").Preload("Tokens").Take(u, "transmission_rsa_hash = ?", transmissionRsaHash).Error
 	if err != nil {
-		return nil, err
+		return nil, notRegistered(err)
 	}
 	return u, nil
 }
@@ -77,6 +144,35 @@ func (d *DatabaseImpl) GetAllUsers() ([]*User, error) {
 	return dest, d.db.Find(&dest).Error
 }
 
+// IterateUsers calls fn with successive batches of at most batchSize users,
+// using keyset pagination on the transmission RSA hash. It stops at the first
+// error returned by fn.
+func (d *DatabaseImpl) IterateUsers(batchSize int, fn func([]*User) error) error {
+	var last []byte
+	for {
+		var batch []*User
+		tx := d.db.Model(&User{})
+		if last != nil {
+			tx = tx.Where("transmission_rsa_hash > ?", last)
+		}
+		err := tx.Order("transmission_rsa_hash").Limit(batchSize).Find(&batch).Error
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		err = fn(batch)
+		if err != nil {
+			return err
+		}
+		if len(batch) < batchSize {
+			return nil
+		}
+		last = batch[len(batch)-1].TransmissionRSAHash
+	}
+}
+
 // GetIdentity retrieves an Identity from storage by primary key.
 func (d *DatabaseImpl) GetIdentity(iid []byte) (*Identity, error) {
 	i := &Identity{}
@@ -94,6 +190,39 @@ func (d *DatabaseImpl) insertIdentity(identity *Identity) error {
 	}).Create(identity).Error
 }
 
+// setIdentityPreimages sets the preimages of the identity stored under iid,
+// which must be tracked by the user with the passed in transmission RSA hash.
+// It returns gorm.ErrRecordNotFound if the user does not track the identity.
+func (d *DatabaseImpl) setIdentityPreimages(iid, transmissionRsaHash, preimages []byte) error {
+	tracked := d.db.Table("user_identities").Select("identity_intermediary_id").
+		Where("identity_intermediary_id = ? AND user_transmission_rsa_hash = ?", iid, transmissionRsaHash)
+	res := d.db.Model(&Identity{}).Where("intermediary_id IN (?)", tracked).Update("preimages", preimages)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// setIdentityConversation sets the conversation of the identity stored under
+// iid, which must be tracked by the user with the passed in transmission RSA
+// hash. It returns gorm.ErrRecordNotFound if the user does not track the
+// identity.
+func (d *DatabaseImpl) setIdentityConversation(iid, transmissionRsaHash []byte, conversation string) error {
+	tracked := d.db.Table("user_identities").Select("identity_intermediary_id").
+		Where("identity_intermediary_id = ? AND user_transmission_rsa_hash = ?", iid, transmissionRsaHash)
+	res := d.db.Model(&Identity{}).Where("intermediary_id IN (?)", tracked).Update("conversation", conversation)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
 // getIdentitiesByOffset returns a list of all identities with the given offset.
 func (d *DatabaseImpl) getIdentitiesByOffset(offset int64) ([]*Identity, error) {
 	var result []*Identity
@@ -107,15 +236,82 @@ func (d *DatabaseImpl) GetOrphanedIdentities() ([]*Identity, error) {
 	return dest, d.db.Find(&dest, "NOT EXISTS (select * from ephemerals where ephemerals.intermediary_id = identities.intermediary_id)").Error
 }
 
-// insertEphemeral inserts an Ephemeral into storage.
+// IterateIdentitiesByOffset calls fn with successive batches of at most
+// batchSize identities with the given offset, without loading them all into memory.
+func (d *DatabaseImpl) IterateIdentitiesByOffset(offset int64, batchSize int, fn func([]*Identity) error) error {
+	return d.iterateIdentities(batchSize, func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("offset_num = ?", offset)
+	}, fn)
+}
+
+// IterateOrphanedIdentities calls fn with successive batches of at most
+// batchSize identities with no associated ephemerals.
+func (d *DatabaseImpl) IterateOrphanedIdentities(batchSize int, fn func([]*Identity) error) error {
+	return d.iterateIdentities(batchSize, func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("NOT EXISTS (select * from ephemerals where ephemerals.intermediary_id = identities.intermediary_id)")
+	}, fn)
+}
+
+// IterateIdentitiesWithoutEphemeral calls fn with successive batches of at
+// most batchSize identities with no ephemeral for an epoch from since on.
+func (d *DatabaseImpl) IterateIdentitiesWithoutEphemeral(since int32, batchSize int, fn func([]*Identity) error) error {
+	return d.iterateIdentities(batchSize, func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("NOT EXISTS (select * from ephemerals where ephemerals.intermediary_id = identities.intermediary_id "+
+			"and ephemerals.epoch >= ?)", since)
+	}, fn)
+}
+
+// iterateIdentities pages through the identities matched by filter using
+// keyset pagination on the intermediary ID, calling fn with each page. It
+// stops at the first error returned by fn.
+func (d *DatabaseImpl) iterateIdentities(batchSize int, filter func(tx *gorm.DB) *gorm.DB, fn func([]*Identity) error) error {
+	var last []byte
+	for {
+		var batch []*Identity
+		tx := filter(d.db.Model(&Identity{}))
+		if last != nil {
+			tx = tx.Where("intermediary_id > ?", last)
+		}
+		err := tx.Order("intermediary_id").Limit(batchSize).Find(&batch).Error
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		err = fn(batch)
+		if err != nil {
+			return err
+		}
+		if len(batch) < batchSize {
+			return nil
+		}
+		last = batch[len(batch)-1].IntermediaryId
+	}
+}
+
+// insertEphemeral inserts an Ephemeral into storage, skipping it if it is
+// already stored.
 func (d *DatabaseImpl) insertEphemeral(ephemeral *Ephemeral) error {
-	return d.db.Create(&ephemeral).Error
+	return d.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&ephemeral).Error
+}
+
+// insertEphemerals inserts the passed in ephemerals in multi-row INSERTs of
+// at most batchSize rows. Ephemerals already stored are skipped, so a bucket
+// whose generation was interrupted can be generated again.
+func (d *DatabaseImpl) insertEphemerals(ephemerals []*Ephemeral, batchSize int) error {
+	if len(ephemerals) == 0 {
+		return nil
+	}
+	return d.db.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(ephemerals, batchSize).Error
 }
 
 // GetEphemeral retrieves a list of ephemerals with the given ID.
 func (d *DatabaseImpl) GetEphemeral(ephemeralId int64) ([]*Ephemeral, error) {
 	var result []*Ephemeral
-	err := d.db.Where("ephemeral_id = ?", ephemeralId).Find(&result).Error
+	err := d.read(func(db *gorm.DB) error {
+		return db.Where("ephemeral_id = ?", ephemeralId).Find(&result).Error
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -128,9 +324,56 @@ func (d *DatabaseImpl) GetEphemeral(ephemeralId int64) ([]*Ephemeral, error) {
 // GTNResult is a type wrapping the custom query for GetToNotify.
 type GTNResult struct {
 	Token               string
+	SealedToken         []byte
 	App                 string
+	Priority            string
+	ChannelID           string
+	Sound               string
+	Locale              string
+	Privacy             string
+	Fallback            string
+	Standby             bool
 	TransmissionRSAHash []byte
 	EphemeralId         int64
+	NotifiedSinceOpen   bool
+	Digest              bool
+	// IntermediaryId is the stored ID of the identity the ephemeral ID
+	// matched and Preimages the message identification preimages registered
+	// for it, if any; see Storage.OpenPreimages
+	IntermediaryId []byte
+	Preimages      []byte
+	// Conversation is the service tag of the identity and
+	// MutedConversations the conversations its user muted
+	Conversation       string
+	MutedConversations string
+
+	// Count is the number of notifications combined into the push sent to
+	// Token and MoreAvailable is set if notifications were truncated from it.
+	// They are set when sending and are not stored.
+	Count         int  `gorm:"-"`
+	MoreAvailable bool `gorm:"-"`
+	// FailedOver is set when sending to a fallback token after the push to
+	// the primary was rejected.
+	FailedOver bool `gorm:"-"`
+	// Broadcast is the operator message carried by a broadcast push in place
+	// of notifications.
+	Broadcast string `gorm:"-"`
+	// Reregister is set to the app of a sibling device whose token was
+	// purged, asking this device to have it refresh its registration.
+	Reregister string `gorm:"-"`
+	// Silent is set on pushes to a user already notified since they last
+	// opened the app; they update the app without alerting.
+	Silent bool `gorm:"-"`
+	// Digested is set on the summary push of notifications held for a user
+	// in digest mode; Count is the number held.
+	Digested bool `gorm:"-"`
+	// Test is set on a push the user requested to check their devices
+	// receive notifications; it carries no notifications.
+	Test bool `gorm:"-"`
+	// AlertTitle and AlertBody replace the app's alert text with that of the
+	// push's conversation; the app's is used where empty.
+	AlertTitle string `gorm:"-"`
+	AlertBody  string `gorm:"-"`
 }
 
 // The following struct can be used to scan in the intermediary result tables t1 and t2
@@ -152,17 +395,28 @@ type GTNResult struct {
 // GetToNotify returns a list of GTNResult data matching the list of ephemeral IDs passed in.
 func (d *DatabaseImpl) GetToNotify(ephemeralIds []int64) ([]GTNResult, error) {
 	var result []GTNResult
-	err := d.db.Transaction(func(tx *gorm.DB) error {
-		t1 := tx.Table("identities").Select("ephemerals.ephemeral_id, identities.intermediary_id").Joins("inner join ephemerals on ephemerals.intermediary_id = identities.intermediary_id").Where("ephemerals.ephemeral_id in ?", ephemeralIds)
-		t2 := tx.Table("user_identities").Select("t1.ephemeral_id, user_identities.user_transmission_rsa_hash as transmission_rsa_hash").Joins("right join (?) as t1 on t1.intermediary_id = user_identities.identity_intermediary_id", t1)
-		t3 := tx.Model(&User{}).Select("users.transmission_rsa_hash, t2.ephemeral_id").Joins("right join (?) as t2 on users.transmission_rsa_hash = t2.transmission_rsa_hash", t2)
-		return tx.Model(&Token{}).Distinct().Select("tokens.token, tokens.app, t3.transmission_rsa_hash, t3.ephemeral_id").Joins("right join (?) as t3 on tokens.transmission_rsa_hash = t3.transmission_rsa_hash", t3).Scan(&result).Error
+	err := d.read(func(db *gorm.DB) error {
+		result = nil
+		return db.Transaction(func(tx *gorm.DB) error {
+			t1 := tx.Table("identities").Select("ephemerals.ephemeral_id, identities.intermediary_id, identities.preimages, identities.conversation").Joins("inner join ephemerals on ephemerals.intermediary_id = identities.intermediary_id").Where("ephemerals.ephemeral_id in ?", ephemeralIds)
+			t2 := tx.Table("user_identities").Select("t1.ephemeral_id, t1.intermediary_id, t1.preimages, t1.conversation, user_identities.user_transmission_rsa_hash as transmission_rsa_hash").Joins("right join (?) as t1 on t1.intermediary_id = user_identities.identity_intermediary_id", t1)
+			t3 := tx.Model(&User{}).Select("users.transmission_rsa_hash, users.notified_since_open, users.digest, users.quarantined, users.muted_conversations, t2.ephemeral_id, t2.intermediary_id, t2.preimages, t2.conversation").Joins("right join (?) as t2 on users.transmission_rsa_hash = t2.transmission_rsa_hash", t2)
+			blocked := tx.Model(&BlockedUser{}).Select("transmission_rsa_hash")
+			return tx.Model(&Token{}).Distinct().Select("tokens.token, tokens.sealed_token, tokens.app, tokens.priority, tokens.channel_id, tokens.sound, tokens.locale, tokens.privacy, tokens.fallback, tokens.standby, t3.transmission_rsa_hash, t3.ephemeral_id, t3.notified_since_open, t3.digest, t3.muted_conversations, t3.intermediary_id, t3.preimages, t3.conversation").Joins("right join (?) as t3 on tokens.transmission_rsa_hash = t3.transmission_rsa_hash", t3).Where("t3.transmission_rsa_hash IS NULL OR (t3.transmission_rsa_hash NOT IN (?) AND NOT t3.quarantined)", blocked).Scan(&result).Error
+		})
 	})
 	return result, err
 }
 
 // DeleteOldEphemerals deletes all ephemerals from storage with an epoch before the passed in value.
+// If the ephemerals table is partitioned, expired partitions are dropped first so
+// only rows in the current partition need to be deleted individually.
 func (d *DatabaseImpl) DeleteOldEphemerals(currentEpoch int32) error {
+	if d.partitioned {
+		if err := d.maintainPartitions(currentEpoch); err != nil {
+			return err
+		}
+	}
 	res := d.db.Where("epoch < ?", currentEpoch).Delete(&Ephemeral{})
 	return res.Error
 }
@@ -183,7 +437,7 @@ func (d *DatabaseImpl) GetLatestEphemeral() (*Ephemeral, error) {
 // registerForNotifications is primarily used for legacy calls.
 // It links an extant user with the given identity and token.
 func (d *DatabaseImpl) registerForNotifications(u *User, identity Identity, token Token) error {
-	return d.db.Transaction(func(tx *gorm.DB) error {
+	return d.inTransaction(func(tx *gorm.DB) error {
 		err := tx.Model(u).Association("Identities").Append(&identity)
 		if err != nil {
 			return errors.WithMessage(err, "Failed to register identity")
@@ -193,6 +447,13 @@ func (d *DatabaseImpl) registerForNotifications(u *User, identity Identity, toke
 		if err != nil {
 			return errors.WithMessage(err, "Failed to register token")
 		}
+		// Re-registering an unregistered token clears its tombstone
+		err = tx.Unscoped().Model(&Token{}).
+			Where("token = ? AND app = ? AND transmission_rsa_hash = ?", token.Token, token.App, u.TransmissionRSAHash).
+			Update("deleted_at", nil).Error
+		if err != nil {
+			return errors.WithMessage(err, "Failed to restore token")
+		}
 		return nil
 	})
 }
@@ -200,7 +461,7 @@ func (d *DatabaseImpl) registerForNotifications(u *User, identity Identity, toke
 // unregisterIdentities deletes all given identities from the given user.
 // It does not remove the user or the identities, just the association.
 func (d *DatabaseImpl) unregisterIdentities(u *User, iids []Identity) error {
-	return d.db.Transaction(func(tx *gorm.DB) error {
+	return d.inTransaction(func(tx *gorm.DB) error {
 		err := tx.Model(&u).Association("Identities").Delete(iids)
 		if err != nil {
 			return errors.WithMessage(err, "Failed to break association")
@@ -237,12 +498,17 @@ func (d *DatabaseImpl) unregisterIdentities(u *User, iids []Identity) error {
 	})
 }
 
-// unregisterTokens deletes all given tokens from the passed in user.
+// unregisterTokens deletes all given tokens from the passed in user. Tokens
+// without an app are deleted for every app they are registered for.
 // It does not remove the tokens or user, just their association.
 func (d *DatabaseImpl) unregisterTokens(u *User, tokens []Token) error {
-	return d.db.Transaction(func(tx *gorm.DB) error {
+	return d.inTransaction(func(tx *gorm.DB) error {
 		for _, t := range tokens {
-			err := tx.Delete(t).Error
+			q := tx.Where("token = ? AND transmission_rsa_hash = ?", t.Token, u.TransmissionRSAHash)
+			if t.App != "" {
+				q = q.Where("app = ?", t.App)
+			}
+			err := q.Delete(&Token{}).Error
 			if err != nil {
 				return errors.WithMessage(err, "Failed to delete token")
 			}
@@ -269,7 +535,7 @@ func (d *DatabaseImpl) unregisterTokens(u *User, tokens []Token) error {
 // LegacyUnregister is a function to mimic the old unregister logic.
 // It will delete a user and identity if they have a 1:1 relationship.
 func (d *DatabaseImpl) LegacyUnregister(iid []byte) error {
-	return d.db.Transaction(func(tx *gorm.DB) error {
+	return d.inTransaction(func(tx *gorm.DB) error {
 		var res Identity
 		err := tx.Preload("Users").Find(&res, "intermediary_id = ?", iid).Error
 		if err != nil {
@@ -296,9 +562,434 @@ func (d *DatabaseImpl) LegacyUnregister(iid []byte) error {
 	})
 }
 
-// insertToken adds a token to storage.
-func (d *DatabaseImpl) insertToken(token Token) error {
-	return d.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&token).Error
+// getUnsealedIdentities returns up to limit identities stored without a sealed
+// intermediary ID.
+func (d *DatabaseImpl) getUnsealedIdentities(limit int) ([]*Identity, error) {
+	var result []*Identity
+	err := d.db.Where("sealed_id IS NULL").Limit(limit).Find(&result).Error
+	return result, err
+}
+
+// rekeyIdentity moves the identity stored under old, along with its users and
+// ephemerals, to the passed in identity.
+func (d *DatabaseImpl) rekeyIdentity(old []byte, updated *Identity) error {
+	return d.inTransaction(func(tx *gorm.DB) error {
+		err := tx.Create(updated).Error
+		if err != nil {
+			return errors.WithMessage(err, "Failed to insert identity")
+		}
+		err = tx.Table("user_identities").Where("identity_intermediary_id = ?", old).
+			Update("identity_intermediary_id", updated.IntermediaryId).Error
+		if err != nil {
+			return errors.WithMessage(err, "Failed to move user associations")
+		}
+		err = tx.Model(&Ephemeral{}).Where("intermediary_id = ?", old).
+			Update("intermediary_id", updated.IntermediaryId).Error
+		if err != nil {
+			return errors.WithMessage(err, "Failed to move ephemerals")
+		}
+		return tx.Delete(&Identity{}, "intermediary_id = ?", old).Error
+	})
+}
+
+// getTokensAfter returns up to limit stored tokens, including deleted ones,
+// ordered by the value they are stored under, their app and their owner and
+// starting after the passed in token's key.
+func (d *DatabaseImpl) getTokensAfter(after *Token, limit int) ([]*Token, error) {
+	var result []*Token
+	err := d.db.Unscoped().
+		Where("token > ? OR (token = ? AND app > ?) OR (token = ? AND app = ? AND transmission_rsa_hash > ?)",
+			after.Token, after.Token, after.App, after.Token, after.App, after.TransmissionRSAHash).
+		Order("token, app, transmission_rsa_hash").Limit(limit).Find(&result).Error
+	return result, err
+}
+
+// rekeyToken replaces the token stored under old for the updated token's app
+// and owner with the passed in token, moving fallback links, delivery logs and dead
+// letters which refer to it. Fallback links name the token without its app,
+// so they are moved along with its first app's registration. The rest of the
+// row is re-read inside the transaction, as rekeying another token may have
+// moved its fallback link since updated was read.
+func (d *DatabaseImpl) rekeyToken(old string, updated *Token) error {
+	if old == updated.Token {
+		return d.db.Unscoped().Model(&Token{}).
+			Where("token = ? AND app = ? AND transmission_rsa_hash = ?", old, updated.App, updated.TransmissionRSAHash).
+			Update("sealed_token", updated.SealedToken).Error
+	}
+	return d.inTransaction(func(tx *gorm.DB) error {
+		current := &Token{}
+		err := tx.Unscoped().
+			Where("token = ? AND app = ? AND transmission_rsa_hash = ?", old, updated.App, updated.TransmissionRSAHash).
+			Take(current).Error
+		if err != nil {
+			return errors.WithMessage(err, "Failed to get token")
+		}
+		current.Token, current.SealedToken = updated.Token, updated.SealedToken
+		err = tx.Create(current).Error
+		if err != nil {
+			return errors.WithMessage(err, "Failed to insert token")
+		}
+		err = tx.Unscoped().Model(&Token{}).Where("fallback = ?", old).Update("fallback", updated.Token).Error
+		if err != nil {
+			return errors.WithMessage(err, "Failed to move fallback links")
+		}
+		err = tx.Model(&DeliveryLog{}).Where("token = ? AND app = ?", old, updated.App).
+			Update("token", updated.Token).Error
+		if err != nil {
+			return errors.WithMessage(err, "Failed to move delivery logs")
+		}
+		err = tx.Model(&DeadLetter{}).Where("token = ? AND app = ?", old, updated.App).
+			Update("token", updated.Token).Error
+		if err != nil {
+			return errors.WithMessage(err, "Failed to move dead letters")
+		}
+		return tx.Unscoped().Delete(&Token{}, "token = ? AND app = ? AND transmission_rsa_hash = ?",
+			old, updated.App, updated.TransmissionRSAHash).Error
+	})
+}
+
+// updateTransmissionRSA replaces the stored transmission RSA key of the user.
+func (d *DatabaseImpl) updateTransmissionRSA(user *User) error {
+	return d.db.Model(&User{}).Where("transmission_rsa_hash = ?", user.TransmissionRSAHash).
+		Update("transmission_rsa", user.TransmissionRSA).Error
+}
+
+// markLegacyV0User flags the user with the passed in transmission RSA hash as
+// migrated from the original schema.
+func (d *DatabaseImpl) markLegacyV0User(transmissionRSAHash []byte) error {
+	return d.db.Model(&User{}).Where("transmission_rsa_hash = ?", transmissionRSAHash).
+		Update("legacy_v0", true).Error
+}
+
+// getLegacyUsers returns up to limit rows of the legacy user table. No rows are
+// returned if the table does not exist.
+func (d *DatabaseImpl) getLegacyUsers(table string, limit int) ([]*UserV1, error) {
+	if !d.db.Migrator().HasTable(table) {
+		return nil, nil
+	}
+	var result []*UserV1
+	err := d.db.Table(table).Order("transmission_rsa_hash").Limit(limit).Find(&result).Error
+	return result, err
+}
+
+// deleteLegacyUser removes a row from the legacy user table.
+func (d *DatabaseImpl) deleteLegacyUser(table string, transmissionRsaHash []byte) error {
+	return d.db.Table(table).Where("transmission_rsa_hash = ?", transmissionRsaHash).Delete(&UserV1{}).Error
+}
+
+// getLegacyV0Users returns up to limit rows of the original user table with
+// IDs after the passed in one, in order. No rows are returned if the table
+// does not exist.
+func (d *DatabaseImpl) getLegacyV0Users(table, after string, limit int) ([]*UserV0, error) {
+	if !d.db.Migrator().HasTable(table) {
+		return nil, nil
+	}
+	var result []*UserV0
+	err := d.db.Table(table).Where("id > ?", after).Order("id").Limit(limit).Find(&result).Error
+	return result, err
+}
+
+// deleteLegacyV0User removes a row from the original user table.
+func (d *DatabaseImpl) deleteLegacyV0User(table, id string) error {
+	return d.db.Table(table).Where("id = ?", id).Delete(&UserV0{}).Error
+}
+
+// upsertToken adds a token to storage in a single statement. If the token is
+// already registered for the app by the same owner, its version is
+// incremented. The stored version is written back to the passed in token.
+func (d *DatabaseImpl) upsertToken(token *Token) error {
+	return d.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "token"}, {Name: "app"}, {Name: "transmission_rsa_hash"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"version":    gorm.Expr("tokens.version + 1"),
+			"standby":    token.Standby,
+			"deleted_at": nil,
+		}),
+	}, clause.Returning{Columns: []clause.Column{{Name: "version"}}}).Create(token).Error
+}
+
+// moveToken hard deletes the registrations of the passed in token for its app
+// held by other users, including unregistered ones, so the token is only
+// registered to its owner. It returns the transmission RSA hashes of the users
+// whose live registration was removed.
+func (d *DatabaseImpl) moveToken(token *Token) ([][]byte, error) {
+	var previous [][]byte
+	err := d.inTransaction(func(tx *gorm.DB) error {
+		others := tx.Unscoped().Model(&Token{}).
+			Where("token = ? AND app = ? AND transmission_rsa_hash <> ?", token.Token, token.App, token.TransmissionRSAHash)
+		err := others.Session(&gorm.Session{}).Where("deleted_at IS NULL").
+			Pluck("transmission_rsa_hash", &previous).Error
+		if err != nil {
+			return errors.WithMessage(err, "Failed to look up previous owners")
+		}
+		return others.Session(&gorm.Session{}).Delete(&Token{}).Error
+	})
+	return previous, err
+}
+
+// removeLegacyV0Token hard deletes the registrations of the passed in token,
+// for any app, held by users migrated from the original schema. It returns the
+// transmission RSA hashes of the users whose live registration was removed.
+func (d *DatabaseImpl) removeLegacyV0Token(token *Token) ([][]byte, error) {
+	var previous [][]byte
+	err := d.inTransaction(func(tx *gorm.DB) error {
+		legacy := tx.Model(&User{}).Select("transmission_rsa_hash").Where("legacy_v0 = ?", true)
+		v0 := tx.Unscoped().Model(&Token{}).
+			Where("token = ? AND transmission_rsa_hash <> ? AND transmission_rsa_hash IN (?)",
+				token.Token, token.TransmissionRSAHash, legacy)
+		err := v0.Session(&gorm.Session{}).Where("deleted_at IS NULL").
+			Pluck("transmission_rsa_hash", &previous).Error
+		if err != nil {
+			return errors.WithMessage(err, "Failed to look up legacy owners")
+		}
+		return v0.Session(&gorm.Session{}).Delete(&Token{}).Error
+	})
+	return previous, err
+}
+
+// SetTokenPriority sets the priority tier of the owner's registration of a
+// token for app. It returns gorm.ErrRecordNotFound if the token is not
+// registered.
+func (d *DatabaseImpl) SetTokenPriority(token, app string, owner []byte, priority string) error {
+	res := d.db.Model(&Token{}).Where("token = ? AND app = ? AND transmission_rsa_hash = ?", token, app, owner).Update("priority", priority)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errNotRegistered
+	}
+	return nil
+}
+
+// SetTokenSound sets the notification channel and sound of the owner's
+// registration of a token for app, overriding the defaults of the app. It
+// returns gorm.ErrRecordNotFound if the token is not registered.
+func (d *DatabaseImpl) SetTokenSound(token, app string, owner []byte, channelID, sound string) error {
+	res := d.db.Model(&Token{}).Where("token = ? AND app = ? AND transmission_rsa_hash = ?", token, app, owner).Updates(map[string]interface{}{
+		"channel_id": channelID,
+		"sound":      sound,
+	})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errNotRegistered
+	}
+	return nil
+}
+
+// SetTokenLocale sets the locale of the owner's registration of a token for
+// app. It returns gorm.ErrRecordNotFound if the token is not registered.
+func (d *DatabaseImpl) SetTokenLocale(token, app string, owner []byte, locale string) error {
+	res := d.db.Model(&Token{}).Where("token = ? AND app = ? AND transmission_rsa_hash = ?", token, app, owner).Update("locale", locale)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errNotRegistered
+	}
+	return nil
+}
+
+// SetTokenPrivacy sets the privacy level of the owner's registration of a
+// token for app. It returns gorm.ErrRecordNotFound if the token is not
+// registered.
+func (d *DatabaseImpl) SetTokenPrivacy(token, app string, owner []byte, privacy string) error {
+	res := d.db.Model(&Token{}).Where("token = ? AND app = ? AND transmission_rsa_hash = ?", token, app, owner).Update("privacy", privacy)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errNotRegistered
+	}
+	return nil
+}
+
+// SetTokenProvenance records the platform and versions the owner's
+// registration of a token for app was last made from. It returns
+// gorm.ErrRecordNotFound if the token is not registered.
+func (d *DatabaseImpl) SetTokenProvenance(token, app string, owner []byte, provenance TokenProvenance) error {
+	res := d.db.Model(&Token{}).Where("token = ? AND app = ? AND transmission_rsa_hash = ?", token, app, owner).Updates(map[string]interface{}{
+		"platform":    provenance.Platform,
+		"app_version": provenance.AppVersion,
+		"sdk_version": provenance.SDKVersion,
+	})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errNotRegistered
+	}
+	return nil
+}
+
+// RestoreToken clears the tombstone of the owner's unregistered registration of
+// a token for app so it is pushed to again. It returns gorm.ErrRecordNotFound
+// if there is no such deleted registration.
+func (d *DatabaseImpl) RestoreToken(token, app string, owner []byte) error {
+	res := d.db.Unscoped().Model(&Token{}).Where("token = ? AND app = ? AND transmission_rsa_hash = ?", token, app, owner).Where("deleted_at IS NOT NULL").
+		Update("deleted_at", nil)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// PurgeDeletedTokens hard deletes tokens which were deleted before the passed
+// in time, returning the number removed.
+func (d *DatabaseImpl) PurgeDeletedTokens(before time.Time) (int64, error) {
+	res := d.db.Unscoped().Where("deleted_at < ?", before).Delete(&Token{})
+	return res.RowsAffected, res.Error
+}
+
+// GetToken retrieves a token registered for app from storage. If several users
+// registered the token for app, any one of their registrations is returned.
+func (d *DatabaseImpl) GetToken(token, app string) (*Token, error) {
+	t := &Token{}
+	err := d.db.Take(t, "token = ? AND app = ?", token, app).Error
+	if err != nil {
+		return nil, notRegistered(err)
+	}
+	return t, nil
+}
+
+// GetOwnedToken retrieves the registration of a token for app made by the user
+// with the passed in transmission RSA hash.
+func (d *DatabaseImpl) GetOwnedToken(token, app string, owner []byte) (*Token, error) {
+	t := &Token{}
+	err := d.db.Take(t, "token = ? AND app = ? AND transmission_rsa_hash = ?", token, app, owner).Error
+	if err != nil {
+		return nil, notRegistered(err)
+	}
+	return t, nil
+}
+
+// CountActiveTokens returns the number of distinct tokens registered for app
+// which are not on standby.
+func (d *DatabaseImpl) CountActiveTokens(app string) (int64, error) {
+	var count int64
+	err := d.db.Model(&Token{}).Where("app = ? AND standby = ?", app, false).
+		Where("transmission_rsa_hash NOT IN (?)", d.db.Model(&BlockedUser{}).Select("transmission_rsa_hash")).
+		Where("transmission_rsa_hash NOT IN (?)", quarantinedUsers(d.db)).
+		Distinct("token").Count(&count).Error
+	return count, err
+}
+
+// IterateActiveTokens calls fn with successive batches of at most batchSize
+// tokens registered for app which are not on standby, using keyset pagination
+// on the token and owner. A token registered by several users is only passed
+// to fn once. It stops at the first error returned by fn.
+func (d *DatabaseImpl) IterateActiveTokens(app string, batchSize int, fn func([]*Token) error) error {
+	last := &Token{}
+	for {
+		var rows []*Token
+		err := d.db.Where("app = ? AND standby = ?", app, false).
+			Where("token > ? OR (token = ? AND transmission_rsa_hash > ?)", last.Token, last.Token, last.TransmissionRSAHash).
+			Where("transmission_rsa_hash NOT IN (?)", d.db.Model(&BlockedUser{}).Select("transmission_rsa_hash")).
+			Where("transmission_rsa_hash NOT IN (?)", quarantinedUsers(d.db)).
+			Order("token, transmission_rsa_hash").Limit(batchSize).Find(&rows).Error
+		if err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+		batch := make([]*Token, 0, len(rows))
+		for _, t := range rows {
+			if t.Token != last.Token {
+				batch = append(batch, t)
+			}
+			last = t
+		}
+		if len(batch) == 0 {
+			continue
+		}
+		if err = fn(batch); err != nil {
+			return err
+		}
+	}
+}
+
+// CountAppTokens returns the number of tokens registered for app, including
+// standby tokens.
+func (d *DatabaseImpl) CountAppTokens(app string) (int64, error) {
+	var count int64
+	err := d.read(func(db *gorm.DB) error {
+		return db.Model(&Token{}).Where("app = ?", app).Count(&count).Error
+	})
+	return count, err
+}
+
+// PurgeAppTokens hard deletes every token of app, including unregistered ones
+// which could otherwise be restored, returning the number of registered tokens
+// removed. Notifications held for their digests are dropped and other tokens
+// no longer fail over to them.
+func (d *DatabaseImpl) PurgeAppTokens(app string) (int64, error) {
+	var count int64
+	err := d.inTransaction(func(tx *gorm.DB) error {
+		appTokens := tx.Unscoped().Model(&Token{}).Select("token").Where("app = ?", app)
+		err := tx.Model(&Token{}).Where("app = ? AND fallback IN (?)", app, appTokens).Update("fallback", "").Error
+		if err != nil {
+			return errors.WithMessage(err, "Failed to unlink fallback tokens")
+		}
+		err = tx.Where("app = ?", app).Delete(&DigestEntry{}).Error
+		if err != nil {
+			return errors.WithMessage(err, "Failed to delete digest entries")
+		}
+		err = tx.Model(&Token{}).Where("app = ?", app).Count(&count).Error
+		if err != nil {
+			return errors.WithMessage(err, "Failed to count tokens")
+		}
+		return tx.Unscoped().Where("app = ?", app).Delete(&Token{}).Error
+	})
+	return count, err
+}
+
+// linkFallbackToken sets fallback as the token to fail over to from primary in
+// every app primary is registered to the owner for. It returns
+// gorm.ErrRecordNotFound if primary is not registered to the owner.
+func (d *DatabaseImpl) linkFallbackToken(primary, fallback string, owner []byte) error {
+	res := d.db.Model(&Token{}).Where("token = ? AND transmission_rsa_hash = ? AND standby = ?", primary, owner, false).
+		Update("fallback", fallback)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errNotRegistered
+	}
+	return nil
+}
+
+// promoteFallbackToken deletes primary from the owner's registrations for app
+// and takes fallback, which may be registered for another app of the same
+// owner, out of standby so it receives pushes in its place. It returns the
+// promoted token.
+func (d *DatabaseImpl) promoteFallbackToken(primary, app, fallback string, owner []byte) (*Token, error) {
+	promoted := &Token{}
+	err := d.inTransaction(func(tx *gorm.DB) error {
+		p := &Token{}
+		err := tx.Take(p, "token = ? AND app = ? AND transmission_rsa_hash = ?", primary, app, owner).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Delete(p).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Order("app").Take(promoted, "token = ? AND transmission_rsa_hash = ?", fallback, p.TransmissionRSAHash).Error
+		if err != nil {
+			return err
+		}
+		promoted.Standby = false
+		return tx.Model(promoted).Update("standby", false).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return promoted, nil
 }
 
 // registerTrackedIdentity links an Identity to a User.
@@ -307,7 +998,7 @@ func (d *DatabaseImpl) registerTrackedIdentity(user User, identity Identity) err
 }
 
 func (d *DatabaseImpl) registerTrackedIdentities(user User, ids []Identity) error {
-	return d.db.Transaction(func(tx *gorm.DB) error {
+	return d.inTransaction(func(tx *gorm.DB) error {
 		for _, iid := range ids {
 			err := tx.Model(&user).Association("Identities").Append(&iid)
 			if err != nil {
@@ -318,3 +1009,835 @@ func (d *DatabaseImpl) registerTrackedIdentities(user User, ids []Identity) erro
 		return nil
 	})
 }
+
+// InsertDeliveryLogs adds a list of delivery log entries to storage.
+func (d *DatabaseImpl) InsertDeliveryLogs(logs []*DeliveryLog) error {
+	if len(logs) == 0 {
+		return nil
+	}
+	return d.db.Create(&logs).Error
+}
+
+// GetDeliveryLogs returns all delivery log entries for the user with the
+// passed in transmission RSA hash, most recent first.
+func (d *DatabaseImpl) GetDeliveryLogs(transmissionRsaHash []byte) ([]*DeliveryLog, error) {
+	var result []*DeliveryLog
+	err := d.read(func(db *gorm.DB) error {
+		return db.Where("transmission_rsa_hash = ?", transmissionRsaHash).Order("timestamp desc").Find(&result).Error
+	})
+	return result, err
+}
+
+// RollupDeliveryLogs aggregates the delivery logs of the day starting at the
+// passed in midnight UTC into a DeliveryRollup per app, replacing any earlier
+// rollup of the day. A send covering several rounds is logged once per round
+// but counted once.
+func (d *DatabaseImpl) RollupDeliveryLogs(day time.Time) error {
+	start, end := day, day.Add(24*time.Hour)
+	var sends []struct {
+		App    string
+		Status int
+		Failed bool
+		Count  int64
+	}
+	err := d.db.Raw("SELECT app, status, failed, COUNT(*) AS count FROM "+
+		"(SELECT DISTINCT app, token, timestamp, status, error <> '' AS failed FROM delivery_logs "+
+		"WHERE timestamp >= ? AND timestamp < ?) AS sends GROUP BY app, status, failed", start, end).
+		Scan(&sends).Error
+	if err != nil {
+		return errors.WithMessage(err, "Failed to count sends")
+	}
+	var users []struct {
+		App   string
+		Count int64
+	}
+	err = d.db.Model(&DeliveryLog{}).Select("app, COUNT(DISTINCT transmission_rsa_hash) AS count").
+		Where("timestamp >= ? AND timestamp < ? AND error = ''", start, end).Group("app").Scan(&users).Error
+	if err != nil {
+		return errors.WithMessage(err, "Failed to count users")
+	}
+
+	now := time.Now()
+	rollups := map[string]*DeliveryRollup{}
+	rollup := func(app string) *DeliveryRollup {
+		r, ok := rollups[app]
+		if !ok {
+			r = &DeliveryRollup{Day: day, App: app, FailedByReason: map[string]int64{}, UpdatedAt: now}
+			rollups[app] = r
+		}
+		return r
+	}
+	for _, s := range sends {
+		r := rollup(s.App)
+		if !s.Failed {
+			r.Sent += s.Count
+			continue
+		}
+		reason := "error"
+		if s.Status != 0 {
+			reason = strconv.Itoa(s.Status)
+		}
+		r.Failed += s.Count
+		r.FailedByReason[reason] += s.Count
+	}
+	for _, u := range users {
+		rollup(u.App).UniqueIdentities = u.Count
+	}
+	if len(rollups) == 0 {
+		return nil
+	}
+	result := make([]*DeliveryRollup, 0, len(rollups))
+	for _, r := range rollups {
+		result = append(result, r)
+	}
+	return d.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&result).Error
+}
+
+// GetDeliveryRollups returns the delivery rollups of the days from from up to
+// and including to, for all apps if app is empty, ordered by day and app.
+func (d *DatabaseImpl) GetDeliveryRollups(from, to time.Time, app string) ([]*DeliveryRollup, error) {
+	var result []*DeliveryRollup
+	err := d.read(func(db *gorm.DB) error {
+		tx := db.Where("day >= ? AND day <= ?", from, to)
+		if app != "" {
+			tx = tx.Where("app = ?", app)
+		}
+		return tx.Order("day asc, app asc").Find(&result).Error
+	})
+	return result, err
+}
+
+// DeleteDeliveryLogs deletes all delivery log entries recorded before the passed in time.
+func (d *DatabaseImpl) DeleteDeliveryLogs(before time.Time) error {
+	return d.db.Where("timestamp < ?", before).Delete(&DeliveryLog{}).Error
+}
+
+// InsertPushEvent adds a push event to storage, removing the oldest events of
+// its user beyond the most recent keep.
+func (d *DatabaseImpl) InsertPushEvent(e *PushEvent, keep int) error {
+	return d.inTransaction(func(tx *gorm.DB) error {
+		err := tx.Create(e).Error
+		if err != nil {
+			return err
+		}
+		var oldest PushEvent
+		err = tx.Where("transmission_rsa_hash = ?", e.TransmissionRSAHash).
+			Order("id desc").Offset(keep).Take(&oldest).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return tx.Where("transmission_rsa_hash = ? AND id <= ?", e.TransmissionRSAHash, oldest.ID).
+			Delete(&PushEvent{}).Error
+	})
+}
+
+// GetPushHistory returns the push events kept for the user with the passed in
+// transmission RSA hash, most recent first.
+func (d *DatabaseImpl) GetPushHistory(transmissionRsaHash []byte) ([]*PushEvent, error) {
+	var result []*PushEvent
+	err := d.read(func(db *gorm.DB) error {
+		return db.Where("transmission_rsa_hash = ?", transmissionRsaHash).Order("id desc").Find(&result).Error
+	})
+	return result, err
+}
+
+// DeletePushEvents deletes all push events recorded before the passed in time.
+func (d *DatabaseImpl) DeletePushEvents(before time.Time) error {
+	return d.db.Where("timestamp < ?", before).Delete(&PushEvent{}).Error
+}
+
+// TakePushQuota counts a push on the passed in day to each of the user's
+// identities which has pushes left in the daily limit of app. It returns the
+// identities which had none left and were not counted.
+func (d *DatabaseImpl) TakePushQuota(day time.Time, app string, transmissionRsaHash []byte,
+	iids [][]byte, limit int64) ([][]byte, error) {
+	var exhausted [][]byte
+	err := d.inTransaction(func(tx *gorm.DB) error {
+		exhausted = nil
+		var counts []*PushCount
+		err := tx.Where("day = ? AND app = ? AND transmission_rsa_hash = ? AND intermediary_id IN ?",
+			day, app, transmissionRsaHash, iids).Find(&counts).Error
+		if err != nil {
+			return err
+		}
+		used := make(map[string]int64, len(counts))
+		for _, c := range counts {
+			used[string(c.IntermediaryId)] = c.Count
+		}
+
+		var taken []*PushCount
+		for _, iid := range iids {
+			if used[string(iid)] >= limit {
+				exhausted = append(exhausted, iid)
+				continue
+			}
+			taken = append(taken, &PushCount{Day: day, App: app,
+				TransmissionRSAHash: transmissionRsaHash, IntermediaryId: iid, Count: 1})
+		}
+		if len(taken) == 0 {
+			return nil
+		}
+		return tx.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "day"}, {Name: "app"},
+				{Name: "transmission_rsa_hash"}, {Name: "intermediary_id"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{
+				"count": gorm.Expr("push_counts.count + 1"),
+			}),
+		}).Create(&taken).Error
+	})
+	return exhausted, err
+}
+
+// DeletePushCounts deletes the push counts of days before the passed in time.
+func (d *DatabaseImpl) DeletePushCounts(before time.Time) error {
+	return d.db.Where("day < ?", before).Delete(&PushCount{}).Error
+}
+
+// upsertCanary adds a canary to storage, replacing the app of an existing one.
+func (d *DatabaseImpl) upsertCanary(c *Canary) error {
+	return d.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "token"}},
+		DoUpdates: clause.AssignmentColumns([]string{"sealed_token", "app"}),
+	}).Create(c).Error
+}
+
+// GetCanaries returns all canaries in storage, oldest first.
+func (d *DatabaseImpl) GetCanaries() ([]*Canary, error) {
+	var result []*Canary
+	return result, d.db.Order("created_at asc").Find(&result).Error
+}
+
+// DeleteCanary removes the canary with the passed in token from storage. It
+// returns gorm.ErrRecordNotFound if there is no such canary.
+func (d *DatabaseImpl) DeleteCanary(token string) error {
+	res := d.db.Delete(&Canary{}, "token = ?", token)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// UpsertGatewayWatermark records that a batch for round was accepted from the
+// gateway at the passed in time, counting it towards the gateway's batches.
+func (d *DatabaseImpl) UpsertGatewayWatermark(gatewayID string, round uint64, received time.Time) error {
+	return d.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "gateway_id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"last_round":  round,
+			"received_at": received,
+			"batches":     gorm.Expr("gateway_watermarks.batches + 1"),
+		}),
+	}).Create(&GatewayWatermark{GatewayID: gatewayID, LastRound: round, Batches: 1, ReceivedAt: received}).Error
+}
+
+// GetGatewayWatermarks returns the watermark of every gateway a batch has
+// been accepted from, ordered by gateway ID.
+func (d *DatabaseImpl) GetGatewayWatermarks() ([]*GatewayWatermark, error) {
+	var result []*GatewayWatermark
+	err := d.read(func(db *gorm.DB) error {
+		return db.Order("gateway_id asc").Find(&result).Error
+	})
+	return result, err
+}
+
+// DeleteGatewayWatermark removes the watermark of the gateway with the passed
+// in ID, if there is one.
+func (d *DatabaseImpl) DeleteGatewayWatermark(gatewayID string) error {
+	return d.db.Delete(&GatewayWatermark{}, "gateway_id = ?", gatewayID).Error
+}
+
+// InsertBatchKey records the idempotency key of a batch for round from the
+// gateway, returning false if the key was already recorded.
+func (d *DatabaseImpl) InsertBatchKey(gatewayID string, round uint64, received time.Time) (bool, error) {
+	result := d.db.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&BatchKey{GatewayID: gatewayID, RoundId: round, Timestamp: received})
+	return result.RowsAffected > 0, result.Error
+}
+
+// DeleteBatchKey removes the idempotency key of a batch, so it is processed
+// if the gateway resends it.
+func (d *DatabaseImpl) DeleteBatchKey(gatewayID string, round uint64) error {
+	return d.db.Where("gateway_id = ? AND round_id = ?", gatewayID, round).Delete(&BatchKey{}).Error
+}
+
+// DeleteBatchKeys removes the idempotency keys of batches received before the
+// passed in time.
+func (d *DatabaseImpl) DeleteBatchKeys(before time.Time) error {
+	return d.db.Where("timestamp < ?", before).Delete(&BatchKey{}).Error
+}
+
+// AcquireLease takes or renews the named lease for holder until ttl after now,
+// returning false if another holder has it and it has not expired.
+func (d *DatabaseImpl) AcquireLease(name, holder string, now time.Time, ttl time.Duration) (bool, error) {
+	result := d.db.Model(&Lease{}).Where("name = ? AND (holder = ? OR expires < ?)", name, holder, now).
+		Updates(map[string]interface{}{"holder": holder, "expires": now.Add(ttl)})
+	if result.Error != nil || result.RowsAffected > 0 {
+		return result.RowsAffected > 0, result.Error
+	}
+	// Nobody has held the lease yet; of several instances creating it at
+	// once only one succeeds
+	result = d.db.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&Lease{Name: name, Holder: holder, Expires: now.Add(ttl)})
+	return result.RowsAffected > 0, result.Error
+}
+
+// ReleaseLease gives up the named lease if it is held by holder, so another
+// instance can take it without waiting for it to expire.
+func (d *DatabaseImpl) ReleaseLease(name, holder string) error {
+	return d.db.Where("name = ? AND holder = ?", name, holder).Delete(&Lease{}).Error
+}
+
+// MarkUserNotified records that the user was sent a visible push since they
+// last opened the app.
+func (d *DatabaseImpl) MarkUserNotified(transmissionRsaHash []byte) error {
+	return d.db.Model(&User{}).Where("transmission_rsa_hash = ? AND notified_since_open = ?", transmissionRsaHash, false).
+		Update("notified_since_open", true).Error
+}
+
+// MarkAppOpened records that the user opened the app, so their next push is
+// visible. It returns gorm.ErrRecordNotFound if the user is not registered.
+func (d *DatabaseImpl) MarkAppOpened(transmissionRsaHash []byte) error {
+	res := d.db.Model(&User{}).Where("transmission_rsa_hash = ?", transmissionRsaHash).
+		Update("notified_since_open", false)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errNotRegistered
+	}
+	return nil
+}
+
+// SetUserDigest turns digest mode on or off for the user. It returns
+// gorm.ErrRecordNotFound if the user is not registered.
+func (d *DatabaseImpl) SetUserDigest(transmissionRsaHash []byte, enabled bool) error {
+	res := d.db.Model(&User{}).Where("transmission_rsa_hash = ?", transmissionRsaHash).
+		Update("digest", enabled)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errNotRegistered
+	}
+	return nil
+}
+
+// SetUserMutedConversations sets the comma separated list of conversations
+// the user is not pushed for. It returns gorm.ErrRecordNotFound if the user is
+// not registered.
+func (d *DatabaseImpl) SetUserMutedConversations(transmissionRsaHash []byte, muted string) error {
+	res := d.db.Model(&User{}).Where("transmission_rsa_hash = ?", transmissionRsaHash).
+		Update("muted_conversations", muted)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errNotRegistered
+	}
+	return nil
+}
+
+// SetUserRegistrar records the registrar signature the user's registration
+// was last accepted with and lifts any quarantine, as it verified. It returns
+// gorm.ErrRecordNotFound if the user is not registered.
+func (d *DatabaseImpl) SetUserRegistrar(transmissionRsaHash []byte, timestamp int64, sig []byte) error {
+	res := d.db.Model(&User{}).Where("transmission_rsa_hash = ?", transmissionRsaHash).
+		Updates(map[string]interface{}{
+			"registration_timestamp": timestamp,
+			"registrar_sig":          sig,
+			"quarantined":            false,
+		})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errNotRegistered
+	}
+	return nil
+}
+
+// SetUserQuarantined quarantines the user, so they are not pushed to, or
+// lifts their quarantine. It returns gorm.ErrRecordNotFound if the user is not
+// registered.
+func (d *DatabaseImpl) SetUserQuarantined(transmissionRsaHash []byte, quarantined bool) error {
+	res := d.db.Model(&User{}).Where("transmission_rsa_hash = ?", transmissionRsaHash).
+		Update("quarantined", quarantined)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errNotRegistered
+	}
+	return nil
+}
+
+// quarantinedUsers selects the transmission RSA hashes of quarantined users.
+func quarantinedUsers(db *gorm.DB) *gorm.DB {
+	return db.Model(&User{}).Select("transmission_rsa_hash").Where("quarantined = ?", true)
+}
+
+// CountQuarantinedUsers returns the number of quarantined users.
+func (d *DatabaseImpl) CountQuarantinedUsers() (int64, error) {
+	var count int64
+	err := d.read(func(db *gorm.DB) error {
+		return db.Model(&User{}).Where("quarantined = ?", true).Count(&count).Error
+	})
+	return count, err
+}
+
+// AddToDigest holds notifications for the entry's registration until the next
+// summary push, adding to the count already held and refreshing the target.
+func (d *DatabaseImpl) AddToDigest(entry *DigestEntry) error {
+	return d.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "token"}, {Name: "app"}, {Name: "transmission_rsa_hash"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"target": gorm.Expr("excluded.target"),
+			"count":  gorm.Expr("digest_entries.count + excluded.count"),
+		}),
+	}).Create(entry).Error
+}
+
+// TakeDigests removes and returns every held digest entry.
+func (d *DatabaseImpl) TakeDigests() ([]*DigestEntry, error) {
+	var entries []*DigestEntry
+	err := d.inTransaction(func(tx *gorm.DB) error {
+		err := tx.Order("held_since").Find(&entries).Error
+		if err != nil || len(entries) == 0 {
+			return err
+		}
+		for _, e := range entries {
+			err = tx.Where("token = ? AND app = ? AND transmission_rsa_hash = ?",
+				e.Token, e.App, e.TransmissionRsaHash).Delete(&DigestEntry{}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// BlockUser adds the user to the blocklist, replacing the reason if they are
+// already blocked.
+func (d *DatabaseImpl) BlockUser(b *BlockedUser) error {
+	return d.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "transmission_rsa_hash"}},
+		DoUpdates: clause.AssignmentColumns([]string{"reason"}),
+	}).Create(b).Error
+}
+
+// UnblockUser removes the user from the blocklist. It returns
+// gorm.ErrRecordNotFound if the user is not blocked.
+func (d *DatabaseImpl) UnblockUser(transmissionRsaHash []byte) error {
+	res := d.db.Delete(&BlockedUser{}, "transmission_rsa_hash = ?", transmissionRsaHash)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// IsUserBlocked returns true if the user is on the blocklist.
+func (d *DatabaseImpl) IsUserBlocked(transmissionRsaHash []byte) (bool, error) {
+	var count int64
+	err := d.db.Model(&BlockedUser{}).Where("transmission_rsa_hash = ?", transmissionRsaHash).Count(&count).Error
+	return count > 0, err
+}
+
+// GetBlockedUsers returns the blocklist, oldest entries first.
+func (d *DatabaseImpl) GetBlockedUsers() ([]*BlockedUser, error) {
+	var result []*BlockedUser
+	err := d.read(func(db *gorm.DB) error {
+		return db.Order("created_at").Find(&result).Error
+	})
+	return result, err
+}
+
+// UpsertFeatureFlag stores the feature flag, replacing its percentage if it is
+// already set.
+func (d *DatabaseImpl) UpsertFeatureFlag(f *FeatureFlag) error {
+	return d.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"percent", "updated_at"}),
+	}).Create(f).Error
+}
+
+// DeleteFeatureFlag removes the feature flag with the passed in name. It
+// returns gorm.ErrRecordNotFound if the flag is not set.
+func (d *DatabaseImpl) DeleteFeatureFlag(name string) error {
+	res := d.db.Delete(&FeatureFlag{}, "name = ?", name)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// GetFeatureFlags returns every feature flag set, ordered by name.
+func (d *DatabaseImpl) GetFeatureFlags() ([]*FeatureFlag, error) {
+	var result []*FeatureFlag
+	err := d.read(func(db *gorm.DB) error {
+		return db.Order("name").Find(&result).Error
+	})
+	return result, err
+}
+
+// InsertDeadLetter adds a dead letter to storage.
+func (d *DatabaseImpl) InsertDeadLetter(dl *DeadLetter) error {
+	return d.db.Create(dl).Error
+}
+
+// GetDeadLetter retrieves the dead letter with the passed in ID from storage.
+func (d *DatabaseImpl) GetDeadLetter(id uint) (*DeadLetter, error) {
+	dl := &DeadLetter{}
+	err := d.db.Take(dl, "id = ?", id).Error
+	if err != nil {
+		return nil, err
+	}
+	return dl, nil
+}
+
+// GetDeadLetters returns all dead letters in storage, oldest first.
+func (d *DatabaseImpl) GetDeadLetters() ([]*DeadLetter, error) {
+	var result []*DeadLetter
+	err := d.read(func(db *gorm.DB) error {
+		return db.Order("timestamp asc").Find(&result).Error
+	})
+	return result, err
+}
+
+// DeleteDeadLetter removes the dead letter with the passed in ID from storage.
+func (d *DatabaseImpl) DeleteDeadLetter(id uint) error {
+	return d.db.Delete(&DeadLetter{}, id).Error
+}
+
+// DeleteAllDeadLetters removes every dead letter from storage.
+func (d *DatabaseImpl) DeleteAllDeadLetters() error {
+	return d.db.Where("1 = 1").Delete(&DeadLetter{}).Error
+}
+
+// InsertQueuedNotifications adds a list of queued notifications to storage.
+func (d *DatabaseImpl) InsertQueuedNotifications(queued []*QueuedNotification) error {
+	if len(queued) == 0 {
+		return nil
+	}
+	return d.db.Create(&queued).Error
+}
+
+// GetQueuedRounds returns up to limit distinct round IDs with queued
+// notifications, in ascending order.
+func (d *DatabaseImpl) GetQueuedRounds(limit int) ([]uint64, error) {
+	var rounds []uint64
+	err := d.db.Model(&QueuedNotification{}).Distinct("round_id").Order("round_id asc").
+		Limit(limit).Pluck("round_id", &rounds).Error
+	return rounds, err
+}
+
+// GetQueuedNotifications returns all queued notifications for the passed in
+// rounds, in the order they were queued.
+func (d *DatabaseImpl) GetQueuedNotifications(rounds []uint64) ([]*QueuedNotification, error) {
+	var result []*QueuedNotification
+	err := d.db.Where("round_id in ?", rounds).Order("id asc").Find(&result).Error
+	return result, err
+}
+
+// DeleteQueuedNotifications removes all queued notifications for the passed in
+// rounds from storage.
+func (d *DatabaseImpl) DeleteQueuedNotifications(rounds []uint64) error {
+	return d.db.Where("round_id in ?", rounds).Delete(&QueuedNotification{}).Error
+}
+
+// CountQueuedNotifications returns the number of queued notifications.
+func (d *DatabaseImpl) CountQueuedNotifications() (int64, error) {
+	var count int64
+	err := d.db.Model(&QueuedNotification{}).Count(&count).Error
+	return count, err
+}
+
+// insertOutboxEntries adds the passed in entries to the outbox.
+func (d *DatabaseImpl) insertOutboxEntries(entries []*OutboxEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	return d.db.Create(entries).Error
+}
+
+// ClaimOutboxEntries claims up to limit outbox entries which are not claimed
+// as of now, oldest first, so they are not dispatched again until lease has
+// passed. Each entry is claimed with a conditional update, so concurrent
+// dispatchers never claim the same entry.
+func (d *DatabaseImpl) ClaimOutboxEntries(limit int, now time.Time, lease time.Duration) ([]*OutboxEntry, error) {
+	now = outboxTime(now)
+	var candidates []*OutboxEntry
+	err := d.db.Where("claimed_until <= ?", now).Order("id").Limit(limit).Find(&candidates).Error
+	if err != nil {
+		return nil, err
+	}
+
+	claimed := make([]*OutboxEntry, 0, len(candidates))
+	for _, e := range candidates {
+		res := d.db.Model(&OutboxEntry{}).Where("id = ? AND claimed_until = ?", e.ID, e.ClaimedUntil).
+			Update("claimed_until", now.Add(lease))
+		if res.Error != nil {
+			return claimed, res.Error
+		}
+		if res.RowsAffected == 1 {
+			e.ClaimedUntil = now.Add(lease)
+			claimed = append(claimed, e)
+		}
+	}
+	return claimed, nil
+}
+
+// outboxTime normalizes times stored in the outbox, so that they compare the
+// same way on every backend.
+func outboxTime(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Microsecond)
+}
+
+// DeleteOutboxEntry removes the outbox entry with the passed in ID.
+func (d *DatabaseImpl) DeleteOutboxEntry(id uint) error {
+	return d.db.Delete(&OutboxEntry{}, id).Error
+}
+
+// markRoundsProcessed records the passed in rounds as processed.
+func (d *DatabaseImpl) markRoundsProcessed(rounds []uint64, now time.Time) error {
+	if len(rounds) == 0 {
+		return nil
+	}
+	processed := make([]*ProcessedRound, 0, len(rounds))
+	for _, rid := range rounds {
+		processed = append(processed, &ProcessedRound{RoundId: rid, Timestamp: now})
+	}
+	return d.db.Clauses(clause.OnConflict{DoNothing: true}).Create(processed).Error
+}
+
+// IsRoundProcessed returns true if the round has been recorded as processed.
+func (d *DatabaseImpl) IsRoundProcessed(roundId uint64) (bool, error) {
+	var count int64
+	err := d.db.Model(&ProcessedRound{}).Where("round_id = ?", roundId).Count(&count).Error
+	return count > 0, err
+}
+
+// DeleteProcessedRounds removes processed round records from before the
+// passed in time.
+func (d *DatabaseImpl) DeleteProcessedRounds(before time.Time) error {
+	return d.db.Where("timestamp < ?", before).Delete(&ProcessedRound{}).Error
+}
+
+// CheckSchema returns an error listing where the database differs from the
+// schema: missing tables, columns and indexes, and columns whose type is of a
+// different kind than their field, such as a text column for an integer.
+func (d *DatabaseImpl) CheckSchema() error {
+	diff, err := d.schemaDiff()
+	if err != nil {
+		return err
+	}
+	if len(diff) > 0 {
+		return errors.Errorf("Database schema does not match the models:\n\t%s", strings.Join(diff, "\n\t"))
+	}
+	return nil
+}
+
+// schemaDiff returns a line for each difference between the database and the
+// schema models.
+func (d *DatabaseImpl) schemaDiff() ([]string, error) {
+	var diff []string
+	m := d.db.Migrator()
+	for _, model := range schemaModels() {
+		stmt := &gorm.Statement{DB: d.db}
+		if err := stmt.Parse(model); err != nil {
+			return nil, errors.WithMessagef(err, "Failed to parse model %T", model)
+		}
+		table := stmt.Schema.Table
+		if !m.HasTable(model) {
+			diff = append(diff, "missing table "+table)
+			continue
+		}
+
+		columnTypes, err := m.ColumnTypes(model)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "Failed to get columns of %s", table)
+		}
+		columns := make(map[string]string, len(columnTypes))
+		for _, c := range columnTypes {
+			columns[c.Name()] = c.DatabaseTypeName()
+		}
+		for _, f := range stmt.Schema.Fields {
+			if f.DBName == "" {
+				continue
+			}
+			dbType, ok := columns[f.DBName]
+			if !ok {
+				diff = append(diff, "missing column "+table+"."+f.DBName)
+				continue
+			}
+			expected, actual := fieldKind(f.DataType), columnKind(dbType)
+			if expected != "" && actual != "" && expected != actual {
+				diff = append(diff, fmt.Sprintf("column %s.%s is %s, expected %s",
+					table, f.DBName, dbType, expected))
+			}
+		}
+
+		indexes := stmt.Schema.ParseIndexes()
+		names := make([]string, 0, len(indexes))
+		for name := range indexes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if !m.HasIndex(model, name) {
+				diff = append(diff, "missing index "+table+"."+name)
+			}
+		}
+	}
+
+	scoped, err := hasScopedTokens(d.db)
+	if err != nil {
+		return nil, err
+	}
+	if !scoped {
+		diff = append(diff, "tokens is not keyed on token, app and owner")
+	}
+	scoped, err = hasScopedDigests(d.db)
+	if err != nil {
+		return nil, err
+	}
+	if !scoped {
+		diff = append(diff, "digest_entries is not keyed on token, app and owner")
+	}
+	return diff, nil
+}
+
+// fieldKind returns the kind of column a field of the passed in data type is
+// stored in, or an empty string for types the schema check does not compare.
+func fieldKind(dataType schema.DataType) string {
+	switch dataType {
+	case schema.Bool:
+		return "boolean"
+	case schema.Int, schema.Uint:
+		return "integer"
+	case schema.String:
+		return "text"
+	case schema.Time:
+		return "timestamp"
+	case schema.Bytes:
+		return "binary"
+	}
+	return ""
+}
+
+// columnKind returns the kind of a column of the passed in database type, as
+// named by fieldKind, or an empty string if it is ambiguous, such as sqlite's
+// numeric, which stores booleans.
+func columnKind(dbType string) string {
+	dbType = strings.ToLower(dbType)
+	switch {
+	case strings.Contains(dbType, "int"), strings.Contains(dbType, "serial"):
+		return "integer"
+	case strings.HasPrefix(dbType, "bool"):
+		return "boolean"
+	case strings.Contains(dbType, "char"), strings.Contains(dbType, "text"):
+		return "text"
+	case strings.Contains(dbType, "time"), strings.Contains(dbType, "date"):
+		return "timestamp"
+	case dbType == "bytea", dbType == "blob":
+		return "binary"
+	}
+	return ""
+}
+
+// CountTokensByApp returns the number of registered tokens for each app.
+func (d *DatabaseImpl) CountTokensByApp() (map[string]int64, error) {
+	var rows []struct {
+		App   string
+		Count int64
+	}
+	err := d.read(func(db *gorm.DB) error {
+		return db.Model(&Token{}).Select("app, count(*) as count").Group("app").Scan(&rows).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int64, len(rows))
+	for _, r := range rows {
+		counts[r.App] = r.Count
+	}
+	return counts, nil
+}
+
+// CountTokensByVersion returns the number of registered tokens for each app,
+// platform, app version and SDK version they were last registered from.
+func (d *DatabaseImpl) CountTokensByVersion() ([]TokenVersionCount, error) {
+	var counts []TokenVersionCount
+	err := d.read(func(db *gorm.DB) error {
+		return db.Model(&Token{}).
+			Select("app, platform, app_version, sdk_version, count(*) as count").
+			Group("app, platform, app_version, sdk_version").
+			Order("app, platform, app_version, sdk_version").
+			Scan(&counts).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// CountTenantTokens returns the number of tokens registered for the apps of
+// the passed in tenant.
+func (d *DatabaseImpl) CountTenantTokens(tenant string) (int64, error) {
+	var count int64
+	err := d.read(func(db *gorm.DB) error {
+		return db.Model(&Token{}).Where("app LIKE ?", constants.TenantApp(tenant, "%")).Count(&count).Error
+	})
+	return count, err
+}
+
+// CountUsers returns the number of registered users.
+func (d *DatabaseImpl) CountUsers() (int64, error) {
+	var count int64
+	err := d.read(func(db *gorm.DB) error {
+		return db.Model(&User{}).Count(&count).Error
+	})
+	return count, err
+}
+
+// CountIdentities returns the number of tracked identities.
+func (d *DatabaseImpl) CountIdentities() (int64, error) {
+	var count int64
+	err := d.read(func(db *gorm.DB) error {
+		return db.Model(&Identity{}).Count(&count).Error
+	})
+	return count, err
+}
+
+// CountEphemeralsByEpoch returns the number of stored ephemerals in each epoch.
+func (d *DatabaseImpl) CountEphemeralsByEpoch() (map[int32]int64, error) {
+	var rows []struct {
+		Epoch int32
+		Count int64
+	}
+	err := d.read(func(db *gorm.DB) error {
+		return db.Model(&Ephemeral{}).Select("epoch, count(*) as count").Group("epoch").Scan(&rows).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[int32]int64, len(rows))
+	for _, r := range rows {
+		counts[r.Epoch] = r.Count
+	}
+	return counts, nil
+}
@@ -3,6 +3,7 @@ package storage
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"gitlab.com/elixxir/crypto/hash"
 	"gitlab.com/elixxir/notifications-bot/constants"
 	"gitlab.com/xx_network/crypto/csprng"
@@ -10,7 +11,10 @@ import (
 	"gitlab.com/xx_network/primitives/id"
 	"gitlab.com/xx_network/primitives/id/ephemeral"
 	"gorm.io/gorm"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestDatabaseImpl_UpsertState(t *testing.T) {
@@ -126,7 +130,7 @@ func TestDatabaseImpl_DeleteToken(t *testing.T) {
 		t.Fatalf("User should have %d tokens registered, instead had %d", 1, len(receivedUser.Tokens))
 	}
 
-	err = db.DeleteToken(token)
+	err = db.DeleteToken(token, constants.MessengerIOS.String())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1006,6 +1010,359 @@ func TestDatabaseImpl_LegacyUnregister(t *testing.T) {
 	}
 }
 
+func TestDatabaseImpl_DeliveryLogs(t *testing.T) {
+	db, err := newDatabase("", "", "TestDatabaseImpl_DeliveryLogs", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := generateTestUser(t)
+	now := time.Now()
+
+	err = db.InsertDeliveryLogs([]*DeliveryLog{
+		{TransmissionRSAHash: u.TransmissionRSAHash, Token: "token", App: "app", RoundId: 1, Timestamp: now.Add(-2 * time.Hour)},
+		{TransmissionRSAHash: u.TransmissionRSAHash, Token: "token", App: "app", RoundId: 2, Timestamp: now},
+		{TransmissionRSAHash: []byte("other"), Token: "token2", App: "app", RoundId: 2, Timestamp: now},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logs, err := db.GetDeliveryLogs(u.TransmissionRSAHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 2 {
+		t.Fatalf("Expected %d delivery logs, received %d", 2, len(logs))
+	}
+	if logs[0].RoundId != 2 {
+		t.Errorf("Delivery logs not ordered by most recent first: %+v", logs)
+	}
+
+	err = db.DeleteDeliveryLogs(now.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs, err = db.GetDeliveryLogs(u.TransmissionRSAHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 1 {
+		t.Fatalf("Expected %d delivery logs after delete, received %d", 1, len(logs))
+	}
+}
+
+func TestDatabaseImpl_DeadLetters(t *testing.T) {
+	db, err := newDatabase("", "", "TestDatabaseImpl_DeadLetters", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		err = db.InsertDeadLetter(&DeadLetter{
+			TransmissionRSAHash: []byte("trsaHash"),
+			Token:               "token",
+			App:                 "app",
+			Rounds:              []uint64{uint64(i)},
+			Payload:             "csv",
+			Attempts:            3,
+			Error:               "failed",
+			Timestamp:           time.Now(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dls, err := db.GetDeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dls) != 3 {
+		t.Fatalf("Expected %d dead letters, received %d", 3, len(dls))
+	}
+
+	dl, err := db.GetDeadLetter(dls[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dl.Rounds) != 1 || dl.Rounds[0] != 1 {
+		t.Errorf("Dead letter rounds not stored correctly: %+v", dl.Rounds)
+	}
+
+	err = db.DeleteDeadLetter(dl.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.GetDeadLetter(dl.ID)
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("Expected record not found for deleted dead letter, received %+v", err)
+	}
+
+	err = db.DeleteAllDeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dls, err = db.GetDeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dls) != 0 {
+		t.Errorf("Expected no dead letters after purge, received %d", len(dls))
+	}
+}
+
+func TestDatabaseImpl_QueuedNotifications(t *testing.T) {
+	db, err := newDatabase("", "", "TestDatabaseImpl_QueuedNotifications", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var queued []*QueuedNotification
+	for _, rid := range []uint64{7, 3, 5, 3} {
+		queued = append(queued, &QueuedNotification{
+			RoundId:     rid,
+			EphemeralId: int64(rid),
+			IdentityFP:  []byte("fp"),
+			MessageHash: []byte("hash"),
+			Timestamp:   time.Now(),
+		})
+	}
+	err = db.InsertQueuedNotifications(queued)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rounds, err := db.GetQueuedRounds(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rounds) != 2 || rounds[0] != 3 || rounds[1] != 5 {
+		t.Fatalf("Unexpected queued rounds\n\tExpected: %v\n\tReceived: %v", []uint64{3, 5}, rounds)
+	}
+
+	received, err := db.GetQueuedNotifications(rounds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 3 {
+		t.Errorf("Expected %d queued notifications, received %d", 3, len(received))
+	}
+
+	err = db.DeleteQueuedNotifications(rounds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := db.CountQueuedNotifications()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("Expected %d queued notification after delete, received %d", 1, count)
+	}
+}
+
+func TestDatabaseImpl_Counts(t *testing.T) {
+	db, err := newDatabase("", "", "TestDatabaseImpl_Counts", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, app := range []string{"messengerIOS", "messengerAndroid", "messengerAndroid"} {
+		hash := []byte(fmt.Sprintf("user%d", i))
+		err = db.insertUser(&User{TransmissionRSAHash: hash, TransmissionRSA: []byte("rsa")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.upsertToken(&Token{Token: fmt.Sprintf("token%d", i), App: app, TransmissionRSAHash: hash})
+		if err != nil {
+			t.Fatal(err)
+		}
+		iid := []byte(fmt.Sprintf("iid%d", i))
+		err = db.insertIdentity(&Identity{IntermediaryId: iid, OffsetNum: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.insertEphemeral(&Ephemeral{IntermediaryId: iid, EphemeralId: int64(i), Epoch: int32(10 + i%2)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tokens, err := db.CountTokensByApp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens["messengerIOS"] != 1 || tokens["messengerAndroid"] != 2 {
+		t.Errorf("Unexpected token counts: %+v", tokens)
+	}
+	users, err := db.CountUsers()
+	if err != nil || users != 3 {
+		t.Errorf("Expected 3 users, got %d: %+v", users, err)
+	}
+	identities, err := db.CountIdentities()
+	if err != nil || identities != 3 {
+		t.Errorf("Expected 3 identities, got %d: %+v", identities, err)
+	}
+	ephemerals, err := db.CountEphemeralsByEpoch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ephemerals[10] != 2 || ephemerals[11] != 1 {
+		t.Errorf("Unexpected ephemeral counts: %+v", ephemerals)
+	}
+}
+
+// Tests that tokens are counted by the provenance last recorded for them, and
+// that recording it for an unknown token fails.
+func TestDatabaseImpl_CountTokensByVersion(t *testing.T) {
+	db, err := newDatabase("", "", "TestDatabaseImpl_CountTokensByVersion", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash := []byte("user")
+	err = db.insertUser(&User{TransmissionRSAHash: hash, TransmissionRSA: []byte("rsa")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1 := TokenProvenance{Platform: "android", AppVersion: "1.0.0", SDKVersion: "4.6.0"}
+	for i, provenance := range []TokenProvenance{v1, v1, {}} {
+		token := fmt.Sprintf("token%d", i)
+		err = db.upsertToken(&Token{Token: token, App: "messengerAndroid", TransmissionRSAHash: hash})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !provenance.Empty() {
+			if err = db.SetTokenProvenance(token, "messengerAndroid", hash, provenance); err != nil {
+				t.Fatalf("Failed to set token provenance: %+v", err)
+			}
+		}
+	}
+	if err = db.SetTokenProvenance("unknown", "messengerAndroid", hash, v1); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("Expected gorm.ErrRecordNotFound for an unknown token, got %+v", err)
+	}
+
+	counts, err := db.CountTokensByVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []TokenVersionCount{
+		{App: "messengerAndroid", Count: 1},
+		{App: "messengerAndroid", Platform: "android", AppVersion: "1.0.0", SDKVersion: "4.6.0", Count: 2},
+	}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Errorf("Unexpected version counts.\nexpected: %+v\nreceived: %+v", expected, counts)
+	}
+}
+
+// Tests that only the tokens of a tenant's apps are counted for it.
+func TestDatabaseImpl_CountTenantTokens(t *testing.T) {
+	db, err := newDatabase("", "", "TestDatabaseImpl_CountTenantTokens", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash := []byte("user")
+	err = db.insertUser(&User{TransmissionRSAHash: hash, TransmissionRSA: []byte("rsa")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, app := range []string{"messengerIOS", "acme/fcm", "acme/apns", "acmeCorp/fcm"} {
+		err = db.upsertToken(&Token{Token: fmt.Sprintf("token%d", i), App: app, TransmissionRSAHash: hash})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	count, err := db.CountTenantTokens("acme")
+	if err != nil || count != 2 {
+		t.Errorf("Expected 2 acme tokens, got %d: %+v", count, err)
+	}
+	count, err = db.CountTenantTokens("other")
+	if err != nil || count != 0 {
+		t.Errorf("Expected no tokens of unknown tenant, got %d: %+v", count, err)
+	}
+}
+
+func TestDatabaseImpl_IterateIdentitiesByOffset(t *testing.T) {
+	db, err := newDatabase("", "", "TestDatabaseImpl_IterateIdentitiesByOffset", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offset := int64(7)
+	for i := 0; i < 5; i++ {
+		identity := generateTestIdentity(t)
+		identity.OffsetNum = offset
+		err = db.insertIdentity(&identity)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := generateTestIdentity(t)
+	other.OffsetNum = offset + 1
+	err = db.insertIdentity(&other)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var batches []int
+	seen := map[string]bool{}
+	err = db.IterateIdentitiesByOffset(offset, 2, func(identities []*Identity) error {
+		batches = append(batches, len(identities))
+		for _, i := range identities {
+			if seen[string(i.IntermediaryId)] {
+				t.Errorf("Identity %v returned more than once", i.IntermediaryId)
+			}
+			seen[string(i.IntermediaryId)] = true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 5 || len(batches) != 3 || batches[2] != 1 {
+		t.Errorf("Did not iterate over expected identities: %d identities in batches %v", len(seen), batches)
+	}
+
+	// Errors returned by the callback stop iteration
+	calls := 0
+	expectedErr := errors.New("stop")
+	err = db.IterateIdentitiesByOffset(offset, 2, func([]*Identity) error {
+		calls++
+		return expectedErr
+	})
+	if !errors.Is(err, expectedErr) || calls != 1 {
+		t.Errorf("Iteration did not stop on callback error: %+v after %d calls", err, calls)
+	}
+}
+
+func TestDatabaseImpl_IterateUsers(t *testing.T) {
+	db, err := newDatabase("", "", "TestDatabaseImpl_IterateUsers", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 4; i++ {
+		err = db.insertUser(generateTestUser(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	count := 0
+	err = db.IterateUsers(3, func(users []*User) error {
+		count += len(users)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Errorf("Expected to iterate over %d users, received %d", 4, count)
+	}
+}
+
 func generateTestIdentity(t *testing.T) Identity {
 	uid, err := id.NewRandomID(csprng.NewSystemRNG(), id.User)
 	if err != nil {
@@ -1034,3 +1391,207 @@ func generateTestUser(t *testing.T) *User {
 	}
 	return u
 }
+
+// Tests that unregistered tokens are tombstoned rather than removed, can be
+// restored, and are only removed once purged.
+func TestDatabaseImpl_RestoreToken(t *testing.T) {
+	db, err := newDatabase("", "", "TestDatabaseImpl_RestoreToken", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := generateTestUser(t)
+	if err = db.insertUser(u); err != nil {
+		t.Fatal(err)
+	}
+	token := &Token{Token: "restorable", App: constants.MessengerIOS.String(), TransmissionRSAHash: u.TransmissionRSAHash}
+	if err = db.upsertToken(token); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.RestoreToken(token.Token, token.App, token.TransmissionRSAHash); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("Restoring a live token should return gorm.ErrRecordNotFound, received %+v", err)
+	}
+
+	if err = db.DeleteToken(token.Token, token.App); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.GetToken(token.Token, token.App); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("Deleted token should not be returned, received %+v", err)
+	}
+
+	if err = db.RestoreToken(token.Token, token.App, token.TransmissionRSAHash); err != nil {
+		t.Fatalf("Failed to restore token: %+v", err)
+	}
+	if _, err = db.GetToken(token.Token, token.App); err != nil {
+		t.Errorf("Restored token should be returned: %+v", err)
+	}
+
+	if err = db.DeleteToken(token.Token, token.App); err != nil {
+		t.Fatal(err)
+	}
+	purged, err := db.PurgeDeletedTokens(time.Now().Add(-time.Hour))
+	if err != nil || purged != 0 {
+		t.Errorf("Token within its retention period should not be purged: %d, %+v", purged, err)
+	}
+	purged, err = db.PurgeDeletedTokens(time.Now().Add(time.Hour))
+	if err != nil || purged != 1 {
+		t.Errorf("Expected %d token purged, purged %d: %+v", 1, purged, err)
+	}
+	if err = db.RestoreToken(token.Token, token.App, token.TransmissionRSAHash); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("Purged token should not be restorable, received %+v", err)
+	}
+
+	// Re-registering a deleted token brings it back
+	if err = db.upsertToken(token); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.DeleteToken(token.Token, token.App); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.upsertToken(token); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.GetToken(token.Token, token.App); err != nil {
+		t.Errorf("Re-registered token should be returned: %+v", err)
+	}
+}
+
+// Tests that a lease is only acquired by another holder once it expired, and
+// is free to take once released.
+func TestDatabaseImpl_AcquireLease(t *testing.T) {
+	db, err := newDatabase("", "", "TestDatabaseImpl_AcquireLease", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	held, err := db.AcquireLease("sender", "a", now, time.Minute)
+	if err != nil || !held {
+		t.Fatalf("Free lease should be acquired: %t %+v", held, err)
+	}
+	held, err = db.AcquireLease("sender", "b", now.Add(time.Second), time.Minute)
+	if err != nil || held {
+		t.Errorf("Lease should not be taken before it expires: %t %+v", held, err)
+	}
+	held, err = db.AcquireLease("sender", "a", now.Add(30*time.Second), time.Minute)
+	if err != nil || !held {
+		t.Errorf("Holder should renew its lease: %t %+v", held, err)
+	}
+	held, err = db.AcquireLease("sender", "b", now.Add(time.Minute), time.Minute)
+	if err != nil || held {
+		t.Errorf("Renewed lease should not be taken: %t %+v", held, err)
+	}
+	held, err = db.AcquireLease("sender", "b", now.Add(2*time.Minute), time.Minute)
+	if err != nil || !held {
+		t.Errorf("Expired lease should be taken over: %t %+v", held, err)
+	}
+
+	if err = db.ReleaseLease("sender", "a"); err != nil {
+		t.Fatal(err)
+	}
+	held, err = db.AcquireLease("sender", "a", now.Add(2*time.Minute), time.Minute)
+	if err != nil || held {
+		t.Errorf("Releasing a lease held by another holder should have no effect: %t %+v", held, err)
+	}
+	if err = db.ReleaseLease("sender", "b"); err != nil {
+		t.Fatal(err)
+	}
+	held, err = db.AcquireLease("sender", "a", now.Add(2*time.Minute), time.Minute)
+	if err != nil || !held {
+		t.Errorf("Released lease should be acquired: %t %+v", held, err)
+	}
+}
+
+// Tests that a migrated database passes the schema check and that a dropped
+// column is reported.
+func TestDatabaseImpl_CheckSchema(t *testing.T) {
+	db, err := newDatabase("", "", "TestDatabaseImpl_CheckSchema", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.CheckSchema(); err != nil {
+		t.Fatalf("Migrated schema should pass the check: %+v", err)
+	}
+	if err = db.(*DatabaseImpl).db.Migrator().DropColumn(&Canary{}, "sealed_token"); err != nil {
+		t.Fatal(err)
+	}
+	err = db.CheckSchema()
+	if err == nil || !strings.Contains(err.Error(), "canaries.sealed_token") {
+		t.Errorf("Dropped column should be reported, got %+v", err)
+	}
+
+	gormDb := db.(*DatabaseImpl).db
+	if err = gormDb.Migrator().DropIndex(&DeliveryLog{}, "idx_delivery_logs_round_id"); err != nil {
+		t.Fatal(err)
+	}
+	err = gormDb.Exec("DROP TABLE leases").Error
+	if err == nil {
+		err = gormDb.Exec("CREATE TABLE leases (name text PRIMARY KEY, holder integer, expires datetime)").Error
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.CheckSchema()
+	for _, expected := range []string{
+		"missing index delivery_logs.idx_delivery_logs_round_id",
+		"column leases.holder is integer, expected text",
+	} {
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected %q to be reported, got %+v", expected, err)
+		}
+	}
+}
+
+// Tests that a database is not migrated and fails to open if migration is
+// skipped and its schema differs.
+func TestNewDatabaseFromParams_SkipMigration(t *testing.T) {
+	_, err := newDatabaseFromParams(Params{DBName: "TestNewDatabaseFromParams_SkipMigration", SkipMigration: true})
+	if err == nil || !strings.Contains(err.Error(), "missing table tokens") {
+		t.Errorf("Unmigrated database should fail to open, got %+v", err)
+	}
+	if _, err = newDatabase("", "", "TestNewDatabaseFromParams_SkipMigration", "", ""); err != nil {
+		t.Fatalf("Failed to migrate database: %+v", err)
+	}
+	_, err = newDatabaseFromParams(Params{DBName: "TestNewDatabaseFromParams_SkipMigration", SkipMigration: true})
+	if err != nil {
+		t.Errorf("Migrated database should open without migration: %+v", err)
+	}
+}
+
+// Tests that push quotas are counted per identity and day, and that
+// identities without pushes left are returned uncounted.
+func TestDatabaseImpl_TakePushQuota(t *testing.T) {
+	db, err := newDatabase("", "", "TestDatabaseImpl_TakePushQuota", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2022, 3, 4, 0, 0, 0, 0, time.UTC)
+	trsaHash := []byte("hash")
+	busy, quiet := []byte("busy"), []byte("quiet")
+
+	for i := 0; i < 2; i++ {
+		exhausted, err := db.TakePushQuota(day, "app", trsaHash, [][]byte{busy}, 2)
+		if err != nil || len(exhausted) != 0 {
+			t.Fatalf("Push %d should be within quota: %v %+v", i, exhausted, err)
+		}
+	}
+	exhausted, err := db.TakePushQuota(day, "app", trsaHash, [][]byte{busy, quiet}, 2)
+	if err != nil {
+		t.Fatalf("Failed to take push quota: %+v", err)
+	}
+	if len(exhausted) != 1 || !bytes.Equal(exhausted[0], busy) {
+		t.Errorf("Only the busy identity should be over quota: %q", exhausted)
+	}
+	exhausted, err = db.TakePushQuota(day, "other", trsaHash, [][]byte{busy}, 2)
+	if err != nil || len(exhausted) != 0 {
+		t.Errorf("Quotas should be counted per app: %q %+v", exhausted, err)
+	}
+
+	if err = db.DeletePushCounts(day.Add(24 * time.Hour)); err != nil {
+		t.Fatalf("Failed to delete push counts: %+v", err)
+	}
+	exhausted, err = db.TakePushQuota(day, "app", trsaHash, [][]byte{busy}, 2)
+	if err != nil || len(exhausted) != 0 {
+		t.Errorf("Deleted counts should not count towards the quota: %q %+v", exhausted, err)
+	}
+}
@@ -0,0 +1,38 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Handles deduplication of ephemerals on the identity, ephemeral ID and epoch
+
+package storage
+
+import (
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gorm.io/gorm"
+)
+
+// ephemeralsUniqueIndex is the name of the unique index of ephemerals.
+const ephemeralsUniqueIndex = "idx_ephemerals_unique"
+
+// dedupeEphemerals removes duplicate ephemerals, keeping the first inserted,
+// from an ephemerals table without the unique index, as created by earlier
+// releases. It runs on startup before the unique index is created.
+func dedupeEphemerals(db *gorm.DB) error {
+	m := db.Migrator()
+	if !m.HasTable(&Ephemeral{}) || m.HasIndex(&Ephemeral{}, ephemeralsUniqueIndex) {
+		return nil
+	}
+	res := db.Exec("DELETE FROM ephemerals WHERE id NOT IN " +
+		"(SELECT MIN(id) FROM ephemerals GROUP BY intermediary_id, ephemeral_id, epoch)")
+	if res.Error != nil {
+		return errors.WithMessage(res.Error, "Failed to delete duplicate ephemerals")
+	}
+	if res.RowsAffected > 0 {
+		jww.WARN.Printf("Removed %d duplicate ephemerals before creating %s", res.RowsAffected, ephemeralsUniqueIndex)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"testing"
+)
+
+// Tests that inserting stored ephemerals again is skipped, and that an
+// ephemerals table holding duplicates is deduplicated before the unique index
+// is created.
+func TestDatabaseImpl_insertEphemerals_Duplicates(t *testing.T) {
+	db, err := newDatabase("", "", "TestDatabaseImpl_insertEphemerals_Duplicates", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := db.(*DatabaseImpl)
+	identity := generateTestIdentity(t)
+	if err = d.insertIdentity(&identity); err != nil {
+		t.Fatal(err)
+	}
+	ephemerals := func() int64 {
+		var count int64
+		if err := d.db.Model(&Ephemeral{}).Count(&count).Error; err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+	batch := func() []*Ephemeral {
+		return []*Ephemeral{
+			{IntermediaryId: identity.IntermediaryId, EphemeralId: 1, Epoch: 10},
+			{IntermediaryId: identity.IntermediaryId, EphemeralId: 2, Epoch: 11},
+		}
+	}
+
+	if err = d.insertEphemerals(batch(), 1); err != nil {
+		t.Fatalf("Failed to insert ephemerals: %+v", err)
+	}
+	if err = d.insertEphemerals(batch(), 2); err != nil {
+		t.Fatalf("Inserting stored ephemerals again should not fail: %+v", err)
+	}
+	if err = d.insertEphemeral(batch()[0]); err != nil {
+		t.Fatalf("Inserting a stored ephemeral again should not fail: %+v", err)
+	}
+	if n := ephemerals(); n != 2 {
+		t.Errorf("Expected 2 ephemerals, got %d", n)
+	}
+
+	// Tables from earlier releases have no unique index
+	if err = d.db.Migrator().DropIndex(&Ephemeral{}, ephemeralsUniqueIndex); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err = d.db.Create(batch()).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = dedupeEphemerals(d.db); err != nil {
+		t.Fatalf("Failed to remove duplicates: %+v", err)
+	}
+	if n := ephemerals(); n != 2 {
+		t.Errorf("Expected 2 ephemerals after removing duplicates, got %d", n)
+	}
+	if err = d.db.AutoMigrate(&Ephemeral{}); err != nil {
+		t.Fatalf("Failed to create unique index: %+v", err)
+	}
+	if !d.db.Migrator().HasIndex(&Ephemeral{}, ephemeralsUniqueIndex) {
+		t.Errorf("Unique index should have been created")
+	}
+}
+
+// Tests that only identities without an ephemeral for a recent epoch are
+// iterated over.
+func TestDatabaseImpl_IterateIdentitiesWithoutEphemeral(t *testing.T) {
+	db, err := newDatabase("", "", "TestDatabaseImpl_IterateIdentitiesWithoutEphemeral", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, epoch := range []int32{5, 10, -1} {
+		iid := []byte{byte(i + 1)}
+		if err = db.insertIdentity(&Identity{IntermediaryId: iid, OffsetNum: 1}); err != nil {
+			t.Fatal(err)
+		}
+		if epoch < 0 {
+			continue
+		}
+		if err = db.insertEphemeral(&Ephemeral{IntermediaryId: iid, EphemeralId: int64(i), Epoch: epoch}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var missing [][]byte
+	err = db.IterateIdentitiesWithoutEphemeral(8, 1, func(identities []*Identity) error {
+		for _, i := range identities {
+			missing = append(missing, i.IntermediaryId)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to iterate identities: %+v", err)
+	}
+	if len(missing) != 2 || missing[0][0] != 1 || missing[1][0] != 3 {
+		t.Errorf("Unexpected identities without a recent ephemeral: %v", missing)
+	}
+}
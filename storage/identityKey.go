@@ -0,0 +1,239 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package storage
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"io"
+)
+
+// IdentityKeySize is the size in bytes of the key intermediary IDs are
+// protected with.
+const IdentityKeySize = 32
+
+// identityKey protects stored intermediary IDs, which are a deterministic hash
+// of a user's ID and so can be mapped back to users with a rainbow table.
+// Identities are keyed by an HMAC of the intermediary ID, and the ID itself,
+// which is needed to derive ephemeral IDs every period, is stored sealed. The
+// key is supplied from outside the database, so a dump of the database alone
+// does not reveal which identities are tracked.
+//
+// The key cannot rotate with each epoch as the bot must derive new ephemeral
+// IDs for every stored identity each period.
+type identityKey struct {
+	lookup []byte
+	seal   cipher.AEAD
+}
+
+// newIdentityKey derives the lookup and sealing keys from the passed in key.
+func newIdentityKey(key []byte) (*identityKey, error) {
+	if len(key) != IdentityKeySize {
+		return nil, errors.Errorf("identity key must be %d bytes, received %d", IdentityKeySize, len(key))
+	}
+	aead, err := newAEAD(deriveKey(key, "seal"))
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to create identity cipher")
+	}
+	return &identityKey{lookup: deriveKey(key, "lookup"), seal: aead}, nil
+}
+
+// deriveKey derives a subkey for the named purpose.
+func deriveKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// pseudonym returns the value identities with the passed in intermediary ID
+// are stored under.
+func (k *identityKey) pseudonym(iid []byte) []byte {
+	mac := hmac.New(sha256.New, k.lookup)
+	mac.Write(iid)
+	return mac.Sum(nil)
+}
+
+// sealID encrypts the intermediary ID for storage alongside its pseudonym.
+func (k *identityKey) sealID(iid, pseudonym []byte) ([]byte, error) {
+	nonce := make([]byte, k.seal.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.WithMessage(err, "Failed to generate nonce")
+	}
+	return k.seal.Seal(nonce, nonce, iid, pseudonym), nil
+}
+
+// openID decrypts a sealed intermediary ID.
+func (k *identityKey) openID(sealed, pseudonym []byte) ([]byte, error) {
+	if len(sealed) < k.seal.NonceSize() {
+		return nil, errors.New("sealed intermediary ID is too short")
+	}
+	nonce, ct := sealed[:k.seal.NonceSize()], sealed[k.seal.NonceSize():]
+	iid, err := k.seal.Open(nil, nonce, ct, pseudonym)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to open sealed intermediary ID")
+	}
+	return iid, nil
+}
+
+// storedID returns the value the identity with the passed in intermediary ID
+// is stored under: its pseudonym if identities are protected, otherwise the
+// ID itself.
+func (s *Storage) storedID(iid []byte) []byte {
+	if s.identityKey == nil {
+		return iid
+	}
+	return s.identityKey.pseudonym(iid)
+}
+
+// newIdentity builds the identity stored for the passed in intermediary ID.
+func (s *Storage) newIdentity(iid []byte, offsetNum int64) (*Identity, error) {
+	i := &Identity{IntermediaryId: s.storedID(iid), OffsetNum: offsetNum}
+	if s.identityKey != nil {
+		var err error
+		i.SealedId, err = s.identityKey.sealID(iid, i.IntermediaryId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return i, nil
+}
+
+// intermediaryID returns the intermediary ID of a stored identity, opening it
+// if it is sealed.
+func (s *Storage) intermediaryID(i *Identity) ([]byte, error) {
+	if len(i.SealedId) == 0 {
+		return i.IntermediaryId, nil
+	}
+	if s.identityKey == nil {
+		return nil, errors.New("identity is sealed but no identity key is configured")
+	}
+	return s.identityKey.openID(i.SealedId, i.IntermediaryId)
+}
+
+// SetIdentityPreimages registers the message identification preimages of the
+// identity with the passed in intermediary ID, which must be tracked by the
+// user with the passed in transmission RSA key; an empty list removes them.
+// They are sealed like the intermediary ID if identities are protected.
+func (s *Storage) SetIdentityPreimages(iid, transmissionRSA []byte, preimages [][]byte) error {
+	trsaHash, err := getHash(transmissionRSA)
+	if err != nil {
+		return err
+	}
+	stored := s.storedID(iid)
+	var data []byte
+	if len(preimages) > 0 {
+		data, err = s.sealPreimages(preimages, stored)
+		if err != nil {
+			return err
+		}
+	}
+	return s.setIdentityPreimages(stored, trsaHash, data)
+}
+
+// sealPreimages encodes preimages for storage with the identity stored under
+// the passed in ID, sealing them if identities are protected.
+func (s *Storage) sealPreimages(preimages [][]byte, storedID []byte) ([]byte, error) {
+	data, err := json.Marshal(preimages)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to encode preimages")
+	}
+	if s.identityKey == nil {
+		return data, nil
+	}
+	return s.identityKey.sealID(data, storedID)
+}
+
+// OpenPreimages returns the message identification preimages registered for
+// the identity a GetToNotify result matched, or nil if there are none.
+func (s *Storage) OpenPreimages(target GTNResult) ([][]byte, error) {
+	if len(target.Preimages) == 0 {
+		return nil, nil
+	}
+	data := target.Preimages
+	if s.identityKey != nil {
+		var err error
+		data, err = s.identityKey.openID(target.Preimages, target.IntermediaryId)
+		if err != nil {
+			return nil, errors.WithMessage(err, "Failed to open preimages")
+		}
+	}
+	var preimages [][]byte
+	err := json.Unmarshal(data, &preimages)
+	return preimages, errors.WithMessage(err, "Failed to decode preimages")
+}
+
+// GetIdentity retrieves the identity with the passed in intermediary ID,
+// opening the transmission RSA keys of its users.
+func (s *Storage) GetIdentity(iid []byte) (*Identity, error) {
+	i, err := s.database.GetIdentity(s.storedID(iid))
+	if err != nil {
+		return nil, err
+	}
+	for j := range i.Users {
+		if err = s.openUser(&i.Users[j]); err != nil {
+			return nil, errors.WithMessage(err, "Failed to open transmission RSA")
+		}
+	}
+	return i, nil
+}
+
+// LegacyUnregister removes the identity with the passed in intermediary ID
+// and its only user.
+func (s *Storage) LegacyUnregister(iid []byte) error {
+	return s.database.LegacyUnregister(s.storedID(iid))
+}
+
+// SealIdentities moves identities stored before the identity key was
+// configured under their pseudonym, sealing their intermediary ID. It is a
+// no-op if no identity key is configured.
+func (s *Storage) SealIdentities() error {
+	if s.identityKey == nil {
+		return nil
+	}
+	sealed := 0
+	for {
+		batch, err := s.getUnsealedIdentities(IdentityBatchSize)
+		if err != nil {
+			return errors.WithMessage(err, "Failed to get unsealed identities")
+		}
+		if len(batch) == 0 {
+			break
+		}
+		for _, i := range batch {
+			updated, err := s.newIdentity(i.IntermediaryId, i.OffsetNum)
+			if err != nil {
+				return err
+			}
+			if len(i.Preimages) > 0 {
+				// Registered before the key, so stored in the clear
+				var preimages [][]byte
+				if err = json.Unmarshal(i.Preimages, &preimages); err != nil {
+					return errors.WithMessage(err, "Failed to decode preimages")
+				}
+				updated.Preimages, err = s.sealPreimages(preimages, updated.IntermediaryId)
+				if err != nil {
+					return err
+				}
+			}
+			err = s.rekeyIdentity(i.IntermediaryId, updated)
+			if err != nil {
+				return errors.WithMessage(err, "Failed to seal identity")
+			}
+		}
+		sealed += len(batch)
+	}
+	if sealed > 0 {
+		jww.INFO.Printf("Sealed %d stored intermediary IDs", sealed)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"gitlab.com/xx_network/crypto/csprng"
+	"gitlab.com/xx_network/crypto/signature/rsa"
+	"gitlab.com/xx_network/primitives/id"
+	"gitlab.com/xx_network/primitives/id/ephemeral"
+	"gorm.io/gorm"
+	"testing"
+	"time"
+)
+
+// Tests that with an identity key, intermediary IDs are stored under their
+// pseudonym and sealed, while lookups and ephemeral generation still work.
+func TestStorage_IdentityKey(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, IdentityKeySize)
+	s, err := NewStorageFromParams(Params{DBName: "TestStorage_IdentityKey", IdentityKey: key})
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+
+	trsaPrivate, err := rsa.GenerateKey(csprng.NewSystemRNG(), 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := rsa.CreatePublicKeyPem(trsaPrivate.GetPublic())
+	testId, err := id.NewRandomID(csprng.NewSystemRNG(), id.User)
+	if err != nil {
+		t.Fatalf("Failed to generate test ID: %+v", err)
+	}
+	iid, err := ephemeral.GetIntermediaryId(testId)
+	if err != nil {
+		t.Fatalf("Failed to generate intermediary ID: %+v", err)
+	}
+	_, epoch := ephemeral.HandleQuantization(time.Now())
+
+	if err = s.RegisterToken("token", "app", pub); err != nil {
+		t.Fatalf("Failed to register token: %+v", err)
+	}
+	if err = s.RegisterTrackedID([][]byte{iid}, pub, epoch, 16); err != nil {
+		t.Fatalf("Failed to register tracked ID: %+v", err)
+	}
+
+	identity, err := s.GetIdentity(iid)
+	if err != nil {
+		t.Fatalf("Failed to look up identity: %+v", err)
+	}
+	if bytes.Equal(identity.IntermediaryId, iid) || bytes.Contains(identity.SealedId, iid) {
+		t.Errorf("Intermediary ID was stored in the clear: %+v", identity)
+	}
+	opened, err := s.intermediaryID(identity)
+	if err != nil || !bytes.Equal(opened, iid) {
+		t.Errorf("Failed to open sealed intermediary ID: %v, %+v", opened, err)
+	}
+
+	eid, _, _, err := ephemeral.GetIdFromIntermediary(iid, 16, time.Now().UnixNano())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.GetToNotify([]int64{eid.Int64()})
+	if err != nil {
+		t.Fatalf("Failed to get tokens to notify: %+v", err)
+	}
+	if len(res) != 1 || res[0].Token != "token" {
+		t.Errorf("Ephemeral ID derived from the sealed identity did not match: %+v", res)
+	}
+
+	if _, err = newIdentityKey(key[:16]); err == nil {
+		t.Errorf("Short identity key should be rejected")
+	}
+}
+
+// Tests that identities stored before a key was configured are moved under
+// their pseudonym along with their users and ephemerals.
+func TestStorage_SealIdentities(t *testing.T) {
+	s, err := NewStorage("", "", "TestStorage_SealIdentities", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+	trsaPrivate, err := rsa.GenerateKey(csprng.NewSystemRNG(), 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := rsa.CreatePublicKeyPem(trsaPrivate.GetPublic())
+	iid := []byte("intermediaryIdentity")
+	_, epoch := ephemeral.HandleQuantization(time.Now())
+	if err = s.RegisterToken("token", "app", pub); err != nil {
+		t.Fatalf("Failed to register token: %+v", err)
+	}
+	if err = s.RegisterTrackedID([][]byte{iid}, pub, epoch, 16); err != nil {
+		t.Fatalf("Failed to register tracked ID: %+v", err)
+	}
+	preimage := bytes.Repeat([]byte{9}, 32)
+	if err = s.SetIdentityPreimages(iid, pub, [][]byte{preimage}); err != nil {
+		t.Fatalf("Failed to set preimages: %+v", err)
+	}
+	if err = s.SetIdentityPreimages(iid, []byte("other"), [][]byte{preimage}); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("Only a user tracking the identity should set its preimages, got %+v", err)
+	}
+
+	s.identityKey, err = newIdentityKey(bytes.Repeat([]byte{3}, IdentityKeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SealIdentities(); err != nil {
+		t.Fatalf("Failed to seal identities: %+v", err)
+	}
+
+	identity, err := s.GetIdentity(iid)
+	if err != nil {
+		t.Fatalf("Failed to look up sealed identity: %+v", err)
+	}
+	if len(identity.SealedId) == 0 || len(identity.Users) != 1 {
+		t.Errorf("Identity was not sealed with its user: %+v", identity)
+	}
+	if _, err = s.database.GetIdentity(iid); err == nil {
+		t.Errorf("Identity should no longer be stored under its intermediary ID")
+	}
+
+	eid, _, _, err := ephemeral.GetIdFromIntermediary(iid, 16, time.Now().UnixNano())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.GetToNotify([]int64{eid.Int64()})
+	if err != nil {
+		t.Fatalf("Failed to get tokens to notify: %+v", err)
+	}
+	if len(res) != 1 || res[0].Token != "token" {
+		t.Fatalf("Ephemerals were not moved with the identity: %+v", res)
+	}
+	if bytes.Contains(res[0].Preimages, preimage) {
+		t.Errorf("Preimages should be sealed with the identity")
+	}
+	preimages, err := s.OpenPreimages(res[0])
+	if err != nil {
+		t.Fatalf("Failed to open preimages: %+v", err)
+	}
+	if len(preimages) != 1 || !bytes.Equal(preimages[0], preimage) {
+		t.Errorf("Preimages were not carried over: %v", preimages)
+	}
+}
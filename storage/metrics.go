@@ -0,0 +1,178 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Queries are instrumented with gorm callbacks, as the write fault injection
+// is. Each query is attributed to the DatabaseImpl method which ran it, found
+// from the call stack, so methods added later are covered without wrapping.
+
+package storage
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gorm.io/gorm"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// queryLatencyBuckets are the upper bounds in seconds of the query latency
+// histogram buckets.
+var queryLatencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// queryStartKey is the statement setting holding the time a query started.
+const queryStartKey = "metrics:start"
+
+// queryStat holds the latency histogram and error count of the queries run by
+// a method.
+type queryStat struct {
+	buckets []uint64
+	sum     float64
+	count   uint64
+	errors  uint64
+}
+
+// queryMetrics holds the query stats of each DatabaseImpl method by name.
+type queryMetrics struct {
+	mux     sync.Mutex
+	methods map[string]*queryStat
+	// slowThreshold is the duration above which queries are logged; none
+	// are if 0
+	slowThreshold time.Duration
+}
+
+// newQueryMetrics returns empty query metrics logging queries slower than
+// slowThreshold.
+func newQueryMetrics(slowThreshold time.Duration) *queryMetrics {
+	return &queryMetrics{methods: map[string]*queryStat{}, slowThreshold: slowThreshold}
+}
+
+// register adds callbacks timing every query run through db.
+func (m *queryMetrics) register(db *gorm.DB) error {
+	start := func(tx *gorm.DB) {
+		tx.InstanceSet(queryStartKey, time.Now())
+	}
+	end := func(tx *gorm.DB) {
+		started, ok := tx.InstanceGet(queryStartKey)
+		if !ok {
+			return
+		}
+		elapsed := time.Since(started.(time.Time))
+		method := queryMethod()
+		failed := tx.Error != nil && !errors.Is(tx.Error, gorm.ErrRecordNotFound)
+		m.observe(method, elapsed, failed)
+		if m.slowThreshold > 0 && elapsed > m.slowThreshold {
+			jww.WARN.Printf("Slow query in %s took %s: %s", method, elapsed, tx.Statement.SQL.String())
+		}
+	}
+
+	cb := db.Callback()
+	for _, err := range []error{
+		cb.Create().Before("gorm:create").Register("metrics:before_create", start),
+		cb.Create().After("gorm:create").Register("metrics:after_create", end),
+		cb.Query().Before("gorm:query").Register("metrics:before_query", start),
+		cb.Query().After("gorm:query").Register("metrics:after_query", end),
+		cb.Update().Before("gorm:update").Register("metrics:before_update", start),
+		cb.Update().After("gorm:update").Register("metrics:after_update", end),
+		cb.Delete().Before("gorm:delete").Register("metrics:before_delete", start),
+		cb.Delete().After("gorm:delete").Register("metrics:after_delete", end),
+		cb.Row().Before("gorm:row").Register("metrics:before_row", start),
+		cb.Row().After("gorm:row").Register("metrics:after_row", end),
+		cb.Raw().Before("gorm:raw").Register("metrics:before_raw", start),
+		cb.Raw().After("gorm:raw").Register("metrics:after_raw", end),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// observe records a query run by the passed in method.
+func (m *queryMetrics) observe(method string, elapsed time.Duration, failed bool) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	s, ok := m.methods[method]
+	if !ok {
+		s = &queryStat{buckets: make([]uint64, len(queryLatencyBuckets))}
+		m.methods[method] = s
+	}
+	seconds := elapsed.Seconds()
+	for i, bound := range queryLatencyBuckets {
+		if seconds <= bound {
+			s.buckets[i]++
+		}
+	}
+	s.sum += seconds
+	s.count++
+	if failed {
+		s.errors++
+	}
+}
+
+// format renders the query stats as Prometheus metrics.
+func (m *queryMetrics) format() string {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if len(m.methods) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(m.methods))
+	for name := range m.methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("# HELP notifications_db_query_duration_seconds Time taken by database queries, by storage method.\n" +
+		"# TYPE notifications_db_query_duration_seconds histogram\n")
+	for _, name := range names {
+		s := m.methods[name]
+		for i, bound := range queryLatencyBuckets {
+			fmt.Fprintf(&b, "notifications_db_query_duration_seconds_bucket{method=%q,le=\"%g\"} %d\n", name, bound, s.buckets[i])
+		}
+		fmt.Fprintf(&b, "notifications_db_query_duration_seconds_bucket{method=%q,le=\"+Inf\"} %d\n", name, s.count)
+		fmt.Fprintf(&b, "notifications_db_query_duration_seconds_sum{method=%q} %g\n", name, s.sum)
+		fmt.Fprintf(&b, "notifications_db_query_duration_seconds_count{method=%q} %d\n", name, s.count)
+	}
+	b.WriteString("# HELP notifications_db_query_errors_total Database queries which failed, by storage method.\n" +
+		"# TYPE notifications_db_query_errors_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "notifications_db_query_errors_total{method=%q} %d\n", name, m.methods[name].errors)
+	}
+	return b.String()
+}
+
+// queryMethod returns the name of the innermost DatabaseImpl method on the
+// call stack, or "other" for queries run outside of one, such as migrations.
+func queryMethod() string {
+	const receiver = ".(*DatabaseImpl)."
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	for {
+		frame, more := frames.Next()
+		if i := strings.Index(frame.Function, receiver); i >= 0 {
+			method := frame.Function[i+len(receiver):]
+			// Closures are named after their method, e.g. GetToNotify.func1
+			if j := strings.IndexByte(method, '.'); j >= 0 {
+				method = method[:j]
+			}
+			return method
+		}
+		if !more {
+			return "other"
+		}
+	}
+}
+
+// QueryMetrics renders the per method query stats as Prometheus metrics.
+func (s *Storage) QueryMetrics() string {
+	return s.database.queryMetrics().format()
+}
@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+)
+
+// Tests that queries are counted under the method which ran them, and that
+// missing records are not counted as errors.
+func TestStorage_QueryMetrics(t *testing.T) {
+	s, err := NewStorage("", "", "TestStorage_QueryMetrics", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+	if err = s.RegisterToken("token", "app", []byte("trsa")); err != nil {
+		t.Fatalf("Failed to register token: %+v", err)
+	}
+	if _, err = s.GetToken("missing", "app"); err == nil {
+		t.Fatalf("Expected missing token to not be found")
+	}
+	if err = s.UpsertState(&State{Key: "key", Value: "value"}); err != nil {
+		t.Fatalf("Failed to upsert state: %+v", err)
+	}
+
+	metrics := s.QueryMetrics()
+	for _, expected := range []string{
+		`notifications_db_query_duration_seconds_count{method="GetToken"}`,
+		`notifications_db_query_duration_seconds_count{method="UpsertState"} 1`,
+		`notifications_db_query_errors_total{method="GetToken"} 0`,
+		`method="upsertToken"`,
+	} {
+		if !strings.Contains(metrics, expected) {
+			t.Errorf("Metrics do not contain %s:\n%s", expected, metrics)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package storage
+
+import (
+	"encoding/base64"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/xx_network/primitives/id"
+	"gitlab.com/xx_network/primitives/id/ephemeral"
+)
+
+// LegacyUsersTable is the default name of the table holding legacy users. The
+// legacy table is expected to be renamed to it before the current schema is
+// migrated, since both schemas use a users table.
+const LegacyUsersTable = "users_v1"
+
+// LegacyV0UsersTable is the default name of the table holding users of the
+// original schema, renamed like LegacyUsersTable.
+const LegacyV0UsersTable = "users_v0"
+
+// UnmigratableUser is a row of the original user table which could not be
+// migrated, and why.
+type UnmigratableUser struct {
+	Id     string
+	Token  string
+	Reason string
+}
+
+// MigrateLegacyUsers converts every row of the legacy user table into a user,
+// token and tracked identity in the current schema, using the same path as
+// legacy registrations. Each row is converted and removed from the legacy
+// table in a single transaction, so an interrupted migration can be resumed
+// by running it again. It returns the number of rows migrated.
+func (s *Storage) MigrateLegacyUsers(table string, epoch int32, addressSpace uint8) (int, error) {
+	migrated := 0
+	for {
+		legacy, err := s.getLegacyUsers(table, IdentityBatchSize)
+		if err != nil {
+			return migrated, errors.WithMessagef(err, "Failed to read legacy users from %s", table)
+		}
+		if len(legacy) == 0 {
+			break
+		}
+
+		for _, u := range legacy {
+			err = s.Transaction(func(tx *Storage) error {
+				app := constants.LegacyApp(u.Token).String()
+				_, err := tx.RegisterForNotifications(u.IntermediaryId, u.TransmissionRSA, u.Token, app, epoch, addressSpace)
+				if err != nil {
+					return err
+				}
+				return tx.deleteLegacyUser(table, u.TransmissionRSAHash)
+			})
+			if err != nil {
+				return migrated, errors.WithMessagef(err, "Failed to migrate legacy user with tRSA hash %s",
+					base64.StdEncoding.EncodeToString(u.TransmissionRSAHash))
+			}
+			migrated++
+		}
+		jww.INFO.Printf("Migrated %d legacy users", migrated)
+	}
+	return migrated, nil
+}
+
+// MigrateLegacyV0Users converts every row of the original user table, which
+// held a token for each base64 encoded user ID, into a user, token and
+// tracked identity in the current schema. The tracked identity is the
+// intermediary ID of the user ID. Original users never registered a
+// transmission key, so they are keyed on their ID instead and flagged as
+// LegacyV0; their registration of the token is removed when the client next
+// registers it with its key. Each row is converted and removed
+// in a single transaction, so an interrupted migration can be resumed. Rows
+// whose ID cannot be decoded or which have no token are left in the table and
+// returned with the number of rows migrated.
+func (s *Storage) MigrateLegacyV0Users(table string, epoch int32, addressSpace uint8) (int, []UnmigratableUser, error) {
+	migrated := 0
+	var unmigratable []UnmigratableUser
+	after := ""
+	for {
+		legacy, err := s.getLegacyV0Users(table, after, IdentityBatchSize)
+		if err != nil {
+			return migrated, unmigratable, errors.WithMessagef(err, "Failed to read legacy users from %s", table)
+		}
+		if len(legacy) == 0 {
+			break
+		}
+
+		for _, u := range legacy {
+			after = u.Id
+			iid, err := legacyIntermediaryID(u)
+			if err != nil {
+				unmigratable = append(unmigratable, UnmigratableUser{Id: u.Id, Token: u.Token, Reason: err.Error()})
+				continue
+			}
+			err = s.Transaction(func(tx *Storage) error {
+				app := constants.LegacyApp(u.Token).String()
+				user, err := tx.RegisterForNotifications(iid, []byte(u.Id), u.Token, app, epoch, addressSpace)
+				if err != nil {
+					return err
+				}
+				if err = tx.markLegacyV0User(user.TransmissionRSAHash); err != nil {
+					return errors.WithMessage(err, "Failed to flag user as legacy")
+				}
+				return tx.deleteLegacyV0User(table, u.Id)
+			})
+			if err != nil {
+				return migrated, unmigratable, errors.WithMessagef(err, "Failed to migrate legacy user %s", u.Id)
+			}
+			migrated++
+		}
+		jww.INFO.Printf("Migrated %d legacy users, %d unmigratable", migrated, len(unmigratable))
+	}
+	return migrated, unmigratable, nil
+}
+
+// legacyIntermediaryID returns the intermediary ID of the base64 encoded user
+// ID of an original user.
+func legacyIntermediaryID(u *UserV0) ([]byte, error) {
+	if u.Token == "" {
+		return nil, errors.New("no token")
+	}
+	b, err := base64.StdEncoding.DecodeString(u.Id)
+	if err != nil {
+		return nil, errors.WithMessage(err, "ID is not base64 encoded")
+	}
+	uid, err := id.Unmarshal(b)
+	if err != nil {
+		return nil, errors.WithMessage(err, "ID is not a user ID")
+	}
+	iid, err := ephemeral.GetIntermediaryId(uid)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to derive intermediary ID")
+	}
+	return iid, nil
+}
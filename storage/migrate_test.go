@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"gitlab.com/xx_network/crypto/csprng"
+	"gitlab.com/xx_network/crypto/signature/rsa"
+	"gitlab.com/xx_network/primitives/id"
+	"gitlab.com/xx_network/primitives/id/ephemeral"
+	"testing"
+)
+
+// Tests that legacy users are converted to the current schema and removed
+// from the legacy table.
+func TestStorage_MigrateLegacyUsers(t *testing.T) {
+	s, err := NewStorage("", "", "TestStorage_MigrateLegacyUsers", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create new storage object: %+v", err)
+	}
+	db := s.database.(*DatabaseImpl).db
+
+	migrated, err := s.MigrateLegacyUsers(LegacyUsersTable, 5, 16)
+	if err != nil || migrated != 0 {
+		t.Fatalf("Migration without a legacy table should do nothing, got %d: %+v", migrated, err)
+	}
+
+	err = db.Exec("CREATE TABLE " + LegacyUsersTable + " (transmission_rsa_hash blob primary key, " +
+		"intermediary_id blob, offset_num integer, transmission_rsa blob, signature blob, token text)").Error
+	if err != nil {
+		t.Fatalf("Failed to create legacy table: %+v", err)
+	}
+	tokens := []string{"apnsToken", "fcm:token"}
+	var hashes [][]byte
+	for i, token := range tokens {
+		trsaPrivate, err := rsa.GenerateKey(csprng.NewSystemRNG(), 512)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub := rsa.CreatePublicKeyPem(trsaPrivate.GetPublic())
+		h, err := getHash(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, h)
+		err = db.Table(LegacyUsersTable).Create(&UserV1{
+			TransmissionRSAHash: h,
+			IntermediaryId:      id.NewIdFromUInt(uint64(i+1), id.User, t).Marshal(),
+			TransmissionRSA:     pub,
+			Signature:           []byte("sig"),
+			Token:               token,
+		}).Error
+		if err != nil {
+			t.Fatalf("Failed to insert legacy user: %+v", err)
+		}
+	}
+
+	migrated, err = s.MigrateLegacyUsers(LegacyUsersTable, 5, 16)
+	if err != nil {
+		t.Fatalf("Failed to migrate legacy users: %+v", err)
+	}
+	if migrated != len(tokens) {
+		t.Errorf("Expected %d users migrated, got %d", len(tokens), migrated)
+	}
+
+	expectedApps := []string{"messengerIOS", "messengerAndroid"}
+	for i, h := range hashes {
+		u, err := s.GetUser(h)
+		if err != nil {
+			t.Fatalf("Failed to get migrated user: %+v", err)
+		}
+		if len(u.Tokens) != 1 || u.Tokens[0].Token != tokens[i] || u.Tokens[0].App != expectedApps[i] {
+			t.Errorf("Unexpected tokens for migrated user: %+v", u.Tokens)
+		}
+		if len(u.Identities) != 1 {
+			t.Errorf("Expected one identity for migrated user, got %+v", u.Identities)
+		}
+	}
+
+	remaining, err := s.getLegacyUsers(LegacyUsersTable, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 0 {
+		t.Errorf("Legacy rows should have been removed, found %d", len(remaining))
+	}
+}
+
+// Tests that original users are converted to the current schema keyed on
+// their ID, and rows which cannot be migrated are reported and kept.
+func TestStorage_MigrateLegacyV0Users(t *testing.T) {
+	s, err := NewStorage("", "", "TestStorage_MigrateLegacyV0Users", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create new storage object: %+v", err)
+	}
+	db := s.database.(*DatabaseImpl).db
+
+	migrated, unmigratable, err := s.MigrateLegacyV0Users(LegacyV0UsersTable, 5, 16)
+	if err != nil || migrated != 0 || len(unmigratable) != 0 {
+		t.Fatalf("Migration without a legacy table should do nothing, got %d: %+v", migrated, err)
+	}
+
+	err = db.Exec("CREATE TABLE " + LegacyV0UsersTable + " (id text primary key, token text)").Error
+	if err != nil {
+		t.Fatalf("Failed to create legacy table: %+v", err)
+	}
+	uid := id.NewIdFromString("legacy", id.User, t)
+	legacyID := base64.StdEncoding.EncodeToString(uid.Marshal())
+	rows := []UserV0{
+		{Id: legacyID, Token: "fcm:token"},
+		{Id: "not an ID", Token: "apnsToken"},
+		{Id: base64.StdEncoding.EncodeToString(id.NewIdFromString("tokenless", id.User, t).Marshal())},
+	}
+	for _, row := range rows {
+		if err = db.Table(LegacyV0UsersTable).Create(&row).Error; err != nil {
+			t.Fatalf("Failed to insert legacy user: %+v", err)
+		}
+	}
+
+	migrated, unmigratable, err = s.MigrateLegacyV0Users(LegacyV0UsersTable, 5, 16)
+	if err != nil {
+		t.Fatalf("Failed to migrate legacy users: %+v", err)
+	}
+	if migrated != 1 || len(unmigratable) != 2 {
+		t.Fatalf("Expected 1 user migrated and 2 unmigratable, got %d and %+v", migrated, unmigratable)
+	}
+
+	h, err := getHash([]byte(legacyID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := s.GetUser(h)
+	if err != nil {
+		t.Fatalf("Failed to get migrated user: %+v", err)
+	}
+	if len(u.Tokens) != 1 || u.Tokens[0].Token != "fcm:token" || u.Tokens[0].App != "messengerAndroid" {
+		t.Errorf("Unexpected tokens for migrated user: %+v", u.Tokens)
+	}
+	iid, err := ephemeral.GetIntermediaryId(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(u.Identities) != 1 || !bytes.Equal(u.Identities[0].IntermediaryId, iid) {
+		t.Errorf("Migrated user should track the intermediary ID of its ID: %+v", u.Identities)
+	}
+	if !u.LegacyV0 {
+		t.Errorf("Migrated user should be flagged as legacy")
+	}
+
+	// A signed registration of the token replaces the legacy one even when
+	// tokens may be shared
+	s.tokenPolicy = MultiIdentity
+	if err = s.RegisterToken("fcm:token", "messengerAndroid", []byte("trsa")); err != nil {
+		t.Fatalf("Failed to register token: %+v", err)
+	}
+	u, err = s.GetUser(h)
+	if err != nil {
+		t.Fatalf("Failed to get migrated user: %+v", err)
+	}
+	if len(u.Tokens) != 0 || len(u.Identities) != 0 {
+		t.Errorf("Legacy registration should be removed, got %+v and %+v", u.Tokens, u.Identities)
+	}
+
+	remaining, err := s.getLegacyV0Users(LegacyV0UsersTable, "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 2 {
+		t.Errorf("Unmigratable rows should be kept, found %d rows", len(remaining))
+	}
+}
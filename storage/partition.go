@@ -0,0 +1,173 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Native postgres partitioning of the ephemerals table by epoch, so expired
+// ephemerals can be removed by dropping whole partitions instead of deleting
+// them row by row.
+
+package storage
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gitlab.com/xx_network/primitives/id/ephemeral"
+	"gorm.io/gorm"
+	"time"
+)
+
+// partitionWidth is the number of epochs covered by each partition of the
+// ephemerals table, equal to one ephemeral ID period.
+const partitionWidth = int32(ephemeral.NumOffsets)
+
+// partitionsAhead is the number of partitions kept created past the one
+// containing the current epoch.
+const partitionsAhead = 2
+
+const partitionPrefix = "ephemerals_p"
+
+// partitionStart returns the first epoch of the partition containing epoch.
+func partitionStart(epoch int32) int32 {
+	start := epoch - epoch%partitionWidth
+	if epoch < 0 && epoch%partitionWidth != 0 {
+		start -= partitionWidth
+	}
+	return start
+}
+
+// partitionName returns the name of the partition starting at start.
+func partitionName(start int32) string {
+	return fmt.Sprintf("%s%d", partitionPrefix, start)
+}
+
+// partitionEphemerals converts the ephemerals table into a table partitioned
+// by range of epoch if it is not one already, and creates the partitions
+// needed around the current epoch.
+func (d *DatabaseImpl) partitionEphemerals() error {
+	var kind string
+	err := d.db.Raw("SELECT relkind FROM pg_class WHERE oid = 'ephemerals'::regclass").Scan(&kind).Error
+	if err != nil {
+		return errors.WithMessage(err, "Failed to look up ephemerals table")
+	}
+	if kind != "p" {
+		jww.INFO.Printf("Converting ephemerals table to a partitioned table")
+		err = d.inTransaction(convertEphemerals)
+		if err != nil {
+			return err
+		}
+	}
+
+	d.partitioned = true
+	_, epoch := ephemeral.HandleQuantization(time.Now())
+	return d.maintainPartitions(epoch)
+}
+
+// convertEphemerals replaces the plain ephemerals table with a partitioned one
+// holding the same rows, indexes and constraints.
+func convertEphemerals(tx *gorm.DB) error {
+	statements := []string{
+		"ALTER TABLE ephemerals RENAME TO ephemerals_unpartitioned",
+		"ALTER TABLE ephemerals_unpartitioned DROP CONSTRAINT IF EXISTS fk_identities_ephemerals",
+		"ALTER TABLE ephemerals_unpartitioned DROP CONSTRAINT IF EXISTS ephemerals_pkey",
+		"DROP INDEX IF EXISTS idx_ephemerals_ephemeral_id",
+		"DROP INDEX IF EXISTS idx_ephemerals_epoch",
+		"DROP INDEX IF EXISTS idx_ephemerals_unique",
+		"CREATE TABLE ephemerals (LIKE ephemerals_unpartitioned INCLUDING DEFAULTS) PARTITION BY RANGE (epoch)",
+		// The partition key must be part of the primary key
+		"ALTER TABLE ephemerals ADD PRIMARY KEY (id, epoch)",
+		"CREATE INDEX idx_ephemerals_ephemeral_id ON ephemerals (ephemeral_id)",
+		"CREATE INDEX idx_ephemerals_epoch ON ephemerals (epoch)",
+		"CREATE UNIQUE INDEX idx_ephemerals_unique ON ephemerals (intermediary_id, ephemeral_id, epoch)",
+		"ALTER TABLE ephemerals ADD CONSTRAINT fk_identities_ephemerals FOREIGN KEY (intermediary_id) " +
+			"REFERENCES identities(intermediary_id) ON DELETE CASCADE",
+		// Keep the id sequence alive once the old table is dropped
+		"ALTER SEQUENCE IF EXISTS ephemerals_id_seq OWNED BY ephemerals.id",
+	}
+	for _, s := range statements {
+		if err := tx.Exec(s).Error; err != nil {
+			return errors.WithMessagef(err, "Failed to execute %q", s)
+		}
+	}
+
+	// Create partitions covering the existing rows before copying them over
+	var bounds struct {
+		Min *int32
+		Max *int32
+	}
+	err := tx.Raw("SELECT MIN(epoch) AS min, MAX(epoch) AS max FROM ephemerals_unpartitioned").
+		Scan(&bounds).Error
+	if err != nil {
+		return errors.WithMessage(err, "Failed to get epoch range of existing ephemerals")
+	}
+	if bounds.Min != nil && bounds.Max != nil {
+		err = createPartitions(tx, *bounds.Min, *bounds.Max)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Exec("INSERT INTO ephemerals SELECT * FROM ephemerals_unpartitioned").Error
+	if err != nil {
+		return errors.WithMessage(err, "Failed to copy existing ephemerals")
+	}
+	return tx.Exec("DROP TABLE ephemerals_unpartitioned").Error
+}
+
+// createPartitions creates any missing partitions covering epochs from
+// through to.
+func createPartitions(tx *gorm.DB, from, to int32) error {
+	for start := partitionStart(from); start <= partitionStart(to); start += partitionWidth {
+		err := tx.Exec(fmt.Sprintf(
+			"CREATE TABLE IF NOT EXISTS %s PARTITION OF ephemerals FOR VALUES FROM (%d) TO (%d)",
+			partitionName(start), start, start+partitionWidth)).Error
+		if err != nil {
+			return errors.WithMessagef(err, "Failed to create partition %s", partitionName(start))
+		}
+	}
+	return nil
+}
+
+// maintainPartitions drops partitions which only hold epochs before
+// currentEpoch and makes sure partitions exist for the previous period through
+// partitionsAhead periods from now.
+func (d *DatabaseImpl) maintainPartitions(currentEpoch int32) error {
+	d.partitionMux.Lock()
+	defer d.partitionMux.Unlock()
+
+	var names []string
+	err := d.db.Raw("SELECT c.relname FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid " +
+		"WHERE i.inhparent = 'ephemerals'::regclass").Scan(&names).Error
+	if err != nil {
+		return errors.WithMessage(err, "Failed to list ephemeral partitions")
+	}
+	for _, name := range names {
+		var start int32
+		if _, err = fmt.Sscanf(name, partitionPrefix+"%d", &start); err != nil {
+			jww.WARN.Printf("Skipping unrecognized ephemerals partition %s", name)
+			continue
+		}
+		if start+partitionWidth > currentEpoch {
+			continue
+		}
+		jww.DEBUG.Printf("Dropping expired ephemerals partition %s", name)
+		err = d.db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", name)).Error
+		if err != nil {
+			return errors.WithMessagef(err, "Failed to drop partition %s", name)
+		}
+	}
+
+	through := partitionStart(currentEpoch) + partitionsAhead*partitionWidth
+	if through <= d.partitionsThrough {
+		return nil
+	}
+	err = createPartitions(d.db, currentEpoch-partitionWidth, through)
+	if err != nil {
+		return err
+	}
+	d.partitionsThrough = through
+	return nil
+}
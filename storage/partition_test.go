@@ -0,0 +1,41 @@
+package storage
+
+import "testing"
+
+// Tests that partitionStart returns the first epoch of the containing range.
+func Test_partitionStart(t *testing.T) {
+	tests := []struct {
+		epoch, start int32
+	}{
+		{0, 0},
+		{1, 0},
+		{partitionWidth - 1, 0},
+		{partitionWidth, partitionWidth},
+		{3*partitionWidth + 7, 3 * partitionWidth},
+		{-1, -partitionWidth},
+	}
+	for _, tt := range tests {
+		if start := partitionStart(tt.epoch); start != tt.start {
+			t.Errorf("Unexpected start for epoch %d\n\tExpected: %d\n\tReceived: %d",
+				tt.epoch, tt.start, start)
+		}
+	}
+}
+
+// Tests that DeleteOldEphemerals on an unpartitioned database still deletes
+// expired ephemerals.
+func TestDatabaseImpl_DeleteOldEphemerals_Unpartitioned(t *testing.T) {
+	db, err := newDatabaseFromParams(Params{
+		DBName:              "TestDatabaseImpl_DeleteOldEphemerals_Unpartitioned",
+		PartitionEphemerals: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create database: %+v", err)
+	}
+	if db.(*DatabaseImpl).partitioned {
+		t.Fatal("sqlite database should not be partitioned")
+	}
+	if err = db.DeleteOldEphemerals(5); err != nil {
+		t.Errorf("Failed to delete old ephemerals: %+v", err)
+	}
+}
@@ -0,0 +1,55 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Handles routing of read traffic to database read replicas
+
+package storage
+
+import (
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"sync/atomic"
+)
+
+// openReplicas connects to the read replicas with the passed in DSNs.
+func openReplicas(dsns []string, config *gorm.Config) ([]*gorm.DB, error) {
+	replicas := make([]*gorm.DB, 0, len(dsns))
+	for i, dsn := range dsns {
+		db, err := gorm.Open(postgres.Open(dsn), config)
+		if err != nil {
+			return nil, errors.Errorf("Unable to connect to read replica %d: %+v", i, err)
+		}
+		sqlDb, err := db.DB()
+		if err != nil {
+			return nil, errors.Errorf("Unable to configure read replica %d connection pool: %+v", i, err)
+		}
+		sqlDb.SetMaxIdleConns(10)
+		sqlDb.SetMaxOpenConns(50)
+		replicas = append(replicas, db)
+	}
+	return replicas, nil
+}
+
+// read runs the query in fn against the next read replica in turn. If no
+// replica is configured, or the query fails on the replica, it is run against
+// the primary instead. Queries in a transaction always use the primary.
+//
+// Replicas may lag behind the primary, so only reads which tolerate slightly
+// stale results, such as those on the notification path, go through read.
+func (d *DatabaseImpl) read(fn func(db *gorm.DB) error) error {
+	if len(d.replicas) > 0 {
+		i := atomic.AddUint32(&d.nextReplica, 1) % uint32(len(d.replicas))
+		err := fn(d.replicas[i])
+		if err == nil || errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		jww.WARN.Printf("Read from replica %d failed, falling back to primary: %+v", i, err)
+	}
+	return fn(d.db)
+}
@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"testing"
+)
+
+// Tests that reads go to a replica when one is configured and fall back to the
+// primary when the replica fails.
+func TestDatabaseImpl_read(t *testing.T) {
+	primary, err := newDatabase("", "", "TestDatabaseImpl_read_primary", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica, err := newDatabase("", "", "TestDatabaseImpl_read_replica", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := primary.(*DatabaseImpl)
+
+	for _, db := range []database{primary, replica} {
+		err = db.insertIdentity(&Identity{IntermediaryId: []byte("iid"), OffsetNum: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = replica.insertEphemeral(&Ephemeral{IntermediaryId: []byte("iid"), EphemeralId: 5, Epoch: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.replicas = []*gorm.DB{replica.(*DatabaseImpl).db}
+	eph, err := d.GetEphemeral(5)
+	if err != nil || len(eph) != 1 {
+		t.Fatalf("Read should have been served by the replica: %+v", err)
+	}
+
+	// A replica without the schema fails every query
+	broken, err := gorm.Open(sqlite.Open("file:TestDatabaseImpl_read_broken?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.replicas = []*gorm.DB{broken}
+	err = d.insertEphemeral(&Ephemeral{IntermediaryId: []byte("iid"), EphemeralId: 6, Epoch: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	eph, err = d.GetEphemeral(6)
+	if err != nil || len(eph) != 1 {
+		t.Fatalf("Read should have fallen back to the primary: %+v", err)
+	}
+}
@@ -0,0 +1,223 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Brief database blips, such as a dropped connection or a postgres failover,
+// are retried with jittered backoff instead of failing the notification loop.
+// Statements outside of a transaction are retried by wrapping the primary's
+// connection pool, but only if they failed before reaching the database, as a
+// statement whose connection dropped may have been committed. Transactions
+// are retried as a whole on any transient error, since a statement cannot be
+// retried in a transaction postgres has aborted.
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gorm.io/gorm"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// RetryParams configures the retries of transient database errors.
+type RetryParams struct {
+	// Attempts is the number of times an operation is tried; transient
+	// errors are not retried if it is less than 2
+	Attempts int
+	// BaseDelay is the delay before the first retry, doubling with each
+	// further retry up to MaxDelay. Each delay is jittered between half and
+	// all of its value
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// transientSQLStates are the postgres error codes of failures which may
+// succeed if retried. Connection exceptions (class 08) are matched by class.
+var transientSQLStates = map[string]struct{}{
+	"40001": {}, // serialization_failure
+	"40P01": {}, // deadlock_detected
+	"57P01": {}, // admin_shutdown
+	"57P02": {}, // crash_shutdown
+	"57P03": {}, // cannot_connect_now
+}
+
+// unsentSQLStates are the postgres error codes of failures to connect, which
+// are returned before a statement is sent.
+var unsentSQLStates = map[string]struct{}{
+	"08001": {}, // sqlclient_unable_to_establish_sqlconnection
+	"08004": {}, // sqlserver_rejected_establishment_of_sqlconnection
+	"57P03": {}, // cannot_connect_now
+}
+
+// IsTransient returns true if err is a database error which may succeed if
+// the operation is retried, such as a serialization failure or a dropped
+// connection.
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var pgErr interface{ SQLState() string }
+	if errors.As(err, &pgErr) {
+		code := pgErr.SQLState()
+		_, ok := transientSQLStates[code]
+		return ok || strings.HasPrefix(code, "08")
+	}
+	var opErr *net.OpError
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.As(err, &opErr)
+}
+
+// isUnsent returns true if err is a failure to reach the database, after which
+// the statement cannot have run and may be retried on another connection.
+func isUnsent(err error) bool {
+	if err == nil {
+		return false
+	}
+	var pgErr interface{ SQLState() string }
+	if errors.As(err, &pgErr) {
+		_, ok := unsentSQLStates[pgErr.SQLState()]
+		return ok
+	}
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// retry runs fn until it succeeds, fails with an error which is not
+// retryable, the attempts are exhausted or ctx is done, returning the error of
+// the last attempt.
+func (p RetryParams) retry(ctx context.Context, op string, retryable func(error) bool, fn func() error) error {
+	err := fn()
+	for attempt := 1; attempt < p.Attempts && retryable(err); attempt++ {
+		delay := p.delay(attempt)
+		jww.WARN.Printf("Transient database error in %s, retrying in %s (attempt %d of %d): %+v",
+			op, delay, attempt+1, p.Attempts, err)
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+		err = fn()
+	}
+	return err
+}
+
+// delay returns the jittered delay before the passed in retry, counting from 1.
+func (p RetryParams) delay(retry int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < retry && (p.MaxDelay <= 0 || d < p.MaxDelay); i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryingPool is a gorm connection pool retrying statements and transaction
+// starts which fail before reaching the database. Statements run in a
+// transaction use the transaction's connection instead, so are not retried
+// here.
+type retryingPool struct {
+	db     *sql.DB
+	params RetryParams
+}
+
+// newRetryingPool wraps the connection pool of db so its statements are
+// retried with the passed in params.
+func newRetryingPool(db *gorm.DB, params RetryParams) error {
+	sqlDb, err := db.DB()
+	if err != nil {
+		return err
+	}
+	pool := &retryingPool{db: sqlDb, params: params}
+	db.ConnPool = pool
+	db.Statement.ConnPool = pool
+	return nil
+}
+
+func (p *retryingPool) PrepareContext(ctx context.Context, query string) (stmt *sql.Stmt, err error) {
+	err = p.params.retry(ctx, "prepare", isUnsent, func() error {
+		stmt, err = p.db.PrepareContext(ctx, query)
+		return err
+	})
+	return stmt, err
+}
+
+func (p *retryingPool) ExecContext(ctx context.Context, query string, args ...interface{}) (res sql.Result, err error) {
+	err = p.params.retry(ctx, "exec", isUnsent, func() error {
+		res, err = p.db.ExecContext(ctx, query, args...)
+		return err
+	})
+	return res, err
+}
+
+func (p *retryingPool) QueryContext(ctx context.Context, query string, args ...interface{}) (rows *sql.Rows, err error) {
+	err = p.params.retry(ctx, "query", isUnsent, func() error {
+		rows, err = p.db.QueryContext(ctx, query, args...)
+		return err
+	})
+	return rows, err
+}
+
+// QueryRowContext retries if the row's deferred error shows the query was not
+// sent; errors scanning the row are returned as usual.
+func (p *retryingPool) QueryRowContext(ctx context.Context, query string, args ...interface{}) (row *sql.Row) {
+	_ = p.params.retry(ctx, "query", isUnsent, func() error {
+		row = p.db.QueryRowContext(ctx, query, args...)
+		return row.Err()
+	})
+	return row
+}
+
+// BeginTx implements gorm.TxBeginner.
+func (p *retryingPool) BeginTx(ctx context.Context, opts *sql.TxOptions) (tx *sql.Tx, err error) {
+	err = p.params.retry(ctx, "begin", isUnsent, func() error {
+		tx, err = p.db.BeginTx(ctx, opts)
+		return err
+	})
+	return tx, err
+}
+
+// GetDBConn implements gorm.GetDBConnector, so gorm's DB returns the pool.
+func (p *retryingPool) GetDBConn() (*sql.DB, error) {
+	return p.db, nil
+}
+
+// inTransaction runs fn in a transaction, retrying it as a whole if it fails
+// with a transient error. A transaction nested in another is not retried, as
+// the outer transaction must be retried instead.
+func (d *DatabaseImpl) inTransaction(fn func(tx *gorm.DB) error) error {
+	if _, nested := d.db.Statement.ConnPool.(gorm.TxCommitter); nested {
+		return d.db.Transaction(fn)
+	}
+	ctx := d.db.Statement.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return d.retry.retry(ctx, "transaction", IsTransient, func() error {
+		return d.db.Transaction(fn)
+	})
+}
+
+// IsReadOnly returns true if err is postgres refusing a write because the
+// database is read-only, as a replica is until it is promoted.
+func IsReadOnly(err error) bool {
+	var pgErr interface{ SQLState() string }
+	return errors.As(err, &pgErr) && pgErr.SQLState() == "25006"
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"io"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// sqlStateError is an error carrying a postgres error code, as pgconn's
+// PgError does.
+type sqlStateError string
+
+func (e sqlStateError) Error() string    { return "postgres error " + string(e) }
+func (e sqlStateError) SQLState() string { return string(e) }
+
+// Tests that serialization failures, deadlocks, failovers and dropped
+// connections are classified as transient, and other errors are not.
+func Test_isTransient(t *testing.T) {
+	for err, expected := range map[error]bool{
+		sqlStateError("40001"):                          true,
+		sqlStateError("40P01"):                          true,
+		sqlStateError("57P01"):                          true,
+		sqlStateError("08006"):                          true,
+		errors.WithMessage(sqlStateError("40001"), "x"): true,
+		syscall.ECONNRESET:                              true,
+		sqlStateError("23505"):                          false,
+		gorm.ErrRecordNotFound:                          false,
+		context.Canceled:                                false,
+	} {
+		if IsTransient(err) != expected {
+			t.Errorf("IsTransient(%v) should be %t", err, expected)
+		}
+	}
+}
+
+// Tests that only failures to reach the database are classified as unsent, as
+// a statement may have been committed before other errors.
+func Test_isUnsent(t *testing.T) {
+	for err, expected := range map[error]bool{
+		sqlStateError("08001"):                          true,
+		sqlStateError("08004"):                          true,
+		sqlStateError("57P03"):                          true,
+		errors.WithMessage(driver.ErrBadConn, "x"):      true,
+		syscall.ECONNREFUSED:                            true,
+		sqlStateError("08006"):                          false,
+		sqlStateError("40001"):                          false,
+		sqlStateError("57P01"):                          false,
+		syscall.ECONNRESET:                              false,
+		io.ErrUnexpectedEOF:                             false,
+		errors.WithMessage(sqlStateError("23505"), "x"): false,
+	} {
+		if isUnsent(err) != expected {
+			t.Errorf("isUnsent(%v) should be %t", err, expected)
+		}
+	}
+}
+
+// Tests that transient errors are retried up to the number of attempts and
+// other errors are returned at once.
+func TestRetryParams_retry(t *testing.T) {
+	p := RetryParams{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond}
+
+	calls := 0
+	err := p.retry(context.Background(), "test", IsTransient, func() error {
+		calls++
+		return sqlStateError("40001")
+	})
+	if err == nil || calls != 3 {
+		t.Errorf("Expected 3 attempts ending in an error, got %d: %v", calls, err)
+	}
+
+	calls = 0
+	err = p.retry(context.Background(), "test", IsTransient, func() error {
+		calls++
+		if calls == 1 {
+			return syscall.ECONNRESET
+		}
+		return nil
+	})
+	if err != nil || calls != 2 {
+		t.Errorf("Expected success on the second attempt, got %d: %v", calls, err)
+	}
+
+	calls = 0
+	_ = p.retry(context.Background(), "test", IsTransient, func() error {
+		calls++
+		return sqlStateError("23505")
+	})
+	if calls != 1 {
+		t.Errorf("Errors which are not transient should not be retried, got %d attempts", calls)
+	}
+
+	for retry := 1; retry <= 5; retry++ {
+		if d := p.delay(retry); d < time.Millisecond/2 || d > p.MaxDelay {
+			t.Errorf("Delay %s of retry %d is out of bounds", d, retry)
+		}
+	}
+}
@@ -8,58 +8,318 @@
 package storage
 
 import (
+	"context"
 	"fmt"
 	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
 	"gitlab.com/elixxir/crypto/hash"
+	"gitlab.com/elixxir/notifications-bot/clock"
+	"gitlab.com/elixxir/notifications-bot/constants"
+	"gitlab.com/elixxir/notifications-bot/faults"
 	"gitlab.com/xx_network/primitives/id/ephemeral"
 	"gorm.io/gorm"
+	"runtime"
+	"sync"
 	"time"
 )
 
+// IdentityBatchSize is the number of rows read per page when iterating over
+// large identity or user sets.
+const IdentityBatchSize = 1000
+
 type Storage struct {
 	database
 	notificationBuffer *NotificationBuffer
+	clock              clock.Clock
+	// identityKey protects stored intermediary IDs; they are stored in the
+	// clear if nil
+	identityKey *identityKey
+	// tokenKey protects stored tokens and transmission RSA keys; they are
+	// stored in the clear if nil
+	tokenKey *tokenKey
+	// tokenPolicy decides what happens to the registration of a user whose
+	// token is registered by another user
+	tokenPolicy TokenPolicy
+	// ephemerals configures generating the ephemerals of an offset bucket
+	ephemerals EphemeralParams
+}
+
+// Params holds the configuration for the storage backend. If Address or Port
+// is empty, an in-memory sqlite database is used.
+type Params struct {
+	Username string
+	Password string
+	DBName   string
+	Address  string
+	Port     string
+
+	// PartitionEphemerals partitions the ephemerals table by epoch so expired
+	// ephemerals can be dropped a partition at a time (postgres only)
+	PartitionEphemerals bool
+
+	// SkipMigration leaves the schema as it is instead of migrating it on
+	// startup; the database is still checked against the schema and opening
+	// it fails if they differ
+	SkipMigration bool
+
+	// IdentityKey is the IdentityKeySize byte key stored intermediary IDs
+	// are protected with; they are stored in the clear if empty
+	IdentityKey []byte
+
+	// TokenLookupKey is the TokenKeySize byte key stored tokens are keyed by
+	// and TokenKeys are the TokenKeySize byte keys, by ID, tokens and
+	// transmission RSA keys are sealed with; the key with the highest ID seals
+	// new values. They are stored in the clear if TokenLookupKey is empty.
+	TokenLookupKey []byte
+	TokenKeys      map[uint8][]byte
+
+	// ReadReplicas are postgres DSNs of read replicas which serve lookups on
+	// the notification path; the primary is used if a replica fails
+	ReadReplicas []string
+
+	// SlowQueryThreshold is the duration above which queries are logged
+	// with the method which ran them; none are if 0
+	SlowQueryThreshold time.Duration
+
+	// Retry configures the retries of statements and transactions on the
+	// primary which fail with a transient error
+	Retry RetryParams
+
+	// TokenPolicy decides what happens to the registration of a user whose
+	// token is registered by another user; LatestWins if empty
+	TokenPolicy TokenPolicy
+
+	// Ephemerals configures generating the ephemerals of an offset bucket
+	Ephemerals EphemeralParams
+}
+
+// DefaultEphemeralInsertBatch is the number of ephemerals written per INSERT
+// if EphemeralParams.InsertBatch is not set.
+const DefaultEphemeralInsertBatch = 500
+
+// DefaultCreationLead is how far ahead of now the ephemeral of a newly
+// tracked identity's next period is generated if EphemeralParams.CreationLead
+// is not set.
+const DefaultCreationLead = 5 * time.Minute
+
+// EphemeralParams configures generating the ephemerals of an offset bucket.
+type EphemeralParams struct {
+	// Workers is the number of goroutines deriving ephemeral IDs from
+	// intermediary IDs; one per CPU if 0
+	Workers int
+	// InsertBatch is the number of ephemerals written per multi-row INSERT;
+	// DefaultEphemeralInsertBatch if 0
+	InsertBatch int
+	// CreationLead is how far ahead of an offset bucket ephemerals are
+	// generated, so a newly tracked identity whose next period starts within
+	// it is given that period's ephemeral too; DefaultCreationLead if 0
+	CreationLead time.Duration
 }
 
 // NewStorage creates a new Storage object with the given connection parameters
 func NewStorage(username, password, dbName, address, port string) (*Storage, error) {
-	db, err := newDatabase(username, password, dbName, address, port)
+	return NewStorageFromParams(Params{
+		Username: username,
+		Password: password,
+		DBName:   dbName,
+		Address:  address,
+		Port:     port,
+	})
+}
+
+// NewStorageFromParams creates a new Storage object with the given Params
+func NewStorageFromParams(params Params) (*Storage, error) {
+	var key *identityKey
+	if len(params.IdentityKey) > 0 {
+		var err error
+		key, err = newIdentityKey(params.IdentityKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var tk *tokenKey
+	if len(params.TokenLookupKey) > 0 {
+		var err error
+		tk, err = newTokenKey(params.TokenLookupKey, params.TokenKeys)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := params.TokenPolicy.Validate(); err != nil {
+		return nil, err
+	}
+	policy := params.TokenPolicy
+	if policy == "" {
+		policy = LatestWins
+	}
+	db, err := newDatabaseFromParams(params)
 	nb := NewNotificationBuffer()
-	storage := &Storage{db, nb}
+	storage := &Storage{db, nb, clock.Real{}, key, tk, policy, params.Ephemerals}
 	return storage, err
 }
 
-// RegisterToken registers a token to a user based on their transmission RSA
+// SetClock replaces the time source used when generating ephemeral IDs.
+func (s *Storage) SetClock(c clock.Clock) {
+	s.clock = c
+}
+
+// InjectWriteFaults makes database writes fail at the rate set on inj. It is
+// only meant for staging deployments validating failure handling.
+func (s *Storage) InjectWriteFaults(inj *faults.Injector) error {
+	return s.database.injectWriteFaults(inj)
+}
+
+// RegisterToken registers a token to a user based on their transmission RSA.
+// The user is created if it does not exist and the token is upserted, so
+// concurrent registrations from several devices cannot race each other. If the
+// token is registered to other users for the app, the token policy decides
+// whether their registrations are kept or the token is moved to this user.
 func (s *Storage) RegisterToken(token, app string, transmissionRSA []byte) error {
 	transmissionRSAHash, err := getHash(transmissionRSA)
 	if err != nil {
 		return errors.WithMessage(err, "Failed to hash transmisssion RSA")
 	}
 
-	u, err := s.GetUser(transmissionRSAHash)
+	u, err := s.newUser(transmissionRSA, transmissionRSAHash)
 	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			u = &User{
-				TransmissionRSAHash: transmissionRSAHash,
-				TransmissionRSA:     transmissionRSA,
-				Tokens: []Token{
-					{Token: token, TransmissionRSAHash: transmissionRSAHash, App: app},
-				},
-			}
-			return s.insertUser(u)
-		} else {
+		return err
+	}
+	t, err := s.newToken(token, app, transmissionRSAHash)
+	if err != nil {
+		return err
+	}
+
+	return s.database.transaction(func(tx database) error {
+		err := tx.insertUser(u)
+		if err != nil {
+			return errors.WithMessage(err, "Failed to register user")
+		}
+		err = tx.upsertToken(t)
+		if err != nil {
 			return err
 		}
+		return s.resolveSharedToken(tx, t)
+	})
+}
+
+// RegisterFallbackToken registers fallback as a standby token of the user with
+// the passed in RSA and links it to primary, which must already be registered
+// to the same user. The fallback receives no pushes until the primary is
+// permanently rejected by its provider.
+func (s *Storage) RegisterFallbackToken(primary, fallback, app string, transmissionRSA []byte) error {
+	if primary == fallback {
+		return errors.New("A token cannot be its own fallback")
 	}
+	transmissionRSAHash, err := getHash(transmissionRSA)
+	if err != nil {
+		return errors.WithMessage(err, "Failed to hash transmisssion RSA")
+	}
+
+	standby, err := s.newToken(fallback, app, transmissionRSAHash)
+	if err != nil {
+		return err
+	}
+	standby.Standby = true
+	primary = s.storedToken(primary)
 
-	return s.database.insertToken(Token{
-		App:                 app,
-		Token:               token,
-		TransmissionRSAHash: transmissionRSAHash,
+	return s.database.transaction(func(tx database) error {
+		err := tx.upsertToken(standby)
+		if err != nil {
+			return errors.WithMessage(err, "Failed to register fallback token")
+		}
+		err = tx.linkFallbackToken(primary, standby.Token, transmissionRSAHash)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errors.New("Primary token is not registered to the user")
+		}
+		return err
+	})
+}
+
+// PromoteFallbackToken replaces primary with its fallback token for app in the
+// registrations of the user with the passed in transmission RSA hash and
+// returns the promoted token. Both are passed in as stored, as returned by
+// GetToNotify.
+func (s *Storage) PromoteFallbackToken(primary, fallback, app string, transmissionRSAHash []byte) (*Token, error) {
+	promoted, err := s.database.promoteFallbackToken(primary, app, fallback, transmissionRSAHash)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to promote fallback token")
+	}
+	return promoted, nil
+}
+
+// RegisterIdentity registers a token and the tracked IDs for the user with the
+// passed in RSA in a single transaction, so either all of them are stored or
+// none are.
+func (s *Storage) RegisterIdentity(token, app string, transmissionRSA []byte, iidList [][]byte, epoch int32, addressSpace uint8) error {
+	return s.Transaction(func(tx *Storage) error {
+		err := tx.RegisterToken(token, app, transmissionRSA)
+		if err != nil {
+			return errors.WithMessage(err, "Failed to register token")
+		}
+		err = tx.RegisterTrackedID(iidList, transmissionRSA, epoch, addressSpace)
+		if err != nil {
+			return errors.WithMessage(err, "Failed to register tracked IDs")
+		}
+		return nil
+	})
+}
+
+// IterateRegistrars calls fn with successive batches of at most batchSize
+// users whose registrar signature is recorded, with their transmission RSA
+// keys in the clear. It stops at the first error returned by fn.
+func (s *Storage) IterateRegistrars(batchSize int, fn func([]*User) error) error {
+	return s.database.IterateUsers(batchSize, func(users []*User) error {
+		batch := make([]*User, 0, len(users))
+		for _, u := range users {
+			if len(u.RegistrarSig) == 0 {
+				continue
+			}
+			if err := s.openUser(u); err != nil {
+				return errors.WithMessage(err, "Failed to open transmission RSA")
+			}
+			batch = append(batch, u)
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		return fn(batch)
 	})
 }
 
-// UnregisterToken token unregisters a token from the user with the passed in RSA
+// Transaction runs fn against a Storage backed by a single database
+// transaction. If fn returns an error, all writes made through it are
+// rolled back.
+func (s *Storage) Transaction(fn func(tx *Storage) error) error {
+	return s.database.transaction(func(db database) error {
+		return fn(&Storage{db, s.notificationBuffer, s.clock, s.identityKey, s.tokenKey, s.tokenPolicy, s.ephemerals})
+	})
+}
+
+// WithContext returns a Storage whose database queries are cancelled once ctx
+// is done. It shares the notification buffer of s.
+func (s *Storage) WithContext(ctx context.Context) *Storage {
+	return &Storage{s.database.withContext(ctx), s.notificationBuffer, s.clock, s.identityKey, s.tokenKey, s.tokenPolicy, s.ephemerals}
+}
+
+// EnqueueOutbox writes the passed in outbox entries and marks the rounds they
+// were built from as processed in a single transaction, so a batch is either
+// fully handed to the dispatcher or can be processed again.
+func (s *Storage) EnqueueOutbox(entries []*OutboxEntry, rounds []uint64) error {
+	now := outboxTime(s.clock.Now())
+	for _, e := range entries {
+		e.ClaimedUntil = now
+	}
+	return s.database.transaction(func(tx database) error {
+		err := tx.insertOutboxEntries(entries)
+		if err != nil {
+			return errors.WithMessage(err, "Failed to write outbox entries")
+		}
+		return tx.markRoundsProcessed(rounds, now)
+	})
+}
+
+// UnregisterToken token unregisters a token from the user with the passed in
+// RSA, for every app it is registered for
 func (s *Storage) UnregisterToken(token string, transmissionRSA []byte) error {
 	transmissionRSAHash, err := getHash(transmissionRSA)
 	if err != nil {
@@ -74,7 +334,7 @@ func (s *Storage) UnregisterToken(token string, transmissionRSA []byte) error {
 		return nil
 	}
 
-	err = s.database.unregisterTokens(u, []Token{{Token: token}})
+	err = s.database.unregisterTokens(u, []Token{{Token: s.storedToken(token)}})
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return nil
@@ -84,6 +344,53 @@ func (s *Storage) UnregisterToken(token string, transmissionRSA []byte) error {
 	return nil
 }
 
+// UnregisterUser unregisters every token and tracked ID of the user with the
+// passed in RSA in a single transaction. Does not return an error if the user
+// cannot be found.
+func (s *Storage) UnregisterUser(transmissionRSA []byte) error {
+	transmissionRSAHash, err := getHash(transmissionRSA)
+	if err != nil {
+		return errors.WithMessage(err, "Failed to hash transmisssion RSA")
+	}
+
+	return s.Transaction(func(tx *Storage) error {
+		u, err := tx.GetUser(transmissionRSAHash)
+		if err != nil {
+			if !errors.Is(err, gorm.ErrRecordNotFound) {
+				return errors.WithMessage(err, "Failed to retrieve user")
+			}
+			return nil
+		}
+		if len(u.Tokens) > 0 {
+			err = tx.database.unregisterTokens(u, u.Tokens)
+			if err != nil {
+				return errors.WithMessage(err, "Failed to unregister tokens")
+			}
+		}
+		if len(u.Identities) > 0 {
+			err = tx.database.unregisterIdentities(u, u.Identities)
+			if err != nil {
+				return errors.WithMessage(err, "Failed to unregister tracked IDs")
+			}
+		}
+		return nil
+	})
+}
+
+// AddCanary registers the passed in device token as a canary of app.
+func (s *Storage) AddCanary(token, app string) error {
+	t, err := s.newToken(token, app, nil)
+	if err != nil {
+		return err
+	}
+	return s.upsertCanary(&Canary{Token: t.Token, SealedToken: t.SealedToken, App: app, CreatedAt: time.Now()})
+}
+
+// DeleteCanary removes the canary with the passed in device token.
+func (s *Storage) DeleteCanary(token string) error {
+	return s.database.DeleteCanary(s.storedToken(token))
+}
+
 // RegisterTrackedID registers a tracked ID for the user with the passed in RSA
 func (s *Storage) RegisterTrackedID(iidList [][]byte, transmissionRSA []byte, epoch int32, addressSpace uint8) error {
 	transmissionRSAHash, err := getHash(transmissionRSA)
@@ -94,9 +401,9 @@ func (s *Storage) RegisterTrackedID(iidList [][]byte, transmissionRSA []byte, ep
 	u, err := s.GetUser(transmissionRSAHash)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			u = &User{
-				TransmissionRSAHash: transmissionRSAHash,
-				TransmissionRSA:     transmissionRSA,
+			u, err = s.newUser(transmissionRSA, transmissionRSAHash)
+			if err != nil {
+				return err
 			}
 			err = s.insertUser(u)
 			if err != nil {
@@ -112,9 +419,9 @@ func (s *Storage) RegisterTrackedID(iidList [][]byte, transmissionRSA []byte, ep
 		identity, err := s.GetIdentity(iid)
 		if err != nil {
 			if errors.Is(err, gorm.ErrRecordNotFound) {
-				identity = &Identity{
-					IntermediaryId: iid,
-					OffsetNum:      ephemeral.GetOffsetNum(ephemeral.GetOffset(iid)),
+				identity, err = s.newIdentity(iid, ephemeral.GetOffsetNum(ephemeral.GetOffset(iid)))
+				if err != nil {
+					return err
 				}
 				err = s.insertIdentity(identity)
 				if err != nil {
@@ -151,7 +458,7 @@ func (s *Storage) UnregisterTrackedIDs(trackedIdList [][]byte, transmissionRSA [
 
 	var ids []Identity
 	for _, i := range trackedIdList {
-		ids = append(ids, Identity{IntermediaryId: i})
+		ids = append(ids, Identity{IntermediaryId: s.storedID(i)})
 	}
 
 	err = s.database.unregisterIdentities(u, ids)
@@ -164,6 +471,17 @@ func (s *Storage) UnregisterTrackedIDs(trackedIdList [][]byte, transmissionRSA [
 	return nil
 }
 
+// SetIdentityConversation tags the identity with the passed in intermediary
+// ID, which must be tracked by the user with the passed in transmission RSA
+// key, with the conversation its messages belong to.
+func (s *Storage) SetIdentityConversation(iid, transmissionRSA []byte, conversation constants.Conversation) error {
+	trsaHash, err := getHash(transmissionRSA)
+	if err != nil {
+		return errors.WithMessage(err, "Failed to hash transmission RSA")
+	}
+	return s.setIdentityConversation(s.storedID(iid), trsaHash, string(conversation))
+}
+
 // RegisterForNotifications registers a user with the passed in transmissionRSA
 // to receive notifications on the identity with intermediary id iid, with the passed in token
 func (s *Storage) RegisterForNotifications(iid, transmissionRSA []byte, token, app string, epoch int32, addressSpace uint8) (*User, error) {
@@ -174,9 +492,9 @@ func (s *Storage) RegisterForNotifications(iid, transmissionRSA []byte, token, a
 	identity, err := s.GetIdentity(iid)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			identity = &Identity{
-				IntermediaryId: iid,
-				OffsetNum:      ephemeral.GetOffsetNum(ephemeral.GetOffset(iid)),
+			identity, err = s.newIdentity(iid, ephemeral.GetOffsetNum(ephemeral.GetOffset(iid)))
+			if err != nil {
+				return nil, err
 			}
 			err = s.insertIdentity(identity)
 			if err != nil {
@@ -191,29 +509,36 @@ func (s *Storage) RegisterForNotifications(iid, transmissionRSA []byte, token, a
 		}
 	}
 
+	t, err := s.newToken(token, app, transmissionRSAHash)
+	if err != nil {
+		return nil, err
+	}
 	u, err := s.GetUser(transmissionRSAHash)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			u = &User{
-				TransmissionRSAHash: transmissionRSAHash,
-				TransmissionRSA:     transmissionRSA,
-				Tokens: []Token{
-					{Token: token, TransmissionRSAHash: transmissionRSAHash, App: app},
-				}, Identities: []Identity{*identity},
+			u, err = s.newUser(transmissionRSA, transmissionRSAHash)
+			if err != nil {
+				return nil, err
 			}
+			u.Tokens = []Token{*t}
+			u.Identities = []Identity{*identity}
 			return u, s.insertUser(u)
 		} else {
 			return nil, err
 		}
 	}
 
-	return u, s.registerForNotifications(u, *identity, Token{Token: token, App: app, TransmissionRSAHash: transmissionRSAHash})
+	return u, s.registerForNotifications(u, *identity, *t)
 }
 
 // AddLatestEphemeral generates an ephemeral ID for the passed in identity and adds it to storage
 func (s *Storage) AddLatestEphemeral(i *Identity, epoch int32, size uint) (*Ephemeral, error) {
-	now := time.Now()
-	eid, _, _, err := ephemeral.GetIdFromIntermediary(i.IntermediaryId, size, now.UnixNano())
+	iid, err := s.intermediaryID(i)
+	if err != nil {
+		return nil, err
+	}
+	now := s.clock.Now()
+	eid, _, _, err := ephemeral.GetIdFromIntermediary(iid, size, now.UnixNano())
 	if err != nil {
 		return nil, errors.WithMessage(err, "Failed to get ephemeral id for user")
 	}
@@ -228,7 +553,11 @@ func (s *Storage) AddLatestEphemeral(i *Identity, epoch int32, size uint) (*Ephe
 		return nil, err
 	}
 
-	eid2, _, _, err := ephemeral.GetIdFromIntermediary(i.IntermediaryId, size, now.Add(5*time.Minute).UnixNano())
+	lead := s.ephemerals.CreationLead
+	if lead == 0 {
+		lead = DefaultCreationLead
+	}
+	eid2, _, _, err := ephemeral.GetIdFromIntermediary(iid, size, now.Add(lead).UnixNano())
 	if err != nil {
 		return nil, errors.WithMessage(err, "Failed to get ephemeral id for user")
 	}
@@ -249,35 +578,86 @@ func (s *Storage) AddLatestEphemeral(i *Identity, epoch int32, size uint) (*Ephe
 }
 
 // AddEphemeralsForOffset generates new ephemerals for all identities with the given offset, using the passed in parameters
+// Identities are read from storage in batches of IdentityBatchSize so large offsets are never fully loaded into memory.
+// The ephemeral IDs of each batch are derived across the configured workers and written in multi-row INSERTs.
 func (s *Storage) AddEphemeralsForOffset(offset int64, epoch int32, size uint, t time.Time) error {
-	identities, err := s.getIdentitiesByOffset(offset)
-	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
-		return errors.WithMessage(err, "Failed to get users for given offset")
-	}
-	if len(identities) > 0 {
-		fmt.Println(fmt.Sprintf("Adding ephemerals for identities: %+v", identities))
-	}
-	for _, i := range identities {
-		eid, _, _, err := ephemeral.GetIdFromIntermediary(i.IntermediaryId, size, t.UnixNano())
+	err := s.IterateIdentitiesByOffset(offset, IdentityBatchSize, func(identities []*Identity) error {
+		jww.DEBUG.Printf("Adding ephemerals for %d identities with offset %d", len(identities), offset)
+		ephemerals, err := s.deriveEphemerals(identities, epoch, size, t)
 		if err != nil {
-			return errors.WithMessage(err, "Failed to get eid for user")
+			return err
 		}
-		err = s.insertEphemeral(&Ephemeral{
-			IntermediaryId: i.IntermediaryId,
-			EphemeralId:    eid.Int64(),
-			Epoch:          epoch,
-		})
+		insertBatch := s.ephemerals.InsertBatch
+		if insertBatch <= 0 {
+			insertBatch = DefaultEphemeralInsertBatch
+		}
+		err = s.insertEphemerals(ephemerals, insertBatch)
 		if err != nil {
-			return errors.WithMessage(err, "Failed to insert ephemeral ID for user")
+			return errors.WithMessage(err, "Failed to insert ephemeral IDs")
 		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return errors.WithMessage(err, "Failed to add ephemerals for given offset")
 	}
 	return nil
 }
 
+// deriveEphemerals returns the ephemerals of the passed in identities at t,
+// in the same order, sharding the identities across the configured workers.
+func (s *Storage) deriveEphemerals(identities []*Identity, epoch int32, size uint, t time.Time) ([]*Ephemeral, error) {
+	workers := s.ephemerals.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if workers > len(identities) {
+		workers = len(identities)
+	}
+	ephemerals := make([]*Ephemeral, len(identities))
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(identities); i += workers {
+				iid, err := s.intermediaryID(identities[i])
+				if err != nil {
+					errs[w] = err
+					return
+				}
+				eid, _, _, err := ephemeral.GetIdFromIntermediary(iid, size, t.UnixNano())
+				if err != nil {
+					errs[w] = errors.WithMessage(err, "Failed to get eid for user")
+					return
+				}
+				ephemerals[i] = &Ephemeral{
+					IntermediaryId: identities[i].IntermediaryId,
+					EphemeralId:    eid.Int64(),
+					Epoch:          epoch,
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ephemerals, nil
+}
+
 func (s *Storage) GetNotificationBuffer() *NotificationBuffer {
 	return s.notificationBuffer
 }
 
+// HashTransmissionRSA returns the hash used to key users by their
+// transmission RSA public key.
+func HashTransmissionRSA(transmissionRSA []byte) ([]byte, error) {
+	return getHash(transmissionRSA)
+}
+
 func getHash(transmissionRSA []byte) (transmissionRSAHash []byte, err error) {
 	h, err := hash.NewCMixHash()
 	if err != nil {
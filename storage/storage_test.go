@@ -9,11 +9,16 @@
 package storage
 
 import (
+	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
+	"gitlab.com/elixxir/notifications-bot/clock"
 	"gitlab.com/elixxir/notifications-bot/constants"
 	"gitlab.com/xx_network/crypto/csprng"
 	"gitlab.com/xx_network/crypto/signature/rsa"
 	"gitlab.com/xx_network/primitives/id"
 	"gitlab.com/xx_network/primitives/id/ephemeral"
+	"gorm.io/gorm"
 	"testing"
 	"time"
 )
@@ -43,6 +48,168 @@ func TestStorage_RegisterToken(t *testing.T) {
 	}
 }
 
+// Tests that re-registering a token under a new transmission RSA moves it to
+// the new user as a new registration.
+func TestStorage_RegisterToken_Upsert(t *testing.T) {
+	s, err := NewStorage("", "", "TestStorage_RegisterToken_Upsert", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create new storage object: %+v", err)
+	}
+
+	token := "TestToken"
+	app := "HavenIOS"
+	var hashes [][]byte
+	for i := 0; i < 2; i++ {
+		trsaPrivate, err := rsa.GenerateKey(csprng.NewSystemRNG(), 512)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub := rsa.CreatePublicKeyPem(trsaPrivate.GetPublic())
+		err = s.RegisterToken(token, app, pub)
+		if err != nil {
+			t.Fatalf("Failed to register token: %+v", err)
+		}
+		h, err := getHash(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, h)
+	}
+
+	old, err := s.GetUser(hashes[0])
+	if err != nil {
+		t.Fatalf("Failed to get first user: %+v", err)
+	}
+	if len(old.Tokens) != 0 {
+		t.Errorf("Token should have moved off of the first user, found %+v", old.Tokens)
+	}
+	u, err := s.GetUser(hashes[1])
+	if err != nil {
+		t.Fatalf("Failed to get second user: %+v", err)
+	}
+	if len(u.Tokens) != 1 || u.Tokens[0].Version != 1 {
+		t.Errorf("Expected token at version 1 on second user, found %+v", u.Tokens)
+	}
+}
+
+// Tests that when a token is registered under a new identity, the previous
+// identity's registration is removed and its tracked IDs unlinked, and that
+// both registrations are kept under MultiIdentity.
+func TestStorage_RegisterToken_TokenPolicy(t *testing.T) {
+	for _, policy := range []TokenPolicy{LatestWins, MultiIdentity} {
+		s, err := NewStorageFromParams(Params{
+			DBName:      "TestStorage_RegisterToken_TokenPolicy_" + string(policy),
+			TokenPolicy: policy,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create new storage object: %+v", err)
+		}
+
+		var pems, hashes [][]byte
+		for i := 0; i < 2; i++ {
+			trsaPrivate, err := rsa.GenerateKey(csprng.NewSystemRNG(), 512)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pub := rsa.CreatePublicKeyPem(trsaPrivate.GetPublic())
+			h, err := getHash(pub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pems, hashes = append(pems, pub), append(hashes, h)
+		}
+		iid, err := ephemeral.GetIntermediaryId(id.NewIdFromString("abandoned", id.User, t))
+		if err != nil {
+			t.Fatalf("Failed to generate intermediary ID: %+v", err)
+		}
+		_, epoch := ephemeral.HandleQuantization(time.Now())
+		err = s.RegisterIdentity("TestToken", "HavenIOS", pems[0], [][]byte{iid}, epoch, 16)
+		if err != nil {
+			t.Fatalf("Failed to register identity: %+v", err)
+		}
+
+		// Reinstalling the app registers the same token under a new identity
+		err = s.RegisterToken("TestToken", "HavenIOS", pems[1])
+		if err != nil {
+			t.Fatalf("Failed to register token: %+v", err)
+		}
+
+		old, err := s.GetUser(hashes[0])
+		if err != nil {
+			t.Fatalf("Failed to get previous user: %+v", err)
+		}
+		expected := 0
+		if policy == MultiIdentity {
+			expected = 1
+		}
+		if len(old.Identities) != expected || len(old.Tokens) != expected {
+			t.Errorf("%s: expected previous user to keep %d identities and tokens, found %d and %d",
+				policy, expected, len(old.Identities), len(old.Tokens))
+		}
+		u, err := s.GetUser(hashes[1])
+		if err != nil {
+			t.Fatalf("Failed to get new user: %+v", err)
+		}
+		if len(u.Identities) != 0 || len(u.Tokens) != 1 {
+			t.Errorf("%s: expected new user to hold only the token, found %d identities and %d tokens",
+				policy, len(u.Identities), len(u.Tokens))
+		}
+	}
+}
+
+func TestStorage_RegisterFallbackToken(t *testing.T) {
+	s, err := NewStorage("", "", "TestStorage_RegisterFallbackToken", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create new storage object: %+v", err)
+	}
+
+	trsaPrivate, err := rsa.GenerateKey(csprng.NewSystemRNG(), 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := rsa.CreatePublicKeyPem(trsaPrivate.GetPublic())
+	err = s.RegisterToken("primary", "messengerAndroid", pub)
+	if err != nil {
+		t.Fatalf("Failed to register token: %+v", err)
+	}
+
+	err = s.RegisterFallbackToken("unknown", "fallback", "messengerWeb", pub)
+	if err == nil {
+		t.Error("Should not be able to link a fallback to an unregistered token")
+	}
+	err = s.RegisterFallbackToken("primary", "fallback", "messengerWeb", pub)
+	if err != nil {
+		t.Fatalf("Failed to register fallback token: %+v", err)
+	}
+
+	primary, err := s.GetToken("primary", "messengerAndroid")
+	if err != nil {
+		t.Fatalf("Failed to get primary token: %+v", err)
+	}
+	if primary.Fallback != "fallback" {
+		t.Errorf("Primary token not linked to fallback: %+v", primary)
+	}
+	fallback, err := s.GetToken("fallback", "messengerWeb")
+	if err != nil {
+		t.Fatalf("Failed to get fallback token: %+v", err)
+	}
+	if !fallback.Standby {
+		t.Errorf("Fallback token should be on standby: %+v", fallback)
+	}
+
+	promoted, err := s.PromoteFallbackToken("primary", "fallback", "messengerAndroid", primary.TransmissionRSAHash)
+	if err != nil {
+		t.Fatalf("Failed to promote fallback token: %+v", err)
+	}
+	if promoted.Standby || promoted.App != "messengerWeb" {
+		t.Errorf("Unexpected promoted token: %+v", promoted)
+	}
+	_, err = s.GetToken("primary", "messengerAndroid")
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("Primary token should have been deleted, got %+v", err)
+	}
+}
+
 func TestStorage_RegisterTrackedID(t *testing.T) {
 	s, err := NewStorage("", "", "", "", "")
 	if err != nil {
@@ -82,6 +249,81 @@ func TestStorage_RegisterTrackedID(t *testing.T) {
 	}
 }
 
+func TestStorage_RegisterIdentity(t *testing.T) {
+	s, err := NewStorage("", "", "TestStorage_RegisterIdentity", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create new storage object: %+v", err)
+	}
+
+	trsaPrivate, err := rsa.GenerateKey(csprng.NewSystemRNG(), 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := rsa.CreatePublicKeyPem(trsaPrivate.GetPublic())
+	testId, err := id.NewRandomID(csprng.NewSystemRNG(), id.User)
+	if err != nil {
+		t.Fatalf("Failed to generate test ID: %+v", err)
+	}
+	iid, err := ephemeral.GetIntermediaryId(testId)
+	if err != nil {
+		t.Fatalf("Failed to generate intermediary ID: %+v", err)
+	}
+	_, epoch := ephemeral.HandleQuantization(time.Now())
+
+	err = s.RegisterIdentity("TestToken", "HavenIOS", pub, [][]byte{iid}, epoch, 16)
+	if err != nil {
+		t.Fatalf("Failed to register identity: %+v", err)
+	}
+
+	trsaHash, err := getHash(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := s.GetUser(trsaHash)
+	if err != nil {
+		t.Fatalf("Failed to get registered user: %+v", err)
+	}
+	if len(u.Tokens) != 1 || len(u.Identities) != 1 {
+		t.Errorf("Expected one token and one identity, received %d tokens and %d identities",
+			len(u.Tokens), len(u.Identities))
+	}
+}
+
+// Tests that writes made through Storage.Transaction are rolled back when the
+// passed in function returns an error.
+func TestStorage_Transaction_Rollback(t *testing.T) {
+	s, err := NewStorage("", "", "TestStorage_Transaction_Rollback", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create new storage object: %+v", err)
+	}
+
+	trsaPrivate, err := rsa.GenerateKey(csprng.NewSystemRNG(), 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := rsa.CreatePublicKeyPem(trsaPrivate.GetPublic())
+
+	err = s.Transaction(func(tx *Storage) error {
+		err := tx.RegisterToken("TestToken", "HavenIOS", pub)
+		if err != nil {
+			t.Fatalf("Failed to register token in transaction: %+v", err)
+		}
+		return errors.New("verification failed")
+	})
+	if err == nil {
+		t.Fatal("Expected error from transaction")
+	}
+
+	trsaHash, err := getHash(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.GetUser(trsaHash)
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("User should not exist after rollback, received error: %+v", err)
+	}
+}
+
 func TestStorage_UnregisterToken(t *testing.T) {
 	s, err := NewStorage("", "", "", "", "")
 	if err != nil {
@@ -156,6 +398,59 @@ func TestStorage_UnregisterToken(t *testing.T) {
 
 }
 
+// Tests that UnregisterUser removes every token and tracked ID of the user but
+// leaves other users' registrations alone.
+func TestStorage_UnregisterUser(t *testing.T) {
+	s, err := NewStorage("", "", "TestStorage_UnregisterUser", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create new storage object: %+v", err)
+	}
+	iid, err := ephemeral.GetIntermediaryId(id.NewIdFromString("zezima", id.User, t))
+	if err != nil {
+		t.Fatalf("Failed to create iid: %+v", err)
+	}
+	pub, other := []byte("transmissionRSA"), []byte("otherRSA")
+
+	err = s.UnregisterUser(pub)
+	if err != nil {
+		t.Fatalf("Received error on unregister with nothing inserted: %+v", err)
+	}
+
+	for _, token := range []string{"token1", "token2"} {
+		if err = s.RegisterToken(token, "HavenIOS", pub); err != nil {
+			t.Fatalf("Failed to register token: %+v", err)
+		}
+	}
+	if err = s.RegisterToken("otherToken", "HavenIOS", other); err != nil {
+		t.Fatalf("Failed to register token: %+v", err)
+	}
+	for _, trsa := range [][]byte{pub, other} {
+		if err = s.RegisterTrackedID([][]byte{iid}, trsa, 0, 8); err != nil {
+			t.Fatalf("Failed to register tracked ID: %+v", err)
+		}
+	}
+
+	err = s.UnregisterUser(pub)
+	if err != nil {
+		t.Fatalf("Failed to unregister user: %+v", err)
+	}
+
+	for trsa, expected := range map[string]int{string(pub): 0, string(other): 1} {
+		trsaHash, err := getHash([]byte(trsa))
+		if err != nil {
+			t.Fatalf("Failed to get trsa hash: %+v", err)
+		}
+		u, err := s.GetUser(trsaHash)
+		if err != nil {
+			t.Fatalf("Failed to get user: %+v", err)
+		}
+		if len(u.Tokens) != expected || len(u.Identities) != expected {
+			t.Errorf("Expected %d tokens and tracked IDs for %s, found %d and %d",
+				expected, trsa, len(u.Tokens), len(u.Identities))
+		}
+	}
+}
+
 func TestStorage_UnregisterTrackedID(t *testing.T) {
 	s, err := NewStorage("", "", "", "", "")
 	if err != nil {
@@ -309,9 +604,336 @@ func TestStorage_AddLatestEphemeral(t *testing.T) {
 	}
 }
 
+// Tests that the ephemeral of a newly tracked identity's next period is only
+// added when the period starts within the configured creation lead.
+func TestStorage_AddLatestEphemeral_CreationLead(t *testing.T) {
+	iid, err := ephemeral.GetIntermediaryId(id.NewIdFromString("zezima", id.User, t))
+	if err != nil {
+		t.Fatalf("Failed to create iid: %+v", err)
+	}
+	_, _, end, err := ephemeral.GetIdFromIntermediary(iid, 16, time.Now().UnixNano())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for lead, expected := range map[time.Duration]int{0: 1, 2 * time.Hour: 2} {
+		s, err := NewStorageFromParams(Params{
+			DBName:     fmt.Sprintf("TestStorage_AddLatestEphemeral_CreationLead%s", lead),
+			Ephemerals: EphemeralParams{CreationLead: lead},
+		})
+		if err != nil {
+			t.Fatalf("Failed to create new storage object: %+v", err)
+		}
+		s.SetClock(clock.NewFake(end.Add(-time.Hour)))
+		ident := &Identity{IntermediaryId: iid, OffsetNum: ephemeral.GetOffsetNum(ephemeral.GetOffset(iid))}
+		if err = s.insertIdentity(ident); err != nil {
+			t.Fatalf("Failed to add identity: %+v", err)
+		}
+		if _, err = s.AddLatestEphemeral(ident, 5, 16); err != nil {
+			t.Fatalf("Failed to add latest ephemeral: %+v", err)
+		}
+		var count int64
+		if err = s.database.(*DatabaseImpl).db.Model(&Ephemeral{}).Count(&count).Error; err != nil {
+			t.Fatal(err)
+		}
+		if count != int64(expected) {
+			t.Errorf("Expected %d ephemerals with a creation lead of %s, got %d", expected, lead, count)
+		}
+	}
+}
+
+// Tests that every identity in the offset bucket gets its ephemeral when they
+// are derived across several workers and written in several INSERTs.
 func TestStorage_AddEphemeralsForOffset(t *testing.T) {
-	_, err := NewStorage("", "", "", "", "")
+	s, err := NewStorageFromParams(Params{
+		DBName:     "TestStorage_AddEphemeralsForOffset",
+		Ephemerals: EphemeralParams{Workers: 3, InsertBatch: 2},
+	})
 	if err != nil {
-		t.Errorf("Failed to create new storage object: %+v", err)
+		t.Fatalf("Failed to create new storage object: %+v", err)
+	}
+	const offset = 7
+	var iids [][]byte
+	for i := 0; i < 7; i++ {
+		testId, err := id.NewRandomID(csprng.NewSystemRNG(), id.User)
+		if err != nil {
+			t.Fatalf("Failed to generate test ID: %+v", err)
+		}
+		iid, err := ephemeral.GetIntermediaryId(testId)
+		if err != nil {
+			t.Fatalf("Failed to generate intermediary ID: %+v", err)
+		}
+		ident, err := s.newIdentity(iid, offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = s.insertIdentity(ident); err != nil {
+			t.Fatalf("Failed to add identity: %+v", err)
+		}
+		iids = append(iids, iid)
+	}
+
+	now := time.Now()
+	if err = s.AddEphemeralsForOffset(offset, 5, 16, now); err != nil {
+		t.Fatalf("Failed to add ephemerals: %+v", err)
+	}
+	for _, iid := range iids {
+		eid, _, _, err := ephemeral.GetIdFromIntermediary(iid, 16, now.UnixNano())
+		if err != nil {
+			t.Fatal(err)
+		}
+		found, err := s.GetEphemeral(eid.Int64())
+		if err != nil {
+			t.Fatalf("Failed to get ephemeral of identity %v: %+v", iid, err)
+		}
+		matched := false
+		for _, e := range found {
+			matched = matched || (bytes.Equal(e.IntermediaryId, iid) && e.Epoch == 5)
+		}
+		if !matched {
+			t.Errorf("No ephemeral added for identity %v: %+v", iid, found)
+		}
+	}
+}
+
+// Tests that blocked users are left out of token lookups and broadcasts until
+// they are unblocked.
+func TestStorage_BlockUser(t *testing.T) {
+	s, err := NewStorage("", "", "TestStorage_BlockUser", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create new storage object: %+v", err)
+	}
+	trsaPrivate, err := rsa.GenerateKey(csprng.NewSystemRNG(), 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := rsa.CreatePublicKeyPem(trsaPrivate.GetPublic())
+	trsaHash, err := HashTransmissionRSA(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testId, err := id.NewRandomID(csprng.NewSystemRNG(), id.User)
+	if err != nil {
+		t.Fatalf("Failed to generate test ID: %+v", err)
+	}
+	iid, err := ephemeral.GetIntermediaryId(testId)
+	if err != nil {
+		t.Fatalf("Failed to generate intermediary ID: %+v", err)
+	}
+	_, epoch := ephemeral.HandleQuantization(time.Now())
+	if err = s.RegisterToken("token", "app", pub); err != nil {
+		t.Fatalf("Failed to register token: %+v", err)
+	}
+	if err = s.RegisterTrackedID([][]byte{iid}, pub, epoch, 16); err != nil {
+		t.Fatalf("Failed to register tracked ID: %+v", err)
+	}
+	eid, _, _, err := ephemeral.GetIdFromIntermediary(iid, 16, time.Now().UnixNano())
+	if err != nil {
+		t.Fatal(err)
+	}
+	notified := func() int {
+		res, err := s.GetToNotify([]int64{eid.Int64()})
+		if err != nil {
+			t.Fatalf("Failed to get tokens to notify: %+v", err)
+		}
+		count, err := s.CountActiveTokens("app")
+		if err != nil {
+			t.Fatalf("Failed to count tokens: %+v", err)
+		}
+		if int64(len(res)) != count {
+			t.Errorf("Lookup found %d tokens but broadcasts count %d", len(res), count)
+		}
+		return len(res)
+	}
+
+	if err = s.BlockUser(&BlockedUser{TransmissionRsaHash: trsaHash, Reason: "test", CreatedAt: time.Now()}); err != nil {
+		t.Fatalf("Failed to block user: %+v", err)
+	}
+	if err = s.BlockUser(&BlockedUser{TransmissionRsaHash: trsaHash, Reason: "abuse", CreatedAt: time.Now()}); err != nil {
+		t.Fatalf("Blocking a user twice should update the reason: %+v", err)
+	}
+	blocked, err := s.IsUserBlocked(trsaHash)
+	if err != nil || !blocked {
+		t.Errorf("User should be blocked: %+v", err)
+	}
+	list, err := s.GetBlockedUsers()
+	if err != nil || len(list) != 1 || list[0].Reason != "abuse" {
+		t.Errorf("Unexpected blocklist %+v: %+v", list, err)
+	}
+	if n := notified(); n != 0 {
+		t.Errorf("Blocked user should not be notified, got %d tokens", n)
+	}
+
+	if err = s.UnblockUser(trsaHash); err != nil {
+		t.Fatalf("Failed to unblock user: %+v", err)
+	}
+	if n := notified(); n != 1 {
+		t.Errorf("Unblocked user should be notified, got %d tokens", n)
+	}
+	if err = s.UnblockUser(trsaHash); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("Unblocking a user who is not blocked should not be found, got %+v", err)
+	}
+}
+
+// Tests that quarantined users are left out of token lookups and broadcasts
+// until their registrar signature is recorded again.
+func TestStorage_SetUserQuarantined(t *testing.T) {
+	s, err := NewStorage("", "", "TestStorage_SetUserQuarantined", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create new storage object: %+v", err)
+	}
+	trsaPrivate, err := rsa.GenerateKey(csprng.NewSystemRNG(), 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := rsa.CreatePublicKeyPem(trsaPrivate.GetPublic())
+	trsaHash, err := HashTransmissionRSA(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testId, err := id.NewRandomID(csprng.NewSystemRNG(), id.User)
+	if err != nil {
+		t.Fatalf("Failed to generate test ID: %+v", err)
+	}
+	iid, err := ephemeral.GetIntermediaryId(testId)
+	if err != nil {
+		t.Fatalf("Failed to generate intermediary ID: %+v", err)
+	}
+	_, epoch := ephemeral.HandleQuantization(time.Now())
+	if err = s.RegisterToken("token", "app", pub); err != nil {
+		t.Fatalf("Failed to register token: %+v", err)
+	}
+	if err = s.RegisterTrackedID([][]byte{iid}, pub, epoch, 16); err != nil {
+		t.Fatalf("Failed to register tracked ID: %+v", err)
+	}
+	if err = s.SetUserRegistrar(trsaHash, 5, []byte("sig")); err != nil {
+		t.Fatalf("Failed to set registrar: %+v", err)
+	}
+	eid, _, _, err := ephemeral.GetIdFromIntermediary(iid, 16, time.Now().UnixNano())
+	if err != nil {
+		t.Fatal(err)
+	}
+	notified := func() (int, int64) {
+		res, err := s.GetToNotify([]int64{eid.Int64()})
+		if err != nil {
+			t.Fatalf("Failed to get tokens to notify: %+v", err)
+		}
+		count, err := s.CountActiveTokens("app")
+		if err != nil {
+			t.Fatalf("Failed to count tokens: %+v", err)
+		}
+		return len(res), count
+	}
+
+	var registrars []*User
+	err = s.IterateRegistrars(10, func(users []*User) error {
+		registrars = append(registrars, users...)
+		return nil
+	})
+	if err != nil || len(registrars) != 1 || !bytes.Equal(registrars[0].TransmissionRSA, pub) ||
+		registrars[0].RegistrationTimestamp != 5 {
+		t.Fatalf("Expected the user's registrar to be iterated, got %+v: %+v", registrars, err)
+	}
+
+	if err = s.SetUserQuarantined(trsaHash, true); err != nil {
+		t.Fatalf("Failed to quarantine user: %+v", err)
+	}
+	if n, count := notified(); n != 0 || count != 0 {
+		t.Errorf("Quarantined user should not be notified, got %d tokens and %d active", n, count)
+	}
+	if count, err := s.CountQuarantinedUsers(); err != nil || count != 1 {
+		t.Errorf("Expected 1 quarantined user, got %d: %+v", count, err)
+	}
+
+	if err = s.SetUserRegistrar(trsaHash, 6, []byte("sig")); err != nil {
+		t.Fatalf("Failed to set registrar: %+v", err)
+	}
+	if n, count := notified(); n != 1 || count != 1 {
+		t.Errorf("User should be notified once they register again, got %d tokens and %d active", n, count)
+	}
+	if err = s.SetUserQuarantined([]byte("unknown"), true); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("Quarantining an unknown user should not be found, got %+v", err)
+	}
+}
+
+// Tests that held digest counts accumulate per registration and are cleared
+// once taken.
+func TestStorage_TakeDigests(t *testing.T) {
+	s, err := NewStorage("", "", "TestStorage_TakeDigests", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create new storage object: %+v", err)
+	}
+	if err = s.RegisterToken("token", "app", []byte("trsa")); err != nil {
+		t.Fatalf("Failed to register token: %+v", err)
+	}
+	trsaHash, err := HashTransmissionRSA([]byte("trsa"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SetUserDigest(trsaHash, true); err != nil {
+		t.Fatalf("Failed to turn on digest mode: %+v", err)
+	}
+	if u, err := s.GetUser(trsaHash); err != nil || !u.Digest {
+		t.Errorf("User should be in digest mode: %+v", err)
+	}
+	if err = s.SetUserDigest([]byte("unknown"), true); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("Setting digest mode of an unknown user should not be found, got %+v", err)
+	}
+
+	for i, owner := range [][]byte{trsaHash, trsaHash, []byte("other")} {
+		err = s.AddToDigest(&DigestEntry{
+			Token:               "token",
+			App:                 "app",
+			TransmissionRsaHash: owner,
+			Target:              GTNResult{Token: "token", App: "app", TransmissionRSAHash: owner},
+			Count:               3,
+			HeldSince:           time.Now().Add(time.Duration(i) * time.Second),
+		})
+		if err != nil {
+			t.Fatalf("Failed to hold notifications: %+v", err)
+		}
+	}
+	entries, err := s.TakeDigests()
+	if err != nil {
+		t.Fatalf("Failed to take digests: %+v", err)
+	}
+	if len(entries) != 2 || entries[0].Count != 6 || entries[0].Target.App != "app" {
+		t.Errorf("Expected the user's entry to hold 6 notifications, got %+v", entries)
+	}
+	if len(entries) == 2 && (entries[1].Count != 3 || string(entries[1].TransmissionRsaHash) != "other") {
+		t.Errorf("Another user's registration of the token should be held apart, got %+v", entries[1])
+	}
+	entries, err = s.TakeDigests()
+	if err != nil || len(entries) != 0 {
+		t.Errorf("Taken digests should be cleared, got %+v: %+v", entries, err)
+	}
+}
+
+// Tests that only the most recent push events of each user are kept.
+func TestStorage_InsertPushEvent(t *testing.T) {
+	s, err := NewStorage("", "", "TestStorage_InsertPushEvent", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create new storage object: %+v", err)
+	}
+	for i := 0; i < 5; i++ {
+		for _, user := range []string{"user", "other"} {
+			err = s.InsertPushEvent(&PushEvent{
+				TransmissionRSAHash: []byte(user),
+				App:                 "app",
+				Rounds:              []uint64{uint64(i)},
+				Timestamp:           time.Now(),
+			}, 3)
+			if err != nil {
+				t.Fatalf("Failed to insert push event: %+v", err)
+			}
+		}
+	}
+	for _, user := range []string{"user", "other"} {
+		history, err := s.GetPushHistory([]byte(user))
+		if err != nil {
+			t.Fatalf("Failed to get push history: %+v", err)
+		}
+		if len(history) != 3 || history[0].Rounds[0] != 4 || history[2].Rounds[0] != 2 {
+			t.Errorf("Expected the 3 most recent pushes of %s, got %+v", user, history)
+		}
 	}
 }
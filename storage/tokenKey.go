@@ -0,0 +1,338 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"io"
+)
+
+// TokenKeySize is the size in bytes of the keys tokens and transmission RSA
+// keys are protected with.
+const TokenKeySize = 32
+
+// sealedMarker is the first byte of values sealed with a token key. A PEM
+// encoded key cannot start with it, so sealed and plaintext transmission RSA
+// keys can be told apart.
+const sealedMarker = 0x00
+
+// tokenKey protects stored device tokens and transmission RSA keys. Tokens are
+// stored under an HMAC of their value, so they can still be looked up when a
+// client unregisters, and the token itself is sealed alongside it. Sealed
+// values are prefixed with the ID of the key which sealed them, so keys can be
+// rotated: new values are sealed with the current key, older keys are only
+// used to open values until they are re-encrypted.
+//
+// The lookup key cannot be rotated, as stored tokens are keyed by it.
+type tokenKey struct {
+	lookup  []byte
+	current uint8
+	keys    map[uint8]cipher.AEAD
+}
+
+// newTokenKey builds a tokenKey from the passed in lookup key and sealing keys.
+// The sealing key with the highest ID is used to seal new values.
+func newTokenKey(lookup []byte, keys map[uint8][]byte) (*tokenKey, error) {
+	if len(lookup) != TokenKeySize {
+		return nil, errors.Errorf("token lookup key must be %d bytes, received %d", TokenKeySize, len(lookup))
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("at least one token encryption key is required")
+	}
+	k := &tokenKey{lookup: lookup, keys: make(map[uint8]cipher.AEAD, len(keys))}
+	for keyID, key := range keys {
+		if len(key) != TokenKeySize {
+			return nil, errors.Errorf("token encryption key %d must be %d bytes, received %d", keyID, TokenKeySize, len(key))
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, errors.WithMessagef(err, "Failed to create cipher for token encryption key %d", keyID)
+		}
+		k.keys[keyID] = aead
+		if keyID > k.current {
+			k.current = keyID
+		}
+	}
+	return k, nil
+}
+
+// newAEAD returns an AES-GCM cipher using the passed in key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// pseudonym returns the value the passed in token is stored under.
+func (k *tokenKey) pseudonym(token string) string {
+	mac := hmac.New(sha256.New, k.lookup)
+	mac.Write([]byte(token))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// seal encrypts plaintext with the current key, binding it to ad.
+func (k *tokenKey) seal(plaintext, ad []byte) ([]byte, error) {
+	aead := k.keys[k.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.WithMessage(err, "Failed to generate nonce")
+	}
+	return aead.Seal(append([]byte{sealedMarker, k.current}, nonce...), nonce, plaintext, ad), nil
+}
+
+// open decrypts a value sealed with any of the configured keys.
+func (k *tokenKey) open(sealed, ad []byte) ([]byte, error) {
+	if !isSealed(sealed) || len(sealed) < 2 {
+		return nil, errors.New("value is not sealed")
+	}
+	aead, ok := k.keys[sealed[1]]
+	if !ok {
+		return nil, errors.Errorf("value is sealed with unknown token encryption key %d", sealed[1])
+	}
+	body := sealed[2:]
+	if len(body) < aead.NonceSize() {
+		return nil, errors.New("sealed value is too short")
+	}
+	plaintext, err := aead.Open(nil, body[:aead.NonceSize()], body[aead.NonceSize():], ad)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Failed to open sealed value")
+	}
+	return plaintext, nil
+}
+
+// isCurrent returns true if the passed in value is sealed with the current key.
+func (k *tokenKey) isCurrent(sealed []byte) bool {
+	return isSealed(sealed) && len(sealed) > 1 && sealed[1] == k.current
+}
+
+// isSealed returns true if the passed in value was sealed with a token key.
+func isSealed(b []byte) bool {
+	return len(b) > 0 && b[0] == sealedMarker
+}
+
+// storedToken returns the value the passed in token is stored under: its
+// pseudonym if tokens are protected, otherwise the token itself.
+func (s *Storage) storedToken(token string) string {
+	if s.tokenKey == nil {
+		return token
+	}
+	return s.tokenKey.pseudonym(token)
+}
+
+// newToken builds the token stored for the passed in device token.
+func (s *Storage) newToken(token, app string, transmissionRSAHash []byte) (*Token, error) {
+	t := &Token{Token: s.storedToken(token), App: app, TransmissionRSAHash: transmissionRSAHash}
+	if s.tokenKey != nil {
+		var err error
+		t.SealedToken, err = s.tokenKey.seal([]byte(token), []byte(t.Token))
+		if err != nil {
+			return nil, errors.WithMessage(err, "Failed to seal token")
+		}
+	}
+	return t, nil
+}
+
+// newUser builds the user stored for the passed in transmission RSA key.
+func (s *Storage) newUser(transmissionRSA, transmissionRSAHash []byte) (*User, error) {
+	u := &User{TransmissionRSAHash: transmissionRSAHash, TransmissionRSA: transmissionRSA}
+	if s.tokenKey != nil {
+		var err error
+		u.TransmissionRSA, err = s.tokenKey.seal(transmissionRSA, transmissionRSAHash)
+		if err != nil {
+			return nil, errors.WithMessage(err, "Failed to seal transmission RSA")
+		}
+	}
+	return u, nil
+}
+
+// openUser replaces the sealed transmission RSA key of the passed in user with
+// its plaintext.
+func (s *Storage) openUser(u *User) error {
+	if !isSealed(u.TransmissionRSA) {
+		return nil
+	}
+	if s.tokenKey == nil {
+		return errors.New("transmission RSA is sealed but no token key is configured")
+	}
+	rsa, err := s.tokenKey.open(u.TransmissionRSA, u.TransmissionRSAHash)
+	if err != nil {
+		return err
+	}
+	u.TransmissionRSA = rsa
+	return nil
+}
+
+// OpenToken returns target with its token replaced by the device token it was
+// stored for, so it can be handed to a provider. Targets which were queued
+// without their sealed token, such as dead letters, are looked up.
+func (s *Storage) OpenToken(target GTNResult) (GTNResult, error) {
+	if s.tokenKey == nil {
+		return target, nil
+	}
+	sealed := target.SealedToken
+	if len(sealed) == 0 {
+		t, err := s.database.GetToken(target.Token, target.App)
+		if err != nil {
+			return target, errors.WithMessage(err, "Failed to look up sealed token")
+		}
+		if len(t.SealedToken) == 0 {
+			// Stored before token encryption was enabled
+			return target, nil
+		}
+		sealed = t.SealedToken
+	}
+	token, err := s.tokenKey.open(sealed, []byte(target.Token))
+	if err != nil {
+		return target, err
+	}
+	target.Token = string(token)
+	target.SealedToken = nil
+	return target, nil
+}
+
+// TokensEncrypted returns true if tokens and transmission RSA keys are sealed
+// with a token key.
+func (s *Storage) TokensEncrypted() bool {
+	return s.tokenKey != nil
+}
+
+// SealRecord seals a record kept outside of the database, such as a buffered
+// registration, with the current token key, binding it to ad.
+func (s *Storage) SealRecord(record, ad []byte) ([]byte, error) {
+	if s.tokenKey == nil {
+		return nil, errors.New("no token key is configured")
+	}
+	return s.tokenKey.seal(record, ad)
+}
+
+// OpenRecord opens a record sealed by SealRecord with the passed in ad.
+func (s *Storage) OpenRecord(sealed, ad []byte) ([]byte, error) {
+	if s.tokenKey == nil {
+		return nil, errors.New("record is sealed but no token key is configured")
+	}
+	return s.tokenKey.open(sealed, ad)
+}
+
+// SetTokenPriority sets the priority tier of the passed in device token as
+// registered for app by the user with the passed in transmission RSA hash.
+func (s *Storage) SetTokenPriority(token, app string, transmissionRSAHash []byte, priority string) error {
+	return s.database.SetTokenPriority(s.storedToken(token), app, transmissionRSAHash, priority)
+}
+
+// SetTokenSound sets the notification channel and sound of the passed in
+// device token as registered for app by the user with the passed in
+// transmission RSA hash.
+func (s *Storage) SetTokenSound(token, app string, transmissionRSAHash []byte, channelID, sound string) error {
+	return s.database.SetTokenSound(s.storedToken(token), app, transmissionRSAHash, channelID, sound)
+}
+
+// SetTokenLocale sets the locale of the passed in device token as registered
+// for app by the user with the passed in transmission RSA hash.
+func (s *Storage) SetTokenLocale(token, app string, transmissionRSAHash []byte, locale string) error {
+	return s.database.SetTokenLocale(s.storedToken(token), app, transmissionRSAHash, locale)
+}
+
+// SetTokenPrivacy sets the privacy level of the passed in device token as
+// registered for app by the user with the passed in transmission RSA hash.
+func (s *Storage) SetTokenPrivacy(token, app string, transmissionRSAHash []byte, privacy string) error {
+	return s.database.SetTokenPrivacy(s.storedToken(token), app, transmissionRSAHash, privacy)
+}
+
+// SetTokenProvenance records the platform and versions the passed in device
+// token was last registered from for app by the user with the passed in
+// transmission RSA hash.
+func (s *Storage) SetTokenProvenance(token, app string, transmissionRSAHash []byte, provenance TokenProvenance) error {
+	return s.database.SetTokenProvenance(s.storedToken(token), app, transmissionRSAHash, provenance)
+}
+
+// RestoreToken clears the tombstone of the passed in unregistered device token
+// as registered for app by the user with the passed in transmission RSA hash.
+func (s *Storage) RestoreToken(token, app string, transmissionRSAHash []byte) error {
+	return s.database.RestoreToken(s.storedToken(token), app, transmissionRSAHash)
+}
+
+// ReencryptTokens seals every stored token and transmission RSA key which is
+// stored in the clear or sealed with an older key using the current key,
+// moving plaintext tokens under their pseudonym. It returns the number of rows
+// rewritten, and is a no-op if no token key is configured.
+func (s *Storage) ReencryptTokens() (int, error) {
+	if s.tokenKey == nil {
+		return 0, nil
+	}
+	rewritten := 0
+	after := &Token{}
+	for {
+		batch, err := s.getTokensAfter(after, IdentityBatchSize)
+		if err != nil {
+			return rewritten, errors.WithMessage(err, "Failed to get stored tokens")
+		}
+		if len(batch) == 0 {
+			break
+		}
+		for _, t := range batch {
+			after = &Token{Token: t.Token, App: t.App, TransmissionRSAHash: t.TransmissionRSAHash}
+			if s.tokenKey.isCurrent(t.SealedToken) {
+				continue
+			}
+			token := t.Token
+			if len(t.SealedToken) > 0 {
+				opened, err := s.tokenKey.open(t.SealedToken, []byte(t.Token))
+				if err != nil {
+					return rewritten, errors.WithMessage(err, "Failed to open stored token")
+				}
+				token = string(opened)
+			}
+			updated, err := s.newToken(token, t.App, t.TransmissionRSAHash)
+			if err != nil {
+				return rewritten, err
+			}
+			t.Token, t.SealedToken = updated.Token, updated.SealedToken
+			err = s.rekeyToken(after.Token, t)
+			if err != nil {
+				return rewritten, errors.WithMessage(err, "Failed to re-encrypt token")
+			}
+			rewritten++
+		}
+	}
+
+	err := s.IterateUsers(IdentityBatchSize, func(users []*User) error {
+		for _, u := range users {
+			if s.tokenKey.isCurrent(u.TransmissionRSA) {
+				continue
+			}
+			if err := s.openUser(u); err != nil {
+				return errors.WithMessage(err, "Failed to open stored transmission RSA")
+			}
+			updated, err := s.newUser(u.TransmissionRSA, u.TransmissionRSAHash)
+			if err != nil {
+				return err
+			}
+			if err = s.updateTransmissionRSA(updated); err != nil {
+				return errors.WithMessage(err, "Failed to re-encrypt transmission RSA")
+			}
+			rewritten++
+		}
+		return nil
+	})
+	if err != nil {
+		return rewritten, err
+	}
+	if rewritten > 0 {
+		jww.INFO.Printf("Re-encrypted %d stored tokens and transmission RSA keys with key %d", rewritten, s.tokenKey.current)
+	}
+	return rewritten, nil
+}
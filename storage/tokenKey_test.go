@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"gitlab.com/xx_network/crypto/csprng"
+	"gitlab.com/xx_network/crypto/signature/rsa"
+	"gitlab.com/xx_network/primitives/id"
+	"gitlab.com/xx_network/primitives/id/ephemeral"
+	"gorm.io/gorm"
+	"testing"
+	"time"
+)
+
+// Tests that with a token key, tokens are stored under their pseudonym and
+// sealed along with transmission RSA keys, while registration, lookups and
+// admin operations still take the device token.
+func TestStorage_TokenKey(t *testing.T) {
+	lookup := bytes.Repeat([]byte{1}, TokenKeySize)
+	s, err := NewStorageFromParams(Params{
+		DBName:         "TestStorage_TokenKey",
+		TokenLookupKey: lookup,
+		TokenKeys:      map[uint8][]byte{1: bytes.Repeat([]byte{2}, TokenKeySize)},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+
+	trsaPrivate, err := rsa.GenerateKey(csprng.NewSystemRNG(), 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := rsa.CreatePublicKeyPem(trsaPrivate.GetPublic())
+	testId, err := id.NewRandomID(csprng.NewSystemRNG(), id.User)
+	if err != nil {
+		t.Fatalf("Failed to generate test ID: %+v", err)
+	}
+	iid, err := ephemeral.GetIntermediaryId(testId)
+	if err != nil {
+		t.Fatalf("Failed to generate intermediary ID: %+v", err)
+	}
+	_, epoch := ephemeral.HandleQuantization(time.Now())
+
+	if err = s.RegisterToken("devicetoken", "app", pub); err != nil {
+		t.Fatalf("Failed to register token: %+v", err)
+	}
+	if err = s.RegisterTrackedID([][]byte{iid}, pub, epoch, 16); err != nil {
+		t.Fatalf("Failed to register tracked ID: %+v", err)
+	}
+
+	if _, err = s.GetToken("devicetoken", "app"); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("Token should not be stored in the clear: %+v", err)
+	}
+	stored, err := s.GetToken(s.storedToken("devicetoken"), "app")
+	if err != nil {
+		t.Fatalf("Failed to get token by pseudonym: %+v", err)
+	}
+	if bytes.Contains(stored.SealedToken, []byte("devicetoken")) {
+		t.Errorf("Sealed token contains the device token: %+v", stored)
+	}
+	u, err := s.GetUser(stored.TransmissionRSAHash)
+	if err != nil {
+		t.Fatalf("Failed to get user: %+v", err)
+	}
+	if !isSealed(u.TransmissionRSA) {
+		t.Errorf("Transmission RSA should be stored sealed")
+	}
+	identity, err := s.GetIdentity(iid)
+	if err != nil {
+		t.Fatalf("Failed to get identity: %+v", err)
+	}
+	if len(identity.Users) != 1 || !bytes.Equal(identity.Users[0].TransmissionRSA, pub) {
+		t.Errorf("Transmission RSA of identity users was not opened: %+v", identity.Users)
+	}
+
+	eid, _, _, err := ephemeral.GetIdFromIntermediary(iid, 16, time.Now().UnixNano())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.GetToNotify([]int64{eid.Int64()})
+	if err != nil || len(res) != 1 {
+		t.Fatalf("Failed to get tokens to notify: %+v, %+v", res, err)
+	}
+	opened, err := s.OpenToken(res[0])
+	if err != nil || opened.Token != "devicetoken" {
+		t.Errorf("Failed to open token to notify: %+v, %+v", opened, err)
+	}
+	res[0].SealedToken = nil
+	opened, err = s.OpenToken(res[0])
+	if err != nil || opened.Token != "devicetoken" {
+		t.Errorf("Failed to open token looked up by pseudonym: %+v, %+v", opened, err)
+	}
+
+	if err = s.SetTokenPriority("devicetoken", "app", stored.TransmissionRSAHash, "high"); err != nil {
+		t.Errorf("Failed to set priority by device token: %+v", err)
+	}
+	if err = s.UnregisterToken("devicetoken", pub); err != nil {
+		t.Fatalf("Failed to unregister token: %+v", err)
+	}
+	if _, err = s.GetToken(stored.Token, "app"); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("Token should be unregistered: %+v", err)
+	}
+}
+
+// Tests that tokens stored in the clear are moved under their pseudonym and
+// sealed, and that values sealed with an older key are re-sealed after a key
+// is added.
+func TestStorage_ReencryptTokens(t *testing.T) {
+	s, err := NewStorage("", "", "TestStorage_ReencryptTokens", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+	pub := []byte("rsacert")
+	if err = s.RegisterToken("primary", "app", pub); err != nil {
+		t.Fatalf("Failed to register token: %+v", err)
+	}
+	if err = s.RegisterFallbackToken("primary", "fallback", "app", pub); err != nil {
+		t.Fatalf("Failed to register fallback token: %+v", err)
+	}
+
+	lookup := bytes.Repeat([]byte{1}, TokenKeySize)
+	k1, k2 := bytes.Repeat([]byte{2}, TokenKeySize), bytes.Repeat([]byte{3}, TokenKeySize)
+	s.tokenKey, err = newTokenKey(lookup, map[uint8][]byte{1: k1})
+	if err != nil {
+		t.Fatalf("Failed to create token key: %+v", err)
+	}
+	rewritten, err := s.ReencryptTokens()
+	if err != nil {
+		t.Fatalf("Failed to re-encrypt tokens: %+v", err)
+	}
+	if rewritten != 3 {
+		t.Errorf("Expected %d rows rewritten, got %d", 3, rewritten)
+	}
+	if _, err = s.GetToken("primary", "app"); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("Plaintext token should have been moved: %+v", err)
+	}
+	primary, err := s.GetToken(s.storedToken("primary"), "app")
+	if err != nil {
+		t.Fatalf("Failed to get moved token: %+v", err)
+	}
+	if primary.Fallback != s.storedToken("fallback") {
+		t.Errorf("Fallback link was not moved: %+v", primary)
+	}
+
+	s.tokenKey, err = newTokenKey(lookup, map[uint8][]byte{1: k1, 2: k2})
+	if err != nil {
+		t.Fatalf("Failed to create token key: %+v", err)
+	}
+	if rewritten, err = s.ReencryptTokens(); err != nil || rewritten != 3 {
+		t.Fatalf("Failed to re-encrypt tokens after rotation: %d, %+v", rewritten, err)
+	}
+	primary, err = s.GetToken(s.storedToken("primary"), "app")
+	if err != nil {
+		t.Fatalf("Failed to get token: %+v", err)
+	}
+	if !s.tokenKey.isCurrent(primary.SealedToken) {
+		t.Errorf("Token was not sealed with the new key")
+	}
+	opened, err := s.OpenToken(GTNResult{Token: primary.Token, SealedToken: primary.SealedToken})
+	if err != nil || opened.Token != "primary" {
+		t.Errorf("Failed to open re-encrypted token: %+v, %+v", opened, err)
+	}
+	if rewritten, err = s.ReencryptTokens(); err != nil || rewritten != 0 {
+		t.Errorf("Re-encryption should be a no-op once complete: %d, %+v", rewritten, err)
+	}
+}
@@ -0,0 +1,88 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package storage
+
+import (
+	"encoding/base64"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gorm.io/gorm"
+)
+
+// TokenPolicy decides what happens to the registration of a user when their
+// token is registered by another user for the same app, as happens when the
+// app is reinstalled and creates a new identity on the same device.
+type TokenPolicy string
+
+const (
+	// LatestWins moves the token to the new user and stops tracking the
+	// previous user's identities once they have no tokens left, so the
+	// device is only pushed for the new identity
+	LatestWins TokenPolicy = "latestWins"
+	// MultiIdentity keeps the previous user's registration alongside the new
+	// one, so the device keeps being pushed for both identities
+	MultiIdentity TokenPolicy = "multiIdentity"
+)
+
+// Validate returns an error if the token policy is not recognised.
+func (p TokenPolicy) Validate() error {
+	switch p {
+	case "", LatestWins, MultiIdentity:
+		return nil
+	}
+	return errors.Errorf("unknown token policy %q, must be latestWins or multiIdentity", p)
+}
+
+// resolveSharedToken applies the token policy once t has been registered.
+// Unless the policy is MultiIdentity, registrations of t for its app held by
+// other users are removed, and the tracked identities of those users are
+// unlinked if they have no tokens left, as nothing can be pushed to them.
+// Registrations of t migrated from the original schema are removed whatever
+// the policy, as the signed registration replaces them.
+func (s *Storage) resolveSharedToken(tx database, t *Token) error {
+	previous, err := tx.removeLegacyV0Token(t)
+	if err != nil {
+		return errors.WithMessage(err, "Failed to remove legacy registrations of token")
+	}
+	if s.tokenPolicy != MultiIdentity {
+		moved, err := tx.moveToken(t)
+		if err != nil {
+			return errors.WithMessage(err, "Failed to move token")
+		}
+		previous = append(previous, moved...)
+	}
+	for _, p := range previous {
+		if err = unlinkOrphanedIdentities(tx, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unlinkOrphanedIdentities unlinks the tracked identities of the user with the
+// transmission RSA hash previous if it has no tokens left after its token was
+// moved to another user.
+func unlinkOrphanedIdentities(tx database, previous []byte) error {
+	prev, err := tx.GetUser(previous)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return errors.WithMessage(err, "Failed to retrieve previous user of token")
+	}
+	if len(prev.Identities) == 0 || len(prev.Tokens) > 0 {
+		return nil
+	}
+	jww.INFO.Printf("Token moved from user %s, unlinking their %d orphaned tracked identities",
+		base64.StdEncoding.EncodeToString(previous), len(prev.Identities))
+	err = tx.unregisterIdentities(prev, prev.Identities)
+	if err != nil {
+		return errors.WithMessage(err, "Failed to unlink identities of previous user of token")
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Tokens are keyed on the token, app and owner, so a device token keeps a
+// registration for each app and user it is registered for. Tokens and digest
+// entries tables keyed on fewer columns, as created by earlier releases, are
+// converted on startup.
+
+package storage
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	jww "github.com/spf13/jwalterweatherman"
+	"gorm.io/gorm"
+	"strings"
+)
+
+const unscopedTokensTable = "tokens_unscoped"
+
+// hasScopedTokens returns whether the tokens table is keyed on the token, app
+// and owner. It returns true if the table does not exist yet.
+func hasScopedTokens(db *gorm.DB) (bool, error) {
+	if !db.Migrator().HasTable(&Token{}) {
+		return true, nil
+	}
+	return keyedOnOwner(db, "tokens")
+}
+
+// hasScopedDigests returns whether the digest entries table is keyed on the
+// token, app and owner. It returns true if the table does not exist yet.
+func hasScopedDigests(db *gorm.DB) (bool, error) {
+	if !db.Migrator().HasTable(&DigestEntry{}) {
+		return true, nil
+	}
+	return keyedOnOwner(db, "digest_entries")
+}
+
+// keyedOnOwner returns whether the table is keyed on the token, app and owner.
+func keyedOnOwner(db *gorm.DB, table string) (bool, error) {
+	keys, err := primaryKey(db, table)
+	if err != nil {
+		return false, err
+	}
+	return keys["token"] && keys["app"] && keys["transmission_rsa_hash"], nil
+}
+
+// primaryKey returns the set of columns the table is keyed on. The sqlite
+// migrator misreads keys of more than two columns from the table's DDL, so
+// sqlite is asked for them directly.
+func primaryKey(db *gorm.DB, table string) (map[string]bool, error) {
+	keys := make(map[string]bool)
+	if db.Dialector.Name() == "sqlite" {
+		var columns []struct {
+			Name string
+			Pk   int
+		}
+		if err := db.Raw("PRAGMA table_info(" + table + ")").Scan(&columns).Error; err != nil {
+			return nil, errors.WithMessagef(err, "Failed to get columns of %s", table)
+		}
+		for _, c := range columns {
+			keys[c.Name] = c.Pk > 0
+		}
+		return keys, nil
+	}
+	columns, err := db.Migrator().ColumnTypes(table)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "Failed to get columns of %s", table)
+	}
+	for _, c := range columns {
+		keys[c.Name()], _ = c.PrimaryKey()
+	}
+	return keys, nil
+}
+
+// scopeTokens converts a tokens table keyed on the token alone, or on the
+// token and app, into one keyed on the token, app and owner. Tables created
+// before tokens had a primary key may hold duplicates; the registration with
+// the highest version is kept.
+func scopeTokens(db *gorm.DB) error {
+	scoped, err := hasScopedTokens(db)
+	if err != nil || scoped {
+		return err
+	}
+	jww.INFO.Printf("Converting tokens table to be keyed on token, app and owner")
+	return db.Transaction(convertTokens)
+}
+
+// convertTokens replaces the tokens table with one keyed on the token, app and
+// owner holding the same rows. Rows without an app are kept under an empty app.
+func convertTokens(tx *gorm.DB) error {
+	m := tx.Migrator()
+	statements := []string{
+		"ALTER TABLE tokens RENAME TO " + unscopedTokensTable,
+		"DROP INDEX IF EXISTS idx_tokens_deleted_at",
+	}
+	if tx.Dialector.Name() == "postgres" {
+		// Postgres names the key after the table it was created for
+		statements = append(statements,
+			"ALTER TABLE "+unscopedTokensTable+" DROP CONSTRAINT IF EXISTS tokens_pkey")
+	}
+	for _, s := range statements {
+		if err := tx.Exec(s).Error; err != nil {
+			return errors.WithMessagef(err, "Failed to execute %q", s)
+		}
+	}
+	if err := m.CreateTable(&Token{}); err != nil {
+		return errors.WithMessage(err, "Failed to create tokens table")
+	}
+
+	// Copy the columns the old table has, which may predate some of the model
+	old, err := m.ColumnTypes(unscopedTokensTable)
+	if err != nil {
+		return errors.WithMessage(err, "Failed to get columns of old tokens table")
+	}
+	var columns, values []string
+	order := ""
+	for _, c := range old {
+		name := c.Name()
+		if !m.HasColumn(&Token{}, name) {
+			continue
+		}
+		columns = append(columns, name)
+		switch name {
+		case "app":
+			values = append(values, "COALESCE(app, '')")
+		case "version":
+			order = " ORDER BY version DESC"
+			values = append(values, name)
+		default:
+			values = append(values, name)
+		}
+	}
+	// WHERE true lets sqlite tell the ON CONFLICT clause from a join
+	res := tx.Exec(fmt.Sprintf("INSERT INTO tokens (%s) SELECT %s FROM %s WHERE true%s ON CONFLICT DO NOTHING",
+		strings.Join(columns, ", "), strings.Join(values, ", "), unscopedTokensTable, order))
+	if res.Error != nil {
+		return errors.WithMessage(res.Error, "Failed to copy existing tokens")
+	}
+	var total int64
+	if err = tx.Table(unscopedTokensTable).Count(&total).Error; err != nil {
+		return errors.WithMessage(err, "Failed to count existing tokens")
+	}
+	if dropped := total - res.RowsAffected; dropped > 0 {
+		jww.WARN.Printf("Dropped %d duplicate token registrations while converting tokens table", dropped)
+	}
+	return tx.Exec("DROP TABLE " + unscopedTokensTable).Error
+}
+
+// scopeDigests converts a digest entries table keyed on the token alone into
+// one keyed on the token, app and owner. The app and owner of held entries are
+// taken from their targets.
+func scopeDigests(db *gorm.DB) error {
+	scoped, err := hasScopedDigests(db)
+	if err != nil || scoped {
+		return err
+	}
+	jww.INFO.Printf("Converting digest entries table to be keyed on token, app and owner")
+	return db.Transaction(func(tx *gorm.DB) error {
+		var entries []*DigestEntry
+		err := tx.Table("digest_entries").Select("token", "target", "count", "held_since").Find(&entries).Error
+		if err != nil {
+			return errors.WithMessage(err, "Failed to get held digest entries")
+		}
+		if err = tx.Migrator().DropTable(&DigestEntry{}); err != nil {
+			return errors.WithMessage(err, "Failed to drop digest entries table")
+		}
+		if err = tx.Migrator().CreateTable(&DigestEntry{}); err != nil {
+			return errors.WithMessage(err, "Failed to create digest entries table")
+		}
+		for _, e := range entries {
+			e.App = e.Target.App
+			e.TransmissionRsaHash = e.Target.TransmissionRSAHash
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+		return errors.WithMessage(tx.Create(&entries).Error, "Failed to copy held digest entries")
+	})
+}
@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"strings"
+	"testing"
+)
+
+// Tests that a token registered for several apps keeps a registration for
+// each of them.
+func TestStorage_RegisterToken_PerApp(t *testing.T) {
+	s, err := NewStorage("", "", "TestStorage_RegisterToken_PerApp", "", "")
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+	for _, app := range []string{"messengerAndroid", "otherAndroid"} {
+		if err = s.RegisterToken("token", app, []byte("trsa")); err != nil {
+			t.Fatalf("Failed to register token for %s: %+v", app, err)
+		}
+	}
+	for _, app := range []string{"messengerAndroid", "otherAndroid"} {
+		if _, err = s.GetToken("token", app); err != nil {
+			t.Errorf("Token should be registered for %s: %+v", app, err)
+		}
+	}
+
+	if err = s.DeleteToken("token", "messengerAndroid"); err != nil {
+		t.Fatalf("Failed to delete token: %+v", err)
+	}
+	if _, err = s.GetToken("token", "messengerAndroid"); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("Token should have been deleted from its app, got %+v", err)
+	}
+	if _, err = s.GetToken("token", "otherAndroid"); err != nil {
+		t.Errorf("Token should still be registered for its other app: %+v", err)
+	}
+}
+
+// Tests that two users registering the same token for an app each keep their
+// registration, and that unregistering it from one leaves the other's.
+func TestStorage_RegisterToken_PerOwner(t *testing.T) {
+	s, err := NewStorageFromParams(Params{DBName: "TestStorage_RegisterToken_PerOwner", TokenPolicy: MultiIdentity})
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+	owners := [][]byte{[]byte("trsa1"), []byte("trsa2")}
+	for _, owner := range owners {
+		if err = s.RegisterToken("token", "app", owner); err != nil {
+			t.Fatalf("Failed to register token: %+v", err)
+		}
+	}
+	if err = s.RegisterToken("token", "app", owners[0]); err != nil {
+		t.Fatalf("Failed to re-register token: %+v", err)
+	}
+	for i, owner := range owners {
+		h, err := getHash(owner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := s.GetUser(h)
+		if err != nil {
+			t.Fatalf("Failed to get user: %+v", err)
+		}
+		if len(u.Tokens) != 1 || u.Tokens[0].Version != uint64(2-i) {
+			t.Errorf("Expected user %d to keep its registration at version %d: %+v", i, 2-i, u.Tokens)
+		}
+	}
+	h0, err := getHash(owners[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SetTokenPrivacy("token", "app", h0, "minimal"); err != nil {
+		t.Fatalf("Failed to set token privacy: %+v", err)
+	}
+	for i, owner := range owners {
+		h, err := getHash(owner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := s.GetUser(h)
+		if err != nil || len(u.Tokens) != 1 {
+			t.Fatalf("Failed to get user: %+v, %+v", u, err)
+		}
+		if expected := map[int]string{0: "minimal"}[i]; u.Tokens[0].Privacy != expected {
+			t.Errorf("Expected user %d's token privacy %q, got %q", i, expected, u.Tokens[0].Privacy)
+		}
+	}
+	if token, err := s.GetOwnedToken("token", "app", h0); err != nil || token.Privacy != "minimal" {
+		t.Errorf("Expected user 0's registration, got %+v: %+v", token, err)
+	}
+	if _, err = s.GetOwnedToken("token", "app", []byte("unknown")); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("Token should not be registered for an unknown user, got %+v", err)
+	}
+	if count, err := s.CountActiveTokens("app"); err != nil || count != 1 {
+		t.Errorf("Expected the shared token to be counted once, got %d: %+v", count, err)
+	}
+
+	if err = s.UnregisterToken("token", owners[0]); err != nil {
+		t.Fatalf("Failed to unregister token: %+v", err)
+	}
+	h, err := getHash(owners[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := s.GetUser(h)
+	if err != nil || len(u.Tokens) != 1 {
+		t.Errorf("Other user's registration should be kept: %+v, %+v", u, err)
+	}
+}
+
+// Tests that a tokens table keyed on the token alone is converted, keeping the
+// latest of duplicate registrations and rows without an app.
+func TestScopeTokens(t *testing.T) {
+	db, err := newDatabase("", "", "TestScopeTokens", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := db.(*DatabaseImpl)
+	if err = d.insertUser(&User{TransmissionRSAHash: []byte("hash"), TransmissionRSA: []byte("rsa")}); err != nil {
+		t.Fatal(err)
+	}
+	// Tables created by early releases may lack a primary key altogether
+	for _, s := range []string{
+		"DROP TABLE tokens",
+		"CREATE TABLE tokens (token text, app text, transmission_rsa_hash blob NOT NULL, " +
+			"version integer NOT NULL DEFAULT 1, deleted_at datetime)",
+		"CREATE INDEX idx_tokens_deleted_at ON tokens (deleted_at)",
+		"INSERT INTO tokens (token, app, transmission_rsa_hash, version) VALUES " +
+			"('dup', 'app', x'68617368', 1), ('dup', 'app', x'68617368', 2), ('noapp', NULL, x'68617368', 1)",
+	} {
+		if err = d.db.Exec(s).Error; err != nil {
+			t.Fatalf("Failed to execute %q: %+v", s, err)
+		}
+	}
+	err = db.CheckSchema()
+	if err == nil || !strings.Contains(err.Error(), "tokens is not keyed on token, app and owner") {
+		t.Errorf("Unscoped tokens should be reported, got %+v", err)
+	}
+
+	if err = scopeTokens(d.db); err != nil {
+		t.Fatalf("Failed to convert tokens table: %+v", err)
+	}
+	if err = db.CheckSchema(); err != nil {
+		t.Errorf("Converted schema should pass the check: %+v", err)
+	}
+	token, err := db.GetToken("dup", "app")
+	if err != nil || token.Version != 2 {
+		t.Errorf("Expected the latest duplicate to be kept, got %+v: %+v", token, err)
+	}
+	if _, err = db.GetToken("noapp", ""); err != nil {
+		t.Errorf("Token without an app should be kept: %+v", err)
+	}
+	if err = db.upsertToken(&Token{Token: "noapp", App: "app", TransmissionRSAHash: []byte("hash")}); err != nil {
+		t.Fatalf("Failed to register token for another app: %+v", err)
+	}
+	if _, err = db.GetToken("noapp", ""); err != nil {
+		t.Errorf("Registering a token for another app should keep its registration: %+v", err)
+	}
+}
+
+// Tests that a digest entries table keyed on the token alone is converted,
+// keeping held entries under the app and owner of their targets.
+func TestScopeDigests(t *testing.T) {
+	db, err := newDatabase("", "", "TestScopeDigests", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := db.(*DatabaseImpl)
+	for _, s := range []string{
+		"DROP TABLE digest_entries",
+		"CREATE TABLE digest_entries (token text, target text NOT NULL, count integer NOT NULL, " +
+			"held_since datetime NOT NULL, PRIMARY KEY (token))",
+		`INSERT INTO digest_entries (token, target, count, held_since) VALUES ` +
+			`('token', '{"Token":"token","App":"app","TransmissionRSAHash":"aGFzaA=="}', 4, CURRENT_TIMESTAMP)`,
+	} {
+		if err = d.db.Exec(s).Error; err != nil {
+			t.Fatalf("Failed to execute %q: %+v", s, err)
+		}
+	}
+	err = db.CheckSchema()
+	if err == nil || !strings.Contains(err.Error(), "digest_entries is not keyed on token, app and owner") {
+		t.Errorf("Unscoped digest entries should be reported, got %+v", err)
+	}
+
+	if err = scopeDigests(d.db); err != nil {
+		t.Fatalf("Failed to convert digest entries table: %+v", err)
+	}
+	if err = db.CheckSchema(); err != nil {
+		t.Errorf("Converted schema should pass the check: %+v", err)
+	}
+	entries, err := db.TakeDigests()
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Expected the held entry to be kept, got %+v: %+v", entries, err)
+	}
+	if entries[0].App != "app" || string(entries[0].TransmissionRsaHash) != "hash" || entries[0].Count != 4 {
+		t.Errorf("Unexpected converted entry: %+v", entries[0])
+	}
+}
@@ -0,0 +1,65 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package testutil
+
+import (
+	"gitlab.com/xx_network/comms/connect"
+	"gitlab.com/xx_network/primitives/id"
+	"sync"
+	"testing"
+)
+
+// Comms is a NotificationComms test double holding hosts without starting a
+// server or connecting to them.
+type Comms struct {
+	hosts map[id.ID]*connect.Host
+	mux   sync.RWMutex
+}
+
+// NewComms returns a Comms with no hosts.
+func NewComms() *Comms {
+	return &Comms{hosts: make(map[id.ID]*connect.Host)}
+}
+
+// NewPermissioningComms returns a Comms holding a permissioning host with the
+// permissioning fixture certificate, so registration signatures made with
+// LoadPermissioningKey verify.
+func NewPermissioningComms(t testing.TB) *Comms {
+	t.Helper()
+	c := NewComms()
+	c.AddHost(t, &id.Permissioning, ReadFile(t, PermissioningCert))
+	return c
+}
+
+// AddHost adds a host with the passed in ID and certificate.
+func (c *Comms) AddHost(t testing.TB, hostID *id.ID, cert []byte) *connect.Host {
+	t.Helper()
+	h, err := connect.NewHost(hostID, "0.0.0.0:0", cert, connect.GetDefaultHostParams())
+	if err != nil {
+		t.Fatalf("Failed to create host %s: %+v", hostID, err)
+	}
+	c.mux.Lock()
+	c.hosts[*hostID] = h
+	c.mux.Unlock()
+	return h
+}
+
+// RemoveHost removes the host with the passed in ID.
+func (c *Comms) RemoveHost(hostID *id.ID) {
+	c.mux.Lock()
+	delete(c.hosts, *hostID)
+	c.mux.Unlock()
+}
+
+// GetHost returns the host with the passed in ID.
+func (c *Comms) GetHost(hostID *id.ID) (*connect.Host, bool) {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	h, ok := c.hosts[*hostID]
+	return h, ok
+}
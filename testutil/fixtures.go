@@ -0,0 +1,121 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package testutil
+
+import (
+	pb "gitlab.com/elixxir/comms/mixmessages"
+	"gitlab.com/elixxir/crypto/notifications"
+	"gitlab.com/elixxir/crypto/registration"
+	"gitlab.com/elixxir/crypto/rsa"
+	"gitlab.com/elixxir/notifications-bot/client"
+	"gitlab.com/xx_network/crypto/csprng"
+	"testing"
+	"time"
+)
+
+// clientKeySize is the size of generated client keys; smaller than in
+// production so tests run quickly.
+const clientKeySize = 2048
+
+// NotificationBatch returns a batch for the round with a notification for
+// each passed in ephemeral ID.
+func NotificationBatch(round uint64, ephemeralIDs ...int64) *pb.NotificationBatch {
+	batch := &pb.NotificationBatch{RoundID: round}
+	for _, eid := range ephemeralIDs {
+		batch.Notifications = append(batch.Notifications, &pb.NotificationData{
+			EphemeralID: eid,
+			IdentityFP:  []byte("IdentityFP"),
+			MessageHash: []byte("MessageHash"),
+		})
+	}
+	return batch
+}
+
+// Client is a client identity with a transmission RSA key signed by the
+// permissioning fixture key.
+type Client struct {
+	Key                         rsa.PrivateKey
+	TransmissionRsaPem          []byte
+	RegistrationTimestamp       int64
+	TransmissionRsaRegistrarSig []byte
+}
+
+// NewClient generates a client key and signs it with the permissioning
+// fixture key.
+func NewClient(t testing.TB) *Client {
+	t.Helper()
+	rng := csprng.NewSystemRNG()
+	key, err := rsa.GetScheme().Generate(rng, clientKeySize)
+	if err != nil {
+		t.Fatalf("Failed to generate client key: %+v", err)
+	}
+	c := &Client{
+		Key:                   key,
+		TransmissionRsaPem:    key.Public().MarshalPem(),
+		RegistrationTimestamp: time.Now().UnixNano(),
+	}
+	c.TransmissionRsaRegistrarSig, err = registration.SignWithTimestamp(rng, LoadPermissioningKey(t),
+		c.RegistrationTimestamp, string(c.TransmissionRsaPem))
+	if err != nil {
+		t.Fatalf("Failed to sign client key: %+v", err)
+	}
+	return c
+}
+
+// identity returns the client as a client package identity.
+func (c *Client) identity() client.Identity {
+	return client.Identity{
+		Key:                         c.Key,
+		RegistrationTimestamp:       c.RegistrationTimestamp,
+		TransmissionRsaRegistrarSig: c.TransmissionRsaRegistrarSig,
+	}
+}
+
+// RegisterTokenRequest returns a request by the client to register the token
+// for the app, signed at the passed in time.
+func (c *Client) RegisterTokenRequest(t testing.TB, token, app string, at time.Time) *pb.RegisterTokenRequest {
+	t.Helper()
+	req, err := c.identity().RegisterTokenRequest(token, app, at)
+	if err != nil {
+		t.Fatalf("Failed to build request: %+v", err)
+	}
+	return req
+}
+
+// RegisterTrackedIDRequest returns a request by the client to track the passed
+// in intermediary IDs, signed at the passed in time.
+func (c *Client) RegisterTrackedIDRequest(t testing.TB, iids [][]byte, at time.Time) *pb.RegisterTrackedIdRequest {
+	t.Helper()
+	req, err := c.identity().RegisterTrackedIDRequest(iids, at)
+	if err != nil {
+		t.Fatalf("Failed to build request: %+v", err)
+	}
+	return req
+}
+
+// UnregisterTokenRequest returns a request by the client to unregister the
+// token of the app, signed at the passed in time.
+func (c *Client) UnregisterTokenRequest(t testing.TB, token, app string, at time.Time) *pb.UnregisterTokenRequest {
+	t.Helper()
+	req, err := c.identity().UnregisterTokenRequest(token, app, at)
+	if err != nil {
+		t.Fatalf("Failed to build request: %+v", err)
+	}
+	return req
+}
+
+// SignAccountRequest returns the client's signature of an account request with
+// the passed in tag, signed at the passed in time.
+func (c *Client) SignAccountRequest(t testing.TB, tag notifications.NotificationTag, at time.Time) []byte {
+	t.Helper()
+	sig, err := notifications.SignIdentity(c.Key, [][]byte{c.TransmissionRsaPem}, at, tag, csprng.NewSystemRNG())
+	if err != nil {
+		t.Fatalf("Failed to sign account request: %+v", err)
+	}
+	return sig
+}
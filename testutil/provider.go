@@ -0,0 +1,75 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+package testutil
+
+import (
+	"context"
+	"gitlab.com/elixxir/notifications-bot/notifications/providers"
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"sync"
+	"time"
+)
+
+// Result is the outcome of a send through a Provider.
+type Result struct {
+	Receipt providers.Receipt
+	// Invalid reports the target's token as no longer valid
+	Invalid bool
+	Err     error
+}
+
+// Send records a push made through a Provider.
+type Send struct {
+	CSV    string
+	Target storage.GTNResult
+}
+
+// Provider is a providers.Provider test double which records its sends and
+// returns scripted results. Once the scripted results run out, sends succeed.
+type Provider struct {
+	// Delay is waited before each send completes, unless the send's context
+	// is done first
+	Delay time.Duration
+
+	results []Result
+	sends   []Send
+	mux     sync.Mutex
+}
+
+// NewProvider returns a Provider returning the passed in results in order.
+func NewProvider(results ...Result) *Provider {
+	return &Provider{results: results}
+}
+
+// Notify records the send and returns the next scripted result.
+func (p *Provider) Notify(ctx context.Context, csv string, target storage.GTNResult) (providers.Receipt, bool, error) {
+	if p.Delay > 0 {
+		select {
+		case <-time.After(p.Delay):
+		case <-ctx.Done():
+			return providers.Receipt{}, true, ctx.Err()
+		}
+	}
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.sends = append(p.sends, Send{CSV: csv, Target: target})
+	if len(p.results) == 0 {
+		return providers.Receipt{}, true, nil
+	}
+	r := p.results[0]
+	p.results = p.results[1:]
+	return r.Receipt, !r.Invalid, r.Err
+}
+
+// Sends returns a copy of the sends made so far.
+func (p *Provider) Sends() []Send {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	return append([]Send(nil), p.sends...)
+}
@@ -0,0 +1,66 @@
+////////////////////////////////////////////////////////////////////////////////
+// Copyright © 2022 xx foundation                                             //
+//                                                                            //
+// Use of this source code is governed by a license that can be found in the  //
+// LICENSE file.                                                              //
+////////////////////////////////////////////////////////////////////////////////
+
+// Package testutil holds the fixtures and test doubles shared by the bot's
+// tests: storage, comms and provider doubles, and signed requests.
+package testutil
+
+import (
+	"gitlab.com/elixxir/notifications-bot/storage"
+	"gitlab.com/xx_network/crypto/signature/rsa"
+	"gitlab.com/xx_network/primitives/utils"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// Names of the fixture files in this directory.
+const (
+	// PermissioningCert and PermissioningKey are the certificate and key used
+	// as the permissioning server's
+	PermissioningCert = "cmix.rip.crt"
+	PermissioningKey  = "cmix.rip.key"
+)
+
+// Path returns the path of the named fixture file, wherever the test runs.
+func Path(name string) string {
+	_, file, _, _ := runtime.Caller(0)
+	return filepath.Join(filepath.Dir(file), name)
+}
+
+// ReadFile returns the contents of the named fixture file, failing the test if
+// it cannot be read.
+func ReadFile(t testing.TB, name string) []byte {
+	t.Helper()
+	data, err := utils.ReadFile(Path(name))
+	if err != nil {
+		t.Fatalf("Failed to read fixture %s: %+v", name, err)
+	}
+	return data
+}
+
+// LoadPermissioningKey returns the private key of the permissioning fixture.
+func LoadPermissioningKey(t testing.TB) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.LoadPrivateKeyFromPem(ReadFile(t, PermissioningKey))
+	if err != nil {
+		t.Fatalf("Failed to load permissioning key: %+v", err)
+	}
+	return key
+}
+
+// NewStorage returns an in-memory storage private to the test, so tests do not
+// see each other's registrations.
+func NewStorage(t testing.TB) *storage.Storage {
+	t.Helper()
+	s, err := storage.NewStorage("", "", strings.ReplaceAll(t.Name(), "/", "_"), "", "")
+	if err != nil {
+		t.Fatalf("Failed to create storage: %+v", err)
+	}
+	return s
+}